@@ -75,10 +75,13 @@ do
       # one directory.
       rm -fR ./releases/tmp
       mkdir -p ./releases/tmp/templ
+      mkdir -p ./releases/tmp/i18n
 
       # Copy templates and database initialization files
       cp ./server/tinode.conf ./releases/tmp
+      cp ./server/client-config.json ./releases/tmp
       cp ./server/templ/*.templ ./releases/tmp/templ
+      cp ./server/i18n/*.json ./releases/tmp/i18n
       cp ./tinode-db/data.json ./releases/tmp
       cp ./tinode-db/*.jpg ./releases/tmp
       cp ./tinode-db/credentials.sh ./releases/tmp
@@ -0,0 +1,57 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *    Grants of readers: the core server checks the reader's access to the
+ *    channel and issues a short-lived grant signed with the key shared with
+ *    the relays. The relay attaches the reader to the channel only with a
+ *    valid grant.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Maximum lifetime of a grant. Revocations are kept for this long.
+	grantMaxTTL = time.Hour
+	// Length of the truncated HMAC signature of a grant, bytes.
+	grantSigLength = 16
+)
+
+// grantSign computes the signature of the grant the same way the core server does.
+func grantSign(key []byte, uid, topic string, issued, expires int64) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(uid + "/" + topic + "/" + strconv.FormatInt(issued, 10) + "/" + strconv.FormatInt(expires, 10)))
+	return mac.Sum(nil)[:grantSigLength]
+}
+
+// grantValid checks the grant "<issued>.<expires>.<signature>" of the user to read the channel.
+// Returns the time when the grant was issued.
+func grantValid(key []byte, uid, topic, grant string, now time.Time) (time.Time, bool) {
+	parts := strings.Split(grant, ".")
+	if len(key) == 0 || len(parts) != 3 {
+		return time.Time{}, false
+	}
+	issued, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	expires, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || expires <= now.Unix() || expires < issued || expires-issued > int64(grantMaxTTL/time.Second) {
+		return time.Time{}, false
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || !hmac.Equal(sig, grantSign(key, uid, topic, issued, expires)) {
+		return time.Time{}, false
+	}
+	return time.Unix(issued, 0), true
+}
@@ -0,0 +1,412 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *    Relay hub: keeps track of channels and their readers, subscribes to a
+ *    channel upstream when the first reader joins it and leaves it when the
+ *    last reader is gone. Messages of the channel are serialized once and
+ *    queued to every reader. Readers who lose access to the channel are
+ *    dropped and their grants issued before that are refused.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/tinode/chat/pbx"
+)
+
+// readerReq is a request of a reader to join or to leave a channel.
+type readerReq struct {
+	rdr   *reader
+	id    string
+	topic string
+	// Time when the grant to read the channel was issued.
+	issued time.Time
+}
+
+// channel is a channel relayed to local readers.
+type channel struct {
+	// Readers receiving messages of the channel.
+	readers map[*reader]bool
+	// Readers waiting for the upstream subscription.
+	pending []*readerReq
+	// The channel is subscribed upstream.
+	subscribed bool
+	// ID of the outstanding upstream {sub} request.
+	subId string
+}
+
+// dataMsg is a {data} message forwarded to readers.
+type dataMsg struct {
+	Data struct {
+		Topic     string                     `json:"topic"`
+		From      string                     `json:"from,omitempty"`
+		Timestamp time.Time                  `json:"ts"`
+		SeqId     int                        `json:"seq"`
+		Head      map[string]json.RawMessage `json:"head,omitempty"`
+		Content   json.RawMessage            `json:"content"`
+	} `json:"data"`
+}
+
+// presMsg is a {pres} message forwarded to readers.
+type presMsg struct {
+	Pres struct {
+		Topic string `json:"topic"`
+		What  string `json:"what"`
+	} `json:"pres"`
+}
+
+type relayHub struct {
+	channels map[string]*channel
+	// Channels joined by each reader.
+	byReader map[*reader]map[string]bool
+	// Topic names of outstanding upstream {sub} requests by request ID.
+	subs  map[string]string
+	subId int
+	// Times when access to channels was revoked, by channel and user ID. The empty user ID stands
+	// for all grants of the channel.
+	revoked map[string]map[string]time.Time
+
+	// Current upstream connection, nil while disconnected.
+	conn *upstreamConn
+
+	join  chan *readerReq
+	leave chan *readerReq
+	unreg chan *reader
+
+	// Upstream connection is established or lost.
+	upConn chan *upstreamConn
+	upLost chan *upstreamConn
+	// Messages received from upstream.
+	upMsg chan *pbx.ServerMsg
+}
+
+func newRelayHub() *relayHub {
+	return &relayHub{
+		channels: make(map[string]*channel),
+		byReader: make(map[*reader]map[string]bool),
+		subs:     make(map[string]string),
+		revoked:  make(map[string]map[string]time.Time),
+		join:     make(chan *readerReq, 256),
+		leave:    make(chan *readerReq, 256),
+		unreg:    make(chan *reader, 256),
+		upConn:   make(chan *upstreamConn),
+		upLost:   make(chan *upstreamConn),
+		upMsg:    make(chan *pbx.ServerMsg, 1024),
+	}
+}
+
+func (h *relayHub) run() {
+	// Revocations are forgotten when all grants issued before them have expired.
+	prune := time.NewTicker(time.Minute)
+	defer prune.Stop()
+
+	for {
+		select {
+		case req := <-h.join:
+			h.handleJoin(req)
+
+		case req := <-h.leave:
+			h.removeReader(req.rdr, req.topic)
+			req.rdr.reply(req.id, req.topic, http.StatusOK, "ok", nil)
+
+		case rdr := <-h.unreg:
+			for topic := range h.byReader[rdr] {
+				h.removeReader(rdr, topic)
+			}
+			delete(h.byReader, rdr)
+
+		case conn := <-h.upConn:
+			h.conn = conn
+			// Subscribe again to all channels with readers.
+			for topic, ch := range h.channels {
+				ch.subscribed = false
+				h.subscribe(topic, ch)
+			}
+
+		case conn := <-h.upLost:
+			if conn != h.conn {
+				continue
+			}
+			h.conn = nil
+			h.subs = make(map[string]string)
+			for _, ch := range h.channels {
+				ch.subscribed = false
+				ch.subId = ""
+			}
+
+		case msg := <-h.upMsg:
+			h.handleUpstream(msg)
+
+		case now := <-prune.C:
+			for topic, users := range h.revoked {
+				for uid, at := range users {
+					if now.Sub(at) > grantMaxTTL {
+						delete(users, uid)
+					}
+				}
+				if len(users) == 0 {
+					delete(h.revoked, topic)
+				}
+			}
+		}
+	}
+}
+
+func (h *relayHub) handleJoin(req *readerReq) {
+	if h.isRevoked(req.topic, req.rdr.uid, req.issued) {
+		req.rdr.reply(req.id, req.topic, http.StatusForbidden, "permission denied", nil)
+		return
+	}
+
+	ch := h.channels[req.topic]
+	if ch == nil {
+		ch = &channel{readers: make(map[*reader]bool)}
+		h.channels[req.topic] = ch
+	}
+
+	topics := h.byReader[req.rdr]
+	if topics == nil {
+		topics = make(map[string]bool)
+		h.byReader[req.rdr] = topics
+	}
+	if topics[req.topic] {
+		req.rdr.reply(req.id, req.topic, http.StatusNotModified, "already subscribed", nil)
+		return
+	}
+	topics[req.topic] = true
+
+	if ch.subscribed {
+		ch.readers[req.rdr] = true
+		req.rdr.reply(req.id, req.topic, http.StatusOK, "ok", nil)
+		return
+	}
+
+	ch.pending = append(ch.pending, req)
+	if ch.subId == "" {
+		h.subscribe(req.topic, ch)
+	}
+}
+
+// removeReader detaches the reader from the channel. The channel is left upstream when it has no readers.
+func (h *relayHub) removeReader(rdr *reader, topic string) {
+	if topics := h.byReader[rdr]; topics != nil {
+		delete(topics, topic)
+	}
+
+	ch := h.channels[topic]
+	if ch == nil {
+		return
+	}
+	delete(ch.readers, rdr)
+	for i, req := range ch.pending {
+		if req.rdr == rdr {
+			ch.pending = append(ch.pending[:i], ch.pending[i+1:]...)
+			break
+		}
+	}
+	if len(ch.readers) > 0 || len(ch.pending) > 0 {
+		return
+	}
+
+	if ch.subscribed && h.conn != nil {
+		h.conn.send(&pbx.ClientMsg{Message: &pbx.ClientMsg_Leave{Leave: &pbx.ClientLeave{Topic: topic}}})
+	}
+	delete(h.channels, topic)
+}
+
+// subscribe sends {sub} for the channel upstream if connected.
+func (h *relayHub) subscribe(topic string, ch *channel) {
+	if h.conn == nil {
+		ch.subId = ""
+		return
+	}
+	h.subId++
+	ch.subId = strconv.Itoa(h.subId)
+	h.subs[ch.subId] = topic
+	h.conn.send(&pbx.ClientMsg{Message: &pbx.ClientMsg_Sub{Sub: &pbx.ClientSub{Id: ch.subId, Topic: topic}}})
+}
+
+func (h *relayHub) handleUpstream(msg *pbx.ServerMsg) {
+	switch m := msg.Message.(type) {
+	case *pbx.ServerMsg_Ctrl:
+		h.handleSubReply(m.Ctrl)
+	case *pbx.ServerMsg_Data:
+		h.handleData(m.Data)
+	case *pbx.ServerMsg_Pres:
+		switch m.Pres.What {
+		case pbx.ServerPres_ACS:
+			// The core server tells the relay accounts that the user may no longer read the channel.
+			if m.Pres.Src != "" && m.Pres.Acs != nil && m.Pres.Acs.Given == "N" {
+				h.revokeReader(m.Pres.Topic, m.Pres.Src)
+			}
+		case pbx.ServerPres_TERM, pbx.ServerPres_GONE:
+			// Access of the readers may have changed while the channel was not available:
+			// they must get new grants from the core server.
+			h.revoke(m.Pres.Topic, "", time.Now().Truncate(time.Second))
+			h.dropChannel(m.Pres.Topic, func(rdr *reader, id string) {
+				var pres presMsg
+				pres.Pres.Topic = m.Pres.Topic
+				pres.Pres.What = "term"
+				out, _ := json.Marshal(&pres)
+				rdr.queueOut(out)
+			})
+		}
+	}
+}
+
+// revoke records the time when access of the user (or of everyone if uid is empty) to the channel was revoked.
+func (h *relayHub) revoke(topic, uid string, at time.Time) {
+	users := h.revoked[topic]
+	if users == nil {
+		users = make(map[string]time.Time)
+		h.revoked[topic] = users
+	}
+	users[uid] = at
+}
+
+// isRevoked checks if the grant of the user issued at the given time was revoked.
+func (h *relayHub) isRevoked(topic, uid string, issued time.Time) bool {
+	users := h.revoked[topic]
+	if users == nil {
+		return false
+	}
+	if at, ok := users[uid]; ok && !issued.After(at) {
+		return true
+	}
+	at, ok := users[""]
+	return ok && issued.Before(at)
+}
+
+// revokeReader detaches all readers of the user from the channel and refuses the user's current grants.
+func (h *relayHub) revokeReader(topic, uid string) {
+	h.revoke(topic, uid, time.Now())
+
+	ch := h.channels[topic]
+	if ch == nil {
+		return
+	}
+	var evicted []*reader
+	for rdr := range ch.readers {
+		if rdr.uid == uid {
+			evicted = append(evicted, rdr)
+		}
+	}
+	var refused []*readerReq
+	for _, req := range ch.pending {
+		if req.rdr.uid == uid {
+			refused = append(refused, req)
+		}
+	}
+
+	for _, rdr := range evicted {
+		h.removeReader(rdr, topic)
+		rdr.reply("", topic, http.StatusResetContent, "evicted", nil)
+	}
+	for _, req := range refused {
+		h.removeReader(req.rdr, topic)
+		req.rdr.reply(req.id, topic, http.StatusForbidden, "permission denied", nil)
+	}
+}
+
+// handleSubReply processes the response to an upstream {sub}.
+func (h *relayHub) handleSubReply(ctrl *pbx.ServerCtrl) {
+	topic, ok := h.subs[ctrl.Id]
+	if !ok {
+		return
+	}
+	delete(h.subs, ctrl.Id)
+
+	ok = ctrl.Code < http.StatusMultipleChoices || ctrl.Code == http.StatusNotModified
+	ch := h.channels[topic]
+	if ch == nil {
+		// All readers left while the request was in flight.
+		if ok && h.conn != nil {
+			h.conn.send(&pbx.ClientMsg{Message: &pbx.ClientMsg_Leave{Leave: &pbx.ClientLeave{Topic: topic}}})
+		}
+		return
+	}
+	if ch.subId != ctrl.Id {
+		return
+	}
+	ch.subId = ""
+
+	if !ok {
+		log.Println("relay: failed to subscribe to", topic, ctrl.Code, ctrl.Text)
+		h.dropChannel(topic, func(rdr *reader, id string) {
+			rdr.reply(id, topic, int(ctrl.Code), ctrl.Text, nil)
+		})
+		return
+	}
+
+	ch.subscribed = true
+	for _, req := range ch.pending {
+		ch.readers[req.rdr] = true
+		req.rdr.reply(req.id, topic, http.StatusOK, "ok", nil)
+	}
+	ch.pending = nil
+}
+
+// handleData forwards a message of the channel to its readers.
+func (h *relayHub) handleData(data *pbx.ServerData) {
+	ch := h.channels[data.Topic]
+	if ch == nil || !ch.subscribed || len(ch.readers) == 0 {
+		return
+	}
+
+	var msg dataMsg
+	msg.Data.Topic = data.Topic
+	msg.Data.From = data.FromUserId
+	msg.Data.Timestamp = time.Unix(0, data.Timestamp*int64(time.Millisecond)).UTC()
+	msg.Data.SeqId = int(data.SeqId)
+	if len(data.Head) > 0 {
+		msg.Data.Head = make(map[string]json.RawMessage, len(data.Head))
+		for key, val := range data.Head {
+			msg.Data.Head[key] = val
+		}
+	}
+	if len(data.Content) > 0 {
+		msg.Data.Content = data.Content
+	}
+	out, err := json.Marshal(&msg)
+	if err != nil {
+		log.Println("relay: failed to serialize message of", data.Topic, err)
+		return
+	}
+
+	for rdr := range ch.readers {
+		if !rdr.queueOut(out) {
+			// The reader cannot keep up, disconnect it. It will be removed by unreg.
+			log.Println("relay: dropping slow reader", rdr.remoteAddr)
+			rdr.ws.Close()
+		}
+	}
+}
+
+// dropChannel detaches all readers from the channel after notifying them. Pending readers
+// are notified with the ID of their {sub} request.
+func (h *relayHub) dropChannel(topic string, notify func(rdr *reader, id string)) {
+	ch := h.channels[topic]
+	if ch == nil {
+		return
+	}
+	for rdr := range ch.readers {
+		notify(rdr, "")
+		delete(h.byReader[rdr], topic)
+	}
+	for _, req := range ch.pending {
+		notify(req.rdr, req.id)
+		delete(h.byReader[req.rdr], topic)
+	}
+	if ch.subId != "" {
+		delete(h.subs, ch.subId)
+	}
+	delete(h.channels, topic)
+}
@@ -0,0 +1,94 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *    Edge relay for channels: accepts websocket connections of channel readers,
+ *    subscribes to each requested channel once over a single gRPC connection to
+ *    the core server and fans out messages of the channel to its readers.
+ *    The relay keeps no state other than the list of connected readers and
+ *    recent revocations of their access.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/websocket"
+
+	_ "github.com/tinode/chat/server/auth/token"
+	"github.com/tinode/chat/server/store"
+)
+
+func main() {
+	var listenOn = flag.String("listen", ":6070", "Address and port to listen on for websocket connections of readers.")
+	var path = flag.String("path", "/v0/channels", "URL path where readers connect.")
+	var upstreamAddr = flag.String("upstream", "localhost:16060", "Address and port of the gRPC endpoint of the core server.")
+	var scheme = flag.String("scheme", "basic", "Authentication scheme of the relay account.")
+	var secret = flag.String("secret", "", "Secret of the relay account, e.g. 'relay:relay123' for the basic scheme.")
+	var tokenKey = flag.String("token_key", "", "Base64-encoded key of the token authenticator of the core server.")
+	var tokenSerial = flag.Int("token_serial", 1, "Serial number of the token authenticator of the core server.")
+	var grantKey = flag.String("grant_key", "", "Base64-encoded key for checking grants of readers, 'grant_key' of the 'relays' section of the core server config.")
+	var origins = flag.String("origins", "", "Comma-separated list of allowed origins of websocket connections. Any origin if empty.")
+	flag.Parse()
+
+	if *secret == "" {
+		log.Fatal("Secret of the relay account is required")
+	}
+	key, err := base64.StdEncoding.DecodeString(*tokenKey)
+	if err != nil {
+		log.Fatal("Invalid token key: ", err)
+	}
+	gkey, err := base64.StdEncoding.DecodeString(*grantKey)
+	if err != nil || len(gkey) == 0 {
+		log.Fatal("Missing or invalid grant key: ", err)
+	}
+
+	// Tokens of readers are checked locally with the key of the core server.
+	authhdl := store.GetAuthHandler("token")
+	authconf, _ := json.Marshal(map[string]interface{}{"key": key, "serial_num": *tokenSerial, "expire_in": 1})
+	if err = authhdl.Init(authconf, "token"); err != nil {
+		log.Fatal("Failed to initialize token authenticator: ", err)
+	}
+
+	hub := newRelayHub()
+	go hub.run()
+
+	up := &upstream{addr: *upstreamAddr, scheme: *scheme, secret: []byte(*secret), hub: hub}
+	go up.run()
+
+	var allowed map[string]bool
+	if *origins != "" {
+		allowed = make(map[string]bool)
+		for _, origin := range strings.Split(*origins, ",") {
+			allowed[strings.TrimSpace(origin)] = true
+		}
+	}
+	upgrader := websocket.Upgrader{
+		ReadBufferSize:  1024,
+		WriteBufferSize: 1024,
+		CheckOrigin: func(r *http.Request) bool {
+			return allowed == nil || allowed[r.Header.Get("Origin")]
+		},
+	}
+
+	http.HandleFunc(*path, func(wrt http.ResponseWriter, req *http.Request) {
+		ws, err := upgrader.Upgrade(wrt, req, nil)
+		if err != nil {
+			log.Println("relay: failed to upgrade connection", err)
+			return
+		}
+		rdr := newReader(ws, hub, authhdl, gkey, req.RemoteAddr)
+		go rdr.writeLoop()
+		go rdr.readLoop()
+	})
+
+	log.Printf("Relaying channels of %s to readers at %s%s", *upstreamAddr, *listenOn, *path)
+	log.Fatal(http.ListenAndServe(*listenOn, nil))
+}
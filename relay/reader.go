@@ -0,0 +1,237 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *    Websocket connection of a channel reader. Readers speak a subset of the
+ *    client protocol: {hi}, {login} with a token, {sub} and {leave} of
+ *    channels. Everything else is rejected.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/tinode/chat/server/auth"
+)
+
+const (
+	// Time allowed to write a message to the peer.
+	writeWait = 10 * time.Second
+
+	// Time allowed to read the next pong message from the peer.
+	pongWait = 55 * time.Second
+
+	// Send pings to peer with this period. Must be less than pongWait.
+	pingPeriod = (pongWait * 9) / 10
+
+	// Maximum size of a message from a reader.
+	maxMessageSize = 1 << 16
+
+	// Number of outgoing messages queued for a reader. Slow readers are disconnected.
+	sendQueueLimit = 128
+)
+
+// clientMsg is the part of the client message understood by the relay.
+type clientMsg struct {
+	Hi *struct {
+		Id string `json:"id"`
+	} `json:"hi"`
+	Login *struct {
+		Id     string `json:"id"`
+		Scheme string `json:"scheme"`
+		Secret []byte `json:"secret"`
+	} `json:"login"`
+	Sub *struct {
+		Id    string `json:"id"`
+		Topic string `json:"topic"`
+		// Grant issued by the core server in the response to {sub} of the channel.
+		Grant string `json:"grant"`
+	} `json:"sub"`
+	Leave *struct {
+		Id    string `json:"id"`
+		Topic string `json:"topic"`
+	} `json:"leave"`
+}
+
+// ctrlMsg is a {ctrl} response to a reader.
+type ctrlMsg struct {
+	Ctrl struct {
+		Id        string                 `json:"id,omitempty"`
+		Topic     string                 `json:"topic,omitempty"`
+		Params    map[string]interface{} `json:"params,omitempty"`
+		Code      int                    `json:"code"`
+		Text      string                 `json:"text,omitempty"`
+		Timestamp time.Time              `json:"ts"`
+	} `json:"ctrl"`
+}
+
+// reader is a websocket connection of a channel reader.
+type reader struct {
+	ws         *websocket.Conn
+	hub        *relayHub
+	authhdl    auth.AuthHandler
+	grantKey   []byte
+	remoteAddr string
+
+	// ID of the authenticated user.
+	uid string
+
+	// Outgoing messages, serialized.
+	send chan []byte
+	// Closed when the connection is terminated.
+	stop chan struct{}
+}
+
+func newReader(ws *websocket.Conn, hub *relayHub, authhdl auth.AuthHandler, grantKey []byte,
+	remoteAddr string) *reader {
+	return &reader{
+		ws:         ws,
+		hub:        hub,
+		authhdl:    authhdl,
+		grantKey:   grantKey,
+		remoteAddr: remoteAddr,
+		send:       make(chan []byte, sendQueueLimit),
+		stop:       make(chan struct{}),
+	}
+}
+
+// queueOut queues a message for sending. Returns false if the reader is too slow and must be dropped.
+func (r *reader) queueOut(msg []byte) bool {
+	select {
+	case r.send <- msg:
+		return true
+	case <-r.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// reply sends a {ctrl} response to the reader.
+func (r *reader) reply(id, topic string, code int, text string, params map[string]interface{}) {
+	var msg ctrlMsg
+	msg.Ctrl.Id = id
+	msg.Ctrl.Topic = topic
+	msg.Ctrl.Code = code
+	msg.Ctrl.Text = text
+	msg.Ctrl.Params = params
+	msg.Ctrl.Timestamp = time.Now().UTC().Round(time.Millisecond)
+	data, _ := json.Marshal(&msg)
+	if !r.queueOut(data) {
+		r.ws.Close()
+	}
+}
+
+func (r *reader) readLoop() {
+	defer func() {
+		r.ws.Close()
+		close(r.stop)
+		r.hub.unreg <- r
+	}()
+
+	r.ws.SetReadLimit(maxMessageSize)
+	r.ws.SetReadDeadline(time.Now().Add(pongWait))
+	r.ws.SetPongHandler(func(string) error {
+		r.ws.SetReadDeadline(time.Now().Add(pongWait))
+		return nil
+	})
+
+	for {
+		_, raw, err := r.ws.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure,
+				websocket.CloseNormalClosure) {
+				log.Println("relay: readLoop", r.remoteAddr, err)
+			}
+			return
+		}
+
+		var msg clientMsg
+		if err := json.Unmarshal(raw, &msg); err != nil {
+			r.reply("", "", http.StatusBadRequest, "malformed", nil)
+			continue
+		}
+		r.dispatch(&msg)
+	}
+}
+
+func (r *reader) dispatch(msg *clientMsg) {
+	switch {
+	case msg.Hi != nil:
+		r.reply(msg.Hi.Id, "", http.StatusCreated, "created", nil)
+
+	case msg.Login != nil:
+		if r.uid != "" {
+			r.reply(msg.Login.Id, "", http.StatusConflict, "already authenticated", nil)
+			return
+		}
+		if strings.ToLower(msg.Login.Scheme) != "token" {
+			r.reply(msg.Login.Id, "", http.StatusUnauthorized, "authentication failed", nil)
+			return
+		}
+		rec, _, err := r.authhdl.Authenticate(msg.Login.Secret, r.remoteAddr, "")
+		if err != nil || rec.Uid.IsZero() || rec.AuthLevel < auth.LevelAuth {
+			r.reply(msg.Login.Id, "", http.StatusUnauthorized, "authentication failed", nil)
+			return
+		}
+		r.uid = rec.Uid.UserId()
+		r.reply(msg.Login.Id, "", http.StatusOK, "ok", map[string]interface{}{"user": r.uid})
+
+	case msg.Sub != nil:
+		if r.uid == "" {
+			r.reply(msg.Sub.Id, msg.Sub.Topic, http.StatusUnauthorized, "authentication required", nil)
+			return
+		}
+		if !strings.HasPrefix(msg.Sub.Topic, "chn") {
+			r.reply(msg.Sub.Id, msg.Sub.Topic, http.StatusMethodNotAllowed, "operation or method not allowed", nil)
+			return
+		}
+		issued, ok := grantValid(r.grantKey, r.uid, msg.Sub.Topic, msg.Sub.Grant, time.Now())
+		if !ok {
+			r.reply(msg.Sub.Id, msg.Sub.Topic, http.StatusForbidden, "permission denied", nil)
+			return
+		}
+		r.hub.join <- &readerReq{rdr: r, id: msg.Sub.Id, topic: msg.Sub.Topic, issued: issued}
+
+	case msg.Leave != nil:
+		r.hub.leave <- &readerReq{rdr: r, id: msg.Leave.Id, topic: msg.Leave.Topic}
+
+	default:
+		r.reply("", "", http.StatusMethodNotAllowed, "operation or method not allowed", nil)
+	}
+}
+
+func (r *reader) writeLoop() {
+	ticker := time.NewTicker(pingPeriod)
+
+	defer func() {
+		ticker.Stop()
+		// Break readLoop.
+		r.ws.Close()
+	}()
+
+	for {
+		select {
+		case msg := <-r.send:
+			r.ws.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := r.ws.WriteMessage(websocket.TextMessage, msg); err != nil {
+				return
+			}
+		case <-ticker.C:
+			r.ws.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := r.ws.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		case <-r.stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,135 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *    Connection to the core server: a single gRPC stream authenticated as the
+ *    relay account. All channels of the relay are multiplexed over it. The
+ *    connection is re-established with a backoff when lost.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"google.golang.org/grpc"
+
+	"github.com/tinode/chat/pbx"
+)
+
+const (
+	// Delays between attempts to reconnect to the core server.
+	minReconnectDelay = 200 * time.Millisecond
+	maxReconnectDelay = 30 * time.Second
+
+	// Version of the client protocol spoken to the core server.
+	protocolVersion = "0.16"
+)
+
+// upstream maintains the connection to the core server.
+type upstream struct {
+	addr   string
+	scheme string
+	secret []byte
+	hub    *relayHub
+}
+
+// upstreamConn is one established gRPC stream.
+type upstreamConn struct {
+	stream pbx.Node_MessageLoopClient
+	cancel context.CancelFunc
+}
+
+// send writes a message to the stream. Called by the hub only, so writes are not concurrent.
+// Errors are ignored: the broken stream is reported by the receiving goroutine.
+func (c *upstreamConn) send(msg *pbx.ClientMsg) {
+	if err := c.stream.Send(msg); err != nil {
+		log.Println("relay: upstream send failed", err)
+		c.cancel()
+	}
+}
+
+func (u *upstream) run() {
+	delay := minReconnectDelay
+	for {
+		conn, err := u.connect()
+		if err != nil {
+			log.Println("relay: failed to connect to", u.addr, err)
+			time.Sleep(delay)
+			if delay *= 2; delay > maxReconnectDelay {
+				delay = maxReconnectDelay
+			}
+			continue
+		}
+
+		log.Println("relay: connected to", u.addr)
+		delay = minReconnectDelay
+		u.hub.upConn <- conn
+		for {
+			msg, err := conn.stream.Recv()
+			if err != nil {
+				log.Println("relay: connection to", u.addr, "lost", err)
+				break
+			}
+			u.hub.upMsg <- msg
+		}
+		conn.cancel()
+		u.hub.upLost <- conn
+	}
+}
+
+// connect opens the stream and logs in as the relay account.
+func (u *upstream) connect() (*upstreamConn, error) {
+	cc, err := grpc.Dial(u.addr, grpc.WithInsecure())
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-ctx.Done()
+		cc.Close()
+	}()
+
+	stream, err := pbx.NewNodeClient(cc).MessageLoop(ctx)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	if err = u.request(stream, &pbx.ClientMsg{Message: &pbx.ClientMsg_Hi{Hi: &pbx.ClientHi{
+		Id: "hi", UserAgent: "TinodeRelay/" + protocolVersion, Ver: protocolVersion}}}, "hi"); err != nil {
+		cancel()
+		return nil, err
+	}
+	if err = u.request(stream, &pbx.ClientMsg{Message: &pbx.ClientMsg_Login{Login: &pbx.ClientLogin{
+		Id: "login", Scheme: u.scheme, Secret: u.secret}}}, "login"); err != nil {
+		cancel()
+		return nil, err
+	}
+
+	return &upstreamConn{stream: stream, cancel: cancel}, nil
+}
+
+// request sends a message and waits for the {ctrl} response with the given ID.
+func (u *upstream) request(stream pbx.Node_MessageLoopClient, msg *pbx.ClientMsg, id string) error {
+	if err := stream.Send(msg); err != nil {
+		return err
+	}
+	for {
+		resp, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+		if ctrl := resp.GetCtrl(); ctrl != nil && ctrl.Id == id {
+			if ctrl.Code >= http.StatusMultipleChoices {
+				return errors.New(id + ": " + ctrl.Text)
+			}
+			return nil
+		}
+	}
+}
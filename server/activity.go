@@ -0,0 +1,232 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *    Account activity timeline: logins, changes of the password and of the
+ *    credentials, exports of message history. Users review the timeline with
+ *    {get what="activity"} on 'me' and get push alerts on sensitive events.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+	"unicode/utf8"
+
+	"github.com/tinode/chat/server/push"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+// Kinds of account events.
+const (
+	activityLogin  = "login"
+	activityPasswd = "passwd"
+	activityCred   = "cred"
+	activityExport = "export"
+)
+
+const (
+	// Maximum number of events returned by {get what="activity"}. Also the number of recent events
+	// checked for earlier logins from the same device.
+	activityMaxCount = 100
+	// Maximum length of the stored user agent and details.
+	activityMaxFieldLen = 255
+	// How often to delete events past the retention period.
+	activityGcPeriod = time.Hour * 6
+)
+
+// activityConfig is the "activity" section of the server config.
+type activityConfig struct {
+	Enabled bool `json:"enabled"`
+	// Events are deleted after this number of days, 0 to keep them until the account is deleted.
+	RetentionDays int `json:"retention_days"`
+	// Send push notifications about logins from new devices, changes of credentials and exports.
+	Alerts bool `json:"alerts"`
+}
+
+var activity struct {
+	enabled   bool
+	retention time.Duration
+	alerts    bool
+}
+
+// activityInit parses the config of the activity timeline.
+func activityInit(jsconfig json.RawMessage) error {
+	if len(jsconfig) == 0 {
+		return nil
+	}
+
+	var config activityConfig
+	if err := json.Unmarshal(jsconfig, &config); err != nil {
+		return errors.New("failed to parse config: " + err.Error())
+	}
+	if config.RetentionDays < 0 {
+		return errors.New("invalid retention period")
+	}
+
+	activity.enabled = config.Enabled
+	activity.retention = time.Hour * 24 * time.Duration(config.RetentionDays)
+	activity.alerts = config.Alerts
+	return nil
+}
+
+// activityRunGc periodically deletes events past the retention period. Returns nil if events are kept forever.
+func activityRunGc(period time.Duration) chan<- bool {
+	if !activity.enabled || activity.retention == 0 {
+		return nil
+	}
+
+	// Unbuffered stop channel. Whoever stops it must wait for the process to finish.
+	stop := make(chan bool)
+	go func() {
+		gcTimer := time.Tick(period)
+		for {
+			select {
+			case <-gcTimer:
+				count, err := store.AccountEvents.DeleteOlder(time.Now().Add(-activity.retention))
+				if err != nil {
+					log.Println("activity gc:", err)
+				} else if count > 0 {
+					log.Println("activity gc: deleted", count, "account events")
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	return stop
+}
+
+// activityEvent creates an event caused by the session.
+func (s *Session) activityEvent(uid types.Uid, what, detail string) *types.AccountEvent {
+	return &types.AccountEvent{
+		User:       uid.String(),
+		What:       what,
+		Detail:     detail,
+		UserAgent:  s.userAgent,
+		RemoteAddr: s.remoteAddr,
+		DeviceId:   s.deviceID,
+	}
+}
+
+// activityRecord saves the event in the background and alerts the user if the event is sensitive.
+func activityRecord(ev *types.AccountEvent) {
+	if !activity.enabled {
+		return
+	}
+
+	ev.Detail = activityTruncate(ev.Detail)
+	ev.UserAgent = activityTruncate(ev.UserAgent)
+	go func() {
+		uid := types.ParseUid(ev.User)
+		if ev.What == activityLogin {
+			ev.NewDevice = activityIsNewDevice(uid, ev)
+			// Clients log in with a token on every reconnect. Such logins are recorded only if the token
+			// is used on another device.
+			if ev.Detail == "token" && !ev.NewDevice {
+				return
+			}
+		}
+		if err := store.AccountEvents.Create(ev); err != nil {
+			log.Println("activity: failed to save event", ev.What, uid.UserId(), err)
+			return
+		}
+		if activity.alerts && (ev.What != activityLogin || ev.NewDevice) {
+			// Sent directly: the alert is not an unread message.
+			push.Push(&push.Receipt{
+				To: map[types.Uid]push.Recipient{uid: {}},
+				Payload: push.Payload{
+					What:      push.ActSecurity,
+					Topic:     "me",
+					Timestamp: ev.CreatedAt,
+					Event:     ev.What,
+					Content:   ev.UserAgent}})
+		}
+	}()
+}
+
+// activityIsNewDevice checks if the user has not logged in from the device of the event recently.
+// Devices are identified by the push token if known, by the user agent otherwise. The very first
+// login of the user is not reported as new.
+func activityIsNewDevice(uid types.Uid, ev *types.AccountEvent) bool {
+	events, err := store.AccountEvents.GetAll(uid, activityMaxCount)
+	if err != nil {
+		log.Println("activity: failed to get events", uid.UserId(), err)
+		return false
+	}
+	seenLogin := false
+	for i := range events {
+		prev := &events[i]
+		if prev.What != activityLogin {
+			continue
+		}
+		seenLogin = true
+		if (ev.DeviceId != "" && prev.DeviceId == ev.DeviceId) ||
+			(ev.DeviceId == "" && prev.DeviceId == "" && prev.UserAgent == ev.UserAgent) {
+			return false
+		}
+	}
+	return seenLogin
+}
+
+// activityTruncate limits the length of the string to fit the database field.
+func activityTruncate(s string) string {
+	if len(s) <= activityMaxFieldLen {
+		return s
+	}
+	// Don't split a multibyte character.
+	end := activityMaxFieldLen
+	for end > 0 && !utf8.RuneStart(s[end]) {
+		end--
+	}
+	return s[:end]
+}
+
+// replyGetActivity returns the activity timeline of the user, newest first, 'me' only.
+func (t *Topic) replyGetActivity(sess *Session, asUid types.Uid, msg *ClientComMessage) error {
+	now := types.TimeNow()
+
+	if t.cat != types.TopicCatMe {
+		sess.queueOut(ErrOperationNotAllowedReply(msg, now))
+		return errors.New("get.activity: invalid topic category")
+	}
+
+	events, err := store.AccountEvents.GetAll(asUid, activityMaxCount)
+	if err != nil {
+		sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, msg.Original, now, msg.Timestamp, nil))
+		return err
+	}
+
+	if len(events) == 0 {
+		sess.queueOut(NoContentParamsReply(msg, now, map[string]interface{}{"what": "activity"}))
+		return nil
+	}
+
+	timeline := make([]MsgAccountEvent, len(events))
+	for i := range events {
+		ev := &events[i]
+		createdAt := ev.CreatedAt
+		timeline[i] = MsgAccountEvent{
+			What:       ev.What,
+			Timestamp:  &createdAt,
+			Detail:     ev.Detail,
+			NewDevice:  ev.NewDevice,
+			UserAgent:  ev.UserAgent,
+			RemoteAddr: ev.RemoteAddr,
+		}
+		if ev.DeviceId != "" {
+			timeline[i].DeviceId = deviceIdMask(ev.DeviceId)
+		}
+	}
+
+	sess.queueOut(&ServerComMessage{
+		Meta: &MsgServerMeta{Id: msg.Id, Topic: msg.Original, Timestamp: &now, Activity: timeline}})
+
+	return nil
+}
@@ -0,0 +1,52 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *    Anchors: a position in the message stream saved by the user on the
+ *    subscription, e.g. to restore the scroll position on another device.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"errors"
+
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+// replySetAnchor saves the position in the message stream of the topic for the current user or clears it.
+func (t *Topic) replySetAnchor(sess *Session, asUid types.Uid, msg *ClientComMessage) error {
+	now := types.TimeNow()
+
+	if t.cat != types.TopicCatP2P && t.cat != types.TopicCatGrp {
+		sess.queueOut(ErrOperationNotAllowedReply(msg, now))
+		return errors.New("set.sub.anchor: invalid topic category")
+	}
+	if asChan, _ := t.verifyChannelAccess(msg.Original); asChan {
+		sess.queueOut(ErrOperationNotAllowedReply(msg, now))
+		return errors.New("set.sub.anchor: channel readers cannot save anchors")
+	}
+	if pud, ok := t.perUser[asUid]; !ok || pud.deleted {
+		sess.queueOut(ErrPermissionDeniedReply(msg, now))
+		return errors.New("set.sub.anchor: not a subscriber")
+	}
+
+	anchor := *msg.Set.Sub.Anchor
+	if anchor < 0 || anchor > t.lastID {
+		sess.queueOut(ErrMalformedReply(msg, now))
+		return errors.New("set.sub.anchor: invalid seq id")
+	}
+
+	if err := store.Subs.Update(t.name, asUid, map[string]interface{}{"AnchorSeq": anchor}, false); err != nil {
+		sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, msg.Original, now, msg.Timestamp, nil))
+		return err
+	}
+
+	// Let user's other sessions know the anchor has changed.
+	t.presSubsOnline("anchor", "", &presParams{seqID: anchor}, &presFilters{singleUser: asUid.UserId()}, sess.sid)
+	sess.queueOut(NoErrParamsReply(msg, now, map[string]interface{}{"what": "anchor", "seq": anchor}))
+
+	return nil
+}
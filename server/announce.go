@@ -0,0 +1,64 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *    Announcement mode of group topics: only administrators may publish,
+ *    other subscribers keep their permissions and can read, vote and reply
+ *    to events, but their messages are rejected while the mode is on.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"errors"
+
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+// announceAllowed checks if the user may publish to the topic in announcement mode.
+func (t *Topic) announceAllowed(uid types.Uid) bool {
+	if !t.announce {
+		return true
+	}
+	pud, ok := t.perUser[uid]
+	return t.isOwner(uid) || (ok && (pud.modeGiven & pud.modeWant).IsAdmin())
+}
+
+// replySetAnnounce turns announcement mode on or off.
+func (t *Topic) replySetAnnounce(sess *Session, asUid types.Uid, msg *ClientComMessage) error {
+	now := types.TimeNow()
+
+	if t.cat != types.TopicCatGrp {
+		sess.queueOut(ErrOperationNotAllowedReply(msg, now))
+		return errors.New("set.announce: invalid topic category")
+	}
+	if !t.isOwner(asUid) {
+		sess.queueOut(ErrPermissionDeniedReply(msg, now))
+		return errors.New("set.announce: request by non-owner")
+	}
+
+	enable := *msg.Set.Announce
+	if enable == t.announce {
+		sess.queueOut(InfoNotModifiedReply(msg, now))
+		return nil
+	}
+
+	if err := store.Topics.Update(t.name, map[string]interface{}{
+		"Announce": enable, "UpdatedAt": now}); err != nil {
+		sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, t.original(asUid), now, msg.Timestamp, nil))
+		return err
+	}
+
+	t.announce = enable
+	t.updated = now
+
+	// Clients show or hide the input field, let them know the description has changed.
+	filter := &presFilters{excludeUser: asUid.UserId(), filterIn: types.ModeJoin}
+	t.presSubsOffline("upd", nilPresParams, filter, filter, sess.sid, false)
+
+	sess.queueOut(NoErrReply(msg, now))
+
+	return nil
+}
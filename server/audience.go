@@ -0,0 +1,61 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *    Size of the audience of channels: the number of channel readers and the
+ *    number of readers attached now. Reported in the topic description and
+ *    sent to the attached sessions as {pres what="audience"} when changed.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+// Interval between checks if the audience size has changed and should be sent to the attached sessions.
+const audienceInterval = 30 * time.Second
+
+// audienceLoad counts channel readers when the topic is loaded. Later the count is maintained
+// as readers subscribe and leave.
+func (t *Topic) audienceLoad() {
+	count, err := store.Topics.CountSubs(types.GrpToChn(t.name))
+	if err != nil {
+		log.Printf("topic[%s]: failed to count channel readers: %v", t.name, err)
+		return
+	}
+	t.chanReaders = count
+}
+
+// audienceReader counts a channel reader subscribing or leaving.
+func (t *Topic) audienceReader(joined bool) {
+	if joined {
+		t.chanReaders++
+	} else if t.chanReaders > 0 {
+		t.chanReaders--
+	}
+}
+
+// audience returns the current size of the audience of the channel.
+// Readers attached through other cluster nodes are not counted as viewers.
+func (t *Topic) audience() *MsgAudience {
+	return &MsgAudience{Readers: t.chanReaders, Viewers: t.capacityReaders()}
+}
+
+// audienceUpdate sends the size of the audience to the attached sessions if it has changed since it was last sent.
+func (t *Topic) audienceUpdate() {
+	audience := t.audience()
+	if *audience == t.audienceSent {
+		return
+	}
+	t.audienceSent = *audience
+
+	globals.hub.routeMsg(&ServerComMessage{
+		Pres:   &MsgServerPres{Topic: t.xoriginal, What: "audience", Audience: audience},
+		RcptTo: t.name})
+}
@@ -0,0 +1,68 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *    Voice messages: the 'audio' head describes the recording with its
+ *    duration and waveform. Voice messages are indexed by the type of media,
+ *    so they can be queried with {get what="data" data={type="audio"}}.
+ *
+ *****************************************************************************/
+
+package main
+
+import "math"
+
+const (
+	// Head of voice messages.
+	msgAudioHeader = "audio"
+	// Type of media of voice messages.
+	msgMediaAudio = "audio"
+
+	// Maximum duration of a voice message in milliseconds: one hour.
+	audioMaxDuration = 3600 * 1000
+	// Maximum number of points in the waveform.
+	audioMaxWaveform = 256
+	// Maximum amplitude of a point of the waveform.
+	audioMaxAmplitude = 100
+)
+
+// audioParse checks the 'audio' head of the message. Returns the type of media of the message, empty string
+// if it's not a voice message, and false if the head is invalid.
+func audioParse(head map[string]interface{}) (string, bool) {
+	val, ok := head[msgAudioHeader]
+	if !ok {
+		return "", true
+	}
+	audio, ok := val.(map[string]interface{})
+	if !ok {
+		return "", false
+	}
+	for key := range audio {
+		if key != "duration" && key != "waveform" {
+			return "", false
+		}
+	}
+
+	if !audioIsInt(audio["duration"], 1, audioMaxDuration) {
+		return "", false
+	}
+	if val, ok := audio["waveform"]; ok {
+		waveform, ok := val.([]interface{})
+		if !ok || len(waveform) == 0 || len(waveform) > audioMaxWaveform {
+			return "", false
+		}
+		for _, point := range waveform {
+			if !audioIsInt(point, 0, audioMaxAmplitude) {
+				return "", false
+			}
+		}
+	}
+
+	return msgMediaAudio, true
+}
+
+// audioIsInt checks if the value decoded from JSON is an integer between min and max inclusive.
+func audioIsInt(val interface{}, min, max float64) bool {
+	num, ok := val.(float64)
+	return ok && num == math.Trunc(num) && num >= min && num <= max
+}
@@ -21,6 +21,13 @@ const (
 	defaultMaxLoginLength = 32
 
 	defaultMinPasswordLength = 3
+
+	// Minimum time between changes of login.
+	defaultRenameCooldown = time.Hour * 24 * 30
+	// For how long the old login cannot be taken by another user.
+	defaultAliasReservation = time.Hour * 24 * 180
+	// Maximum number of old logins kept in user's history.
+	defaultMaxAliases = 10
 )
 
 // Token suitable as a login: starts with a Unicode letter (class L) and contains Unicode letters (L),
@@ -34,6 +41,10 @@ type authenticator struct {
 
 	minPasswordLength int
 	minLoginLength    int
+
+	renameCooldown   time.Duration
+	aliasReservation time.Duration
+	maxAliases       int
 }
 
 func (a *authenticator) checkLoginPolicy(uname string) error {
@@ -45,6 +56,76 @@ func (a *authenticator) checkLoginPolicy(uname string) error {
 	return nil
 }
 
+// checkAvailable checks that the login is neither used nor reserved by another user. Returns users
+// who still have the login as an old login after the reservation has expired. Nothing is changed.
+func (a *authenticator) checkAvailable(uid types.Uid, uname string) ([]types.Uid, error) {
+	holder, _, _, _, err := store.Users.GetAuthUniqueRecord(a.name, uname)
+	if err != nil {
+		return nil, err
+	}
+	if !holder.IsZero() {
+		return nil, types.ErrDuplicate
+	}
+
+	if !a.addToTags {
+		// Old logins are found by tags. Without tags they are not reserved.
+		return nil, nil
+	}
+
+	subs, err := store.Users.FindSubs(uid, [][]string{{a.name + ":" + uname}}, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	var expired []types.Uid
+	for i := range subs {
+		owner := types.ParseUserId(subs[i].User)
+		if owner.IsZero() {
+			// Not a user.
+			continue
+		}
+		user, err := store.Users.Get(owner)
+		if err != nil {
+			return nil, err
+		}
+		if user == nil {
+			continue
+		}
+		idx := user.Aliases.Find(a.name, uname)
+		if idx < 0 {
+			continue
+		}
+		if time.Since(user.Aliases[idx].ChangedAt) < a.aliasReservation {
+			return nil, types.ErrDuplicate
+		}
+		expired = append(expired, owner)
+	}
+
+	return expired, nil
+}
+
+// releaseAliases removes the old login from the tags of the users whose reservation has expired,
+// so the login resolves to the new owner only. Called when the login is taken.
+func (a *authenticator) releaseAliases(uname string, expired []types.Uid) error {
+	tag := a.name + ":" + uname
+	for _, owner := range expired {
+		if _, err := store.Users.UpdateTags(owner, nil, []string{tag}, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkRenameCooldown checks if enough time has passed since the previous change of login.
+func (a *authenticator) checkRenameCooldown(aliases types.AliasList) error {
+	for i := range aliases {
+		if aliases[i].Scheme == a.name && time.Since(aliases[i].ChangedAt) < a.renameCooldown {
+			return types.ErrPolicy
+		}
+	}
+
+	return nil
+}
+
 func (a *authenticator) checkPasswordPolicy(password string) error {
 	if len([]rune(password)) < a.minPasswordLength {
 		return types.ErrPolicy
@@ -82,6 +163,12 @@ func (a *authenticator) Init(jsonconf json.RawMessage, name string) error {
 		AddToTags         bool `json:"add_to_tags"`
 		MinPasswordLength int  `json:"min_password_length"`
 		MinLoginLength    int  `json:"min_login_length"`
+		// Minimum time between changes of login, in seconds.
+		RenameCooldown int `json:"rename_cooldown"`
+		// For how long the old login is reserved for the user who used it, in seconds.
+		AliasReservation int `json:"alias_reservation"`
+		// Maximum number of old logins to keep.
+		MaxAliases int `json:"max_aliases"`
 	}
 
 	var config configType
@@ -101,6 +188,18 @@ func (a *authenticator) Init(jsonconf json.RawMessage, name string) error {
 	if a.minLoginLength <= 0 {
 		a.minLoginLength = defaultMinLoginLength
 	}
+	a.renameCooldown = time.Duration(config.RenameCooldown) * time.Second
+	if a.renameCooldown <= 0 {
+		a.renameCooldown = defaultRenameCooldown
+	}
+	a.aliasReservation = time.Duration(config.AliasReservation) * time.Second
+	if a.aliasReservation <= 0 {
+		a.aliasReservation = defaultAliasReservation
+	}
+	a.maxAliases = config.MaxAliases
+	if a.maxAliases <= 0 {
+		a.maxAliases = defaultMaxAliases
+	}
 
 	return nil
 }
@@ -116,6 +215,11 @@ func (a *authenticator) AddRecord(rec *auth.Rec, secret []byte, remoteAddr strin
 		return nil, err
 	}
 
+	expired, err := a.checkAvailable(rec.Uid, uname)
+	if err != nil {
+		return nil, err
+	}
+
 	if err = a.checkPasswordPolicy(password); err != nil {
 		return nil, err
 	}
@@ -138,6 +242,9 @@ func (a *authenticator) AddRecord(rec *auth.Rec, secret []byte, remoteAddr strin
 	if err != nil {
 		return nil, err
 	}
+	if err = a.releaseAliases(uname, expired); err != nil {
+		return nil, err
+	}
 
 	rec.AuthLevel = authLevel
 	if a.addToTags {
@@ -146,14 +253,15 @@ func (a *authenticator) AddRecord(rec *auth.Rec, secret []byte, remoteAddr strin
 	return rec, nil
 }
 
-// UpdateRecord updates password for basic authentication.
+// UpdateRecord updates password and/or login for basic authentication. The old login is kept
+// in user's history of aliases and remains reserved for the user for some time.
 func (a *authenticator) UpdateRecord(rec *auth.Rec, secret []byte, remoteAddr string) (*auth.Rec, error) {
 	uname, password, err := parseSecret(secret)
 	if err != nil {
 		return nil, err
 	}
 
-	login, _, _, _, err := store.Users.GetAuthRecord(rec.Uid, a.name)
+	login, _, passhash, _, err := store.Users.GetAuthRecord(rec.Uid, a.name)
 	if err != nil {
 		return nil, err
 	}
@@ -162,25 +270,33 @@ func (a *authenticator) UpdateRecord(rec *auth.Rec, secret []byte, remoteAddr st
 		return nil, types.ErrNotFound
 	}
 
+	var user *types.User
+	var expired []types.Uid
 	if uname == "" || uname == login {
 		// User is changing just the password.
 		uname = login
 	} else if err = a.checkLoginPolicy(uname); err != nil {
 		return nil, err
-	} else if uid, _, _, _, err := store.Users.GetAuthUniqueRecord(a.name, uname); err != nil {
+	} else if user, err = store.Users.Get(rec.Uid); err != nil {
 		return nil, err
-	} else if !uid.IsZero() {
-		// The (new) user name already exists. Report an error.
-		return nil, types.ErrDuplicate
-	}
-
-	if err = a.checkPasswordPolicy(password); err != nil {
+	} else if user == nil {
+		return nil, types.ErrNotFound
+	} else if err = a.checkRenameCooldown(user.Aliases); err != nil {
+		return nil, err
+	} else if expired, err = a.checkAvailable(rec.Uid, uname); err != nil {
 		return nil, err
 	}
 
-	passhash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
-	if err != nil {
-		return nil, types.ErrInternal
+	if password != "" || uname == login {
+		// Password is optional when changing the login.
+		if err = a.checkPasswordPolicy(password); err != nil {
+			return nil, err
+		}
+
+		passhash, err = bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			return nil, types.ErrInternal
+		}
 	}
 	var expires time.Time
 	if rec.Lifetime > 0 {
@@ -191,17 +307,61 @@ func (a *authenticator) UpdateRecord(rec *auth.Rec, secret []byte, remoteAddr st
 		return nil, err
 	}
 
-	// Remove old tag from the list of tags
-	oldTag := a.name + ":" + login
-	for i, tag := range rec.Tags {
-		if tag == oldTag {
-			rec.Tags[i] = rec.Tags[len(rec.Tags)-1]
-			rec.Tags = rec.Tags[:len(rec.Tags)-1]
-			break
+	if uname == login {
+		return rec, nil
+	}
+	if err = a.releaseAliases(uname, expired); err != nil {
+		return nil, err
+	}
+
+	// Save the old login to the history. If the user returns to one of the old logins, it's no longer an alias.
+	var aliases types.AliasList
+	var dropped []string
+	for _, al := range user.Aliases {
+		if al.Scheme != a.name || al.Login != uname {
+			aliases = append(aliases, al)
 		}
 	}
-	// Add new tag
-	rec.Tags = append(rec.Tags, a.name+":"+uname)
+	aliases = append(aliases, types.LoginAlias{Scheme: a.name, Login: login, ChangedAt: types.TimeNow()})
+	for len(aliases) > a.maxAliases {
+		if aliases[0].Scheme == a.name {
+			dropped = append(dropped, a.name+":"+aliases[0].Login)
+		}
+		aliases = aliases[1:]
+	}
+	if err = store.Users.Update(rec.Uid, map[string]interface{}{"Aliases": aliases}); err != nil {
+		return nil, err
+	}
+
+	if a.addToTags {
+		// Old tag is kept so the old login still resolves to the user. Tags of aliases
+		// removed from the history are dropped.
+		var tags []string
+		for _, tag := range rec.Tags {
+			keep := true
+			for _, drop := range dropped {
+				if tag == drop {
+					keep = false
+					break
+				}
+			}
+			if keep {
+				tags = append(tags, tag)
+			}
+		}
+		newTag := a.name + ":" + uname
+		found := false
+		for _, tag := range tags {
+			if tag == newTag {
+				found = true
+				break
+			}
+		}
+		if !found {
+			tags = append(tags, newTag)
+		}
+		rec.Tags = tags
+	}
 
 	return rec, nil
 }
@@ -268,15 +428,11 @@ func (a *authenticator) IsUnique(secret []byte, remoteAddr string) (bool, error)
 		return false, err
 	}
 
-	uid, _, _, _, err := store.Users.GetAuthUniqueRecord(a.name, uname)
-	if err != nil {
+	if _, err := a.checkAvailable(types.ZeroUid, uname); err != nil {
 		return false, err
 	}
 
-	if uid.IsZero() {
-		return true, nil
-	}
-	return false, types.ErrDuplicate
+	return true, nil
 }
 
 // GenSecret is not supported, generates an error.
@@ -0,0 +1,169 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *    Auto-reply (vacation responder): a message sent by the server on behalf
+ *    of the user in response to P2P messages.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+const (
+	// Minimum interval between two auto-replies in the same conversation.
+	autoReplyInterval = 24 * time.Hour
+	// How long the cached auto-reply is used before it's read from the database again.
+	// Auto-reply may be changed at another cluster node.
+	autoReplyCacheTTL = time.Minute
+	// Maximum size of the serialized auto-reply content.
+	autoReplyMaxSize = 4096
+	// Message header which marks auto-generated messages.
+	autoReplyHeader = "auto"
+)
+
+type autoReplyCached struct {
+	reply    types.AutoReply
+	loadedAt time.Time
+}
+
+// autoReplies caches auto-replies of users, types.Uid -> *autoReplyCached.
+var autoReplies sync.Map
+
+// autoReplySent records when the auto-reply was last sent to a conversation, "topic/uid" -> time.Time.
+var autoReplySent struct {
+	sync.Mutex
+	at     map[string]time.Time
+	pruned time.Time
+}
+
+// autoReplySet replaces the cached auto-reply of the user.
+func autoReplySet(uid types.Uid, reply types.AutoReply) {
+	autoReplies.Store(uid, &autoReplyCached{reply: reply, loadedAt: time.Now()})
+}
+
+// autoReplyGet returns the auto-reply of the user reading it from the database if it's not cached
+// or the cached copy is too old.
+func autoReplyGet(uid types.Uid) types.AutoReply {
+	if val, ok := autoReplies.Load(uid); ok {
+		cached := val.(*autoReplyCached)
+		if time.Since(cached.loadedAt) < autoReplyCacheTTL {
+			return cached.reply
+		}
+	}
+
+	user, err := store.Users.Get(uid)
+	if err != nil {
+		log.Println("autoreply: failed to load user", uid.UserId(), err)
+		return types.AutoReply{}
+	}
+
+	var reply types.AutoReply
+	if user != nil {
+		reply = user.AutoReply
+	}
+	autoReplySet(uid, reply)
+	return reply
+}
+
+// autoReplyDue checks if the auto-reply of the user should be sent to the conversation and if so
+// records it as sent.
+func autoReplyDue(topic string, uid types.Uid, now time.Time) bool {
+	autoReplySent.Lock()
+	defer autoReplySent.Unlock()
+
+	if autoReplySent.at == nil {
+		autoReplySent.at = make(map[string]time.Time)
+	}
+
+	// Forget replies which no longer matter.
+	if now.Sub(autoReplySent.pruned) > autoReplyInterval {
+		for key, at := range autoReplySent.at {
+			if now.Sub(at) >= autoReplyInterval {
+				delete(autoReplySent.at, key)
+			}
+		}
+		autoReplySent.pruned = now
+	}
+
+	key := topic + "/" + uid.UserId()
+	if at, ok := autoReplySent.at[key]; ok && now.Sub(at) < autoReplyInterval {
+		return false
+	}
+	autoReplySent.at[key] = now
+	return true
+}
+
+// isAutoGenerated checks if the message was generated automatically, by the server
+// or by a client-side responder. Such messages never trigger an auto-reply.
+func isAutoGenerated(data *MsgServerData) bool {
+	if data.From == "" {
+		return true
+	}
+	auto, _ := data.Head[autoReplyHeader].(bool)
+	return auto
+}
+
+// autoReplyFromMsg validates the auto-reply sent by the client and converts it to the stored format.
+func autoReplyFromMsg(src *MsgAutoReply) (types.AutoReply, error) {
+	if src.Content == nil {
+		// Remove the auto-reply.
+		return types.AutoReply{}, nil
+	}
+
+	reply := types.AutoReply{Content: src.Content, Start: src.Start, End: src.End}
+	if reply.Start != nil && reply.End != nil && !reply.End.After(*reply.Start) {
+		return types.AutoReply{}, types.ErrMalformed
+	}
+	if val, err := reply.Value(); err != nil {
+		return types.AutoReply{}, types.ErrMalformed
+	} else if len(val.([]byte)) > autoReplyMaxSize {
+		return types.AutoReply{}, types.ErrPolicy
+	}
+	return reply, nil
+}
+
+// sendAutoReply responds to the message in a P2P topic with the auto-reply of the recipient, if the
+// recipient has an active auto-reply and it has not been sent to the conversation recently.
+func (t *Topic) sendAutoReply(from types.Uid, data *MsgServerData) {
+	if t.cat != types.TopicCatP2P || t.isProxy || isAutoGenerated(data) {
+		return
+	}
+
+	var rcpt types.Uid
+	for uid := range t.perUser {
+		if uid != from {
+			rcpt = uid
+			break
+		}
+	}
+	pud, ok := t.perUser[rcpt]
+	if rcpt.IsZero() || !ok || pud.deleted || !(pud.modeWant & pud.modeGiven).IsWriter() {
+		return
+	}
+
+	now := types.TimeNow()
+	reply := autoReplyGet(rcpt)
+	if !reply.Active(now) || blockListGet(rcpt).Find(from.UserId()) >= 0 || !autoReplyDue(t.name, rcpt, now) {
+		return
+	}
+
+	t.handleBroadcast(&ServerComMessage{
+		Data: &MsgServerData{
+			Topic:     t.xoriginal,
+			From:      rcpt.UserId(),
+			Timestamp: now,
+			Head:      map[string]interface{}{autoReplyHeader: true},
+			Content:   reply.Content},
+		RcptTo:    t.name,
+		AsUser:    rcpt.UserId(),
+		Timestamp: now})
+}
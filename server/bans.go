@@ -0,0 +1,298 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *    Bans of users from group topics: admins list banned users with
+ *    {get what="banned"} and ban or unban them with {set ban}, optionally
+ *    with a reason and the time when the ban lapses. A banned user is a
+ *    subscriber without the J permission. The access mode the user had
+ *    before the ban is restored when the ban is lifted.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"errors"
+	"log"
+	"sort"
+	"time"
+	"unicode/utf8"
+
+	"github.com/tinode/chat/server/auth"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+// Maximum length of the reason of the ban, characters.
+const banMaxReason = 256
+
+// Maximum duration of a ban which lapses by itself. Ban without 'until' to ban indefinitely.
+const banMaxDuration = 365 * 24 * time.Hour
+
+// banIsAdmin checks if the user can manage bans: admins and owners.
+func (t *Topic) banIsAdmin(uid types.Uid) bool {
+	pud, ok := t.perUser[uid]
+	return ok && !pud.deleted && ((pud.modeGiven & pud.modeWant).IsAdmin() || t.isOwner(uid))
+}
+
+// isBanned checks if the subscriber cannot join the topic. Pending requests to join are not bans.
+func (pud *perUserData) isBanned() bool {
+	return !pud.deleted && !pud.modeGiven.IsJoiner() && pud.request == nil
+}
+
+// replyGetBanned lists users banned from the group topic. Admins and owners only.
+func (t *Topic) replyGetBanned(sess *Session, asUid types.Uid, msg *ClientComMessage) error {
+	now := types.TimeNow()
+
+	if t.cat != types.TopicCatGrp {
+		sess.queueOut(ErrOperationNotAllowedReply(msg, now))
+		return errors.New("get.banned: invalid topic category")
+	}
+	if !t.banIsAdmin(asUid) {
+		sess.queueOut(ErrPermissionDeniedReply(msg, now))
+		return errors.New("get.banned: admin access required")
+	}
+
+	var banned []MsgBannedUser
+	for uid, pud := range t.perUser {
+		if !pud.isBanned() {
+			continue
+		}
+		user := MsgBannedUser{User: uid.UserId()}
+		if pud.ban != nil {
+			createdAt := pud.ban.CreatedAt
+			user.Reason = pud.ban.Reason
+			user.Until = pud.ban.Until
+			user.By = pud.ban.By
+			user.CreatedAt = &createdAt
+		}
+		banned = append(banned, user)
+	}
+	if len(banned) == 0 {
+		sess.queueOut(NoContentParamsReply(msg, now, map[string]string{"what": "banned"}))
+		return nil
+	}
+	sort.Slice(banned, func(i, j int) bool {
+		return banned[i].User < banned[j].User
+	})
+
+	sess.queueOut(&ServerComMessage{
+		Meta: &MsgServerMeta{Id: msg.Id, Topic: t.original(asUid), Timestamp: &now, Banned: banned}})
+
+	return nil
+}
+
+// replySetBan bans or unbans the user. Admins and owners only, owners cannot be banned.
+func (t *Topic) replySetBan(sess *Session, asUid types.Uid, msg *ClientComMessage) error {
+	now := types.TimeNow()
+	req := msg.Set.Ban
+
+	if t.cat != types.TopicCatGrp {
+		sess.queueOut(ErrOperationNotAllowedReply(msg, now))
+		return errors.New("set.ban: invalid topic category")
+	}
+	if asChan, _ := t.verifyChannelAccess(msg.Original); asChan {
+		sess.queueOut(ErrOperationNotAllowedReply(msg, now))
+		return errors.New("set.ban: channel readers cannot ban")
+	}
+	if !t.banIsAdmin(asUid) {
+		sess.queueOut(ErrPermissionDeniedReply(msg, now))
+		return errors.New("set.ban: admin access required")
+	}
+
+	target := types.ParseUserId(req.User)
+	if target.IsZero() || target == asUid || utf8.RuneCountInString(req.Reason) > banMaxReason ||
+		(!req.Banned && (req.Reason != "" || req.Until != nil)) ||
+		(req.Until != nil && (!req.Until.After(now) || req.Until.Sub(now) > banMaxDuration)) {
+		sess.queueOut(ErrMalformedReply(msg, now))
+		return errors.New("set.ban: invalid request")
+	}
+	if t.isOwner(target) {
+		sess.queueOut(ErrPermissionDeniedReply(msg, now))
+		return errors.New("set.ban: owners cannot be banned")
+	}
+
+	var changed bool
+	var err error
+	if req.Banned {
+		changed, err = t.banUser(asUid, target, req.Reason, req.Until, now, sess.sid)
+	} else {
+		changed, err = t.unbanUser(asUid, target, sess.sid)
+	}
+	if err != nil {
+		sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, msg.Original, now, msg.Timestamp, nil))
+		return err
+	}
+	t.banSchedule()
+
+	if !changed {
+		sess.queueOut(InfoNotModifiedReply(msg, now))
+		return nil
+	}
+	sess.queueOut(NoErrReply(msg, now))
+	return nil
+}
+
+// banUser removes all access of the user to the topic and detaches the user's sessions. The user
+// who is not subscribed to the topic gets a subscription without access so they cannot subscribe.
+// Banning the banned user again replaces the reason and the expiration of the ban.
+func (t *Topic) banUser(actor, target types.Uid, reason string, until *time.Time, now time.Time,
+	skip string) (bool, error) {
+
+	ban := &types.SubBan{CreatedAt: now, Until: until, Reason: reason, By: actor.UserId(), Given: types.ModeUnset}
+
+	pud, ok := t.perUser[target]
+	if !ok || pud.deleted {
+		if user, err := store.Users.Get(target); err != nil {
+			return false, err
+		} else if user == nil {
+			return false, types.ErrUserNotFound
+		}
+
+		sub := &types.Subscription{
+			User:      target.String(),
+			Topic:     t.name,
+			ModeWant:  types.ModeNone,
+			ModeGiven: types.ModeNone,
+			CreatedAt: now,
+		}
+		if err := store.Subs.Create(sub); err != nil {
+			return false, err
+		}
+		if err := store.Subs.Update(t.name, target, map[string]interface{}{"Ban": ban}, false); err != nil {
+			return false, err
+		}
+
+		// The user may be reading the channel: detach the reader's sessions.
+		t.evictUser(target, false, "")
+		t.relayRevoke(target)
+
+		t.perUser[target] = &perUserData{modeGiven: types.ModeNone, modeWant: types.ModeNone, ban: ban}
+		t.computePerUserAcsUnion()
+		usersRegisterUser(target, true)
+		return true, nil
+	}
+
+	if pud.modeGiven.IsJoiner() {
+		ban.Given = pud.modeGiven
+	} else if pud.ban != nil {
+		// Keep the access mode the user had before the first ban.
+		ban.Given = pud.ban.Given
+	}
+
+	update := map[string]interface{}{"ModeGiven": types.ModeNone, "Ban": ban}
+	if pud.request != nil {
+		// The pending request to join is denied.
+		update["Request"] = nil
+	}
+	if err := store.Subs.Update(t.name, target, update, false); err != nil {
+		return false, err
+	}
+
+	oldGiven := pud.modeGiven
+	pud.modeGiven = types.ModeNone
+	pud.request = nil
+	pud.ban = ban
+
+	if oldGiven != types.ModeNone {
+		if (pud.modeWant & oldGiven).IsReader() {
+			usersUpdateUnread(target, pud.readID-t.lastID, 0, true)
+		}
+		t.notifySubChange(target, actor, false, pud.modeWant, oldGiven, pud.modeWant, types.ModeNone, skip)
+		t.computePerUserAcsUnion()
+	}
+	t.evictUser(target, false, "")
+	t.relayRevoke(target)
+
+	return true, nil
+}
+
+// unbanUser restores the access mode the user had before the ban. Users banned without
+// a subscription get the default access.
+func (t *Topic) unbanUser(actor, target types.Uid, skip string) (bool, error) {
+	pud, ok := t.perUser[target]
+	if !ok || !pud.isBanned() {
+		return false, nil
+	}
+
+	given := types.ModeUnset
+	if pud.ban != nil {
+		given = pud.ban.Given
+	}
+	if !given.IsDefined() || !given.IsJoiner() {
+		given = t.accessFor(auth.LevelAuth) | types.ModeJoin
+	}
+
+	if err := store.Subs.Update(t.name, target,
+		map[string]interface{}{"ModeGiven": given, "Ban": nil}, false); err != nil {
+		return false, err
+	}
+
+	oldGiven := pud.modeGiven
+	pud.modeGiven = given
+	pud.ban = nil
+
+	if (pud.modeWant & given).IsReader() {
+		usersUpdateUnread(target, t.lastID-pud.readID, 0, true)
+	}
+	t.notifySubChange(target, actor, false, pud.modeWant, oldGiven, pud.modeWant, given, skip)
+	t.computePerUserAcsUnion()
+
+	return true, nil
+}
+
+// banResolve clears the record of the ban once an admin has given the user access to join with {set sub}.
+func (t *Topic) banResolve(target types.Uid, pud *perUserData) {
+	if pud.ban == nil || !pud.modeGiven.IsJoiner() {
+		return
+	}
+	if err := store.Subs.Update(t.name, target, map[string]interface{}{"Ban": nil}, false); err != nil {
+		log.Printf("topic[%s]: failed to clear ban of %s: %v", t.name, target.UserId(), err)
+		return
+	}
+	pud.ban = nil
+	t.banSchedule()
+}
+
+// banSchedule starts the timer which lifts the earliest expiring ban. Bans which have lapsed
+// while the topic was not loaded are lifted right away.
+func (t *Topic) banSchedule() {
+	t.banTimer.Stop()
+
+	var next *time.Time
+	for _, pud := range t.perUser {
+		if pud.ban == nil || pud.ban.Until == nil || !pud.isBanned() {
+			continue
+		}
+		if next == nil || pud.ban.Until.Before(*next) {
+			next = pud.ban.Until
+		}
+	}
+	if next != nil {
+		t.banTimer.Reset(time.Until(*next))
+	}
+}
+
+// banLapse lifts the bans when their time is up.
+func (t *Topic) banLapse() {
+	now := types.TimeNow()
+	failed := false
+	for uid, pud := range t.perUser {
+		if pud.ban == nil || pud.ban.Until == nil || pud.ban.Until.After(now) {
+			continue
+		}
+		if _, err := t.unbanUser(types.ParseUserId(pud.ban.By), uid, ""); err != nil {
+			log.Printf("topic[%s]: failed to lift ban of %s: %v", t.name, uid.UserId(), err)
+			failed = true
+		}
+	}
+
+	if failed {
+		// Try again later.
+		t.banTimer.Stop()
+		t.banTimer.Reset(time.Minute)
+		return
+	}
+	t.banSchedule()
+}
@@ -0,0 +1,193 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *    Cache of user-level block lists.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"container/list"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+const (
+	// Maximum number of cached block lists. The least recently used lists are evicted first.
+	blockListCacheSize = 65536
+	// Cached block lists are read from the database again after this time.
+	blockListTTL = 10 * time.Minute
+)
+
+// blockListEntry is a cached block list of a user.
+type blockListEntry struct {
+	uid     types.Uid
+	list    types.BlockList
+	expires time.Time
+	// Position in the LRU list.
+	elem *list.Element
+}
+
+// blockLists caches block lists of users. The lists are shared between goroutines: they are never
+// modified in place, a changed list replaces the cached one. The list is loaded when the user logs in,
+// attaches to a group topic or when it's needed for filtering push notifications. Changes are sent
+// to the other cluster nodes.
+var blockLists struct {
+	lock    sync.Mutex
+	entries map[types.Uid]*blockListEntry
+	// Most recently used lists are at the front.
+	lru *list.List
+	// Users whose lists are being loaded in the background.
+	loading map[types.Uid]bool
+}
+
+func init() {
+	blockLists.entries = make(map[types.Uid]*blockListEntry)
+	blockLists.lru = list.New()
+	blockLists.loading = make(map[types.Uid]bool)
+}
+
+// blockListSet replaces the cached block list of the user.
+func blockListSet(uid types.Uid, blocked types.BlockList) {
+	if blocked == nil {
+		// Empty list is cached too: it's not the same as the list not loaded yet.
+		blocked = types.BlockList{}
+	}
+
+	blockLists.lock.Lock()
+	defer blockLists.lock.Unlock()
+
+	if entry := blockLists.entries[uid]; entry != nil {
+		entry.list = blocked
+		entry.expires = time.Now().Add(blockListTTL)
+		blockLists.lru.MoveToFront(entry.elem)
+		return
+	}
+
+	entry := &blockListEntry{uid: uid, list: blocked, expires: time.Now().Add(blockListTTL)}
+	entry.elem = blockLists.lru.PushFront(entry)
+	blockLists.entries[uid] = entry
+	for blockLists.lru.Len() > blockListCacheSize {
+		oldest := blockLists.lru.Remove(blockLists.lru.Back()).(*blockListEntry)
+		delete(blockLists.entries, oldest.uid)
+	}
+}
+
+// blockListCached returns the cached block list of the user. The second value is false if the list
+// is not cached or it's time to read it again.
+func blockListCached(uid types.Uid) (types.BlockList, bool) {
+	blockLists.lock.Lock()
+	defer blockLists.lock.Unlock()
+
+	entry := blockLists.entries[uid]
+	if entry == nil {
+		return nil, false
+	}
+	blockLists.lru.MoveToFront(entry.elem)
+	return entry.list, time.Now().Before(entry.expires)
+}
+
+// blockListGet returns the block list of the user reading it from the database if it's not cached.
+func blockListGet(uid types.Uid) types.BlockList {
+	if blocked, ok := blockListCached(uid); ok {
+		return blocked
+	}
+	return blockListLoad(uid)
+}
+
+// blockListLoad reads the block list of the user from the database and caches it.
+func blockListLoad(uid types.Uid) types.BlockList {
+	user, err := store.Users.Get(uid)
+	if err != nil {
+		log.Println("blocklist: failed to load block list", uid.UserId(), err)
+		return nil
+	}
+
+	var blocked types.BlockList
+	if user != nil {
+		blocked = user.Blocked
+	}
+	blockListSet(uid, blocked)
+	return blocked
+}
+
+// blockListRefresh loads the block list of the user in the background unless it's cached.
+func blockListRefresh(uid types.Uid) {
+	if _, ok := blockListCached(uid); ok {
+		return
+	}
+
+	blockLists.lock.Lock()
+	if blockLists.loading[uid] {
+		blockLists.lock.Unlock()
+		return
+	}
+	blockLists.loading[uid] = true
+	blockLists.lock.Unlock()
+
+	go func() {
+		blockListLoad(uid)
+		blockLists.lock.Lock()
+		delete(blockLists.loading, uid)
+		blockLists.lock.Unlock()
+	}()
+}
+
+// blockListHides checks if the user has blocked the sender with the sender's messages hidden
+// in group topics. If the list is not cached it's read from the database when load is true.
+// Otherwise the list last cached is used and a fresh one is loaded in the background: the messages
+// are not hidden if the list was never cached.
+func blockListHides(uid types.Uid, from string, load bool) bool {
+	var blocked types.BlockList
+	if load {
+		blocked = blockListGet(uid)
+	} else {
+		var ok bool
+		if blocked, ok = blockListCached(uid); !ok {
+			blockListRefresh(uid)
+		}
+	}
+
+	i := blocked.Find(from)
+	return i >= 0 && blocked[i].Hide
+}
+
+// blockListChanged caches the changed block list of the user and sends it to the other cluster nodes.
+func blockListChanged(uid types.Uid, blocked types.BlockList) {
+	blockListSet(uid, blocked)
+
+	if globals.cluster == nil {
+		return
+	}
+	req := &ClusterBlockList{Node: globals.cluster.thisNodeName, UserId: uid, Blocked: blocked}
+	for _, n := range globals.cluster.nodes {
+		go func(n *ClusterNode) {
+			var unused bool
+			if err := n.call("Cluster.BlockListUpdate", req, &unused); err != nil {
+				log.Println("blocklist: failed to update block list at", n.name, uid.UserId(), err)
+			}
+		}(n)
+	}
+}
+
+// ClusterBlockList is the changed block list of a user sent to the other cluster nodes.
+type ClusterBlockList struct {
+	// Name of the node sending this request.
+	Node string
+	// User who changed the list.
+	UserId types.Uid
+	// The new list.
+	Blocked types.BlockList
+}
+
+// BlockListUpdate is a gRPC endpoint which receives changed block lists of users.
+func (c *Cluster) BlockListUpdate(msg *ClusterBlockList, unused *bool) error {
+	blockListSet(msg.UserId, msg.Blocked)
+	return nil
+}
@@ -0,0 +1,113 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *    Starred messages: users star messages with {note what="star"} and
+ *    fetch them across topics with {get what="starred"} on 'me'.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"errors"
+	"log"
+
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+// Maximum number of starred messages returned by {get what="starred"}.
+const starredMaxCount = 100
+
+// bookmarkSave stars or unstars the message on behalf of the user. Returns false if the change
+// could not be saved.
+func (t *Topic) bookmarkSave(uid types.Uid, info *MsgServerInfo) bool {
+	var err error
+	if info.What == "star" {
+		err = store.Bookmarks.Create(uid, t.name, info.SeqId)
+	} else {
+		err = store.Bookmarks.Delete(uid, t.name, info.SeqId)
+	}
+	if err != nil {
+		log.Printf("topic[%s]: failed to save bookmark: %v", t.name, err)
+		return false
+	}
+	return true
+}
+
+// replyGetStarred returns messages starred by the user, most recently starred first, 'me' only.
+// Messages the user can no longer read are skipped.
+func (t *Topic) replyGetStarred(sess *Session, asUid types.Uid, msg *ClientComMessage) error {
+	now := types.TimeNow()
+
+	if t.cat != types.TopicCatMe {
+		sess.queueOut(ErrOperationNotAllowedReply(msg, now))
+		return errors.New("get.starred: invalid topic category")
+	}
+
+	bookmarks, err := store.Bookmarks.GetAll(asUid, starredMaxCount)
+	if err != nil {
+		sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, msg.Original, now, msg.Timestamp, nil))
+		return err
+	}
+
+	// Cache of read permissions and masking rules in topics of the bookmarks.
+	readable := make(map[string]bool)
+	masks := make(map[string]*maskingRule)
+	var starred []MsgStarred
+	for i := range bookmarks {
+		bm := &bookmarks[i]
+
+		canRead, ok := readable[bm.Topic]
+		if !ok {
+			sub, err := store.Subs.Get(bm.Topic, asUid)
+			if err != nil {
+				sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, msg.Original, now, msg.Timestamp, nil))
+				return err
+			}
+			canRead = sub != nil && (sub.ModeGiven & sub.ModeWant).IsReader()
+			readable[bm.Topic] = canRead
+			if canRead {
+				masks[bm.Topic] = maskingRuleOf(msg.OrganizationId, bm.Topic, sub.ModeGiven&sub.ModeWant, false)
+			}
+		}
+		if !canRead {
+			continue
+		}
+
+		messages, err := store.Messages.GetAll(bm.Topic, asUid,
+			&types.QueryOpt{Since: bm.SeqId, Before: bm.SeqId + 1, Limit: 1})
+		if err != nil {
+			sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, msg.Original, now, msg.Timestamp, nil))
+			return err
+		}
+		if len(messages) == 0 || messages[0].DeletedAt != nil {
+			// The message is deleted.
+			continue
+		}
+
+		mm := &messages[0]
+		createdAt := mm.CreatedAt
+		starredAt := bm.CreatedAt
+		starred = append(starred, MsgStarred{
+			Topic:     topicNameForUser(bm.Topic, asUid, false),
+			SeqId:     mm.SeqId,
+			From:      types.ParseUid(mm.From).UserId(),
+			Timestamp: &createdAt,
+			Head:      mm.Head,
+			Content:   masks[bm.Topic].stored(mm, asUid),
+			Starred:   &starredAt,
+		})
+	}
+
+	if len(starred) == 0 {
+		sess.queueOut(NoContentParamsReply(msg, now, map[string]interface{}{"what": "starred"}))
+		return nil
+	}
+
+	sess.queueOut(&ServerComMessage{
+		Meta: &MsgServerMeta{Id: msg.Id, Topic: msg.Original, Timestamp: &now, Starred: starred}})
+
+	return nil
+}
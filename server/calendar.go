@@ -0,0 +1,320 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *    Events announced in group topics: members respond whether they will
+ *    attend and receive a reminder before the event starts.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+	"unicode/utf8"
+
+	"github.com/tinode/chat/server/push"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+const (
+	// MIME type of messages which announce events.
+	calEventMime = "application/x-tinode-calendar"
+
+	// Maximum length of the title and the location of an event, runes.
+	calEventMaxText = 256
+	// Default and maximum time between the reminder and the start of the event, minutes.
+	calEventDefaultRemind = 15
+	calEventMaxRemind     = 7 * 24 * 60
+
+	// How often to check for reminders which are due.
+	calEventCheckPeriod = time.Minute
+	// Maximum number of reminders sent in one pass.
+	calEventBlockSize = 100
+
+	// Events which started less than this long ago are still listed by {get what="events"}.
+	calEventListPast = 24 * time.Hour
+	// Maximum number of events returned by {get what="events"}.
+	calEventMaxListed = 32
+)
+
+// calEventContent is the content of a message which announces an event.
+type calEventContent struct {
+	Title    string     `json:"title"`
+	Start    *time.Time `json:"start"`
+	End      *time.Time `json:"end,omitempty"`
+	Location string     `json:"location,omitempty"`
+	// Minutes before the start when the reminder is sent, 0 for no reminder.
+	Remind *int `json:"remind,omitempty"`
+}
+
+// calEventParse extracts the event from the message. Returns nil if the message does not announce
+// an event. The second value is false if the message announces an event but the event is malformed.
+func calEventParse(head map[string]interface{}, content interface{}) (*types.CalEvent, bool) {
+	if mime, _ := head["mime"].(string); mime != calEventMime {
+		return nil, true
+	}
+
+	var cnt calEventContent
+	raw, err := json.Marshal(content)
+	if err == nil {
+		err = json.Unmarshal(raw, &cnt)
+	}
+	if err != nil || cnt.Title == "" || cnt.Start == nil ||
+		utf8.RuneCountInString(cnt.Title) > calEventMaxText || utf8.RuneCountInString(cnt.Location) > calEventMaxText ||
+		(cnt.End != nil && cnt.End.Before(*cnt.Start)) {
+		return nil, false
+	}
+
+	remind := calEventDefaultRemind
+	if cnt.Remind != nil {
+		remind = *cnt.Remind
+	}
+	if remind < 0 || remind > calEventMaxRemind {
+		return nil, false
+	}
+
+	ev := &types.CalEvent{
+		Title:    cnt.Title,
+		Location: cnt.Location,
+		StartAt:  cnt.Start.UTC().Round(time.Millisecond),
+	}
+	if cnt.End != nil {
+		end := cnt.End.UTC().Round(time.Millisecond)
+		ev.EndAt = &end
+	}
+	if remind > 0 && ev.StartAt.After(types.TimeNow()) {
+		remindAt := ev.StartAt.Add(-time.Duration(remind) * time.Minute)
+		ev.RemindAt = &remindAt
+	}
+	return ev, true
+}
+
+// calEventsRun periodically sends reminders which are due. Reminders are sent by the cluster node
+// which hosts the topic.
+func calEventsRun(period time.Duration, block int) chan<- bool {
+	// Unbuffered stop channel. Whoever stops it must wait for the process to finish.
+	stop := make(chan bool)
+	go func() {
+		timer := time.Tick(period)
+		for {
+			select {
+			case <-timer:
+				now := types.TimeNow()
+				events, err := store.CalEvents.GetDue(now, block)
+				if err != nil {
+					log.Println("events:", err)
+					continue
+				}
+				for i := range events {
+					if globals.cluster.isRemoteTopic(events[i].Topic) {
+						continue
+					}
+					calEventRemind(&events[i], now)
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	return stop
+}
+
+// calEventRemind sends a push notification about the upcoming event to members of the topic
+// who did not decline it.
+func calEventRemind(ev *types.CalEvent, now time.Time) {
+	// The reminder is sent once even if the push fails.
+	if err := store.CalEvents.Reminded(ev.Topic, ev.SeqId); err != nil {
+		log.Println("events: failed to mark reminder as sent", ev.Topic, ev.SeqId, err)
+		return
+	}
+	if !ev.StartAt.After(now) {
+		// Too late for a reminder.
+		return
+	}
+
+	// The event is cancelled if the message has been deleted.
+	messages, err := store.Messages.GetAll(ev.Topic, types.ZeroUid,
+		&types.QueryOpt{Since: ev.SeqId, Before: ev.SeqId + 1, Limit: 1})
+	if err != nil {
+		log.Println("events: failed to get message", ev.Topic, ev.SeqId, err)
+		return
+	}
+	if len(messages) == 0 {
+		return
+	}
+
+	subs, err := store.Topics.GetSubs(ev.Topic, nil)
+	if err != nil {
+		log.Println("events: failed to get subscribers", ev.Topic, err)
+		return
+	}
+
+	rcpt := &push.Receipt{
+		To: make(map[types.Uid]push.Recipient, len(subs)),
+		Payload: push.Payload{
+			What:      push.ActReminder,
+			Topic:     ev.Topic,
+			Timestamp: ev.StartAt,
+			SeqId:     ev.SeqId,
+			Content:   ev.Title,
+			Link:      permalinkMake(ev.Topic, ev.SeqId)}}
+	for i := range subs {
+		sub := &subs[i]
+		mode := sub.ModeWant & sub.ModeGiven
+		if !mode.IsReader() || !notifyAll(mode, sub.Notify) || muteUntilFromStored(sub.MuteUntil).After(now) {
+			continue
+		}
+		if sub.Quiet != nil && !quietHoursUntil(sub.Quiet.Start, sub.Quiet.End, sub.Quiet.TzOffset, now).IsZero() {
+			continue
+		}
+		if ev.Rsvp[sub.User] == types.RsvpNo {
+			continue
+		}
+		rcpt.To[types.ParseUid(sub.User)] = push.Recipient{}
+	}
+	if len(rcpt.To) > 0 {
+		usersPush(rcpt)
+	}
+}
+
+// calEventCreate saves the event announced by the message which has just been saved.
+func (t *Topic) calEventCreate(ev *types.CalEvent, seq int) {
+	ev.Topic = t.name
+	ev.SeqId = seq
+	if err := store.CalEvents.Create(ev); err != nil {
+		log.Printf("topic[%s]: failed to save event: %v", t.name, err)
+	}
+}
+
+// calEventToMsg converts the event to the form sent to the client: responses are counted,
+// the user's own response is reported separately.
+func calEventToMsg(ev *types.CalEvent, asUid types.Uid) MsgCalEvent {
+	startAt := ev.StartAt
+	msg := MsgCalEvent{
+		SeqId:    ev.SeqId,
+		Title:    ev.Title,
+		Location: ev.Location,
+		Start:    &startAt,
+		End:      ev.EndAt,
+	}
+	if len(ev.Rsvp) > 0 {
+		msg.Rsvp = make(map[string]int)
+		for _, resp := range ev.Rsvp {
+			msg.Rsvp[resp]++
+		}
+	}
+	if !asUid.IsZero() {
+		msg.Own = ev.Rsvp[asUid.String()]
+	}
+	return msg
+}
+
+// replyGetEvents returns current and upcoming events of the group topic with responses of members.
+func (t *Topic) replyGetEvents(sess *Session, asUid types.Uid, msg *ClientComMessage) error {
+	now := types.TimeNow()
+
+	asChan, err := t.verifyChannelAccess(msg.Original)
+	if err != nil {
+		sess.queueOut(ErrNotFoundReply(msg, now))
+		return types.ErrNotFound
+	}
+	if t.cat != types.TopicCatGrp {
+		sess.queueOut(ErrOperationNotAllowedReply(msg, now))
+		return errors.New("get.events: invalid topic category")
+	}
+	if pud, ok := t.perUser[asUid]; !asChan && (!ok || !(pud.modeGiven & pud.modeWant).IsReader()) {
+		sess.queueOut(ErrPermissionDeniedReply(msg, now))
+		return errors.New("get.events: no read permission")
+	}
+
+	events, err := store.CalEvents.GetAll(t.name, now.Add(-calEventListPast), calEventMaxListed)
+	if err != nil {
+		sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, msg.Original, now, msg.Timestamp, nil))
+		return err
+	}
+	if len(events) == 0 {
+		sess.queueOut(NoContentParamsReply(msg, now, map[string]string{"what": "events"}))
+		return nil
+	}
+
+	if asChan {
+		// Channel readers don't respond to events.
+		asUid = types.ZeroUid
+	}
+	list := make([]MsgCalEvent, 0, len(events))
+	for i := range events {
+		list = append(list, calEventToMsg(&events[i], asUid))
+	}
+
+	sess.queueOut(&ServerComMessage{
+		Meta: &MsgServerMeta{Id: msg.Id, Topic: msg.Original, Timestamp: &now, Events: list}})
+
+	return nil
+}
+
+// replySetRsvp records the response of the member to the event and lets other members know.
+func (t *Topic) replySetRsvp(sess *Session, asUid types.Uid, msg *ClientComMessage) error {
+	now := types.TimeNow()
+
+	if asChan, err := t.verifyChannelAccess(msg.Original); err != nil || asChan || t.cat != types.TopicCatGrp {
+		sess.queueOut(ErrOperationNotAllowedReply(msg, now))
+		return errors.New("set.rsvp: not a member of a group topic")
+	}
+	pud, ok := t.perUser[asUid]
+	if !ok || pud.deleted || !(pud.modeGiven & pud.modeWant).IsReader() {
+		sess.queueOut(ErrPermissionDeniedReply(msg, now))
+		return errors.New("set.rsvp: no read permission")
+	}
+
+	req := msg.Set.Rsvp
+	switch req.Resp {
+	case types.RsvpYes, types.RsvpNo, types.RsvpMaybe, "":
+	default:
+		sess.queueOut(ErrMalformedReply(msg, now))
+		return errors.New("set.rsvp: invalid response")
+	}
+	if req.SeqId <= 0 || req.SeqId > t.lastID {
+		sess.queueOut(ErrMalformedReply(msg, now))
+		return errors.New("set.rsvp: invalid seq ID")
+	}
+
+	ev, err := store.CalEvents.Get(t.name, req.SeqId)
+	if err == nil && ev == nil {
+		err = types.ErrNotFound
+	}
+	if err != nil {
+		sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, msg.Original, now, msg.Timestamp, nil))
+		return err
+	}
+	if ev.Rsvp[asUid.String()] == req.Resp {
+		sess.queueOut(InfoNotModifiedReply(msg, now))
+		return nil
+	}
+
+	if err = store.CalEvents.Rsvp(t.name, req.SeqId, asUid, req.Resp); err != nil {
+		sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, msg.Original, now, msg.Timestamp, nil))
+		return err
+	}
+	sess.queueOut(NoErrReply(msg, now))
+
+	// Members update the counts of responses themselves.
+	t.handleBroadcast(&ServerComMessage{
+		Info: &MsgServerInfo{
+			Topic: msg.Original,
+			From:  asUid.UserId(),
+			What:  "rsvp",
+			SeqId: req.SeqId,
+			Act:   req.Resp},
+		RcptTo:    t.name,
+		AsUser:    asUid.UserId(),
+		Timestamp: now,
+		SkipSid:   sess.sid})
+
+	return nil
+}
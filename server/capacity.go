@@ -0,0 +1,236 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *    Limit of readers attached to a channel at the same time, e.g. for
+ *    ticketed live events. Readers over the limit are rejected with a delay
+ *    to retry or wait in a queue and receive updates of their position.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"errors"
+	"log"
+	"sync/atomic"
+
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+// What happens to readers over the limit.
+const (
+	capacityReject = "reject"
+	capacityQueue  = "queue"
+)
+
+const (
+	// Delay before a rejected reader should try again if the owner did not set one, seconds.
+	capacityDefaultRetry = 60
+	// Maximum delay before a rejected reader should try again, seconds.
+	capacityMaxRetry = 24 * 3600
+	// Maximum number of readers waiting in the queue. Readers are rejected when the queue is full.
+	capacityMaxQueue = 10000
+)
+
+// capacityDesc converts the limit of readers for reporting in topic description, nil if not set.
+func capacityDesc(capacity types.TopicCapacity) *MsgTopicCapacity {
+	if capacity.Max == 0 {
+		return nil
+	}
+	return &MsgTopicCapacity{Max: capacity.Max, Overflow: capacity.Overflow, RetryAfter: capacity.RetryAfter}
+}
+
+// capacityReaders counts the readers attached to the channel, including guests.
+// Readers attached through other cluster nodes are not counted.
+func (t *Topic) capacityReaders() int {
+	readers := 0
+	for _, pssd := range t.sessions {
+		if pssd.isChanSub {
+			readers++
+		}
+	}
+	return readers
+}
+
+// capacityAdmit checks if the reader may attach to the channel. If the channel is full, the reader
+// is queued or rejected depending on the policy of the channel and false is returned. The error
+// is not nil if the reader is rejected.
+func (t *Topic) capacityAdmit(join *sessionJoin) (bool, error) {
+	if t.capacity.Max == 0 || !t.isChan || !isChannel(join.pkt.Original) || join.admitted {
+		return true, nil
+	}
+	if _, ok := t.sessions[join.sess]; ok {
+		// Already attached.
+		return true, nil
+	}
+	if t.capacityReaders() < t.capacity.Max && len(t.capQueue) == 0 {
+		return true, nil
+	}
+
+	now := types.TimeNow()
+	if t.capacity.Overflow == capacityQueue && !join.sess.isMultiplex() {
+		pos := t.capacityEnqueue(join)
+		if pos > 0 {
+			reply := NoErrAccepted(join.pkt.Id, join.pkt.Original, now)
+			reply.Ctrl.Params = map[string]interface{}{"what": "capacity", "limit": t.capacity.Max, "position": pos}
+			join.sess.queueOut(reply)
+			return false, nil
+		}
+	}
+
+	retry := t.capacity.RetryAfter
+	if retry == 0 {
+		retry = capacityDefaultRetry
+	}
+	resp := ErrPolicyReply(join.pkt, now)
+	resp.Ctrl.Params = map[string]interface{}{"what": "capacity", "limit": t.capacity.Max, "retry": retry}
+	join.sess.queueOut(resp)
+	return false, errors.New("channel is full")
+}
+
+// capacityEnqueue adds the reader to the queue or replaces the earlier request of the same session.
+// Returns the position of the reader in the queue starting with 1, or 0 if the queue is full.
+func (t *Topic) capacityEnqueue(join *sessionJoin) int {
+	for i, queued := range t.capQueue {
+		if queued.sess == join.sess {
+			t.capQueue[i] = join
+			return i + 1
+		}
+	}
+	if len(t.capQueue) >= capacityMaxQueue {
+		return 0
+	}
+	t.capQueue = append(t.capQueue, join)
+	return len(t.capQueue)
+}
+
+// capacityUpdate lets waiting readers into the channel while there are free slots, sends the
+// new positions to the readers who are still waiting and notifies the webhook when the channel
+// becomes full or stops being full.
+func (t *Topic) capacityUpdate(h *Hub) {
+	if t.capacity.Max == 0 && len(t.capQueue) == 0 && !t.capFull {
+		return
+	}
+
+	// Readers who disconnected while waiting are forgotten.
+	queue := t.capQueue[:0]
+	for _, join := range t.capQueue {
+		if atomic.LoadInt32(&join.sess.terminating) == 0 {
+			queue = append(queue, join)
+		}
+	}
+	for i := len(queue); i < len(t.capQueue); i++ {
+		t.capQueue[i] = nil
+	}
+	t.capQueue = queue
+
+	admitted := 0
+	for len(t.capQueue) > 0 && (t.capacity.Max == 0 || t.capacityReaders() < t.capacity.Max) {
+		join := t.capQueue[0]
+		t.capQueue[0] = nil
+		t.capQueue = t.capQueue[1:]
+		join.admitted = true
+		if err := t.handleSubscription(h, join); err != nil {
+			log.Printf("topic[%s] failed to attach queued reader %v, sid=%s", t.name, err, join.sess.sid)
+		}
+		admitted++
+	}
+
+	if admitted > 0 {
+		now := types.TimeNow()
+		for i, join := range t.capQueue {
+			reply := NoErrAccepted(join.pkt.Id, join.pkt.Original, now)
+			reply.Ctrl.Params = map[string]interface{}{"what": "capacity", "limit": t.capacity.Max, "position": i + 1}
+			join.sess.queueOut(reply)
+		}
+	}
+
+	full := t.capacity.Max > 0 && t.capacityReaders() >= t.capacity.Max
+	if full != t.capFull {
+		t.capFull = full
+		t.fireCapacityHook(full)
+	}
+}
+
+// fireCapacityHook reports to the webhook that the channel is full or has free slots again.
+func (t *Topic) fireCapacityHook(full bool) {
+	if t.isProxy || t.webhook.Url == "" {
+		return
+	}
+	state := "open"
+	if full {
+		state = "full"
+	}
+	hookFire(&t.webhook, &hookEvent{
+		Event:     hookEventCapacity,
+		Topic:     types.GrpToChn(t.name),
+		State:     state,
+		Readers:   t.capacityReaders(),
+		Queued:    len(t.capQueue),
+		Timestamp: types.TimeNow(),
+	})
+}
+
+// replySetCapacity sets or removes the limit of readers of the channel, owner only.
+func (t *Topic) replySetCapacity(h *Hub, sess *Session, asUid types.Uid, msg *ClientComMessage) error {
+	now := types.TimeNow()
+
+	if t.cat != types.TopicCatGrp || !t.isChan {
+		sess.queueOut(ErrOperationNotAllowedReply(msg, now))
+		return errors.New("set.capacity: not a channel")
+	}
+	if !t.isOwner(asUid) {
+		sess.queueOut(ErrPermissionDeniedReply(msg, now))
+		return errors.New("set.capacity: request by non-owner")
+	}
+
+	req := msg.Set.Capacity
+	capacity := types.TopicCapacity{Max: req.Max, Overflow: req.Overflow, RetryAfter: req.RetryAfter}
+	if capacity.Overflow == "" {
+		capacity.Overflow = capacityReject
+	}
+	if capacity.Max < 0 || capacity.RetryAfter < 0 || capacity.RetryAfter > capacityMaxRetry ||
+		(capacity.Overflow != capacityReject && capacity.Overflow != capacityQueue) {
+		sess.queueOut(ErrMalformedReply(msg, now))
+		return errors.New("set.capacity: invalid limit")
+	}
+	if capacity.Max == 0 {
+		capacity = types.TopicCapacity{}
+	}
+	if capacity == t.capacity {
+		sess.queueOut(InfoNotModifiedReply(msg, now))
+		return nil
+	}
+
+	if err := store.Topics.Update(t.name, map[string]interface{}{
+		"Capacity": capacity, "UpdatedAt": now}); err != nil {
+		sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, msg.Original, now, msg.Timestamp, nil))
+		return err
+	}
+
+	t.capacity = capacity
+	t.updated = now
+	sess.queueOut(NoErrReply(msg, now))
+
+	// Readers already attached stay. Waiting readers are let in if the limit is raised or removed,
+	// and rejected if the queue is disabled.
+	if capacity.Overflow != capacityQueue {
+		queue := t.capQueue
+		t.capQueue = nil
+		for _, join := range queue {
+			if capacity.Max == 0 || t.capacityReaders() < capacity.Max {
+				join.admitted = true
+				if err := t.handleSubscription(h, join); err != nil {
+					log.Printf("topic[%s] failed to attach queued reader %v, sid=%s", t.name, err, join.sess.sid)
+				}
+				continue
+			}
+			t.capacityAdmit(join)
+		}
+	}
+	t.capacityUpdate(h)
+
+	return nil
+}
@@ -0,0 +1,134 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *    Read and received pointers of channel readers. Readers are not cached
+ *    with the subscribers of the topic: their pointers are loaded when the
+ *    reader acknowledges a message and saved to the 'chnXXX' subscription
+ *    the same way as pointers of group subscribers. The reader's other
+ *    devices are notified of the change.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"log"
+
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+// chanCursor is the read and received pointers of a channel reader.
+type chanCursor struct {
+	readID int
+	recvID int
+}
+
+// chanCursorGet returns the pointers of the channel reader, nil if the user is not a reader.
+func (t *Topic) chanCursorGet(uid types.Uid) (*chanCursor, error) {
+	if cur := t.chanCursors[uid]; cur != nil {
+		return cur, nil
+	}
+
+	sub, err := store.Subs.Get(types.GrpToChn(t.name), uid)
+	if err != nil || sub == nil || !(sub.ModeGiven & sub.ModeWant).IsReader() {
+		return nil, err
+	}
+
+	if t.chanCursors == nil {
+		t.chanCursors = make(map[types.Uid]*chanCursor)
+	}
+	cur := &chanCursor{readID: sub.ReadSeqId, recvID: max(sub.RecvSeqId, sub.ReadSeqId)}
+	t.chanCursors[uid] = cur
+	return cur, nil
+}
+
+// chanCursorForget drops the cached pointers of the user who is no longer a channel reader.
+func (t *Topic) chanCursorForget(uid types.Uid) {
+	delete(t.chanCursors, uid)
+}
+
+// chanCursorsPrune drops the cached pointers of readers who are not attached to the channel.
+func (t *Topic) chanCursorsPrune() {
+	if len(t.chanCursors) == 0 {
+		return
+	}
+
+	attached := make(map[types.Uid]bool)
+	for _, pssd := range t.sessions {
+		if pssd.isChanSub {
+			attached[pssd.uid] = true
+		}
+	}
+	for uid := range t.chanCursors {
+		if !attached[uid] {
+			delete(t.chanCursors, uid)
+		}
+	}
+}
+
+// chanReaderNote handles {note what="read"} and {note what="recv"} from a channel reader.
+// Returns true if the pointer has moved and the note should be forwarded to the reader's other
+// sessions attached to the channel.
+func (t *Topic) chanReaderNote(msg *ServerComMessage) bool {
+	if (msg.Info.What != "read" && msg.Info.What != "recv") || msg.Info.SeqId > t.lastID {
+		return false
+	}
+	if t.isProxy {
+		// The master topic has saved the pointers already.
+		return true
+	}
+
+	uid := types.ParseUserId(msg.Info.From)
+	cur, err := t.chanCursorGet(uid)
+	if err != nil {
+		log.Printf("topic[%s]: failed to load channel reader %s: %v", t.name, uid.UserId(), err)
+		return false
+	}
+	if cur == nil {
+		// Not a reader of the channel.
+		return false
+	}
+
+	// Changes are applied to the cursor only after they are persisted.
+	readID, recvID := cur.readID, cur.recvID
+	if msg.Info.What == "read" {
+		if msg.Info.SeqId <= readID {
+			return false
+		}
+		readID = msg.Info.SeqId
+	} else {
+		if msg.Info.SeqId <= recvID {
+			return false
+		}
+		recvID = msg.Info.SeqId
+	}
+	// Message which was read was also received.
+	if readID > recvID {
+		recvID = readID
+	}
+
+	if err := store.Subs.Update(types.GrpToChn(t.name), uid, map[string]interface{}{
+		"RecvSeqId": recvID,
+		"ReadSeqId": readID}, false); err != nil {
+		log.Printf("topic[%s]: failed to update channel reader's SeqRead/Recv counter: %v", t.name, err)
+		return false
+	}
+	read := readID > cur.readID
+	cur.readID, cur.recvID = readID, recvID
+
+	// Announce to user's other sessions on 'me' if they are not attached to the channel.
+	globals.hub.routeMsg(&ServerComMessage{
+		Pres: &MsgServerPres{Topic: "me", What: msg.Info.What,
+			Src: types.GrpToChn(t.xoriginal), SeqId: msg.Info.SeqId, SkipTopic: t.name},
+		RcptTo: uid.UserId(), SkipSid: msg.SkipSid})
+
+	if read {
+		// New channel messages are not counted for each reader as they are published,
+		// the count of unread messages is loaded again with the channel included.
+		usersRecountUnread(uid)
+	}
+
+	return true
+}
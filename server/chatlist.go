@@ -0,0 +1,118 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *    Pinned topics and folders of the user's chat list, synced across devices.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"errors"
+	"unicode/utf8"
+
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+const (
+	// Maximum number of folders in the chat list.
+	chatListMaxFolders = 32
+	// Maximum length of a folder name (runes) or a topic name.
+	chatListMaxName = 64
+	// Maximum number of topic references in the chat list: pinned and in all folders.
+	chatListMaxTopics = 1024
+)
+
+// chatListFromMsg validates the chat list sent by the client and converts it to the stored form.
+func chatListFromMsg(src *MsgChatList) (types.ChatList, error) {
+	list := types.ChatList{Pinned: src.Pinned}
+	if len(src.Folders) > chatListMaxFolders {
+		return types.ChatList{}, types.ErrPolicy
+	}
+
+	count := len(src.Pinned)
+	if !chatListTopicsValid(src.Pinned) {
+		return types.ChatList{}, types.ErrMalformed
+	}
+	names := make(map[string]bool, len(src.Folders))
+	for _, f := range src.Folders {
+		if f.Name == "" || utf8.RuneCountInString(f.Name) > chatListMaxName || names[f.Name] {
+			return types.ChatList{}, types.ErrMalformed
+		}
+		if !chatListTopicsValid(f.Topics) {
+			return types.ChatList{}, types.ErrMalformed
+		}
+		names[f.Name] = true
+		count += len(f.Topics)
+		list.Folders = append(list.Folders, types.ChatFolder{Name: f.Name, Topics: f.Topics})
+	}
+	if count > chatListMaxTopics {
+		return types.ChatList{}, types.ErrPolicy
+	}
+
+	return list, nil
+}
+
+// chatListTopicsValid checks that the list has no duplicates and all topics are named as in
+// the subscriptions of 'me': usrXXX for P2P topics, grpXXX and chnXXX for group topics and channels.
+func chatListTopicsValid(topics []string) bool {
+	seen := make(map[string]bool, len(topics))
+	for _, topic := range topics {
+		if len(topic) <= 3 || len(topic) > chatListMaxName || seen[topic] {
+			return false
+		}
+		if prefix := topic[:3]; prefix != "usr" && prefix != "grp" && prefix != "chn" {
+			return false
+		}
+		seen[topic] = true
+	}
+	return true
+}
+
+// chatListToMsg converts the stored chat list to the form sent to the client. Returns nil if the list is empty.
+func chatListToMsg(list *types.ChatList) *MsgChatList {
+	if list.IsEmpty() {
+		return nil
+	}
+	dst := &MsgChatList{Pinned: list.Pinned}
+	for _, f := range list.Folders {
+		dst.Folders = append(dst.Folders, MsgChatFolder{Name: f.Name, Topics: f.Topics})
+	}
+	return dst
+}
+
+// replySetChatList replaces pinned topics and folders of the user's chat list, 'me' only.
+func (t *Topic) replySetChatList(sess *Session, asUid types.Uid, msg *ClientComMessage) error {
+	now := types.TimeNow()
+
+	if t.cat != types.TopicCatMe {
+		sess.queueOut(ErrOperationNotAllowedReply(msg, now))
+		return errors.New("set.chatlist: invalid topic category")
+	}
+
+	list, err := chatListFromMsg(msg.Set.ChatList)
+	if err != nil {
+		sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, t.original(asUid), now, msg.Timestamp, nil))
+		return err
+	}
+
+	if list.IsEmpty() && t.chatList.IsEmpty() {
+		sess.queueOut(InfoNotModifiedReply(msg, now))
+		return nil
+	}
+
+	if err := store.Users.Update(asUid, map[string]interface{}{"ChatList": list}); err != nil {
+		sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, t.original(asUid), now, msg.Timestamp, nil))
+		return err
+	}
+
+	t.chatList = list
+
+	// Let user's other sessions know the chat list has changed.
+	t.presSubsOnline("chatlist", "", nilPresParams, nilPresFilters, sess.sid)
+	sess.queueOut(NoErrReply(msg, now))
+
+	return nil
+}
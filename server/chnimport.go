@@ -0,0 +1,258 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *    Bulk import of channel readers, e.g. when migrating an audience from
+ *    another platform.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"log"
+	"strings"
+
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+const (
+	// Maximum number of users in one import request.
+	chnImportMaxUsers = 10000
+	// Number of users processed between progress reports.
+	chnImportBatchSize = 100
+	// Maximum number of users not found listed in the final report.
+	chnImportMaxMissing = 100
+)
+
+// chnImport is an import of channel readers in progress.
+type chnImport struct {
+	// Request which started the import, the progress is reported in response to it.
+	msg  *ClientComMessage
+	sess *Session
+	// Name of the group topic and of the channel.
+	grp string
+	chn string
+	// Users to import: user IDs or credentials like "email:alice@example.com".
+	users []string
+
+	// Users subscribed as channel readers.
+	added int
+	// Users already subscribed to the topic or the channel.
+	skipped int
+	// Users which could not be found.
+	missing []string
+}
+
+// chnImportStart validates the import request and starts processing it in the background.
+func chnImportStart(sess *Session, msg *ClientComMessage) error {
+	now := types.TimeNow()
+	req := msg.Set.Import
+
+	grp := types.ChnToGrp(req.Topic)
+	if grp == "" || len(req.Users) == 0 {
+		sess.queueOut(ErrMalformedReply(msg, now))
+		return types.ErrMalformed
+	}
+	if len(req.Users) > chnImportMaxUsers {
+		sess.queueOut(ErrPolicyLimitReply(msg, now, "users", chnImportMaxUsers))
+		return types.ErrPolicy
+	}
+
+	topic, err := store.Topics.Get(grp)
+	if err != nil {
+		sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, msg.Original, now, msg.Timestamp, nil))
+		return err
+	}
+	if topic == nil || !topic.UseBt {
+		sess.queueOut(ErrNotFoundReply(msg, now))
+		return types.ErrNotFound
+	}
+
+	imp := &chnImport{
+		msg:   msg,
+		sess:  sess,
+		grp:   grp,
+		chn:   types.GrpToChn(grp),
+		users: req.Users,
+	}
+
+	reply := NoErrAccepted(msg.Id, msg.Original, now)
+	reply.Ctrl.Params = imp.progress(0)
+	sess.queueOut(reply)
+
+	go imp.run()
+
+	return nil
+}
+
+// run subscribes the users in batches and reports progress after each batch.
+func (imp *chnImport) run() {
+	for start := 0; start < len(imp.users); start += chnImportBatchSize {
+		end := start + chnImportBatchSize
+		if end > len(imp.users) {
+			end = len(imp.users)
+		}
+		if err := imp.batch(imp.users[start:end]); err != nil {
+			log.Println("chnimport: failed to import readers", imp.chn, err)
+			imp.sess.queueOut(decodeStoreErrorExplicitTs(err, imp.msg.Id, imp.msg.Original,
+				types.TimeNow(), imp.msg.Timestamp, imp.progress(start)))
+			return
+		}
+
+		if end < len(imp.users) {
+			reply := NoErrAccepted(imp.msg.Id, imp.msg.Original, types.TimeNow())
+			reply.Ctrl.Params = imp.progress(end)
+			imp.sess.queueOut(reply)
+		}
+	}
+
+	log.Printf("chnimport: %s readers added: %d, skipped: %d, not found: %d", imp.chn,
+		imp.added, imp.skipped, len(imp.missing))
+
+	params := imp.progress(len(imp.users))
+	if len(imp.missing) > 0 {
+		missing := imp.missing
+		if len(missing) > chnImportMaxMissing {
+			missing = missing[:chnImportMaxMissing]
+		}
+		params["notfound"] = missing
+	}
+	imp.sess.queueOut(NoErrParamsReply(imp.msg, types.TimeNow(), params))
+}
+
+// batch subscribes a batch of users to the channel.
+func (imp *chnImport) batch(users []string) error {
+	var subs []*types.Subscription
+	seen := make(map[types.Uid]bool, len(users))
+	now := types.TimeNow()
+
+	uids := make([]types.Uid, 0, len(users))
+	for _, user := range users {
+		uid, err := chnImportResolve(user)
+		if err != nil {
+			return err
+		}
+		if uid.IsZero() {
+			imp.missing = append(imp.missing, user)
+			continue
+		}
+		if seen[uid] {
+			imp.skipped++
+			continue
+		}
+		seen[uid] = true
+		uids = append(uids, uid)
+	}
+
+	if len(uids) == 0 {
+		return nil
+	}
+
+	// Skip users which don't exist or are deleted.
+	found, err := store.Users.GetAll(uids...)
+	if err != nil {
+		return err
+	}
+	exists := make(map[types.Uid]bool, len(found))
+	for i := range found {
+		exists[found[i].Uid()] = true
+	}
+
+	for _, uid := range uids {
+		if !exists[uid] {
+			imp.missing = append(imp.missing, uid.UserId())
+			continue
+		}
+
+		// Full subscribers of the topic and existing readers are left as they are.
+		subscribed, err := imp.isSubscribed(uid)
+		if err != nil {
+			return err
+		}
+		if subscribed {
+			imp.skipped++
+			continue
+		}
+
+		subs = append(subs, &types.Subscription{
+			User:      uid.String(),
+			Topic:     imp.chn,
+			ModeWant:  types.ModeCChnReader,
+			ModeGiven: types.ModeCChnReader,
+			CreatedAt: now,
+		})
+	}
+
+	if len(subs) == 0 {
+		return nil
+	}
+
+	if err := store.Subs.Create(subs...); err != nil {
+		return err
+	}
+	imp.added += len(subs)
+
+	for _, sub := range subs {
+		// Subscribe to FCM topic (channel) for push notifications.
+		pushChannelSub(types.ParseUid(sub.User), imp.chn, true)
+		pluginSubscription(sub, plgActCreate)
+	}
+
+	return nil
+}
+
+// isSubscribed checks if the user is subscribed to the topic or to the channel.
+func (imp *chnImport) isSubscribed(uid types.Uid) (bool, error) {
+	for _, name := range []string{imp.grp, imp.chn} {
+		sub, err := store.Subs.Get(name, uid)
+		if err != nil || sub != nil {
+			return sub != nil, err
+		}
+	}
+	return false, nil
+}
+
+// progress formats the state of the import for reporting to the client.
+func (imp *chnImport) progress(done int) map[string]interface{} {
+	return map[string]interface{}{
+		"what":    "import",
+		"topic":   imp.chn,
+		"total":   len(imp.users),
+		"done":    done,
+		"added":   imp.added,
+		"skipped": imp.skipped,
+		"missing": len(imp.missing),
+	}
+}
+
+// chnImportResolve finds the user by ID or by credential such as "email:alice@example.com".
+// An address without the method is treated as an email. Returns zero Uid if the user is not found.
+func chnImportResolve(user string) (types.Uid, error) {
+	if uid := types.ParseUserId(user); !uid.IsZero() {
+		return uid, nil
+	}
+
+	method, value := "email", user
+	if parts := strings.SplitN(user, ":", 2); len(parts) == 2 {
+		method, value = parts[0], parts[1]
+	} else if !strings.Contains(user, "@") {
+		return types.ZeroUid, nil
+	}
+
+	method = strings.ToLower(strings.TrimSpace(method))
+	value = strings.TrimSpace(value)
+	if method == "email" {
+		value = strings.ToLower(value)
+	}
+	if value == "" {
+		return types.ZeroUid, nil
+	}
+
+	uid, err := store.Users.GetByCred(method, value)
+	if err == types.ErrNotFound {
+		err = nil
+	}
+	return uid, err
+}
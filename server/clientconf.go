@@ -0,0 +1,326 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *    Server-driven client configuration: feature flags, URLs and limits
+ *    selected by organization, application and its version.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tinode/chat/server/store/types"
+)
+
+// Default interval between checks of the client configuration file for changes.
+const defaultClientConfCheckInterval = 30 * time.Second
+
+// clientConfConfig is the "client_config" section of the server config.
+type clientConfConfig struct {
+	// Path to the JSON file with the client configuration.
+	File string `json:"file"`
+	// Interval in seconds between checks of the file for changes. Negative value disables live updates.
+	CheckInterval int `json:"check_interval"`
+}
+
+// clientConfRule is a configuration applied to the matching clients.
+type clientConfRule struct {
+	// Organization of the user, as reported by the authenticator at login.
+	Org string `json:"org"`
+	// Name of the client application, the first token of the User-Agent, e.g. "TinodeWeb".
+	App string `json:"app"`
+	// Client platform: "web", "android", "ios".
+	Platform string `json:"platform"`
+	// Range of application versions, inclusive.
+	MinVer string `json:"min_ver"`
+	MaxVer string `json:"max_ver"`
+	// Configuration values, merged into the result.
+	Config map[string]interface{} `json:"config"`
+
+	minVer int
+	maxVer int
+}
+
+// clientConfRules is the content of the client configuration file.
+type clientConfRules struct {
+	// Configuration sent to all clients.
+	Default map[string]interface{} `json:"default"`
+	// Rules applied on top of the default configuration in the order of declaration.
+	Rules []clientConfRule `json:"rules"`
+}
+
+// clientClass identifies clients which receive the same configuration.
+type clientClass struct {
+	org      string
+	app      string
+	ver      int
+	platform string
+}
+
+var clientConf struct {
+	sync.RWMutex
+	rules   *clientConfRules
+	path    string
+	modTime time.Time
+}
+
+// clientConfInit loads the client configuration and starts watching it for changes.
+func clientConfInit(jsconfig json.RawMessage, rootpath string) error {
+	if len(jsconfig) == 0 {
+		return nil
+	}
+
+	var config clientConfConfig
+	if err := json.Unmarshal(jsconfig, &config); err != nil {
+		return errors.New("failed to parse config: " + err.Error())
+	}
+	if config.File == "" {
+		return nil
+	}
+
+	clientConf.path = toAbsolutePath(rootpath, config.File)
+	if _, err := clientConfReload(); err != nil {
+		return err
+	}
+
+	if config.CheckInterval >= 0 {
+		interval := time.Duration(config.CheckInterval) * time.Second
+		if interval == 0 {
+			interval = defaultClientConfCheckInterval
+		}
+		go func() {
+			for range time.Tick(interval) {
+				old, err := clientConfReload()
+				if err != nil {
+					log.Println("client config: failed to reload", err)
+				} else if old != nil {
+					clientConfBroadcast(old)
+				}
+			}
+		}()
+	}
+
+	return nil
+}
+
+// clientConfReload reads the configuration file if it has changed since the last read.
+// Returns the previous rules if the file was reloaded.
+func clientConfReload() (*clientConfRules, error) {
+	info, err := os.Stat(clientConf.path)
+	if err != nil {
+		return nil, err
+	}
+	if info.ModTime().Equal(clientConf.modTime) {
+		return nil, nil
+	}
+
+	data, err := ioutil.ReadFile(clientConf.path)
+	if err != nil {
+		return nil, err
+	}
+	var rules clientConfRules
+	if err = json.Unmarshal(data, &rules); err != nil {
+		return nil, errors.New("failed to parse " + clientConf.path + ": " + err.Error())
+	}
+	for i := range rules.Rules {
+		rule := &rules.Rules[i]
+		if rule.MinVer != "" {
+			if rule.minVer = parseVersion(rule.MinVer); rule.minVer == 0 {
+				return nil, errors.New("invalid min_ver '" + rule.MinVer + "'")
+			}
+		}
+		if rule.MaxVer != "" {
+			if rule.maxVer = parseVersion(rule.MaxVer); rule.maxVer == 0 {
+				return nil, errors.New("invalid max_ver '" + rule.MaxVer + "'")
+			}
+		}
+	}
+
+	clientConf.Lock()
+	old := clientConf.rules
+	clientConf.rules = &rules
+	clientConf.modTime = info.ModTime()
+	clientConf.Unlock()
+
+	if old == nil {
+		old = &clientConfRules{}
+	}
+	return old, nil
+}
+
+// matches checks if the rule applies to the class of clients.
+func (rule *clientConfRule) matches(class *clientClass) bool {
+	if rule.Org != "" && rule.Org != class.org {
+		return false
+	}
+	if rule.App != "" && !strings.EqualFold(rule.App, class.app) {
+		return false
+	}
+	if rule.Platform != "" && rule.Platform != class.platform {
+		return false
+	}
+	if rule.minVer != 0 && (class.ver == 0 || class.ver < rule.minVer) {
+		return false
+	}
+	if rule.maxVer != 0 && (class.ver == 0 || class.ver > rule.maxVer) {
+		return false
+	}
+	return true
+}
+
+// configFor builds the configuration for the class of clients.
+func (rules *clientConfRules) configFor(class *clientClass) map[string]interface{} {
+	if rules == nil {
+		return nil
+	}
+	config := clientConfMerge(nil, rules.Default)
+	for i := range rules.Rules {
+		if rules.Rules[i].matches(class) {
+			config = clientConfMerge(config, rules.Rules[i].Config)
+		}
+	}
+	return config
+}
+
+// clientConfMerge merges src into dst recursively: nested objects are merged, all other values are replaced.
+// The src is not modified, the dst is modified and returned.
+func clientConfMerge(dst, src map[string]interface{}) map[string]interface{} {
+	if len(src) == 0 {
+		return dst
+	}
+	if dst == nil {
+		dst = make(map[string]interface{}, len(src))
+	}
+	for key, val := range src {
+		if obj, ok := val.(map[string]interface{}); ok {
+			prev, _ := dst[key].(map[string]interface{})
+			dst[key] = clientConfMerge(prev, obj)
+		} else {
+			dst[key] = val
+		}
+	}
+	return dst
+}
+
+// clientClassFor describes the session for selecting the client configuration.
+func clientClassFor(ua, platform, org string) *clientClass {
+	app, ver := appFromUA(ua)
+	return &clientClass{org: org, app: app, ver: ver, platform: platform}
+}
+
+// appFromUA extracts the name and version of the application from the User-Agent string
+// such as "TinodeWeb/0.16.5 (MacOS; en-US); tinodejs/0.16.5".
+func appFromUA(ua string) (string, int) {
+	if i := strings.IndexAny(ua, " ;("); i >= 0 {
+		ua = ua[:i]
+	}
+	parts := strings.SplitN(ua, "/", 2)
+	if len(parts) < 2 {
+		return parts[0], 0
+	}
+	return parts[0], parseVersion(parts[1])
+}
+
+// minClientVersion is the minimum supported version of a client application on a platform.
+type minClientVersion struct {
+	// Name of the application, the first token of the User-Agent. If set, other applications
+	// on the platform are not checked.
+	App string `json:"app"`
+	// Minimum supported version, e.g. "0.17.2".
+	Version string `json:"version"`
+	// URL of the application in the app store.
+	Url string `json:"url"`
+	// Accept older clients in read-only mode instead of rejecting them.
+	ReadOnly bool `json:"read_only"`
+
+	ver int
+}
+
+// clientUpgradeRequired checks if the client must be upgraded. Returns the applicable requirement
+// or nil if the client is up to date or its version cannot be determined.
+func clientUpgradeRequired(ua, platform string) *minClientVersion {
+	mcv := liveConfig().minClientVersions[platform]
+	if mcv == nil {
+		return nil
+	}
+	app, ver := appFromUA(ua)
+	if ver == 0 || (mcv.App != "" && !strings.EqualFold(mcv.App, app)) || ver >= mcv.ver {
+		return nil
+	}
+	return mcv
+}
+
+// params formats the requirement for reporting to the client.
+func (mcv *minClientVersion) params(platform string) map[string]interface{} {
+	params := map[string]interface{}{
+		"what":    "upgrade",
+		"platf":   platform,
+		"min_ver": mcv.Version}
+	if mcv.Url != "" {
+		params["url"] = mcv.Url
+	}
+	if mcv.ReadOnly {
+		params["readonly"] = true
+	}
+	return params
+}
+
+// clientConfGet returns the client configuration for the class of clients.
+func clientConfGet(class *clientClass) map[string]interface{} {
+	clientConf.RLock()
+	defer clientConf.RUnlock()
+
+	return clientConf.rules.configFor(class)
+}
+
+// clientConfBroadcast sends the updated configuration to the sessions whose configuration has changed.
+func clientConfBroadcast(old *clientConfRules) {
+	clientConf.RLock()
+	rules := clientConf.rules
+	clientConf.RUnlock()
+
+	now := types.TimeNow()
+	changed := make(map[clientClass]map[string]interface{})
+	unchanged := make(map[clientClass]bool)
+	var count int
+	globals.sessionStore.Range(func(sid string, s *Session) bool {
+		if s.isMultiplex() || s.isProxy() {
+			return true
+		}
+		class, _ := s.confClass.Load().(*clientClass)
+		if class == nil {
+			// The session has not sent {hi} yet.
+			return true
+		}
+		if unchanged[*class] {
+			return true
+		}
+		config, ok := changed[*class]
+		if !ok {
+			config = rules.configFor(class)
+			if reflect.DeepEqual(config, old.configFor(class)) {
+				unchanged[*class] = true
+				return true
+			}
+			changed[*class] = config
+		}
+		s.queueOut(NoErrClientConfig(config, now))
+		count++
+		return true
+	})
+
+	if count > 0 {
+		log.Println("client config: update sent to sessions:", count)
+	}
+}
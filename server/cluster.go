@@ -68,6 +68,8 @@ type clusterConfig struct {
 	NumProxyEventGoRoutines int `json:"-"`
 	// Failover configuration
 	Failover *clusterFailoverConfig
+	// Warm standby configuration
+	Standby *clusterStandbyConfig `json:"standby"`
 }
 
 // ClusterNode is a client's connection to another node.
@@ -417,6 +419,8 @@ type Cluster struct {
 
 	// Failover parameters. Could be nil if failover is not enabled
 	fo *clusterFailover
+	// Warm standby parameters. Could be nil if warm standby is not enabled
+	sb *clusterStandby
 }
 
 // TopicMaster is a gRPC endpoint which receives requests sent by proxy topic to master topic.
@@ -492,11 +496,11 @@ func (c *Cluster) TopicMaster(msg *ClusterReq, rejected *bool) error {
 			sess: sess,
 		}
 		select {
-		case globals.hub.join <- join:
+		case globals.hub.shardFor(msg.CliMsg.RcptTo).join <- join:
 		default:
 			// Reply with a 500 to the user.
 			sess.queueOut(ErrUnknownReply(msg.CliMsg, msg.CliMsg.Timestamp))
-			log.Println("cluster: join req failed - hub.join queue full, topic ", msg.CliMsg.RcptTo, "; orig sid ", sess.sid)
+			queueOverflow("cluster.join", queueHubJoin, msg.CliMsg.RcptTo, sess.sid, len(globals.hub.shardFor(msg.CliMsg.RcptTo).join))
 		}
 
 	case ProxyReqLeave:
@@ -518,7 +522,7 @@ func (c *Cluster) TopicMaster(msg *ClusterReq, rejected *bool) error {
 				}:
 			default:
 				sess.queueOut(ErrUnknownReply(msg.CliMsg, msg.CliMsg.Timestamp))
-				log.Println("cluster: meta req failed - topic.meta queue full, topic ", msg.CliMsg.RcptTo, "; orig sid ", sess.sid)
+				queueOverflow("cluster.meta", queueTopicMeta, msg.CliMsg.RcptTo, sess.sid, len(t.meta))
 			}
 		} else {
 			log.Println("cluster: meta request for unknown topic", msg.RcptTo)
@@ -528,9 +532,9 @@ func (c *Cluster) TopicMaster(msg *ClusterReq, rejected *bool) error {
 		// sess could be nil
 		msg.SrvMsg.sess = sess
 		select {
-		case globals.hub.route <- msg.SrvMsg:
+		case globals.hub.shardFor(msg.SrvMsg.RcptTo).route <- msg.SrvMsg:
 		default:
-			log.Println("cluster: route req failed - hub.route queue full")
+			queueOverflow("cluster.route", queueHubRoute, msg.SrvMsg.RcptTo, "", len(globals.hub.shardFor(msg.SrvMsg.RcptTo).route))
 		}
 
 	case ProxyReqBgSession, ProxyReqMeUserAgent:
@@ -594,7 +598,7 @@ func (c *Cluster) Route(msg *ClusterRoute, rejected *bool) error {
 		*rejected = true
 		return nil
 	}
-	globals.hub.route <- msg.SrvMsg
+	globals.hub.routeMsg(msg.SrvMsg)
 	return nil
 }
 
@@ -812,13 +816,16 @@ func (c *Cluster) makeClusterReq(reqType ProxyReqType, payload interface{}, topi
 	}
 
 	if sess != nil {
+		activeUid, authLvl, _ := sess.activeAccount()
 		if uid.IsZero() {
-			uid = sess.uid
+			uid = activeUid
+		} else if lvl, _, ok := sess.account(uid); ok {
+			authLvl = lvl
 		}
 
 		req.Sess = &ClusterSess{
 			Uid:         uid,
-			AuthLvl:     sess.authLvl,
+			AuthLvl:     authLvl,
 			RemoteAddr:  sess.remoteAddr,
 			UserAgent:   sess.userAgent,
 			Ver:         sess.ver,
@@ -976,6 +983,7 @@ func clusterInit(configString json.RawMessage, self *string) int {
 	if !globals.cluster.failoverInit(config.Failover) {
 		globals.cluster.rehash(nil)
 	}
+	globals.cluster.standbyInit(config.Standby)
 
 	sort.Strings(nodeNames)
 	workerId := sort.SearchStrings(nodeNames, thisName) + 1
@@ -1067,6 +1075,7 @@ func (c *Cluster) rehash(nodes []string) []string {
 	ring.Add(ringKeys...)
 
 	c.ring = ring
+	c.standbyRehash(ringKeys)
 
 	return ringKeys
 }
@@ -1078,7 +1087,7 @@ func (c *Cluster) rehash(nodes []string) []string {
 // TODO: consider resubscribing to topics instead of forcing sessions to resubscribe.
 func (c *Cluster) invalidateProxySubs(forNode string) {
 	sessions := make(map[*Session][]string)
-	globals.hub.topics.Range(func(_, v interface{}) bool {
+	globals.hub.topicsRange(func(_, v interface{}) bool {
 		topic := v.(*Topic)
 		if !topic.isProxy {
 			// Topic either isn't a proxy.
@@ -1205,7 +1214,10 @@ func (t *Topic) clusterWriteLoop() {
 			} else {
 				response.OrigReqType = srvMsg.sess.proxyReq
 				response.OrigSid = srvMsg.sess.sid
-				srvMsg.AsUser = srvMsg.sess.uid.UserId()
+				if srvMsg.AsUser == "" {
+					activeUid, _, _ := srvMsg.sess.activeAccount()
+					srvMsg.AsUser = activeUid.UserId()
+				}
 
 				switch srvMsg.sess.proxyReq {
 				case ProxyReqJoin, ProxyReqLeave, ProxyReqMeta, ProxyReqBgSession, ProxyReqMeUserAgent:
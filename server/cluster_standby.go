@@ -0,0 +1,315 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	rh "github.com/tinode/chat/server/ringhash"
+	"github.com/tinode/chat/server/store/types"
+)
+
+// Cluster methods related to warm standby of topics. The master node of a busy group topic periodically
+// sends the state of the topic to the standby node: the node which becomes the master of the topic if the
+// current master fails. When the topic is moved to the standby node after a failover, the replicated state
+// is merged with the state loaded from the database and the users who were online in the topic before the
+// failover are not announced again.
+
+const (
+	// Default interval between replications of the state of a topic.
+	defaultStandbyInterval = time.Second
+	// Default minimum number of subscribers of a topic for the topic to be replicated.
+	defaultStandbyMinSubs = 100
+	// Replicated state older than this is discarded.
+	clusterStandbyMaxAge = 5 * time.Minute
+)
+
+type clusterStandbyConfig struct {
+	// Warm standby is enabled.
+	Enabled bool `json:"enabled"`
+	// Time in milliseconds between replications of the state of a topic.
+	Interval int `json:"interval"`
+	// Minimum number of subscribers of a topic for the topic to be replicated.
+	MinSubs int `json:"min_subs"`
+}
+
+// Warm standby parameters and the state of topics replicated to this node.
+type clusterStandby struct {
+	// Interval between replications of the state of a topic.
+	interval time.Duration
+	// Minimum number of subscribers of a replicated topic.
+	minSubs int
+	// Ring hash of live nodes except the current one: maps topic names to their standby nodes.
+	ring *rh.Ring
+
+	// Guards topics.
+	lock sync.Mutex
+	// State of topics replicated to this node by their masters.
+	topics map[string]*clusterStandbyTopic
+}
+
+// Replicated state of one topic.
+type clusterStandbyTopic struct {
+	state    *ClusterTopicState
+	received time.Time
+}
+
+// ClusterUserState is the replicated state of a subscriber of a topic.
+type ClusterUserState struct {
+	ReadID int
+	RecvID int
+	DlvID  int
+	// The user has at least one session attached to the topic.
+	Online bool
+}
+
+// ClusterTopicState is the state of a topic sent by the master node to the standby node.
+type ClusterTopicState struct {
+	// Name of the master node which sent the state.
+	Node string
+	// Name of the topic.
+	Topic string
+	// The state replaces the previously sent state rather than updates it.
+	Full bool
+	// The topic is unloaded at the master; the state should be discarded.
+	Gone bool
+
+	LastID int
+	DelID  int
+	// Subscribers whose state changed since the last replication.
+	Users map[types.Uid]ClusterUserState
+}
+
+// Replication state of a topic at the master node.
+type topicStandby struct {
+	// Name of the standby node the state was last sent to.
+	node   string
+	lastID int
+	delID  int
+	// State of subscribers last sent to the standby node.
+	users map[types.Uid]ClusterUserState
+}
+
+func (c *Cluster) standbyInit(config *clusterStandbyConfig) {
+	if config == nil || !config.Enabled {
+		return
+	}
+	if c.fo == nil {
+		log.Println("cluster: warm standby disabled; requires failover")
+		return
+	}
+
+	c.sb = &clusterStandby{
+		interval: time.Duration(config.Interval) * time.Millisecond,
+		minSubs:  config.MinSubs,
+		topics:   make(map[string]*clusterStandbyTopic),
+	}
+	if c.sb.interval <= 0 {
+		c.sb.interval = defaultStandbyInterval
+	}
+	if c.sb.minSubs <= 0 {
+		c.sb.minSubs = defaultStandbyMinSubs
+	}
+	c.standbyRehash(c.fo.activeNodes)
+
+	log.Println("cluster: warm standby enabled")
+}
+
+// standbyRehash recalculates standby nodes of topics using the provided list of live nodes.
+func (c *Cluster) standbyRehash(nodes []string) {
+	if c.sb == nil {
+		return
+	}
+
+	ring := rh.New(clusterHashReplicas, nil)
+	for _, name := range nodes {
+		if name != c.thisNodeName {
+			ring.Add(name)
+		}
+	}
+	c.sb.ring = ring
+
+	// Drop replicated state which is too old to be useful.
+	c.sb.lock.Lock()
+	for name, entry := range c.sb.topics {
+		if time.Since(entry.received) > clusterStandbyMaxAge {
+			delete(c.sb.topics, name)
+		}
+	}
+	c.sb.lock.Unlock()
+}
+
+// standbyNodeForTopic returns the node which takes over the topic if the current node fails.
+func (c *Cluster) standbyNodeForTopic(topic string) *ClusterNode {
+	if c == nil || c.sb == nil || c.sb.ring.Len() == 0 {
+		return nil
+	}
+	return c.nodes[c.sb.ring.Get(topic)]
+}
+
+// TopicState is a gRPC endpoint which receives the state of topics from their master nodes.
+func (c *Cluster) TopicState(msg *ClusterTopicState, unused *bool) error {
+	if c.nodes[msg.Node] == nil {
+		log.Println("cluster TopicState: request from an unknown node", msg.Node)
+		return nil
+	}
+	if c.sb == nil {
+		return nil
+	}
+
+	c.sb.lock.Lock()
+	defer c.sb.lock.Unlock()
+
+	if msg.Gone {
+		delete(c.sb.topics, msg.Topic)
+		return nil
+	}
+
+	entry := c.sb.topics[msg.Topic]
+	if msg.Full || entry == nil || entry.state.Node != msg.Node {
+		if msg.Users == nil {
+			msg.Users = make(map[types.Uid]ClusterUserState)
+		}
+		c.sb.topics[msg.Topic] = &clusterStandbyTopic{state: msg, received: time.Now()}
+		return nil
+	}
+
+	entry.state.LastID = msg.LastID
+	entry.state.DelID = msg.DelID
+	for uid, user := range msg.Users {
+		entry.state.Users[uid] = user
+	}
+	entry.received = time.Now()
+	return nil
+}
+
+// standbyTake returns and forgets the replicated state of the topic. Returns nil if there is none.
+func (c *Cluster) standbyTake(topic string) *ClusterTopicState {
+	if c == nil || c.sb == nil {
+		return nil
+	}
+
+	c.sb.lock.Lock()
+	defer c.sb.lock.Unlock()
+
+	entry := c.sb.topics[topic]
+	if entry == nil {
+		return nil
+	}
+	delete(c.sb.topics, topic)
+	if time.Since(entry.received) > clusterStandbyMaxAge {
+		return nil
+	}
+	return entry.state
+}
+
+// standbyEnabled checks if the state of the topic may be replicated to a standby node.
+func (t *Topic) standbyEnabled() bool {
+	return globals.cluster != nil && globals.cluster.sb != nil && t.cat == types.TopicCatGrp && !t.isProxy
+}
+
+// standbyReplicate sends the changes to the state of the topic to the standby node.
+func (t *Topic) standbyReplicate() {
+	if len(t.perUser) < globals.cluster.sb.minSubs {
+		return
+	}
+
+	node := globals.cluster.standbyNodeForTopic(t.name)
+	if node == nil {
+		return
+	}
+
+	full := t.standby == nil || t.standby.node != node.name
+	if full {
+		t.standby = &topicStandby{node: node.name, users: make(map[types.Uid]ClusterUserState)}
+	}
+
+	users := make(map[types.Uid]ClusterUserState)
+	for uid, pud := range t.perUser {
+		user := ClusterUserState{ReadID: pud.readID, RecvID: pud.recvID, DlvID: pud.dlvID, Online: pud.online > 0}
+		if sent, ok := t.standby.users[uid]; !ok || sent != user {
+			users[uid] = user
+			t.standby.users[uid] = user
+		}
+	}
+	if !full && len(users) == 0 && t.standby.lastID == t.lastID && t.standby.delID == t.delID {
+		// Nothing has changed.
+		return
+	}
+	t.standby.lastID, t.standby.delID = t.lastID, t.delID
+
+	var unused bool
+	call := node.callAsync("Cluster.TopicState", &ClusterTopicState{
+		Node:   globals.cluster.thisNodeName,
+		Topic:  t.name,
+		Full:   full,
+		LastID: t.lastID,
+		DelID:  t.delID,
+		Users:  users}, &unused, nil)
+	if call.Error != nil {
+		// Node is not connected. Send the full state next time.
+		t.standby = nil
+	}
+}
+
+// standbyGone tells the standby node that the topic is unloaded and the replicated state is no longer needed.
+func (t *Topic) standbyGone() {
+	if t.standby == nil || globals.cluster == nil {
+		return
+	}
+
+	if node := globals.cluster.nodes[t.standby.node]; node != nil {
+		var unused bool
+		node.callAsync("Cluster.TopicState", &ClusterTopicState{
+			Node:  globals.cluster.thisNodeName,
+			Topic: t.name,
+			Gone:  true}, &unused, nil)
+	}
+	t.standby = nil
+}
+
+// standbyRestore merges the state replicated by the previous master of the topic with the state loaded
+// from the database.
+func (t *Topic) standbyRestore() {
+	if t.isProxy {
+		return
+	}
+
+	state := globals.cluster.standbyTake(t.name)
+	if state == nil {
+		return
+	}
+
+	t.lastID = max(t.lastID, state.LastID)
+	t.delID = max(t.delID, state.DelID)
+
+	t.standbyOnline = make(map[types.Uid]bool)
+	for uid, user := range state.Users {
+		pud, ok := t.perUser[uid]
+		if !ok {
+			// Unsubscribed in the meantime.
+			continue
+		}
+		pud.readID = max(pud.readID, user.ReadID)
+		pud.recvID = max(pud.recvID, user.RecvID)
+		pud.dlvID = max(pud.dlvID, user.DlvID)
+		if user.Online {
+			t.standbyOnline[uid] = true
+		}
+	}
+
+	// Subscribers have been told that the topic is online before the failover.
+	t.markLoaded()
+
+	log.Printf("topic[%s]: restored warm state from node '%s'", t.name, state.Node)
+}
+
+// standbyWasOnline checks if the user was online in the topic before the failover and has not
+// been announced yet.
+func (t *Topic) standbyWasOnline(uid types.Uid) bool {
+	if !t.standbyOnline[uid] {
+		return false
+	}
+	delete(t.standbyOnline, uid)
+	return true
+}
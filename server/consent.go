@@ -0,0 +1,195 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *    User's consent to sharing data: engagement analytics, promotional pushes,
+ *    read receipts and last seen time.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"errors"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tinode/chat/server/push"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+// How long the cached consent is used before it's read from the database again.
+// Consent may be changed at another cluster node.
+const consentCacheTTL = time.Minute
+
+type consentCached struct {
+	consent  types.Consent
+	loadedAt time.Time
+}
+
+// consents caches choices of users, types.Uid -> *consentCached.
+var consents sync.Map
+
+// consentSet replaces the cached consent of the user.
+func consentSet(uid types.Uid, consent types.Consent) {
+	consents.Store(uid, &consentCached{consent: consent, loadedAt: time.Now()})
+}
+
+// consentPeek returns the cached consent of the user without reading it from the database,
+// nil if it's not cached or the cached copy is too old.
+func consentPeek(uid types.Uid) *types.Consent {
+	if val, ok := consents.Load(uid); ok {
+		cached := val.(*consentCached)
+		if time.Since(cached.loadedAt) < consentCacheTTL {
+			consent := cached.consent
+			return &consent
+		}
+	}
+	return nil
+}
+
+// consentOf returns the consent of the subscriber as known to the topic, nil if unknown. The consent
+// is loaded when the user attaches to the topic, a change made at this node is picked up from the cache.
+// Never reads the database.
+func (t *Topic) consentOf(uid types.Uid, pud *perUserData) *types.Consent {
+	if consent := consentPeek(uid); consent != nil {
+		pud.consent = consent
+	}
+	return pud.consent
+}
+
+// consentGet returns the consent of the user reading it from the database if it's not cached
+// or the cached copy is too old.
+func consentGet(uid types.Uid) types.Consent {
+	if consent := consentPeek(uid); consent != nil {
+		return *consent
+	}
+
+	user, err := store.Users.Get(uid)
+	if err != nil {
+		log.Println("consent: failed to load user", uid.UserId(), err)
+		return types.Consent{}
+	}
+
+	var consent types.Consent
+	if user != nil {
+		consent = user.Consent
+	}
+	consentSet(uid, consent)
+	return consent
+}
+
+// pushChannelSub subscribes user's devices to push notifications of the channel or unsubscribes them.
+// Users who did not consent to promotional pushes are never subscribed.
+func pushChannelSub(uid types.Uid, chn string, sub bool) {
+	if sub {
+		consent := consentGet(uid)
+		sub = consent.AllowsMarketing()
+	}
+	push.ChannelSub(&push.ChannelReq{
+		Uid:     uid,
+		Channel: chn,
+		Unsub:   !sub})
+}
+
+// consentAllowsReceipts checks if the user agreed to share read receipts with others.
+func consentAllowsReceipts(uid types.Uid) bool {
+	consent := consentGet(uid)
+	return consent.AllowsReadReceipts()
+}
+
+// consentToMsg converts the consent to the form sent to the client with all choices resolved.
+func consentToMsg(consent *types.Consent) *MsgConsent {
+	analytics, marketing := consent.AllowsAnalytics(), consent.AllowsMarketing()
+	receipts, lastSeen := consent.AllowsReadReceipts(), consent.AllowsLastSeen()
+	return &MsgConsent{Analytics: &analytics, Marketing: &marketing, Receipts: &receipts, LastSeen: &lastSeen}
+}
+
+// replyGetConsent returns the choices of the user on sharing data, 'me' only.
+func (t *Topic) replyGetConsent(sess *Session, asUid types.Uid, msg *ClientComMessage) error {
+	now := types.TimeNow()
+
+	if t.cat != types.TopicCatMe {
+		sess.queueOut(ErrOperationNotAllowedReply(msg, now))
+		return errors.New("get.consent: invalid topic category")
+	}
+
+	sess.queueOut(&ServerComMessage{
+		Meta: &MsgServerMeta{Id: msg.Id, Topic: t.original(asUid), Timestamp: &now,
+			Consent: consentToMsg(&t.consent)}})
+
+	return nil
+}
+
+// replySetConsent changes the choices of the user on sharing data, 'me' only. Choices missing from
+// the request are not changed.
+func (t *Topic) replySetConsent(sess *Session, asUid types.Uid, msg *ClientComMessage) error {
+	now := types.TimeNow()
+
+	if t.cat != types.TopicCatMe {
+		sess.queueOut(ErrOperationNotAllowedReply(msg, now))
+		return errors.New("set.consent: invalid topic category")
+	}
+
+	req := msg.Set.Consent
+	consent := t.consent
+	if req.Analytics != nil {
+		consent.Analytics = req.Analytics
+	}
+	if req.Marketing != nil {
+		consent.Marketing = req.Marketing
+	}
+	if req.Receipts != nil {
+		consent.ReadReceipts = req.Receipts
+	}
+	if req.LastSeen != nil {
+		consent.LastSeen = req.LastSeen
+	}
+
+	update := map[string]interface{}{"Consent": consent}
+	if !consent.AllowsLastSeen() && t.consent.AllowsLastSeen() {
+		// Forget when the user was last online.
+		update["LastSeen"] = nil
+		update["UserAgent"] = ""
+	}
+	if err := store.Users.Update(asUid, update); err != nil {
+		sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, t.original(asUid), now, msg.Timestamp, nil))
+		return err
+	}
+
+	marketingChanged := consent.AllowsMarketing() != t.consent.AllowsMarketing()
+	t.consent = consent
+	consentSet(asUid, consent)
+
+	if marketingChanged {
+		go consentResubChannels(asUid, consent.AllowsMarketing())
+	}
+
+	// Let user's other sessions know the consent has changed.
+	t.presSubsOnline("consent", "", nilPresParams, nilPresFilters, sess.sid)
+	sess.queueOut(NoErrReply(msg, now))
+
+	return nil
+}
+
+// consentResubChannels subscribes devices of the user to push notifications of user's channels
+// or unsubscribes them after the user changed consent to promotional pushes.
+func consentResubChannels(uid types.Uid, allowed bool) {
+	subs, err := store.Users.GetSubs(uid, nil)
+	if err != nil {
+		log.Println("consent: failed to load subscriptions", uid.UserId(), err)
+		return
+	}
+	for i := range subs {
+		sub := &subs[i]
+		if !strings.HasPrefix(sub.Topic, "chn") {
+			continue
+		}
+		// Readers who receive digests or turned off notifications are not subscribed.
+		want := allowed && (sub.ModeWant & sub.ModeGiven).IsPresencer() && !digestActive(sub.Topic, uid)
+		pushChannelSub(uid, sub.Topic, want)
+	}
+}
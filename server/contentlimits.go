@@ -0,0 +1,76 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *    Limits on the size and the number of attachments of messages published
+ *    to a group topic, set by the owner within the global limits.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+
+	"github.com/tinode/chat/server/drafty"
+	"github.com/tinode/chat/server/store/types"
+)
+
+// contentLimitsParse validates the limits requested by the topic owner. If a limit exceeds
+// the global limit, the name and the value of the global limit are returned.
+func contentLimitsParse(req *MsgTopicLimits) (types.TopicLimits, string, int, error) {
+	if req.MaxMessageSize < 0 || req.MaxAttachments < 0 {
+		return types.TopicLimits{}, "", 0, errors.New("negative content limits")
+	}
+	live := liveConfig()
+	if req.MaxMessageSize > live.maxMessageSize {
+		return types.TopicLimits{}, "size", int(live.maxMessageSize), errors.New("message size limit is too high")
+	}
+	if req.MaxAttachments > live.maxAttachments {
+		return types.TopicLimits{}, "attachments", live.maxAttachments, errors.New("attachment limit is too high")
+	}
+	return types.TopicLimits{MaxMessageSize: req.MaxMessageSize, MaxAttachments: req.MaxAttachments}, "", 0, nil
+}
+
+// contentLimitsDesc converts the limits of the topic for reporting in topic description, nil if not set.
+func contentLimitsDesc(limits types.TopicLimits) *MsgTopicLimits {
+	if limits == (types.TopicLimits{}) {
+		return nil
+	}
+	return &MsgTopicLimits{MaxMessageSize: limits.MaxMessageSize, MaxAttachments: limits.MaxAttachments}
+}
+
+// contentAllowed checks the message against the limits of the topic and the global limits.
+// If the message exceeds a limit, the sender is notified and false is returned.
+func (t *Topic) contentAllowed(msg *ServerComMessage, asUid types.Uid) bool {
+	if isSysEvent(msg.Data) {
+		return true
+	}
+
+	what, limit := "", 0
+	maxAttachments := liveConfig().maxAttachments
+	if t.limits.MaxAttachments > 0 && t.limits.MaxAttachments < maxAttachments {
+		maxAttachments = t.limits.MaxAttachments
+	}
+	if drafty.Attachments(msg.Data.Content) > maxAttachments {
+		what, limit = "attachments", maxAttachments
+	} else if t.limits.MaxMessageSize > 0 {
+		// The global size limit is enforced by the transport, the content is measured only if the topic is stricter.
+		if content, err := json.Marshal(msg.Data.Content); err != nil || int64(len(content)) > t.limits.MaxMessageSize {
+			what, limit = "size", int(t.limits.MaxMessageSize)
+		}
+	}
+	if what == "" {
+		return true
+	}
+
+	if msg.sess != nil {
+		resp := ErrPolicy(msg.Id, t.original(asUid), msg.Timestamp)
+		resp.Ctrl.Params = map[string]interface{}{"what": what, "limit": limit}
+		msg.sess.queueOut(resp)
+	}
+	log.Printf("topic[%s]: message rejected, %s limit %d exceeded", t.name, what, limit)
+	return false
+}
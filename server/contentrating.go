@@ -0,0 +1,147 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *    Language and content rating of group topics. Both are kept as tags
+ *    managed by the server, so topics can be found by language and topics
+ *    rated for adults can be hidden from minors in search results.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"golang.org/x/text/language"
+)
+
+const (
+	// Tag namespaces managed by the server.
+	contentLangTagNS   = "lang"
+	contentRatingTagNS = "rating"
+
+	// Rating of topics hidden from minors.
+	contentRatingAdult = "adult"
+
+	// Default age of majority.
+	defaultAdultAge = 18
+
+	// Format of the date of birth.
+	birthdateLayout = "2006-01-02"
+)
+
+// Valid content ratings.
+var contentRatings = map[string]bool{
+	"general":          true,
+	"teen":             true,
+	contentRatingAdult: true,
+}
+
+// contentLangParse validates the language of the topic, returns the normalized value or an empty
+// string if the language is cleared.
+func contentLangParse(lang string) (string, error) {
+	if lang == nullValue {
+		return "", nil
+	}
+	tag, err := language.Parse(lang)
+	if err != nil {
+		return "", err
+	}
+	return strings.ToLower(tag.String()), nil
+}
+
+// contentRatingParse validates the content rating of the topic, returns an empty string if the rating is cleared.
+func contentRatingParse(rating string) (string, error) {
+	if rating == nullValue {
+		return "", nil
+	}
+	if !contentRatings[rating] {
+		return "", errors.New("unknown content rating '" + rating + "'")
+	}
+	return rating, nil
+}
+
+// contentTagValue returns the value of the server-managed tag in the namespace ns, e.g. "es" for "lang:es".
+func contentTagValue(tags []string, ns string) string {
+	for _, tag := range tags {
+		if strings.HasPrefix(tag, ns+":") {
+			return tag[len(ns)+1:]
+		}
+	}
+	return ""
+}
+
+// contentTagSet replaces the value of the server-managed tag in the namespace ns.
+// Returns the updated tags and true if they have changed.
+func contentTagSet(tags []string, ns, value string) ([]string, bool) {
+	if contentTagValue(tags, ns) == value {
+		return tags, false
+	}
+	updated := make([]string, 0, len(tags)+1)
+	for _, tag := range tags {
+		if !strings.HasPrefix(tag, ns+":") {
+			updated = append(updated, tag)
+		}
+	}
+	if value != "" {
+		updated = append(updated, ns+":"+value)
+	}
+	return updated, true
+}
+
+// contentDescTags applies the language and the rating requested in topic description to tags.
+// Returns the updated tags and true if they have changed.
+func contentDescTags(tags []string, desc *MsgSetDesc) ([]string, bool, error) {
+	var changed bool
+	if desc.Lang != "" {
+		lang, err := contentLangParse(desc.Lang)
+		if err != nil {
+			return nil, false, err
+		}
+		tags, changed = contentTagSet(tags, contentLangTagNS, lang)
+	}
+	if desc.Rating != "" {
+		rating, err := contentRatingParse(desc.Rating)
+		if err != nil {
+			return nil, false, err
+		}
+		var ratingChanged bool
+		tags, ratingChanged = contentTagSet(tags, contentRatingTagNS, rating)
+		changed = changed || ratingChanged
+	}
+	return tags, changed, nil
+}
+
+// birthdateParse validates the date of birth of the user.
+func birthdateParse(birthdate string, now time.Time) error {
+	date, err := time.Parse(birthdateLayout, birthdate)
+	if err != nil {
+		return err
+	}
+	if !date.Before(now) {
+		return errors.New("date of birth in the future")
+	}
+	return nil
+}
+
+// isAdult checks if the user born on birthdate has reached the age of majority. Users with unknown
+// date of birth are treated as minors.
+func isAdult(birthdate string, now time.Time) bool {
+	date, err := time.Parse(birthdateLayout, birthdate)
+	if err != nil {
+		return false
+	}
+	return !date.AddDate(liveConfig().adultAge, 0, 0).After(now)
+}
+
+// contentFindExclude returns the tags of topics which must not be found by the user of 'fnd': topics
+// rated for adults are hidden from minors by the database query.
+func (t *Topic) contentFindExclude(now time.Time) []string {
+	if isAdult(t.birthdate, now) {
+		return nil
+	}
+	return []string{contentRatingTagNS + ":" + contentRatingAdult}
+}
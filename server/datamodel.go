@@ -18,6 +18,12 @@ import (
 	"github.com/tinode/chat/server/store/types"
 )
 
+// MsgGetFilter selects messages by their attachments.
+type MsgGetFilter struct {
+	// MIME types of attachments, e.g. "image/png", or "image/*" for any image.
+	Mime []string `json:"mime,omitempty"`
+}
+
 // MsgGetOpts defines Get query parameters.
 type MsgGetOpts struct {
 	// Optional User ID to return result(s) for one user.
@@ -35,6 +41,16 @@ type MsgGetOpts struct {
 	// Pagination parameters
 	Order         string     `json:"order,omitempty"`
 	LastCreatedAt *time.Time `json:"lastCreatedAt,omitempty"`
+	// Load only replies in the thread started by the message with this ID.
+	Thread int `json:"thread,omitempty"`
+	// Load only messages with this type of media, e.g. "audio".
+	Type string `json:"type,omitempty"`
+	// Load only messages with attachments of the given types.
+	Filter *MsgGetFilter `json:"filter,omitempty"`
+	// Full-text query: find messages matching it.
+	Query string `json:"q,omitempty"`
+	// Include child topics of the space, 'grp' only.
+	Children bool `json:"children,omitempty"`
 }
 
 // MsgGetQuery is a topic metadata or data query.
@@ -45,10 +61,90 @@ type MsgGetQuery struct {
 	Desc *MsgGetOpts `json:"desc,omitempty"`
 	// Parameters of "sub" request: User, Topic, IfModifiedSince, Limit.
 	Sub *MsgGetOpts `json:"sub,omitempty"`
-	// Parameters of "data" request: Since, Before, Limit.
+	// Parameters of "data" request: Since, Before, Limit, Thread, Type, Filter, Query.
 	Data *MsgGetOpts `json:"data,omitempty"`
 	// Parameters of "del" request: Since, Before, Limit.
 	Del *MsgGetOpts `json:"del,omitempty"`
+	// Parameters of "emoji" request: short codes to resolve.
+	Emoji *MsgGetEmoji `json:"emoji,omitempty"`
+	// Parameters of "gap" request: client's sync state.
+	Gap *MsgGetGap `json:"gap,omitempty"`
+	// Parameters of "link" request: message to create a permalink to.
+	Link *MsgGetLink `json:"link,omitempty"`
+	// Parameters of "guests" request: guest token to issue.
+	Guests *MsgGetGuests `json:"guests,omitempty"`
+	// Parameters of "translate" request: message to translate.
+	Translate *MsgGetTranslate `json:"translate,omitempty"`
+	// Parameters of "devices" request: User.
+	Devices *MsgGetOpts `json:"devices,omitempty"`
+	// Parameters of "receipts" request: message to get receipts of.
+	Receipts *MsgGetReceipts `json:"receipts,omitempty"`
+	// Parameters of "stats" request in the 'sys' topic: Topic.
+	Stats *MsgGetOpts `json:"stats,omitempty"`
+	// Parameters of "poll" request: message which created the poll.
+	Poll *MsgGetPoll `json:"poll,omitempty"`
+	// Parameters of "directory" request in the 'fnd' topic: category, sort order and page.
+	Directory *MsgGetDirectory `json:"directory,omitempty"`
+}
+
+// MsgGetDirectory is a payload of get.directory request.
+type MsgGetDirectory struct {
+	// Category of topics to list.
+	Category string `json:"category"`
+	// Sort order: "activity" (default) or "members".
+	Sort string `json:"sort,omitempty"`
+	// Position returned with the previous page, empty for the first page.
+	Cursor string `json:"cursor,omitempty"`
+	// Maximum number of topics on the page.
+	Limit int `json:"limit,omitempty"`
+}
+
+// MsgGetPoll is a payload of get.poll request.
+type MsgGetPoll struct {
+	// SeqId of the message which created the poll.
+	Seq int `json:"seq"`
+}
+
+// MsgGetReceipts is a payload of get.receipts request.
+type MsgGetReceipts struct {
+	// SeqId of the message.
+	Seq int `json:"seq"`
+}
+
+// MsgGetGap is a payload of get.gap request: the state of the client's copy of the topic.
+type MsgGetGap struct {
+	// Highest SeqId such that the client has all messages up to it.
+	Seq int `json:"seq"`
+	// Latest delete ID known to the client.
+	Clear int `json:"clear,omitempty"`
+	// Maximum number of messages to send.
+	Limit int `json:"limit,omitempty"`
+}
+
+// MsgGetGuests is a payload of get.guests request.
+type MsgGetGuests struct {
+	// Lifetime of the guest token in seconds.
+	Ttl int `json:"ttl,omitempty"`
+}
+
+// MsgGetLink is a payload of get.link request.
+type MsgGetLink struct {
+	// ID of the message.
+	Seq int `json:"seq"`
+}
+
+// MsgGetTranslate is a payload of get.translate request.
+type MsgGetTranslate struct {
+	// ID of the message.
+	Seq int `json:"seq"`
+	// Language to translate the message to, e.g. "en".
+	Lang string `json:"lang"`
+}
+
+// MsgGetEmoji is a payload of get.emoji request.
+type MsgGetEmoji struct {
+	// Short codes to resolve. If empty, all available packs are returned.
+	Codes []string `json:"codes,omitempty"`
 }
 
 // MsgSetSub is a payload in set.sub request to update current subscription or invite another user, {sub.what} == "sub"
@@ -58,13 +154,41 @@ type MsgSetSub struct {
 
 	// Access mode change, either Given or Want depending on context
 	Mode string `json:"mode,omitempty"`
+
+	// Position in the message stream to save, 0 to clear, current user only.
+	Anchor *int `json:"anchor,omitempty"`
+
+	// Role label of the user: "moderator", "speaker", "guest" or empty to clear, group topics only.
+	Role *string `json:"role,omitempty"`
+
+	// Message to the admins sent with the request to join, current user only.
+	Note string `json:"note,omitempty"`
 }
 
 // MsgSetDesc is a C2S in set.what == "desc", acc, sub message
 type MsgSetDesc struct {
 	DefaultAcs *MsgDefaultAcsMode `json:"defacs,omitempty"` // default access mode
 	Public     interface{}        `json:"public,omitempty"`
+	Trusted    interface{}        `json:"trusted,omitempty"` // Server-assigned user data, root only
 	Private    interface{}        `json:"private,omitempty"` // Per-subscription private data
+	// Limits on the content of messages, 'grp' only, owner only.
+	Limits *MsgTopicLimits `json:"limits,omitempty"`
+	// Language of the topic, e.g. "es", 'grp' only, owner only.
+	Lang string `json:"lang,omitempty"`
+	// Content rating: "general", "teen" or "adult", 'grp' only, owner only.
+	Rating string `json:"rating,omitempty"`
+	// Date of birth of the user as YYYY-MM-DD, 'me' only. Cannot be changed once set.
+	Birthdate string `json:"birthdate,omitempty"`
+	// Parent topic of the space, 'grp' only, owner only. An empty string removes the topic from the space.
+	Parent *string `json:"parent,omitempty"`
+}
+
+// MsgTopicLimits are limits on the content of messages in a group topic, stricter than the global limits.
+type MsgTopicLimits struct {
+	// Maximum size of the content of a message, bytes. Zero means the global limit.
+	MaxMessageSize int64 `json:"maxMessageSize,omitempty"`
+	// Maximum number of attachments in a message. Zero means the global limit.
+	MaxAttachments int `json:"maxAttachments,omitempty"`
 }
 
 // MsgCredClient is an account credential such as email or phone number.
@@ -89,6 +213,301 @@ type MsgSetQuery struct {
 	Tags []string `json:"tags,omitempty"`
 	// Update to account credentials.
 	Cred *MsgCredClient `json:"cred,omitempty"`
+	// User to add to the block list, 'me' only.
+	Block *MsgBlockedUser `json:"block,omitempty"`
+	// Unsent message to save on the subscription.
+	Draft *MsgDraft `json:"draft,omitempty"`
+	// Emoji pack to create or update ('me' only, root only) or packs to enable in a group topic.
+	Emoji *MsgSetEmoji `json:"emoji,omitempty"`
+	// Membership webhook of a group topic, owner only.
+	Hook *MsgTopicHook `json:"hook,omitempty"`
+	// Auto-reply to P2P messages, 'me' only.
+	AutoReply *MsgAutoReply `json:"autoreply,omitempty"`
+	// Channel readers to import, 'me' only, root only.
+	Import *MsgChnImport `json:"import,omitempty"`
+	// Guest access to a channel, owner only.
+	Guests *MsgTopicGuests `json:"guests,omitempty"`
+	// Co-owners of a group topic, owners only.
+	Owners *MsgTopicOwners `json:"owners,omitempty"`
+	// Automatic translation of incoming messages, 'me' only.
+	Translate *MsgTranslate `json:"translate,omitempty"`
+	// Periodic digests of a channel, channel readers only.
+	Digest *MsgDigest `json:"digest,omitempty"`
+	// Temporary mute of notifications, subscribers of 'grp' and 'p2p' topics.
+	Mute *MsgMute `json:"mute,omitempty"`
+	// Pinned topics and folders of the chat list, 'me' only.
+	ChatList *MsgChatList `json:"chatlist,omitempty"`
+	// Consent to sharing data, 'me' only.
+	Consent *MsgConsent `json:"consent,omitempty"`
+	// Response to an event announced in a group topic.
+	Rsvp *MsgRsvp `json:"rsvp,omitempty"`
+	// Decision on a new topic waiting for approval, 'sys' only, root only.
+	Review *MsgTopicReview `json:"review,omitempty"`
+	// Enable or disable per-message read receipts, 'grp' only, owner only.
+	Receipts *bool `json:"receipts,omitempty"`
+	// Enable or disable announcement mode, 'grp' only, owner only.
+	Announce *bool `json:"announce,omitempty"`
+	// Topic to check and repair, 'sys' only, root only.
+	Repair *MsgTopicRepair `json:"repair,omitempty"`
+	// Bulk moderation action, 'sys' only, root only.
+	Moderate *MsgModerate `json:"moderate,omitempty"`
+	// Limit of concurrent readers of a channel, owner only.
+	Capacity *MsgTopicCapacity `json:"capacity,omitempty"`
+	// Reload of the server config, 'sys' only, root only.
+	Config *MsgConfigAction `json:"config,omitempty"`
+	// Maximum number of subscribers of a topic, 'sys' only, root only.
+	MaxSubs *MsgTopicMaxSubs `json:"maxsubs,omitempty"`
+	// Suspend or resume posting, 'grp' only, owner or root only.
+	Freeze *MsgTopicFreeze `json:"freeze,omitempty"`
+	// Which messages trigger push notifications: "all", "mentions", "none" or empty for the default.
+	Notify *string `json:"notify,omitempty"`
+	// Ban or unban a user, 'grp' only, admins only.
+	Ban *MsgBan `json:"ban,omitempty"`
+	// Default time to live of new messages in seconds, 0 to keep messages, 'grp' only, owner only.
+	Ttl *int `json:"ttl,omitempty"`
+}
+
+// MsgBan is a request to ban a user from a group topic or to lift the ban.
+type MsgBan struct {
+	User string `json:"user"`
+	// True to ban the user, false to lift the ban.
+	Banned bool `json:"banned"`
+	// Reason shown to the admins, optional.
+	Reason string `json:"reason,omitempty"`
+	// Time when the ban is lifted automatically, optional.
+	Until *time.Time `json:"until,omitempty"`
+}
+
+// MsgConfigAction is a request to reload the server config or to roll it back.
+type MsgConfigAction struct {
+	// "reload" to read the config file again, "rollback" to apply the previous version.
+	Action string `json:"action"`
+}
+
+// MsgAudience is the size of the audience of a channel.
+type MsgAudience struct {
+	// Number of channel readers: users subscribed to the channel as readers.
+	Readers int `json:"readers"`
+	// Number of sessions attached to the channel as readers now, including guests.
+	Viewers int `json:"viewers"`
+}
+
+// MsgTopicCapacity limits the number of readers attached to a channel at the same time.
+type MsgTopicCapacity struct {
+	// Maximum number of attached readers, 0 to remove the limit.
+	Max int `json:"max"`
+	// What happens to readers over the limit: "reject" (default) or "queue".
+	Overflow string `json:"overflow,omitempty"`
+	// Seconds before a rejected reader should try again.
+	RetryAfter int `json:"retry,omitempty"`
+}
+
+// MsgTopicFreeze is the state of posting to a topic: suspended or not.
+type MsgTopicFreeze struct {
+	// Name of the topic to freeze, 'sys' topic only.
+	Topic string `json:"topic,omitempty"`
+	// Posting is suspended.
+	Frozen bool `json:"frozen"`
+	// Time when posting resumes automatically, optional.
+	Until *time.Time `json:"until,omitempty"`
+}
+
+// MsgModerate is a bulk moderation action executed as a background job.
+type MsgModerate struct {
+	// Action: "del" to delete messages, "ban" to ban users.
+	Action string `json:"action"`
+	// Topics to act on.
+	Topics []string `json:"topics"`
+	// Users to ban or whose messages to delete.
+	Users []string `json:"users,omitempty"`
+	// Delete only messages which match this full-text query.
+	Query string `json:"query,omitempty"`
+	// Delete only messages sent at or after this time.
+	Since *time.Time `json:"since,omitempty"`
+	// Delete only messages sent before this time.
+	Before *time.Time `json:"before,omitempty"`
+}
+
+// MsgTopicRepair is a request to repair the stored state of a topic.
+type MsgTopicRepair struct {
+	Topic string `json:"topic"`
+}
+
+// MsgTopicMaxSubs overrides the global limit of subscribers for one group topic.
+type MsgTopicMaxSubs struct {
+	Topic string `json:"topic"`
+	// Maximum number of subscribers. Zero restores the global limit.
+	Max int `json:"max"`
+}
+
+// MsgTopicReview is the decision of an administrator on a new topic.
+type MsgTopicReview struct {
+	Topic string `json:"topic"`
+	// The topic is activated if true, deleted otherwise.
+	Approve bool `json:"approve"`
+}
+
+// MsgRsvp is the member's response to an event.
+type MsgRsvp struct {
+	// SeqId of the message which announced the event.
+	SeqId int `json:"seq"`
+	// "yes", "no", "maybe" or empty to withdraw the response.
+	Resp string `json:"resp,omitempty"`
+}
+
+// MsgConsent is the user's choice on sharing data. Missing choices are not changed by {set};
+// all choices are present in {meta}. Everything is shared unless the user opts out.
+type MsgConsent struct {
+	// Message activity is counted in engagement statistics.
+	Analytics *bool `json:"analytics,omitempty"`
+	// Promotional push notifications from channels.
+	Marketing *bool `json:"marketing,omitempty"`
+	// Read and received receipts are reported to other users.
+	Receipts *bool `json:"receipts,omitempty"`
+	// Last seen time is reported to other users.
+	LastSeen *bool `json:"lastseen,omitempty"`
+}
+
+// MsgChatList is the user's arrangement of the chat list.
+type MsgChatList struct {
+	// Pinned topics in display order.
+	Pinned []string `json:"pinned,omitempty"`
+	// Folders in display order.
+	Folders []MsgChatFolder `json:"folders,omitempty"`
+}
+
+// MsgChatFolder is a named group of topics in the chat list.
+type MsgChatFolder struct {
+	Name string `json:"name"`
+	// Topics in the folder in display order.
+	Topics []string `json:"topics,omitempty"`
+}
+
+// MsgMute is a request to mute notifications of a topic for some time.
+type MsgMute struct {
+	// Duration of the mute, seconds. Zero unmutes the topic.
+	For int `json:"for"`
+	// Daily quiet hours. If present, the mute is left unchanged.
+	Quiet *MsgQuietHours `json:"quiet,omitempty"`
+}
+
+// MsgQuietHours is a daily schedule of quiet hours when push notifications are not sent.
+type MsgQuietHours struct {
+	// Start and end of the quiet hours, minutes since midnight of user's local time. Equal values
+	// remove the quiet hours.
+	Start int `json:"start"`
+	End   int `json:"end"`
+	// Offset of user's time zone from UTC, minutes.
+	Tz int `json:"tz,omitempty"`
+}
+
+// MsgDigest is a schedule of periodic digests of a channel.
+type MsgDigest struct {
+	// Interval between digests, minutes. Zero turns digests off.
+	Period int `json:"period"`
+	// Maximum number of messages in a digest.
+	Limit int `json:"limit,omitempty"`
+	// Start and end of quiet hours, minutes since midnight of the reader's local time.
+	QuietStart int `json:"quietstart,omitempty"`
+	QuietEnd   int `json:"quietend,omitempty"`
+	// Offset of the reader's local time from UTC, minutes.
+	Tz int `json:"tz,omitempty"`
+}
+
+// MsgTranslate is the preferred language of automatic translation of messages.
+type MsgTranslate struct {
+	// Language to translate incoming messages to, e.g. "en". Empty string disables translation.
+	Lang string `json:"lang"`
+}
+
+// MsgTopicOwners is a list of co-owners of a group topic.
+type MsgTopicOwners struct {
+	// IDs of co-owners. Replaces the current list, an empty list removes all co-owners.
+	Users []string `json:"users"`
+}
+
+// MsgTopicGuests configures read-only guest access to a channel.
+type MsgTopicGuests struct {
+	// Maximum number of guests attached to the channel at the same time. Zero disables guest access.
+	Limit int `json:"limit"`
+}
+
+// MsgSetEmoji is a payload of set.emoji request.
+type MsgSetEmoji struct {
+	// Pack to create (no ID) or replace (with ID), 'me' only.
+	Pack *MsgEmojiPack `json:"pack,omitempty"`
+	// IDs of packs to enable in a group topic. Replaces the current list, an empty list disables all packs.
+	Enabled []string `json:"enabled,omitempty"`
+}
+
+// MsgTopicHook is a webhook which receives membership events of a group topic.
+type MsgTopicHook struct {
+	// URL to POST the events to. Empty URL removes the webhook.
+	Url string `json:"url,omitempty"`
+	// Key for signing the events. Generated by the server if missing. Never sent back to the client.
+	Secret string `json:"secret,omitempty"`
+	// Events to report: "join", "leave", "ban", "role", "capacity". All events if empty.
+	Events []string `json:"events,omitempty"`
+}
+
+// MsgAutoReply is a message sent by the server on behalf of the user in response to P2P messages.
+type MsgAutoReply struct {
+	// Content of the reply. Missing content disables the auto-reply.
+	Content interface{} `json:"content,omitempty"`
+	// Time when the auto-reply becomes active, optional.
+	Start *time.Time `json:"start,omitempty"`
+	// Time when the auto-reply stops being active, optional.
+	End *time.Time `json:"end,omitempty"`
+}
+
+// MsgChnImport is a request to subscribe users to a channel as readers.
+type MsgChnImport struct {
+	// Name of the channel or of the corresponding group topic.
+	Topic string `json:"topic"`
+	// Users to subscribe: user IDs or credentials such as "email:alice@example.com".
+	Users []string `json:"users"`
+}
+
+// MsgDayStats contains engagement counters of a topic for one day.
+type MsgDayStats struct {
+	// Day in "2006-01-02" format, UTC.
+	Day string `json:"day"`
+	// Number of messages published.
+	Messages int `json:"msgs"`
+	// Number of distinct users who published messages.
+	Posters int `json:"posters"`
+	// Number of users who joined the topic.
+	Joins int `json:"joins"`
+	// Number of users who left or were removed from the topic.
+	Leaves int `json:"leaves"`
+}
+
+// MsgHourStats contains activity counters of a topic for one hour.
+type MsgHourStats struct {
+	// Hour in "2006-01-02T15" format, UTC.
+	Hour string `json:"hour"`
+	// Number of messages published.
+	Messages int `json:"msgs"`
+	// Number of users who joined the topic.
+	Joins int `json:"joins"`
+	// Number of users who left or were removed from the topic.
+	Leaves int `json:"leaves"`
+}
+
+// MsgTopicStats contains running totals of a topic.
+type MsgTopicStats struct {
+	// Name of the topic, requests in the 'sys' topic only.
+	Topic string `json:"topic,omitempty"`
+	// Number of messages published since the counters were introduced.
+	Messages int64 `json:"msgs"`
+	// Size of the content of these messages, bytes.
+	Bytes int64 `json:"bytes"`
+	// Number of subscribers with the J permission, channel readers are not included.
+	Members int `json:"members"`
+	// Number of subscribers attached to the topic now.
+	Online int `json:"online"`
+	// Counters for the last 24 hours, oldest first. Hours without activity are skipped.
+	Hours []MsgHourStats `json:"hours,omitempty"`
 }
 
 // MsgDelRange is either an individual ID (HiId=0) or a randge of deleted IDs, low end inclusive (closed),
@@ -159,6 +578,10 @@ type MsgClientLogin struct {
 	Cred []MsgCredClient `json:"cred,omitempty"`
 	// Organization sdk key
 	SdkKey string `json:"sdkKey,omitempty"`
+	// Authenticate an additional account keeping the session's active account unchanged.
+	Add bool `json:"add,omitempty"`
+	// Make active another account already authenticated in this session. Other fields are ignored.
+	Switch string `json:"switch,omitempty"`
 }
 
 // MsgClientSub is a subscription request {sub} message.
@@ -172,6 +595,16 @@ type MsgClientSub struct {
 	// Mirrors {get}.
 	Get *MsgGetQuery `json:"get,omitempty"`
 
+	// Request redelivery of messages not yet acknowledged with {note what="recv"}.
+	Ack bool `json:"ack,omitempty"`
+
+	// Flow control window: the number of {data} messages the session is willing to receive from
+	// a channel before granting more credit with {note what="credit"}. 0 means no flow control.
+	Window int `json:"window,omitempty"`
+
+	// Guest token for attaching to a channel in read-only mode without authentication.
+	Guest string `json:"guest,omitempty"`
+
 	// Intra-cluster fields.
 
 	// True if this subscription created a new topic.
@@ -189,6 +622,44 @@ const (
 	constMsgMetaTags
 	constMsgMetaDel
 	constMsgMetaCred
+	constMsgMetaBlock
+	constMsgMetaDraft
+	constMsgMetaEmoji
+	constMsgMetaGap
+	constMsgMetaHook
+	constMsgMetaAutoReply
+	constMsgMetaImport
+	constMsgMetaStats
+	constMsgMetaLink
+	constMsgMetaGuests
+	constMsgMetaOwners
+	constMsgMetaTranslate
+	constMsgMetaDigest
+	constMsgMetaMute
+	constMsgMetaChatList
+	constMsgMetaConsent
+	constMsgMetaPending
+	constMsgMetaDevices
+	constMsgMetaEvents
+	constMsgMetaRsvp
+	constMsgMetaReview
+	constMsgMetaReceipts
+	constMsgMetaPoll
+	constMsgMetaStarred
+	constMsgMetaRepair
+	constMsgMetaInbox
+	constMsgMetaAnnounce
+	constMsgMetaActivity
+	constMsgMetaModerate
+	constMsgMetaCapacity
+	constMsgMetaConfig
+	constMsgMetaRequests
+	constMsgMetaMaxSubs
+	constMsgMetaFreeze
+	constMsgMetaNotify
+	constMsgMetaBanned
+	constMsgMetaTtl
+	constMsgMetaDirectory
 )
 
 const (
@@ -197,11 +668,13 @@ const (
 	constMsgDelSub
 	constMsgDelUser
 	constMsgDelCred
+	constMsgDelBlock
+	constMsgDelEmoji
 )
 
 func parseMsgClientMeta(params string) int {
 	var bits int
-	parts := strings.SplitN(params, " ", 8)
+	parts := strings.SplitN(params, " ", 21)
 	for _, p := range parts {
 		switch p {
 		case "desc":
@@ -216,6 +689,56 @@ func parseMsgClientMeta(params string) int {
 			bits |= constMsgMetaDel
 		case "cred":
 			bits |= constMsgMetaCred
+		case "block":
+			bits |= constMsgMetaBlock
+		case "draft":
+			bits |= constMsgMetaDraft
+		case "emoji":
+			bits |= constMsgMetaEmoji
+		case "gap":
+			bits |= constMsgMetaGap
+		case "hook":
+			bits |= constMsgMetaHook
+		case "autoreply":
+			bits |= constMsgMetaAutoReply
+		case "stats":
+			bits |= constMsgMetaStats
+		case "link":
+			bits |= constMsgMetaLink
+		case "guests":
+			bits |= constMsgMetaGuests
+		case "owners":
+			bits |= constMsgMetaOwners
+		case "translate":
+			bits |= constMsgMetaTranslate
+		case "digest":
+			bits |= constMsgMetaDigest
+		case "consent":
+			bits |= constMsgMetaConsent
+		case "pending":
+			bits |= constMsgMetaPending
+		case "devices":
+			bits |= constMsgMetaDevices
+		case "events":
+			bits |= constMsgMetaEvents
+		case "review":
+			bits |= constMsgMetaReview
+		case "receipts":
+			bits |= constMsgMetaReceipts
+		case "poll":
+			bits |= constMsgMetaPoll
+		case "starred":
+			bits |= constMsgMetaStarred
+		case "inbox":
+			bits |= constMsgMetaInbox
+		case "activity":
+			bits |= constMsgMetaActivity
+		case "requests":
+			bits |= constMsgMetaRequests
+		case "banned":
+			bits |= constMsgMetaBanned
+		case "directory":
+			bits |= constMsgMetaDirectory
 		default:
 			// ignore unknown
 		}
@@ -235,6 +758,10 @@ func parseMsgClientDel(params string) int {
 		return constMsgDelUser
 	case "cred":
 		return constMsgDelCred
+	case "block":
+		return constMsgDelBlock
+	case "emoji":
+		return constMsgDelEmoji
 	default:
 		// ignore
 	}
@@ -261,6 +788,9 @@ type MsgClientPub struct {
 	NoEcho  bool                   `json:"noecho,omitempty"`
 	Head    map[string]interface{} `json:"head,omitempty"`
 	Content interface{}            `json:"content"`
+
+	// Content as received over gRPC, i.e. serialized to JSON bytes. Nil for other transports.
+	pbContent []byte
 }
 
 // MsgClientGet is a query of topic state {get}.
@@ -287,6 +817,8 @@ type MsgClientDel struct {
 	// * "sub" to delete a subscription to topic.
 	// * "user" to delete or disable user.
 	// * "cred" to delete credential (email or phone)
+	// * "block" to remove a user from the block list
+	// * "emoji" to delete an emoji pack
 	What string `json:"what"`
 	// Delete messages with these IDs (either one by one or a set of ranges)
 	DelSeq []MsgDelRange `json:"delseq,omitempty"`
@@ -294,6 +826,8 @@ type MsgClientDel struct {
 	User string `json:"user,omitempty"`
 	// Credential to delete
 	Cred *MsgCredClient `json:"cred,omitempty"`
+	// ID of the emoji pack to delete
+	Pack string `json:"pack,omitempty"`
 	// Request to hard-delete objects (i.e. delete messages for all users), if such option is available.
 	Hard bool `json:"hard,omitempty"`
 }
@@ -302,14 +836,32 @@ type MsgClientDel struct {
 type MsgClientNote struct {
 	// There is no Id -- server will not akn {ping} packets, they are "fire and forget"
 	Topic string `json:"topic"`
-	// what is being reported: "recv" - message received, "read" - message read, "kp" - typing notification
+	// what is being reported: "recv" - message received, "read" - message read, "kp" - typing notification,
+	// "dlv" - message delivered to the device, "credit" - flow control credit granted,
+	// "focus", "blur" - topic is shown to or hidden from the user.
 	What string `json:"what"`
-	// Server-issued message ID being reported
+	// Server-issued message ID being reported or the number of messages granted with "credit".
 	SeqId int `json:"seq,omitempty"`
+	// Kind of activity reported with "kp", see kpActivities. Empty means typing.
+	Act string `json:"act,omitempty"`
+	// Indexes of the options chosen with "vote". Empty vote withdraws the previous one.
+	Vote []int `json:"vote,omitempty"`
 	// Client's count of unread messages to report back to the server. Used in push notifications on iOS.
 	Unread int `json:"unread,omitempty"`
 }
 
+// Kinds of activity which can be reported with {note what="kp"} in addition to typing.
+var kpActivities = map[string]bool{
+	// Recording an audio message.
+	"audio": true,
+	// Recording a video message.
+	"video": true,
+	// Uploading a file.
+	"file": true,
+	// Choosing a sticker.
+	"sticker": true,
+}
+
 // ClientComMessage is a wrapper for client messages.
 type ClientComMessage struct {
 	Hi    *MsgClientHi    `json:"hi"`
@@ -323,6 +875,9 @@ type ClientComMessage struct {
 	Del   *MsgClientDel   `json:"del"`
 	Note  *MsgClientNote  `json:"note"`
 
+	// ID of the account authenticated in this session to act as. Active account if empty.
+	From string `json:"from,omitempty"`
+
 	// Internal fields, routed only within the cluster.
 
 	// Message ID denormalized
@@ -368,6 +923,52 @@ type MsgCredServer struct {
 	Done bool `json:"done,omitempty"`
 }
 
+// MsgBlockedUser is an entry in the user's block list.
+type MsgBlockedUser struct {
+	// ID of the blocked user.
+	User string `json:"user,omitempty"`
+	// Hide messages of the blocked user in group topics.
+	Hide bool `json:"hide,omitempty"`
+	// Time when the user was blocked, server to client only.
+	Created *time.Time `json:"created,omitempty"`
+}
+
+// MsgDraft is an unsent message saved on the server.
+type MsgDraft struct {
+	// Content of the draft, same as {pub content}; blank to clear the draft.
+	Content interface{} `json:"content,omitempty"`
+	// SeqId of the message the draft is a reply to.
+	ReplyTo int `json:"reply,omitempty"`
+	// Time when the draft was edited by the client. Older edits do not replace newer ones.
+	UpdatedAt *time.Time `json:"ts,omitempty"`
+}
+
+// MsgEmojiItem is a custom emoji or sticker.
+type MsgEmojiItem struct {
+	// Short code of the item without colons, e.g. "party" for :party:.
+	Code string `json:"code"`
+	// URL of the image, as returned by the upload endpoint.
+	Ref string `json:"ref"`
+	// Type of the image, server to client only.
+	Mime string `json:"mime,omitempty"`
+	// The item is a sticker.
+	Sticker bool `json:"sticker,omitempty"`
+}
+
+// MsgEmojiPack is a collection of custom emoji and stickers.
+type MsgEmojiPack struct {
+	// ID of the pack, assigned by the server.
+	Id string `json:"id,omitempty"`
+	// ID of the organization the pack belongs to, empty if the pack is available to everyone.
+	Org string `json:"org,omitempty"`
+	// Name of the pack.
+	Name string `json:"name,omitempty"`
+	// Time of the last change to the pack, server to client only.
+	Updated *time.Time `json:"updated,omitempty"`
+	// Emoji and stickers in the pack.
+	Items []MsgEmojiItem `json:"items,omitempty"`
+}
+
 // MsgAccessMode is a definition of access mode.
 type MsgAccessMode struct {
 	// Access mode requested by the user
@@ -412,11 +1013,39 @@ type MsgTopicDesc struct {
 	SeqId     int `json:"seq,omitempty"`
 	ReadSeqId int `json:"read,omitempty"`
 	RecvSeqId int `json:"recv,omitempty"`
+	DlvSeqId  int `json:"dlv,omitempty"`
 	// Id of the last delete operation as seen by the requesting user
 	DelId  int         `json:"clear,omitempty"`
 	Public interface{} `json:"public,omitempty"`
+	// Values assigned to the user by the server or root, 'me' and p2p topics only
+	Trusted interface{} `json:"trusted,omitempty"`
 	// Per-subscription private data
 	Private interface{} `json:"private,omitempty"`
+	// Per-message read receipts are recorded, 'grp' topics only.
+	Receipts bool `json:"receipts,omitempty"`
+	// Only administrators may publish, 'grp' topics only.
+	Announce bool `json:"announce,omitempty"`
+	// Limits on the content of messages set by the owner, 'grp' topics only.
+	Limits *MsgTopicLimits `json:"limits,omitempty"`
+	// Limit of concurrent readers set by the owner, channels only.
+	Capacity *MsgTopicCapacity `json:"capacity,omitempty"`
+	// Size of the audience, channels only.
+	Audience *MsgAudience `json:"audience,omitempty"`
+	// Parent topic of the space, 'grp' topics only.
+	Parent string `json:"parent,omitempty"`
+	// Maximum number of subscribers, 'grp' topics only, reported to owners only.
+	MaxSubs int `json:"maxsubs,omitempty"`
+	// Posting is suspended, 'grp' topics only.
+	Freeze *MsgTopicFreeze `json:"freeze,omitempty"`
+	// Default time to live of messages in seconds, 'grp' topics only.
+	Ttl int `json:"ttl,omitempty"`
+	// Language and content rating, 'grp' topics only.
+	Lang   string `json:"lang,omitempty"`
+	Rating string `json:"rating,omitempty"`
+	// Date of birth of the user, 'me' topic only.
+	Birthdate string `json:"birthdate,omitempty"`
+	// Count of unread mentions across all topics, 'me' topic only.
+	Mentions int `json:"mentions,omitempty"`
 }
 
 func (src *MsgTopicDesc) describe() string {
@@ -437,12 +1066,18 @@ func (src *MsgTopicDesc) describe() string {
 	if src.RecvSeqId != 0 {
 		s += " recv=" + strconv.Itoa(src.RecvSeqId)
 	}
+	if src.DlvSeqId != 0 {
+		s += " dlv=" + strconv.Itoa(src.DlvSeqId)
+	}
 	if src.DelId != 0 {
 		s += " clear=" + strconv.Itoa(src.DelId)
 	}
 	if src.Public != nil {
 		s += " pub='...'"
 	}
+	if src.Trusted != nil {
+		s += " trst='...'"
+	}
 	if src.Private != nil {
 		s += " priv='...'"
 	}
@@ -463,6 +1098,17 @@ type MsgTopicSub struct {
 	// If the subscriber/topic is online
 	Online bool `json:"online,omitempty"`
 
+	// Notifications of the topic are muted until this time, user's own subscription only.
+	MuteUntil *time.Time `json:"muteuntil,omitempty"`
+	// Daily quiet hours of notifications, user's own subscription only.
+	Quiet *MsgQuietHours `json:"quiet,omitempty"`
+	// Level of push notifications, user's own subscription only.
+	Notify string `json:"notify,omitempty"`
+	// Position in the message stream saved by the user, user's own subscription only.
+	Anchor int `json:"anchor,omitempty"`
+	// Role label of the subscriber in a group topic.
+	Role string `json:"role,omitempty"`
+
 	// Access mode. Topic admins receive the full info, non-admins receive just the cumulative mode
 	// Acs.Mode = want & given. The field is not a pointer because at least one value is always assigned.
 	Acs MsgAccessMode `json:"acs,omitempty"`
@@ -470,8 +1116,12 @@ type MsgTopicSub struct {
 	ReadSeqId int `json:"read,omitempty"`
 	// ID of the message reported by the given user as received
 	RecvSeqId int `json:"recv,omitempty"`
+	// ID of the message reported as delivered to at least one of the user's devices
+	DlvSeqId int `json:"dlv,omitempty"`
 	// Topic's public data
 	Public interface{} `json:"public,omitempty"`
+	// Values assigned to the user by the server or root, users and p2p topics only
+	Trusted interface{} `json:"trusted,omitempty"`
 	// User's own private data per topic
 	Private interface{} `json:"private,omitempty"`
 
@@ -510,12 +1160,18 @@ func (src *MsgTopicSub) describe() string {
 	if src.RecvSeqId != 0 {
 		s += " recv=" + strconv.Itoa(src.RecvSeqId)
 	}
+	if src.DlvSeqId != 0 {
+		s += " dlv=" + strconv.Itoa(src.DlvSeqId)
+	}
 	if src.DelId != 0 {
 		s += " clear=" + strconv.Itoa(src.DelId)
 	}
 	if src.Public != nil {
 		s += " pub='...'"
 	}
+	if src.Trusted != nil {
+		s += " trst='...'"
+	}
 	if src.Private != nil {
 		s += " priv='...'"
 	}
@@ -540,6 +1196,9 @@ type MsgServerCtrl struct {
 	Code      int       `json:"code"`
 	Text      string    `json:"text,omitempty"`
 	Timestamp time.Time `json:"ts"`
+
+	// Description of the error in the language of the client.
+	Hint string `json:"hint,omitempty"`
 }
 
 // Deep-shallow copy.
@@ -565,6 +1224,29 @@ type MsgServerData struct {
 	SeqId     int                    `json:"seq"`
 	Head      map[string]interface{} `json:"head,omitempty"`
 	Content   interface{}            `json:"content"`
+
+	// Thread summary of the first message of a thread: the number of replies and the time of the latest one.
+	Replies   int        `json:"replies,omitempty"`
+	LastReply *time.Time `json:"lastreply,omitempty"`
+
+	// Content already serialized for gRPC, kept to avoid converting Content back to bytes
+	// for every gRPC recipient. Could be nil. Must be cleared if Content is changed.
+	pbContent []byte
+	// The message converted for gRPC, shared by copies of the message sent to different sessions.
+	// Could be nil. Must be replaced if Head or Content is changed.
+	pbCache *pbDataCache
+}
+
+// MIME type of the system events recorded in the message stream, such as membership changes.
+const sysEventMime = "application/x-tinode-event"
+
+// isSysEvent checks if the message is a system event generated by the server.
+func isSysEvent(data *MsgServerData) bool {
+	if data.From != "" {
+		return false
+	}
+	mime, _ := data.Head["mime"].(string)
+	return mime == sysEventMime
 }
 
 // Deep-shallow copy.
@@ -600,6 +1282,12 @@ type MsgServerPres struct {
 	DelSeq    []MsgDelRange `json:"delseq,omitempty"`
 	AcsTarget string        `json:"tgt,omitempty"`
 	AcsActor  string        `json:"act,omitempty"`
+	// New role label of the user 'src' for what="role".
+	Role string `json:"role,omitempty"`
+	// Size of the audience of the channel for what="audience".
+	Audience *MsgAudience `json:"audience,omitempty"`
+	// New state of posting for what="freeze".
+	Freeze *MsgTopicFreeze `json:"freeze,omitempty"`
 	// Acs or a delta Acs. Need to marshal it to json under a name different than 'acs'
 	// to allow different handling on the client
 	Acs *MsgAccessMode `json:"dacs,omitempty"`
@@ -685,6 +1373,218 @@ type MsgServerMeta struct {
 	Tags []string `json:"tags,omitempty"`
 	// Account credentials, 'me' only.
 	Cred []*MsgCredServer `json:"cred,omitempty"`
+	// Blocked users, 'me' only.
+	Block []MsgBlockedUser `json:"block,omitempty"`
+	// Unsent message saved by the user.
+	Draft *MsgDraft `json:"draft,omitempty"`
+	// Custom emoji packs.
+	Emoji []MsgEmojiPack `json:"emoji,omitempty"`
+	// Membership webhook, 'grp' only.
+	Hook *MsgTopicHook `json:"hook,omitempty"`
+	// Auto-reply to P2P messages, 'me' only.
+	AutoReply *MsgAutoReply `json:"autoreply,omitempty"`
+	// Daily engagement counters, 'grp' only, owner only.
+	Stats []MsgDayStats `json:"stats,omitempty"`
+	// Running totals and hourly counters, 'grp' only, owner only or root in 'sys'.
+	Totals *MsgTopicStats `json:"totals,omitempty"`
+	// Co-owners, 'grp' only.
+	Owners []string `json:"owners,omitempty"`
+	// Automatic translation of incoming messages, 'me' only.
+	Translate *MsgTranslate `json:"translate,omitempty"`
+	// Periodic digests of a channel, channel readers only.
+	Digest *MsgDigest `json:"digest,omitempty"`
+	// Pinned topics and folders of the chat list, 'me' only, sent with subscriptions.
+	ChatList *MsgChatList `json:"chatlist,omitempty"`
+	// Consent to sharing data, 'me' only.
+	Consent *MsgConsent `json:"consent,omitempty"`
+	// Accounts waiting for approval, 'sys' only, root only.
+	Pending []MsgPendingAccount `json:"pending,omitempty"`
+	// Devices of a user registered for push notifications, 'sys' only, root only.
+	Devices []MsgDevice `json:"devices,omitempty"`
+	// Messages found by the full-text search.
+	Found []MsgFoundMessage `json:"found,omitempty"`
+	// Current and upcoming events of a group topic.
+	Events []MsgCalEvent `json:"events,omitempty"`
+	// New group topics waiting for approval, 'sys' only, root only.
+	Review []MsgPendingTopic `json:"review,omitempty"`
+	// Child topics of the space, 'grp' only.
+	Children []MsgSpaceChild `json:"children,omitempty"`
+	// Pending requests to join the topic, 'grp' only, admins only.
+	Requests []MsgJoinRequest `json:"requests,omitempty"`
+	// Users banned from the topic, 'grp' only, admins only.
+	Banned []MsgBannedUser `json:"banned,omitempty"`
+	// Users who have read the message, 'grp' only.
+	Receipts *MsgReceipts `json:"receipts,omitempty"`
+	// Poll with the current tally, 'grp' only.
+	Poll *MsgPoll `json:"poll,omitempty"`
+	// Messages starred by the user, 'me' only.
+	Starred []MsgStarred `json:"starred,omitempty"`
+	// Unread mentions and thread replies of the user, 'me' only.
+	Inbox []MsgInboxItem `json:"inbox,omitempty"`
+	// Activity timeline of the user's account, 'me' only.
+	Activity []MsgAccountEvent `json:"activity,omitempty"`
+	// Page of the topic directory, 'fnd' only.
+	Directory *MsgDirectory `json:"directory,omitempty"`
+}
+
+// MsgDirectory is a page of topics listed in the directory under a category.
+type MsgDirectory struct {
+	Topics []MsgDirectoryTopic `json:"topics"`
+	// Position of the next page, empty if there are no more topics.
+	Cursor string `json:"cursor,omitempty"`
+}
+
+// MsgDirectoryTopic is a topic listed in the directory.
+type MsgDirectoryTopic struct {
+	Topic     string      `json:"topic"`
+	CreatedAt *time.Time  `json:"created,omitempty"`
+	TouchedAt *time.Time  `json:"touched,omitempty"`
+	Public    interface{} `json:"public,omitempty"`
+	// Number of members when the counters of the topic were last saved.
+	Members int `json:"members,omitempty"`
+}
+
+// MsgAccountEvent is a security-related event in the user's account.
+type MsgAccountEvent struct {
+	// "login", "passwd", "cred", "export".
+	What      string     `json:"what"`
+	Timestamp *time.Time `json:"ts,omitempty"`
+	// Authentication scheme, credential method or the exported topic.
+	Detail string `json:"detail,omitempty"`
+	// The login is from a device the user has not logged in from before.
+	NewDevice  bool   `json:"newdevice,omitempty"`
+	UserAgent  string `json:"ua,omitempty"`
+	RemoteAddr string `json:"ip,omitempty"`
+	// Push token of the device with most characters hidden.
+	DeviceId string `json:"device,omitempty"`
+}
+
+// MsgStarred is a message starred by the user.
+type MsgStarred struct {
+	Topic     string                 `json:"topic"`
+	SeqId     int                    `json:"seq"`
+	From      string                 `json:"from,omitempty"`
+	Timestamp *time.Time             `json:"ts,omitempty"`
+	Head      map[string]interface{} `json:"head,omitempty"`
+	Content   interface{}            `json:"content"`
+	// Time when the message was starred.
+	Starred *time.Time `json:"starred,omitempty"`
+}
+
+// MsgInboxItem is an unread message which mentions the user or replies in the thread started by the user.
+type MsgInboxItem struct {
+	// "mention" or "reply".
+	What      string                 `json:"what"`
+	Topic     string                 `json:"topic"`
+	SeqId     int                    `json:"seq"`
+	From      string                 `json:"from,omitempty"`
+	Timestamp *time.Time             `json:"ts,omitempty"`
+	Head      map[string]interface{} `json:"head,omitempty"`
+	Content   interface{}            `json:"content"`
+	// SeqId of the first message of the thread, replies only.
+	Thread int `json:"thread,omitempty"`
+}
+
+// MsgPoll is a poll with the current tally.
+type MsgPoll struct {
+	// SeqId of the message which created the poll.
+	Seq      int      `json:"seq"`
+	Question string   `json:"question"`
+	Options  []string `json:"options"`
+	Multi    bool     `json:"multi,omitempty"`
+	// Number of votes for each option.
+	Tally []int `json:"tally"`
+	// Options chosen by the requester.
+	Own []int `json:"own,omitempty"`
+}
+
+// MsgReceipts lists users who have read the message.
+type MsgReceipts struct {
+	// SeqId of the message.
+	Seq  int          `json:"seq"`
+	Read []MsgReceipt `json:"read,omitempty"`
+}
+
+// MsgReceipt is the time when the user has read the message.
+type MsgReceipt struct {
+	User   string     `json:"user"`
+	ReadAt *time.Time `json:"ts,omitempty"`
+}
+
+// MsgPendingTopic is a new group topic waiting for approval.
+type MsgPendingTopic struct {
+	Topic     string      `json:"topic"`
+	Owner     string      `json:"owner,omitempty"`
+	CreatedAt *time.Time  `json:"created,omitempty"`
+	Public    interface{} `json:"public,omitempty"`
+}
+
+// MsgSpaceChild is a child topic of a space.
+type MsgSpaceChild struct {
+	Topic     string      `json:"topic"`
+	CreatedAt *time.Time  `json:"created,omitempty"`
+	TouchedAt *time.Time  `json:"touched,omitempty"`
+	Public    interface{} `json:"public,omitempty"`
+}
+
+// MsgBannedUser is a user banned from a group topic.
+type MsgBannedUser struct {
+	User      string     `json:"user"`
+	Reason    string     `json:"reason,omitempty"`
+	Until     *time.Time `json:"until,omitempty"`
+	By        string     `json:"by,omitempty"`
+	CreatedAt *time.Time `json:"created,omitempty"`
+}
+
+// MsgJoinRequest is a pending request of a user to join a group topic.
+type MsgJoinRequest struct {
+	User      string     `json:"user"`
+	Want      string     `json:"want,omitempty"`
+	Note      string     `json:"note,omitempty"`
+	CreatedAt *time.Time `json:"created,omitempty"`
+}
+
+// MsgCalEvent is an event announced in a group topic.
+type MsgCalEvent struct {
+	// SeqId of the message which announced the event.
+	SeqId    int        `json:"seq"`
+	Title    string     `json:"title"`
+	Location string     `json:"location,omitempty"`
+	Start    *time.Time `json:"start,omitempty"`
+	End      *time.Time `json:"end,omitempty"`
+	// Number of members who gave each response.
+	Rsvp map[string]int `json:"rsvp,omitempty"`
+	// Response of the current user.
+	Own string `json:"own,omitempty"`
+}
+
+// MsgFoundMessage is a message matching the full-text query.
+type MsgFoundMessage struct {
+	SeqId     int        `json:"seq"`
+	From      string     `json:"from,omitempty"`
+	Timestamp *time.Time `json:"ts,omitempty"`
+	// Text of the message around the match.
+	Snippet string `json:"snippet,omitempty"`
+}
+
+// MsgDevice is a device registered for push notifications.
+type MsgDevice struct {
+	// Push token with all but the last few characters hidden.
+	DeviceId string     `json:"id"`
+	Platform string     `json:"platf,omitempty"`
+	Lang     string     `json:"lang,omitempty"`
+	LastSeen *time.Time `json:"seen,omitempty"`
+	// Time of the last successful push notification.
+	LastPush *time.Time `json:"push,omitempty"`
+	// Number of push notifications failed since the last successful one.
+	PushFailures int `json:"failures,omitempty"`
+}
+
+// MsgPendingAccount is a new account waiting for approval.
+type MsgPendingAccount struct {
+	User      string      `json:"user"`
+	CreatedAt *time.Time  `json:"created,omitempty"`
+	Public    interface{} `json:"public,omitempty"`
 }
 
 // Deep-shallow copy of meta message. Deep copy of Id and Topic fields, shallow copy of payload.
@@ -720,6 +1620,37 @@ func (src *MsgServerMeta) describe() string {
 		x, _ := json.Marshal(src.Cred)
 		s += " cred=[" + string(x) + "]"
 	}
+	if src.Block != nil {
+		x, _ := json.Marshal(src.Block)
+		s += " block=[" + string(x) + "]"
+	}
+	if src.Draft != nil {
+		s += " draft={...}"
+	}
+	if src.Emoji != nil {
+		s += " emoji=[" + strconv.Itoa(len(src.Emoji)) + "]"
+	}
+	if src.Hook != nil {
+		s += " hook={" + src.Hook.Url + "}"
+	}
+	if src.AutoReply != nil {
+		s += " autoreply={...}"
+	}
+	if src.Stats != nil {
+		s += " stats=[" + strconv.Itoa(len(src.Stats)) + "]"
+	}
+	if src.Totals != nil {
+		s += " totals={" + strconv.FormatInt(src.Totals.Messages, 10) + "}"
+	}
+	if src.Owners != nil {
+		s += " owners=[" + strings.Join(src.Owners, ",") + "]"
+	}
+	if src.Translate != nil {
+		s += " translate={" + src.Translate.Lang + "}"
+	}
+	if src.Digest != nil {
+		s += " digest={" + strconv.Itoa(src.Digest.Period) + "}"
+	}
 	return s
 }
 
@@ -732,6 +1663,15 @@ type MsgServerInfo struct {
 	What string `json:"what"`
 	// Server-issued message ID being reported
 	SeqId int `json:"seq,omitempty"`
+	// Kind of activity for "kp": empty for typing, "audio", "video", "file", "sticker".
+	// Response for "rsvp": "yes", "no", "maybe" or empty if the response was withdrawn.
+	Act string `json:"act,omitempty"`
+	// Vote as submitted with {note what="vote"}, not sent to clients.
+	Vote []int `json:"-"`
+	// The receipt is sent to the user's own sessions only, set by the master topic.
+	Private bool `json:"-"`
+	// Number of votes for each option of the poll after the "vote".
+	Tally []int `json:"tally,omitempty"`
 }
 
 // Deep copy
@@ -749,6 +1689,9 @@ func (src *MsgServerInfo) describe() string {
 	if src.SeqId > 0 {
 		s += " seq=" + strconv.Itoa(src.SeqId)
 	}
+	if src.Act != "" {
+		s += " act=" + src.Act
+	}
 	return s
 }
 
@@ -778,6 +1721,38 @@ type ServerComMessage struct {
 	SkipSid string `json:"-"`
 	// User id affected by this message.
 	uid types.Uid
+	// Link preview to attach to the message, set by the server only.
+	preview *linkPreviewUpdate
+
+	// Serialized representations of the message cached for reuse when the message is fanned out
+	// to multiple sessions. Nil unless caching is explicitly enabled with enableSerializeCache().
+	serialized map[string]interface{}
+}
+
+// enableSerializeCache turns on caching of serialized forms of the message. The message must not
+// be modified after this call except for per-recipient fields which are part of serializeCacheKey().
+func (src *ServerComMessage) enableSerializeCache() {
+	src.serialized = make(map[string]interface{})
+}
+
+// disableSerializeCache discards cached serialized forms of the message.
+func (src *ServerComMessage) disableSerializeCache() {
+	src.serialized = nil
+}
+
+// serializeCacheKey returns a key identifying the per-recipient variant of the message
+// serialized in the given format.
+func (src *ServerComMessage) serializeCacheKey(format SessionProto) string {
+	key := strconv.Itoa(int(format))
+	switch {
+	case src.Data != nil:
+		key += ":" + src.Data.Topic + ":" + src.Data.From
+	case src.Pres != nil:
+		key += ":" + src.Pres.Topic
+	case src.Info != nil:
+		key += ":" + src.Info.Topic
+	}
+	return key
 }
 
 // Deep-shallow copy of ServerComMessage. Deep copy of service fields,
@@ -794,6 +1769,7 @@ func (src *ServerComMessage) copy() *ServerComMessage {
 		sess:      src.sess,
 		SkipSid:   src.SkipSid,
 		uid:       src.uid,
+		preview:   src.preview,
 	}
 
 	dst.Ctrl = src.Ctrl.copy()
@@ -928,6 +1904,24 @@ func NoErrShutdown(ts time.Time) *ServerComMessage {
 		Timestamp: ts}}
 }
 
+// NoErrClientConfig is an unsolicited update to the client configuration (200).
+func NoErrClientConfig(config map[string]interface{}, ts time.Time) *ServerComMessage {
+	return &ServerComMessage{Ctrl: &MsgServerCtrl{
+		Code:      http.StatusOK, // 200
+		Text:      "ok",
+		Params:    map[string]interface{}{"what": "config", "config": config},
+		Timestamp: ts}}
+}
+
+// NoErrMaintenance is an unsolicited notification of scheduled maintenance (200).
+func NoErrMaintenance(maintenance map[string]interface{}, ts time.Time) *ServerComMessage {
+	return &ServerComMessage{Ctrl: &MsgServerCtrl{
+		Code:      http.StatusOK, // 200
+		Text:      "ok",
+		Params:    map[string]interface{}{"what": "maintenance", "maintenance": maintenance},
+		Timestamp: ts}}
+}
+
 // NoErrDelivered means requested content has been delivered (208).
 func NoErrDeliveredParams(id, topic string, ts time.Time, params interface{}) *ServerComMessage {
 	return &ServerComMessage{Ctrl: &MsgServerCtrl{
@@ -939,6 +1933,38 @@ func NoErrDeliveredParams(id, topic string, ts time.Time, params interface{}) *S
 		Timestamp: ts}, Id: id}
 }
 
+// NoErrDropped informs the client that some {pres} or {info} notifications were dropped because
+// the client could not keep up. The client should resync topic state (206).
+func NoErrDropped(ts time.Time, count int) *ServerComMessage {
+	return &ServerComMessage{Ctrl: &MsgServerCtrl{
+		Code:      http.StatusPartialContent, // 206
+		Text:      "dropped",
+		Params:    map[string]interface{}{"count": count},
+		Timestamp: ts}}
+}
+
+// NoErrSkipped informs the client that {data} messages in range [since, before) were not sent
+// because the flow control window was exhausted. The client may fetch them with {get what="data"} (206).
+func NoErrSkipped(topic string, ts time.Time, count, since, before int) *ServerComMessage {
+	return &ServerComMessage{Ctrl: &MsgServerCtrl{
+		Code:      http.StatusPartialContent, // 206
+		Text:      "skipped",
+		Topic:     topic,
+		Params:    map[string]interface{}{"count": count, "since": since, "before": before},
+		Timestamp: ts}}
+}
+
+// NoErrTruncated informs the client that unacknowledged {data} messages in range [since, before) were
+// not redelivered because there were too many of them. The client may fetch them with {get what="data"} (206).
+func NoErrTruncated(topic string, ts time.Time, count, since, before int) *ServerComMessage {
+	return &ServerComMessage{Ctrl: &MsgServerCtrl{
+		Code:      http.StatusPartialContent, // 206
+		Text:      "truncated",
+		Topic:     topic,
+		Params:    map[string]interface{}{"count": count, "since": since, "before": before},
+		Timestamp: ts}}
+}
+
 // 3xx
 
 // InfoValidateCredentials requires user to confirm credentials before going forward (300).
@@ -1337,6 +2363,14 @@ func ErrPolicyReply(msg *ClientComMessage, ts time.Time) *ServerComMessage {
 	return ErrPolicyExplicitTs(msg.Id, msg.Original, ts, msg.Timestamp)
 }
 
+// ErrPolicyLimitReply request exceeds the limit 'what' in response to a client request (422).
+// The name of the limit and its value are reported in params.
+func ErrPolicyLimitReply(msg *ClientComMessage, ts time.Time, what string, limit int) *ServerComMessage {
+	resp := ErrPolicyExplicitTs(msg.Id, msg.Original, ts, msg.Timestamp)
+	resp.Ctrl.Params = map[string]interface{}{"what": what, "limit": limit}
+	return resp
+}
+
 // ErrLockedReply operation rejected because the topic is being deleted
 // with explicit server and incoming request timestamps in response to a client request (423).
 func ErrLockedReply(msg *ClientComMessage, ts time.Time) *ServerComMessage {
@@ -1399,6 +2433,22 @@ func ErrServiceUnavailableExplicitTs(id, topic string, serverTs, incomingReqTs t
 		Timestamp: serverTs}, Id: id, Timestamp: incomingReqTs}
 }
 
+// ErrMaintenance operation rejected because the server is under maintenance (503).
+func ErrMaintenance(id, topic string, serverTs, incomingReqTs time.Time, window *maintenanceWindow) *ServerComMessage {
+	msg := ErrServiceUnavailableExplicitTs(id, topic, serverTs, incomingReqTs)
+	params := map[string]interface{}{
+		"what": "maintenance",
+		"end":  window.End,
+		// Retry delay is rounded up to whole seconds.
+		"retry": int((window.End.Sub(serverTs) + time.Second - 1) / time.Second),
+	}
+	if window.Note != "" {
+		params["note"] = window.Note
+	}
+	msg.Ctrl.Params = params
+	return msg
+}
+
 // ErrLocked operation rejected because the topic is being deleted (503).
 func ErrLocked(id, topic string, ts time.Time) *ServerComMessage {
 	return ErrLockedExplicitTs(id, topic, ts, ts)
@@ -1415,6 +2465,17 @@ func ErrLockedExplicitTs(id, topic string, serverTs, incomingReqTs time.Time) *S
 		Timestamp: serverTs}, Id: id, Timestamp: incomingReqTs}
 }
 
+// ErrUpgradeRequired the client application is too old and must be upgraded (426).
+func ErrUpgradeRequired(id, topic string, ts time.Time, params interface{}) *ServerComMessage {
+	return &ServerComMessage{Ctrl: &MsgServerCtrl{
+		Id:        id,
+		Code:      http.StatusUpgradeRequired, // 426
+		Text:      "upgrade required",
+		Topic:     topic,
+		Params:    params,
+		Timestamp: ts}, Id: id, Timestamp: ts}
+}
+
 // ErrVersionNotSupported invalid (too low) protocol version (505).
 func ErrVersionNotSupported(id string, ts time.Time) *ServerComMessage {
 	return &ServerComMessage{Ctrl: &MsgServerCtrl{
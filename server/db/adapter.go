@@ -51,6 +51,9 @@ type Adapter interface {
 	UserUpdateTags(uid t.Uid, add, remove, reset []string) ([]string, error)
 	// UserGetByCred returns user ID for the given validated credential.
 	UserGetByCred(method, value string) (t.Uid, error)
+	// UserGetByState returns IDs of users who have been in the given state since before the given time,
+	// ordered by ID, starting after the given ID.
+	UserGetByState(state t.ObjState, before time.Time, after t.Uid, limit int) ([]t.Uid, error)
 	// UserUnreadCount returns the total number of unread messages in all topics with
 	// the R permission.
 	UserUnreadCount(uid t.Uid) (int, error)
@@ -94,6 +97,12 @@ type Adapter interface {
 	TopicCreateP2P(initiator, invited *t.Subscription) error
 	// TopicGet loads a single topic by name, if it exists. If the topic does not exist the call returns (nil, nil)
 	TopicGet(topic string) (*t.Topic, error)
+	// TopicGetByState loads up to limit topics in the given state, oldest first.
+	TopicGetByState(state t.ObjState, limit int) ([]t.Topic, error)
+	// TopicGetChildren loads up to limit topics which have the given parent, oldest first.
+	TopicGetChildren(parent string, limit int) ([]t.Topic, error)
+	// TopicGetDirectory loads one page of active topics which have the category tag of the query.
+	TopicGetDirectory(query *t.TopicDirectoryQuery) ([]t.Topic, error)
 	// TopicsForUser loads subscriptions for a given user. Reads public value.
 	TopicsForUser(uid t.Uid, keepDeleted bool, opts *t.QueryOpt) ([]t.Subscription, error)
 	// UsersForTopic loads users' subscriptions for a given topic. Public is loaded.
@@ -108,7 +117,8 @@ type Adapter interface {
 	TopicUpdateOnMessage(topic string, msg *t.Message) error
 	// TopicUpdate updates topic record.
 	TopicUpdate(topic string, update map[string]interface{}) error
-	// TopicOwnerChange updates topic's owner
+	// TopicOwnerChange updates topic's owner and moves the O permission from the subscription of the old owner
+	// to the subscription of the new owner.
 	TopicOwnerChange(topic string, newOwner t.Uid) error
 	// Topic subscriptions
 
@@ -118,6 +128,8 @@ type Adapter interface {
 	SubsForUser(user t.Uid, keepDeleted bool, opts *t.QueryOpt) ([]t.Subscription, error)
 	// SubsForTopic gets a list of subscriptions to a given topic.. Does NOT load Public value.
 	SubsForTopic(topic string, keepDeleted bool, opts *t.QueryOpt) ([]t.Subscription, error)
+	// SubsCountForTopic returns the number of subscriptions to the given topic which are not deleted.
+	SubsCountForTopic(topic string) (int, error)
 	// SubsUpdate updates pasrt of a subscription object. Pass nil for fields which don't need to be updated
 	SubsUpdate(topic string, user t.Uid, update map[string]interface{}) error
 	// SubsDelete deletes a single subscription
@@ -131,8 +143,8 @@ type Adapter interface {
 
 	// FindUsers searches for new contacts given a list of tags
 	FindUsers(user t.Uid, req [][]string, opt []string) ([]t.Subscription, error)
-	// FindTopics searches for group topics given a list of tags
-	FindTopics(req [][]string, opt []string) ([]t.Subscription, error)
+	// FindTopics searches for group topics given a list of tags. Topics with any of the excluded tags are skipped.
+	FindTopics(req [][]string, opt []string, excl []string) ([]t.Subscription, error)
 
 	// Messages
 
@@ -140,6 +152,8 @@ type Adapter interface {
 	MessageSave(msg *t.Message) error
 	// MessageGetAll returns messages matching the query
 	MessageGetAll(topic string, forUser t.Uid, opts *t.QueryOpt) ([]t.Message, error)
+	// MessageSearch returns messages of the topic matching the full-text query and not deleted for the user.
+	MessageSearch(topic string, forUser t.Uid, query string, opts *t.QueryOpt) ([]t.Message, error)
 	// MessageDeleteList marks messages as deleted.
 	// Soft- or Hard- is defined by forUser value: forUSer.IsZero == true is hard.
 	MessageDeleteList(topic string, toDel *t.DelMessage) error
@@ -147,6 +161,14 @@ type Adapter interface {
 	MessageGetDeleted(topic string, forUser t.Uid, opts *t.QueryOpt) ([]t.DelMessage, error)
 	// MessageAttachments connects given message to a list of file record IDs.
 	MessageAttachments(msgId t.Uid, fids []string) error
+	// MessageAttachmentsUpdate connects the message to the added file record IDs and disconnects it from
+	// the removed ones.
+	MessageAttachmentsUpdate(topic string, seqId int, added, removed []string) error
+	// MessageUpdate replaces headers and content of a message.
+	MessageUpdate(topic string, seqId int, head t.MessageHeaders, content interface{}) error
+	// MessageThreadReply increments the count of replies of the first message of a thread
+	// and records the time of the latest reply.
+	MessageThreadReply(topic string, root int, at time.Time) error
 
 	// Devices (for push notifications)
 
@@ -156,6 +178,12 @@ type Adapter interface {
 	DeviceGetAll(uid ...t.Uid) (map[t.Uid][]t.DeviceDef, int, error)
 	// DeviceDelete deletes a device record
 	DeviceDelete(uid t.Uid, deviceID string) error
+	// DevicePushResults records results of push notifications: success resets the failure count,
+	// failure increments it.
+	DevicePushResults(delivered, failed []string, at time.Time) error
+	// DeviceDeleteStale deletes devices with at least maxFailures failed push notifications in a row or
+	// not seen since idleBefore. Returns the number of affected users.
+	DeviceDeleteStale(maxFailures int, idleBefore time.Time) (int, error)
 
 	// File upload records. The files are stored outside of the database.
 
@@ -169,4 +197,98 @@ type Adapter interface {
 	// unused records with UpdatedAt before olderThan.
 	// Returns array of FileDef.Location of deleted filerecords so actual files can be deleted too.
 	FileDeleteUnused(olderThan time.Time, limit int) ([]string, error)
+
+	// Custom emoji packs. The images are stored as file uploads.
+
+	// PackUpsert creates or replaces an emoji pack and marks the pack's files as used.
+	PackUpsert(pack *t.EmojiPack) error
+	// PackGet returns packs with the given IDs.
+	PackGet(ids ...string) ([]t.EmojiPack, error)
+	// PackGetForOrg returns packs which belong to any of the given organizations.
+	PackGetForOrg(orgs ...string) ([]t.EmojiPack, error)
+	// PackDelete deletes the pack and releases the pack's files.
+	PackDelete(id string) error
+
+	// Channel digests.
+
+	// DigestUpsert creates or replaces the digest of a channel reader.
+	DigestUpsert(dg *t.Digest) error
+	// DigestGet returns the digest of the channel reader or nil if there is none.
+	DigestGet(topic string, user t.Uid) (*t.Digest, error)
+	// DigestGetDue returns digests with NextAt before the given time, earliest first.
+	DigestGetDue(before time.Time, limit int) ([]t.Digest, error)
+	// DigestDelete deletes the digest of the channel reader.
+	DigestDelete(topic string, user t.Uid) error
+
+	// Events announced in topics.
+
+	// CalEventUpsert creates or replaces the event.
+	CalEventUpsert(ev *t.CalEvent) error
+	// CalEventGet returns the event announced by the message or nil if there is none.
+	CalEventGet(topic string, seqId int) (*t.CalEvent, error)
+	// CalEventGetAll returns events of the topic starting at or after the given time, earliest first.
+	CalEventGetAll(topic string, since time.Time, limit int) ([]t.CalEvent, error)
+	// CalEventGetDue returns events with RemindAt before the given time, earliest first.
+	CalEventGetDue(before time.Time, limit int) ([]t.CalEvent, error)
+	// CalEventRsvp records the response of the user to the event, an empty response removes it.
+	CalEventRsvp(topic string, seqId int, user t.Uid, resp string) error
+	// CalEventReminded marks the reminder of the event as sent.
+	CalEventReminded(topic string, seqId int) error
+
+	// Per-message read receipts.
+
+	// ReceiptCreate records that the user has read a range of messages.
+	ReceiptCreate(rcpt *t.Receipt) error
+	// ReceiptsForMessage returns receipts of all users who have read the message, earliest first.
+	ReceiptsForMessage(topic string, seqId int) ([]t.Receipt, error)
+
+	// Polls.
+
+	// PollCreate saves a new poll.
+	PollCreate(poll *t.Poll) error
+	// PollGet returns the poll created by the message or nil if there is none.
+	PollGet(topic string, seqId int) (*t.Poll, error)
+	// PollVote records the vote of the user replacing the previous one, an empty vote removes it.
+	PollVote(topic string, seqId int, user t.Uid, options []int) error
+
+	// Unread mentions.
+
+	// MentionsCreate records mentions of users and replies in threads started by users.
+	MentionsCreate(mentions []t.Mention) error
+	// MentionsDelete removes mentions and thread replies of the user in the topic up to and including
+	// seqId, all of them if seqId is 0. Returns the number of removed mentions, thread replies are not counted.
+	MentionsDelete(topic string, user t.Uid, seqId int) (int, error)
+	// MentionsCount returns the number of unread mentions of the user across all topics.
+	MentionsCount(user t.Uid) (int, error)
+	// MentionsGetAll returns unread mentions and thread replies of the user across all topics, newest first.
+	MentionsGetAll(user t.Uid, limit int) ([]t.Mention, error)
+
+	// Starred messages.
+
+	// BookmarkCreate saves the bookmark, does nothing if the message is already starred by the user.
+	BookmarkCreate(bm *t.Bookmark) error
+	// BookmarkDelete removes the bookmark of the message.
+	BookmarkDelete(user t.Uid, topic string, seqId int) error
+	// BookmarkGetAll returns bookmarks of the user, newest first.
+	BookmarkGetAll(user t.Uid, limit int) ([]t.Bookmark, error)
+
+	// View-once attachments.
+
+	// ViewOnceCreate marks files attached to a message as view-once.
+	ViewOnceCreate(vos []t.ViewOnce) error
+	// ViewOnceGet returns the view-once mark of the file, nil if the file is not view-once.
+	ViewOnceGet(fid string) (*t.ViewOnce, error)
+	// ViewOnceView records that the user has retrieved the file. Returns false if the user
+	// has retrieved it before.
+	ViewOnceView(view *t.ViewOnceView) (bool, error)
+
+	// Account activity timeline.
+
+	// AccountEventCreate saves a security-related event of the user's account.
+	AccountEventCreate(ev *t.AccountEvent) error
+	// AccountEventGetAll returns events of the user, newest first.
+	AccountEventGetAll(user t.Uid, limit int) ([]t.AccountEvent, error)
+	// AccountEventDeleteOlder deletes events of all users created before the given time.
+	// Returns the number of deleted events.
+	AccountEventDeleteOlder(before time.Time) (int, error)
 }
@@ -40,7 +40,7 @@ const (
 	defaultHost     = "localhost:27017"
 	defaultDatabase = "tinode"
 
-	adpVersion  = 111
+	adpVersion  = 155
 	adapterName = "mongodb"
 
 	defaultMaxResults = 1024
@@ -324,6 +324,11 @@ func (a *adapter) CreateDb(reset bool) error {
 			Collection: "topics",
 			Field:      "tags",
 		},
+		// Index on 'parent' for listing child topics of a space.
+		{
+			Collection: "topics",
+			Field:      "parent",
+		},
 
 		// Stored message
 		// Compound index of 'topic - seqid' for selecting messages in a topic.
@@ -336,6 +341,26 @@ func (a *adapter) CreateDb(reset bool) error {
 			Collection: "messages",
 			IndexOpts:  mdb.IndexModel{Keys: b.M{"topic": 1, "delid": 1}},
 		},
+		// Compound index of thread replies.
+		{
+			Collection: "messages",
+			IndexOpts:  mdb.IndexModel{Keys: b.M{"topic": 1, "thread": 1, "seqid": 1}},
+		},
+		// Compound index of messages by type of media.
+		{
+			Collection: "messages",
+			IndexOpts:  mdb.IndexModel{Keys: b.D{{Key: "topic", Value: 1}, {Key: "mediatype", Value: 1}, {Key: "seqid", Value: 1}}},
+		},
+		// Compound index of messages by MIME type of attachments.
+		{
+			Collection: "messages",
+			IndexOpts:  mdb.IndexModel{Keys: b.D{{Key: "topic", Value: 1}, {Key: "mime", Value: 1}, {Key: "seqid", Value: 1}}},
+		},
+		// Full-text index of message content.
+		{
+			Collection: "messages",
+			IndexOpts:  messagesTextIndex,
+		},
 		// Compound multi-index of soft-deleted messages: each message gets multiple compound index entries like
 		// 		 [topic, user1, delid1], [topic, user2, delid2],...
 		{
@@ -369,6 +394,99 @@ func (a *adapter) CreateDb(reset bool) error {
 			Collection: "fileuploads",
 			Field:      "usecount",
 		},
+
+		// Custom emoji packs. See types.EmojiPack.
+		// Index on 'emojipacks.org' to be able to get packs of an organization.
+		{
+			Collection: "emojipacks",
+			Field:      "org",
+		},
+
+		// Channel digests. See types.Digest.
+		// Index on 'digests.nextat' to be able to find digests which are due.
+		{
+			Collection: "digests",
+			Field:      "nextat",
+		},
+
+		// Events announced in topics. See types.CalEvent.
+		// Compound index 'topic - startat' to be able to get upcoming events of a topic.
+		{
+			Collection: "calevents",
+			IndexOpts:  mdb.IndexModel{Keys: b.D{{Key: "topic", Value: 1}, {Key: "startat", Value: 1}}},
+		},
+		// Index on 'calevents.remindat' to be able to find reminders which are due.
+		{
+			Collection: "calevents",
+			Field:      "remindat",
+		},
+
+		// Per-message read receipts. See types.Receipt.
+		// Compound index 'topic - seqto' to be able to find receipts of a message.
+		{
+			Collection: "receipts",
+			IndexOpts:  mdb.IndexModel{Keys: b.D{{Key: "topic", Value: 1}, {Key: "seqto", Value: 1}}},
+		},
+
+		// Unread mentions. See types.Mention.
+		// Compound index 'user - topic - seqid' to be able to count and clear mentions of the user.
+		{
+			Collection: "mentions",
+			IndexOpts:  mdb.IndexModel{Keys: b.D{{Key: "user", Value: 1}, {Key: "topic", Value: 1}, {Key: "seqid", Value: 1}}},
+		},
+		// Index on 'topic' to delete mentions of a deleted topic.
+		{
+			Collection: "mentions",
+			Field:      "topic",
+		},
+
+		// Polls. See types.Poll.
+		// Index on 'topic' to delete polls of a deleted topic.
+		{
+			Collection: "polls",
+			Field:      "topic",
+		},
+
+		// Starred messages. See types.Bookmark.
+		// Compound index 'user - createdat' to be able to list bookmarks of the user, newest first.
+		{
+			Collection: "bookmarks",
+			IndexOpts:  mdb.IndexModel{Keys: b.D{{Key: "user", Value: 1}, {Key: "createdat", Value: -1}}},
+		},
+		// Index on 'topic' to delete bookmarks of a deleted topic.
+		{
+			Collection: "bookmarks",
+			Field:      "topic",
+		},
+
+		// View-once attachments. See types.ViewOnce and types.ViewOnceView.
+		// Index on 'topic' to delete view-once marks of files in a deleted topic.
+		{
+			Collection: "viewonce",
+			Field:      "topic",
+		},
+		// Index on 'user' to delete retrievals of a deleted user.
+		{
+			Collection: "viewoncelog",
+			Field:      "user",
+		},
+		// Index on 'topic' to delete retrievals in a deleted topic.
+		{
+			Collection: "viewoncelog",
+			Field:      "topic",
+		},
+
+		// Account activity timeline. See types.AccountEvent.
+		// Compound index on 'user' and 'createdat' to get the timeline of the user.
+		{
+			Collection: "accountevents",
+			IndexOpts:  mdb.IndexModel{Keys: b.D{{Key: "user", Value: 1}, {Key: "createdat", Value: -1}}},
+		},
+		// Index on 'createdat' to delete events past the retention period.
+		{
+			Collection: "accountevents",
+			Field:      "createdat",
+		},
 	}
 
 	var err error
@@ -482,6 +600,434 @@ func (a *adapter) UpgradeDb() error {
 		}
 	}
 
+	if a.version == 111 {
+		// Perform database upgrade from version 111 to version 112.
+		// Users.Blocked is added on first write, nothing to do.
+		if err := bumpVersion(a, 112); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 112 {
+		// Perform database upgrade from version 112 to version 113.
+		// Users.Aliases is added on first write, nothing to do.
+		if err := bumpVersion(a, 113); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 113 {
+		// Perform database upgrade from version 113 to version 114.
+		// Subscriptions.Cursors is added on first write, nothing to do.
+		if err := bumpVersion(a, 114); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 114 {
+		// Perform database upgrade from version 114 to version 115.
+		// Subscriptions.Draft is added on first write, nothing to do.
+		if err := bumpVersion(a, 115); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 115 {
+		// Perform database upgrade from version 115 to version 116.
+		// Users.Trusted is added on first write, nothing to do.
+		if err := bumpVersion(a, 116); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 116 {
+		// Perform database upgrade from version 116 to version 117.
+		// Topics.Packs is added on first write. Collection 'emojipacks' is created on first write.
+		if _, err := a.db.Collection("emojipacks").Indexes().CreateOne(a.ctx, mdb.IndexModel{Keys: b.M{"org": 1}}); err != nil {
+			return err
+		}
+
+		if err := bumpVersion(a, 117); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 117 {
+		// Perform database upgrade from version 117 to version 118.
+		// Subscriptions.DlvSeqId is added on first write, nothing to do.
+		if err := bumpVersion(a, 118); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 118 {
+		// Perform database upgrade from version 118 to version 119.
+		// Topics.Webhook is added on first write, nothing to do.
+		if err := bumpVersion(a, 119); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 119 {
+		// Perform database upgrade from version 119 to version 120.
+		// Users.AutoReply is added on first write, nothing to do.
+		if err := bumpVersion(a, 120); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 120 {
+		// Perform database upgrade from version 120 to version 121.
+		// Topics.Stats is added on first write, nothing to do.
+		if err := bumpVersion(a, 121); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 121 {
+		// Perform database upgrade from version 121 to version 122.
+		// Topics.Guests is added on first write, nothing to do.
+		if err := bumpVersion(a, 122); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 122 {
+		// Perform database upgrade from version 122 to version 123.
+		// Topics.Owners is added on first write, nothing to do.
+		if err := bumpVersion(a, 123); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 123 {
+		// Perform database upgrade from version 123 to version 124.
+		// Users.AutoTranslate is added on first write, nothing to do.
+		if err := bumpVersion(a, 124); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 124 {
+		// Perform database upgrade from version 124 to version 125.
+		// Collection 'digests' is created on first write.
+		if _, err := a.db.Collection("digests").Indexes().CreateOne(a.ctx, mdb.IndexModel{Keys: b.M{"nextat": 1}}); err != nil {
+			return err
+		}
+
+		if err := bumpVersion(a, 125); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 125 {
+		// Perform database upgrade from version 125 to version 126.
+		// Subscriptions.MuteUntil is added on first write, nothing to do.
+		if err := bumpVersion(a, 126); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 126 {
+		// Perform database upgrade from version 126 to version 127.
+		// Users.ChatList is added on first write, nothing to do.
+		if err := bumpVersion(a, 127); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 127 {
+		// Perform database upgrade from version 127 to version 128.
+		if _, err := a.db.Collection("messages").Indexes().CreateOne(a.ctx,
+			mdb.IndexModel{Keys: b.M{"topic": 1, "thread": 1, "seqid": 1}}); err != nil {
+			return err
+		}
+
+		if err := bumpVersion(a, 128); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 128 {
+		// Perform database upgrade from version 128 to version 129.
+		// Users.Consent is added on first write, nothing to do.
+		if err := bumpVersion(a, 129); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 129 {
+		// Perform database upgrade from version 129 to version 130.
+		// Devices.LastPushAt and Devices.PushFailures are added on first write, nothing to do.
+		if err := bumpVersion(a, 130); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 130 {
+		// Perform database upgrade from version 130 to version 131.
+		if _, err := a.db.Collection("messages").Indexes().CreateOne(a.ctx, messagesTextIndex); err != nil {
+			return err
+		}
+
+		if err := bumpVersion(a, 131); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 131 {
+		// Perform database upgrade from version 131 to version 132.
+		// Collection 'calevents' is created on first write.
+		if _, err := a.db.Collection("calevents").Indexes().CreateOne(a.ctx,
+			mdb.IndexModel{Keys: b.D{{Key: "topic", Value: 1}, {Key: "startat", Value: 1}}}); err != nil {
+			return err
+		}
+		if _, err := a.db.Collection("calevents").Indexes().CreateOne(a.ctx, mdb.IndexModel{Keys: b.M{"remindat": 1}}); err != nil {
+			return err
+		}
+
+		if err := bumpVersion(a, 132); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 132 {
+		// Perform database upgrade from version 132 to version 133.
+		// Collection 'receipts' is created on first write.
+		if _, err := a.db.Collection("receipts").Indexes().CreateOne(a.ctx,
+			mdb.IndexModel{Keys: b.D{{Key: "topic", Value: 1}, {Key: "seqto", Value: 1}}}); err != nil {
+			return err
+		}
+
+		if err := bumpVersion(a, 133); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 133 {
+		// Perform database upgrade from version 133 to version 134.
+		// Collection 'mentions' is created on first write.
+		if _, err := a.db.Collection("mentions").Indexes().CreateMany(a.ctx, []mdb.IndexModel{
+			{Keys: b.D{{Key: "user", Value: 1}, {Key: "topic", Value: 1}, {Key: "seqid", Value: 1}}},
+			{Keys: b.M{"topic": 1}},
+		}); err != nil {
+			return err
+		}
+
+		if err := bumpVersion(a, 134); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 134 {
+		// Perform database upgrade from version 134 to version 135.
+		// Collection 'polls' is created on first write.
+		if _, err := a.db.Collection("polls").Indexes().CreateOne(a.ctx, mdb.IndexModel{Keys: b.M{"topic": 1}}); err != nil {
+			return err
+		}
+
+		if err := bumpVersion(a, 135); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 135 {
+		// Perform database upgrade from version 135 to version 136.
+		// Collection 'bookmarks' is created on first write.
+		if _, err := a.db.Collection("bookmarks").Indexes().CreateMany(a.ctx, []mdb.IndexModel{
+			{Keys: b.D{{Key: "user", Value: 1}, {Key: "createdat", Value: -1}}},
+			{Keys: b.M{"topic": 1}},
+		}); err != nil {
+			return err
+		}
+
+		if err := bumpVersion(a, 136); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 136 {
+		// Perform database upgrade from version 136 to version 137.
+		// Topics.Limits is added on first write, nothing to do.
+		if err := bumpVersion(a, 137); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 137 {
+		// Perform database upgrade from version 137 to version 138.
+		// Collections 'viewonce' and 'viewoncelog' are created on first write.
+		if _, err := a.db.Collection("viewonce").Indexes().CreateOne(a.ctx, mdb.IndexModel{Keys: b.M{"topic": 1}}); err != nil {
+			return err
+		}
+		if _, err := a.db.Collection("viewoncelog").Indexes().CreateMany(a.ctx, []mdb.IndexModel{
+			{Keys: b.M{"user": 1}},
+			{Keys: b.M{"topic": 1}},
+		}); err != nil {
+			return err
+		}
+
+		if err := bumpVersion(a, 138); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 138 {
+		// Perform database upgrade from version 138 to version 139.
+		// Users.Birthdate is added on first write, nothing to do.
+		if err := bumpVersion(a, 139); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 139 {
+		// Perform database upgrade from version 139 to version 140.
+		// Subscriptions.AnchorSeq is added on first write, nothing to do.
+		if err := bumpVersion(a, 140); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 140 {
+		// Perform database upgrade from version 140 to version 141.
+		// Mentions.Thread and Mentions.CreatedAt are added on first write, nothing to do.
+		if err := bumpVersion(a, 141); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 141 {
+		// Perform database upgrade from version 141 to version 142.
+		if _, err := a.db.Collection("messages").Indexes().CreateOne(a.ctx,
+			mdb.IndexModel{Keys: b.D{{Key: "topic", Value: 1}, {Key: "mediatype", Value: 1}, {Key: "seqid", Value: 1}}}); err != nil {
+			return err
+		}
+
+		if err := bumpVersion(a, 142); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 142 {
+		// Perform database upgrade from version 142 to version 143.
+		if _, err := a.db.Collection("messages").Indexes().CreateOne(a.ctx,
+			mdb.IndexModel{Keys: b.D{{Key: "topic", Value: 1}, {Key: "mime", Value: 1}, {Key: "seqid", Value: 1}}}); err != nil {
+			return err
+		}
+
+		if err := bumpVersion(a, 143); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 143 {
+		// Perform database upgrade from version 143 to version 144.
+		// Topics.Announce is added on first write, nothing to do.
+
+		if err := bumpVersion(a, 144); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 144 {
+		// Perform database upgrade from version 144 to version 145.
+		// Collection 'accountevents' is created on first write.
+		if _, err := a.db.Collection("accountevents").Indexes().CreateMany(a.ctx, []mdb.IndexModel{
+			{Keys: b.D{{Key: "user", Value: 1}, {Key: "createdat", Value: -1}}},
+			{Keys: b.M{"createdat": 1}},
+		}); err != nil {
+			return err
+		}
+
+		if err := bumpVersion(a, 145); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 145 {
+		// Perform database upgrade from version 145 to version 146.
+		// Subscriptions.Role is added on first write, nothing to do.
+		if err := bumpVersion(a, 146); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 146 {
+		// Perform database upgrade from version 146 to version 147.
+		// Topics.Capacity is added on first write, nothing to do.
+		if err := bumpVersion(a, 147); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 147 {
+		// Perform database upgrade from version 147 to version 148.
+		// Topics.Parent is added on first write, the index is needed for listing child topics.
+		if _, err := a.db.Collection("topics").Indexes().CreateOne(a.ctx, mdb.IndexModel{Keys: b.M{"parent": 1}}); err != nil {
+			return err
+		}
+
+		if err := bumpVersion(a, 148); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 148 {
+		// Perform database upgrade from version 148 to version 149.
+		// Subscriptions.Request is added on first write, nothing to do.
+		if err := bumpVersion(a, 149); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 149 {
+		// Perform database upgrade from version 149 to version 150.
+		// Subscriptions.Quiet is added on first write, nothing to do.
+		if err := bumpVersion(a, 150); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 150 {
+		// Perform database upgrade from version 150 to version 151.
+		// Topics.MaxSubs is added on first write, nothing to do.
+		if err := bumpVersion(a, 151); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 151 {
+		// Perform database upgrade from version 151 to version 152.
+		// Topics.Freeze is added on first write, nothing to do.
+		if err := bumpVersion(a, 152); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 152 {
+		// Perform database upgrade from version 152 to version 153.
+		// Subscriptions.Notify is added on first write, nothing to do.
+		if err := bumpVersion(a, 153); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 153 {
+		// Perform database upgrade from version 153 to version 154.
+		// Subscriptions.Ban is added on first write, nothing to do.
+		if err := bumpVersion(a, 154); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 154 {
+		// Perform database upgrade from version 154 to version 155.
+		// Topics.Expiry is added on first write, nothing to do.
+		if err := bumpVersion(a, 155); err != nil {
+			return err
+		}
+	}
+
 	if a.version != adpVersion {
 		return errors.New("Failed to perform database upgrade to version " + strconv.Itoa(adpVersion) +
 			". DB is still at " + strconv.Itoa(a.version))
@@ -537,6 +1083,8 @@ func (a *adapter) UserGet(id t.Uid) (*t.User, error) {
 		}
 	}
 	user.Public = unmarshalBsonD(user.Public)
+	user.Trusted = unmarshalBsonD(user.Trusted)
+	user.AutoReply.Content = unmarshalBsonD(user.AutoReply.Content)
 	return &user, nil
 }
 
@@ -561,6 +1109,8 @@ func (a *adapter) UserGetAll(ids ...t.Uid) ([]t.User, error) {
 			return nil, err
 		}
 		user.Public = unmarshalBsonD(user.Public)
+		user.Trusted = unmarshalBsonD(user.Trusted)
+		user.AutoReply.Content = unmarshalBsonD(user.AutoReply.Content)
 		users = append(users, user)
 	}
 	return users, nil
@@ -615,6 +1165,26 @@ func (a *adapter) UserDelete(uid t.Uid, hard bool) error {
 				return err
 			}
 
+			// Delete user's unread mentions.
+			if _, err = a.db.Collection("mentions").DeleteMany(sc, b.M{"user": uid.String()}); err != nil {
+				return err
+			}
+
+			// Delete user's bookmarks.
+			if _, err = a.db.Collection("bookmarks").DeleteMany(sc, b.M{"user": uid.String()}); err != nil {
+				return err
+			}
+
+			// Delete records of view-once attachments retrieved by the user.
+			if _, err = a.db.Collection("viewoncelog").DeleteMany(sc, b.M{"user": uid.String()}); err != nil {
+				return err
+			}
+
+			// Delete the activity timeline of the user.
+			if _, err = a.db.Collection("accountevents").DeleteMany(sc, b.M{"user": uid.String()}); err != nil {
+				return err
+			}
+
 			// Delete dellog
 			_, err = a.db.Collection("dellog").DeleteMany(sc, topicFilter)
 			if err != nil {
@@ -798,15 +1368,46 @@ func (a *adapter) UserGetByCred(method, value string) (t.Uid, error) {
 	return t.ParseUid(userId["user"]), nil
 }
 
+// UserGetByState returns IDs of users who have been in the given state since before the given time,
+// ordered by ID, starting after the given ID.
+func (a *adapter) UserGetByState(state t.ObjState, before time.Time, after t.Uid, limit int) ([]t.Uid, error) {
+	filter := b.M{"state": state, "stateat": b.M{"$lt": before}}
+	if !after.IsZero() {
+		filter["_id"] = b.M{"$gt": after.String()}
+	}
+	findOpts := mdbopts.Find().SetProjection(b.M{"_id": 1}).SetSort(b.M{"_id": 1}).SetLimit(int64(limit))
+	cur, err := a.db.Collection("users").Find(a.ctx, filter, findOpts)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(a.ctx)
+
+	var res map[string]string
+	var uids []t.Uid
+	for cur.Next(a.ctx) {
+		if err := cur.Decode(&res); err != nil {
+			return nil, err
+		}
+		uids = append(uids, t.ParseUid(res["_id"]))
+	}
+
+	return uids, nil
+}
+
 // UserUnreadCount returns the total number of unread messages in all topics with
 // the R permission.
 func (a *adapter) UserUnreadCount(uid t.Uid) (int, error) {
 	pipeline := b.A{
 		b.M{"$match": b.M{"user": uid.String()}},
+		// Subscriptions of channel readers 'chnXXX' count messages of the topic 'grpXXX'.
+		b.M{"$addFields": b.M{"seqtopic": b.M{"$cond": b.A{
+			b.M{"$eq": b.A{b.M{"$substrBytes": b.A{"$topic", 0, 3}}, "chn"}},
+			b.M{"$concat": b.A{"grp", b.M{"$substrBytes": b.A{"$topic", 3, -1}}}},
+			"$topic"}}}},
 		// Join documents from two collection
 		b.M{"$lookup": b.M{
 			"from":         "topics",
-			"localField":   "topic",
+			"localField":   "seqtopic",
 			"foreignField": "_id",
 			"as":           "fromTopics"},
 		},
@@ -1171,7 +1772,7 @@ func (a *adapter) undeleteSubscription(sub *t.Subscription) error {
 	_, err := a.db.Collection("subscriptions").UpdateOne(a.ctx,
 		b.M{"_id": sub.Id},
 		b.M{
-			"$unset": b.M{"deletedat": ""},
+			"$unset": b.M{"deletedat": "", "role": "", "request": "", "ban": ""},
 			"$set": b.M{
 				"updatedat": sub.UpdatedAt,
 				"createdat": sub.CreatedAt,
@@ -1233,6 +1834,98 @@ func (a *adapter) TopicGet(topic string) (*t.Topic, error) {
 	return tpc, nil
 }
 
+// TopicGetByState loads up to limit topics in the given state, oldest first.
+func (a *adapter) TopicGetByState(state t.ObjState, limit int) ([]t.Topic, error) {
+	findOpts := mdbopts.Find().SetSort(b.M{"createdat": 1}).SetLimit(int64(limit))
+	cur, err := a.db.Collection("topics").Find(a.ctx, b.M{"state": state}, findOpts)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(a.ctx)
+
+	var topics []t.Topic
+	for cur.Next(a.ctx) {
+		var tpc t.Topic
+		if err = cur.Decode(&tpc); err != nil {
+			return nil, err
+		}
+		tpc.Public = unmarshalBsonD(tpc.Public)
+		topics = append(topics, tpc)
+	}
+	return topics, cur.Err()
+}
+
+// TopicGetChildren loads up to limit topics which have the given parent, oldest first.
+func (a *adapter) TopicGetChildren(parent string, limit int) ([]t.Topic, error) {
+	findOpts := mdbopts.Find().SetSort(b.M{"createdat": 1}).SetLimit(int64(limit))
+	cur, err := a.db.Collection("topics").Find(a.ctx, b.M{"parent": parent}, findOpts)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(a.ctx)
+
+	var topics []t.Topic
+	for cur.Next(a.ctx) {
+		var tpc t.Topic
+		if err = cur.Decode(&tpc); err != nil {
+			return nil, err
+		}
+		tpc.Public = unmarshalBsonD(tpc.Public)
+		topics = append(topics, tpc)
+	}
+	return topics, cur.Err()
+}
+
+// TopicGetDirectory loads one page of active topics which have the category tag of the query.
+func (a *adapter) TopicGetDirectory(query *t.TopicDirectoryQuery) ([]t.Topic, error) {
+	// Number of members is saved with the counters of the topic.
+	match := b.M{"tags": query.Tag, "state": t.StateOK}
+	if len(query.Exclude) > 0 {
+		match["tags"] = b.M{"$eq": query.Tag, "$nin": query.Exclude}
+	}
+	pipeline := b.A{
+		b.M{"$match": match},
+		b.M{"$addFields": b.M{"dirkey": "$touchedat"}},
+	}
+	var after interface{}
+	if query.ByMembers {
+		pipeline[1] = b.M{"$addFields": b.M{"dirkey": b.M{"$ifNull": b.A{"$stats.members", 0}}}}
+		if query.After != nil {
+			after = query.After.Members
+		}
+	} else if query.After != nil {
+		after = query.After.TouchedAt
+	}
+	if query.After != nil {
+		// Topics after the last one of the previous page: lower sort key or the same key and greater name.
+		pipeline = append(pipeline, b.M{"$match": b.M{"$or": b.A{
+			b.M{"dirkey": b.M{"$lt": after}},
+			b.M{"dirkey": after, "_id": b.M{"$gt": query.After.Name}},
+		}}})
+	}
+	pipeline = append(pipeline,
+		b.M{"$sort": b.D{{Key: "dirkey", Value: -1}, {Key: "_id", Value: 1}}},
+		b.M{"$limit": query.Limit},
+		b.M{"$project": b.M{"dirkey": 0}})
+
+	cur, err := a.db.Collection("topics").Aggregate(a.ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(a.ctx)
+
+	var topics []t.Topic
+	for cur.Next(a.ctx) {
+		var tpc t.Topic
+		if err = cur.Decode(&tpc); err != nil {
+			return nil, err
+		}
+		tpc.Public = unmarshalBsonD(tpc.Public)
+		topics = append(topics, tpc)
+	}
+	return topics, cur.Err()
+}
+
 // TopicsForUser loads subscriptions for a given user. Reads public value.
 func (a *adapter) TopicsForUser(uid t.Uid, keepDeleted bool, opts *t.QueryOpt) ([]t.Subscription, error) {
 	// Fetch user's subscriptions
@@ -1344,8 +2037,9 @@ func (a *adapter) TopicsForUser(uid t.Uid, keepDeleted bool, opts *t.QueryOpt) (
 			return nil, err
 		}
 
-		var usr t.User
 		for cur.Next(a.ctx) {
+			// Decode does not reset fields missing from the document, use a new value every time.
+			var usr t.User
 			if err = cur.Decode(&usr); err != nil {
 				return nil, err
 			}
@@ -1355,6 +2049,7 @@ func (a *adapter) TopicsForUser(uid t.Uid, keepDeleted bool, opts *t.QueryOpt) (
 				sub.ObjHeader.MergeTimes(&usr.ObjHeader)
 				sub.SetState(usr.State)
 				sub.SetPublic(unmarshalBsonD(usr.Public))
+				sub.SetTrusted(unmarshalBsonD(usr.Trusted))
 				sub.SetWith(uid2.UserId())
 				sub.SetDefaultAccess(usr.Access.Auth, usr.Access.Anon)
 				sub.SetLastSeenAndUA(usr.LastSeen, usr.UserAgent)
@@ -1428,8 +2123,9 @@ func (a *adapter) UsersForTopic(topic string, keepDeleted bool, opts *t.QueryOpt
 			return nil, err
 		}
 
-		var usr t.User
 		for cur.Next(a.ctx) {
+			// Decode does not reset fields missing from the document, use a new value every time.
+			var usr t.User
 			if err = cur.Decode(&usr); err != nil {
 				return nil, err
 			}
@@ -1437,6 +2133,7 @@ func (a *adapter) UsersForTopic(topic string, keepDeleted bool, opts *t.QueryOpt
 				sub.ObjHeader.MergeTimes(&usr.ObjHeader)
 				sub.Private = unmarshalBsonD(sub.Private)
 				sub.SetPublic(unmarshalBsonD(usr.Public))
+				sub.SetTrusted(unmarshalBsonD(usr.Trusted))
 				subs = append(subs, sub)
 			}
 		}
@@ -1444,14 +2141,18 @@ func (a *adapter) UsersForTopic(topic string, keepDeleted bool, opts *t.QueryOpt
 	}
 
 	if t.GetTopicCat(topic) == t.TopicCatP2P && len(subs) > 0 {
-		// Swap public values of P2P topics as expected.
+		// Swap public and trusted values of P2P topics as expected.
 		if len(subs) == 1 {
 			// User is deleted. Nothing we can do.
 			subs[0].SetPublic(nil)
+			subs[0].SetTrusted(nil)
 		} else {
 			pub := subs[0].GetPublic()
 			subs[0].SetPublic(subs[1].GetPublic())
 			subs[1].SetPublic(pub)
+			trst := subs[0].GetTrusted()
+			subs[0].SetTrusted(subs[1].GetTrusted())
+			subs[1].SetTrusted(trst)
 		}
 
 		// Remove deleted and unneeded subscriptions
@@ -1530,6 +2231,24 @@ func (a *adapter) TopicDelete(topic string, hard bool) error {
 		if err = a.MessageDeleteList(topic, nil); err != nil {
 			return err
 		}
+		if _, err = a.db.Collection("receipts").DeleteMany(a.ctx, b.M{"topic": topic}); err != nil {
+			return err
+		}
+		if _, err = a.db.Collection("mentions").DeleteMany(a.ctx, b.M{"topic": topic}); err != nil {
+			return err
+		}
+		if _, err = a.db.Collection("polls").DeleteMany(a.ctx, b.M{"topic": topic}); err != nil {
+			return err
+		}
+		if _, err = a.db.Collection("bookmarks").DeleteMany(a.ctx, b.M{"topic": topic}); err != nil {
+			return err
+		}
+		if _, err = a.db.Collection("viewoncelog").DeleteMany(a.ctx, b.M{"topic": topic}); err != nil {
+			return err
+		}
+		if _, err = a.db.Collection("viewonce").DeleteMany(a.ctx, b.M{"topic": topic}); err != nil {
+			return err
+		}
 	}
 
 	filter := b.M{"_id": topic}
@@ -1555,9 +2274,63 @@ func (a *adapter) TopicUpdate(topic string, update map[string]interface{}) error
 	return a.topicUpdate(topic, normalizeUpdateMap(update))
 }
 
-// TopicOwnerChange updates topic's owner
+// TopicOwnerChange updates topic's owner and moves the O permission to the new owner.
 func (a *adapter) TopicOwnerChange(topic string, newOwner t.Uid) error {
-	return a.topicUpdate(topic, map[string]interface{}{"owner": newOwner.String()})
+	sess, err := a.conn.StartSession()
+	if err != nil {
+		return err
+	}
+	defer sess.EndSession(a.ctx)
+
+	if err = a.maybeStartTransaction(sess); err != nil {
+		return err
+	}
+	if err = mdb.WithSession(a.ctx, sess, func(sc mdb.SessionContext) error {
+		var tt t.Topic
+		if err := a.db.Collection("topics").FindOne(sc, b.M{"_id": topic}).Decode(&tt); err != nil {
+			if err == mdb.ErrNoDocuments {
+				err = t.ErrNotFound
+			}
+			return err
+		}
+		oldOwner := t.ParseUid(tt.Owner)
+
+		if _, err := a.db.Collection("topics").UpdateOne(sc, b.M{"_id": topic},
+			b.M{"$set": b.M{"owner": newOwner.String()}}); err != nil {
+			return err
+		}
+
+		// Move the O permission from the old owner to the new owner.
+		for _, user := range []t.Uid{oldOwner, newOwner} {
+			if user.IsZero() || (user == oldOwner && user == newOwner) {
+				continue
+			}
+			var sub t.Subscription
+			filter := b.M{"_id": topic + ":" + user.String()}
+			if err := a.db.Collection("subscriptions").FindOne(sc, filter).Decode(&sub); err != nil {
+				if err == mdb.ErrNoDocuments {
+					continue
+				}
+				return err
+			}
+			if user == newOwner {
+				sub.ModeWant |= t.ModeOwner
+				sub.ModeGiven |= t.ModeOwner
+			} else {
+				sub.ModeWant &^= t.ModeOwner
+				sub.ModeGiven &^= t.ModeOwner
+			}
+			if _, err := a.db.Collection("subscriptions").UpdateOne(sc, filter,
+				b.M{"$set": b.M{"modewant": sub.ModeWant, "modegiven": sub.ModeGiven}}); err != nil {
+				return err
+			}
+		}
+
+		return a.maybeCommitTransaction(sc, sess)
+	}); err != nil {
+		return err
+	}
+	return nil
 }
 
 func (a *adapter) topicUpdate(topic string, update map[string]interface{}) error {
@@ -1582,6 +2355,9 @@ func (a *adapter) SubscriptionGet(topic string, user t.Uid) (*t.Subscription, er
 		}
 		return nil, err
 	}
+	if sub.Draft != nil {
+		sub.Draft.Content = unmarshalBsonD(sub.Draft.Content)
+	}
 
 	return sub, nil
 }
@@ -1666,6 +2442,13 @@ func (a *adapter) SubsForTopic(topic string, keepDeleted bool, opts *t.QueryOpt)
 	return subs, cur.Err()
 }
 
+// SubsCountForTopic returns the number of subscriptions to the given topic which are not deleted.
+func (a *adapter) SubsCountForTopic(topic string) (int, error) {
+	count, err := a.db.Collection("subscriptions").CountDocuments(a.ctx,
+		b.M{"topic": topic, "deletedat": b.M{"$exists": false}})
+	return int(count), err
+}
+
 // SubsUpdate updates pasrt of a subscription object. Pass nil for fields which don't need to be updated
 func (a *adapter) SubsUpdate(topic string, user t.Uid, update map[string]interface{}) error {
 	// to get round the hardcoded pass of "Private" key
@@ -1717,7 +2500,7 @@ func (a *adapter) SubsDelForUser(user t.Uid, hard bool) error {
 }
 
 // Search
-func (a *adapter) getFindPipeline(req [][]string, opt []string) (map[string]struct{}, b.A) {
+func (a *adapter) getFindPipeline(req [][]string, opt []string, excl []string) (map[string]struct{}, b.A) {
 	allReq := t.FlattenDoubleSlice(req)
 	index := make(map[string]struct{})
 	var allTags []interface{}
@@ -1726,13 +2509,17 @@ func (a *adapter) getFindPipeline(req [][]string, opt []string) (map[string]stru
 		index[tag] = struct{}{}
 	}
 
+	tags := b.M{"$in": allTags}
+	if len(excl) > 0 {
+		tags["$nin"] = excl
+	}
 	pipeline := b.A{
 		b.M{"$match": b.M{
-			"tags":  b.M{"$in": allTags},
+			"tags":  tags,
 			"state": b.M{"$ne": t.StateDeleted},
 		}},
 
-		b.M{"$project": b.M{"_id": 1, "access": 1, "createdat": 1, "updatedat": 1, "public": 1, "tags": 1}},
+		b.M{"$project": b.M{"_id": 1, "access": 1, "createdat": 1, "updatedat": 1, "public": 1, "trusted": 1, "tags": 1}},
 
 		b.M{"$unwind": "$tags"},
 
@@ -1744,6 +2531,7 @@ func (a *adapter) getFindPipeline(req [][]string, opt []string) (map[string]stru
 			"createdat":        b.M{"$first": "$createdat"},
 			"updatedat":        b.M{"$first": "$updatedat"},
 			"public":           b.M{"$first": "$public"},
+			"trusted":          b.M{"$first": "$trusted"},
 			"tags":             b.M{"$addToSet": "$tags"},
 			"matchedTagsCount": b.M{"$sum": 1},
 		}},
@@ -1767,7 +2555,7 @@ func (a *adapter) getFindPipeline(req [][]string, opt []string) (map[string]stru
 
 // FindUsers searches for new contacts given a list of tags
 func (a *adapter) FindUsers(uid t.Uid, req [][]string, opt []string) ([]t.Subscription, error) {
-	index, pipeline := a.getFindPipeline(req, opt)
+	index, pipeline := a.getFindPipeline(req, opt, nil)
 	cur, err := a.db.Collection("users").Aggregate(a.ctx, pipeline)
 	if err != nil {
 		return nil, err
@@ -1789,6 +2577,7 @@ func (a *adapter) FindUsers(uid t.Uid, req [][]string, opt []string) ([]t.Subscr
 		sub.UpdatedAt = user.UpdatedAt
 		sub.User = user.Id
 		sub.SetPublic(unmarshalBsonD(user.Public))
+		sub.SetTrusted(unmarshalBsonD(user.Trusted))
 		sub.SetDefaultAccess(user.Access.Auth, user.Access.Anon)
 		tags := make([]string, 0, 1)
 		for _, tag := range user.Tags {
@@ -1804,8 +2593,8 @@ func (a *adapter) FindUsers(uid t.Uid, req [][]string, opt []string) ([]t.Subscr
 }
 
 // FindTopics searches for group topics given a list of tags
-func (a *adapter) FindTopics(req [][]string, opt []string) ([]t.Subscription, error) {
-	index, pipeline := a.getFindPipeline(req, opt)
+func (a *adapter) FindTopics(req [][]string, opt []string, excl []string) ([]t.Subscription, error) {
+	index, pipeline := a.getFindPipeline(req, opt, excl)
 	cur, err := a.db.Collection("topics").Aggregate(a.ctx, pipeline)
 	if err != nil {
 		return nil, err
@@ -1844,6 +2633,13 @@ func (a *adapter) FindTopics(req [][]string, opt []string) ([]t.Subscription, er
 
 // Messages
 
+// Full-text index of message content: plain text messages and the text of Drafty. Prefixed with the topic,
+// so the search is always limited to one topic.
+var messagesTextIndex = mdb.IndexModel{Keys: b.D{
+	{Key: "topic", Value: 1},
+	{Key: "content", Value: "text"},
+	{Key: "content.txt", Value: "text"}}}
+
 // MessageSave saves message to database
 func (a *adapter) MessageSave(msg *t.Message) error {
 	_, err := a.db.Collection("messages").InsertOne(a.ctx, msg)
@@ -1877,6 +2673,24 @@ func (a *adapter) MessageGetAll(topic string, forUser t.Uid, opts *t.QueryOpt) (
 	} else {
 		filter["seqid"] = b.M{"$gte": lower, "$lt": upper}
 	}
+	if opts != nil && opts.Thread > 0 {
+		filter["thread"] = opts.Thread
+	}
+	if opts != nil && opts.MediaType != "" {
+		filter["mediatype"] = opts.MediaType
+	}
+	if opts != nil && len(opts.Mime) > 0 {
+		// Patterns like "image/*" are matched by prefix. The type consists of letters only.
+		mimes := make([]interface{}, 0, len(opts.Mime))
+		for _, mime := range opts.Mime {
+			if strings.HasSuffix(mime, "/*") {
+				mimes = append(mimes, primitive.Regex{Pattern: "^" + strings.TrimSuffix(mime, "*")})
+			} else {
+				mimes = append(mimes, mime)
+			}
+		}
+		filter["mime"] = b.M{"$in": mimes}
+	}
 	findOpts := mdbopts.Find().SetSort(b.M{"topic": -1, "seqid": -1})
 	findOpts.SetLimit(int64(limit))
 
@@ -1899,6 +2713,49 @@ func (a *adapter) MessageGetAll(topic string, forUser t.Uid, opts *t.QueryOpt) (
 	return msgs, nil
 }
 
+// MessageSearch returns messages of the topic matching the full-text query, skipping deleted ones.
+func (a *adapter) MessageSearch(topic string, forUser t.Uid, query string, opts *t.QueryOpt) ([]t.Message, error) {
+	var limit = a.maxMessageResults
+	var lower, upper int
+	if opts != nil {
+		lower = opts.Since
+		upper = opts.Before
+		if opts.Limit > 0 && opts.Limit < limit {
+			limit = opts.Limit
+		}
+	}
+	filter := b.M{
+		"topic":           topic,
+		"$text":           b.M{"$search": query},
+		"delid":           b.M{"$exists": false},
+		"deletedfor.user": b.M{"$ne": forUser.String()},
+	}
+	if upper == 0 {
+		filter["seqid"] = b.M{"$gte": lower}
+	} else {
+		filter["seqid"] = b.M{"$gte": lower, "$lt": upper}
+	}
+	findOpts := mdbopts.Find().SetSort(b.M{"seqid": -1}).SetLimit(int64(limit))
+
+	cur, err := a.db.Collection("messages").Find(a.ctx, filter, findOpts)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(a.ctx)
+
+	var msgs []t.Message
+	for cur.Next(a.ctx) {
+		var msg t.Message
+		if err = cur.Decode(&msg); err != nil {
+			return nil, err
+		}
+		msg.Content = unmarshalBsonD(msg.Content)
+		msgs = append(msgs, msg)
+	}
+
+	return msgs, nil
+}
+
 func (a *adapter) messagesHardDelete(topic string) error {
 	var err error
 
@@ -2033,6 +2890,22 @@ func (a *adapter) MessageGetDeleted(topic string, forUser t.Uid, opts *t.QueryOp
 	return dmsgs, nil
 }
 
+// MessageThreadReply increments the count of replies of the first message of a thread.
+func (a *adapter) MessageThreadReply(topic string, root int, at time.Time) error {
+	_, err := a.db.Collection("messages").UpdateOne(a.ctx,
+		b.M{"topic": topic, "seqid": root},
+		b.M{"$inc": b.M{"replies": 1}, "$set": b.M{"lastreplyat": at}})
+	return err
+}
+
+// MessageUpdate replaces headers and content of a message.
+func (a *adapter) MessageUpdate(topic string, seqId int, head t.MessageHeaders, content interface{}) error {
+	_, err := a.db.Collection("messages").UpdateOne(a.ctx,
+		b.M{"topic": topic, "seqid": seqId},
+		b.M{"$set": b.M{"updatedat": t.TimeNow(), "head": head, "content": content}})
+	return err
+}
+
 // MessageAttachments connects given message to a list of file record IDs.
 func (a *adapter) MessageAttachments(msgId t.Uid, fids []string) error {
 	now := t.TimeNow()
@@ -2056,6 +2929,31 @@ func (a *adapter) MessageAttachments(msgId t.Uid, fids []string) error {
 	return err
 }
 
+// MessageAttachmentsUpdate connects the message to the added file record IDs and disconnects it from
+// the removed ones.
+func (a *adapter) MessageAttachmentsUpdate(topic string, seqId int, added, removed []string) error {
+	filter := b.M{"topic": topic, "seqid": seqId}
+	if len(removed) > 0 {
+		if _, err := a.db.Collection("messages").UpdateOne(a.ctx, filter,
+			b.M{"$set": b.M{"updatedat": t.TimeNow()}, "$pullAll": b.M{"attachments": removed}}); err != nil {
+			return err
+		}
+		if err := a.fileChangeUseCounter(removed, -1); err != nil {
+			return err
+		}
+	}
+	if len(added) > 0 {
+		if _, err := a.db.Collection("messages").UpdateOne(a.ctx, filter,
+			b.M{"$set": b.M{"updatedat": t.TimeNow()}, "$addToSet": b.M{"attachments": b.M{"$each": added}}}); err != nil {
+			return err
+		}
+		if err := a.fileChangeUseCounter(added, 1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // Devices (for push notifications)
 
 // DeviceUpsert creates or updates a device record
@@ -2168,6 +3066,47 @@ func (a *adapter) DeviceDelete(uid t.Uid, deviceID string) error {
 	return err
 }
 
+// DevicePushResults records results of push notifications.
+func (a *adapter) DevicePushResults(delivered, failed []string, at time.Time) error {
+	if len(delivered) > 0 {
+		updOpts := mdbopts.Update().SetArrayFilters(mdbopts.ArrayFilters{
+			Filters: []interface{}{b.M{"dev.deviceid": b.M{"$in": delivered}}}})
+		if _, err := a.db.Collection("users").UpdateMany(a.ctx,
+			b.M{"devices.deviceid": b.M{"$in": delivered}},
+			b.M{"$set": b.M{
+				"devices.$[dev].lastpushat":   at,
+				"devices.$[dev].pushfailures": 0}},
+			updOpts); err != nil {
+			return err
+		}
+	}
+	if len(failed) > 0 {
+		updOpts := mdbopts.Update().SetArrayFilters(mdbopts.ArrayFilters{
+			Filters: []interface{}{b.M{"dev.deviceid": b.M{"$in": failed}}}})
+		if _, err := a.db.Collection("users").UpdateMany(a.ctx,
+			b.M{"devices.deviceid": b.M{"$in": failed}},
+			b.M{"$inc": b.M{"devices.$[dev].pushfailures": 1}},
+			updOpts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeviceDeleteStale deletes devices which repeatedly failed to receive push notifications or have been idle for too long.
+func (a *adapter) DeviceDeleteStale(maxFailures int, idleBefore time.Time) (int, error) {
+	stale := b.M{"$or": b.A{
+		b.M{"pushfailures": b.M{"$gte": maxFailures}},
+		b.M{"lastseen": b.M{"$lt": idleBefore}}}}
+	res, err := a.db.Collection("users").UpdateMany(a.ctx,
+		b.M{"devices": b.M{"$elemMatch": stale}},
+		b.M{"$pull": b.M{"devices": stale}})
+	if err != nil {
+		return 0, err
+	}
+	return int(res.ModifiedCount), nil
+}
+
 // File upload records. The files are stored outside of the database.
 
 // FileStartUpload initializes a file upload
@@ -2240,6 +3179,429 @@ func (a *adapter) FileDeleteUnused(olderThan time.Time, limit int) ([]string, er
 	return locations, err
 }
 
+// PackUpsert creates or replaces an emoji pack and updates use counters of the pack's files.
+func (a *adapter) PackUpsert(pack *t.EmojiPack) error {
+	var old t.EmojiPack
+	err := a.db.Collection("emojipacks").FindOne(a.ctx, b.M{"_id": pack.Id}).Decode(&old)
+	if err != nil && err != mdb.ErrNoDocuments {
+		return err
+	}
+
+	if _, err = a.db.Collection("emojipacks").ReplaceOne(a.ctx, b.M{"_id": pack.Id}, pack,
+		mdbopts.Replace().SetUpsert(true)); err != nil {
+		return err
+	}
+
+	if err = a.fileChangeUseCounter(old.Items.FileIds(), -1); err != nil {
+		return err
+	}
+	return a.fileChangeUseCounter(pack.Items.FileIds(), 1)
+}
+
+// PackGet returns packs with the given IDs.
+func (a *adapter) PackGet(ids ...string) ([]t.EmojiPack, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	return a.packsFind(b.M{"_id": b.M{"$in": ids}})
+}
+
+// PackGetForOrg returns packs which belong to any of the given organizations.
+func (a *adapter) PackGetForOrg(orgs ...string) ([]t.EmojiPack, error) {
+	if len(orgs) == 0 {
+		return nil, nil
+	}
+	return a.packsFind(b.M{"org": b.M{"$in": orgs}})
+}
+
+func (a *adapter) packsFind(filter b.M) ([]t.EmojiPack, error) {
+	cur, err := a.db.Collection("emojipacks").Find(a.ctx, filter, mdbopts.Find().SetSort(b.M{"createdat": 1}))
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(a.ctx)
+
+	var packs []t.EmojiPack
+	for cur.Next(a.ctx) {
+		// Decode does not reset fields missing from the document, use a fresh struct.
+		var pack t.EmojiPack
+		if err = cur.Decode(&pack); err != nil {
+			return nil, err
+		}
+		packs = append(packs, pack)
+	}
+
+	return packs, cur.Err()
+}
+
+// PackDelete deletes the pack and decrements use counters of the pack's files.
+func (a *adapter) PackDelete(id string) error {
+	var pack t.EmojiPack
+	err := a.db.Collection("emojipacks").FindOneAndDelete(a.ctx, b.M{"_id": id}).Decode(&pack)
+	if err != nil {
+		if err == mdb.ErrNoDocuments {
+			return t.ErrNotFound
+		}
+		return err
+	}
+
+	return a.fileChangeUseCounter(pack.Items.FileIds(), -1)
+}
+
+// DigestUpsert creates or replaces the digest of a channel reader.
+func (a *adapter) DigestUpsert(dg *t.Digest) error {
+	_, err := a.db.Collection("digests").ReplaceOne(a.ctx, b.M{"_id": dg.Id}, dg, mdbopts.Replace().SetUpsert(true))
+	return err
+}
+
+// DigestGet returns the digest of the channel reader or nil if there is none.
+func (a *adapter) DigestGet(topic string, user t.Uid) (*t.Digest, error) {
+	var dg t.Digest
+	if err := a.db.Collection("digests").FindOne(a.ctx, b.M{"_id": topic + ":" + user.String()}).Decode(&dg); err != nil {
+		if err == mdb.ErrNoDocuments {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &dg, nil
+}
+
+// DigestGetDue returns digests with NextAt before the given time, earliest first.
+func (a *adapter) DigestGetDue(before time.Time, limit int) ([]t.Digest, error) {
+	cur, err := a.db.Collection("digests").Find(a.ctx, b.M{"nextat": b.M{"$lt": before}},
+		mdbopts.Find().SetSort(b.M{"nextat": 1}).SetLimit(int64(limit)))
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(a.ctx)
+
+	var digests []t.Digest
+	for cur.Next(a.ctx) {
+		var dg t.Digest
+		if err = cur.Decode(&dg); err != nil {
+			return nil, err
+		}
+		digests = append(digests, dg)
+	}
+
+	return digests, cur.Err()
+}
+
+// DigestDelete deletes the digest of the channel reader.
+func (a *adapter) DigestDelete(topic string, user t.Uid) error {
+	_, err := a.db.Collection("digests").DeleteOne(a.ctx, b.M{"_id": topic + ":" + user.String()})
+	return err
+}
+
+// CalEventUpsert creates or replaces the event.
+func (a *adapter) CalEventUpsert(ev *t.CalEvent) error {
+	_, err := a.db.Collection("calevents").ReplaceOne(a.ctx, b.M{"_id": ev.Id}, ev, mdbopts.Replace().SetUpsert(true))
+	return err
+}
+
+// CalEventGet returns the event announced by the message or nil if there is none.
+func (a *adapter) CalEventGet(topic string, seqId int) (*t.CalEvent, error) {
+	var ev t.CalEvent
+	if err := a.db.Collection("calevents").FindOne(a.ctx,
+		b.M{"_id": topic + ":" + strconv.Itoa(seqId)}).Decode(&ev); err != nil {
+		if err == mdb.ErrNoDocuments {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &ev, nil
+}
+
+// CalEventGetAll returns events of the topic starting at or after the given time, earliest first.
+func (a *adapter) CalEventGetAll(topic string, since time.Time, limit int) ([]t.CalEvent, error) {
+	return a.calEventsFind(b.M{"topic": topic, "startat": b.M{"$gte": since}},
+		mdbopts.Find().SetSort(b.M{"startat": 1}).SetLimit(int64(limit)))
+}
+
+// CalEventGetDue returns events with RemindAt before the given time, earliest first.
+func (a *adapter) CalEventGetDue(before time.Time, limit int) ([]t.CalEvent, error) {
+	return a.calEventsFind(b.M{"remindat": b.M{"$lt": before}},
+		mdbopts.Find().SetSort(b.M{"remindat": 1}).SetLimit(int64(limit)))
+}
+
+func (a *adapter) calEventsFind(filter b.M, opts *mdbopts.FindOptions) ([]t.CalEvent, error) {
+	cur, err := a.db.Collection("calevents").Find(a.ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(a.ctx)
+
+	var events []t.CalEvent
+	for cur.Next(a.ctx) {
+		var ev t.CalEvent
+		if err = cur.Decode(&ev); err != nil {
+			return nil, err
+		}
+		events = append(events, ev)
+	}
+
+	return events, cur.Err()
+}
+
+// CalEventRsvp records the response of the user to the event, an empty response removes it.
+func (a *adapter) CalEventRsvp(topic string, seqId int, user t.Uid, resp string) error {
+	field := "rsvp." + user.String()
+	update := b.M{"$set": b.M{"updatedat": t.TimeNow(), field: resp}}
+	if resp == "" {
+		update = b.M{"$set": b.M{"updatedat": t.TimeNow()}, "$unset": b.M{field: ""}}
+	}
+	_, err := a.db.Collection("calevents").UpdateOne(a.ctx, b.M{"_id": topic + ":" + strconv.Itoa(seqId)}, update)
+	return err
+}
+
+// CalEventReminded marks the reminder of the event as sent.
+func (a *adapter) CalEventReminded(topic string, seqId int) error {
+	_, err := a.db.Collection("calevents").UpdateOne(a.ctx, b.M{"_id": topic + ":" + strconv.Itoa(seqId)},
+		b.M{"$set": b.M{"updatedat": t.TimeNow()}, "$unset": b.M{"remindat": ""}})
+	return err
+}
+
+// PollCreate saves a new poll.
+func (a *adapter) PollCreate(poll *t.Poll) error {
+	_, err := a.db.Collection("polls").InsertOne(a.ctx, poll)
+	return err
+}
+
+// PollGet returns the poll created by the message or nil if there is none.
+func (a *adapter) PollGet(topic string, seqId int) (*t.Poll, error) {
+	var poll t.Poll
+	if err := a.db.Collection("polls").FindOne(a.ctx,
+		b.M{"_id": topic + ":" + strconv.Itoa(seqId)}).Decode(&poll); err != nil {
+		if err == mdb.ErrNoDocuments {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &poll, nil
+}
+
+// PollVote records the vote of the user replacing the previous one, an empty vote removes it.
+func (a *adapter) PollVote(topic string, seqId int, user t.Uid, options []int) error {
+	field := "votes." + user.String()
+	update := b.M{"$set": b.M{"updatedat": t.TimeNow(), field: options}}
+	if len(options) == 0 {
+		update = b.M{"$set": b.M{"updatedat": t.TimeNow()}, "$unset": b.M{field: ""}}
+	}
+	_, err := a.db.Collection("polls").UpdateOne(a.ctx, b.M{"_id": topic + ":" + strconv.Itoa(seqId)}, update)
+	return err
+}
+
+// ReceiptCreate records that the user has read a range of messages.
+func (a *adapter) ReceiptCreate(rcpt *t.Receipt) error {
+	_, err := a.db.Collection("receipts").InsertOne(a.ctx, rcpt)
+	return err
+}
+
+// ReceiptsForMessage returns receipts of all users who have read the message, earliest first.
+func (a *adapter) ReceiptsForMessage(topic string, seqId int) ([]t.Receipt, error) {
+	filter := b.M{"topic": topic, "seqto": b.M{"$gte": seqId}, "seqfrom": b.M{"$lte": seqId}}
+	cur, err := a.db.Collection("receipts").Find(a.ctx, filter, mdbopts.Find().SetSort(b.M{"readat": 1}))
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(a.ctx)
+
+	var receipts []t.Receipt
+	for cur.Next(a.ctx) {
+		var rcpt t.Receipt
+		if err = cur.Decode(&rcpt); err != nil {
+			return nil, err
+		}
+		receipts = append(receipts, rcpt)
+	}
+	return receipts, cur.Err()
+}
+
+// MentionsCreate records mentions of users and replies in threads started by users.
+func (a *adapter) MentionsCreate(mentions []t.Mention) error {
+	if len(mentions) == 0 {
+		return nil
+	}
+	docs := make([]interface{}, 0, len(mentions))
+	for i := range mentions {
+		docs = append(docs, &mentions[i])
+	}
+	_, err := a.db.Collection("mentions").InsertMany(a.ctx, docs)
+	return err
+}
+
+// MentionsDelete removes mentions and thread replies of the user in the topic up to and including
+// seqId, all of them if seqId is 0. Returns the number of removed mentions, thread replies are not counted.
+func (a *adapter) MentionsDelete(topic string, user t.Uid, seqId int) (int, error) {
+	filter := b.M{"user": user.String(), "topic": topic}
+	if seqId > 0 {
+		filter["seqid"] = b.M{"$lte": seqId}
+	}
+	// Mentions are deleted first to count them. Mentions saved before thread replies were added have no 'thread'.
+	mentionsFilter := b.M{"thread": b.M{"$not": b.M{"$gt": 0}}}
+	for k, v := range filter {
+		mentionsFilter[k] = v
+	}
+	res, err := a.db.Collection("mentions").DeleteMany(a.ctx, mentionsFilter)
+	if err != nil {
+		return 0, err
+	}
+	if _, err = a.db.Collection("mentions").DeleteMany(a.ctx, filter); err != nil {
+		return 0, err
+	}
+	return int(res.DeletedCount), nil
+}
+
+// MentionsCount returns the number of unread mentions of the user across all topics.
+func (a *adapter) MentionsCount(user t.Uid) (int, error) {
+	count, err := a.db.Collection("mentions").CountDocuments(a.ctx,
+		b.M{"user": user.String(), "thread": b.M{"$not": b.M{"$gt": 0}}})
+	return int(count), err
+}
+
+// MentionsGetAll returns unread mentions and thread replies of the user across all topics, newest first.
+func (a *adapter) MentionsGetAll(user t.Uid, limit int) ([]t.Mention, error) {
+	cur, err := a.db.Collection("mentions").Find(a.ctx, b.M{"user": user.String()},
+		mdbopts.Find().SetSort(b.M{"createdat": -1}).SetLimit(int64(limit)))
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(a.ctx)
+
+	var mentions []t.Mention
+	for cur.Next(a.ctx) {
+		var m t.Mention
+		if err = cur.Decode(&m); err != nil {
+			return nil, err
+		}
+		mentions = append(mentions, m)
+	}
+	return mentions, cur.Err()
+}
+
+// BookmarkCreate saves the bookmark, does nothing if the message is already starred by the user.
+func (a *adapter) BookmarkCreate(bm *t.Bookmark) error {
+	_, err := a.db.Collection("bookmarks").InsertOne(a.ctx, bm)
+	if isDuplicateErr(err) {
+		return nil
+	}
+	return err
+}
+
+// BookmarkDelete removes the bookmark of the message.
+func (a *adapter) BookmarkDelete(user t.Uid, topic string, seqId int) error {
+	_, err := a.db.Collection("bookmarks").DeleteOne(a.ctx,
+		b.M{"_id": user.String() + ":" + topic + ":" + strconv.Itoa(seqId)})
+	return err
+}
+
+// BookmarkGetAll returns bookmarks of the user, newest first.
+func (a *adapter) BookmarkGetAll(user t.Uid, limit int) ([]t.Bookmark, error) {
+	cur, err := a.db.Collection("bookmarks").Find(a.ctx, b.M{"user": user.String()},
+		mdbopts.Find().SetSort(b.M{"createdat": -1}).SetLimit(int64(limit)))
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(a.ctx)
+
+	var bookmarks []t.Bookmark
+	for cur.Next(a.ctx) {
+		var bm t.Bookmark
+		if err = cur.Decode(&bm); err != nil {
+			return nil, err
+		}
+		bookmarks = append(bookmarks, bm)
+	}
+	return bookmarks, cur.Err()
+}
+
+// ViewOnceCreate marks files attached to a message as view-once.
+func (a *adapter) ViewOnceCreate(vos []t.ViewOnce) error {
+	if len(vos) == 0 {
+		return nil
+	}
+	docs := make([]interface{}, 0, len(vos))
+	for i := range vos {
+		docs = append(docs, &vos[i])
+	}
+	_, err := a.db.Collection("viewonce").InsertMany(a.ctx, docs, mdbopts.InsertMany().SetOrdered(false))
+	if isDuplicateErr(err) {
+		return nil
+	}
+	return err
+}
+
+// ViewOnceGet returns the view-once mark of the file, nil if the file is not view-once.
+func (a *adapter) ViewOnceGet(fid string) (*t.ViewOnce, error) {
+	var vo t.ViewOnce
+	if err := a.db.Collection("viewonce").FindOne(a.ctx, b.M{"_id": fid}).Decode(&vo); err != nil {
+		if err == mdb.ErrNoDocuments {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &vo, nil
+}
+
+// ViewOnceView records that the user has retrieved the file. Returns false if the user
+// has retrieved it before.
+func (a *adapter) ViewOnceView(view *t.ViewOnceView) (bool, error) {
+	_, err := a.db.Collection("viewoncelog").InsertOne(a.ctx, view)
+	if isDuplicateErr(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// AccountEventCreate saves a security-related event of the user's account.
+func (a *adapter) AccountEventCreate(ev *t.AccountEvent) error {
+	_, err := a.db.Collection("accountevents").InsertOne(a.ctx, ev)
+	return err
+}
+
+// AccountEventGetAll returns events of the user, newest first.
+func (a *adapter) AccountEventGetAll(user t.Uid, limit int) ([]t.AccountEvent, error) {
+	cur, err := a.db.Collection("accountevents").Find(a.ctx, b.M{"user": user.String()},
+		mdbopts.Find().SetSort(b.M{"createdat": -1}).SetLimit(int64(limit)))
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(a.ctx)
+
+	var events []t.AccountEvent
+	for cur.Next(a.ctx) {
+		var ev t.AccountEvent
+		if err = cur.Decode(&ev); err != nil {
+			return nil, err
+		}
+		events = append(events, ev)
+	}
+	return events, cur.Err()
+}
+
+// AccountEventDeleteOlder deletes events of all users created before the given time.
+func (a *adapter) AccountEventDeleteOlder(before time.Time) (int, error) {
+	res, err := a.db.Collection("accountevents").DeleteMany(a.ctx, b.M{"createdat": b.M{"$lt": before}})
+	if err != nil {
+		return 0, err
+	}
+	return int(res.DeletedCount), nil
+}
+
+// fileChangeUseCounter adds delta to use counters of the given files.
+func (a *adapter) fileChangeUseCounter(fids []string, delta int) error {
+	if len(fids) == 0 {
+		return nil
+	}
+
+	_, err := a.db.Collection("fileuploads").UpdateMany(a.ctx,
+		b.M{"_id": b.M{"$in": fids}},
+		b.M{
+			"$set": b.M{"updatedat": t.TimeNow()},
+			"$inc": b.M{"usecount": delta}})
+	return err
+}
+
 // Given a filter query against 'messages' collection, decrement corresponding use counter in 'fileuploads' table.
 func (a *adapter) fileDecrementUseCounter(ctx context.Context, msgFilter b.M) error {
 	// Copy msgFilter
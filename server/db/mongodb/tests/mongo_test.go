@@ -531,7 +531,7 @@ func TestFindUsers(t *testing.T) {
 
 func TestFindTopics(t *testing.T) {
 	reqTags := []string{"travel", "qwer", "asdf", "zxcv"}
-	gotSubs, err := adp.FindTopics(reqTags, nil)
+	gotSubs, err := adp.FindTopics(reqTags, nil, nil)
 	if err != nil {
 		t.Error(err)
 	}
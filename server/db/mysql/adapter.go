@@ -35,7 +35,7 @@ const (
 	defaultDSN      = "root:@tcp(localhost:3306)/tinode?parseTime=true"
 	defaultDatabase = "tinode"
 
-	adpVersion = 111
+	adpVersion = 155
 
 	adapterName = "mysql"
 
@@ -234,7 +234,15 @@ func (a *adapter) CreateDb(reset bool) error {
 			lastseen  DATETIME,
 			useragent VARCHAR(255) DEFAULT '',
 			public    JSON,
+			trusted   JSON,
 			tags      JSON,
+			blocked   JSON,
+			aliases   JSON,
+			autoreply JSON,
+			autotranslate VARCHAR(16) NOT NULL DEFAULT '',
+			chatlist JSON,
+			consent JSON,
+			birthdate VARCHAR(10) NOT NULL DEFAULT '',
 			PRIMARY KEY(id),
 			INDEX users_state_stateat(state, stateat)
 		)`); err != nil {
@@ -265,6 +273,8 @@ func (a *adapter) CreateDb(reset bool) error {
 			platform VARCHAR(32),
 			lastseen DATETIME NOT NULL,
 			lang     VARCHAR(8),
+			lastpushat   DATETIME,
+			pushfailures INT NOT NULL DEFAULT 0,
 			PRIMARY KEY(id),
 			FOREIGN KEY(userid) REFERENCES users(id),
 			UNIQUE INDEX devices_hash (hash)
@@ -307,10 +317,24 @@ func (a *adapter) CreateDb(reset bool) error {
 			delid     INT DEFAULT 0,
 			public    JSON,
 			tags      JSON,
+			packs     JSON,
+			webhook   JSON,
+			stats     JSON,
+			guests    JSON,
+			owners    JSON,
+			receipts  TINYINT DEFAULT 0,
+			limits    JSON,
+			announce  TINYINT DEFAULT 0,
+			capacity  JSON,
+			parent    CHAR(25) NOT NULL DEFAULT '',
+			maxsubs   INT NOT NULL DEFAULT 0,
+			freeze    JSON,
+			expiry    JSON,
 			PRIMARY KEY(id),
 			UNIQUE INDEX topics_name(name),
 			INDEX topics_owner(owner),
-			INDEX topics_state_stateat(state, stateat)
+			INDEX topics_state_stateat(state, stateat),
+			INDEX topics_parent(parent)
 		)`); err != nil {
 		return err
 	}
@@ -346,6 +370,16 @@ func (a *adapter) CreateDb(reset bool) error {
 			delid     INT DEFAULT 0,
 			recvseqid INT DEFAULT 0,
 			readseqid INT DEFAULT 0,
+			dlvseqid  INT DEFAULT 0,
+			cursors   JSON,
+			draft     JSON,
+			muteuntil DATETIME(3),
+			quiet     JSON,
+			notify    VARCHAR(16) NOT NULL DEFAULT '',
+			anchorseq INT DEFAULT 0,
+			role      VARCHAR(16) NOT NULL DEFAULT '',
+			request   JSON,
+			ban       JSON,
 			modewant  CHAR(8),
 			modegiven CHAR(8),
 			private   JSON,
@@ -371,9 +405,19 @@ func (a *adapter) CreateDb(reset bool) error {
 			"`from`   BIGINT NOT NULL," +
 			`head     JSON,
 			content   JSON,
+			plaintext TEXT GENERATED ALWAYS AS (IF(JSON_TYPE(content)='STRING',content->>'$',content->>'$.txt')) STORED,
+			thread    INT NOT NULL DEFAULT 0,
+			replies   INT NOT NULL DEFAULT 0,
+			lastreplyat DATETIME(3),
+			mediatype VARCHAR(16) NOT NULL DEFAULT '',
+			mime      VARCHAR(255) NOT NULL DEFAULT '',
 			PRIMARY KEY(id),
 			FOREIGN KEY(topic) REFERENCES topics(name),
-			UNIQUE INDEX messages_topic_seqid(topic, seqid)
+			UNIQUE INDEX messages_topic_seqid(topic, seqid),
+			INDEX messages_topic_thread_seqid(topic, thread, seqid),
+			INDEX messages_topic_mediatype_seqid(topic, mediatype, seqid),
+			INDEX messages_topic_mime_seqid(topic, mime, seqid),
+			FULLTEXT INDEX messages_plaintext(plaintext)
 		);`); err != nil {
 		return err
 	}
@@ -448,6 +492,51 @@ func (a *adapter) CreateDb(reset bool) error {
 		return err
 	}
 
+	// Custom emoji packs and links to their files.
+	if err = createEmojiTables(tx); err != nil {
+		return err
+	}
+
+	// Periodic digests of channels.
+	if err = createDigestTable(tx); err != nil {
+		return err
+	}
+
+	// Events announced in topics.
+	if err = createCalEventTable(tx); err != nil {
+		return err
+	}
+
+	// Per-message read receipts.
+	if err = createReceiptTable(tx); err != nil {
+		return err
+	}
+
+	// Unread mentions.
+	if err = createMentionTable(tx); err != nil {
+		return err
+	}
+
+	// Polls.
+	if err = createPollTable(tx); err != nil {
+		return err
+	}
+
+	// Starred messages.
+	if err = createBookmarkTable(tx); err != nil {
+		return err
+	}
+
+	// View-once attachments.
+	if err = createViewOnceTables(tx); err != nil {
+		return err
+	}
+
+	// Account activity timeline.
+	if err = createAccountEventTable(tx); err != nil {
+		return err
+	}
+
 	if _, err = tx.Exec(
 		`CREATE TABLE kvmeta(` +
 			"`key`   CHAR(32)," +
@@ -593,504 +682,1220 @@ func (a *adapter) UpgradeDb() error {
 		}
 	}
 
-	if a.version != adpVersion {
-		return errors.New("Failed to perform database upgrade to version " + strconv.Itoa(adpVersion) +
-			". DB is still at " + strconv.Itoa(a.version))
-	}
-	return nil
-}
-
-func createSystemTopic(tx *sql.Tx) error {
-	now := t.TimeNow()
-	sql := `INSERT INTO topics(createdat,updatedat,state,touchedat,name,access,public)
-				VALUES(?,?,?,?,'sys','{"Auth": "N","Anon": "N"}','{"fn": "System"}')`
-	_, err := tx.Exec(sql, now, now, t.StateOK, now)
-	return err
-}
-
-func addTags(tx *sqlx.Tx, table, keyName string, keyVal interface{}, tags []string, ignoreDups bool) error {
+	if a.version == 111 {
+		// Perform database upgrade from version 111 to version 112.
+		if _, err := a.db.Exec("ALTER TABLE users ADD blocked JSON AFTER tags"); err != nil {
+			return err
+		}
 
-	if len(tags) == 0 {
-		return nil
+		if err := bumpVersion(a, 112); err != nil {
+			return err
+		}
 	}
 
-	var insert *sql.Stmt
-	var err error
-	insert, err = tx.Prepare("INSERT INTO " + table + "(" + keyName + ",tag) VALUES(?,?)")
-	if err != nil {
-		return err
+	if a.version == 112 {
+		// Perform database upgrade from version 112 to version 113.
+		if _, err := a.db.Exec("ALTER TABLE users ADD aliases JSON AFTER blocked"); err != nil {
+			return err
+		}
+
+		if err := bumpVersion(a, 113); err != nil {
+			return err
+		}
 	}
 
-	for _, tag := range tags {
-		_, err = insert.Exec(keyVal, tag)
+	if a.version == 113 {
+		// Perform database upgrade from version 113 to version 114.
+		if _, err := a.db.Exec("ALTER TABLE subscriptions ADD cursors JSON AFTER readseqid"); err != nil {
+			return err
+		}
 
-		if err != nil {
-			if isDupe(err) {
-				if ignoreDups {
-					continue
-				}
-				return t.ErrDuplicate
-			}
+		if err := bumpVersion(a, 114); err != nil {
 			return err
 		}
 	}
 
-	return nil
-}
+	if a.version == 114 {
+		// Perform database upgrade from version 114 to version 115.
+		if _, err := a.db.Exec("ALTER TABLE subscriptions ADD draft JSON AFTER cursors"); err != nil {
+			return err
+		}
 
-func removeTags(tx *sqlx.Tx, table, keyName string, keyVal interface{}, tags []string) error {
-	if len(tags) == 0 {
-		return nil
+		if err := bumpVersion(a, 115); err != nil {
+			return err
+		}
 	}
 
-	var args []interface{}
-	for _, tag := range tags {
-		args = append(args, tag)
+	if a.version == 115 {
+		// Perform database upgrade from version 115 to version 116.
+		if _, err := a.db.Exec("ALTER TABLE users ADD trusted JSON AFTER public"); err != nil {
+			return err
+		}
+
+		if err := bumpVersion(a, 116); err != nil {
+			return err
+		}
 	}
 
-	query, args, _ := sqlx.In("DELETE FROM "+table+" WHERE "+keyName+"=? AND tag IN (?)", keyVal, args)
-	query = tx.Rebind(query)
-	_, err := tx.Exec(query, args...)
+	if a.version == 116 {
+		// Perform database upgrade from version 116 to version 117.
+		if _, err := a.db.Exec("ALTER TABLE topics ADD packs JSON AFTER tags"); err != nil {
+			return err
+		}
 
-	return err
-}
+		if err := createEmojiTables(a.db); err != nil {
+			return err
+		}
 
-// UserCreate creates a new user. Returns error and true if error is due to duplicate user name,
-// false for any other error
-func (a *adapter) UserCreate(user *t.User) error {
-	tx, err := a.db.Beginx()
-	if err != nil {
-		return err
+		if err := bumpVersion(a, 117); err != nil {
+			return err
+		}
 	}
 
-	defer func() {
-		if err != nil {
-			tx.Rollback()
+	if a.version == 117 {
+		// Perform database upgrade from version 117 to version 118.
+		if _, err := a.db.Exec("ALTER TABLE subscriptions ADD dlvseqid INT DEFAULT 0 AFTER readseqid"); err != nil {
+			return err
 		}
-	}()
 
-	decoded_uid := store.DecodeUid(user.Uid())
-	if _, err = tx.Exec("INSERT INTO users(id,createdat,updatedat,state,access,public,tags) VALUES(?,?,?,?,?,?,?)",
-		decoded_uid,
-		user.CreatedAt, user.UpdatedAt,
-		user.State, user.Access,
-		toJSON(user.Public), user.Tags); err != nil {
-		return err
+		if err := bumpVersion(a, 118); err != nil {
+			return err
+		}
 	}
 
-	// Save user's tags to a separate table to make user findable.
-	if err = addTags(tx, "usertags", "userid", decoded_uid, user.Tags, false); err != nil {
-		return err
-	}
+	if a.version == 118 {
+		// Perform database upgrade from version 118 to version 119.
+		if _, err := a.db.Exec("ALTER TABLE topics ADD webhook JSON AFTER packs"); err != nil {
+			return err
+		}
 
-	return tx.Commit()
-}
+		if err := bumpVersion(a, 119); err != nil {
+			return err
+		}
+	}
 
-// Add user's authentication record
-func (a *adapter) AuthAddRecord(uid t.Uid, scheme, unique string, authLvl auth.Level,
-	secret []byte, expires time.Time) error {
+	if a.version == 119 {
+		// Perform database upgrade from version 119 to version 120.
+		if _, err := a.db.Exec("ALTER TABLE users ADD autoreply JSON AFTER aliases"); err != nil {
+			return err
+		}
 
-	var exp *time.Time
-	if !expires.IsZero() {
-		exp = &expires
-	}
-	_, err := a.db.Exec("INSERT INTO auth(uname,userid,scheme,authLvl,secret,expires) VALUES(?,?,?,?,?,?)",
-		unique, store.DecodeUid(uid), scheme, authLvl, secret, exp)
-	if err != nil {
-		if isDupe(err) {
-			return t.ErrDuplicate
+		if err := bumpVersion(a, 120); err != nil {
+			return err
 		}
-		return err
 	}
-	return nil
-}
 
-// AuthDelScheme deletes an existing authentication scheme for the user.
-func (a *adapter) AuthDelScheme(user t.Uid, scheme string) error {
-	_, err := a.db.Exec("DELETE FROM auth WHERE userid=? AND scheme=?", store.DecodeUid(user), scheme)
-	return err
-}
+	if a.version == 120 {
+		// Perform database upgrade from version 120 to version 121.
+		if _, err := a.db.Exec("ALTER TABLE topics ADD stats JSON AFTER webhook"); err != nil {
+			return err
+		}
 
-// AuthDelAllRecords deletes all authentication records for the user.
-func (a *adapter) AuthDelAllRecords(user t.Uid) (int, error) {
-	res, err := a.db.Exec("DELETE FROM auth WHERE userid=?", store.DecodeUid(user))
-	if err != nil {
-		return 0, err
+		if err := bumpVersion(a, 121); err != nil {
+			return err
+		}
 	}
-	count, _ := res.RowsAffected()
 
-	return int(count), nil
-}
+	if a.version == 121 {
+		// Perform database upgrade from version 121 to version 122.
+		if _, err := a.db.Exec("ALTER TABLE topics ADD guests JSON AFTER stats"); err != nil {
+			return err
+		}
 
-// Update user's authentication secret
-func (a *adapter) AuthUpdRecord(uid t.Uid, scheme, unique string, authLvl auth.Level,
-	secret []byte, expires time.Time) error {
-	var exp *time.Time
-	if !expires.IsZero() {
-		exp = &expires
+		if err := bumpVersion(a, 122); err != nil {
+			return err
+		}
 	}
 
-	_, err := a.db.Exec("UPDATE auth SET uname=?,authLvl=?,secret=?,expires=? WHERE userid=? AND scheme=?",
-		unique, authLvl, secret, exp, store.DecodeUid(uid), scheme)
-	if isDupe(err) {
-		return t.ErrDuplicate
-	}
+	if a.version == 122 {
+		// Perform database upgrade from version 122 to version 123.
+		if _, err := a.db.Exec("ALTER TABLE topics ADD owners JSON AFTER guests"); err != nil {
+			return err
+		}
 
-	return err
-}
+		if err := bumpVersion(a, 123); err != nil {
+			return err
+		}
+	}
 
-// Retrieve user's authentication record
-func (a *adapter) AuthGetRecord(uid t.Uid, scheme string) (string, auth.Level, []byte, time.Time, error) {
-	var expires time.Time
+	if a.version == 123 {
+		// Perform database upgrade from version 123 to version 124.
+		if _, err := a.db.Exec("ALTER TABLE users ADD autotranslate VARCHAR(16) NOT NULL DEFAULT '' AFTER autoreply"); err != nil {
+			return err
+		}
 
-	var record struct {
-		Uname   string
-		Authlvl auth.Level
-		Secret  []byte
-		Expires *time.Time
+		if err := bumpVersion(a, 124); err != nil {
+			return err
+		}
 	}
 
-	if err := a.db.Get(&record, "SELECT uname,secret,expires,authlvl FROM auth WHERE userid=? AND scheme=?",
-		store.DecodeUid(uid), scheme); err != nil {
-		if err == sql.ErrNoRows {
-			// Nothing found - clear the error
-			err = nil
+	if a.version == 124 {
+		// Perform database upgrade from version 124 to version 125.
+		if err := createDigestTable(a.db); err != nil {
+			return err
 		}
-		return "", 0, nil, expires, err
-	}
 
-	if record.Expires != nil {
-		expires = *record.Expires
+		if err := bumpVersion(a, 125); err != nil {
+			return err
+		}
 	}
 
-	return record.Uname, record.Authlvl, record.Secret, expires, nil
-}
-
-// Retrieve user's authentication record
-func (a *adapter) AuthGetUniqueRecord(unique string) (t.Uid, auth.Level, []byte, time.Time, error) {
-	var expires time.Time
+	if a.version == 125 {
+		// Perform database upgrade from version 125 to version 126.
+		if _, err := a.db.Exec("ALTER TABLE subscriptions ADD muteuntil DATETIME(3) AFTER draft"); err != nil {
+			return err
+		}
 
-	var record struct {
-		Userid  int64
-		Authlvl auth.Level
-		Secret  []byte
-		Expires *time.Time
+		if err := bumpVersion(a, 126); err != nil {
+			return err
+		}
 	}
 
-	if err := a.db.Get(&record, "SELECT userid,secret,expires,authlvl FROM auth WHERE uname=?", unique); err != nil {
-		if err == sql.ErrNoRows {
-			// Nothing found - clear the error
-			err = nil
+	if a.version == 126 {
+		// Perform database upgrade from version 126 to version 127.
+		if _, err := a.db.Exec("ALTER TABLE users ADD chatlist JSON AFTER autotranslate"); err != nil {
+			return err
 		}
-		return t.ZeroUid, 0, nil, expires, err
-	}
 
-	if record.Expires != nil {
-		expires = *record.Expires
+		if err := bumpVersion(a, 127); err != nil {
+			return err
+		}
 	}
 
-	return store.EncodeUid(record.Userid), record.Authlvl, record.Secret, expires, nil
-}
+	if a.version == 127 {
+		// Perform database upgrade from version 127 to version 128.
+		if _, err := a.db.Exec("ALTER TABLE messages ADD thread INT NOT NULL DEFAULT 0 AFTER content," +
+			" ADD replies INT NOT NULL DEFAULT 0 AFTER thread, ADD lastreplyat DATETIME(3) AFTER replies," +
+			" ADD INDEX messages_topic_thread_seqid(topic, thread, seqid)"); err != nil {
+			return err
+		}
 
-// UserGet fetches a single user by user id. If user is not found it returns (nil, nil)
-func (a *adapter) UserGet(uid t.Uid) (*t.User, error) {
-	var user t.User
-	err := a.db.Get(&user, "SELECT * FROM users WHERE id=? AND state!=?", store.DecodeUid(uid), t.StateDeleted)
-	if err == nil {
-		user.SetUid(uid)
-		user.Public = fromJSON(user.Public)
-		return &user, nil
+		if err := bumpVersion(a, 128); err != nil {
+			return err
+		}
 	}
 
-	if err == sql.ErrNoRows {
-		// Clear the error if user does not exist or marked as soft-deleted.
-		return nil, nil
+	if a.version == 128 {
+		// Perform database upgrade from version 128 to version 129.
+		if _, err := a.db.Exec("ALTER TABLE users ADD consent JSON AFTER chatlist"); err != nil {
+			return err
+		}
+
+		if err := bumpVersion(a, 129); err != nil {
+			return err
+		}
 	}
 
-	return nil, err
-}
+	if a.version == 129 {
+		// Perform database upgrade from version 129 to version 130.
+		if _, err := a.db.Exec("ALTER TABLE devices ADD lastpushat DATETIME AFTER lastseen, ADD pushfailures INT NOT NULL DEFAULT 0 AFTER lastpushat"); err != nil {
+			return err
+		}
 
-func (a *adapter) UserGetAll(ids ...t.Uid) ([]t.User, error) {
-	uids := make([]interface{}, len(ids))
-	for i, id := range ids {
-		uids[i] = store.DecodeUid(id)
+		if err := bumpVersion(a, 130); err != nil {
+			return err
+		}
 	}
 
-	users := []t.User{}
-	q, uids, _ := sqlx.In("SELECT * FROM users WHERE id IN (?) AND state!=?", uids, t.StateDeleted)
-	q = a.db.Rebind(q)
-	rows, err := a.db.Queryx(q, uids...)
-	if err != nil {
-		return nil, err
+	if a.version == 130 {
+		// Perform database upgrade from version 130 to version 131.
+		if _, err := a.db.Exec("ALTER TABLE messages ADD plaintext TEXT GENERATED ALWAYS AS (IF(JSON_TYPE(content)='STRING',content->>'$',content->>'$.txt')) STORED AFTER content, ADD FULLTEXT INDEX messages_plaintext(plaintext)"); err != nil {
+			return err
+		}
+
+		if err := bumpVersion(a, 131); err != nil {
+			return err
+		}
 	}
 
-	var user t.User
-	for rows.Next() {
-		if err = rows.StructScan(&user); err != nil {
-			users = nil
-			break
+	if a.version == 131 {
+		// Perform database upgrade from version 131 to version 132.
+		if err := createCalEventTable(a.db); err != nil {
+			return err
 		}
 
-		if user.State == t.StateDeleted {
-			continue
+		if err := bumpVersion(a, 132); err != nil {
+			return err
 		}
+	}
 
-		user.SetUid(encodeUidString(user.Id))
-		user.Public = fromJSON(user.Public)
+	if a.version == 132 {
+		// Perform database upgrade from version 132 to version 133.
+		if _, err := a.db.Exec("ALTER TABLE topics ADD receipts TINYINT DEFAULT 0 AFTER owners"); err != nil {
+			return err
+		}
+		if err := createReceiptTable(a.db); err != nil {
+			return err
+		}
 
-		users = append(users, user)
+		if err := bumpVersion(a, 133); err != nil {
+			return err
+		}
 	}
-	rows.Close()
 
-	return users, err
-}
+	if a.version == 133 {
+		// Perform database upgrade from version 133 to version 134.
+		if err := createMentionTable(a.db); err != nil {
+			return err
+		}
 
-// UserDelete deletes specified user: wipes completely (hard-delete) or marks as deleted.
-// TODO: report when the user is not found.
-func (a *adapter) UserDelete(uid t.Uid, hard bool) error {
-	tx, err := a.db.Beginx()
-	if err != nil {
-		return err
+		if err := bumpVersion(a, 134); err != nil {
+			return err
+		}
 	}
 
-	defer func() {
-		if err != nil {
-			tx.Rollback()
+	if a.version == 134 {
+		// Perform database upgrade from version 134 to version 135.
+		if err := createPollTable(a.db); err != nil {
+			return err
 		}
-	}()
 
-	decoded_uid := store.DecodeUid(uid)
+		if err := bumpVersion(a, 135); err != nil {
+			return err
+		}
+	}
 
-	if hard {
-		// Delete user's devices
-		// t.ErrNotFound = user has no devices.
-		if err = deviceDelete(tx, uid, ""); err != nil && err != t.ErrNotFound {
+	if a.version == 135 {
+		// Perform database upgrade from version 135 to version 136.
+		if err := createBookmarkTable(a.db); err != nil {
 			return err
 		}
 
-		// Delete user's subscriptions in all topics.
-		if err = subsDelForUser(tx, uid, true); err != nil {
+		if err := bumpVersion(a, 136); err != nil {
 			return err
 		}
+	}
 
-		// Delete records of messages soft-deleted for the user.
-		if _, err = tx.Exec("DELETE FROM dellog WHERE deletedfor=?", decoded_uid); err != nil {
+	if a.version == 136 {
+		// Perform database upgrade from version 136 to version 137.
+		if _, err := a.db.Exec("ALTER TABLE topics ADD limits JSON AFTER receipts"); err != nil {
 			return err
 		}
 
-		// Can't delete user's messages in all topics because we cannot notify topics of such deletion.
-		// Just leave the messages there marked as sent by "not found" user.
+		if err := bumpVersion(a, 137); err != nil {
+			return err
+		}
+	}
 
-		// Delete topics where the user is the owner.
+	if a.version == 137 {
+		// Perform database upgrade from version 137 to version 138.
+		if err := createViewOnceTables(a.db); err != nil {
+			return err
+		}
 
-		// First delete all messages in those topics.
-		if _, err = tx.Exec("DELETE dellog FROM dellog LEFT JOIN topics ON topics.name=dellog.topic WHERE topics.owner=?",
-			decoded_uid); err != nil {
+		if err := bumpVersion(a, 138); err != nil {
 			return err
 		}
-		if _, err = tx.Exec("DELETE messages FROM messages LEFT JOIN topics ON topics.name=messages.topic WHERE topics.owner=?",
-			decoded_uid); err != nil {
+	}
+
+	if a.version == 138 {
+		// Perform database upgrade from version 138 to version 139.
+		if _, err := a.db.Exec("ALTER TABLE users ADD birthdate VARCHAR(10) NOT NULL DEFAULT '' AFTER consent"); err != nil {
 			return err
 		}
 
-		// Delete all subscriptions.
-		if _, err = tx.Exec("DELETE sub FROM subscriptions AS sub LEFT JOIN topics ON topics.name=sub.topic WHERE topics.owner=?",
-			decoded_uid); err != nil {
+		if err := bumpVersion(a, 139); err != nil {
 			return err
 		}
+	}
 
-		// Delete topic tags
-		if _, err = tx.Exec("DELETE topictags FROM topictags LEFT JOIN topics ON topics.name=topictags.topic WHERE topics.owner=?",
-			decoded_uid); err != nil {
+	if a.version == 139 {
+		// Perform database upgrade from version 139 to version 140.
+		if _, err := a.db.Exec("ALTER TABLE subscriptions ADD anchorseq INT DEFAULT 0 AFTER muteuntil"); err != nil {
 			return err
 		}
 
-		// And finally delete the topics.
-		if _, err = tx.Exec("DELETE FROM topics WHERE owner=?", decoded_uid); err != nil {
+		if err := bumpVersion(a, 140); err != nil {
 			return err
 		}
+	}
 
-		// Delete user's authentication records.
-		if _, err = tx.Exec("DELETE FROM auth WHERE userid=?", decoded_uid); err != nil {
+	if a.version == 140 {
+		// Perform database upgrade from version 140 to version 141.
+		if _, err := a.db.Exec("ALTER TABLE mentions ADD createdat DATETIME(3) NOT NULL DEFAULT CURRENT_TIMESTAMP(3) AFTER id," +
+			" ADD thread INT NOT NULL DEFAULT 0 AFTER seqid"); err != nil {
 			return err
 		}
 
-		// Delete all credentials.
-		if err = credDel(tx, uid, "", ""); err != nil && err != t.ErrNotFound {
+		if err := bumpVersion(a, 141); err != nil {
 			return err
 		}
+	}
 
-		if _, err = tx.Exec("DELETE FROM usertags WHERE userid=?", decoded_uid); err != nil {
+	if a.version == 141 {
+		// Perform database upgrade from version 141 to version 142.
+		if _, err := a.db.Exec("ALTER TABLE messages ADD mediatype VARCHAR(16) NOT NULL DEFAULT '' AFTER lastreplyat," +
+			" ADD INDEX messages_topic_mediatype_seqid(topic, mediatype, seqid)"); err != nil {
 			return err
 		}
 
-		if _, err = tx.Exec("DELETE FROM users WHERE id=?", decoded_uid); err != nil {
+		if err := bumpVersion(a, 142); err != nil {
 			return err
 		}
-	} else {
-		now := t.TimeNow()
-		// Disable all user's subscriptions. That includes p2p subscriptions. No need to delete them.
-		if err = subsDelForUser(tx, uid, false); err != nil {
+	}
+
+	if a.version == 142 {
+		// Perform database upgrade from version 142 to version 143.
+		if _, err := a.db.Exec("ALTER TABLE messages ADD mime VARCHAR(255) NOT NULL DEFAULT '' AFTER mediatype," +
+			" ADD INDEX messages_topic_mime_seqid(topic, mime, seqid)"); err != nil {
 			return err
 		}
 
-		// Disable all subscriptions to topics where the user is the owner.
-		if _, err = tx.Exec("UPDATE subscriptions LEFT JOIN topics ON subscriptions.topic=topics.name "+
-			"SET subscriptions.updatedat=?, subscriptions.deletedat=? WHERE topics.owner=?",
-			now, now, decoded_uid); err != nil {
+		if err := bumpVersion(a, 143); err != nil {
 			return err
 		}
-		// Disable group topics where the user is the owner.
-		if _, err = tx.Exec("UPDATE topics SET updatedat=?, state=?, stateat=? WHERE owner=?",
-			now, t.StateDeleted, now, decoded_uid); err != nil {
+	}
+
+	if a.version == 143 {
+		// Perform database upgrade from version 143 to version 144.
+		if _, err := a.db.Exec("ALTER TABLE topics ADD announce TINYINT DEFAULT 0 AFTER limits"); err != nil {
 			return err
 		}
-		// Disable p2p topics with the user (p2p topic's owner is 0).
-		if _, err = tx.Exec("UPDATE topics LEFT JOIN subscriptions ON topics.name=subscriptions.topic "+
-			"SET topics.updatedat=?, topics.state=?, topics.stateat=? WHERE topics.owner=0 AND subscriptions.userid=?",
-			now, t.StateDeleted, now, decoded_uid); err != nil {
+
+		if err := bumpVersion(a, 144); err != nil {
 			return err
 		}
+	}
 
-		// Disable the other user's subscription to a disabled p2p topic.
-		if _, err = tx.Exec("UPDATE subscriptions AS s_one LEFT JOIN subscriptions AS s_two "+
-			"ON s_one.topic=s_two.topic "+
-			"SET s_two.updatedat=?, s_two.deletedat=? WHERE s_one.userid=?",
-			now, now, decoded_uid); err != nil {
+	if a.version == 144 {
+		// Perform database upgrade from version 144 to version 145.
+		if err := createAccountEventTable(a.db); err != nil {
 			return err
 		}
 
-		// Disable user.
-		if _, err = tx.Exec("UPDATE users SET updatedat=?, state=?, stateat=? WHERE id=?",
-			now, t.StateDeleted, now, decoded_uid); err != nil {
+		if err := bumpVersion(a, 145); err != nil {
 			return err
 		}
 	}
 
-	return tx.Commit()
-}
-
-// topicStateForUser is called by UserUpdate when the update contains state change.
-func (a *adapter) topicStateForUser(tx *sqlx.Tx, decoded_uid int64, now time.Time, update interface{}) error {
-	var err error
+	if a.version == 145 {
+		// Perform database upgrade from version 145 to version 146.
+		if _, err := a.db.Exec("ALTER TABLE subscriptions ADD role VARCHAR(16) NOT NULL DEFAULT '' AFTER anchorseq"); err != nil {
+			return err
+		}
 
-	state, ok := update.(t.ObjState)
-	if !ok {
-		return t.ErrMalformed
+		if err := bumpVersion(a, 146); err != nil {
+			return err
+		}
 	}
 
-	if now.IsZero() {
-		now = t.TimeNow()
-	}
+	if a.version == 146 {
+		// Perform database upgrade from version 146 to version 147.
+		if _, err := a.db.Exec("ALTER TABLE topics ADD capacity JSON AFTER announce"); err != nil {
+			return err
+		}
 
-	// Change state of all topics where the user is the owner.
-	if _, err = tx.Exec("UPDATE topics SET state=?, stateat=? WHERE owner=? AND state!=?",
-		state, now, decoded_uid, t.StateDeleted); err != nil {
-		return err
+		if err := bumpVersion(a, 147); err != nil {
+			return err
+		}
 	}
 
-	// Change state of p2p topics with the user (p2p topic's owner is 0)
-	if _, err = tx.Exec("UPDATE topics LEFT JOIN subscriptions ON topics.name=subscriptions.topic "+
-		"SET topics.state=?, topics.stateat=? WHERE topics.owner=0 AND subscriptions.userid=? AND topics.state!=?",
-		state, now, decoded_uid, t.StateDeleted); err != nil {
-		return err
-	}
+	if a.version == 147 {
+		// Perform database upgrade from version 147 to version 148.
+		if _, err := a.db.Exec("ALTER TABLE topics ADD parent CHAR(25) NOT NULL DEFAULT '' AFTER capacity, " +
+			"ADD INDEX topics_parent(parent)"); err != nil {
+			return err
+		}
 
-	// Subscriptions don't need to be updated:
-	// subscriptions of a disabled user are not disabled and still can be manipulated.
+		if err := bumpVersion(a, 148); err != nil {
+			return err
+		}
+	}
 
-	return nil
-}
+	if a.version == 148 {
+		// Perform database upgrade from version 148 to version 149.
+		if _, err := a.db.Exec("ALTER TABLE subscriptions ADD request JSON AFTER role"); err != nil {
+			return err
+		}
 
-// UserUpdate updates user object.
-func (a *adapter) UserUpdate(uid t.Uid, update map[string]interface{}) error {
-	tx, err := a.db.Beginx()
-	if err != nil {
-		return err
+		if err := bumpVersion(a, 149); err != nil {
+			return err
+		}
 	}
 
-	defer func() {
-		if err != nil {
-			tx.Rollback()
+	if a.version == 149 {
+		// Perform database upgrade from version 149 to version 150.
+		if _, err := a.db.Exec("ALTER TABLE subscriptions ADD quiet JSON AFTER muteuntil"); err != nil {
+			return err
 		}
-	}()
 
-	cols, args := updateByMap(update)
-	decoded_uid := store.DecodeUid(uid)
-	args = append(args, decoded_uid)
-	_, err = tx.Exec("UPDATE users SET "+strings.Join(cols, ",")+" WHERE id=?", args...)
-	if err != nil {
-		return err
+		if err := bumpVersion(a, 150); err != nil {
+			return err
+		}
 	}
 
-	if state, ok := update["State"]; ok {
-		now, _ := update["StateAt"].(time.Time)
-		err = a.topicStateForUser(tx, decoded_uid, now, state)
-		if err != nil {
+	if a.version == 150 {
+		// Perform database upgrade from version 150 to version 151.
+		if _, err := a.db.Exec("ALTER TABLE topics ADD maxsubs INT NOT NULL DEFAULT 0 AFTER parent"); err != nil {
+			return err
+		}
+
+		if err := bumpVersion(a, 151); err != nil {
 			return err
 		}
 	}
 
-	// Tags are also stored in a separate table
-	if tags := extractTags(update); tags != nil {
-		// First delete all user tags
-		_, err = tx.Exec("DELETE FROM usertags WHERE userid=?", decoded_uid)
-		if err != nil {
+	if a.version == 151 {
+		// Perform database upgrade from version 151 to version 152.
+		if _, err := a.db.Exec("ALTER TABLE topics ADD freeze JSON AFTER maxsubs"); err != nil {
 			return err
 		}
-		// Now insert new tags
-		err = addTags(tx, "usertags", "userid", decoded_uid, tags, false)
-		if err != nil {
+
+		if err := bumpVersion(a, 152); err != nil {
 			return err
 		}
 	}
 
-	return tx.Commit()
-}
+	if a.version == 152 {
+		// Perform database upgrade from version 152 to version 153.
+		if _, err := a.db.Exec("ALTER TABLE subscriptions ADD notify VARCHAR(16) NOT NULL DEFAULT '' AFTER quiet"); err != nil {
+			return err
+		}
 
-// UserUpdateTags adds or resets user's tags
-func (a *adapter) UserUpdateTags(uid t.Uid, add, remove, reset []string) ([]string, error) {
-	tx, err := a.db.Beginx()
-	if err != nil {
-		return nil, err
+		if err := bumpVersion(a, 153); err != nil {
+			return err
+		}
 	}
 
-	defer func() {
-		if err != nil {
-			tx.Rollback()
+	if a.version == 153 {
+		// Perform database upgrade from version 153 to version 154.
+		if _, err := a.db.Exec("ALTER TABLE subscriptions ADD ban JSON AFTER request"); err != nil {
+			return err
 		}
-	}()
-
-	decoded_uid := store.DecodeUid(uid)
 
-	if reset != nil {
-		// Delete all tags first if resetting.
-		_, err = tx.Exec("DELETE FROM usertags WHERE userid=?", decoded_uid)
-		if err != nil {
-			return nil, err
+		if err := bumpVersion(a, 154); err != nil {
+			return err
 		}
-		add = reset
-		remove = nil
 	}
 
-	// Now insert new tags. Ignore duplicates if resetting.
-	err = addTags(tx, "usertags", "userid", decoded_uid, add, reset == nil)
-	if err != nil {
-		return nil, err
-	}
+	if a.version == 154 {
+		// Perform database upgrade from version 154 to version 155.
+		if _, err := a.db.Exec("ALTER TABLE topics ADD expiry JSON AFTER freeze"); err != nil {
+			return err
+		}
 
-	// Delete tags.
-	err = removeTags(tx, "usertags", "userid", decoded_uid, remove)
-	if err != nil {
-		return nil, err
+		if err := bumpVersion(a, 155); err != nil {
+			return err
+		}
 	}
 
-	var allTags []string
-	err = tx.Select(&allTags, "SELECT tag FROM usertags WHERE userid=?", decoded_uid)
-	if err != nil {
-		return nil, err
+	if a.version != adpVersion {
+		return errors.New("Failed to perform database upgrade to version " + strconv.Itoa(adpVersion) +
+			". DB is still at " + strconv.Itoa(a.version))
 	}
-
+	return nil
+}
+
+// createEmojiTables creates tables for custom emoji packs.
+func createEmojiTables(db sqlx.Execer) error {
+	if _, err := db.Exec(
+		`CREATE TABLE emojipacks(
+			id        BIGINT NOT NULL,
+			createdat DATETIME(3) NOT NULL,
+			updatedat DATETIME(3) NOT NULL,
+			org       VARCHAR(64) NOT NULL DEFAULT '',
+			name      VARCHAR(255) NOT NULL,
+			items     JSON,
+			PRIMARY KEY(id),
+			INDEX emojipacks_org(org)
+		)`); err != nil {
+		return err
+	}
+
+	// Links between uploaded files and the emoji packs which use them.
+	_, err := db.Exec(
+		`CREATE TABLE filepacklinks(
+			id			INT NOT NULL AUTO_INCREMENT,
+			createdat	DATETIME(3) NOT NULL,
+			fileid		BIGINT NOT NULL,
+			packid 		BIGINT NOT NULL,
+			PRIMARY KEY(id),
+			FOREIGN KEY(fileid) REFERENCES fileuploads(id) ON DELETE CASCADE,
+			FOREIGN KEY(packid) REFERENCES emojipacks(id) ON DELETE CASCADE
+		)`)
+	return err
+}
+
+// createDigestTable creates the table for periodic digests of channels.
+func createDigestTable(db sqlx.Execer) error {
+	_, err := db.Exec(
+		`CREATE TABLE digests(
+			id         INT NOT NULL AUTO_INCREMENT,
+			createdat  DATETIME(3) NOT NULL,
+			updatedat  DATETIME(3) NOT NULL,
+			userid     BIGINT NOT NULL,
+			topic      CHAR(25) NOT NULL,
+			period     INT NOT NULL,
+			msglimit   INT NOT NULL,
+			quietstart INT NOT NULL DEFAULT 0,
+			quietend   INT NOT NULL DEFAULT 0,
+			tzoffset   INT NOT NULL DEFAULT 0,
+			seqid      INT NOT NULL DEFAULT 0,
+			nextat     DATETIME(3) NOT NULL,
+			PRIMARY KEY(id),
+			UNIQUE INDEX digests_topic_userid(topic, userid),
+			INDEX digests_nextat(nextat)
+		)`)
+	return err
+}
+
+// createCalEventTable creates the table for events announced in topics.
+func createCalEventTable(db sqlx.Execer) error {
+	_, err := db.Exec(
+		`CREATE TABLE calevents(
+			id        INT NOT NULL AUTO_INCREMENT,
+			createdat DATETIME(3) NOT NULL,
+			updatedat DATETIME(3) NOT NULL,
+			topic     CHAR(25) NOT NULL,
+			seqid     INT NOT NULL,
+			title     VARCHAR(256) NOT NULL,
+			location  VARCHAR(256) NOT NULL DEFAULT '',
+			startat   DATETIME(3) NOT NULL,
+			endat     DATETIME(3),
+			remindat  DATETIME(3),
+			rsvp      JSON,
+			PRIMARY KEY(id),
+			UNIQUE INDEX calevents_topic_seqid(topic, seqid),
+			INDEX calevents_topic_startat(topic, startat),
+			INDEX calevents_remindat(remindat)
+		)`)
+	return err
+}
+
+// createPollTable creates the table for polls.
+func createPollTable(db sqlx.Execer) error {
+	_, err := db.Exec(
+		`CREATE TABLE polls(
+			id        INT NOT NULL AUTO_INCREMENT,
+			createdat DATETIME(3) NOT NULL,
+			updatedat DATETIME(3) NOT NULL,
+			topic     CHAR(25) NOT NULL,
+			seqid     INT NOT NULL,
+			question  VARCHAR(256) NOT NULL,
+			options   JSON NOT NULL,
+			multi     TINYINT NOT NULL DEFAULT 0,
+			votes     JSON,
+			PRIMARY KEY(id),
+			UNIQUE INDEX polls_topic_seqid(topic, seqid)
+		)`)
+	return err
+}
+
+// createBookmarkTable creates the table for starred messages.
+func createBookmarkTable(db sqlx.Execer) error {
+	_, err := db.Exec(
+		`CREATE TABLE bookmarks(
+			id        INT NOT NULL AUTO_INCREMENT,
+			createdat DATETIME(3) NOT NULL,
+			userid    BIGINT NOT NULL,
+			topic     CHAR(25) NOT NULL,
+			seqid     INT NOT NULL,
+			PRIMARY KEY(id),
+			UNIQUE INDEX bookmarks_userid_topic_seqid(userid, topic, seqid),
+			INDEX bookmarks_userid_createdat(userid, createdat),
+			INDEX bookmarks_topic(topic)
+		)`)
+	return err
+}
+
+// createViewOnceTables creates tables for view-once attachments and their retrievals.
+func createViewOnceTables(db sqlx.Execer) error {
+	if _, err := db.Exec(
+		`CREATE TABLE viewonce(
+			fileid    BIGINT NOT NULL,
+			createdat DATETIME(3) NOT NULL,
+			topic     CHAR(25) NOT NULL,
+			seqid     INT NOT NULL,
+			sender    BIGINT NOT NULL,
+			PRIMARY KEY(fileid),
+			FOREIGN KEY(fileid) REFERENCES fileuploads(id) ON DELETE CASCADE,
+			INDEX viewonce_topic(topic)
+		)`); err != nil {
+		return err
+	}
+
+	_, err := db.Exec(
+		`CREATE TABLE viewoncelog(
+			id        INT NOT NULL AUTO_INCREMENT,
+			createdat DATETIME(3) NOT NULL,
+			fileid    BIGINT NOT NULL,
+			userid    BIGINT NOT NULL,
+			topic     CHAR(25) NOT NULL,
+			PRIMARY KEY(id),
+			FOREIGN KEY(fileid) REFERENCES fileuploads(id) ON DELETE CASCADE,
+			UNIQUE INDEX viewoncelog_fileid_userid(fileid, userid),
+			INDEX viewoncelog_userid(userid),
+			INDEX viewoncelog_topic(topic)
+		)`)
+	return err
+}
+
+// createAccountEventTable creates the table for the account activity timeline.
+func createAccountEventTable(db sqlx.Execer) error {
+	_, err := db.Exec(
+		`CREATE TABLE accountevents(
+			id         BIGINT NOT NULL,
+			createdat  DATETIME(3) NOT NULL,
+			userid     BIGINT NOT NULL,
+			what       VARCHAR(16) NOT NULL,
+			detail     VARCHAR(255) NOT NULL DEFAULT '',
+			newdevice  TINYINT NOT NULL DEFAULT 0,
+			useragent  VARCHAR(255) NOT NULL DEFAULT '',
+			remoteaddr VARCHAR(64) NOT NULL DEFAULT '',
+			deviceid   VARCHAR(255) NOT NULL DEFAULT '',
+			PRIMARY KEY(id),
+			INDEX accountevents_userid_createdat(userid, createdat),
+			INDEX accountevents_createdat(createdat)
+		)`)
+	return err
+}
+
+// createMentionTable creates the table for unread mentions.
+func createMentionTable(db sqlx.Execer) error {
+	_, err := db.Exec(
+		`CREATE TABLE mentions(
+			id        INT NOT NULL AUTO_INCREMENT,
+			createdat DATETIME(3) NOT NULL,
+			topic     CHAR(25) NOT NULL,
+			userid    BIGINT NOT NULL,
+			seqid     INT NOT NULL,
+			thread    INT NOT NULL DEFAULT 0,
+			PRIMARY KEY(id),
+			INDEX mentions_userid_topic_seqid(userid, topic, seqid),
+			INDEX mentions_topic(topic)
+		)`)
+	return err
+}
+
+// createReceiptTable creates the table for per-message read receipts.
+func createReceiptTable(db sqlx.Execer) error {
+	_, err := db.Exec(
+		`CREATE TABLE receipts(
+			id        INT NOT NULL AUTO_INCREMENT,
+			topic     CHAR(25) NOT NULL,
+			userid    BIGINT NOT NULL,
+			seqfrom   INT NOT NULL,
+			seqto     INT NOT NULL,
+			readat    DATETIME(3) NOT NULL,
+			PRIMARY KEY(id),
+			INDEX receipts_topic_seqto(topic, seqto)
+		)`)
+	return err
+}
+
+func createSystemTopic(tx *sql.Tx) error {
+	now := t.TimeNow()
+	sql := `INSERT INTO topics(createdat,updatedat,state,touchedat,name,access,public)
+				VALUES(?,?,?,?,'sys','{"Auth": "N","Anon": "N"}','{"fn": "System"}')`
+	_, err := tx.Exec(sql, now, now, t.StateOK, now)
+	return err
+}
+
+func addTags(tx *sqlx.Tx, table, keyName string, keyVal interface{}, tags []string, ignoreDups bool) error {
+
+	if len(tags) == 0 {
+		return nil
+	}
+
+	var insert *sql.Stmt
+	var err error
+	insert, err = tx.Prepare("INSERT INTO " + table + "(" + keyName + ",tag) VALUES(?,?)")
+	if err != nil {
+		return err
+	}
+
+	for _, tag := range tags {
+		_, err = insert.Exec(keyVal, tag)
+
+		if err != nil {
+			if isDupe(err) {
+				if ignoreDups {
+					continue
+				}
+				return t.ErrDuplicate
+			}
+			return err
+		}
+	}
+
+	return nil
+}
+
+func removeTags(tx *sqlx.Tx, table, keyName string, keyVal interface{}, tags []string) error {
+	if len(tags) == 0 {
+		return nil
+	}
+
+	var args []interface{}
+	for _, tag := range tags {
+		args = append(args, tag)
+	}
+
+	query, args, _ := sqlx.In("DELETE FROM "+table+" WHERE "+keyName+"=? AND tag IN (?)", keyVal, args)
+	query = tx.Rebind(query)
+	_, err := tx.Exec(query, args...)
+
+	return err
+}
+
+// UserCreate creates a new user. Returns error and true if error is due to duplicate user name,
+// false for any other error
+func (a *adapter) UserCreate(user *t.User) error {
+	tx, err := a.db.Beginx()
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	decoded_uid := store.DecodeUid(user.Uid())
+	if _, err = tx.Exec("INSERT INTO users(id,createdat,updatedat,state,access,public,trusted,tags) VALUES(?,?,?,?,?,?,?,?)",
+		decoded_uid,
+		user.CreatedAt, user.UpdatedAt,
+		user.State, user.Access,
+		toJSON(user.Public), toJSON(user.Trusted), user.Tags); err != nil {
+		return err
+	}
+
+	// Save user's tags to a separate table to make user findable.
+	if err = addTags(tx, "usertags", "userid", decoded_uid, user.Tags, false); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Add user's authentication record
+func (a *adapter) AuthAddRecord(uid t.Uid, scheme, unique string, authLvl auth.Level,
+	secret []byte, expires time.Time) error {
+
+	var exp *time.Time
+	if !expires.IsZero() {
+		exp = &expires
+	}
+	_, err := a.db.Exec("INSERT INTO auth(uname,userid,scheme,authLvl,secret,expires) VALUES(?,?,?,?,?,?)",
+		unique, store.DecodeUid(uid), scheme, authLvl, secret, exp)
+	if err != nil {
+		if isDupe(err) {
+			return t.ErrDuplicate
+		}
+		return err
+	}
+	return nil
+}
+
+// AuthDelScheme deletes an existing authentication scheme for the user.
+func (a *adapter) AuthDelScheme(user t.Uid, scheme string) error {
+	_, err := a.db.Exec("DELETE FROM auth WHERE userid=? AND scheme=?", store.DecodeUid(user), scheme)
+	return err
+}
+
+// AuthDelAllRecords deletes all authentication records for the user.
+func (a *adapter) AuthDelAllRecords(user t.Uid) (int, error) {
+	res, err := a.db.Exec("DELETE FROM auth WHERE userid=?", store.DecodeUid(user))
+	if err != nil {
+		return 0, err
+	}
+	count, _ := res.RowsAffected()
+
+	return int(count), nil
+}
+
+// Update user's authentication secret
+func (a *adapter) AuthUpdRecord(uid t.Uid, scheme, unique string, authLvl auth.Level,
+	secret []byte, expires time.Time) error {
+	var exp *time.Time
+	if !expires.IsZero() {
+		exp = &expires
+	}
+
+	_, err := a.db.Exec("UPDATE auth SET uname=?,authLvl=?,secret=?,expires=? WHERE userid=? AND scheme=?",
+		unique, authLvl, secret, exp, store.DecodeUid(uid), scheme)
+	if isDupe(err) {
+		return t.ErrDuplicate
+	}
+
+	return err
+}
+
+// Retrieve user's authentication record
+func (a *adapter) AuthGetRecord(uid t.Uid, scheme string) (string, auth.Level, []byte, time.Time, error) {
+	var expires time.Time
+
+	var record struct {
+		Uname   string
+		Authlvl auth.Level
+		Secret  []byte
+		Expires *time.Time
+	}
+
+	if err := a.db.Get(&record, "SELECT uname,secret,expires,authlvl FROM auth WHERE userid=? AND scheme=?",
+		store.DecodeUid(uid), scheme); err != nil {
+		if err == sql.ErrNoRows {
+			// Nothing found - clear the error
+			err = nil
+		}
+		return "", 0, nil, expires, err
+	}
+
+	if record.Expires != nil {
+		expires = *record.Expires
+	}
+
+	return record.Uname, record.Authlvl, record.Secret, expires, nil
+}
+
+// Retrieve user's authentication record
+func (a *adapter) AuthGetUniqueRecord(unique string) (t.Uid, auth.Level, []byte, time.Time, error) {
+	var expires time.Time
+
+	var record struct {
+		Userid  int64
+		Authlvl auth.Level
+		Secret  []byte
+		Expires *time.Time
+	}
+
+	if err := a.db.Get(&record, "SELECT userid,secret,expires,authlvl FROM auth WHERE uname=?", unique); err != nil {
+		if err == sql.ErrNoRows {
+			// Nothing found - clear the error
+			err = nil
+		}
+		return t.ZeroUid, 0, nil, expires, err
+	}
+
+	if record.Expires != nil {
+		expires = *record.Expires
+	}
+
+	return store.EncodeUid(record.Userid), record.Authlvl, record.Secret, expires, nil
+}
+
+// UserGet fetches a single user by user id. If user is not found it returns (nil, nil)
+func (a *adapter) UserGet(uid t.Uid) (*t.User, error) {
+	var user t.User
+	err := a.db.Get(&user, "SELECT * FROM users WHERE id=? AND state!=?", store.DecodeUid(uid), t.StateDeleted)
+	if err == nil {
+		user.SetUid(uid)
+		user.Public = fromJSON(user.Public)
+		user.Trusted = fromJSON(user.Trusted)
+		return &user, nil
+	}
+
+	if err == sql.ErrNoRows {
+		// Clear the error if user does not exist or marked as soft-deleted.
+		return nil, nil
+	}
+
+	return nil, err
+}
+
+func (a *adapter) UserGetAll(ids ...t.Uid) ([]t.User, error) {
+	uids := make([]interface{}, len(ids))
+	for i, id := range ids {
+		uids[i] = store.DecodeUid(id)
+	}
+
+	users := []t.User{}
+	q, uids, _ := sqlx.In("SELECT * FROM users WHERE id IN (?) AND state!=?", uids, t.StateDeleted)
+	q = a.db.Rebind(q)
+	rows, err := a.db.Queryx(q, uids...)
+	if err != nil {
+		return nil, err
+	}
+
+	var user t.User
+	for rows.Next() {
+		if err = rows.StructScan(&user); err != nil {
+			users = nil
+			break
+		}
+
+		if user.State == t.StateDeleted {
+			continue
+		}
+
+		user.SetUid(encodeUidString(user.Id))
+		user.Public = fromJSON(user.Public)
+		user.Trusted = fromJSON(user.Trusted)
+
+		users = append(users, user)
+	}
+	rows.Close()
+
+	return users, err
+}
+
+// UserDelete deletes specified user: wipes completely (hard-delete) or marks as deleted.
+// TODO: report when the user is not found.
+func (a *adapter) UserDelete(uid t.Uid, hard bool) error {
+	tx, err := a.db.Beginx()
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	decoded_uid := store.DecodeUid(uid)
+
+	if hard {
+		// Delete user's devices
+		// t.ErrNotFound = user has no devices.
+		if err = deviceDelete(tx, uid, ""); err != nil && err != t.ErrNotFound {
+			return err
+		}
+
+		// Delete user's subscriptions in all topics.
+		if err = subsDelForUser(tx, uid, true); err != nil {
+			return err
+		}
+
+		// Delete records of messages soft-deleted for the user.
+		if _, err = tx.Exec("DELETE FROM dellog WHERE deletedfor=?", decoded_uid); err != nil {
+			return err
+		}
+
+		// Delete user's unread mentions.
+		if _, err = tx.Exec("DELETE FROM mentions WHERE userid=?", decoded_uid); err != nil {
+			return err
+		}
+
+		// Delete user's bookmarks.
+		if _, err = tx.Exec("DELETE FROM bookmarks WHERE userid=?", decoded_uid); err != nil {
+			return err
+		}
+
+		// Delete records of view-once attachments retrieved by the user.
+		if _, err = tx.Exec("DELETE FROM viewoncelog WHERE userid=?", decoded_uid); err != nil {
+			return err
+		}
+
+		// Delete the activity timeline of the user.
+		if _, err = tx.Exec("DELETE FROM accountevents WHERE userid=?", decoded_uid); err != nil {
+			return err
+		}
+
+		// Can't delete user's messages in all topics because we cannot notify topics of such deletion.
+		// Just leave the messages there marked as sent by "not found" user.
+
+		// Delete topics where the user is the owner.
+
+		// First delete all messages in those topics.
+		if _, err = tx.Exec("DELETE dellog FROM dellog LEFT JOIN topics ON topics.name=dellog.topic WHERE topics.owner=?",
+			decoded_uid); err != nil {
+			return err
+		}
+		if _, err = tx.Exec("DELETE messages FROM messages LEFT JOIN topics ON topics.name=messages.topic WHERE topics.owner=?",
+			decoded_uid); err != nil {
+			return err
+		}
+
+		// Delete all subscriptions.
+		if _, err = tx.Exec("DELETE sub FROM subscriptions AS sub LEFT JOIN topics ON topics.name=sub.topic WHERE topics.owner=?",
+			decoded_uid); err != nil {
+			return err
+		}
+
+		// Delete topic tags
+		if _, err = tx.Exec("DELETE topictags FROM topictags LEFT JOIN topics ON topics.name=topictags.topic WHERE topics.owner=?",
+			decoded_uid); err != nil {
+			return err
+		}
+
+		// And finally delete the topics.
+		if _, err = tx.Exec("DELETE FROM topics WHERE owner=?", decoded_uid); err != nil {
+			return err
+		}
+
+		// Delete user's authentication records.
+		if _, err = tx.Exec("DELETE FROM auth WHERE userid=?", decoded_uid); err != nil {
+			return err
+		}
+
+		// Delete all credentials.
+		if err = credDel(tx, uid, "", ""); err != nil && err != t.ErrNotFound {
+			return err
+		}
+
+		if _, err = tx.Exec("DELETE FROM usertags WHERE userid=?", decoded_uid); err != nil {
+			return err
+		}
+
+		if _, err = tx.Exec("DELETE FROM users WHERE id=?", decoded_uid); err != nil {
+			return err
+		}
+	} else {
+		now := t.TimeNow()
+		// Disable all user's subscriptions. That includes p2p subscriptions. No need to delete them.
+		if err = subsDelForUser(tx, uid, false); err != nil {
+			return err
+		}
+
+		// Disable all subscriptions to topics where the user is the owner.
+		if _, err = tx.Exec("UPDATE subscriptions LEFT JOIN topics ON subscriptions.topic=topics.name "+
+			"SET subscriptions.updatedat=?, subscriptions.deletedat=? WHERE topics.owner=?",
+			now, now, decoded_uid); err != nil {
+			return err
+		}
+		// Disable group topics where the user is the owner.
+		if _, err = tx.Exec("UPDATE topics SET updatedat=?, state=?, stateat=? WHERE owner=?",
+			now, t.StateDeleted, now, decoded_uid); err != nil {
+			return err
+		}
+		// Disable p2p topics with the user (p2p topic's owner is 0).
+		if _, err = tx.Exec("UPDATE topics LEFT JOIN subscriptions ON topics.name=subscriptions.topic "+
+			"SET topics.updatedat=?, topics.state=?, topics.stateat=? WHERE topics.owner=0 AND subscriptions.userid=?",
+			now, t.StateDeleted, now, decoded_uid); err != nil {
+			return err
+		}
+
+		// Disable the other user's subscription to a disabled p2p topic.
+		if _, err = tx.Exec("UPDATE subscriptions AS s_one LEFT JOIN subscriptions AS s_two "+
+			"ON s_one.topic=s_two.topic "+
+			"SET s_two.updatedat=?, s_two.deletedat=? WHERE s_one.userid=?",
+			now, now, decoded_uid); err != nil {
+			return err
+		}
+
+		// Disable user.
+		if _, err = tx.Exec("UPDATE users SET updatedat=?, state=?, stateat=? WHERE id=?",
+			now, t.StateDeleted, now, decoded_uid); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// topicStateForUser is called by UserUpdate when the update contains state change.
+func (a *adapter) topicStateForUser(tx *sqlx.Tx, decoded_uid int64, now time.Time, update interface{}) error {
+	var err error
+
+	state, ok := update.(t.ObjState)
+	if !ok {
+		return t.ErrMalformed
+	}
+
+	if now.IsZero() {
+		now = t.TimeNow()
+	}
+
+	// Change state of all topics where the user is the owner.
+	if _, err = tx.Exec("UPDATE topics SET state=?, stateat=? WHERE owner=? AND state!=?",
+		state, now, decoded_uid, t.StateDeleted); err != nil {
+		return err
+	}
+
+	// Change state of p2p topics with the user (p2p topic's owner is 0)
+	if _, err = tx.Exec("UPDATE topics LEFT JOIN subscriptions ON topics.name=subscriptions.topic "+
+		"SET topics.state=?, topics.stateat=? WHERE topics.owner=0 AND subscriptions.userid=? AND topics.state!=?",
+		state, now, decoded_uid, t.StateDeleted); err != nil {
+		return err
+	}
+
+	// Subscriptions don't need to be updated:
+	// subscriptions of a disabled user are not disabled and still can be manipulated.
+
+	return nil
+}
+
+// UserUpdate updates user object.
+func (a *adapter) UserUpdate(uid t.Uid, update map[string]interface{}) error {
+	tx, err := a.db.Beginx()
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	cols, args := updateByMap(update)
+	decoded_uid := store.DecodeUid(uid)
+	args = append(args, decoded_uid)
+	_, err = tx.Exec("UPDATE users SET "+strings.Join(cols, ",")+" WHERE id=?", args...)
+	if err != nil {
+		return err
+	}
+
+	if state, ok := update["State"]; ok {
+		now, _ := update["StateAt"].(time.Time)
+		err = a.topicStateForUser(tx, decoded_uid, now, state)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Tags are also stored in a separate table
+	if tags := extractTags(update); tags != nil {
+		// First delete all user tags
+		_, err = tx.Exec("DELETE FROM usertags WHERE userid=?", decoded_uid)
+		if err != nil {
+			return err
+		}
+		// Now insert new tags
+		err = addTags(tx, "usertags", "userid", decoded_uid, tags, false)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// UserUpdateTags adds or resets user's tags
+func (a *adapter) UserUpdateTags(uid t.Uid, add, remove, reset []string) ([]string, error) {
+	tx, err := a.db.Beginx()
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	decoded_uid := store.DecodeUid(uid)
+
+	if reset != nil {
+		// Delete all tags first if resetting.
+		_, err = tx.Exec("DELETE FROM usertags WHERE userid=?", decoded_uid)
+		if err != nil {
+			return nil, err
+		}
+		add = reset
+		remove = nil
+	}
+
+	// Now insert new tags. Ignore duplicates if resetting.
+	err = addTags(tx, "usertags", "userid", decoded_uid, add, reset == nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// Delete tags.
+	err = removeTags(tx, "usertags", "userid", decoded_uid, remove)
+	if err != nil {
+		return nil, err
+	}
+
+	var allTags []string
+	err = tx.Select(&allTags, "SELECT tag FROM usertags WHERE userid=?", decoded_uid)
+	if err != nil {
+		return nil, err
+	}
+
 	_, err = tx.Exec("UPDATE users SET tags=? WHERE id=?", t.StringSlice(allTags), decoded_uid)
 	if err != nil {
 		return nil, err
@@ -1114,12 +1919,35 @@ func (a *adapter) UserGetByCred(method, value string) (t.Uid, error) {
 	return t.ZeroUid, err
 }
 
+// UserGetByState returns IDs of users who have been in the given state since before the given time,
+// ordered by ID, starting after the given ID.
+func (a *adapter) UserGetByState(state t.ObjState, before time.Time, after t.Uid, limit int) ([]t.Uid, error) {
+	rows, err := a.db.Queryx("SELECT id FROM users WHERE state=? AND stateat<? AND id>? ORDER BY id LIMIT ?",
+		state, before, store.DecodeUid(after), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var uids []t.Uid
+	for rows.Next() {
+		var decoded_uid int64
+		if err = rows.Scan(&decoded_uid); err != nil {
+			return nil, err
+		}
+		uids = append(uids, store.EncodeUid(decoded_uid))
+	}
+	return uids, rows.Err()
+}
+
 // UserUnreadCount returns the total number of unread messages in all topics with
 // the R permission.
 func (a *adapter) UserUnreadCount(uid t.Uid) (int, error) {
 	var count int
+	// Subscriptions of channel readers 'chnXXX' count messages of the topic 'grpXXX'.
 	err := a.db.Get(&count, "SELECT SUM(t.seqid)-SUM(s.readseqid) FROM topics AS t, subscriptions AS s "+
-		"WHERE s.userid=? AND t.name=s.topic AND s.deletedat IS NULL AND t.state!=? AND "+
+		"WHERE s.userid=? AND t.name=IF(s.topic LIKE 'chn%',CONCAT('grp',SUBSTRING(s.topic,4)),s.topic) AND "+
+		"s.deletedat IS NULL AND t.state!=? AND "+
 		"INSTR(s.modewant, 'R')>0 AND INSTR(s.modegiven, 'R')>0", store.DecodeUid(uid), t.StateDeleted)
 	if err == nil {
 		return count, nil
@@ -1135,10 +1963,10 @@ func (a *adapter) UserUnreadCount(uid t.Uid) (int, error) {
 // *****************************
 
 func (a *adapter) topicCreate(tx *sqlx.Tx, topic *t.Topic) error {
-	_, err := tx.Exec("INSERT INTO topics(createdat,updatedat,touchedat,state,name,usebt,owner,access,public,tags) "+
-		"VALUES(?,?,?,?,?,?,?,?,?,?)",
+	_, err := tx.Exec("INSERT INTO topics(createdat,updatedat,touchedat,state,name,usebt,owner,access,public,tags,parent) "+
+		"VALUES(?,?,?,?,?,?,?,?,?,?,?)",
 		topic.CreatedAt, topic.UpdatedAt, topic.TouchedAt, topic.State, topic.Id, topic.UseBt,
-		store.DecodeUid(t.ParseUid(topic.Owner)), topic.Access, toJSON(topic.Public), topic.Tags)
+		store.DecodeUid(t.ParseUid(topic.Owner)), topic.Access, toJSON(topic.Public), topic.Tags, topic.Parent)
 	if err != nil {
 		return err
 	}
@@ -1180,13 +2008,13 @@ func createSubscription(tx *sqlx.Tx, sub *t.Subscription, undelete bool) error {
 
 	if err != nil && isDupe(err) {
 		if undelete {
-			_, err = tx.Exec("UPDATE subscriptions SET createdat=?,updatedat=?,deletedat=NULL,modeGiven=? "+
+			_, err = tx.Exec("UPDATE subscriptions SET createdat=?,updatedat=?,deletedat=NULL,role='',request=NULL,ban=NULL,modeGiven=? "+
 				"WHERE topic=? AND userid=?",
 				sub.CreatedAt, sub.UpdatedAt, sub.ModeGiven.String(), sub.Topic, decoded_uid)
 
 		} else {
 			_, err = tx.Exec(
-				"UPDATE subscriptions SET createdat=?,updatedat=?,deletedat=NULL,modeWant=?,modeGiven=?,private=? "+
+				"UPDATE subscriptions SET createdat=?,updatedat=?,deletedat=NULL,role='',request=NULL,ban=NULL,modeWant=?,modeGiven=?,private=? "+
 					"WHERE topic=? AND userid=?",
 				sub.CreatedAt, sub.UpdatedAt, sub.ModeWant.String(), sub.ModeGiven.String(),
 				jpriv, sub.Topic, decoded_uid)
@@ -1236,7 +2064,7 @@ func (a *adapter) TopicGet(topic string) (*t.Topic, error) {
 	// Fetch topic by name
 	var tt = new(t.Topic)
 	err := a.db.Get(tt,
-		"SELECT createdat,updatedat,state,stateat,touchedat,name AS id,usebt,access,owner,seqid,delid,public,tags "+
+		"SELECT createdat,updatedat,state,stateat,touchedat,name AS id,usebt,access,owner,seqid,delid,public,tags,packs,webhook,stats,guests,owners,receipts,limits,announce,capacity,parent,maxsubs,freeze,expiry "+
 			"FROM topics WHERE name=?",
 		topic)
 
@@ -1254,12 +2082,108 @@ func (a *adapter) TopicGet(topic string) (*t.Topic, error) {
 	return tt, nil
 }
 
+// TopicGetByState loads up to limit topics in the given state, oldest first.
+func (a *adapter) TopicGetByState(state t.ObjState, limit int) ([]t.Topic, error) {
+	rows, err := a.db.Queryx(
+		"SELECT createdat,updatedat,state,stateat,touchedat,name AS id,usebt,access,owner,seqid,delid,public,tags,packs,webhook,stats,guests,owners,receipts,limits,announce,capacity,parent,maxsubs,freeze,expiry "+
+			"FROM topics WHERE state=? ORDER BY createdat LIMIT ?", state, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var topics []t.Topic
+	for rows.Next() {
+		var tt t.Topic
+		if err = rows.StructScan(&tt); err != nil {
+			return nil, err
+		}
+		tt.Owner = encodeUidString(tt.Owner).String()
+		tt.Public = fromJSON(tt.Public)
+		topics = append(topics, tt)
+	}
+	return topics, rows.Err()
+}
+
+// TopicGetChildren loads up to limit topics which have the given parent, oldest first.
+func (a *adapter) TopicGetChildren(parent string, limit int) ([]t.Topic, error) {
+	rows, err := a.db.Queryx(
+		"SELECT createdat,updatedat,state,stateat,touchedat,name AS id,usebt,access,owner,seqid,delid,public,tags,packs,webhook,stats,guests,owners,receipts,limits,announce,capacity,parent,maxsubs,freeze,expiry "+
+			"FROM topics WHERE parent=? ORDER BY createdat LIMIT ?", parent, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var topics []t.Topic
+	for rows.Next() {
+		var tt t.Topic
+		if err = rows.StructScan(&tt); err != nil {
+			return nil, err
+		}
+		tt.Owner = encodeUidString(tt.Owner).String()
+		tt.Public = fromJSON(tt.Public)
+		topics = append(topics, tt)
+	}
+	return topics, rows.Err()
+}
+
+// TopicGetDirectory loads one page of active topics which have the category tag of the query.
+func (a *adapter) TopicGetDirectory(query *t.TopicDirectoryQuery) ([]t.Topic, error) {
+	// Number of members is saved with the counters of the topic.
+	members := "IFNULL(CAST(JSON_EXTRACT(stats,'$.members') AS SIGNED),0)"
+	key := "touchedat"
+	if query.ByMembers {
+		key = members
+	}
+
+	args := []interface{}{t.StateOK, query.Tag}
+	where := ""
+	if len(query.Exclude) > 0 {
+		where = " AND name NOT IN (SELECT topic FROM topictags WHERE tag IN (?" + strings.Repeat(",?", len(query.Exclude)-1) + "))"
+		for _, tag := range query.Exclude {
+			args = append(args, tag)
+		}
+	}
+	if query.After != nil {
+		// Topics after the last one of the previous page: lower sort key or the same key and greater name.
+		var after interface{} = query.After.TouchedAt
+		if query.ByMembers {
+			after = query.After.Members
+		}
+		where += " AND (" + key + "<? OR (" + key + "=? AND name>?))"
+		args = append(args, after, after, query.After.Name)
+	}
+	args = append(args, query.Limit)
+
+	rows, err := a.db.Queryx(
+		"SELECT createdat,updatedat,state,stateat,touchedat,name AS id,usebt,access,owner,seqid,delid,public,tags,packs,webhook,stats,guests,owners,receipts,limits,announce,capacity,parent,maxsubs,freeze,expiry "+
+			"FROM topics WHERE state=? AND name IN (SELECT topic FROM topictags WHERE tag=?)"+where+
+			" ORDER BY "+key+" DESC,name LIMIT ?", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var topics []t.Topic
+	for rows.Next() {
+		var tt t.Topic
+		if err = rows.StructScan(&tt); err != nil {
+			return nil, err
+		}
+		tt.Owner = encodeUidString(tt.Owner).String()
+		tt.Public = fromJSON(tt.Public)
+		topics = append(topics, tt)
+	}
+	return topics, rows.Err()
+}
+
 // TopicsForUser loads user's contact list: p2p and grp topics, except for 'me' & 'fnd' subscriptions.
 // Reads and denormalizes Public value.
 func (a *adapter) TopicsForUser(uid t.Uid, keepDeleted bool, opts *t.QueryOpt) ([]t.Subscription, error) {
 	// Fetch user's subscriptions
 	q := `SELECT createdat,updatedat,deletedat,topic,delid,recvseqid,
-		readseqid,modewant,modegiven,private FROM subscriptions WHERE userid=?`
+		readseqid,dlvseqid,muteuntil,quiet,notify,anchorseq,role,modewant,modegiven,private FROM subscriptions WHERE userid=?`
 	args := []interface{}{store.DecodeUid(uid)}
 	if !keepDeleted {
 		// Filter out deleted rows.
@@ -1379,7 +2303,7 @@ func (a *adapter) TopicsForUser(uid t.Uid, keepDeleted bool, opts *t.QueryOpt) (
 	// Fetch p2p users and join to p2p tables
 	if err == nil && len(usrq) > 0 {
 		q, usrq, _ := sqlx.In(
-			"SELECT id,state,createdat,updatedat,state,stateat,access,lastseen,useragent,public,tags "+
+			"SELECT id,state,createdat,updatedat,state,stateat,access,lastseen,useragent,public,trusted,tags "+
 				"FROM users WHERE id IN (?)",
 			usrq)
 		// Optionally skip deleted users.
@@ -1403,6 +2327,7 @@ func (a *adapter) TopicsForUser(uid t.Uid, keepDeleted bool, opts *t.QueryOpt) (
 				sub.ObjHeader.MergeTimes(&usr.ObjHeader)
 				sub.SetState(usr.State)
 				sub.SetPublic(fromJSON(usr.Public))
+				sub.SetTrusted(fromJSON(usr.Trusted))
 				sub.SetWith(uid2.UserId())
 				sub.SetDefaultAccess(usr.Access.Auth, usr.Access.Anon)
 				sub.SetLastSeenAndUA(usr.LastSeen, usr.UserAgent)
@@ -1422,7 +2347,7 @@ func (a *adapter) UsersForTopic(topic string, keepDeleted bool, opts *t.QueryOpt
 
 	// Fetch all subscribed users. The number of users is not large
 	q := `SELECT s.createdat,s.updatedat,s.deletedat,s.userid,s.topic,s.delid,s.recvseqid,
-		s.readseqid,s.modewant,s.modegiven,u.public,s.private
+		s.readseqid,s.dlvseqid,s.cursors,s.muteuntil,s.quiet,s.notify,s.anchorseq,s.role,s.modewant,s.modegiven,u.public,u.trusted,s.private
 		FROM subscriptions AS s JOIN users AS u ON s.userid=u.id 
 		WHERE s.topic=?`
 	args := []interface{}{topic}
@@ -1468,32 +2393,37 @@ func (a *adapter) UsersForTopic(topic string, keepDeleted bool, opts *t.QueryOpt
 	// Fetch subscriptions
 	var sub t.Subscription
 	var subs []t.Subscription
-	var public interface{}
+	var public, trusted interface{}
 	for rows.Next() {
 		if err = rows.Scan(
 			&sub.CreatedAt, &sub.UpdatedAt, &sub.DeletedAt,
 			&sub.User, &sub.Topic, &sub.DelId, &sub.RecvSeqId,
-			&sub.ReadSeqId, &sub.ModeWant, &sub.ModeGiven,
-			&public, &sub.Private); err != nil {
+			&sub.ReadSeqId, &sub.DlvSeqId, &sub.Cursors, &sub.MuteUntil, &sub.Quiet, &sub.Notify, &sub.AnchorSeq, &sub.Role, &sub.ModeWant, &sub.ModeGiven,
+			&public, &trusted, &sub.Private); err != nil {
 			break
 		}
 
 		sub.User = encodeUidString(sub.User).String()
 		sub.Private = fromJSON(sub.Private)
 		sub.SetPublic(fromJSON(public))
+		sub.SetTrusted(fromJSON(trusted))
 		subs = append(subs, sub)
 	}
 	rows.Close()
 
 	if err == nil && tcat == t.TopicCatP2P && len(subs) > 0 {
-		// Swap public values of P2P topics as expected.
+		// Swap public and trusted values of P2P topics as expected.
 		if len(subs) == 1 {
 			// The other user is deleted, nothing we can do.
 			subs[0].SetPublic(nil)
+			subs[0].SetTrusted(nil)
 		} else {
 			pub := subs[0].GetPublic()
 			subs[0].SetPublic(subs[1].GetPublic())
 			subs[1].SetPublic(pub)
+			trst := subs[0].GetTrusted()
+			subs[0].SetTrusted(subs[1].GetTrusted())
+			subs[1].SetTrusted(trst)
 		}
 
 		// Remove deleted and unneeded subscriptions
@@ -1579,6 +2509,30 @@ func (a *adapter) TopicDelete(topic string, hard bool) error {
 			return err
 		}
 
+		if _, err = tx.Exec("DELETE FROM receipts WHERE topic=?", topic); err != nil {
+			return err
+		}
+
+		if _, err = tx.Exec("DELETE FROM mentions WHERE topic=?", topic); err != nil {
+			return err
+		}
+
+		if _, err = tx.Exec("DELETE FROM polls WHERE topic=?", topic); err != nil {
+			return err
+		}
+
+		if _, err = tx.Exec("DELETE FROM bookmarks WHERE topic=?", topic); err != nil {
+			return err
+		}
+
+		if _, err = tx.Exec("DELETE FROM viewoncelog WHERE topic=?", topic); err != nil {
+			return err
+		}
+
+		if _, err = tx.Exec("DELETE FROM viewonce WHERE topic=?", topic); err != nil {
+			return err
+		}
+
 		if _, err = tx.Exec("DELETE FROM topics WHERE name=?", topic); err != nil {
 			return err
 		}
@@ -1640,15 +2594,68 @@ func (a *adapter) TopicUpdate(topic string, update map[string]interface{}) error
 }
 
 func (a *adapter) TopicOwnerChange(topic string, newOwner t.Uid) error {
-	_, err := a.db.Exec("UPDATE topics SET owner=? WHERE name=?", store.DecodeUid(newOwner), topic)
-	return err
+	tx, err := a.db.Beginx()
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	var oldOwner int64
+	if err = tx.Get(&oldOwner, "SELECT owner FROM topics WHERE name=? FOR UPDATE", topic); err != nil {
+		if err == sql.ErrNoRows {
+			err = t.ErrNotFound
+		}
+		return err
+	}
+	if _, err = tx.Exec("UPDATE topics SET owner=? WHERE name=?", store.DecodeUid(newOwner), topic); err != nil {
+		return err
+	}
+
+	// Move the O permission from the old owner to the new owner.
+	owners := []int64{oldOwner, store.DecodeUid(newOwner)}
+	for i, user := range owners {
+		if i == 0 && user == owners[1] {
+			continue
+		}
+		var modes struct {
+			Want  t.AccessMode `db:"modewant"`
+			Given t.AccessMode `db:"modegiven"`
+		}
+		err = tx.Get(&modes, "SELECT modewant,modegiven FROM subscriptions WHERE topic=? AND userid=? FOR UPDATE",
+			topic, user)
+		if err == sql.ErrNoRows {
+			err = nil
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if i == 0 {
+			modes.Want &^= t.ModeOwner
+			modes.Given &^= t.ModeOwner
+		} else {
+			modes.Want |= t.ModeOwner
+			modes.Given |= t.ModeOwner
+		}
+		if _, err = tx.Exec("UPDATE subscriptions SET modewant=?,modegiven=? WHERE topic=? AND userid=?",
+			modes.Want, modes.Given, topic, user); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
 }
 
 // Get a subscription of a user to a topic
 func (a *adapter) SubscriptionGet(topic string, user t.Uid) (*t.Subscription, error) {
 	var sub t.Subscription
 	err := a.db.Get(&sub, `SELECT createdat,updatedat,deletedat,userid AS user,topic,delid,recvseqid,
-		readseqid,modewant,modegiven,private FROM subscriptions WHERE topic=? AND userid=?`,
+		readseqid,dlvseqid,draft,muteuntil,quiet,notify,anchorseq,role,request,ban,modewant,modegiven,private FROM subscriptions WHERE topic=? AND userid=?`,
 		topic, store.DecodeUid(user))
 
 	if err != nil {
@@ -1683,7 +2690,7 @@ func (a *adapter) SubsLastSeen(topic string, user t.Uid, lastSeen map[string]tim
 // TODO: this is used only for presence notifications, no need to load Private either.
 func (a *adapter) SubsForUser(forUser t.Uid, keepDeleted bool, opts *t.QueryOpt) ([]t.Subscription, error) {
 	q := `SELECT createdat,updatedat,deletedat,userid AS user,topic,delid,recvseqid,
-		readseqid,modewant,modegiven,private FROM subscriptions WHERE userid=?`
+		readseqid,dlvseqid,modewant,modegiven,private FROM subscriptions WHERE userid=?`
 
 	args := []interface{}{store.DecodeUid(forUser)}
 	if !keepDeleted {
@@ -1732,7 +2739,7 @@ func (a *adapter) SubsForUser(forUser t.Uid, keepDeleted bool, opts *t.QueryOpt)
 // the latter does not.
 func (a *adapter) SubsForTopic(topic string, keepDeleted bool, opts *t.QueryOpt) ([]t.Subscription, error) {
 	q := `SELECT createdat,updatedat,deletedat,userid AS user,topic,delid,recvseqid,
-		readseqid,modewant,modegiven,private FROM subscriptions WHERE topic=?`
+		readseqid,dlvseqid,cursors,muteuntil,quiet,notify,anchorseq,role,request,ban,modewant,modegiven,private FROM subscriptions WHERE topic=?`
 
 	args := []interface{}{topic}
 	if !keepDeleted {
@@ -1777,6 +2784,13 @@ func (a *adapter) SubsForTopic(topic string, keepDeleted bool, opts *t.QueryOpt)
 	return subs, err
 }
 
+// SubsCountForTopic returns the number of subscriptions to the given topic which are not deleted.
+func (a *adapter) SubsCountForTopic(topic string) (int, error) {
+	var count int
+	err := a.db.Get(&count, "SELECT COUNT(*) FROM subscriptions WHERE topic=? AND deletedat IS NULL", topic)
+	return count, err
+}
+
 // SubsUpdate updates one or multiple subscriptions to a topic.
 func (a *adapter) SubsUpdate(topic string, user t.Uid, update map[string]interface{}) error {
 	tx, err := a.db.Begin()
@@ -1881,10 +2895,10 @@ func (a *adapter) FindUsers(uid t.Uid, req [][]string, opt []string) ([]t.Subscr
 		index[tag] = struct{}{}
 	}
 
-	query := "SELECT u.id,u.createdat,u.updatedat,u.access,u.public,u.tags,COUNT(*) AS matches " +
+	query := "SELECT u.id,u.createdat,u.updatedat,u.access,u.public,u.trusted,u.tags,COUNT(*) AS matches " +
 		"FROM users AS u LEFT JOIN usertags AS t ON t.userid=u.id " +
 		"WHERE u.state=? AND t.tag IN (?" + strings.Repeat(",?", len(allReq)+len(opt)-1) + ") " +
-		"GROUP BY u.id,u.createdat,u.updatedat,u.public,u.tags "
+		"GROUP BY u.id,u.createdat,u.updatedat,u.public,u.trusted,u.tags "
 	if len(allReq) > 0 {
 		query += "HAVING"
 		first := true
@@ -1913,7 +2927,7 @@ func (a *adapter) FindUsers(uid t.Uid, req [][]string, opt []string) ([]t.Subscr
 	}
 
 	var userId int64
-	var public interface{}
+	var public, trusted interface{}
 	var access t.DefaultAccess
 	var userTags t.StringSlice
 	var ignored int
@@ -1921,7 +2935,7 @@ func (a *adapter) FindUsers(uid t.Uid, req [][]string, opt []string) ([]t.Subscr
 	var subs []t.Subscription
 	thisUser := store.DecodeUid(uid)
 	for rows.Next() {
-		if err = rows.Scan(&userId, &sub.CreatedAt, &sub.UpdatedAt, &access, &public, &userTags, &ignored); err != nil {
+		if err = rows.Scan(&userId, &sub.CreatedAt, &sub.UpdatedAt, &access, &public, &trusted, &userTags, &ignored); err != nil {
 			subs = nil
 			break
 		}
@@ -1932,6 +2946,7 @@ func (a *adapter) FindUsers(uid t.Uid, req [][]string, opt []string) ([]t.Subscr
 		}
 		sub.User = store.EncodeUid(userId).String()
 		sub.SetPublic(fromJSON(public))
+		sub.SetTrusted(fromJSON(trusted))
 		sub.SetDefaultAccess(access.Auth, access.Anon)
 		foundTags := make([]string, 0, 1)
 		for _, tag := range userTags {
@@ -1950,7 +2965,7 @@ func (a *adapter) FindUsers(uid t.Uid, req [][]string, opt []string) ([]t.Subscr
 
 // Returns a list of topics with matching tags.
 // Searching the 'topics.Tags' for the given tags using respective index.
-func (a *adapter) FindTopics(req [][]string, opt []string) ([]t.Subscription, error) {
+func (a *adapter) FindTopics(req [][]string, opt []string, excl []string) ([]t.Subscription, error) {
 	index := make(map[string]struct{})
 	var args []interface{}
 	args = append(args, t.StateOK)
@@ -1965,8 +2980,14 @@ func (a *adapter) FindTopics(req [][]string, opt []string) ([]t.Subscription, er
 
 	query := "SELECT t.name AS topic,t.createdat,t.updatedat,t.usebt,t.access,t.public,t.tags,COUNT(*) AS matches " +
 		"FROM topics AS t LEFT JOIN topictags AS tt ON t.name=tt.topic " +
-		"WHERE t.state=? AND tt.tag IN (?" + strings.Repeat(",?", len(allReq)+len(opt)-1) + ") " +
-		"GROUP BY t.name,t.createdat,t.updatedat,t.usebt,t.access,t.public,t.tags "
+		"WHERE t.state=? AND tt.tag IN (?" + strings.Repeat(",?", len(allReq)+len(opt)-1) + ") "
+	if len(excl) > 0 {
+		query += "AND t.name NOT IN (SELECT topic FROM topictags WHERE tag IN (?" + strings.Repeat(",?", len(excl)-1) + ")) "
+		for _, tag := range excl {
+			args = append(args, tag)
+		}
+	}
+	query += "GROUP BY t.name,t.createdat,t.updatedat,t.usebt,t.access,t.public,t.tags "
 	if len(allReq) > 0 {
 		query += "HAVING"
 		first := true
@@ -2034,9 +3055,9 @@ func (a *adapter) MessageSave(msg *t.Message) error {
 	// store assignes message ID, but we don't use it. Message IDs are not used anywhere.
 	// Using a sequential ID provided by the database.
 	res, err := a.db.Exec(
-		"INSERT INTO messages(createdAt,updatedAt,seqid,topic,`from`,head,content) VALUES(?,?,?,?,?,?,?)",
+		"INSERT INTO messages(createdAt,updatedAt,seqid,topic,`from`,head,content,thread,mediatype,mime) VALUES(?,?,?,?,?,?,?,?,?,?)",
 		msg.CreatedAt, msg.UpdatedAt, msg.SeqId, msg.Topic,
-		store.DecodeUid(t.ParseUid(msg.From)), msg.Head, toJSON(msg.Content))
+		store.DecodeUid(t.ParseUid(msg.From)), msg.Head, toJSON(msg.Content), msg.Thread, msg.MediaType, msg.Mime)
 	if err == nil {
 		id, _ := res.LastInsertId()
 		// Replacing ID given by store by ID given by the DB.
@@ -2049,6 +3070,9 @@ func (a *adapter) MessageGetAll(topic string, forUser t.Uid, opts *t.QueryOpt) (
 	var limit = a.maxMessageResults
 	var lower = 0
 	var upper = 1<<31 - 1
+	var thread = 0
+	var mediaType string
+	var mimes []string
 
 	if opts != nil {
 		if opts.Since > 0 {
@@ -2062,17 +3086,90 @@ func (a *adapter) MessageGetAll(topic string, forUser t.Uid, opts *t.QueryOpt) (
 		if opts.Limit > 0 && opts.Limit < limit {
 			limit = opts.Limit
 		}
+		thread = opts.Thread
+		mediaType = opts.MediaType
+		mimes = opts.Mime
+	}
+
+	unum := store.DecodeUid(forUser)
+	query := "SELECT m.createdat,m.updatedat,m.deletedat,m.delid,m.seqid,m.topic,m.`from`,m.head,m.content," +
+		"m.thread,m.replies,m.lastreplyat" +
+		" FROM messages AS m LEFT JOIN dellog AS d" +
+		" ON d.topic=m.topic AND m.seqid BETWEEN d.low AND d.hi-1 AND d.deletedfor=?" +
+		" WHERE m.delid=0 AND m.topic=? AND m.seqid BETWEEN ? AND ? AND d.deletedfor IS NULL"
+	args := []interface{}{unum, topic, lower, upper}
+	if thread > 0 {
+		query += " AND m.thread=?"
+		args = append(args, thread)
+	}
+	if mediaType != "" {
+		query += " AND m.mediatype=?"
+		args = append(args, mediaType)
+	}
+	if len(mimes) > 0 {
+		// Patterns like "image/*" are matched by prefix.
+		var cond []string
+		for _, mime := range mimes {
+			if strings.HasSuffix(mime, "/*") {
+				cond = append(cond, "m.mime LIKE ?")
+				args = append(args, strings.TrimSuffix(mime, "*")+"%")
+			} else {
+				cond = append(cond, "m.mime=?")
+				args = append(args, mime)
+			}
+		}
+		query += " AND (" + strings.Join(cond, " OR ") + ")"
+	}
+	query += " ORDER BY m.seqid DESC LIMIT ?"
+	args = append(args, limit)
+	rows, err := a.db.Queryx(query, args...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var msgs []t.Message
+	for rows.Next() {
+		var msg t.Message
+		if err = rows.StructScan(&msg); err != nil {
+			break
+		}
+		msg.From = encodeUidString(msg.From).String()
+		msg.Content = fromJSON(msg.Content)
+		msgs = append(msgs, msg)
+	}
+	rows.Close()
+	return msgs, err
+}
+
+// MessageSearch returns messages of the topic matching the full-text query, skipping deleted ones.
+func (a *adapter) MessageSearch(topic string, forUser t.Uid, query string, opts *t.QueryOpt) ([]t.Message, error) {
+	var limit = a.maxMessageResults
+	var lower = 0
+	var upper = 1<<31 - 1
+
+	if opts != nil {
+		if opts.Since > 0 {
+			lower = opts.Since
+		}
+		if opts.Before > 0 {
+			upper = opts.Before - 1
+		}
+		if opts.Limit > 0 && opts.Limit < limit {
+			limit = opts.Limit
+		}
 	}
 
 	unum := store.DecodeUid(forUser)
 	rows, err := a.db.Queryx(
-		"SELECT m.createdat,m.updatedat,m.deletedat,m.delid,m.seqid,m.topic,m.`from`,m.head,m.content"+
+		"SELECT m.createdat,m.updatedat,m.deletedat,m.delid,m.seqid,m.topic,m.`from`,m.head,m.content,"+
+			"m.thread,m.replies,m.lastreplyat"+
 			" FROM messages AS m LEFT JOIN dellog AS d"+
 			" ON d.topic=m.topic AND m.seqid BETWEEN d.low AND d.hi-1 AND d.deletedfor=?"+
 			" WHERE m.delid=0 AND m.topic=? AND m.seqid BETWEEN ? AND ? AND d.deletedfor IS NULL"+
+			" AND MATCH(m.plaintext) AGAINST(? IN NATURAL LANGUAGE MODE)"+
 			" ORDER BY m.seqid DESC LIMIT ?",
-		unum, topic, lower, upper, limit)
-
+		unum, topic, lower, upper, query, limit)
 	if err != nil {
 		return nil, err
 	}
@@ -2257,6 +3354,20 @@ func (a *adapter) MessageDeleteList(topic string, toDel *t.DelMessage) (err erro
 }
 
 // MessageAttachments connects given message to a list of file record IDs.
+// MessageThreadReply increments the count of replies of the first message of a thread.
+func (a *adapter) MessageThreadReply(topic string, root int, at time.Time) error {
+	_, err := a.db.Exec("UPDATE messages SET replies=replies+1,lastreplyat=? WHERE topic=? AND seqid=?",
+		at, topic, root)
+	return err
+}
+
+// MessageUpdate replaces headers and content of a message.
+func (a *adapter) MessageUpdate(topic string, seqId int, head t.MessageHeaders, content interface{}) error {
+	_, err := a.db.Exec("UPDATE messages SET updatedat=?,head=?,content=? WHERE topic=? AND seqid=?",
+		t.TimeNow(), head, toJSON(content), topic, seqId)
+	return err
+}
+
 func (a *adapter) MessageAttachments(msgId t.Uid, fids []string) error {
 	var args []interface{}
 	var values []string
@@ -2299,6 +3410,49 @@ func (a *adapter) MessageAttachments(msgId t.Uid, fids []string) error {
 	return tx.Commit()
 }
 
+// MessageAttachmentsUpdate connects the message to the added file record IDs and disconnects it from
+// the removed ones.
+func (a *adapter) MessageAttachmentsUpdate(topic string, seqId int, added, removed []string) error {
+	var msgId int64
+	if err := a.db.Get(&msgId, "SELECT id FROM messages WHERE topic=? AND seqid=?", topic, seqId); err != nil {
+		if err == sql.ErrNoRows {
+			return t.ErrNotFound
+		}
+		return err
+	}
+
+	tx, err := a.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	if len(removed) > 0 {
+		var fids []interface{}
+		for _, fid := range removed {
+			fids = append(fids, decodeUidString(fid))
+		}
+		query, args, _ := sqlx.In("DELETE FROM filemsglinks WHERE msgid=? AND fileid IN (?)", msgId, fids)
+		if _, err = tx.Exec(query, args...); err != nil {
+			return err
+		}
+	}
+
+	now := t.TimeNow()
+	for _, fid := range added {
+		if _, err = tx.Exec("INSERT INTO filemsglinks(createdat,fileid,msgid) VALUES(?,?,?)",
+			now, decodeUidString(fid), msgId); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
 func deviceHasher(deviceID string) string {
 	// Generate custom key as [64-bit hash of device id] to ensure predictable
 	// length of the key
@@ -2343,18 +3497,21 @@ func (a *adapter) DeviceGetAll(uids ...t.Uid) (map[t.Uid][]t.DeviceDef, int, err
 		unums = append(unums, store.DecodeUid(uid))
 	}
 
-	q, unums, _ := sqlx.In("SELECT userid,deviceid,platform,lastseen,lang FROM devices WHERE userid IN (?)", unums)
+	q, unums, _ := sqlx.In("SELECT userid,deviceid,platform,lastseen,lang,lastpushat,pushfailures FROM devices "+
+		"WHERE userid IN (?)", unums)
 	rows, err := a.db.Queryx(q, unums...)
 	if err != nil {
 		return nil, 0, err
 	}
 
 	var device struct {
-		Userid   int64
-		Deviceid string
-		Platform string
-		Lastseen time.Time
-		Lang     string
+		Userid       int64
+		Deviceid     string
+		Platform     string
+		Lastseen     time.Time
+		Lang         string
+		Lastpushat   *time.Time
+		Pushfailures int
 	}
 
 	result := make(map[t.Uid][]t.DeviceDef)
@@ -2366,10 +3523,12 @@ func (a *adapter) DeviceGetAll(uids ...t.Uid) (map[t.Uid][]t.DeviceDef, int, err
 		uid := store.EncodeUid(device.Userid)
 		udev := result[uid]
 		udev = append(udev, t.DeviceDef{
-			DeviceId: device.Deviceid,
-			Platform: device.Platform,
-			LastSeen: device.Lastseen,
-			Lang:     device.Lang,
+			DeviceId:     device.Deviceid,
+			Platform:     device.Platform,
+			LastSeen:     device.Lastseen,
+			Lang:         device.Lang,
+			LastPushAt:   device.Lastpushat,
+			PushFailures: device.Pushfailures,
 		})
 		result[uid] = udev
 		count++
@@ -2408,12 +3567,47 @@ func (a *adapter) DeviceDelete(uid t.Uid, deviceID string) error {
 		}
 	}()
 
-	err = deviceDelete(tx, uid, deviceID)
+	err = deviceDelete(tx, uid, deviceID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// DevicePushResults records results of push notifications.
+func (a *adapter) DevicePushResults(delivered, failed []string, at time.Time) error {
+	if len(delivered) > 0 {
+		var hashes []interface{}
+		for _, id := range delivered {
+			hashes = append(hashes, deviceHasher(id))
+		}
+		q, args, _ := sqlx.In("UPDATE devices SET lastpushat=?,pushfailures=0 WHERE hash IN (?)", at, hashes)
+		if _, err := a.db.Exec(q, args...); err != nil {
+			return err
+		}
+	}
+	if len(failed) > 0 {
+		var hashes []interface{}
+		for _, id := range failed {
+			hashes = append(hashes, deviceHasher(id))
+		}
+		q, args, _ := sqlx.In("UPDATE devices SET pushfailures=pushfailures+1 WHERE hash IN (?)", hashes)
+		if _, err := a.db.Exec(q, args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeviceDeleteStale deletes devices which repeatedly failed to receive push notifications or have been idle for too long.
+func (a *adapter) DeviceDeleteStale(maxFailures int, idleBefore time.Time) (int, error) {
+	res, err := a.db.Exec("DELETE FROM devices WHERE pushfailures>=? OR lastseen<?", maxFailures, idleBefore)
 	if err != nil {
-		return err
+		return 0, err
 	}
-
-	return tx.Commit()
+	count, err := res.RowsAffected()
+	return int(count), err
 }
 
 // Credential management
@@ -2544,166 +3738,569 @@ func credDel(tx *sqlx.Tx, uid t.Uid, method, value string) error {
 		}
 	}
 
-	return err
+	return err
+}
+
+// CredDel deletes either credentials of the given user. If method is blank all
+// credentials are removed. If value is blank all credentials of the given the
+// method are removed.
+func (a *adapter) CredDel(uid t.Uid, method, value string) error {
+	tx, err := a.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	err = credDel(tx, uid, method, value)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// CredConfirm marks given credential method as confirmed.
+func (a *adapter) CredConfirm(uid t.Uid, method string) error {
+	res, err := a.db.Exec(
+		"UPDATE credentials SET updatedat=?,done=true,synthetic=CONCAT(method,':',value) "+
+			"WHERE userid=? AND method=? AND deletedat IS NULL AND done=false",
+		t.TimeNow(), store.DecodeUid(uid), method)
+	if err != nil {
+		if isDupe(err) {
+			return t.ErrDuplicate
+		}
+		return err
+	}
+	if numrows, _ := res.RowsAffected(); numrows < 1 {
+		return t.ErrNotFound
+	}
+	return nil
+}
+
+// CredFail increments failure count of the given validation method.
+func (a *adapter) CredFail(uid t.Uid, method string) error {
+	_, err := a.db.Exec("UPDATE credentials SET updatedat=?,retries=retries+1 WHERE userid=? AND method=? AND done=false",
+		t.TimeNow(), store.DecodeUid(uid), method)
+	return err
+}
+
+// CredGetActive returns currently active unvalidated credential of the given user and method.
+func (a *adapter) CredGetActive(uid t.Uid, method string) (*t.Credential, error) {
+	var cred t.Credential
+	err := a.db.Get(&cred, "SELECT createdat,updatedat,method,value,resp,done,retries "+
+		"FROM credentials WHERE userid=? AND deletedat IS NULL AND method=? AND done=false",
+		store.DecodeUid(uid), method)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			err = nil
+		}
+		return nil, err
+	}
+	cred.User = uid.String()
+
+	return &cred, nil
+}
+
+// CredGetAll returns credential records for the given user and method, all or validated only.
+func (a *adapter) CredGetAll(uid t.Uid, method string, validatedOnly bool) ([]t.Credential, error) {
+	query := "SELECT createdat,updatedat,method,value,resp,done,retries FROM credentials WHERE userid=? AND deletedat IS NULL"
+	args := []interface{}{store.DecodeUid(uid)}
+	if method != "" {
+		query += " AND method=?"
+		args = append(args, method)
+	}
+	if validatedOnly {
+		query += " AND done=true"
+	}
+
+	var credentials []t.Credential
+	err := a.db.Select(&credentials, query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	user := uid.String()
+	for i := range credentials {
+		credentials[i].User = user
+	}
+
+	return credentials, err
+}
+
+// FileUploads
+
+// FileStartUpload initializes a file upload
+func (a *adapter) FileStartUpload(fd *t.FileDef) error {
+	_, err := a.db.Exec("INSERT INTO fileuploads(id,createdat,updatedat,userid,status,mimetype,size,location)"+
+		" VALUES(?,?,?,?,?,?,?,?)",
+		store.DecodeUid(fd.Uid()), fd.CreatedAt, fd.UpdatedAt,
+		store.DecodeUid(t.ParseUid(fd.User)), fd.Status, fd.MimeType, fd.Size, fd.Location)
+	return err
+}
+
+// FileFinishUpload marks file upload as completed, successfully or otherwise
+func (a *adapter) FileFinishUpload(fid string, status int, size int64) (*t.FileDef, error) {
+	id := t.ParseUid(fid)
+	if id.IsZero() {
+		return nil, t.ErrMalformed
+	}
+
+	fd, err := a.FileGet(fid)
+	if err != nil {
+		return nil, err
+	}
+	if fd == nil {
+		return nil, t.ErrNotFound
+	}
+
+	fd.UpdatedAt = t.TimeNow()
+	_, err = a.db.Exec("UPDATE fileuploads SET updatedat=?,status=?,size=? WHERE id=?",
+		fd.UpdatedAt, status, size, store.DecodeUid(id))
+	if err == nil {
+		fd.Status = status
+		fd.Size = size
+	} else {
+		fd = nil
+	}
+	return fd, err
+}
+
+// FileGet fetches a record of a specific file
+func (a *adapter) FileGet(fid string) (*t.FileDef, error) {
+	id := t.ParseUid(fid)
+	if id.IsZero() {
+		return nil, t.ErrMalformed
+	}
+
+	var fd t.FileDef
+	err := a.db.Get(&fd, "SELECT id,createdat,updatedat,userid AS user,status,mimetype,size,location "+
+		"FROM fileuploads WHERE id=?", store.DecodeUid(id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	fd.Id = encodeUidString(fd.Id).String()
+	fd.User = encodeUidString(fd.User).String()
+
+	return &fd, nil
+
+}
+
+// FileDeleteUnused deletes file upload records.
+func (a *adapter) FileDeleteUnused(olderThan time.Time, limit int) ([]string, error) {
+	tx, err := a.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	query := "SELECT fu.id,fu.location FROM fileuploads AS fu LEFT JOIN filemsglinks AS fml ON fml.fileid=fu.id " +
+		"LEFT JOIN filepacklinks AS fpl ON fpl.fileid=fu.id WHERE fml.id IS NULL AND fpl.id IS NULL "
+	var args []interface{}
+	if !olderThan.IsZero() {
+		query += "AND fu.updatedat<? "
+		args = append(args, olderThan)
+	}
+	if limit > 0 {
+		query += "LIMIT ?"
+		args = append(args, limit)
+	}
+
+	rows, err := tx.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	var locations []string
+	var ids []interface{}
+	for rows.Next() {
+		var id int
+		var loc string
+		if err = rows.Scan(&id, &loc); err != nil {
+			break
+		}
+		locations = append(locations, loc)
+		ids = append(ids, id)
+	}
+	rows.Close()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(ids) > 0 {
+		query, ids, _ = sqlx.In("DELETE FROM fileuploads WHERE id IN (?)", ids)
+		_, err = tx.Exec(query, ids...)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return locations, tx.Commit()
+}
+
+// PackUpsert creates or replaces an emoji pack and links the pack's files to it.
+func (a *adapter) PackUpsert(pack *t.EmojiPack) error {
+	id := store.DecodeUid(pack.Uid())
+	if id == 0 {
+		return t.ErrMalformed
+	}
+
+	tx, err := a.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	_, err = tx.Exec("INSERT INTO emojipacks(id,createdat,updatedat,org,name,items) VALUES(?,?,?,?,?,?) "+
+		"ON DUPLICATE KEY UPDATE updatedat=VALUES(updatedat),org=VALUES(org),name=VALUES(name),items=VALUES(items)",
+		id, pack.CreatedAt, pack.UpdatedAt, pack.Org, pack.Name, pack.Items)
+	if err != nil {
+		return err
+	}
+
+	// Replace links to files.
+	if _, err = tx.Exec("DELETE FROM filepacklinks WHERE packid=?", id); err != nil {
+		return err
+	}
+	var args []interface{}
+	var values []string
+	for _, fid := range pack.Items.FileIds() {
+		values = append(values, "(?,?,?)")
+		args = append(args, pack.UpdatedAt, store.DecodeUid(t.ParseUid(fid)), id)
+	}
+	if len(values) > 0 {
+		_, err = tx.Exec("INSERT INTO filepacklinks(createdat,fileid,packid) VALUES "+strings.Join(values, ","), args...)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// PackGet returns packs with the given IDs.
+func (a *adapter) PackGet(ids ...string) ([]t.EmojiPack, error) {
+	var args []interface{}
+	for _, id := range ids {
+		if decoded := store.DecodeUid(t.ParseUid(id)); decoded != 0 {
+			args = append(args, decoded)
+		}
+	}
+	if len(args) == 0 {
+		return nil, nil
+	}
+
+	q, args, _ := sqlx.In("SELECT id,createdat,updatedat,org,name,items FROM emojipacks WHERE id IN (?)", args)
+	return a.packsQuery(a.db.Rebind(q), args...)
+}
+
+// PackGetForOrg returns packs which belong to any of the given organizations.
+func (a *adapter) PackGetForOrg(orgs ...string) ([]t.EmojiPack, error) {
+	if len(orgs) == 0 {
+		return nil, nil
+	}
+
+	q, args, _ := sqlx.In("SELECT id,createdat,updatedat,org,name,items FROM emojipacks WHERE org IN (?) ORDER BY createdat", orgs)
+	return a.packsQuery(a.db.Rebind(q), args...)
 }
 
-// CredDel deletes either credentials of the given user. If method is blank all
-// credentials are removed. If value is blank all credentials of the given the
-// method are removed.
-func (a *adapter) CredDel(uid t.Uid, method, value string) error {
-	tx, err := a.db.Beginx()
+func (a *adapter) packsQuery(query string, args ...interface{}) ([]t.EmojiPack, error) {
+	rows, err := a.db.Queryx(query, args...)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer func() {
-		if err != nil {
-			tx.Rollback()
-		}
-	}()
+	defer rows.Close()
 
-	err = credDel(tx, uid, method, value)
-	if err != nil {
-		return err
+	var packs []t.EmojiPack
+	for rows.Next() {
+		var pack t.EmojiPack
+		if err = rows.StructScan(&pack); err != nil {
+			return nil, err
+		}
+		pack.Id = encodeUidString(pack.Id).String()
+		packs = append(packs, pack)
 	}
 
-	return tx.Commit()
+	return packs, rows.Err()
 }
 
-// CredConfirm marks given credential method as confirmed.
-func (a *adapter) CredConfirm(uid t.Uid, method string) error {
-	res, err := a.db.Exec(
-		"UPDATE credentials SET updatedat=?,done=true,synthetic=CONCAT(method,':',value) "+
-			"WHERE userid=? AND method=? AND deletedat IS NULL AND done=false",
-		t.TimeNow(), store.DecodeUid(uid), method)
+// PackDelete deletes the pack. Links to pack's files are deleted by the foreign key constraint.
+func (a *adapter) PackDelete(id string) error {
+	decoded := store.DecodeUid(t.ParseUid(id))
+	if decoded == 0 {
+		return t.ErrMalformed
+	}
+
+	res, err := a.db.Exec("DELETE FROM emojipacks WHERE id=?", decoded)
 	if err != nil {
-		if isDupe(err) {
-			return t.ErrDuplicate
-		}
 		return err
 	}
-	if numrows, _ := res.RowsAffected(); numrows < 1 {
+	if count, _ := res.RowsAffected(); count == 0 {
 		return t.ErrNotFound
 	}
 	return nil
 }
 
-// CredFail increments failure count of the given validation method.
-func (a *adapter) CredFail(uid t.Uid, method string) error {
-	_, err := a.db.Exec("UPDATE credentials SET updatedat=?,retries=retries+1 WHERE userid=? AND method=? AND done=false",
-		t.TimeNow(), store.DecodeUid(uid), method)
+// DigestUpsert creates or replaces the digest of a channel reader.
+func (a *adapter) DigestUpsert(dg *t.Digest) error {
+	_, err := a.db.Exec("INSERT INTO digests(createdat,updatedat,userid,topic,period,msglimit,quietstart,quietend,"+
+		"tzoffset,seqid,nextat) VALUES(?,?,?,?,?,?,?,?,?,?,?) "+
+		"ON DUPLICATE KEY UPDATE updatedat=VALUES(updatedat),period=VALUES(period),msglimit=VALUES(msglimit),"+
+		"quietstart=VALUES(quietstart),quietend=VALUES(quietend),tzoffset=VALUES(tzoffset),seqid=VALUES(seqid),"+
+		"nextat=VALUES(nextat)",
+		dg.CreatedAt, dg.UpdatedAt, store.DecodeUid(t.ParseUid(dg.User)), dg.Topic, dg.Period, dg.Limit,
+		dg.QuietStart, dg.QuietEnd, dg.TzOffset, dg.SeqId, dg.NextAt)
 	return err
 }
 
-// CredGetActive returns currently active unvalidated credential of the given user and method.
-func (a *adapter) CredGetActive(uid t.Uid, method string) (*t.Credential, error) {
-	var cred t.Credential
-	err := a.db.Get(&cred, "SELECT createdat,updatedat,method,value,resp,done,retries "+
-		"FROM credentials WHERE userid=? AND deletedat IS NULL AND method=? AND done=false",
-		store.DecodeUid(uid), method)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			err = nil
-		}
+// DigestGet returns the digest of the channel reader or nil if there is none.
+func (a *adapter) DigestGet(topic string, user t.Uid) (*t.Digest, error) {
+	digests, err := a.digestsQuery("SELECT createdat,updatedat,userid,topic,period,msglimit,quietstart,quietend,"+
+		"tzoffset,seqid,nextat FROM digests WHERE topic=? AND userid=?", topic, store.DecodeUid(user))
+	if err != nil || len(digests) == 0 {
 		return nil, err
 	}
-	cred.User = uid.String()
-
-	return &cred, nil
+	return &digests[0], nil
 }
 
-// CredGetAll returns credential records for the given user and method, all or validated only.
-func (a *adapter) CredGetAll(uid t.Uid, method string, validatedOnly bool) ([]t.Credential, error) {
-	query := "SELECT createdat,updatedat,method,value,resp,done,retries FROM credentials WHERE userid=? AND deletedat IS NULL"
-	args := []interface{}{store.DecodeUid(uid)}
-	if method != "" {
-		query += " AND method=?"
-		args = append(args, method)
-	}
-	if validatedOnly {
-		query += " AND done=true"
-	}
+// DigestGetDue returns digests with NextAt before the given time, earliest first.
+func (a *adapter) DigestGetDue(before time.Time, limit int) ([]t.Digest, error) {
+	return a.digestsQuery("SELECT createdat,updatedat,userid,topic,period,msglimit,quietstart,quietend,"+
+		"tzoffset,seqid,nextat FROM digests WHERE nextat<? ORDER BY nextat LIMIT ?", before, limit)
+}
 
-	var credentials []t.Credential
-	err := a.db.Select(&credentials, query, args...)
+func (a *adapter) digestsQuery(query string, args ...interface{}) ([]t.Digest, error) {
+	rows, err := a.db.Query(query, args...)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 
-	user := uid.String()
-	for i := range credentials {
-		credentials[i].User = user
+	var digests []t.Digest
+	for rows.Next() {
+		var dg t.Digest
+		var userId int64
+		if err = rows.Scan(&dg.CreatedAt, &dg.UpdatedAt, &userId, &dg.Topic, &dg.Period, &dg.Limit,
+			&dg.QuietStart, &dg.QuietEnd, &dg.TzOffset, &dg.SeqId, &dg.NextAt); err != nil {
+			return nil, err
+		}
+		dg.User = store.EncodeUid(userId).String()
+		dg.Id = dg.Topic + ":" + dg.User
+		digests = append(digests, dg)
 	}
 
-	return credentials, err
+	return digests, rows.Err()
 }
 
-// FileUploads
+// DigestDelete deletes the digest of the channel reader.
+func (a *adapter) DigestDelete(topic string, user t.Uid) error {
+	_, err := a.db.Exec("DELETE FROM digests WHERE topic=? AND userid=?", topic, store.DecodeUid(user))
+	return err
+}
 
-// FileStartUpload initializes a file upload
-func (a *adapter) FileStartUpload(fd *t.FileDef) error {
-	_, err := a.db.Exec("INSERT INTO fileuploads(id,createdat,updatedat,userid,status,mimetype,size,location)"+
-		" VALUES(?,?,?,?,?,?,?,?)",
-		store.DecodeUid(fd.Uid()), fd.CreatedAt, fd.UpdatedAt,
-		store.DecodeUid(t.ParseUid(fd.User)), fd.Status, fd.MimeType, fd.Size, fd.Location)
+// CalEventUpsert creates or replaces the event.
+func (a *adapter) CalEventUpsert(ev *t.CalEvent) error {
+	var rsvp []byte
+	if len(ev.Rsvp) > 0 {
+		rsvp = toJSON(ev.Rsvp)
+	}
+	_, err := a.db.Exec("INSERT INTO calevents(createdat,updatedat,topic,seqid,title,location,startat,endat,remindat,rsvp) "+
+		"VALUES(?,?,?,?,?,?,?,?,?,?) "+
+		"ON DUPLICATE KEY UPDATE updatedat=VALUES(updatedat),title=VALUES(title),location=VALUES(location),"+
+		"startat=VALUES(startat),endat=VALUES(endat),remindat=VALUES(remindat),rsvp=VALUES(rsvp)",
+		ev.CreatedAt, ev.UpdatedAt, ev.Topic, ev.SeqId, ev.Title, ev.Location, ev.StartAt, ev.EndAt, ev.RemindAt, rsvp)
 	return err
 }
 
-// FileFinishUpload marks file upload as completed, successfully or otherwise
-func (a *adapter) FileFinishUpload(fid string, status int, size int64) (*t.FileDef, error) {
-	id := t.ParseUid(fid)
-	if id.IsZero() {
-		return nil, t.ErrMalformed
+// CalEventGet returns the event announced by the message or nil if there is none.
+func (a *adapter) CalEventGet(topic string, seqId int) (*t.CalEvent, error) {
+	events, err := a.calEventsQuery("SELECT createdat,updatedat,topic,seqid,title,location,startat,endat,remindat,rsvp "+
+		"FROM calevents WHERE topic=? AND seqid=?", topic, seqId)
+	if err != nil || len(events) == 0 {
+		return nil, err
 	}
+	return &events[0], nil
+}
 
-	fd, err := a.FileGet(fid)
+// CalEventGetAll returns events of the topic starting at or after the given time, earliest first.
+func (a *adapter) CalEventGetAll(topic string, since time.Time, limit int) ([]t.CalEvent, error) {
+	return a.calEventsQuery("SELECT createdat,updatedat,topic,seqid,title,location,startat,endat,remindat,rsvp "+
+		"FROM calevents WHERE topic=? AND startat>=? ORDER BY startat LIMIT ?", topic, since, limit)
+}
+
+// CalEventGetDue returns events with RemindAt before the given time, earliest first.
+func (a *adapter) CalEventGetDue(before time.Time, limit int) ([]t.CalEvent, error) {
+	return a.calEventsQuery("SELECT createdat,updatedat,topic,seqid,title,location,startat,endat,remindat,rsvp "+
+		"FROM calevents WHERE remindat<? ORDER BY remindat LIMIT ?", before, limit)
+}
+
+func (a *adapter) calEventsQuery(query string, args ...interface{}) ([]t.CalEvent, error) {
+	rows, err := a.db.Query(query, args...)
 	if err != nil {
 		return nil, err
 	}
-	if fd == nil {
-		return nil, t.ErrNotFound
+	defer rows.Close()
+
+	var events []t.CalEvent
+	for rows.Next() {
+		var ev t.CalEvent
+		var rsvp []byte
+		if err = rows.Scan(&ev.CreatedAt, &ev.UpdatedAt, &ev.Topic, &ev.SeqId, &ev.Title, &ev.Location,
+			&ev.StartAt, &ev.EndAt, &ev.RemindAt, &rsvp); err != nil {
+			return nil, err
+		}
+		if len(rsvp) > 0 {
+			if err = json.Unmarshal(rsvp, &ev.Rsvp); err != nil {
+				return nil, err
+			}
+		}
+		ev.Id = ev.Topic + ":" + strconv.Itoa(ev.SeqId)
+		events = append(events, ev)
 	}
 
-	fd.UpdatedAt = t.TimeNow()
-	_, err = a.db.Exec("UPDATE fileuploads SET updatedat=?,status=?,size=? WHERE id=?",
-		fd.UpdatedAt, status, size, store.DecodeUid(id))
-	if err == nil {
-		fd.Status = status
-		fd.Size = size
+	return events, rows.Err()
+}
+
+// CalEventRsvp records the response of the user to the event, an empty response removes it.
+func (a *adapter) CalEventRsvp(topic string, seqId int, user t.Uid, resp string) error {
+	path := `$."` + user.String() + `"`
+	var err error
+	if resp == "" {
+		_, err = a.db.Exec("UPDATE calevents SET updatedat=?,rsvp=JSON_REMOVE(rsvp,?) "+
+			"WHERE topic=? AND seqid=? AND JSON_CONTAINS_PATH(rsvp,'one',?)",
+			t.TimeNow(), path, topic, seqId, path)
 	} else {
-		fd = nil
+		_, err = a.db.Exec("UPDATE calevents SET updatedat=?,rsvp=JSON_SET(COALESCE(rsvp,JSON_OBJECT()),?,?) "+
+			"WHERE topic=? AND seqid=?", t.TimeNow(), path, resp, topic, seqId)
 	}
-	return fd, err
+	return err
 }
 
-// FileGet fetches a record of a specific file
-func (a *adapter) FileGet(fid string) (*t.FileDef, error) {
-	id := t.ParseUid(fid)
-	if id.IsZero() {
-		return nil, t.ErrMalformed
+// CalEventReminded marks the reminder of the event as sent.
+func (a *adapter) CalEventReminded(topic string, seqId int) error {
+	_, err := a.db.Exec("UPDATE calevents SET updatedat=?,remindat=NULL WHERE topic=? AND seqid=?",
+		t.TimeNow(), topic, seqId)
+	return err
+}
+
+// PollCreate saves a new poll.
+func (a *adapter) PollCreate(poll *t.Poll) error {
+	_, err := a.db.Exec("INSERT INTO polls(createdat,updatedat,topic,seqid,question,options,multi) VALUES(?,?,?,?,?,?,?)",
+		poll.CreatedAt, poll.UpdatedAt, poll.Topic, poll.SeqId, poll.Question, toJSON(poll.Options), poll.Multi)
+	return err
+}
+
+// PollGet returns the poll created by the message or nil if there is none.
+func (a *adapter) PollGet(topic string, seqId int) (*t.Poll, error) {
+	var poll t.Poll
+	var options, votes []byte
+	err := a.db.QueryRow("SELECT createdat,updatedat,topic,seqid,question,options,multi,votes "+
+		"FROM polls WHERE topic=? AND seqid=?", topic, seqId).Scan(&poll.CreatedAt, &poll.UpdatedAt,
+		&poll.Topic, &poll.SeqId, &poll.Question, &options, &poll.Multi, &votes)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if err = json.Unmarshal(options, &poll.Options); err != nil {
+		return nil, err
+	}
+	if len(votes) > 0 {
+		if err = json.Unmarshal(votes, &poll.Votes); err != nil {
+			return nil, err
+		}
 	}
+	return &poll, nil
+}
 
-	var fd t.FileDef
-	err := a.db.Get(&fd, "SELECT id,createdat,updatedat,userid AS user,status,mimetype,size,location "+
-		"FROM fileuploads WHERE id=?", store.DecodeUid(id))
-	if err == sql.ErrNoRows {
-		return nil, nil
+// PollVote records the vote of the user replacing the previous one, an empty vote removes it.
+func (a *adapter) PollVote(topic string, seqId int, user t.Uid, options []int) error {
+	path := `$."` + user.String() + `"`
+	var err error
+	if len(options) == 0 {
+		_, err = a.db.Exec("UPDATE polls SET updatedat=?,votes=JSON_REMOVE(votes,?) "+
+			"WHERE topic=? AND seqid=? AND JSON_CONTAINS_PATH(votes,'one',?)",
+			t.TimeNow(), path, topic, seqId, path)
+	} else {
+		_, err = a.db.Exec("UPDATE polls SET updatedat=?,votes=JSON_SET(COALESCE(votes,JSON_OBJECT()),?,CAST(? AS JSON)) "+
+			"WHERE topic=? AND seqid=?", t.TimeNow(), path, string(toJSON(options)), topic, seqId)
 	}
+	return err
+}
+
+// ReceiptCreate records that the user has read a range of messages.
+func (a *adapter) ReceiptCreate(rcpt *t.Receipt) error {
+	_, err := a.db.Exec("INSERT INTO receipts(topic,userid,seqfrom,seqto,readat) VALUES(?,?,?,?,?)",
+		rcpt.Topic, store.DecodeUid(t.ParseUid(rcpt.User)), rcpt.SeqFrom, rcpt.SeqTo, rcpt.ReadAt)
+	return err
+}
+
+// ReceiptsForMessage returns receipts of all users who have read the message, earliest first.
+func (a *adapter) ReceiptsForMessage(topic string, seqId int) ([]t.Receipt, error) {
+	rows, err := a.db.Queryx("SELECT topic,userid AS user,seqfrom,seqto,readat FROM receipts "+
+		"WHERE topic=? AND seqto>=? AND seqfrom<=? ORDER BY readat", topic, seqId, seqId)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 
-	fd.Id = encodeUidString(fd.Id).String()
-	fd.User = encodeUidString(fd.User).String()
-
-	return &fd, nil
+	var receipts []t.Receipt
+	for rows.Next() {
+		var rcpt t.Receipt
+		if err = rows.StructScan(&rcpt); err != nil {
+			return nil, err
+		}
+		rcpt.User = encodeUidString(rcpt.User).String()
+		receipts = append(receipts, rcpt)
+	}
+	return receipts, rows.Err()
+}
 
+// MentionsCreate records mentions of users and replies in threads started by users.
+func (a *adapter) MentionsCreate(mentions []t.Mention) error {
+	if len(mentions) == 0 {
+		return nil
+	}
+	var args []interface{}
+	for i := range mentions {
+		args = append(args, mentions[i].CreatedAt, mentions[i].Topic, decodeUidString(mentions[i].User),
+			mentions[i].SeqId, mentions[i].Thread)
+	}
+	_, err := a.db.Exec("INSERT INTO mentions(createdat,topic,userid,seqid,thread) VALUES (?,?,?,?,?)"+
+		strings.Repeat(",(?,?,?,?,?)", len(mentions)-1), args...)
+	return err
 }
 
-// FileDeleteUnused deletes file upload records.
-func (a *adapter) FileDeleteUnused(olderThan time.Time, limit int) ([]string, error) {
-	tx, err := a.db.Begin()
+// MentionsDelete removes mentions and thread replies of the user in the topic up to and including
+// seqId, all of them if seqId is 0. Returns the number of removed mentions, thread replies are not counted.
+func (a *adapter) MentionsDelete(topic string, user t.Uid, seqId int) (int, error) {
+	sql := "DELETE FROM mentions WHERE userid=? AND topic=?"
+	args := []interface{}{store.DecodeUid(user), topic}
+	if seqId > 0 {
+		sql += " AND seqid<=?"
+		args = append(args, seqId)
+	}
+
+	tx, err := a.db.Beginx()
 	if err != nil {
-		return nil, err
+		return 0, err
 	}
 	defer func() {
 		if err != nil {
@@ -2711,48 +4308,164 @@ func (a *adapter) FileDeleteUnused(olderThan time.Time, limit int) ([]string, er
 		}
 	}()
 
-	query := "SELECT fu.id,fu.location FROM fileuploads AS fu LEFT JOIN filemsglinks AS fml ON fml.fileid=fu.id WHERE fml.id IS NULL "
-	var args []interface{}
-	if !olderThan.IsZero() {
-		query += "AND fu.updatedat<? "
-		args = append(args, olderThan)
+	res, err := tx.Exec(sql+" AND thread=0", args...)
+	if err != nil {
+		return 0, err
 	}
-	if limit > 0 {
-		query += "LIMIT ?"
-		args = append(args, limit)
+	count, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	if _, err = tx.Exec(sql, args...); err != nil {
+		return 0, err
 	}
+	return int(count), tx.Commit()
+}
 
-	rows, err := tx.Query(query, args...)
+// MentionsCount returns the number of unread mentions of the user across all topics.
+func (a *adapter) MentionsCount(user t.Uid) (int, error) {
+	var count int
+	err := a.db.Get(&count, "SELECT COUNT(*) FROM mentions WHERE userid=? AND thread=0", store.DecodeUid(user))
+	return count, err
+}
+
+// MentionsGetAll returns unread mentions and thread replies of the user across all topics, newest first.
+func (a *adapter) MentionsGetAll(user t.Uid, limit int) ([]t.Mention, error) {
+	rows, err := a.db.Queryx("SELECT createdat,topic,userid AS user,seqid,thread FROM mentions "+
+		"WHERE userid=? ORDER BY createdat DESC, id DESC LIMIT ?", store.DecodeUid(user), limit)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 
-	var locations []string
-	var ids []interface{}
+	var mentions []t.Mention
 	for rows.Next() {
-		var id int
-		var loc string
-		if err = rows.Scan(&id, &loc); err != nil {
-			break
+		var m t.Mention
+		if err = rows.StructScan(&m); err != nil {
+			return nil, err
 		}
-		locations = append(locations, loc)
-		ids = append(ids, id)
+		m.User = encodeUidString(m.User).String()
+		mentions = append(mentions, m)
 	}
-	rows.Close()
+	return mentions, rows.Err()
+}
+
+// BookmarkCreate saves the bookmark, does nothing if the message is already starred by the user.
+func (a *adapter) BookmarkCreate(bm *t.Bookmark) error {
+	_, err := a.db.Exec("INSERT IGNORE INTO bookmarks(createdat,userid,topic,seqid) VALUES(?,?,?,?)",
+		bm.CreatedAt, decodeUidString(bm.User), bm.Topic, bm.SeqId)
+	return err
+}
 
+// BookmarkDelete removes the bookmark of the message.
+func (a *adapter) BookmarkDelete(user t.Uid, topic string, seqId int) error {
+	_, err := a.db.Exec("DELETE FROM bookmarks WHERE userid=? AND topic=? AND seqid=?",
+		store.DecodeUid(user), topic, seqId)
+	return err
+}
+
+// BookmarkGetAll returns bookmarks of the user, newest first.
+func (a *adapter) BookmarkGetAll(user t.Uid, limit int) ([]t.Bookmark, error) {
+	rows, err := a.db.Queryx("SELECT createdat,userid AS user,topic,seqid FROM bookmarks "+
+		"WHERE userid=? ORDER BY createdat DESC LIMIT ?", store.DecodeUid(user), limit)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 
-	if len(ids) > 0 {
-		query, ids, _ = sqlx.In("DELETE FROM fileuploads WHERE id IN (?)", ids)
-		_, err = tx.Exec(query, ids...)
-		if err != nil {
+	var bookmarks []t.Bookmark
+	for rows.Next() {
+		var bm t.Bookmark
+		if err = rows.StructScan(&bm); err != nil {
 			return nil, err
 		}
+		bm.User = encodeUidString(bm.User).String()
+		bookmarks = append(bookmarks, bm)
 	}
+	return bookmarks, rows.Err()
+}
 
-	return locations, tx.Commit()
+// ViewOnceCreate marks files attached to a message as view-once.
+func (a *adapter) ViewOnceCreate(vos []t.ViewOnce) error {
+	if len(vos) == 0 {
+		return nil
+	}
+	var args []interface{}
+	for i := range vos {
+		args = append(args, decodeUidString(vos[i].Id), vos[i].CreatedAt, vos[i].Topic, vos[i].SeqId,
+			decodeUidString(vos[i].From))
+	}
+	_, err := a.db.Exec("INSERT IGNORE INTO viewonce(fileid,createdat,topic,seqid,sender) VALUES (?,?,?,?,?)"+
+		strings.Repeat(",(?,?,?,?,?)", len(vos)-1), args...)
+	return err
+}
+
+// ViewOnceGet returns the view-once mark of the file, nil if the file is not view-once.
+func (a *adapter) ViewOnceGet(fid string) (*t.ViewOnce, error) {
+	var vo t.ViewOnce
+	err := a.db.Get(&vo, "SELECT fileid AS id,createdat,topic,seqid,sender AS `from` FROM viewonce WHERE fileid=?",
+		decodeUidString(fid))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	vo.Id = encodeUidString(vo.Id).String()
+	vo.From = encodeUidString(vo.From).String()
+	return &vo, nil
+}
+
+// ViewOnceView records that the user has retrieved the file. Returns false if the user
+// has retrieved it before.
+func (a *adapter) ViewOnceView(view *t.ViewOnceView) (bool, error) {
+	res, err := a.db.Exec("INSERT IGNORE INTO viewoncelog(createdat,fileid,userid,topic) VALUES(?,?,?,?)",
+		view.CreatedAt, decodeUidString(view.FileId), decodeUidString(view.User), view.Topic)
+	if err != nil {
+		return false, err
+	}
+	count, err := res.RowsAffected()
+	return count > 0, err
+}
+
+// AccountEventCreate saves a security-related event of the user's account.
+func (a *adapter) AccountEventCreate(ev *t.AccountEvent) error {
+	_, err := a.db.Exec("INSERT INTO accountevents(id,createdat,userid,what,detail,newdevice,useragent,remoteaddr,deviceid) "+
+		"VALUES(?,?,?,?,?,?,?,?,?)", decodeUidString(ev.Id), ev.CreatedAt, decodeUidString(ev.User), ev.What,
+		ev.Detail, ev.NewDevice, ev.UserAgent, ev.RemoteAddr, ev.DeviceId)
+	return err
+}
+
+// AccountEventGetAll returns events of the user, newest first.
+func (a *adapter) AccountEventGetAll(user t.Uid, limit int) ([]t.AccountEvent, error) {
+	rows, err := a.db.Queryx("SELECT id,createdat,userid AS user,what,detail,newdevice,useragent,remoteaddr,deviceid "+
+		"FROM accountevents WHERE userid=? ORDER BY createdat DESC LIMIT ?", store.DecodeUid(user), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []t.AccountEvent
+	for rows.Next() {
+		var ev t.AccountEvent
+		if err = rows.StructScan(&ev); err != nil {
+			return nil, err
+		}
+		ev.Id = encodeUidString(ev.Id).String()
+		ev.User = encodeUidString(ev.User).String()
+		events = append(events, ev)
+	}
+	return events, rows.Err()
+}
+
+// AccountEventDeleteOlder deletes events of all users created before the given time.
+func (a *adapter) AccountEventDeleteOlder(before time.Time) (int, error) {
+	res, err := a.db.Exec("DELETE FROM accountevents WHERE createdat<?", before)
+	if err != nil {
+		return 0, err
+	}
+	count, err := res.RowsAffected()
+	return int(count), err
 }
 
 // Helper functions
@@ -2823,7 +4536,7 @@ func decodeUidString(str string) int64 {
 func updateByMap(update map[string]interface{}) (cols []string, args []interface{}) {
 	for col, arg := range update {
 		col = strings.ToLower(col)
-		if col == "public" || col == "private" {
+		if col == "public" || col == "trusted" || col == "private" {
 			arg = toJSON(arg)
 		}
 		cols = append(cols, col+"=?")
@@ -23,7 +23,15 @@ CREATE TABLE users(
 	lastseen 	DATETIME,
 	useragent 	VARCHAR(255) DEFAULT '',
 	public 		JSON,
+	trusted		JSON, -- Values assigned by the server or root
 	tags		JSON, -- Denormalized array of tags
+	blocked		JSON, -- Users blocked by this user
+	aliases		JSON, -- Logins previously used by this user
+	autoreply	JSON, -- Message sent in response to P2P messages
+	autotranslate	VARCHAR(16) NOT NULL DEFAULT '', -- Language to translate incoming messages to
+	chatlist	JSON, -- Pinned topics and folders of the chat list
+	consent		JSON, -- Choices on sharing user's data
+	birthdate	VARCHAR(10) NOT NULL DEFAULT '', -- Date of birth, YYYY-MM-DD
 	
 	PRIMARY KEY(id),
 	INDEX users_state_stateat(state, stateat)
@@ -50,6 +58,8 @@ CREATE TABLE devices(
 	platform	VARCHAR(32),
 	lastseen 	DATETIME NOT NULL,
 	lang 		VARCHAR(8),
+	lastpushat	DATETIME,
+	pushfailures	INT NOT NULL DEFAULT 0,
 	
 	PRIMARY KEY(id),
 	FOREIGN KEY(userid) REFERENCES users(id),
@@ -89,11 +99,25 @@ CREATE TABLE topics(
 	delid		INT DEFAULT 0,
 	public		JSON,
 	tags		JSON, -- Denormalized array of tags
+	packs		JSON, -- IDs of enabled emoji packs
+	webhook		JSON, -- Membership webhook
+	stats		JSON, -- Daily engagement counters
+	guests		JSON, -- Guest access to the channel
+	owners		JSON, -- IDs of co-owners
+	receipts	TINYINT DEFAULT 0, -- Per-message read receipts are recorded
+	limits		JSON, -- Limits on the content of messages
+	announce	TINYINT DEFAULT 0, -- Only administrators may publish
+	capacity	JSON, -- Limit of concurrent channel readers
+	parent		CHAR(25) NOT NULL DEFAULT '', -- Parent topic of the space
+	maxsubs		INT NOT NULL DEFAULT 0, -- Maximum number of subscribers, 0 for the global limit
+	freeze		JSON, -- Posting is suspended
+	expiry		JSON, -- Default time to live of messages
 	
 	PRIMARY KEY(id),
 	UNIQUE INDEX topics_name (name),
 	INDEX topics_owner(owner),
-	INDEX topics_state_stateat(state, stateat)
+	INDEX topics_state_stateat(state, stateat),
+	INDEX topics_parent(parent)
 );
 
 # Indexed topic tags.
@@ -119,6 +143,16 @@ CREATE TABLE subscriptions(
 	delid		INT DEFAULT 0,
 	recvseqid	INT DEFAULT 0,
 	readseqid	INT DEFAULT 0,
+	dlvseqid	INT DEFAULT 0, -- Last message delivered to at least one device
+	cursors		JSON, -- Per-device positions in the message stream
+	draft		JSON, -- Unsent message saved by the user
+	muteuntil	DATETIME(3), -- Notifications are muted until this time
+	quiet		JSON, -- Daily quiet hours of notifications
+	notify		VARCHAR(16) NOT NULL DEFAULT '', -- Notification level: all, mentions, none
+	anchorseq	INT DEFAULT 0, -- Position in the message stream saved by the user
+	role		VARCHAR(16) NOT NULL DEFAULT '', -- Role label of the subscriber, e.g. moderator
+	request		JSON, -- Pending request to join the topic
+	ban		JSON, -- Reason and expiration of the ban
 	modewant	CHAR(8),
 	modegiven	CHAR(8),
 	private		JSON,
@@ -142,10 +176,20 @@ CREATE TABLE messages(
 	`from` 		BIGINT NOT NULL,
 	head 		JSON,
 	content 	JSON,
+	plaintext	TEXT GENERATED ALWAYS AS (IF(JSON_TYPE(content)='STRING',content->>'$',content->>'$.txt')) STORED, -- Text of the message for full-text search
+	thread		INT NOT NULL DEFAULT 0, -- SeqId of the first message of the thread
+	replies		INT NOT NULL DEFAULT 0, -- Number of replies in the thread started by this message
+	lastreplyat	DATETIME(3), -- Time of the latest reply in the thread
+	mediatype	VARCHAR(16) NOT NULL DEFAULT '', -- Type of media of the message, e.g. 'audio'
+	mime		VARCHAR(255) NOT NULL DEFAULT '', -- MIME type of the first attachment, e.g. 'image/jpeg'
 	
 	PRIMARY KEY(id),
 	FOREIGN KEY(topic) REFERENCES topics(name),
-	UNIQUE INDEX messages_topic_seqid (topic, seqid)
+	UNIQUE INDEX messages_topic_seqid (topic, seqid),
+	INDEX messages_topic_thread_seqid (topic, thread, seqid),
+	INDEX messages_topic_mediatype_seqid (topic, mediatype, seqid),
+	INDEX messages_topic_mime_seqid (topic, mime, seqid),
+	FULLTEXT INDEX messages_plaintext (plaintext)
 );
 
 # Deletion log
@@ -210,4 +254,171 @@ CREATE TABLE filemsglinks(
 	PRIMARY KEY(id),
 	FOREIGN KEY(fileid) REFERENCES fileuploads(id) ON DELETE CASCADE,
 	FOREIGN KEY(msgid) REFERENCES messages(id) ON DELETE CASCADE
-);
\ No newline at end of file
+);
+
+# Custom emoji packs.
+CREATE TABLE emojipacks(
+	id			BIGINT NOT NULL,
+	createdat	DATETIME(3) NOT NULL,
+	updatedat	DATETIME(3) NOT NULL,
+	org			VARCHAR(64) NOT NULL DEFAULT '',
+	name		VARCHAR(255) NOT NULL,
+	items		JSON,
+	
+	PRIMARY KEY(id),
+	INDEX emojipacks_org(org)
+);
+
+# Links between uploaded files and the emoji packs they are used in.
+CREATE TABLE filepacklinks(
+	id			INT NOT NULL AUTO_INCREMENT,
+	createdat	DATETIME(3) NOT NULL,
+	fileid		BIGINT NOT NULL,
+	packid		BIGINT NOT NULL,
+	
+	PRIMARY KEY(id),
+	FOREIGN KEY(fileid) REFERENCES fileuploads(id) ON DELETE CASCADE,
+	FOREIGN KEY(packid) REFERENCES emojipacks(id) ON DELETE CASCADE
+);
+
+# Periodic digests of new messages in channels.
+CREATE TABLE digests(
+	id			INT NOT NULL AUTO_INCREMENT,
+	createdat	DATETIME(3) NOT NULL,
+	updatedat	DATETIME(3) NOT NULL,
+	userid		BIGINT NOT NULL,
+	topic		CHAR(25) NOT NULL,
+	period		INT NOT NULL,
+	msglimit	INT NOT NULL,
+	quietstart	INT NOT NULL DEFAULT 0,
+	quietend	INT NOT NULL DEFAULT 0,
+	tzoffset	INT NOT NULL DEFAULT 0,
+	seqid		INT NOT NULL DEFAULT 0,
+	nextat		DATETIME(3) NOT NULL,
+	
+	PRIMARY KEY(id),
+	UNIQUE INDEX digests_topic_userid(topic, userid),
+	INDEX digests_nextat(nextat)
+);
+
+# Events announced in topics.
+CREATE TABLE calevents(
+	id			INT NOT NULL AUTO_INCREMENT,
+	createdat	DATETIME(3) NOT NULL,
+	updatedat	DATETIME(3) NOT NULL,
+	topic		CHAR(25) NOT NULL,
+	seqid		INT NOT NULL, -- SeqId of the message which announced the event
+	title		VARCHAR(256) NOT NULL,
+	location	VARCHAR(256) NOT NULL DEFAULT '',
+	startat		DATETIME(3) NOT NULL,
+	endat		DATETIME(3),
+	remindat	DATETIME(3), -- Time when the reminder is due, NULL if sent or not needed
+	rsvp		JSON, -- Responses of members: user ID -> yes, no, maybe
+	
+	PRIMARY KEY(id),
+	UNIQUE INDEX calevents_topic_seqid(topic, seqid),
+	INDEX calevents_topic_startat(topic, startat),
+	INDEX calevents_remindat(remindat)
+);
+
+# Per-message read receipts.
+CREATE TABLE receipts(
+	id			INT NOT NULL AUTO_INCREMENT,
+	topic		CHAR(25) NOT NULL,
+	userid		BIGINT NOT NULL,
+	seqfrom		INT NOT NULL, -- The user has read messages from seqfrom to seqto inclusive
+	seqto		INT NOT NULL,
+	readat		DATETIME(3) NOT NULL,
+	
+	PRIMARY KEY(id),
+	INDEX receipts_topic_seqto(topic, seqto)
+);
+
+# Unread mentions.
+CREATE TABLE mentions(
+	id			INT NOT NULL AUTO_INCREMENT,
+	createdat	DATETIME(3) NOT NULL,
+	topic		CHAR(25) NOT NULL,
+	userid		BIGINT NOT NULL,
+	seqid		INT NOT NULL, -- The user was mentioned in this message and has not read it yet
+	thread		INT NOT NULL DEFAULT 0, -- The message is a reply in the thread started by the user
+	
+	PRIMARY KEY(id),
+	INDEX mentions_userid_topic_seqid(userid, topic, seqid),
+	INDEX mentions_topic(topic)
+);
+
+# Polls.
+CREATE TABLE polls(
+	id			INT NOT NULL AUTO_INCREMENT,
+	createdat	DATETIME(3) NOT NULL,
+	updatedat	DATETIME(3) NOT NULL,
+	topic		CHAR(25) NOT NULL,
+	seqid		INT NOT NULL, -- The message which created the poll
+	question	VARCHAR(256) NOT NULL,
+	options		JSON NOT NULL,
+	multi		TINYINT NOT NULL DEFAULT 0, -- Members may vote for more than one option
+	votes		JSON, -- User ID -> indexes of the chosen options
+	
+	PRIMARY KEY(id),
+	UNIQUE INDEX polls_topic_seqid(topic, seqid)
+);
+
+# Starred messages.
+CREATE TABLE bookmarks(
+	id			INT NOT NULL AUTO_INCREMENT,
+	createdat	DATETIME(3) NOT NULL,
+	userid		BIGINT NOT NULL,
+	topic		CHAR(25) NOT NULL,
+	seqid		INT NOT NULL, -- The message starred by the user
+	
+	PRIMARY KEY(id),
+	UNIQUE INDEX bookmarks_userid_topic_seqid(userid, topic, seqid),
+	INDEX bookmarks_userid_createdat(userid, createdat),
+	INDEX bookmarks_topic(topic)
+);
+
+# Files attached to view-once messages.
+CREATE TABLE viewonce(
+	fileid		BIGINT NOT NULL,
+	createdat	DATETIME(3) NOT NULL,
+	topic		CHAR(25) NOT NULL,
+	seqid		INT NOT NULL,
+	sender		BIGINT NOT NULL, -- The sender may retrieve the file any number of times
+	
+	PRIMARY KEY(fileid),
+	FOREIGN KEY(fileid) REFERENCES fileuploads(id) ON DELETE CASCADE,
+	INDEX viewonce_topic(topic)
+);
+
+# Retrievals of view-once files, one per user.
+CREATE TABLE viewoncelog(
+	id			INT NOT NULL AUTO_INCREMENT,
+	createdat	DATETIME(3) NOT NULL,
+	fileid		BIGINT NOT NULL,
+	userid		BIGINT NOT NULL,
+	topic		CHAR(25) NOT NULL,
+	
+	PRIMARY KEY(id),
+	FOREIGN KEY(fileid) REFERENCES fileuploads(id) ON DELETE CASCADE,
+	UNIQUE INDEX viewoncelog_fileid_userid(fileid, userid),
+	INDEX viewoncelog_userid(userid),
+	INDEX viewoncelog_topic(topic)
+);
+
+# Account activity timeline: logins, changes of credentials, exports.
+CREATE TABLE accountevents(
+	id			BIGINT NOT NULL,
+	createdat	DATETIME(3) NOT NULL,
+	userid		BIGINT NOT NULL,
+	what		VARCHAR(16) NOT NULL,
+	detail		VARCHAR(255) NOT NULL DEFAULT '',
+	newdevice	TINYINT NOT NULL DEFAULT 0,
+	useragent	VARCHAR(255) NOT NULL DEFAULT '',
+	remoteaddr	VARCHAR(64) NOT NULL DEFAULT '',
+	deviceid	VARCHAR(255) NOT NULL DEFAULT '',
+	
+	PRIMARY KEY(id),
+	INDEX accountevents_userid_createdat(userid, createdat),
+	INDEX accountevents_createdat(createdat)
+);
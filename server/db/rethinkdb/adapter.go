@@ -7,6 +7,7 @@ import (
 	"encoding/json"
 	"errors"
 	"hash/fnv"
+	"regexp"
 	"sort"
 	"strconv"
 	"strings"
@@ -33,7 +34,7 @@ const (
 	defaultHost     = "localhost:28015"
 	defaultDatabase = "tinode"
 
-	adpVersion = 111
+	adpVersion = 155
 
 	adapterName = "rethinkdb"
 
@@ -306,6 +307,10 @@ func (a *adapter) CreateDb(reset bool) error {
 	if _, err := rdb.DB(a.dbName).Table("topics").IndexCreate("Tags", rdb.IndexCreateOpts{Multi: true}).RunWrite(a.conn); err != nil {
 		return err
 	}
+	// Secondary index on Parent for listing child topics of a space.
+	if err := createTopicParentIndex(a); err != nil {
+		return err
+	}
 	// Create system topic 'sys'.
 	if err := createSystemTopic(a); err != nil {
 		return err
@@ -322,6 +327,12 @@ func (a *adapter) CreateDb(reset bool) error {
 		}).RunWrite(a.conn); err != nil {
 		return err
 	}
+	if err := createThreadIndex(a); err != nil {
+		return err
+	}
+	if err := createMediaTypeIndex(a); err != nil {
+		return err
+	}
 	// Compound index of hard-deleted messages
 	if _, err := rdb.DB(a.dbName).Table("messages").IndexCreateFunc("Topic_DelId",
 		func(row rdb.Term) interface{} {
@@ -374,6 +385,51 @@ func (a *adapter) CreateDb(reset bool) error {
 		return err
 	}
 
+	// Custom emoji packs. See types.EmojiPack.
+	if err := createEmojiTable(a); err != nil {
+		return err
+	}
+
+	// Channel digests. See types.Digest.
+	if err := createDigestTable(a); err != nil {
+		return err
+	}
+
+	// Events announced in topics. See types.CalEvent.
+	if err := createCalEventTable(a); err != nil {
+		return err
+	}
+
+	// Per-message read receipts. See types.Receipt.
+	if err := createReceiptTable(a); err != nil {
+		return err
+	}
+
+	// Unread mentions. See types.Mention.
+	if err := createMentionTable(a); err != nil {
+		return err
+	}
+
+	// Polls. See types.Poll.
+	if err := createPollTable(a); err != nil {
+		return err
+	}
+
+	// Starred messages. See types.Bookmark.
+	if err := createBookmarkTable(a); err != nil {
+		return err
+	}
+
+	// View-once attachments. See types.ViewOnce and types.ViewOnceView.
+	if err := createViewOnceTables(a); err != nil {
+		return err
+	}
+
+	// Account activity timeline. See types.AccountEvent.
+	if err := createAccountEventTable(a); err != nil {
+		return err
+	}
+
 	// Record current DB version.
 	if _, err := rdb.DB(a.dbName).Table("kvmeta").Insert(
 		map[string]interface{}{"key": "version", "value": adpVersion}).RunWrite(a.conn); err != nil {
@@ -515,6 +571,398 @@ func (a *adapter) UpgradeDb() error {
 		}
 	}
 
+	if a.version == 111 {
+		// Perform database upgrade from version 111 to version 112.
+		// Users.Blocked is added on first write, nothing to do.
+		if err := bumpVersion(a, 112); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 112 {
+		// Perform database upgrade from version 112 to version 113.
+		// Users.Aliases is added on first write, nothing to do.
+		if err := bumpVersion(a, 113); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 113 {
+		// Perform database upgrade from version 113 to version 114.
+		// Subscriptions.Cursors is added on first write, nothing to do.
+		if err := bumpVersion(a, 114); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 114 {
+		// Perform database upgrade from version 114 to version 115.
+		// Subscriptions.Draft is added on first write, nothing to do.
+		if err := bumpVersion(a, 115); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 115 {
+		// Perform database upgrade from version 115 to version 116.
+		// Users.Trusted is added on first write, nothing to do.
+		if err := bumpVersion(a, 116); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 116 {
+		// Perform database upgrade from version 116 to version 117.
+		// Topics.Packs is added on first write.
+		if err := createEmojiTable(a); err != nil {
+			return err
+		}
+
+		if err := bumpVersion(a, 117); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 117 {
+		// Perform database upgrade from version 117 to version 118.
+		// Subscriptions.DlvSeqId is added on first write, nothing to do.
+		if err := bumpVersion(a, 118); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 118 {
+		// Perform database upgrade from version 118 to version 119.
+		// Topics.Webhook is added on first write, nothing to do.
+		if err := bumpVersion(a, 119); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 119 {
+		// Perform database upgrade from version 119 to version 120.
+		// Users.AutoReply is added on first write, nothing to do.
+		if err := bumpVersion(a, 120); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 120 {
+		// Perform database upgrade from version 120 to version 121.
+		// Topics.Stats is added on first write, nothing to do.
+		if err := bumpVersion(a, 121); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 121 {
+		// Perform database upgrade from version 121 to version 122.
+		// Topics.Guests is added on first write, nothing to do.
+		if err := bumpVersion(a, 122); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 122 {
+		// Perform database upgrade from version 122 to version 123.
+		// Topics.Owners is added on first write, nothing to do.
+		if err := bumpVersion(a, 123); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 123 {
+		// Perform database upgrade from version 123 to version 124.
+		// Users.AutoTranslate is added on first write, nothing to do.
+		if err := bumpVersion(a, 124); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 124 {
+		// Perform database upgrade from version 124 to version 125.
+		if err := createDigestTable(a); err != nil {
+			return err
+		}
+
+		if err := bumpVersion(a, 125); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 125 {
+		// Perform database upgrade from version 125 to version 126.
+		// Subscriptions.MuteUntil is added on first write, nothing to do.
+		if err := bumpVersion(a, 126); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 126 {
+		// Perform database upgrade from version 126 to version 127.
+		// Users.ChatList is added on first write, nothing to do.
+		if err := bumpVersion(a, 127); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 127 {
+		// Perform database upgrade from version 127 to version 128.
+		if err := createThreadIndex(a); err != nil {
+			return err
+		}
+
+		if err := bumpVersion(a, 128); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 128 {
+		// Perform database upgrade from version 128 to version 129.
+		// Users.Consent is added on first write, nothing to do.
+		if err := bumpVersion(a, 129); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 129 {
+		// Perform database upgrade from version 129 to version 130.
+		// Devices.LastPushAt and Devices.PushFailures are added on first write, nothing to do.
+		if err := bumpVersion(a, 130); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 130 {
+		// Perform database upgrade from version 130 to version 131.
+		// No full-text index in RethinkDB, nothing to do.
+		if err := bumpVersion(a, 131); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 131 {
+		// Perform database upgrade from version 131 to version 132.
+		if err := createCalEventTable(a); err != nil {
+			return err
+		}
+
+		if err := bumpVersion(a, 132); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 132 {
+		// Perform database upgrade from version 132 to version 133.
+		if err := createReceiptTable(a); err != nil {
+			return err
+		}
+
+		if err := bumpVersion(a, 133); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 133 {
+		// Perform database upgrade from version 133 to version 134.
+		if err := createMentionTable(a); err != nil {
+			return err
+		}
+
+		if err := bumpVersion(a, 134); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 134 {
+		// Perform database upgrade from version 134 to version 135.
+		if err := createPollTable(a); err != nil {
+			return err
+		}
+
+		if err := bumpVersion(a, 135); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 135 {
+		// Perform database upgrade from version 135 to version 136.
+		if err := createBookmarkTable(a); err != nil {
+			return err
+		}
+
+		if err := bumpVersion(a, 136); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 136 {
+		// Perform database upgrade from version 136 to version 137.
+		// Topics.Limits is added on first write, nothing to do.
+		if err := bumpVersion(a, 137); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 137 {
+		// Perform database upgrade from version 137 to version 138.
+		if err := createViewOnceTables(a); err != nil {
+			return err
+		}
+
+		if err := bumpVersion(a, 138); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 138 {
+		// Perform database upgrade from version 138 to version 139.
+		// Users.Birthdate is added on first write, nothing to do.
+		if err := bumpVersion(a, 139); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 139 {
+		// Perform database upgrade from version 139 to version 140.
+		// Subscriptions.AnchorSeq is added on first write, nothing to do.
+		if err := bumpVersion(a, 140); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 140 {
+		// Perform database upgrade from version 140 to version 141.
+		// Mentions.Thread and Mentions.CreatedAt are added on first write, nothing to do.
+		if err := bumpVersion(a, 141); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 141 {
+		// Perform database upgrade from version 141 to version 142.
+		if err := createMediaTypeIndex(a); err != nil {
+			return err
+		}
+
+		if err := bumpVersion(a, 142); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 142 {
+		// Perform database upgrade from version 142 to version 143.
+		// Mime is added on first write, nothing to do.
+
+		if err := bumpVersion(a, 143); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 143 {
+		// Perform database upgrade from version 143 to version 144.
+		// Topics.Announce is added on first write, nothing to do.
+
+		if err := bumpVersion(a, 144); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 144 {
+		// Perform database upgrade from version 144 to version 145.
+		if err := createAccountEventTable(a); err != nil {
+			return err
+		}
+
+		if err := bumpVersion(a, 145); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 145 {
+		// Perform database upgrade from version 145 to version 146.
+		// Subscriptions.Role is added on first write, nothing to do.
+		if err := bumpVersion(a, 146); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 146 {
+		// Perform database upgrade from version 146 to version 147.
+		// Topics.Capacity is added on first write, nothing to do.
+		if err := bumpVersion(a, 147); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 147 {
+		// Perform database upgrade from version 147 to version 148.
+		// Topics.Parent is added on first write, the index is needed for listing child topics.
+		if err := createTopicParentIndex(a); err != nil {
+			return err
+		}
+
+		if err := bumpVersion(a, 148); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 148 {
+		// Perform database upgrade from version 148 to version 149.
+		// Subscriptions.Request is added on first write, nothing to do.
+		if err := bumpVersion(a, 149); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 149 {
+		// Perform database upgrade from version 149 to version 150.
+		// Subscriptions.Quiet is added on first write, nothing to do.
+		if err := bumpVersion(a, 150); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 150 {
+		// Perform database upgrade from version 150 to version 151.
+		// Topics.MaxSubs is added on first write, nothing to do.
+		if err := bumpVersion(a, 151); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 151 {
+		// Perform database upgrade from version 151 to version 152.
+		// Topics.Freeze is added on first write, nothing to do.
+		if err := bumpVersion(a, 152); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 152 {
+		// Perform database upgrade from version 152 to version 153.
+		// Subscriptions.Notify is added on first write, nothing to do.
+		if err := bumpVersion(a, 153); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 153 {
+		// Perform database upgrade from version 153 to version 154.
+		// Subscriptions.Ban is added on first write, nothing to do.
+		if err := bumpVersion(a, 154); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 154 {
+		// Perform database upgrade from version 154 to version 155.
+		// Topics.Expiry is added on first write, nothing to do.
+		if err := bumpVersion(a, 155); err != nil {
+			return err
+		}
+	}
+
 	if a.version != adpVersion {
 		return errors.New("Failed to perform database upgrade to version " + strconv.Itoa(adpVersion) +
 			". DB is still at " + strconv.Itoa(a.version))
@@ -522,6 +970,158 @@ func (a *adapter) UpgradeDb() error {
 	return nil
 }
 
+// Create table for custom emoji packs.
+func createEmojiTable(a *adapter) error {
+	if _, err := rdb.DB(a.dbName).TableCreate("emojipacks", rdb.TableCreateOpts{PrimaryKey: "Id"}).RunWrite(a.conn); err != nil {
+		return err
+	}
+	// A secondary index on emojipacks.Org to be able to get packs of an organization.
+	_, err := rdb.DB(a.dbName).Table("emojipacks").IndexCreate("Org").RunWrite(a.conn)
+	return err
+}
+
+// Create table for channel digests.
+func createDigestTable(a *adapter) error {
+	if _, err := rdb.DB(a.dbName).TableCreate("digests", rdb.TableCreateOpts{PrimaryKey: "Id"}).RunWrite(a.conn); err != nil {
+		return err
+	}
+	// A secondary index on digests.NextAt to be able to find digests which are due.
+	_, err := rdb.DB(a.dbName).Table("digests").IndexCreate("NextAt").RunWrite(a.conn)
+	return err
+}
+
+// Create table for events announced in topics.
+func createCalEventTable(a *adapter) error {
+	if _, err := rdb.DB(a.dbName).TableCreate("calevents", rdb.TableCreateOpts{PrimaryKey: "Id"}).RunWrite(a.conn); err != nil {
+		return err
+	}
+	// A compound index on calevents.Topic - StartAt to be able to get upcoming events of a topic.
+	if _, err := rdb.DB(a.dbName).Table("calevents").IndexCreateFunc("Topic_StartAt",
+		func(row rdb.Term) interface{} {
+			return []interface{}{row.Field("Topic"), row.Field("StartAt")}
+		}).RunWrite(a.conn); err != nil {
+		return err
+	}
+	// A secondary index on calevents.RemindAt to be able to find reminders which are due.
+	_, err := rdb.DB(a.dbName).Table("calevents").IndexCreate("RemindAt").RunWrite(a.conn)
+	return err
+}
+
+// Create table for per-message read receipts.
+func createReceiptTable(a *adapter) error {
+	if _, err := rdb.DB(a.dbName).TableCreate("receipts").RunWrite(a.conn); err != nil {
+		return err
+	}
+	// A compound index on receipts.Topic - SeqTo to be able to find receipts of a message.
+	_, err := rdb.DB(a.dbName).Table("receipts").IndexCreateFunc("Topic_SeqTo",
+		func(row rdb.Term) interface{} {
+			return []interface{}{row.Field("Topic"), row.Field("SeqTo")}
+		}).RunWrite(a.conn)
+	return err
+}
+
+// Create table for polls.
+func createPollTable(a *adapter) error {
+	if _, err := rdb.DB(a.dbName).TableCreate("polls", rdb.TableCreateOpts{PrimaryKey: "Id"}).RunWrite(a.conn); err != nil {
+		return err
+	}
+	// Index on polls.Topic to delete polls of a deleted topic.
+	_, err := rdb.DB(a.dbName).Table("polls").IndexCreate("Topic").RunWrite(a.conn)
+	return err
+}
+
+// Create table for starred messages.
+func createBookmarkTable(a *adapter) error {
+	if _, err := rdb.DB(a.dbName).TableCreate("bookmarks", rdb.TableCreateOpts{PrimaryKey: "Id"}).RunWrite(a.conn); err != nil {
+		return err
+	}
+	// Index on bookmarks.User to list and delete bookmarks of the user.
+	if _, err := rdb.DB(a.dbName).Table("bookmarks").IndexCreate("User").RunWrite(a.conn); err != nil {
+		return err
+	}
+	// Index on bookmarks.Topic to delete bookmarks of a deleted topic.
+	_, err := rdb.DB(a.dbName).Table("bookmarks").IndexCreate("Topic").RunWrite(a.conn)
+	return err
+}
+
+// Create tables for view-once attachments and their retrievals.
+func createViewOnceTables(a *adapter) error {
+	if _, err := rdb.DB(a.dbName).TableCreate("viewonce", rdb.TableCreateOpts{PrimaryKey: "Id"}).RunWrite(a.conn); err != nil {
+		return err
+	}
+	// Index on viewonce.Topic to delete view-once marks of files in a deleted topic.
+	if _, err := rdb.DB(a.dbName).Table("viewonce").IndexCreate("Topic").RunWrite(a.conn); err != nil {
+		return err
+	}
+	if _, err := rdb.DB(a.dbName).TableCreate("viewoncelog", rdb.TableCreateOpts{PrimaryKey: "Id"}).RunWrite(a.conn); err != nil {
+		return err
+	}
+	// Index on viewoncelog.User to delete retrievals of a deleted user.
+	if _, err := rdb.DB(a.dbName).Table("viewoncelog").IndexCreate("User").RunWrite(a.conn); err != nil {
+		return err
+	}
+	// Index on viewoncelog.Topic to delete retrievals in a deleted topic.
+	_, err := rdb.DB(a.dbName).Table("viewoncelog").IndexCreate("Topic").RunWrite(a.conn)
+	return err
+}
+
+// Create index on topics.Parent for listing child topics of a space.
+func createTopicParentIndex(a *adapter) error {
+	_, err := rdb.DB(a.dbName).Table("topics").IndexCreate("Parent").RunWrite(a.conn)
+	return err
+}
+
+// Create table for the account activity timeline.
+func createAccountEventTable(a *adapter) error {
+	if _, err := rdb.DB(a.dbName).TableCreate("accountevents", rdb.TableCreateOpts{PrimaryKey: "Id"}).RunWrite(a.conn); err != nil {
+		return err
+	}
+	// Index on accountevents.User to get the timeline of the user.
+	if _, err := rdb.DB(a.dbName).Table("accountevents").IndexCreate("User").RunWrite(a.conn); err != nil {
+		return err
+	}
+	// Index on accountevents.CreatedAt to delete events past the retention period.
+	_, err := rdb.DB(a.dbName).Table("accountevents").IndexCreate("CreatedAt").RunWrite(a.conn)
+	return err
+}
+
+// Create table for unread mentions.
+func createMentionTable(a *adapter) error {
+	if _, err := rdb.DB(a.dbName).TableCreate("mentions").RunWrite(a.conn); err != nil {
+		return err
+	}
+	// A compound index on mentions.User - Topic - SeqId to be able to count and clear mentions of the user.
+	if _, err := rdb.DB(a.dbName).Table("mentions").IndexCreateFunc("User_Topic_SeqId",
+		func(row rdb.Term) interface{} {
+			return []interface{}{row.Field("User"), row.Field("Topic"), row.Field("SeqId")}
+		}).RunWrite(a.conn); err != nil {
+		return err
+	}
+	// Index on mentions.Topic to delete mentions of a deleted topic.
+	_, err := rdb.DB(a.dbName).Table("mentions").IndexCreate("Topic").RunWrite(a.conn)
+	return err
+}
+
+// createThreadIndex creates a compound index topic - thread - seqID for selecting replies in a thread.
+// Messages which are not thread replies have no Thread field and are not indexed.
+func createThreadIndex(a *adapter) error {
+	_, err := rdb.DB(a.dbName).Table("messages").IndexCreateFunc("Topic_Thread_SeqId",
+		func(row rdb.Term) interface{} {
+			return []interface{}{row.Field("Topic"), row.Field("Thread"), row.Field("SeqId")}
+		}).RunWrite(a.conn)
+	return err
+}
+
+// createMediaTypeIndex creates a compound index topic - media type - seqID for selecting messages by type of media.
+// Messages without media type have no MediaType field and are not indexed.
+func createMediaTypeIndex(a *adapter) error {
+	_, err := rdb.DB(a.dbName).Table("messages").IndexCreateFunc("Topic_MediaType_SeqId",
+		func(row rdb.Term) interface{} {
+			return []interface{}{row.Field("Topic"), row.Field("MediaType"), row.Field("SeqId")}
+		}).RunWrite(a.conn)
+	return err
+}
+
 // Create system topic 'sys'.
 func createSystemTopic(a *adapter) error {
 	now := t.TimeNow()
@@ -734,6 +1334,29 @@ func (a *adapter) UserDelete(uid t.Uid, hard bool) error {
 		if err = a.SubsDelForUser(uid, true); err != nil {
 			return err
 		}
+		// Delete user's unread mentions.
+		if _, err = rdb.DB(a.dbName).Table("mentions").
+			Between([]interface{}{uid.String(), rdb.MinVal, rdb.MinVal},
+				[]interface{}{uid.String(), rdb.MaxVal, rdb.MaxVal},
+				rdb.BetweenOpts{Index: "User_Topic_SeqId"}).
+			Delete().RunWrite(a.conn); err != nil {
+			return err
+		}
+		// Delete user's bookmarks.
+		if _, err = rdb.DB(a.dbName).Table("bookmarks").GetAllByIndex("User", uid.String()).
+			Delete().RunWrite(a.conn); err != nil {
+			return err
+		}
+		// Delete records of view-once attachments retrieved by the user.
+		if _, err = rdb.DB(a.dbName).Table("viewoncelog").GetAllByIndex("User", uid.String()).
+			Delete().RunWrite(a.conn); err != nil {
+			return err
+		}
+		// Delete the activity timeline of the user.
+		if _, err = rdb.DB(a.dbName).Table("accountevents").GetAllByIndex("User", uid.String()).
+			Delete().RunWrite(a.conn); err != nil {
+			return err
+		}
 		// Can't delete user's messages in all topics because we cannot notify topics of such deletion.
 		// Or we have to delete these messages one by one.
 		// For now, just leave the messages there marked as sent by "not found" user.
@@ -946,6 +1569,32 @@ func (a *adapter) UserGetByCred(method, value string) (t.Uid, error) {
 	return t.ParseUid(userId), nil
 }
 
+// UserGetByState returns IDs of users who have been in the given state since before the given time,
+// ordered by ID, starting after the given ID.
+func (a *adapter) UserGetByState(state t.ObjState, before time.Time, after t.Uid, limit int) ([]t.Uid, error) {
+	filter := rdb.Row.Field("StateAt").Lt(before)
+	if !after.IsZero() {
+		filter = filter.And(rdb.Row.Field("Id").Gt(after.String()))
+	}
+	cursor, err := rdb.DB(a.dbName).Table("users").GetAllByIndex("State", state).
+		Filter(filter).OrderBy("Id").Limit(limit).Field("Id").Run(a.conn)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+
+	var ids []string
+	if err = cursor.All(&ids); err != nil {
+		return nil, err
+	}
+
+	uids := make([]t.Uid, len(ids))
+	for i, id := range ids {
+		uids[i] = t.ParseUid(id)
+	}
+	return uids, nil
+}
+
 // UserUnreadCount returns the total number of unread messages in all topics with
 // the R permission.
 func (a *adapter) UserUnreadCount(uid t.Uid) (int, error) {
@@ -961,7 +1610,12 @@ func (a *adapter) UserUnreadCount(uid t.Uid) (int, error) {
 			.sum(function(x) {return x.getField("SeqId").sub(x.getField("ReadSeqId"));})
 	*/
 	cursor, err := rdb.DB(a.dbName).Table("subscriptions").GetAllByIndex("User", uid.String()).
-		EqJoin("Topic", rdb.DB(a.dbName).Table("topics"), rdb.EqJoinOpts{Index: "Id"}).
+		// Subscriptions of channel readers 'chnXXX' count messages of the topic 'grpXXX'.
+		EqJoin(func(row rdb.Term) rdb.Term {
+			return rdb.Branch(row.Field("Topic").Match("^chn"),
+				rdb.Expr("grp").Add(row.Field("Topic").Match("^chn(.*)$").Field("groups").Nth(0).Field("str")),
+				row.Field("Topic"))
+		}, rdb.DB(a.dbName).Table("topics"), rdb.EqJoinOpts{Index: "Id"}).
 		// left: subscription; right: topic.
 		Filter(
 			rdb.Not(rdb.Row.HasFields(map[string]interface{}{"left": "DeletedAt"}).
@@ -1062,6 +1716,83 @@ func (a *adapter) TopicGet(topic string) (*t.Topic, error) {
 	return tt, nil
 }
 
+// TopicGetByState loads up to limit topics in the given state, oldest first.
+func (a *adapter) TopicGetByState(state t.ObjState, limit int) ([]t.Topic, error) {
+	cursor, err := rdb.DB(a.dbName).Table("topics").GetAllByIndex("State", state).
+		OrderBy("CreatedAt").Limit(limit).Run(a.conn)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+
+	var topics []t.Topic
+	if err = cursor.All(&topics); err != nil {
+		return nil, err
+	}
+	return topics, nil
+}
+
+// TopicGetChildren loads up to limit topics which have the given parent, oldest first.
+func (a *adapter) TopicGetChildren(parent string, limit int) ([]t.Topic, error) {
+	cursor, err := rdb.DB(a.dbName).Table("topics").GetAllByIndex("Parent", parent).
+		OrderBy("CreatedAt").Limit(limit).Run(a.conn)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+
+	var topics []t.Topic
+	if err = cursor.All(&topics); err != nil {
+		return nil, err
+	}
+	return topics, nil
+}
+
+// TopicGetDirectory loads one page of active topics which have the category tag of the query.
+func (a *adapter) TopicGetDirectory(query *t.TopicDirectoryQuery) ([]t.Topic, error) {
+	// Number of members is saved with the counters of the topic.
+	key := func(row rdb.Term) rdb.Term {
+		if query.ByMembers {
+			return row.Field("Stats").Field("members").Default(0)
+		}
+		return row.Field("TouchedAt")
+	}
+
+	q := rdb.DB(a.dbName).Table("topics").GetAllByIndex("Tags", query.Tag).
+		Filter(rdb.Row.Field("State").Eq(t.StateOK))
+	if len(query.Exclude) > 0 {
+		var excl []interface{}
+		for _, tag := range query.Exclude {
+			excl = append(excl, tag)
+		}
+		q = q.Filter(func(row rdb.Term) rdb.Term {
+			return row.Field("Tags").SetIntersection(excl).Count().Eq(0)
+		})
+	}
+	if query.After != nil {
+		// Topics after the last one of the previous page: lower sort key or the same key and greater name.
+		var after interface{} = query.After.TouchedAt
+		if query.ByMembers {
+			after = query.After.Members
+		}
+		q = q.Filter(func(row rdb.Term) rdb.Term {
+			return key(row).Lt(after).Or(key(row).Eq(after).And(row.Field("Id").Gt(query.After.Name)))
+		})
+	}
+
+	cursor, err := q.OrderBy(rdb.Desc(key), "Id").Limit(query.Limit).Run(a.conn)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+
+	var topics []t.Topic
+	if err = cursor.All(&topics); err != nil {
+		return nil, err
+	}
+	return topics, nil
+}
+
 // TopicsForUser loads user's contact list: p2p and grp topics, except for 'me' & 'fnd' subscriptions.
 // Reads and denormalizes Public value. 89277082226
 // r.db("tinode").table('subscriptions').indexCreate('user_createdAt', [r.row("User"), r.row("CreatedAt")]);
@@ -1193,6 +1924,7 @@ func (a *adapter) TopicsForUser(uid t.Uid, keepDeleted bool, opts *t.QueryOpt) (
 				sub.ObjHeader.MergeTimes(&usr.ObjHeader)
 				sub.SetState(usr.State)
 				sub.SetPublic(usr.Public)
+				sub.SetTrusted(usr.Trusted)
 				sub.SetWith(uid2.UserId())
 				sub.SetDefaultAccess(usr.Access.Auth, usr.Access.Anon)
 				sub.SetLastSeenAndUA(usr.LastSeen, usr.UserAgent)
@@ -1278,6 +2010,7 @@ func (a *adapter) UsersForTopic(topic string, keepDeleted bool, opts *t.QueryOpt
 			if sub, ok := join[usr.Id]; ok {
 				sub.ObjHeader.MergeTimes(&usr.ObjHeader)
 				sub.SetPublic(usr.Public)
+				sub.SetTrusted(usr.Trusted)
 				subs = append(subs, sub)
 			}
 		}
@@ -1285,14 +2018,18 @@ func (a *adapter) UsersForTopic(topic string, keepDeleted bool, opts *t.QueryOpt
 	}
 
 	if t.GetTopicCat(topic) == t.TopicCatP2P && len(subs) > 0 {
-		// Swap public values of P2P topics as expected.
+		// Swap public and trusted values of P2P topics as expected.
 		if len(subs) == 1 {
 			// User is deleted. Nothing we can do.
 			subs[0].SetPublic(nil)
+			subs[0].SetTrusted(nil)
 		} else {
 			pub := subs[0].GetPublic()
 			subs[0].SetPublic(subs[1].GetPublic())
 			subs[1].SetPublic(pub)
+			trst := subs[0].GetTrusted()
+			subs[0].SetTrusted(subs[1].GetTrusted())
+			subs[1].SetTrusted(trst)
 		}
 
 		// Remove deleted and unneeded subscriptions
@@ -1338,7 +2075,7 @@ func (a *adapter) TopicShare(shares []*t.Subscription) error {
 	// updating times and ModeGiven.
 	_, err := rdb.DB(a.dbName).Table("subscriptions").
 		Insert(shares, rdb.InsertOpts{Conflict: func(id, oldsub, newsub rdb.Term) interface{} {
-			return oldsub.Without("DeletedAt").Merge(map[string]interface{}{
+			return oldsub.Without("DeletedAt", "Role", "Request", "Ban").Merge(map[string]interface{}{
 				"CreatedAt": newsub.Field("CreatedAt"),
 				"UpdatedAt": newsub.Field("UpdatedAt"),
 				"ModeGiven": newsub.Field("ModeGiven")})
@@ -1357,6 +2094,32 @@ func (a *adapter) TopicDelete(topic string, hard bool) error {
 		if err = a.MessageDeleteList(topic, nil); err != nil {
 			return err
 		}
+		if _, err = rdb.DB(a.dbName).Table("receipts").
+			Between([]interface{}{topic, rdb.MinVal}, []interface{}{topic, rdb.MaxVal},
+				rdb.BetweenOpts{Index: "Topic_SeqTo"}).
+			Delete().RunWrite(a.conn); err != nil {
+			return err
+		}
+		if _, err = rdb.DB(a.dbName).Table("mentions").GetAllByIndex("Topic", topic).
+			Delete().RunWrite(a.conn); err != nil {
+			return err
+		}
+		if _, err = rdb.DB(a.dbName).Table("polls").GetAllByIndex("Topic", topic).
+			Delete().RunWrite(a.conn); err != nil {
+			return err
+		}
+		if _, err = rdb.DB(a.dbName).Table("bookmarks").GetAllByIndex("Topic", topic).
+			Delete().RunWrite(a.conn); err != nil {
+			return err
+		}
+		if _, err = rdb.DB(a.dbName).Table("viewoncelog").GetAllByIndex("Topic", topic).
+			Delete().RunWrite(a.conn); err != nil {
+			return err
+		}
+		if _, err = rdb.DB(a.dbName).Table("viewonce").GetAllByIndex("Topic", topic).
+			Delete().RunWrite(a.conn); err != nil {
+			return err
+		}
 	}
 
 	q := rdb.DB(a.dbName).Table("topics").Get(topic)
@@ -1391,10 +2154,45 @@ func (a *adapter) TopicUpdate(topic string, update map[string]interface{}) error
 	return err
 }
 
+// TopicOwnerChange updates topic's owner and moves the O permission to the new owner.
+// No transactions in RethinkDB: the new owner gets the permission first, two owners are better than none.
 func (a *adapter) TopicOwnerChange(topic string, newOwner t.Uid) error {
-	_, err := rdb.DB(a.dbName).Table("topics").Get(topic).
-		Update(map[string]interface{}{"Owner": newOwner}).RunWrite(a.conn)
-	return err
+	tt, err := a.TopicGet(topic)
+	if err != nil {
+		return err
+	}
+	if tt == nil {
+		return t.ErrNotFound
+	}
+	oldOwner := t.ParseUid(tt.Owner)
+
+	if err = a.subsOwnerFlag(topic, newOwner, true); err != nil {
+		return err
+	}
+	if _, err = rdb.DB(a.dbName).Table("topics").Get(topic).
+		Update(map[string]interface{}{"Owner": newOwner}).RunWrite(a.conn); err != nil {
+		return err
+	}
+	if oldOwner.IsZero() || oldOwner == newOwner {
+		return nil
+	}
+	return a.subsOwnerFlag(topic, oldOwner, false)
+}
+
+// subsOwnerFlag sets or clears the O permission of the user's subscription if the subscription exists.
+func (a *adapter) subsOwnerFlag(topic string, user t.Uid, set bool) error {
+	sub, err := a.SubscriptionGet(topic, user)
+	if err != nil || sub == nil {
+		return err
+	}
+	if set {
+		sub.ModeWant |= t.ModeOwner
+		sub.ModeGiven |= t.ModeOwner
+	} else {
+		sub.ModeWant &^= t.ModeOwner
+		sub.ModeGiven &^= t.ModeOwner
+	}
+	return a.SubsUpdate(topic, user, map[string]interface{}{"ModeWant": sub.ModeWant, "ModeGiven": sub.ModeGiven})
 }
 
 // SubscriptionGet returns a subscription of a user to a topic
@@ -1495,6 +2293,21 @@ func (a *adapter) SubsForTopic(topic string, keepDeleted bool, opts *t.QueryOpt)
 	return subs, cursor.Err()
 }
 
+// SubsCountForTopic returns the number of subscriptions to the given topic which are not deleted.
+func (a *adapter) SubsCountForTopic(topic string) (int, error) {
+	cursor, err := rdb.DB(a.dbName).Table("subscriptions").GetAllByIndex("Topic", topic).
+		Filter(rdb.Row.HasFields("DeletedAt").Not()).
+		Count().Run(a.conn)
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close()
+
+	var count int
+	err = cursor.One(&count)
+	return count, err
+}
+
 // SubsUpdate updates a single subscription.
 func (a *adapter) SubsUpdate(topic string, user t.Uid, update map[string]interface{}) error {
 	q := rdb.DB(a.dbName).Table("subscriptions")
@@ -1571,7 +2384,7 @@ func (a *adapter) FindUsers(uid t.Uid, req [][]string, opt []string) ([]t.Subscr
 		r.db('tinode').
 			table('users').
 			getAll(<all tags here>, {index: "Tags"}).
-			pluck("Id", "Access", "CreatedAt", "UpdatedAt", "Public", "Tags").
+			pluck("Id", "Access", "CreatedAt", "UpdatedAt", "Public", "Trusted", "Tags").
 			group("Id").ungroup().
 			map(function(row) { return row.getField('reduction').nth(0).merge({matchedCount: row.getField('reduction').count()}); }).
 			filter(function(row) { return row.getField("Tags").setIntersection([<required tags here>]).count().ne(0); }).
@@ -1584,7 +2397,7 @@ func (a *adapter) FindUsers(uid t.Uid, req [][]string, opt []string) ([]t.Subscr
 		Table("users").
 		GetAllByIndex("Tags", allTags...).
 		Filter(rdb.Row.Field("State").Eq(t.StateOK)).
-		Pluck("Id", "Access", "CreatedAt", "UpdatedAt", "Public", "Tags").
+		Pluck("Id", "Access", "CreatedAt", "UpdatedAt", "Public", "Trusted", "Tags").
 		Group("Id").
 		Ungroup().
 		Map(func(row rdb.Term) rdb.Term {
@@ -1619,6 +2432,7 @@ func (a *adapter) FindUsers(uid t.Uid, req [][]string, opt []string) ([]t.Subscr
 		sub.UpdatedAt = user.UpdatedAt
 		sub.User = user.Id
 		sub.SetPublic(user.Public)
+		sub.SetTrusted(user.Trusted)
 		sub.SetDefaultAccess(user.Access.Auth, user.Access.Anon)
 		tags := make([]string, 0, 1)
 		for _, tag := range user.Tags {
@@ -1640,7 +2454,7 @@ func (a *adapter) FindUsers(uid t.Uid, req [][]string, opt []string) ([]t.Subscr
 
 // Returns a list of topics with matching tags.
 // Searching the 'topics.Tags' for the given tags using respective index.
-func (a *adapter) FindTopics(req [][]string, opt []string) ([]t.Subscription, error) {
+func (a *adapter) FindTopics(req [][]string, opt []string, excl []string) ([]t.Subscription, error) {
 	index := make(map[string]struct{})
 	var allReq []string
 	for _, el := range req {
@@ -1651,10 +2465,20 @@ func (a *adapter) FindTopics(req [][]string, opt []string) ([]t.Subscription, er
 		allTags = append(allTags, tag)
 		index[tag] = struct{}{}
 	}
+	var exclTags []interface{}
+	for _, tag := range excl {
+		exclTags = append(exclTags, tag)
+	}
 	query := rdb.DB(a.dbName).
 		Table("topics").
 		GetAllByIndex("Tags", allTags...).
-		Filter(rdb.Row.Field("State").Eq(t.StateOK)).
+		Filter(func(row rdb.Term) rdb.Term {
+			cond := row.Field("State").Eq(t.StateOK)
+			if len(exclTags) > 0 {
+				cond = cond.And(row.Field("Tags").SetIntersection(exclTags).Count().Eq(0))
+			}
+			return cond
+		}).
 		Pluck("Id", "Access", "CreatedAt", "UpdatedAt", "UseBt", "Public", "Tags").
 		Group("Id").
 		Ungroup().
@@ -1738,14 +2562,44 @@ func (a *adapter) MessageGetAll(topic string, forUser t.Uid, opts *t.QueryOpt) (
 		}
 	}
 
-	lower = []interface{}{topic, lower}
-	upper = []interface{}{topic, upper}
+	index := "Topic_SeqId"
+	var mediaType string
+	if opts != nil && opts.Thread > 0 {
+		index = "Topic_Thread_SeqId"
+		lower = []interface{}{topic, opts.Thread, lower}
+		upper = []interface{}{topic, opts.Thread, upper}
+		// Replies in the thread are filtered by type of media below.
+		mediaType = opts.MediaType
+	} else if opts != nil && opts.MediaType != "" {
+		index = "Topic_MediaType_SeqId"
+		lower = []interface{}{topic, opts.MediaType, lower}
+		upper = []interface{}{topic, opts.MediaType, upper}
+	} else {
+		lower = []interface{}{topic, lower}
+		upper = []interface{}{topic, upper}
+	}
 
 	requester := forUser.String()
-	cursor, err := rdb.DB(a.dbName).Table("messages").
-		Between(lower, upper, rdb.BetweenOpts{Index: "Topic_SeqId"}).
+	query := rdb.DB(a.dbName).Table("messages").
+		Between(lower, upper, rdb.BetweenOpts{Index: index}).
 		// Ordering by index must come before filtering
-		OrderBy(rdb.OrderByOpts{Index: rdb.Desc("Topic_SeqId")}).
+		OrderBy(rdb.OrderByOpts{Index: rdb.Desc(index)})
+	if mediaType != "" {
+		query = query.Filter(rdb.Row.Field("MediaType").Default("").Eq(mediaType))
+	}
+	if opts != nil && len(opts.Mime) > 0 {
+		// Patterns like "image/*" are matched by prefix.
+		var mimes []string
+		for _, mime := range opts.Mime {
+			if strings.HasSuffix(mime, "/*") {
+				mimes = append(mimes, regexp.QuoteMeta(strings.TrimSuffix(mime, "*"))+".*")
+			} else {
+				mimes = append(mimes, regexp.QuoteMeta(mime))
+			}
+		}
+		query = query.Filter(rdb.Row.Field("Mime").Default("").Match("^(" + strings.Join(mimes, "|") + ")$"))
+	}
+	cursor, err := query.
 		// Skip hard-deleted messages
 		Filter(rdb.Row.HasFields("DelId").Not()).
 		// Skip messages soft-deleted for the current user
@@ -1769,6 +2623,11 @@ func (a *adapter) MessageGetAll(topic string, forUser t.Uid, opts *t.QueryOpt) (
 	return msgs, nil
 }
 
+// MessageSearch is not supported: RethinkDB has no full-text index.
+func (a *adapter) MessageSearch(topic string, forUser t.Uid, query string, opts *t.QueryOpt) ([]t.Message, error) {
+	return nil, t.ErrUnsupported
+}
+
 // Get ranges of deleted messages
 func (a *adapter) MessageGetDeleted(topic string, forUser t.Uid, opts *t.QueryOpt) ([]t.DelMessage, error) {
 	var limit = a.maxResults
@@ -1918,6 +2777,30 @@ func (a *adapter) MessageDeleteList(topic string, toDel *t.DelMessage) error {
 }
 
 // MessageAttachments adds attachments to a message.
+// MessageThreadReply increments the count of replies of the first message of a thread.
+func (a *adapter) MessageThreadReply(topic string, root int, at time.Time) error {
+	_, err := rdb.DB(a.dbName).Table("messages").
+		GetAllByIndex("Topic_SeqId", []interface{}{topic, root}).
+		Update(map[string]interface{}{
+			"Replies":     rdb.Row.Field("Replies").Default(0).Add(1),
+			"LastReplyAt": at}).
+		RunWrite(a.conn)
+	return err
+}
+
+// MessageUpdate replaces headers and content of a message.
+func (a *adapter) MessageUpdate(topic string, seqId int, head t.MessageHeaders, content interface{}) error {
+	_, err := rdb.DB(a.dbName).Table("messages").
+		GetAllByIndex("Topic_SeqId", []interface{}{topic, seqId}).
+		Update(map[string]interface{}{
+			"UpdatedAt": t.TimeNow(),
+			// Literal replaces the object instead of merging it with the old one.
+			"Head":    rdb.Literal(head),
+			"Content": rdb.Literal(content)}).
+		RunWrite(a.conn)
+	return err
+}
+
 func (a *adapter) MessageAttachments(msgId t.Uid, fids []string) error {
 	now := t.TimeNow()
 	_, err := rdb.DB(a.dbName).Table("messages").Get(msgId.String()).
@@ -1942,6 +2825,34 @@ func (a *adapter) MessageAttachments(msgId t.Uid, fids []string) error {
 	return err
 }
 
+// MessageAttachmentsUpdate connects the message to the added file record IDs and disconnects it from
+// the removed ones.
+func (a *adapter) MessageAttachmentsUpdate(topic string, seqId int, added, removed []string) error {
+	toAdd := make([]interface{}, len(added))
+	for i, id := range added {
+		toAdd[i] = id
+	}
+	toRemove := make([]interface{}, len(removed))
+	for i, id := range removed {
+		toRemove[i] = id
+	}
+	_, err := rdb.DB(a.dbName).Table("messages").
+		GetAllByIndex("Topic_SeqId", []interface{}{topic, seqId}).
+		Update(map[string]interface{}{
+			"UpdatedAt": t.TimeNow(),
+			"Attachments": rdb.Row.Field("Attachments").Default([]interface{}{}).
+				SetDifference(toRemove).SetUnion(toAdd),
+		}).RunWrite(a.conn)
+	if err != nil {
+		return err
+	}
+
+	if err = a.fileChangeUseCounter(removed, -1); err != nil {
+		return err
+	}
+	return a.fileChangeUseCounter(added, 1)
+}
+
 func deviceHasher(deviceID string) string {
 	// Generate custom key as [64-bit hash of device id] to ensure predictable
 	// length of the key
@@ -2045,8 +2956,57 @@ func (a *adapter) DeviceDelete(uid t.Uid, deviceID string) error {
 	} else {
 		q = q.Replace(rdb.Row.Without(map[string]string{"Devices": deviceHasher(deviceID)}))
 	}
-	_, err = q.RunWrite(a.conn)
-	return err
+	_, err = q.RunWrite(a.conn)
+	return err
+}
+
+// DevicePushResults records results of push notifications.
+func (a *adapter) DevicePushResults(delivered, failed []string, at time.Time) error {
+	for _, id := range delivered {
+		hash := deviceHasher(id)
+		if _, err := rdb.DB(a.dbName).Table("users").GetAllByIndex("DeviceIds", id).
+			Update(map[string]interface{}{
+				"Devices": map[string]interface{}{
+					hash: map[string]interface{}{"LastPushAt": at, "PushFailures": 0},
+				}}).RunWrite(a.conn); err != nil {
+			return err
+		}
+	}
+	for _, id := range failed {
+		hash := deviceHasher(id)
+		if _, err := rdb.DB(a.dbName).Table("users").GetAllByIndex("DeviceIds", id).
+			Update(map[string]interface{}{
+				"Devices": map[string]interface{}{
+					hash: map[string]interface{}{
+						"PushFailures": rdb.Row.Field("Devices").Field(hash).Field("PushFailures").Default(0).Add(1)},
+				}}).RunWrite(a.conn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeviceDeleteStale deletes devices which repeatedly failed to receive push notifications or have been idle for too long.
+func (a *adapter) DeviceDeleteStale(maxFailures int, idleBefore time.Time) (int, error) {
+	isStale := func(dev rdb.Term) rdb.Term {
+		return dev.Field("PushFailures").Default(0).Ge(maxFailures).Or(dev.Field("LastSeen").Lt(idleBefore))
+	}
+	res, err := rdb.DB(a.dbName).Table("users").HasFields("Devices").
+		Filter(func(user rdb.Term) rdb.Term {
+			return user.Field("Devices").Values().Contains(isStale)
+		}).
+		Update(func(user rdb.Term) interface{} {
+			return map[string]interface{}{
+				"Devices": rdb.Literal(user.Field("Devices").CoerceTo("array").
+					Filter(func(kv rdb.Term) rdb.Term {
+						return isStale(kv.Nth(1)).Not()
+					}).CoerceTo("object")),
+			}
+		}).RunWrite(a.conn)
+	if err != nil {
+		return 0, err
+	}
+	return res.Replaced, nil
 }
 
 // Credential management
@@ -2334,6 +3294,467 @@ func (a *adapter) FileDeleteUnused(olderThan time.Time, limit int) ([]string, er
 	return locations, err
 }
 
+// PackUpsert creates or replaces an emoji pack and updates use counters of the pack's files.
+func (a *adapter) PackUpsert(pack *t.EmojiPack) error {
+	old, err := a.PackGet(pack.Id)
+	if err != nil {
+		return err
+	}
+
+	if _, err = rdb.DB(a.dbName).Table("emojipacks").Insert(pack, rdb.InsertOpts{Conflict: "replace"}).
+		RunWrite(a.conn); err != nil {
+		return err
+	}
+
+	if len(old) > 0 {
+		if err = a.fileChangeUseCounter(old[0].Items.FileIds(), -1); err != nil {
+			return err
+		}
+	}
+	return a.fileChangeUseCounter(pack.Items.FileIds(), 1)
+}
+
+// PackGet returns packs with the given IDs.
+func (a *adapter) PackGet(ids ...string) ([]t.EmojiPack, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	return a.packsQuery(rdb.DB(a.dbName).Table("emojipacks").GetAll(args...))
+}
+
+// PackGetForOrg returns packs which belong to any of the given organizations.
+func (a *adapter) PackGetForOrg(orgs ...string) ([]t.EmojiPack, error) {
+	if len(orgs) == 0 {
+		return nil, nil
+	}
+
+	args := make([]interface{}, len(orgs))
+	for i, org := range orgs {
+		args[i] = org
+	}
+	return a.packsQuery(rdb.DB(a.dbName).Table("emojipacks").GetAllByIndex("Org", args...).
+		OrderBy("CreatedAt"))
+}
+
+func (a *adapter) packsQuery(q rdb.Term) ([]t.EmojiPack, error) {
+	cursor, err := q.Run(a.conn)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+
+	var packs []t.EmojiPack
+	if err = cursor.All(&packs); err != nil {
+		return nil, err
+	}
+	return packs, nil
+}
+
+// PackDelete deletes the pack and decrements use counters of the pack's files.
+func (a *adapter) PackDelete(id string) error {
+	packs, err := a.PackGet(id)
+	if err != nil {
+		return err
+	}
+	if len(packs) == 0 {
+		return t.ErrNotFound
+	}
+
+	if _, err = rdb.DB(a.dbName).Table("emojipacks").Get(id).Delete().RunWrite(a.conn); err != nil {
+		return err
+	}
+	return a.fileChangeUseCounter(packs[0].Items.FileIds(), -1)
+}
+
+// DigestUpsert creates or replaces the digest of a channel reader.
+func (a *adapter) DigestUpsert(dg *t.Digest) error {
+	_, err := rdb.DB(a.dbName).Table("digests").Insert(dg, rdb.InsertOpts{Conflict: "replace"}).RunWrite(a.conn)
+	return err
+}
+
+// DigestGet returns the digest of the channel reader or nil if there is none.
+func (a *adapter) DigestGet(topic string, user t.Uid) (*t.Digest, error) {
+	cursor, err := rdb.DB(a.dbName).Table("digests").Get(topic + ":" + user.String()).Run(a.conn)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+
+	if cursor.IsNil() {
+		return nil, nil
+	}
+
+	var dg t.Digest
+	if err = cursor.One(&dg); err != nil {
+		return nil, err
+	}
+	return &dg, nil
+}
+
+// DigestGetDue returns digests with NextAt before the given time, earliest first.
+func (a *adapter) DigestGetDue(before time.Time, limit int) ([]t.Digest, error) {
+	cursor, err := rdb.DB(a.dbName).Table("digests").
+		Between(rdb.MinVal, before, rdb.BetweenOpts{Index: "NextAt"}).
+		OrderBy(rdb.OrderByOpts{Index: "NextAt"}).Limit(limit).Run(a.conn)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+
+	var digests []t.Digest
+	if err = cursor.All(&digests); err != nil {
+		return nil, err
+	}
+	return digests, nil
+}
+
+// DigestDelete deletes the digest of the channel reader.
+func (a *adapter) DigestDelete(topic string, user t.Uid) error {
+	_, err := rdb.DB(a.dbName).Table("digests").Get(topic + ":" + user.String()).Delete().RunWrite(a.conn)
+	return err
+}
+
+// CalEventUpsert creates or replaces the event.
+func (a *adapter) CalEventUpsert(ev *t.CalEvent) error {
+	_, err := rdb.DB(a.dbName).Table("calevents").Insert(ev, rdb.InsertOpts{Conflict: "replace"}).RunWrite(a.conn)
+	return err
+}
+
+// CalEventGet returns the event announced by the message or nil if there is none.
+func (a *adapter) CalEventGet(topic string, seqId int) (*t.CalEvent, error) {
+	cursor, err := rdb.DB(a.dbName).Table("calevents").Get(topic + ":" + strconv.Itoa(seqId)).Run(a.conn)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+
+	if cursor.IsNil() {
+		return nil, nil
+	}
+
+	var ev t.CalEvent
+	if err = cursor.One(&ev); err != nil {
+		return nil, err
+	}
+	return &ev, nil
+}
+
+// CalEventGetAll returns events of the topic starting at or after the given time, earliest first.
+func (a *adapter) CalEventGetAll(topic string, since time.Time, limit int) ([]t.CalEvent, error) {
+	return a.calEventsQuery(rdb.DB(a.dbName).Table("calevents").
+		Between([]interface{}{topic, since}, []interface{}{topic, rdb.MaxVal},
+			rdb.BetweenOpts{Index: "Topic_StartAt"}).
+		OrderBy(rdb.OrderByOpts{Index: "Topic_StartAt"}).Limit(limit))
+}
+
+// CalEventGetDue returns events with RemindAt before the given time, earliest first.
+func (a *adapter) CalEventGetDue(before time.Time, limit int) ([]t.CalEvent, error) {
+	return a.calEventsQuery(rdb.DB(a.dbName).Table("calevents").
+		Between(rdb.MinVal, before, rdb.BetweenOpts{Index: "RemindAt"}).
+		OrderBy(rdb.OrderByOpts{Index: "RemindAt"}).Limit(limit))
+}
+
+func (a *adapter) calEventsQuery(query rdb.Term) ([]t.CalEvent, error) {
+	cursor, err := query.Run(a.conn)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+
+	var events []t.CalEvent
+	if err = cursor.All(&events); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+// CalEventRsvp records the response of the user to the event, an empty response removes it.
+func (a *adapter) CalEventRsvp(topic string, seqId int, user t.Uid, resp string) error {
+	q := rdb.DB(a.dbName).Table("calevents").Get(topic + ":" + strconv.Itoa(seqId))
+	var err error
+	if resp == "" {
+		_, err = q.Replace(func(row rdb.Term) interface{} {
+			return row.Without(map[string]interface{}{"Rsvp": map[string]bool{user.String(): true}}).
+				Merge(map[string]interface{}{"UpdatedAt": t.TimeNow()})
+		}).RunWrite(a.conn)
+	} else {
+		_, err = q.Update(map[string]interface{}{
+			"UpdatedAt": t.TimeNow(),
+			"Rsvp":      map[string]string{user.String(): resp}}).RunWrite(a.conn)
+	}
+	return err
+}
+
+// CalEventReminded marks the reminder of the event as sent.
+func (a *adapter) CalEventReminded(topic string, seqId int) error {
+	_, err := rdb.DB(a.dbName).Table("calevents").Get(topic + ":" + strconv.Itoa(seqId)).
+		Replace(func(row rdb.Term) interface{} {
+			return row.Without("RemindAt").Merge(map[string]interface{}{"UpdatedAt": t.TimeNow()})
+		}).RunWrite(a.conn)
+	return err
+}
+
+// PollCreate saves a new poll.
+func (a *adapter) PollCreate(poll *t.Poll) error {
+	_, err := rdb.DB(a.dbName).Table("polls").Insert(poll).RunWrite(a.conn)
+	return err
+}
+
+// PollGet returns the poll created by the message or nil if there is none.
+func (a *adapter) PollGet(topic string, seqId int) (*t.Poll, error) {
+	cursor, err := rdb.DB(a.dbName).Table("polls").Get(topic + ":" + strconv.Itoa(seqId)).Run(a.conn)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+
+	if cursor.IsNil() {
+		return nil, nil
+	}
+
+	var poll t.Poll
+	if err = cursor.One(&poll); err != nil {
+		return nil, err
+	}
+	return &poll, nil
+}
+
+// PollVote records the vote of the user replacing the previous one, an empty vote removes it.
+func (a *adapter) PollVote(topic string, seqId int, user t.Uid, options []int) error {
+	q := rdb.DB(a.dbName).Table("polls").Get(topic + ":" + strconv.Itoa(seqId))
+	var err error
+	if len(options) == 0 {
+		_, err = q.Replace(func(row rdb.Term) interface{} {
+			return row.Without(map[string]interface{}{"Votes": map[string]bool{user.String(): true}}).
+				Merge(map[string]interface{}{"UpdatedAt": t.TimeNow()})
+		}).RunWrite(a.conn)
+	} else {
+		_, err = q.Update(map[string]interface{}{
+			"UpdatedAt": t.TimeNow(),
+			"Votes":     map[string][]int{user.String(): options}}).RunWrite(a.conn)
+	}
+	return err
+}
+
+// ReceiptCreate records that the user has read a range of messages.
+func (a *adapter) ReceiptCreate(rcpt *t.Receipt) error {
+	_, err := rdb.DB(a.dbName).Table("receipts").Insert(rcpt).RunWrite(a.conn)
+	return err
+}
+
+// ReceiptsForMessage returns receipts of all users who have read the message, earliest first.
+func (a *adapter) ReceiptsForMessage(topic string, seqId int) ([]t.Receipt, error) {
+	cursor, err := rdb.DB(a.dbName).Table("receipts").
+		Between([]interface{}{topic, seqId}, []interface{}{topic, rdb.MaxVal},
+			rdb.BetweenOpts{Index: "Topic_SeqTo"}).
+		Filter(rdb.Row.Field("SeqFrom").Le(seqId)).
+		OrderBy("ReadAt").Run(a.conn)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+
+	var receipts []t.Receipt
+	if err = cursor.All(&receipts); err != nil {
+		return nil, err
+	}
+	return receipts, nil
+}
+
+// MentionsCreate records mentions of users and replies in threads started by users.
+func (a *adapter) MentionsCreate(mentions []t.Mention) error {
+	if len(mentions) == 0 {
+		return nil
+	}
+	_, err := rdb.DB(a.dbName).Table("mentions").Insert(mentions).RunWrite(a.conn)
+	return err
+}
+
+// MentionsDelete removes mentions and thread replies of the user in the topic up to and including
+// seqId, all of them if seqId is 0. Returns the number of removed mentions, thread replies are not counted.
+func (a *adapter) MentionsDelete(topic string, user t.Uid, seqId int) (int, error) {
+	var upper interface{} = rdb.MaxVal
+	if seqId > 0 {
+		upper = seqId
+	}
+	q := rdb.DB(a.dbName).Table("mentions").
+		Between([]interface{}{user.String(), topic, rdb.MinVal}, []interface{}{user.String(), topic, upper},
+			rdb.BetweenOpts{Index: "User_Topic_SeqId", RightBound: "closed"})
+	// Mentions are deleted first to count them. Mentions saved before thread replies were added have no 'Thread'.
+	res, err := q.Filter(rdb.Row.Field("Thread").Default(0).Eq(0)).Delete().RunWrite(a.conn)
+	if err != nil {
+		return 0, err
+	}
+	if _, err = q.Delete().RunWrite(a.conn); err != nil {
+		return 0, err
+	}
+	return res.Deleted, nil
+}
+
+// MentionsCount returns the number of unread mentions of the user across all topics.
+func (a *adapter) MentionsCount(user t.Uid) (int, error) {
+	cursor, err := rdb.DB(a.dbName).Table("mentions").
+		Between([]interface{}{user.String(), rdb.MinVal, rdb.MinVal},
+			[]interface{}{user.String(), rdb.MaxVal, rdb.MaxVal},
+			rdb.BetweenOpts{Index: "User_Topic_SeqId"}).
+		Filter(rdb.Row.Field("Thread").Default(0).Eq(0)).
+		Count().Run(a.conn)
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close()
+
+	var count int
+	err = cursor.One(&count)
+	return count, err
+}
+
+// MentionsGetAll returns unread mentions and thread replies of the user across all topics, newest first.
+func (a *adapter) MentionsGetAll(user t.Uid, limit int) ([]t.Mention, error) {
+	cursor, err := rdb.DB(a.dbName).Table("mentions").
+		Between([]interface{}{user.String(), rdb.MinVal, rdb.MinVal},
+			[]interface{}{user.String(), rdb.MaxVal, rdb.MaxVal},
+			rdb.BetweenOpts{Index: "User_Topic_SeqId"}).
+		// Mentions saved before thread replies were added have no 'CreatedAt'.
+		OrderBy(rdb.Desc(rdb.Row.Field("CreatedAt").Default(0))).Limit(limit).Run(a.conn)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+
+	var mentions []t.Mention
+	if err = cursor.All(&mentions); err != nil {
+		return nil, err
+	}
+	return mentions, nil
+}
+
+// BookmarkCreate saves the bookmark, does nothing if the message is already starred by the user.
+func (a *adapter) BookmarkCreate(bm *t.Bookmark) error {
+	_, err := rdb.DB(a.dbName).Table("bookmarks").Insert(bm).RunWrite(a.conn)
+	if rdb.IsConflictErr(err) {
+		return nil
+	}
+	return err
+}
+
+// BookmarkDelete removes the bookmark of the message.
+func (a *adapter) BookmarkDelete(user t.Uid, topic string, seqId int) error {
+	_, err := rdb.DB(a.dbName).Table("bookmarks").Get(user.String() + ":" + topic + ":" + strconv.Itoa(seqId)).
+		Delete().RunWrite(a.conn)
+	return err
+}
+
+// BookmarkGetAll returns bookmarks of the user, newest first.
+func (a *adapter) BookmarkGetAll(user t.Uid, limit int) ([]t.Bookmark, error) {
+	cursor, err := rdb.DB(a.dbName).Table("bookmarks").GetAllByIndex("User", user.String()).
+		OrderBy(rdb.Desc("CreatedAt")).Limit(limit).Run(a.conn)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+
+	var bookmarks []t.Bookmark
+	if err = cursor.All(&bookmarks); err != nil {
+		return nil, err
+	}
+	return bookmarks, nil
+}
+
+// ViewOnceCreate marks files attached to a message as view-once.
+func (a *adapter) ViewOnceCreate(vos []t.ViewOnce) error {
+	if len(vos) == 0 {
+		return nil
+	}
+	_, err := rdb.DB(a.dbName).Table("viewonce").Insert(vos).RunWrite(a.conn)
+	if rdb.IsConflictErr(err) {
+		return nil
+	}
+	return err
+}
+
+// ViewOnceGet returns the view-once mark of the file, nil if the file is not view-once.
+func (a *adapter) ViewOnceGet(fid string) (*t.ViewOnce, error) {
+	cursor, err := rdb.DB(a.dbName).Table("viewonce").Get(fid).Run(a.conn)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+
+	if cursor.IsNil() {
+		return nil, nil
+	}
+
+	var vo t.ViewOnce
+	if err = cursor.One(&vo); err != nil {
+		return nil, err
+	}
+	return &vo, nil
+}
+
+// ViewOnceView records that the user has retrieved the file. Returns false if the user
+// has retrieved it before.
+func (a *adapter) ViewOnceView(view *t.ViewOnceView) (bool, error) {
+	_, err := rdb.DB(a.dbName).Table("viewoncelog").Insert(view).RunWrite(a.conn)
+	if rdb.IsConflictErr(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// AccountEventCreate saves a security-related event of the user's account.
+func (a *adapter) AccountEventCreate(ev *t.AccountEvent) error {
+	_, err := rdb.DB(a.dbName).Table("accountevents").Insert(ev).RunWrite(a.conn)
+	return err
+}
+
+// AccountEventGetAll returns events of the user, newest first.
+func (a *adapter) AccountEventGetAll(user t.Uid, limit int) ([]t.AccountEvent, error) {
+	cursor, err := rdb.DB(a.dbName).Table("accountevents").GetAllByIndex("User", user.String()).
+		OrderBy(rdb.Desc("CreatedAt")).Limit(limit).Run(a.conn)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+
+	var events []t.AccountEvent
+	if err = cursor.All(&events); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+// AccountEventDeleteOlder deletes events of all users created before the given time.
+func (a *adapter) AccountEventDeleteOlder(before time.Time) (int, error) {
+	res, err := rdb.DB(a.dbName).Table("accountevents").
+		Between(rdb.MinVal, before, rdb.BetweenOpts{Index: "CreatedAt"}).
+		Delete().RunWrite(a.conn)
+	return res.Deleted, err
+}
+
+// fileChangeUseCounter adds delta to use counters of the given files.
+func (a *adapter) fileChangeUseCounter(fids []string, delta int) error {
+	if len(fids) == 0 {
+		return nil
+	}
+
+	ids := make([]interface{}, len(fids))
+	for i, id := range fids {
+		ids[i] = id
+	}
+	_, err := rdb.DB(a.dbName).Table("fileuploads").GetAll(ids...).
+		Update(map[string]interface{}{
+			"UpdatedAt": t.TimeNow(),
+			"UseCount":  rdb.Row.Field("UseCount").Default(0).Add(delta),
+		}).RunWrite(a.conn)
+	return err
+}
+
 // Given a select query against 'messages' table, decrement corresponding use counter in 'fileuploads' table.
 func (a *adapter) fileDecrementUseCounter(msgQuery rdb.Term) error {
 	/*
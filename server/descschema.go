@@ -0,0 +1,303 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *    Validation of public, private and trusted values of users and topics
+ *    against the schemas defined in the config for each topic category.
+ *    Schemas use a subset of JSON Schema: type, enum, properties, required,
+ *    additionalProperties, maxProperties, items, minItems, maxItems,
+ *    minLength, maxLength, pattern, minimum and maximum.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"regexp"
+	"strconv"
+	"unicode/utf8"
+
+	"github.com/tinode/chat/server/store/types"
+)
+
+// descSchemaTypes is a list of allowed JSON types of the value: a single string or an array of strings in the config.
+type descSchemaTypes []string
+
+// UnmarshalJSON reads the type as a string or an array of strings.
+func (st *descSchemaTypes) UnmarshalJSON(data []byte) error {
+	var one string
+	if err := json.Unmarshal(data, &one); err == nil {
+		*st = descSchemaTypes{one}
+		return nil
+	}
+	var many []string
+	if err := json.Unmarshal(data, &many); err != nil {
+		return err
+	}
+	*st = many
+	return nil
+}
+
+// descSchema is a schema of a value.
+type descSchema struct {
+	Type       descSchemaTypes        `json:"type"`
+	Enum       []interface{}          `json:"enum"`
+	Properties map[string]*descSchema `json:"properties"`
+	Required   []string               `json:"required"`
+	// Either false or a schema of properties not listed in Properties.
+	AdditionalProperties json.RawMessage `json:"additionalProperties"`
+	MaxProperties        *int            `json:"maxProperties"`
+	Items                *descSchema     `json:"items"`
+	MinItems             *int            `json:"minItems"`
+	MaxItems             *int            `json:"maxItems"`
+	MinLength            *int            `json:"minLength"`
+	MaxLength            *int            `json:"maxLength"`
+	Pattern              string          `json:"pattern"`
+	Minimum              *float64        `json:"minimum"`
+	Maximum              *float64        `json:"maximum"`
+	// Annotations, ignored.
+	Title       string `json:"title"`
+	Description string `json:"description"`
+
+	pattern *regexp.Regexp
+	// Additional properties are not allowed.
+	noAdditional bool
+	additional   *descSchema
+}
+
+// UnmarshalJSON parses the schema and rejects keywords which are not supported.
+func (s *descSchema) UnmarshalJSON(data []byte) error {
+	type schemaAlias descSchema
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode((*schemaAlias)(s)); err != nil {
+		return err
+	}
+
+	for _, typ := range s.Type {
+		switch typ {
+		case "object", "array", "string", "number", "integer", "boolean", "null":
+		default:
+			return errors.New("unknown type '" + typ + "'")
+		}
+	}
+	if s.Pattern != "" {
+		var err error
+		if s.pattern, err = regexp.Compile(s.Pattern); err != nil {
+			return err
+		}
+	}
+	if len(s.AdditionalProperties) > 0 {
+		var allowed bool
+		if err := json.Unmarshal(s.AdditionalProperties, &allowed); err == nil {
+			s.noAdditional = !allowed
+		} else if err = json.Unmarshal(s.AdditionalProperties, &s.additional); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// descSchemaParse parses the schemas from the config. Returns the schemas keyed by the topic category
+// ("me", "p2p", "grp") then by the field ("public", "private", "trusted").
+func descSchemaParse(jsconf json.RawMessage) (map[string]map[string]*descSchema, error) {
+	schemas := make(map[string]map[string]*descSchema)
+	if len(jsconf) > 0 {
+		if err := json.Unmarshal(jsconf, &schemas); err != nil {
+			return nil, errors.New("failed to parse config: " + err.Error())
+		}
+	}
+
+	for cat, fields := range schemas {
+		switch cat {
+		case "me", "p2p", "grp":
+		default:
+			return nil, errors.New("unknown topic category '" + cat + "'")
+		}
+		for field := range fields {
+			switch field {
+			case "public", "private", "trusted":
+			default:
+				return nil, errors.New("unknown field '" + field + "' of '" + cat + "'")
+			}
+		}
+	}
+
+	return schemas, nil
+}
+
+// descSchemaCheck validates public, private and trusted values of the topic category. Nil values are not
+// checked. Returns the name of the first invalid field and the reason.
+func descSchemaCheck(cat types.TopicCat, public, private, trusted interface{}) (string, error) {
+	var name string
+	switch cat {
+	case types.TopicCatMe:
+		name = "me"
+	case types.TopicCatP2P:
+		name = "p2p"
+	case types.TopicCatGrp:
+		name = "grp"
+	default:
+		return "", nil
+	}
+
+	fields := liveConfig().descSchemas[name]
+
+	if len(fields) == 0 {
+		return "", nil
+	}
+	for _, field := range []struct {
+		name string
+		val  interface{}
+	}{{"public", public}, {"private", private}, {"trusted", trusted}} {
+		if schema := fields[field.name]; schema != nil && field.val != nil {
+			if err := schema.validate("", field.val); err != nil {
+				return field.name, err
+			}
+		}
+	}
+	return "", nil
+}
+
+// descSchemaType returns the JSON type of the value.
+func descSchemaType(val interface{}) string {
+	switch val.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	case float64, float32, int, int32, int64, json.Number:
+		return "number"
+	}
+	return ""
+}
+
+// descSchemaNumber converts the number to float64.
+func descSchemaNumber(val interface{}) float64 {
+	switch v := val.(type) {
+	case float64:
+		return v
+	case float32:
+		return float64(v)
+	case int:
+		return float64(v)
+	case int32:
+		return float64(v)
+	case int64:
+		return float64(v)
+	case json.Number:
+		f, _ := v.Float64()
+		return f
+	}
+	return 0
+}
+
+// validate checks the value against the schema. The path is the location of the value, like "/photo/type".
+func (s *descSchema) validate(path string, val interface{}) error {
+	fail := func(msg string) error {
+		if path == "" {
+			return errors.New(msg)
+		}
+		return errors.New(path + ": " + msg)
+	}
+
+	typ := descSchemaType(val)
+	if len(s.Type) > 0 {
+		ok := false
+		for _, want := range s.Type {
+			if want == typ || (want == "integer" && typ == "number" &&
+				descSchemaNumber(val) == float64(int64(descSchemaNumber(val)))) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return fail("must be " + s.Type[0])
+		}
+	}
+
+	if len(s.Enum) > 0 {
+		ok := false
+		for _, allowed := range s.Enum {
+			if reflect.DeepEqual(allowed, val) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return fail("value is not allowed")
+		}
+	}
+
+	switch v := val.(type) {
+	case string:
+		length := utf8.RuneCountInString(v)
+		if s.MinLength != nil && length < *s.MinLength {
+			return fail("shorter than " + strconv.Itoa(*s.MinLength))
+		}
+		if s.MaxLength != nil && length > *s.MaxLength {
+			return fail("longer than " + strconv.Itoa(*s.MaxLength))
+		}
+		if s.pattern != nil && !s.pattern.MatchString(v) {
+			return fail("does not match pattern")
+		}
+	case []interface{}:
+		if s.MinItems != nil && len(v) < *s.MinItems {
+			return fail("fewer than " + strconv.Itoa(*s.MinItems) + " items")
+		}
+		if s.MaxItems != nil && len(v) > *s.MaxItems {
+			return fail("more than " + strconv.Itoa(*s.MaxItems) + " items")
+		}
+		if s.Items != nil {
+			for i, item := range v {
+				if err := s.Items.validate(path+"/"+strconv.Itoa(i), item); err != nil {
+					return err
+				}
+			}
+		}
+	case map[string]interface{}:
+		if s.MaxProperties != nil && len(v) > *s.MaxProperties {
+			return fail("more than " + strconv.Itoa(*s.MaxProperties) + " properties")
+		}
+		for _, name := range s.Required {
+			if _, ok := v[name]; !ok {
+				return fail("missing '" + name + "'")
+			}
+		}
+		for name, prop := range v {
+			if schema, ok := s.Properties[name]; ok {
+				if err := schema.validate(path+"/"+name, prop); err != nil {
+					return err
+				}
+			} else if s.noAdditional {
+				return fail("unexpected '" + name + "'")
+			} else if s.additional != nil {
+				if err := s.additional.validate(path+"/"+name, prop); err != nil {
+					return err
+				}
+			}
+		}
+	default:
+		if typ == "number" {
+			num := descSchemaNumber(val)
+			if s.Minimum != nil && num < *s.Minimum {
+				return fail("less than " + strconv.FormatFloat(*s.Minimum, 'g', -1, 64))
+			}
+			if s.Maximum != nil && num > *s.Maximum {
+				return fail("greater than " + strconv.FormatFloat(*s.Maximum, 'g', -1, 64))
+			}
+		}
+	}
+
+	return nil
+}
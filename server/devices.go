@@ -0,0 +1,105 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *    Push tokens of users' devices: pruning of dead tokens and the device
+ *    inventory for administrators.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"github.com/tinode/chat/server/auth"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+// Number of trailing characters of a push token shown to administrators.
+const deviceIdVisibleChars = 8
+
+// devicesRunStaleGc periodically deletes push tokens which failed maxFailures times in a row or
+// whose devices have not logged in for longer than maxIdle. The deletion is idempotent, every cluster
+// node runs it.
+func devicesRunStaleGc(period time.Duration, maxFailures int, maxIdle time.Duration) chan<- bool {
+	// Unbuffered stop channel. Whoever stops it must wait for the process to finish.
+	stop := make(chan bool)
+	go func() {
+		gcTimer := time.Tick(period)
+		for {
+			select {
+			case <-gcTimer:
+				count, err := store.Devices.DeleteStale(maxFailures, time.Now().Add(-maxIdle))
+				if err != nil {
+					log.Println("stale devices gc:", err)
+				} else if count > 0 {
+					log.Println("stale devices gc: pruned devices of", count, "users")
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	return stop
+}
+
+// deviceIdMask hides all but the last few characters of the push token.
+func deviceIdMask(id string) string {
+	if len(id) <= deviceIdVisibleChars {
+		return id
+	}
+	return "…" + id[len(id)-deviceIdVisibleChars:]
+}
+
+// replyGetDevices returns devices of the user registered for push notifications, 'sys' topic only, root only.
+func (t *Topic) replyGetDevices(sess *Session, asUid types.Uid, authLevel auth.Level, req *MsgGetOpts, msg *ClientComMessage) error {
+	now := types.TimeNow()
+
+	if t.cat != types.TopicCatSys || authLevel != auth.LevelRoot {
+		sess.queueOut(ErrPermissionDeniedReply(msg, now))
+		return errors.New("get.devices: root access required")
+	}
+
+	var uid types.Uid
+	if req != nil {
+		uid = types.ParseUserId(req.User)
+	}
+	if uid.IsZero() {
+		sess.queueOut(ErrMalformedReply(msg, now))
+		return errors.New("get.devices: invalid user")
+	}
+
+	all, _, err := store.Devices.GetAll(uid)
+	if err != nil {
+		sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, t.original(asUid), now, msg.Timestamp, nil))
+		return err
+	}
+	if len(all[uid]) == 0 {
+		sess.queueOut(NoContentParamsReply(msg, now, map[string]string{"what": "devices"}))
+		return nil
+	}
+
+	devices := make([]MsgDevice, 0, len(all[uid]))
+	for i := range all[uid] {
+		dd := &all[uid][i]
+		lastSeen := dd.LastSeen
+		devices = append(devices, MsgDevice{
+			DeviceId:     deviceIdMask(dd.DeviceId),
+			Platform:     dd.Platform,
+			Lang:         dd.Lang,
+			LastSeen:     &lastSeen,
+			LastPush:     dd.LastPushAt,
+			PushFailures: dd.PushFailures,
+		})
+	}
+
+	sess.queueOut(&ServerComMessage{
+		Meta: &MsgServerMeta{Id: msg.Id, Topic: t.original(asUid), Timestamp: &now, Devices: devices}})
+
+	return nil
+}
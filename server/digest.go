@@ -0,0 +1,272 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *    Periodic digests of channels: readers get one push notification which
+ *    summarizes new messages instead of a notification for every message.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/tinode/chat/server/drafty"
+	"github.com/tinode/chat/server/push"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+const (
+	// How often to check for digests which are due.
+	digestCheckPeriod = time.Minute
+	// Maximum number of digests sent in one pass.
+	digestBlockSize = 100
+
+	// Minimum and maximum interval between digests, minutes.
+	digestMinPeriod = 15
+	digestMaxPeriod = 7 * 24 * 60
+	// Default and maximum number of messages in a digest.
+	digestDefaultLimit = 5
+	digestMaxLimit     = 20
+	// Maximum length of one message in a digest, runes.
+	digestMaxLine = 80
+
+	minutesPerDay = 24 * 60
+)
+
+// digestQuietUntil returns the end of the reader's quiet hours if the given time falls within them,
+// zero time otherwise.
+func digestQuietUntil(dg *types.Digest, at time.Time) time.Time {
+	return quietHoursUntil(dg.QuietStart, dg.QuietEnd, dg.TzOffset, at)
+}
+
+// digestNextAt returns the time when the digest following the one sent at the given time is due.
+func digestNextAt(dg *types.Digest, from time.Time) time.Time {
+	next := from.Add(time.Duration(dg.Period) * time.Minute)
+	if until := digestQuietUntil(dg, next); !until.IsZero() {
+		return until
+	}
+	return next
+}
+
+// digestsRun periodically sends digests which are due. Digests are sent by the cluster node
+// which owns the reader.
+func digestsRun(period time.Duration, block int) chan<- bool {
+	// Unbuffered stop channel. Whoever stops it must wait for the process to finish.
+	stop := make(chan bool)
+	go func() {
+		timer := time.Tick(period)
+		for {
+			select {
+			case <-timer:
+				now := types.TimeNow()
+				digests, err := store.Digests.GetDue(now, block)
+				if err != nil {
+					log.Println("digests:", err)
+					continue
+				}
+				for i := range digests {
+					if globals.cluster.isRemoteTopic(types.ParseUid(digests[i].User).UserId()) {
+						continue
+					}
+					digestSend(&digests[i], now)
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	return stop
+}
+
+// digestSend sends a push notification with new messages of the channel to the reader
+// and schedules the next digest.
+func digestSend(dg *types.Digest, now time.Time) {
+	uid := types.ParseUid(dg.User)
+
+	sub, err := store.Subs.Get(dg.Topic, uid)
+	if err != nil {
+		log.Println("digests: failed to get subscription", dg.Topic, uid.UserId(), err)
+		return
+	}
+	if sub == nil || !(sub.ModeWant & sub.ModeGiven).IsReader() {
+		// The reader has left the channel.
+		if err := store.Digests.Delete(dg.Topic, uid); err != nil {
+			log.Println("digests: failed to delete digest", dg.Topic, uid.UserId(), err)
+		}
+		return
+	}
+
+	if until := digestQuietUntil(dg, now); !until.IsZero() {
+		// Hold the digest until the end of quiet hours.
+		dg.NextAt = until
+		if err := store.Digests.Upsert(dg); err != nil {
+			log.Println("digests: failed to reschedule digest", dg.Topic, uid.UserId(), err)
+		}
+		return
+	}
+
+	// Newest messages first.
+	messages, err := store.Messages.GetAll(types.ChnToGrp(dg.Topic), uid,
+		&types.QueryOpt{Since: dg.SeqId + 1, Limit: dg.Limit})
+	if err != nil {
+		log.Println("digests: failed to get messages", dg.Topic, err)
+		return
+	}
+
+	if len(messages) > 0 {
+		latest := &messages[0]
+		labels := i18nDraftyLabels(i18nUserLang(uid))
+		// The organization of the reader is not known outside of a session: the default rule applies.
+		mask := maskingRuleOf("", dg.Topic, 0, true)
+		var lines []string
+		for i := len(messages) - 1; i >= 0; i-- {
+			mm := &messages[i]
+			if mime, _ := mm.Head["mime"].(string); mm.From == "" && mime == sysEventMime {
+				continue
+			}
+			line, err := drafty.ToPlainTextLabels(mask.stored(mm, uid), labels)
+			if err != nil || line == "" {
+				continue
+			}
+			if runes := []rune(line); len(runes) > digestMaxLine {
+				line = string(runes[:digestMaxLine]) + "…"
+			}
+			lines = append(lines, line)
+		}
+
+		// Readers who turned off notifications or opted out of promotional pushes don't get digests either.
+		consent := consentGet(uid)
+		if len(lines) > 0 && (sub.ModeWant & sub.ModeGiven).IsPresencer() && consent.AllowsMarketing() {
+			rcpt := &push.Receipt{
+				To: map[types.Uid]push.Recipient{uid: {}},
+				Payload: push.Payload{
+					What:      push.ActDigest,
+					Topic:     dg.Topic,
+					Timestamp: latest.CreatedAt,
+					SeqId:     latest.SeqId,
+					Count:     latest.SeqId - dg.SeqId,
+					Content:   strings.Join(lines, "\n"),
+					Link:      permalinkMake(types.ChnToGrp(dg.Topic), latest.SeqId)}}
+			usersPush(rcpt)
+		}
+		dg.SeqId = latest.SeqId
+	}
+
+	dg.NextAt = digestNextAt(dg, now)
+	if err := store.Digests.Upsert(dg); err != nil {
+		log.Println("digests: failed to reschedule digest", dg.Topic, uid.UserId(), err)
+	}
+}
+
+// digestActive checks if the channel reader receives digests.
+func digestActive(topic string, uid types.Uid) bool {
+	dg, err := store.Digests.Get(topic, uid)
+	if err != nil {
+		log.Println("digests: failed to get digest", topic, uid.UserId(), err)
+	}
+	return dg != nil
+}
+
+// replyGetDigest returns the digest schedule of the channel reader.
+func (t *Topic) replyGetDigest(sess *Session, asUid types.Uid, msg *ClientComMessage) error {
+	now := types.TimeNow()
+
+	if asChan, err := t.verifyChannelAccess(msg.Original); err != nil || !asChan || asUid.IsZero() {
+		sess.queueOut(ErrOperationNotAllowedReply(msg, now))
+		return errors.New("get.digest: not a channel reader")
+	}
+
+	dg, err := store.Digests.Get(msg.Original, asUid)
+	if err != nil {
+		sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, msg.Original, now, msg.Timestamp, nil))
+		return err
+	}
+	if dg == nil {
+		sess.queueOut(NoContentParamsReply(msg, now, map[string]string{"what": "digest"}))
+		return nil
+	}
+
+	sess.queueOut(&ServerComMessage{
+		Meta: &MsgServerMeta{Id: msg.Id, Topic: msg.Original, Timestamp: &now,
+			Digest: &MsgDigest{Period: dg.Period, Limit: dg.Limit, QuietStart: dg.QuietStart,
+				QuietEnd: dg.QuietEnd, Tz: dg.TzOffset}}})
+
+	return nil
+}
+
+// replySetDigest turns digests of the channel on or off for the reader or changes their schedule.
+// Readers with digests don't get push notifications for individual messages.
+func (t *Topic) replySetDigest(sess *Session, asUid types.Uid, msg *ClientComMessage) error {
+	now := types.TimeNow()
+
+	if asChan, err := t.verifyChannelAccess(msg.Original); err != nil || !asChan || asUid.IsZero() {
+		sess.queueOut(ErrOperationNotAllowedReply(msg, now))
+		return errors.New("set.digest: not a channel reader")
+	}
+
+	req := msg.Set.Digest
+	if req.Limit == 0 {
+		req.Limit = digestDefaultLimit
+	}
+	if req.Period != 0 && (req.Period < digestMinPeriod || req.Period > digestMaxPeriod ||
+		req.Limit < 0 || req.Limit > digestMaxLimit ||
+		!quietHoursValid(req.QuietStart, req.QuietEnd, req.Tz)) {
+		sess.queueOut(ErrMalformedReply(msg, now))
+		return errors.New("set.digest: invalid schedule")
+	}
+
+	sub, err := store.Subs.Get(msg.Original, asUid)
+	if err == nil && sub == nil {
+		err = types.ErrNotFound
+	}
+	if err != nil {
+		sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, msg.Original, now, msg.Timestamp, nil))
+		return err
+	}
+
+	if req.Period == 0 {
+		if err := store.Digests.Delete(msg.Original, asUid); err != nil {
+			sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, msg.Original, now, msg.Timestamp, nil))
+			return err
+		}
+		// Resume notifications for individual messages.
+		t.channelSubUnsub(asUid, sub.ModeWant.IsPresencer())
+		sess.queueOut(NoErrReply(msg, now))
+		return nil
+	}
+
+	dg, err := store.Digests.Get(msg.Original, asUid)
+	if err != nil {
+		sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, msg.Original, now, msg.Timestamp, nil))
+		return err
+	}
+	if dg == nil {
+		// The first digest covers messages published from now on.
+		dg = &types.Digest{User: asUid.String(), Topic: msg.Original, SeqId: t.lastID}
+	}
+	dg.Period = req.Period
+	dg.Limit = req.Limit
+	dg.QuietStart = req.QuietStart
+	dg.QuietEnd = req.QuietEnd
+	dg.TzOffset = req.Tz
+	dg.NextAt = digestNextAt(dg, now)
+
+	if err := store.Digests.Upsert(dg); err != nil {
+		sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, msg.Original, now, msg.Timestamp, nil))
+		return err
+	}
+
+	// Stop notifications for individual messages.
+	t.channelSubUnsub(asUid, false)
+
+	sess.queueOut(NoErrReply(msg, now))
+
+	return nil
+}
@@ -0,0 +1,157 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *    Directory of topics: the 'fnd' topic lists active group topics and
+ *    channels which have a category tag such as 'category:sports', sorted by
+ *    the time of the last message or by the number of members, one page at
+ *    a time. The cursor of the next page is opaque to the client.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+const (
+	// Namespace of category tags.
+	directoryTagNS = "category"
+
+	// Sort orders of the directory.
+	directorySortActivity = "activity"
+	directorySortMembers  = "members"
+
+	// Number of topics on a page if the client has not asked for a specific number.
+	directoryDefaultLimit = 24
+	// Maximum number of topics on a page.
+	directoryMaxLimit = 100
+)
+
+// directoryCursor is the position of the last topic on the page, serialized into the cursor.
+type directoryCursor struct {
+	Sort      string    `json:"s"`
+	Name      string    `json:"n"`
+	Members   int       `json:"m,omitempty"`
+	TouchedAt time.Time `json:"t"`
+}
+
+// directoryCursorEncode serializes the position of the topic in the directory.
+func directoryCursorEncode(sort string, topic *types.Topic) string {
+	data, _ := json.Marshal(&directoryCursor{
+		Sort:      sort,
+		Name:      topic.Id,
+		Members:   topic.Stats.Members,
+		TouchedAt: topic.TouchedAt})
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// directoryCursorDecode parses the cursor of the page. The cursor must be issued for the same sort order.
+func directoryCursorDecode(sort, cursor string) (*types.TopicDirectoryCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, err
+	}
+	var cur directoryCursor
+	if err = json.Unmarshal(data, &cur); err != nil {
+		return nil, err
+	}
+	if cur.Sort != sort || cur.Name == "" {
+		return nil, errors.New("cursor does not match the query")
+	}
+	return &types.TopicDirectoryCursor{Name: cur.Name, Members: cur.Members, TouchedAt: cur.TouchedAt}, nil
+}
+
+// replyGetDirectory sends one page of topics listed under the category, 'fnd' only.
+func (t *Topic) replyGetDirectory(sess *Session, asUid types.Uid, req *MsgGetDirectory, msg *ClientComMessage) error {
+	now := types.TimeNow()
+
+	if t.cat != types.TopicCatFnd {
+		sess.queueOut(ErrOperationNotAllowedReply(msg, now))
+		return errors.New("get.directory: invalid topic category")
+	}
+	if req == nil {
+		sess.queueOut(ErrMalformedReply(msg, now))
+		return errors.New("get.directory: missing parameters")
+	}
+
+	category := strings.ToLower(strings.TrimSpace(req.Category))
+	tag := directoryTagNS + ":" + category
+	if category == "" || len(normalizeTags([]string{tag})) != 1 {
+		sess.queueOut(ErrMalformedReply(msg, now))
+		return errors.New("get.directory: invalid category")
+	}
+
+	sort := req.Sort
+	if sort == "" {
+		sort = directorySortActivity
+	}
+	if (sort != directorySortActivity && sort != directorySortMembers) || req.Limit < 0 {
+		sess.queueOut(ErrMalformedReply(msg, now))
+		return errors.New("get.directory: invalid sort order or limit")
+	}
+	limit := req.Limit
+	if limit == 0 {
+		limit = directoryDefaultLimit
+	} else if limit > directoryMaxLimit {
+		limit = directoryMaxLimit
+	}
+
+	// Topics rated for adults are hidden from minors.
+	query := &types.TopicDirectoryQuery{Tag: tag, ByMembers: sort == directorySortMembers,
+		Exclude: t.contentFindExclude(now), Limit: limit}
+	if req.Cursor != "" {
+		after, err := directoryCursorDecode(sort, req.Cursor)
+		if err != nil {
+			sess.queueOut(ErrMalformedReply(msg, now))
+			return errors.New("get.directory: invalid cursor; " + err.Error())
+		}
+		query.After = after
+	}
+
+	topics, err := store.Topics.GetDirectory(query)
+	if err != nil {
+		sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, t.original(asUid), now, msg.Timestamp, nil))
+		return err
+	}
+
+	page := MsgDirectory{Topics: make([]MsgDirectoryTopic, 0, len(topics))}
+	for i := range topics {
+		topic := &topics[i]
+		item := MsgDirectoryTopic{
+			Topic:     topic.Id,
+			CreatedAt: &topic.CreatedAt,
+			Public:    topic.Public,
+			Members:   topic.Stats.Members,
+		}
+		if topic.UseBt {
+			item.Topic = types.GrpToChn(topic.Id)
+		}
+		if !topic.TouchedAt.IsZero() {
+			item.TouchedAt = &topic.TouchedAt
+		}
+		page.Topics = append(page.Topics, item)
+	}
+	// The page is full: there may be more topics after the last one.
+	if len(topics) == limit {
+		page.Cursor = directoryCursorEncode(sort, &topics[len(topics)-1])
+	}
+
+	if len(page.Topics) == 0 && page.Cursor == "" {
+		sess.queueOut(NoContentParamsReply(msg, now, map[string]string{"what": "directory"}))
+		return nil
+	}
+
+	sess.queueOut(&ServerComMessage{
+		Meta: &MsgServerMeta{Id: msg.Id, Topic: t.original(asUid), Timestamp: &now, Directory: &page}})
+
+	return nil
+}
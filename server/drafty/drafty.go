@@ -37,10 +37,22 @@ var tags = map[string]spanfmt{
 	"EX": {"", true},
 }
 
+// Default names of attachments in plain text.
+var defaultLabels = map[string]string{
+	"IM": "IMAGE",
+	"EX": "FILE",
+}
+
 // ToPlainText converts message payload from Drafy format to string.
 // If content is plain string, then it's returned unchanged. If content is not recognized
 // as either Drafy (as a map[string]interface{}) or as a string, an error is returned.
 func ToPlainText(content interface{}) (string, error) {
+	return ToPlainTextLabels(content, nil)
+}
+
+// ToPlainTextLabels is ToPlainText with names of attachments in plain text replaced by labels,
+// e.g. translated names. The keys are entity types "IM" and "EX". Missing labels use the default names.
+func ToPlainTextLabels(content interface{}, labels map[string]string) (string, error) {
 	if content == nil {
 		return "", nil
 	}
@@ -120,10 +132,10 @@ func ToPlainText(content interface{}) (string, error) {
 		return spans[i].at < spans[j].at
 	})
 
-	return forEach([]rune(txt), 0, textLen, spans), nil
+	return forEach([]rune(txt), 0, textLen, spans, labels), nil
 }
 
-func forEach(line []rune, start, end int, spans []*span) string {
+func forEach(line []rune, start, end int, spans []*span, labels map[string]string) string {
 	// Process ranges calling formatter for each range.
 	var result []string
 	for i := 0; i < len(spans); i++ {
@@ -131,13 +143,13 @@ func forEach(line []rune, start, end int, spans []*span) string {
 
 		if sp.at < 0 {
 			// Attachment
-			result = append(result, formatter(sp.tp, sp.data, ""))
+			result = append(result, formatter(sp.tp, sp.data, "", labels))
 			continue
 		}
 
 		// Add un-styled range before the styled span starts.
 		if start < sp.at {
-			result = append(result, formatter("", nil, string(line[start:sp.at])))
+			result = append(result, formatter("", nil, string(line[start:sp.at]), labels))
 			start = sp.at
 		}
 		// Get all spans which are within current span.
@@ -149,22 +161,22 @@ func forEach(line []rune, start, end int, spans []*span) string {
 
 		tag := tags[sp.tp]
 		if tag.isVoid {
-			result = append(result, formatter(sp.tp, sp.data, ""))
+			result = append(result, formatter(sp.tp, sp.data, "", labels))
 		} else {
-			result = append(result, formatter(sp.tp, sp.data, forEach(line, start, sp.end, subspans)))
+			result = append(result, formatter(sp.tp, sp.data, forEach(line, start, sp.end, subspans, labels), labels))
 		}
 		start = sp.end
 	}
 
 	// Add the last unformatted range.
 	if start < end {
-		result = append(result, formatter("", nil, string(line[start:end])))
+		result = append(result, formatter("", nil, string(line[start:end]), labels))
 	}
 
 	return strings.Join(result, "")
 }
 
-func formatter(tp string, data map[string]interface{}, value string) string {
+func formatter(tp string, data map[string]interface{}, value string, labels map[string]string) string {
 	switch tp {
 	case "ST", "EM", "DL", "CO":
 		return tags[tp].dec + value + tags[tp].dec
@@ -178,13 +190,96 @@ func formatter(tp string, data map[string]interface{}, value string) string {
 		return value
 	case "BR":
 		return "\n"
-	case "IM":
-		name, _ := data["name"].(string)
-		return "[IMAGE '" + name + "']"
-	case "EX":
+	case "IM", "EX":
+		label := labels[tp]
+		if label == "" {
+			label = defaultLabels[tp]
+		}
 		name, _ := data["name"].(string)
-		return "[FILE '" + name + "']"
+		return "[" + label + " '" + name + "']"
 	default:
 		return value
 	}
 }
+
+// Mentions returns distinct values of mention entities in a Drafty document, i.e. IDs of
+// the mentioned users, in order of appearance. Plain strings and unrecognized content have no mentions.
+func Mentions(content interface{}) []string {
+	drafty, _ := content.(map[string]interface{})
+	ent, _ := drafty["ent"].([]interface{})
+
+	var mentions []string
+	seen := make(map[string]bool)
+	for i := range ent {
+		e, _ := ent[i].(map[string]interface{})
+		if tp, _ := e["tp"].(string); tp != "MN" {
+			continue
+		}
+		data, _ := e["data"].(map[string]interface{})
+		val, _ := data["val"].(string)
+		if val == "" || seen[val] {
+			continue
+		}
+		seen[val] = true
+		mentions = append(mentions, val)
+	}
+	return mentions
+}
+
+// Attachments returns the number of inline images and attached files in a Drafty document.
+// Plain strings and unrecognized content have no attachments.
+func Attachments(content interface{}) int {
+	drafty, _ := content.(map[string]interface{})
+	ent, _ := drafty["ent"].([]interface{})
+
+	count := 0
+	for i := range ent {
+		e, _ := ent[i].(map[string]interface{})
+		if tp, _ := e["tp"].(string); tp == "IM" || tp == "EX" {
+			count++
+		}
+	}
+	return count
+}
+
+// AttachmentMime returns the MIME type of the first image, video, audio or file attached to a Drafty document.
+// Returns an empty string if there are no attachments or the type is unknown.
+func AttachmentMime(content interface{}) string {
+	drafty, _ := content.(map[string]interface{})
+	ent, _ := drafty["ent"].([]interface{})
+
+	for i := range ent {
+		e, _ := ent[i].(map[string]interface{})
+		switch tp, _ := e["tp"].(string); tp {
+		case "IM", "EX", "VD", "AU":
+			data, _ := e["data"].(map[string]interface{})
+			mime, _ := data["mime"].(string)
+			return strings.ToLower(mime)
+		}
+	}
+	return ""
+}
+
+// Links returns distinct URLs of link entities in a Drafty document in order of appearance.
+// Plain strings and unrecognized content have no link entities.
+func Links(content interface{}) []string {
+	drafty, _ := content.(map[string]interface{})
+	ent, _ := drafty["ent"].([]interface{})
+
+	var links []string
+	seen := make(map[string]bool)
+	for i := range ent {
+		e, _ := ent[i].(map[string]interface{})
+		if tp, _ := e["tp"].(string); tp != "LN" {
+			continue
+		}
+		data, _ := e["data"].(map[string]interface{})
+		url, _ := data["url"].(string)
+		if url == "" || seen[url] {
+			continue
+		}
+		seen[url] = true
+		links = append(links, url)
+	}
+	return links
+}
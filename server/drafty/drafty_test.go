@@ -89,3 +89,127 @@ func TestToPlainText(t *testing.T) {
 		}
 	}
 }
+
+func TestMentions(t *testing.T) {
+	inputs := []string{
+		`"Hello @alice"`,
+		`{
+			"txt":"Hi @alice and @bob, ping @alice",
+			"fmt":[{"at":3,"len":6},{"at":14,"len":4,"key":1},{"at":25,"len":6,"key":2}],
+			"ent":[{"tp":"MN","data":{"val":"usrAlice"}},{"tp":"MN","data":{"val":"usrBob"}},{"tp":"MN","data":{"val":"usrAlice"}}]
+		}`,
+		`{
+			"txt":"#tag https://tinode.co/",
+			"fmt":[{"len":4},{"at":5,"len":18,"key":1}],
+			"ent":[{"tp":"HT","data":{"val":"tag"}},{"tp":"LN","data":{"url":"https://tinode.co/"}}]
+		}`,
+	}
+	expect := [][]string{
+		nil,
+		{"usrAlice", "usrBob"},
+		nil,
+	}
+
+	for i := range inputs {
+		var val interface{}
+		json.Unmarshal([]byte(inputs[i]), &val)
+		res := Mentions(val)
+		if len(res) != len(expect[i]) {
+			t.Errorf("%d output %v does not match %v", i, res, expect[i])
+			continue
+		}
+		for j := range res {
+			if res[j] != expect[i][j] {
+				t.Errorf("%d output %v does not match %v", i, res, expect[i])
+				break
+			}
+		}
+	}
+}
+
+func TestAttachments(t *testing.T) {
+	inputs := []string{
+		`"Hello"`,
+		`{
+			"txt":" ",
+			"fmt":[{"len":1},{"at":1,"len":0,"key":1}],
+			"ent":[{"tp":"IM","data":{"mime":"image/jpeg","name":"roses.jpg"}},{"tp":"EX","data":{"mime":"application/pdf","name":"menu.pdf"}}]
+		}`,
+		`{
+			"txt":"Hi @alice",
+			"fmt":[{"at":3,"len":6}],
+			"ent":[{"tp":"MN","data":{"val":"usrAlice"}}]
+		}`,
+	}
+	expect := []int{0, 2, 0}
+
+	for i := range inputs {
+		var val interface{}
+		json.Unmarshal([]byte(inputs[i]), &val)
+		if res := Attachments(val); res != expect[i] {
+			t.Errorf("%d output %d does not match %d", i, res, expect[i])
+		}
+	}
+}
+
+func TestAttachmentMime(t *testing.T) {
+	inputs := []string{
+		`"Hello"`,
+		`{
+			"txt":"Hi @alice ",
+			"fmt":[{"at":3,"len":6},{"at":10,"len":0,"key":1}],
+			"ent":[{"tp":"MN","data":{"val":"usrAlice"}},{"tp":"VD","data":{"mime":"Video/MP4","name":"roses.mp4"}},{"tp":"IM","data":{"mime":"image/jpeg"}}]
+		}`,
+		`{
+			"txt":" ",
+			"fmt":[{"at":0,"len":0}],
+			"ent":[{"tp":"EX","data":{"name":"menu"}}]
+		}`,
+	}
+	expect := []string{"", "video/mp4", ""}
+
+	for i := range inputs {
+		var val interface{}
+		json.Unmarshal([]byte(inputs[i]), &val)
+		if res := AttachmentMime(val); res != expect[i] {
+			t.Errorf("%d output '%s' does not match '%s'", i, res, expect[i])
+		}
+	}
+}
+
+func TestLinks(t *testing.T) {
+	inputs := []string{
+		`"See https://tinode.co/"`,
+		`{
+			"txt":"#tag https://tinode.co/ and https://github.com/tinode",
+			"fmt":[{"len":4},{"at":5,"len":18,"key":1},{"at":28,"len":25,"key":2}],
+			"ent":[{"tp":"HT","data":{"val":"tag"}},{"tp":"LN","data":{"url":"https://tinode.co/"}},{"tp":"LN","data":{"url":"https://github.com/tinode"}}]
+		}`,
+		`{
+			"txt":"Hi @alice",
+			"fmt":[{"at":3,"len":6}],
+			"ent":[{"tp":"MN","data":{"val":"usrAlice"}}]
+		}`,
+	}
+	expect := [][]string{
+		nil,
+		{"https://tinode.co/", "https://github.com/tinode"},
+		nil,
+	}
+
+	for i := range inputs {
+		var val interface{}
+		json.Unmarshal([]byte(inputs[i]), &val)
+		res := Links(val)
+		if len(res) != len(expect[i]) {
+			t.Errorf("%d output %v does not match %v", i, res, expect[i])
+			continue
+		}
+		for j := range res {
+			if res[j] != expect[i][j] {
+				t.Errorf("%d output %v does not match %v", i, res, expect[i])
+				break
+			}
+		}
+	}
+}
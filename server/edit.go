@@ -0,0 +1,204 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *    Editing of published messages: the sender replaces the content of
+ *    a message, the message keeps its seq ID. The sender may also
+ *    hard-delete own messages shortly after publishing them.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tinode/chat/server/journal"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+const (
+	// Header of {pub} which makes it an edit of the message ":123".
+	msgReplaceHeader = "replace"
+	// Header of edited messages: time of the latest edit.
+	msgEditedHeader = "edited"
+	// Maximum number of own messages the sender may hard-delete at once without the D permission.
+	maxOwnHardDeleteCount = 64
+)
+
+// msgHeadSeq returns the seq ID from a header which references a message in the same topic as ":123",
+// 0 if the header is missing or invalid.
+func msgHeadSeq(head map[string]interface{}, key string) int {
+	ref, _ := head[key].(string)
+	if !strings.HasPrefix(ref, ":") {
+		return 0
+	}
+	seq, err := strconv.Atoi(ref[1:])
+	if err != nil || seq <= 0 {
+		return 0
+	}
+	return seq
+}
+
+// msgReplaceSeq returns the seq ID of the message being edited or 0 if the message is not an edit.
+func msgReplaceSeq(head map[string]interface{}) int {
+	return msgHeadSeq(head, msgReplaceHeader)
+}
+
+// replaceMessage saves an edit of a previously published message. Only the sender may edit a message.
+// On success the {data} is updated to be broadcast in place of the original message: same seq ID and
+// timestamp, the 'edited' header is set. Returns false if the edit was rejected.
+func (t *Topic) replaceMessage(msg *ServerComMessage) bool {
+	asUid := types.ParseUserId(msg.AsUser)
+	seq := msgReplaceSeq(msg.Data.Head)
+
+	if t.isProxy {
+		// The master topic has saved the edit already.
+		return true
+	}
+
+	if t.isReadOnly() {
+		msg.sess.queueOut(ErrPermissionDenied(msg.Id, t.original(asUid), msg.Timestamp))
+		return false
+	}
+
+	asUser := types.ParseUserId(msg.Data.From)
+	pud, ok := t.perUser[asUser]
+	if !ok || pud.deleted || !(pud.modeWant & pud.modeGiven).IsWriter() {
+		msg.sess.queueOut(ErrPermissionDenied(msg.Id, t.original(asUid), msg.Timestamp))
+		return false
+	}
+
+	if seq > t.lastID {
+		msg.sess.queueOut(ErrNotFound(msg.Id, t.original(asUid), types.TimeNow(), msg.Timestamp))
+		return false
+	}
+
+	messages, err := store.Messages.GetAll(t.name, asUser, &types.QueryOpt{Since: seq, Before: seq + 1, Limit: 1})
+	if err != nil {
+		log.Printf("topic[%s]: failed to load message to edit: %v", t.name, err)
+		msg.sess.queueOut(ErrUnknown(msg.Id, t.original(asUid), msg.Timestamp))
+		return false
+	}
+	if len(messages) == 0 {
+		msg.sess.queueOut(ErrNotFound(msg.Id, t.original(asUid), types.TimeNow(), msg.Timestamp))
+		return false
+	}
+	orig := &messages[0]
+	if orig.From != asUser.String() {
+		// Only own messages can be edited.
+		msg.sess.queueOut(ErrPermissionDenied(msg.Id, t.original(asUid), msg.Timestamp))
+		return false
+	}
+
+	head := types.MessageHeaders{}
+	for key, val := range msg.Data.Head {
+		head[key] = val
+	}
+	delete(head, msgReplaceHeader)
+	delete(head, msgTtlHeader)
+	// Attachments are linked to the message when it's published, the thread and the audio are indexed,
+	// the time of expiration is set when the message is saved. They cannot be changed by an edit.
+	for _, key := range []string{"attachments", msgThreadHeader, msgAudioHeader, msgExpiresHeader} {
+		delete(head, key)
+		if val, ok := orig.Head[key]; ok {
+			head[key] = val
+		}
+	}
+	head[msgEditedHeader] = msg.Timestamp.Format(time.RFC3339Nano)
+
+	if err := store.Messages.Update(t.name, seq, head, msg.Data.Content); err != nil {
+		log.Printf("topic[%s]: failed to edit message: %v", t.name, err)
+		msg.sess.queueOut(ErrUnknown(msg.Id, t.original(asUid), msg.Timestamp))
+		return false
+	}
+
+	if t.recent != nil {
+		t.recent.replace(seq, head, msg.Data.Content)
+	}
+
+	var org string
+	if msg.sess != nil {
+		org = msg.sess.activeOrg()
+	}
+	if journal.Enabled(org, t.name) {
+		journalWrite(&journal.Entry{
+			What:      journal.ActEdit,
+			Org:       org,
+			Topic:     t.name,
+			From:      msg.Data.From,
+			Timestamp: msg.Timestamp,
+			SeqId:     seq,
+			Head:      head,
+			Content:   msg.Data.Content})
+	}
+
+	// Recipients recognize the edit by the 'replace' header and update the message in place.
+	broadcast := make(map[string]interface{}, len(head)+1)
+	for key, val := range head {
+		broadcast[key] = val
+	}
+	broadcast[msgReplaceHeader] = ":" + strconv.Itoa(seq)
+	msg.Data.Head = broadcast
+	msg.Data.SeqId = seq
+	msg.Data.Timestamp = orig.CreatedAt
+	msg.Data.Replies = orig.Replies
+	msg.Data.LastReply = orig.LastReplyAt
+
+	if msg.Id != "" && msg.sess != nil {
+		reply := NoErrAccepted(msg.Id, t.original(asUid), msg.Timestamp)
+		reply.Ctrl.Params = map[string]int{"seq": seq}
+		msg.sess.queueOut(reply)
+	}
+
+	return true
+}
+
+// ownRecentMessages checks if all messages in the ranges exist, were sent by the user and are still within
+// the grace period when the sender may hard-delete them without the D permission.
+func (t *Topic) ownRecentMessages(asUid types.Uid, ranges []types.Range, now time.Time) bool {
+	gracePeriod := liveConfig().delGracePeriod
+	if gracePeriod <= 0 {
+		return false
+	}
+
+	count := 0
+	for _, r := range ranges {
+		if r.Hi == 0 {
+			count++
+		} else {
+			count += r.Hi - r.Low
+		}
+	}
+	if count > maxOwnHardDeleteCount {
+		return false
+	}
+
+	for _, r := range ranges {
+		before := r.Hi
+		if before == 0 {
+			before = r.Low + 1
+		}
+		messages, err := store.Messages.GetAll(t.name, asUid,
+			&types.QueryOpt{Since: r.Low, Before: before, Limit: before - r.Low})
+		if err != nil {
+			log.Printf("topic[%s]: failed to load messages to delete: %v", t.name, err)
+			return false
+		}
+		if len(messages) != before-r.Low {
+			// Some messages are missing or deleted already.
+			return false
+		}
+		for i := range messages {
+			mm := &messages[i]
+			if mm.DeletedAt != nil || mm.From != asUid.String() || now.Sub(mm.CreatedAt) > gracePeriod {
+				return false
+			}
+		}
+	}
+	return true
+}
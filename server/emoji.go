@@ -0,0 +1,143 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *    Custom emoji and sticker packs.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+// Short code of a custom emoji: lowercase letters, digits, '_', '+' and '-'.
+var emojiCodeRegexp = regexp.MustCompile(`^[a-z0-9_+\-]{2,32}$`)
+
+// emojiPacksAvailable returns packs available to members of the organization: packs which
+// belong to the organization and packs which belong to no organization.
+func emojiPacksAvailable(org string) ([]types.EmojiPack, error) {
+	orgs := []string{""}
+	if org != "" {
+		orgs = append(orgs, org)
+	}
+	return store.Packs.GetForOrg(orgs...)
+}
+
+// emojiNormalizeCode strips optional colons and converts the short code to lower case.
+func emojiNormalizeCode(code string) string {
+	return strings.ToLower(strings.Trim(code, ":"))
+}
+
+// emojiPacksToMsg converts stored packs to the wire format. If codes are given, only the items with
+// these codes are returned and the packs without such items are skipped. If the same code is used
+// in more than one pack, the code is resolved to the item from the first pack.
+func emojiPacksToMsg(packs []types.EmojiPack, codes []string) []MsgEmojiPack {
+	var wanted map[string]bool
+	if len(codes) > 0 {
+		wanted = make(map[string]bool, len(codes))
+		for _, code := range codes {
+			wanted[emojiNormalizeCode(code)] = true
+		}
+	}
+
+	var result []MsgEmojiPack
+	for i := range packs {
+		pack := &packs[i]
+		var items []MsgEmojiItem
+		for j := range pack.Items {
+			item := &pack.Items[j]
+			if wanted != nil {
+				if !wanted[item.Code] {
+					continue
+				}
+				// Resolved, don't look for it in other packs.
+				delete(wanted, item.Code)
+			}
+			items = append(items, MsgEmojiItem{
+				Code:    item.Code,
+				Ref:     item.Ref,
+				Mime:    item.MimeType,
+				Sticker: item.Sticker})
+		}
+		if wanted != nil && len(items) == 0 {
+			continue
+		}
+		result = append(result, MsgEmojiPack{
+			Id:      pack.Id,
+			Org:     pack.Org,
+			Name:    pack.Name,
+			Updated: &pack.UpdatedAt,
+			Items:   items})
+	}
+	return result
+}
+
+// emojiPackFromMsg validates the pack sent by the client and converts it to the stored format.
+// The images must be uploaded through the media handler before the pack is created.
+func emojiPackFromMsg(src *MsgEmojiPack) (*types.EmojiPack, error) {
+	name := strings.TrimSpace(src.Name)
+	if name == "" || len(src.Items) == 0 {
+		return nil, types.ErrMalformed
+	}
+	if len(src.Items) > maxEmojiPackItems {
+		return nil, types.ErrPolicy
+	}
+
+	mh := store.GetMediaHandler()
+	if mh == nil {
+		return nil, types.ErrUnsupported
+	}
+
+	pack := &types.EmojiPack{
+		Org:   strings.TrimSpace(src.Org),
+		Name:  name,
+		Items: make(types.EmojiItems, 0, len(src.Items))}
+	for i := range src.Items {
+		code := emojiNormalizeCode(src.Items[i].Code)
+		if !emojiCodeRegexp.MatchString(code) || pack.Items.Find(code) >= 0 {
+			return nil, types.ErrMalformed
+		}
+
+		fid := mh.GetIdFromUrl(src.Items[i].Ref)
+		if fid.IsZero() {
+			return nil, types.ErrMalformed
+		}
+		fd, err := store.Files.Get(fid.String())
+		if err != nil {
+			return nil, err
+		}
+		if fd == nil || fd.Status != types.UploadCompleted || !strings.HasPrefix(fd.MimeType, "image/") {
+			return nil, types.ErrMalformed
+		}
+
+		pack.Items = append(pack.Items, types.EmojiItem{
+			Code:     code,
+			FileId:   fd.Id,
+			Ref:      src.Items[i].Ref,
+			MimeType: fd.MimeType,
+			Sticker:  src.Items[i].Sticker})
+	}
+
+	if src.Id != "" {
+		if types.ParseUid(src.Id).IsZero() {
+			return nil, types.ErrMalformed
+		}
+		existing, err := store.Packs.Get(src.Id)
+		if err != nil {
+			return nil, err
+		}
+		if len(existing) == 0 {
+			return nil, types.ErrNotFound
+		}
+		pack.Id = existing[0].Id
+		pack.CreatedAt = existing[0].CreatedAt
+	}
+
+	return pack, nil
+}
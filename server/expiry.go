@@ -0,0 +1,239 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *    Expiration of messages: the owner of a group topic sets the default time
+ *    to live of messages, the sender may ask for a shorter one with the 'ttl'
+ *    head. The time of expiration is stamped into the 'expires' head of the
+ *    message when it's saved. Clients hide expired messages, the topic deletes
+ *    them from the database.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"errors"
+	"log"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/tinode/chat/server/journal"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+const (
+	// Head with the time of expiration of the message, set by the server.
+	msgExpiresHeader = "expires"
+	// Head with the time to live of the message in seconds requested by the sender.
+	msgTtlHeader = "ttl"
+
+	// Maximum time to live of messages, seconds: one year.
+	expiryMaxTtl = 365 * 24 * 3600
+	// How often expired messages are deleted.
+	expiryInterval = time.Minute
+	// Number of messages checked in one query.
+	expiryPageSize = 100
+	// Maximum number of queries in one pass.
+	expiryMaxPages = 10
+)
+
+// expiryStamp sets the 'expires' head of the new message: the topic's default time to live or
+// the shorter one requested by the sender. Returns the time of expiration, nil if the message does
+// not expire, and false if the requested time to live is invalid or longer than the default.
+func (t *Topic) expiryStamp(data *MsgServerData) (*time.Time, bool) {
+	ttl := t.expiry.Ttl
+	if val, ok := data.Head[msgTtlHeader]; ok {
+		num, ok := val.(float64)
+		if !ok || num != math.Trunc(num) || num < 1 || num > expiryMaxTtl || (ttl > 0 && int(num) > ttl) {
+			return nil, false
+		}
+		ttl = int(num)
+		delete(data.Head, msgTtlHeader)
+	}
+	// The time of expiration is set by the server only.
+	delete(data.Head, msgExpiresHeader)
+
+	if ttl == 0 {
+		if len(data.Head) == 0 {
+			data.Head = nil
+		}
+		return nil, true
+	}
+
+	expires := data.Timestamp.Add(time.Duration(ttl) * time.Second)
+	if data.Head == nil {
+		data.Head = make(map[string]interface{})
+	}
+	data.Head[msgExpiresHeader] = expires.Format(time.RFC3339Nano)
+	return &expires, true
+}
+
+// expiryTime returns the time of expiration of the stored message, nil if the message does not expire.
+func expiryTime(head types.MessageHeaders) *time.Time {
+	val, _ := head[msgExpiresHeader].(string)
+	if val == "" {
+		return nil
+	}
+	expires, err := time.Parse(time.RFC3339Nano, val)
+	if err != nil {
+		return nil
+	}
+	return &expires
+}
+
+// expiryAdded records that the message with the given seq ID will expire.
+func (t *Topic) expiryAdded(seq int) {
+	if t.expiry.Seq > 0 {
+		// Messages which expire are waiting already, the new one is found by the next pass.
+		return
+	}
+	t.expiry.Seq = seq
+	if err := store.Topics.Update(t.name, map[string]interface{}{"Expiry": t.expiry}); err != nil {
+		log.Printf("topic[%s]: failed to save expiry: %v", t.name, err)
+	}
+	t.expirySchedule()
+}
+
+// expirySchedule starts the timer which deletes expired messages if any message is waiting to expire.
+func (t *Topic) expirySchedule() {
+	t.expiryTimer.Stop()
+	if t.expiry.Seq > 0 && !t.isProxy {
+		t.expiryTimer.Reset(expiryInterval)
+	}
+}
+
+// expiryReap deletes expired messages starting with the lowest seq ID which may expire. Messages
+// which expire later stay until the next pass.
+func (t *Topic) expiryReap() {
+	if t.expiry.Seq == 0 {
+		return
+	}
+
+	now := types.TimeNow()
+	seq := t.expiry.Seq
+	// The lowest seq ID of a message which expires later.
+	waiting := 0
+	var ranges []types.Range
+	for page := 0; page < expiryMaxPages && seq <= t.lastID; page++ {
+		msgs, err := store.Messages.GetAll(t.name, types.ZeroUid,
+			&types.QueryOpt{Since: seq, Before: seq + expiryPageSize, Limit: expiryPageSize})
+		if err != nil {
+			log.Printf("topic[%s]: failed to load expiring messages: %v", t.name, err)
+			t.expirySchedule()
+			return
+		}
+		for i := range msgs {
+			expires := expiryTime(msgs[i].Head)
+			if expires == nil {
+				continue
+			}
+			if !expires.After(now) {
+				ranges = append(ranges, types.Range{Low: msgs[i].SeqId})
+			} else if waiting == 0 || msgs[i].SeqId < waiting {
+				waiting = msgs[i].SeqId
+			}
+		}
+		seq += expiryPageSize
+	}
+
+	if len(ranges) > 0 {
+		if err := t.expiryDelete(ranges, now); err != nil {
+			log.Printf("topic[%s]: failed to delete expired messages: %v", t.name, err)
+			t.expirySchedule()
+			return
+		}
+	}
+
+	if waiting == 0 && seq <= t.lastID {
+		// Not all messages were checked in this pass.
+		waiting = seq
+	}
+	if waiting != t.expiry.Seq {
+		t.expiry.Seq = waiting
+		if err := store.Topics.Update(t.name, map[string]interface{}{"Expiry": t.expiry}); err != nil {
+			log.Printf("topic[%s]: failed to save expiry: %v", t.name, err)
+		}
+	}
+	t.expirySchedule()
+}
+
+// expiryDelete hard-deletes expired messages and notifies the subscribers.
+func (t *Topic) expiryDelete(ranges []types.Range, now time.Time) error {
+	sort.Sort(types.RangeSorter(ranges))
+	ranges = types.RangeSorter(ranges).Normalize()
+	if err := store.Messages.DeleteList(t.name, t.delID+1, types.ZeroUid, ranges); err != nil {
+		return err
+	}
+
+	if t.recent != nil {
+		t.recent.delete(types.ZeroUid, ranges)
+	}
+
+	if journal.Enabled("", t.name) {
+		journalWrite(&journal.Entry{
+			What:      journal.ActDel,
+			Topic:     t.name,
+			Timestamp: now,
+			DelSeq:    ranges,
+			Hard:      true})
+	}
+
+	t.delID++
+	for _, pud := range t.perUser {
+		pud.delID = t.delID
+	}
+	// Broadcast the change to all, online and offline.
+	params := &presParams{delID: t.delID, delSeq: delrangeDeserialize(ranges)}
+	filters := &presFilters{filterIn: types.ModeRead}
+	t.presSubsOnline("del", "", params, filters, "")
+	t.presSubsOffline("del", params, filters, nilPresFilters, "", true)
+
+	return nil
+}
+
+// replySetTtl sets the default time to live of new messages. Owner only.
+func (t *Topic) replySetTtl(sess *Session, asUid types.Uid, msg *ClientComMessage) error {
+	now := types.TimeNow()
+
+	if t.cat != types.TopicCatGrp {
+		sess.queueOut(ErrOperationNotAllowedReply(msg, now))
+		return errors.New("set.ttl: invalid topic category")
+	}
+	if !t.isOwner(asUid) {
+		sess.queueOut(ErrPermissionDeniedReply(msg, now))
+		return errors.New("set.ttl: request by non-owner")
+	}
+
+	ttl := *msg.Set.Ttl
+	if ttl < 0 || ttl > expiryMaxTtl {
+		sess.queueOut(ErrMalformedReply(msg, now))
+		return errors.New("set.ttl: invalid time to live")
+	}
+	if ttl == t.expiry.Ttl {
+		sess.queueOut(InfoNotModifiedReply(msg, now))
+		return nil
+	}
+
+	// Messages which are already saved keep their time of expiration.
+	expiry := t.expiry
+	expiry.Ttl = ttl
+	if err := store.Topics.Update(t.name, map[string]interface{}{
+		"Expiry": expiry, "UpdatedAt": now}); err != nil {
+		sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, t.original(asUid), now, msg.Timestamp, nil))
+		return err
+	}
+
+	t.expiry = expiry
+	t.updated = now
+
+	// Let the subscribers know the description has changed.
+	filter := &presFilters{excludeUser: asUid.UserId(), filterIn: types.ModeJoin}
+	t.presSubsOffline("upd", nilPresParams, filter, filter, sess.sid, false)
+
+	sess.queueOut(NoErrReply(msg, now))
+
+	return nil
+}
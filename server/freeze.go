@@ -0,0 +1,197 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *    Freeze of group topics: the owner or the root user suspends posting,
+ *    optionally until the given time. Subscribers keep reading the topic.
+ *    The freeze is saved with the topic and survives restarts.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"github.com/tinode/chat/server/auth"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+// Maximum duration of a freeze which lapses by itself. Freeze without 'until' to suspend posting indefinitely.
+const freezeMaxDuration = 365 * 24 * time.Hour
+
+// freezeDesc converts the freeze for reporting in topic description, nil if the topic is not frozen.
+func freezeDesc(freeze types.TopicFreeze) *MsgTopicFreeze {
+	if freeze.Since.IsZero() {
+		return nil
+	}
+	return &MsgTopicFreeze{Frozen: true, Until: freeze.Until}
+}
+
+// freezeRequest validates the request to freeze or unfreeze the topic and converts it to the stored form.
+func freezeRequest(req *MsgTopicFreeze, asUid types.Uid, now time.Time) (types.TopicFreeze, error) {
+	if !req.Frozen {
+		if req.Until != nil {
+			return types.TopicFreeze{}, types.ErrMalformed
+		}
+		return types.TopicFreeze{}, nil
+	}
+	if req.Until != nil && (!req.Until.After(now) || req.Until.Sub(now) > freezeMaxDuration) {
+		return types.TopicFreeze{}, types.ErrMalformed
+	}
+	return types.TopicFreeze{Since: now, Until: req.Until, By: asUid.UserId()}, nil
+}
+
+// freezeRestore applies the freeze when the topic is loaded. The freeze which has lapsed
+// while the topic was not loaded is lifted.
+func (t *Topic) freezeRestore(freeze types.TopicFreeze) {
+	if freeze.Since.IsZero() {
+		return
+	}
+	if freeze.Until != nil && !freeze.Until.After(types.TimeNow()) {
+		if err := store.Topics.Update(t.name, map[string]interface{}{"Freeze": types.TopicFreeze{}}); err != nil {
+			log.Printf("topic[%s]: failed to lift lapsed freeze: %v", t.name, err)
+		}
+		return
+	}
+	t.freeze = freeze
+	t.markReadOnly(true)
+}
+
+// freezeSchedule starts the timer which lifts the freeze when it lapses.
+func (t *Topic) freezeSchedule() {
+	t.freezeTimer.Stop()
+	if t.freeze.Until != nil {
+		t.freezeTimer.Reset(time.Until(*t.freeze.Until))
+	}
+}
+
+// freezeApply saves the new state of the topic and lets the attached sessions know.
+func (t *Topic) freezeApply(freeze types.TopicFreeze, now time.Time) error {
+	if err := store.Topics.Update(t.name, map[string]interface{}{"Freeze": freeze, "UpdatedAt": now}); err != nil {
+		return err
+	}
+
+	t.freeze = freeze
+	t.updated = now
+	t.markReadOnly(!freeze.Since.IsZero())
+	t.freezeSchedule()
+
+	state := freezeDesc(freeze)
+	if state == nil {
+		state = &MsgTopicFreeze{}
+	}
+	globals.hub.routeMsg(&ServerComMessage{
+		Pres:   &MsgServerPres{Topic: t.xoriginal, What: "freeze", Freeze: state},
+		RcptTo: t.name})
+
+	return nil
+}
+
+// freezeLapse lifts the freeze when its time is up.
+func (t *Topic) freezeLapse() {
+	if t.freeze.Since.IsZero() {
+		return
+	}
+	if err := t.freezeApply(types.TopicFreeze{}, types.TimeNow()); err != nil {
+		log.Printf("topic[%s]: failed to lift freeze: %v", t.name, err)
+		// Try again later.
+		t.freezeTimer.Reset(time.Minute)
+	}
+}
+
+// replySetFreeze suspends or resumes posting to the group topic, owner or root only. In the 'sys' topic
+// the root user freezes the topic given by name.
+func (t *Topic) replySetFreeze(sess *Session, asUid types.Uid, authLevel auth.Level, msg *ClientComMessage) error {
+	now := types.TimeNow()
+
+	if t.cat == types.TopicCatSys {
+		return t.replySetFreezeSys(sess, asUid, authLevel, msg, now)
+	}
+
+	if t.cat != types.TopicCatGrp || msg.Set.Freeze.Topic != "" {
+		sess.queueOut(ErrOperationNotAllowedReply(msg, now))
+		return errors.New("set.freeze: invalid topic category")
+	}
+	if !t.isOwner(asUid) && authLevel != auth.LevelRoot {
+		sess.queueOut(ErrPermissionDeniedReply(msg, now))
+		return errors.New("set.freeze: request by non-owner")
+	}
+
+	freeze, err := freezeRequest(msg.Set.Freeze, asUid, now)
+	if err != nil {
+		sess.queueOut(ErrMalformedReply(msg, now))
+		return err
+	}
+	if freeze.Since.IsZero() && t.freeze.Since.IsZero() {
+		sess.queueOut(InfoNotModifiedReply(msg, now))
+		return nil
+	}
+
+	if err := t.freezeApply(freeze, now); err != nil {
+		sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, t.original(asUid), now, msg.Timestamp, nil))
+		return err
+	}
+
+	sess.queueOut(NoErrReply(msg, now))
+	return nil
+}
+
+// replySetFreezeSys freezes or unfreezes the group topic by name, 'sys' topic only, root only.
+func (t *Topic) replySetFreezeSys(sess *Session, asUid types.Uid, authLevel auth.Level, msg *ClientComMessage,
+	now time.Time) error {
+
+	if authLevel != auth.LevelRoot {
+		sess.queueOut(ErrPermissionDeniedReply(msg, now))
+		return errors.New("set.freeze: root access required")
+	}
+
+	name := msg.Set.Freeze.Topic
+	if tmp := types.ChnToGrp(name); tmp != "" {
+		name = tmp
+	}
+	freeze, err := freezeRequest(msg.Set.Freeze, asUid, now)
+	if err != nil || topicCat(name) != types.TopicCatGrp {
+		sess.queueOut(ErrMalformedReply(msg, now))
+		return errors.New("set.freeze: invalid request")
+	}
+	if globals.cluster.isRemoteTopic(name) {
+		// The topic could be loaded at the other node.
+		sess.queueOut(ErrOperationNotAllowedReply(msg, now))
+		return errors.New("set.freeze: topic is hosted by another node")
+	}
+
+	// The topic is changed in the background, the 'sys' topic should not wait for the database.
+	go func() {
+		err := globals.hub.runTopicTask(name,
+			func(t *Topic) error {
+				// The topic is loaded: the freeze takes effect immediately and the attached sessions are told.
+				return t.freezeApply(freeze, now)
+			},
+			func() error {
+				stopic, err := store.Topics.Get(name)
+				if err != nil {
+					return err
+				}
+				if stopic == nil {
+					return types.ErrTopicNotFound
+				}
+				return store.Topics.Update(name, map[string]interface{}{"Freeze": freeze, "UpdatedAt": now})
+			})
+		if err == errTopicBusy {
+			sess.queueOut(ErrServiceUnavailableReply(msg, types.TimeNow()))
+			return
+		}
+		if err != nil {
+			log.Println("set.freeze: failed to change the freeze", name, err)
+			sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, msg.Original, types.TimeNow(), msg.Timestamp, nil))
+			return
+		}
+		sess.queueOut(NoErrReply(msg, types.TimeNow()))
+	}()
+
+	return nil
+}
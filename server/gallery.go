@@ -0,0 +1,82 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *    Media gallery: messages are indexed by the MIME type of the attachment,
+ *    so clients can page through images, videos or files of the topic.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/tinode/chat/server/drafty"
+)
+
+const (
+	// Maximum number of MIME types in one query.
+	galleryMaxMime = 8
+	// Maximum length of the indexed MIME type. Longer types are not indexed.
+	galleryMaxMimeLen = 255
+)
+
+// galleryMime returns the MIME type of the attachment to index the message by, or an empty string.
+func galleryMime(content interface{}) string {
+	mime := drafty.AttachmentMime(content)
+	if len(mime) > galleryMaxMimeLen || strings.HasSuffix(mime, "/*") || galleryMimeParse(mime) != nil {
+		return ""
+	}
+	return mime
+}
+
+// galleryMimeParse validates a MIME type or a pattern like "image/*".
+func galleryMimeParse(mime string) error {
+	parts := strings.Split(mime, "/")
+	if len(parts) != 2 || !galleryIsToken(parts[0], false) || !galleryIsToken(parts[1], true) {
+		return errors.New("invalid mime type '" + mime + "'")
+	}
+	return nil
+}
+
+// galleryIsToken checks if the part of the MIME type contains only permitted characters. The type must
+// consist of letters only, so it can be matched by prefix. The subtype may be the wildcard '*'.
+func galleryIsToken(s string, subtype bool) bool {
+	if s == "" {
+		return false
+	}
+	if subtype && s == "*" {
+		return true
+	}
+	for _, r := range s {
+		if r >= 'a' && r <= 'z' {
+			continue
+		}
+		if subtype && (r >= '0' && r <= '9' || strings.ContainsRune(".+-", r)) {
+			continue
+		}
+		return false
+	}
+	return true
+}
+
+// galleryFilterParse validates and normalizes the list of MIME types requested by the client.
+func galleryFilterParse(filter *MsgGetFilter) ([]string, error) {
+	if filter == nil {
+		return nil, nil
+	}
+	if len(filter.Mime) == 0 || len(filter.Mime) > galleryMaxMime {
+		return nil, errors.New("invalid number of mime types")
+	}
+	mimes := make([]string, 0, len(filter.Mime))
+	for _, mime := range filter.Mime {
+		mime = strings.ToLower(mime)
+		if err := galleryMimeParse(mime); err != nil {
+			return nil, err
+		}
+		mimes = append(mimes, mime)
+	}
+	return mimes, nil
+}
@@ -0,0 +1,229 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *    Read-only access to channels by unauthenticated guests, e.g. viewers of
+ *    an embedded live-stream chat.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+const (
+	// Lifetime of a guest token if the owner did not ask for a specific one.
+	guestTokenDefaultTTL = 24 * time.Hour
+	// Maximum lifetime of a guest token.
+	guestTokenMaxTTL = 30 * 24 * time.Hour
+	// Length of the key for signing guest tokens, bytes.
+	guestSecretLength = 32
+	// Length of the truncated HMAC signature of a guest token, bytes.
+	guestSigLength = 16
+)
+
+// guestTokenSign computes the signature of the guest token.
+func guestTokenSign(secret []byte, topic string, expires int64) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(topic + "/" + strconv.FormatInt(expires, 10)))
+	return mac.Sum(nil)[:guestSigLength]
+}
+
+// guestTokenMake creates a guest token for the channel valid until the given time.
+func guestTokenMake(secret []byte, topic string, expires time.Time) string {
+	exp := expires.Unix()
+	return strconv.FormatInt(exp, 10) + "." +
+		base64.RawURLEncoding.EncodeToString(guestTokenSign(secret, topic, exp))
+}
+
+// guestTokenValid checks the signature and the expiration time of the guest token.
+func guestTokenValid(secret []byte, topic, token string, now time.Time) bool {
+	parts := strings.Split(token, ".")
+	if len(secret) == 0 || len(parts) != 2 {
+		return false
+	}
+	exp, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || exp <= now.Unix() {
+		return false
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[1])
+	return err == nil && hmac.Equal(sig, guestTokenSign(secret, topic, exp))
+}
+
+// subscribeGuest attaches an unauthenticated session to a channel using a guest token.
+func (s *Session) subscribeGuest(msg *ClientComMessage) {
+	if !isChannel(msg.Original) {
+		// Guests can only read channels.
+		s.queueOut(ErrAuthRequiredReply(msg, msg.Timestamp))
+		return
+	}
+	s.subscribe(msg)
+}
+
+// guestJoin attaches a guest session to the channel if the guest token is valid
+// and the limit of concurrent guests is not reached.
+func (t *Topic) guestJoin(join *sessionJoin) error {
+	now := types.TimeNow()
+	pkt := join.pkt
+
+	if !t.isChan || !isChannel(pkt.Original) {
+		join.sess.queueOut(ErrNotFoundReply(pkt, now))
+		return types.ErrNotFound
+	}
+	if join.sess.isMultiplex() {
+		// Guests are served by the cluster node which hosts the channel.
+		join.sess.queueOut(ErrOperationNotAllowedReply(pkt, now))
+		return errors.New("guest access through a cluster proxy")
+	}
+	if t.guests.Limit == 0 || !guestTokenValid(t.guests.Secret, t.name, pkt.Sub.Guest, now) {
+		join.sess.queueOut(ErrPermissionDeniedReply(pkt, now))
+		return errors.New("invalid or expired guest token")
+	}
+	if t.guestsOnline >= t.guests.Limit {
+		join.sess.queueOut(ErrPolicyLimitReply(pkt, now, "guests", t.guests.Limit))
+		return errors.New("too many guests")
+	}
+
+	join.sess.addSub(t.name, &Subscription{
+		broadcast: t.broadcast,
+		done:      t.unreg,
+		meta:      t.meta,
+		supd:      t.supd})
+	if t.addSession(join.sess, types.ZeroUid, true) {
+		pssd := t.sessions[join.sess]
+		pssd.guest = true
+		t.sessions[join.sess] = pssd
+		t.guestsOnline++
+	}
+
+	join.sess.queueOut(NoErr(pkt.Id, pkt.Original, now))
+
+	// Guests may only fetch the recent messages, other metadata is not available to them.
+	if pkt.Sub.Get != nil && parseMsgClientMeta(pkt.Sub.Get.What)&constMsgMetaData != 0 {
+		if err := t.replyGetData(join.sess, types.ZeroUid, pkt.Sub.Get.Data, pkt); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// replyGetGuests issues a guest token for the channel, owner only.
+func (t *Topic) replyGetGuests(sess *Session, asUid types.Uid, req *MsgGetGuests, msg *ClientComMessage) error {
+	now := types.TimeNow()
+
+	if t.cat != types.TopicCatGrp || !t.isChan {
+		sess.queueOut(ErrOperationNotAllowedReply(msg, now))
+		return errors.New("get.guests: not a channel")
+	}
+	if !t.isOwner(asUid) {
+		sess.queueOut(ErrPermissionDeniedReply(msg, now))
+		return errors.New("get.guests: request by non-owner")
+	}
+
+	if t.guests.Limit == 0 {
+		sess.queueOut(NoContentParamsReply(msg, now, map[string]string{"what": "guests"}))
+		return nil
+	}
+
+	ttl := guestTokenDefaultTTL
+	if req != nil && req.Ttl != 0 {
+		ttl = time.Duration(req.Ttl) * time.Second
+		if ttl < 0 || ttl > guestTokenMaxTTL {
+			sess.queueOut(ErrMalformedReply(msg, now))
+			return errors.New("get.guests: invalid token lifetime")
+		}
+	}
+	expires := now.Add(ttl).Truncate(time.Second)
+
+	sess.queueOut(NoErrParamsReply(msg, now, map[string]interface{}{
+		"what":    "guests",
+		"limit":   t.guests.Limit,
+		"online":  t.guestsOnline,
+		"token":   guestTokenMake(t.guests.Secret, t.name, expires),
+		"expires": expires}))
+
+	return nil
+}
+
+// replySetGuests enables, changes or disables guest access to the channel, owner only.
+// Disabling guest access revokes all issued tokens and detaches the guests.
+func (t *Topic) replySetGuests(sess *Session, asUid types.Uid, msg *ClientComMessage) error {
+	now := types.TimeNow()
+
+	if t.cat != types.TopicCatGrp || !t.isChan {
+		sess.queueOut(ErrOperationNotAllowedReply(msg, now))
+		return errors.New("set.guests: not a channel")
+	}
+	if !t.isOwner(asUid) {
+		sess.queueOut(ErrPermissionDeniedReply(msg, now))
+		return errors.New("set.guests: request by non-owner")
+	}
+
+	limit := msg.Set.Guests.Limit
+	if limit < 0 {
+		sess.queueOut(ErrMalformedReply(msg, now))
+		return errors.New("set.guests: invalid limit")
+	}
+	if limit == t.guests.Limit {
+		sess.queueOut(InfoNotModifiedReply(msg, now))
+		return nil
+	}
+
+	guests := types.TopicGuests{Limit: limit, Secret: t.guests.Secret}
+	if limit == 0 {
+		guests.Secret = nil
+	} else if len(guests.Secret) == 0 {
+		// Guest access is being enabled, previously issued tokens must not become valid again.
+		guests.Secret = make([]byte, guestSecretLength)
+		if _, err := rand.Read(guests.Secret); err != nil {
+			sess.queueOut(ErrUnknownReply(msg, now))
+			return err
+		}
+	}
+
+	if err := store.Topics.Update(t.name, map[string]interface{}{
+		"Guests": guests, "UpdatedAt": now}); err != nil {
+		sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, t.original(asUid), now, msg.Timestamp, nil))
+		return err
+	}
+
+	t.guests = guests
+	t.updated = now
+
+	if limit == 0 {
+		t.evictGuests(now)
+	}
+
+	sess.queueOut(NoErrReply(msg, now))
+
+	return nil
+}
+
+// evictGuests detaches all guest sessions from the channel.
+func (t *Topic) evictGuests(now time.Time) {
+	msg := NoErrEvicted("", types.GrpToChn(t.name), now)
+	var detach []*Session
+	for s, pssd := range t.sessions {
+		if !pssd.guest {
+			continue
+		}
+		if _, removed := t.remSession(s, types.ZeroUid); removed {
+			detach = append(detach, s)
+		}
+		s.queueOut(msg)
+	}
+	t.detachSessions(detach)
+}
@@ -60,8 +60,19 @@ func largeFileServe(wrt http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	// View-once attachments are served to each recipient only once.
+	viewOnce, err := viewOnceGet(mh.GetIdFromUrl(req.URL.String()), uid)
+	if err != nil {
+		writeHttpResponse(decodeStoreError(err, "", "", now, nil), err)
+		return
+	}
+
 	// Check if media handler requests redirection to another service.
 	if redirTo, err := mh.Redirect(req.Method, req.URL.String()); redirTo != "" {
+		if err := viewOnceRetrieve(viewOnce, uid); err != nil {
+			writeHttpResponse(viewOnceError(err, now), err)
+			return
+		}
 		wrt.Header().Set("Location", redirTo)
 		wrt.Header().Set("Content-Type", "application/json; charset=utf-8")
 		wrt.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
@@ -82,8 +93,16 @@ func largeFileServe(wrt http.ResponseWriter, req *http.Request) {
 
 	defer rsc.Close()
 
+	if err = viewOnceRetrieve(viewOnce, uid); err != nil {
+		writeHttpResponse(viewOnceError(err, now), err)
+		return
+	}
+
 	wrt.Header().Set("Content-Type", fd.MimeType)
 	wrt.Header().Set("Content-Disposition", "attachment")
+	if viewOnce != nil {
+		wrt.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	}
 	http.ServeContent(wrt, req, "", fd.UpdatedAt, rsc)
 
 	log.Println("media served OK")
@@ -140,6 +159,10 @@ func largeFileReceive(wrt http.ResponseWriter, req *http.Request) {
 		writeHttpResponse(ErrAuthRequired(msgID, "", now, now), nil)
 		return
 	}
+	if resp := maintenanceReject(&ClientComMessage{Id: msgID, Timestamp: now}); resp != nil {
+		writeHttpResponse(resp, nil)
+		return
+	}
 
 	// Check if uploads are handled elsewhere.
 	if redirTo, err := mh.Redirect(req.Method, req.URL.String()); redirTo != "" {
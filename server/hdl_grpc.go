@@ -17,9 +17,11 @@ import (
 
 	"github.com/tinode/chat/pbx"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/keepalive"
 	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
 )
 
 type grpcNodeServer struct {
@@ -35,10 +37,22 @@ func (sess *Session) closeGrpc() {
 
 // Equivalent of starting a new session and a read loop in one
 func (*grpcNodeServer) MessageLoop(stream pbx.Node_MessageLoopServer) error {
-	sess, count := globals.sessionStore.NewSession(stream, "")
+	var remoteAddr string
 	if p, ok := peer.FromContext(stream.Context()); ok {
-		sess.remoteAddr = p.Addr.String()
+		remoteAddr = p.Addr.String()
 	}
+	limitIP, err := sessionLimitsAcquireIP(remoteAddr)
+	if err != nil {
+		log.Println("grpc: session rejected", remoteAddr, err)
+		if err == errSessionBanned {
+			return status.Error(codes.PermissionDenied, err.Error())
+		}
+		return status.Error(codes.ResourceExhausted, err.Error())
+	}
+
+	sess, count := globals.sessionStore.NewSession(stream, "")
+	sess.remoteAddr = remoteAddr
+	sess.limitIP = limitIP
 	log.Println("grpc: session started", sess.sid, sess.remoteAddr, count)
 
 	defer func() {
@@ -86,15 +100,15 @@ func (sess *Session) writeGrpcLoop() {
 				// channel closed
 				return
 			}
-			if len(sess.send) > sendQueueLimit {
-				log.Println("grpc: outbound queue limit exceeded", sess.sid)
-				return
-			}
 			statsInc("OutgoingMessagesGrpcTotal", 1)
 			if err := grpcWrite(sess, msg); err != nil {
 				log.Println("grpc: write", sess.sid, err)
 				return
 			}
+			sess.sendOverflow()
+
+		case <-sess.overflowReady:
+			sess.sendOverflow()
 
 		case <-sess.bkgTimer.C:
 			if sess.background {
@@ -136,7 +150,7 @@ func serveGrpc(addr string, kaEnabled bool, tlsConf *tls.Config) (*grpc.Server,
 
 	secure := ""
 	var opts []grpc.ServerOption
-	opts = append(opts, grpc.MaxRecvMsgSize(int(globals.maxMessageSize)))
+	opts = append(opts, grpc.MaxRecvMsgSize(int(liveConfig().maxMessageSize)))
 	if tlsConf != nil {
 		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConf)))
 		secure = " secure"
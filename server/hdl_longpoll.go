@@ -24,17 +24,19 @@ func (sess *Session) writeOnce(wrt http.ResponseWriter, req *http.Request) {
 		select {
 		case msg, ok := <-sess.send:
 			if ok {
-				if len(sess.send) > sendQueueLimit {
-					log.Println("longPoll: outbound queue limit exceeded", sess.sid)
-				} else {
-					statsInc("OutgoingMessagesLongpollTotal", 1)
-					if err := lpWrite(wrt, msg); err != nil {
-						log.Println("longPoll: writeOnce failed", sess.sid, err)
-					}
+				statsInc("OutgoingMessagesLongpollTotal", 1)
+				if err := lpWrite(wrt, msg); err != nil {
+					log.Println("longPoll: writeOnce failed", sess.sid, err)
 				}
+				// Make backlogged messages available to the next poll.
+				sess.sendOverflow()
 			}
 			return
 
+		case <-sess.overflowReady:
+			// Move backlogged messages to the send queue, they are written above.
+			sess.sendOverflow()
+
 		case <-sess.bkgTimer.C:
 			if sess.background {
 				sess.background = false
@@ -76,11 +78,11 @@ func lpWrite(wrt http.ResponseWriter, msg interface{}) error {
 }
 
 func (sess *Session) readOnce(wrt http.ResponseWriter, req *http.Request) (int, error) {
-	if req.ContentLength > globals.maxMessageSize {
+	if req.ContentLength > liveConfig().maxMessageSize {
 		return http.StatusExpectationFailed, errors.New("request too large")
 	}
 
-	req.Body = http.MaxBytesReader(wrt, req.Body, globals.maxMessageSize)
+	req.Body = http.MaxBytesReader(wrt, req.Body, liveConfig().maxMessageSize)
 	raw, err := ioutil.ReadAll(req.Body)
 	if err == nil {
 		// Locking-unlocking is needed because the client may issue multiple requests in parallel.
@@ -138,9 +140,18 @@ func serveLongPoll(wrt http.ResponseWriter, req *http.Request) {
 	var sess *Session
 	if sid == "" {
 		// New session
+		remoteAddr := getRemoteAddr(req)
+		limitIP, err := sessionLimitsAcquireIP(remoteAddr)
+		if err != nil {
+			sessionLimitsReject(wrt, err, now)
+			log.Println("longPoll: session rejected", remoteAddr, err)
+			return
+		}
+
 		var count int
 		sess, count = globals.sessionStore.NewSession(wrt, "")
-		sess.remoteAddr = getRemoteAddr(req)
+		sess.remoteAddr = remoteAddr
+		sess.limitIP = limitIP
 		log.Println("longPoll: session started", sess.sid, sess.remoteAddr, count)
 
 		wrt.WriteHeader(http.StatusCreated)
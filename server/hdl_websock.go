@@ -41,7 +41,7 @@ func (sess *Session) readLoop() {
 		sess.cleanUp(false)
 	}()
 
-	sess.ws.SetReadLimit(globals.maxMessageSize)
+	sess.ws.SetReadLimit(liveConfig().maxMessageSize)
 	sess.ws.SetReadDeadline(time.Now().Add(pongWait))
 	sess.ws.SetPongHandler(func(string) error {
 		sess.ws.SetReadDeadline(time.Now().Add(pongWait))
@@ -79,10 +79,6 @@ func (sess *Session) writeLoop() {
 				// Channel closed.
 				return
 			}
-			if len(sess.send) > sendQueueLimit {
-				log.Println("ws: outbound queue limit exceeded", sess.sid)
-				return
-			}
 			statsInc("OutgoingMessagesWebsockTotal", 1)
 			if err := wsWrite(sess.ws, websocket.TextMessage, msg); err != nil {
 				if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure,
@@ -91,6 +87,10 @@ func (sess *Session) writeLoop() {
 				}
 				return
 			}
+			sess.sendOverflow()
+
+		case <-sess.overflowReady:
+			sess.sendOverflow()
 
 		case <-sess.bkgTimer.C:
 			if sess.background {
@@ -157,22 +157,28 @@ func serveWebSocket(wrt http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	ws, err := upgrader.Upgrade(wrt, req, nil)
-	if _, ok := err.(websocket.HandshakeError); ok {
-		log.Println("ws: Not a websocket handshake")
+	remoteAddr := getRemoteAddr(req)
+	limitIP, err := sessionLimitsAcquireIP(remoteAddr)
+	if err != nil {
+		sessionLimitsReject(wrt, err, now)
+		log.Println("ws: session rejected", remoteAddr, err)
 		return
-	} else if err != nil {
-		log.Println("ws: failed to Upgrade ", err)
+	}
+
+	ws, err := upgrader.Upgrade(wrt, req, nil)
+	if err != nil {
+		sessionLimitsReleaseIP(limitIP)
+		if _, ok := err.(websocket.HandshakeError); ok {
+			log.Println("ws: Not a websocket handshake")
+		} else {
+			log.Println("ws: failed to Upgrade ", err)
+		}
 		return
 	}
 
 	sess, count := globals.sessionStore.NewSession(ws, "")
-	if globals.useXForwardedFor {
-		sess.remoteAddr = req.Header.Get("X-Forwarded-For")
-	}
-	if sess.remoteAddr == "" {
-		sess.remoteAddr = req.RemoteAddr
-	}
+	sess.remoteAddr = remoteAddr
+	sess.limitIP = limitIP
 
 	log.Println("ws: session started", sess.sid, sess.remoteAddr, count)
 
@@ -0,0 +1,289 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *    Bulk export of the message history of a topic over gRPC: messages are
+ *    streamed in pages in ascending order at a limited rate.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tinode/chat/pbx"
+	"github.com/tinode/chat/server/auth"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// Default number of messages read from the database at once.
+	historyDefaultPageSize = 256
+	// Maximum number of messages read from the database at once.
+	historyMaxPageSize = 1024
+)
+
+// historyConfig is the configuration of the message history stream.
+type historyConfig struct {
+	// Number of messages read from the database at once.
+	PageSize int `json:"page_size"`
+	// Maximum number of messages sent per second by one stream, 0 for no limit.
+	Rate int `json:"rate"`
+	// Maximum number of concurrent history streams on this node, 0 for no limit.
+	MaxStreams int `json:"max_streams"`
+}
+
+var history struct {
+	pageSize   int
+	rate       int
+	maxStreams int
+
+	// Guards the counter of active streams.
+	lock    sync.Mutex
+	streams int
+}
+
+// historyInit configures the message history stream.
+func historyInit(jsconf json.RawMessage) error {
+	history.pageSize = historyDefaultPageSize
+	if len(jsconf) == 0 {
+		return nil
+	}
+
+	var config historyConfig
+	if err := json.Unmarshal(jsconf, &config); err != nil {
+		return errors.New("failed to parse config: " + err.Error())
+	}
+	if config.PageSize < 0 || config.Rate < 0 || config.MaxStreams < 0 {
+		return errors.New("invalid limits")
+	}
+
+	if config.PageSize > 0 {
+		history.pageSize = config.PageSize
+	}
+	if history.pageSize > historyMaxPageSize {
+		history.pageSize = historyMaxPageSize
+	}
+	history.rate = config.Rate
+	history.maxStreams = config.MaxStreams
+
+	return nil
+}
+
+// historyAcquire counts a new history stream if the limit permits.
+func historyAcquire() bool {
+	history.lock.Lock()
+	defer history.lock.Unlock()
+
+	if history.maxStreams > 0 && history.streams >= history.maxStreams {
+		return false
+	}
+	history.streams++
+	return true
+}
+
+// historyRelease stops counting a finished history stream.
+func historyRelease() {
+	history.lock.Lock()
+	history.streams--
+	history.lock.Unlock()
+}
+
+// historyStatus converts a store error into a gRPC error status.
+func historyStatus(err error) error {
+	switch err {
+	case types.ErrMalformed:
+		return status.Error(codes.InvalidArgument, err.Error())
+	case types.ErrFailed, types.ErrExpired, types.ErrCredentials:
+		return status.Error(codes.Unauthenticated, err.Error())
+	case types.ErrPermissionDenied:
+		return status.Error(codes.PermissionDenied, err.Error())
+	case types.ErrNotFound, types.ErrTopicNotFound, types.ErrUserNotFound:
+		return status.Error(codes.NotFound, err.Error())
+	case types.ErrPolicy:
+		return status.Error(codes.ResourceExhausted, err.Error())
+	}
+	return status.Error(codes.Internal, "internal error")
+}
+
+// historyAuthenticate authenticates the user making a single gRPC request such as history or import.
+func historyAuthenticate(scheme string, secret []byte, remoteAddr string) (*auth.Rec, error) {
+	handler := store.GetLogicalAuthHandler(scheme)
+	if handler == nil {
+		return nil, types.ErrMalformed
+	}
+	rec, challenge, err := handler.Authenticate(secret, remoteAddr, "")
+	if err != nil {
+		return nil, err
+	}
+	if challenge != nil {
+		// Multi-stage authentication is not possible in a single request.
+		return nil, types.ErrFailed
+	}
+
+	if rec.State == types.StateUndefined {
+		if rec.State, err = userGetState(rec.Uid); err != nil {
+			return nil, err
+		}
+	}
+	if rec.State != types.StateOK {
+		return nil, types.ErrPermissionDenied
+	}
+	return rec, nil
+}
+
+// historyTopic converts the name of the topic as seen by the user into the name of the topic in the database.
+func historyTopic(uid types.Uid, name string) (string, error) {
+	if strings.HasPrefix(name, "usr") {
+		uid2 := types.ParseUserId(name)
+		if uid2.IsZero() || uid2 == uid {
+			return "", types.ErrMalformed
+		}
+		return uid.P2PName(uid2), nil
+	}
+	if grp := types.ChnToGrp(name); grp != "" {
+		return grp, nil
+	}
+	if types.GetTopicCat(name) == types.TopicCatGrp {
+		return name, nil
+	}
+	return "", types.ErrMalformed
+}
+
+// historyWait pauses the stream after sending count messages since start to keep within the rate limit.
+// Returns false if the stream was cancelled by the client.
+func historyWait(stream pbx.Node_HistoryServer, start time.Time, count int) bool {
+	if history.rate == 0 {
+		return true
+	}
+	due := start.Add(time.Duration(count) * time.Second / time.Duration(history.rate))
+	if wait := time.Until(due); wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-stream.Context().Done():
+			return false
+		}
+	}
+	return true
+}
+
+// History streams the message history of a topic to the client.
+func (*grpcNodeServer) History(req *pbx.HistoryReq, stream pbx.Node_HistoryServer) error {
+	var remoteAddr string
+	if p, ok := peer.FromContext(stream.Context()); ok {
+		remoteAddr = p.Addr.String()
+	}
+
+	if req.GetSinceId() < 0 || req.GetBeforeId() < 0 || req.GetLimit() < 0 {
+		return status.Error(codes.InvalidArgument, "invalid range")
+	}
+
+	rec, err := historyAuthenticate(req.GetScheme(), req.GetSecret(), remoteAddr)
+	if err != nil {
+		log.Println("grpc history: authentication failed", remoteAddr, err)
+		return historyStatus(err)
+	}
+	uid := rec.Uid
+
+	topic, err := historyTopic(uid, req.GetTopic())
+	if err != nil {
+		return historyStatus(err)
+	}
+	original, asChan, err := permalinkAccess(topic, uid)
+	if err != nil {
+		return historyStatus(err)
+	}
+	stopic, err := store.Topics.Get(topic)
+	if err != nil {
+		return historyStatus(err)
+	}
+	if stopic == nil {
+		return historyStatus(types.ErrTopicNotFound)
+	}
+	mask, err := maskingRuleStored(rec.OrganizationId, topic, uid, asChan)
+	if err != nil {
+		return historyStatus(err)
+	}
+
+	if !historyAcquire() {
+		return status.Error(codes.ResourceExhausted, "too many history streams")
+	}
+	defer historyRelease()
+
+	since := int(req.GetSinceId())
+	if since < 1 {
+		since = 1
+	}
+	// Messages with IDs up to the current last ID of the topic. Newer messages are not included.
+	end := stopic.SeqId + 1
+	if before := int(req.GetBeforeId()); before > 0 && before < end {
+		end = before
+	}
+	limit := int(req.GetLimit())
+
+	log.Println("grpc history: started", original, uid.UserId(), since, end, remoteAddr)
+	activityRecord(&types.AccountEvent{
+		User:       uid.String(),
+		What:       activityExport,
+		Detail:     original,
+		RemoteAddr: remoteAddr,
+	})
+
+	start := time.Now()
+	sent := 0
+	for since < end && (limit == 0 || sent < limit) {
+		before := since + history.pageSize
+		if before > end {
+			before = end
+		}
+		messages, err := store.Messages.GetAll(topic, uid,
+			&types.QueryOpt{Since: since, Before: before, Limit: history.pageSize})
+		if err != nil {
+			log.Println("grpc history: failed to read messages", topic, err)
+			return historyStatus(err)
+		}
+
+		// Messages are returned in descending order.
+		count := sent
+		for i := len(messages) - 1; i >= 0 && (limit == 0 || sent < limit); i-- {
+			mm := &messages[i]
+			data := &pbx.ServerData{
+				Topic:     original,
+				Timestamp: timeToInt64(&mm.CreatedAt),
+				DeletedAt: timeToInt64(mm.DeletedAt),
+				SeqId:     int32(mm.SeqId),
+				Head:      interfaceMapToByteMap(mm.Head),
+				Content:   interfaceToBytes(mask.stored(mm, uid))}
+			if !asChan {
+				// Don't show sender to channel readers.
+				data.FromUserId = types.ParseUid(mm.From).UserId()
+			}
+			if err := stream.Send(data); err != nil {
+				log.Println("grpc history: send", original, err)
+				return err
+			}
+			sent++
+		}
+		statsInc("OutgoingMessagesGrpcTotal", sent-count)
+
+		since = before
+		if !historyWait(stream, start, sent) {
+			return status.Error(codes.Canceled, "cancelled by client")
+		}
+	}
+
+	log.Println("grpc history: finished", original, uid.UserId(), sent)
+	return nil
+}
@@ -151,10 +151,18 @@ func signalHandler() <-chan bool {
 	signal.Notify(signchan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
 
 	go func() {
-		// Wait for a signal. Don't care which signal it is
-		sig := <-signchan
-		log.Printf("Signal received: '%s', shutting down", sig)
-		stop <- true
+		for {
+			sig := <-signchan
+			if sig == syscall.SIGHUP {
+				// Reload the config instead of shutting down.
+				log.Printf("Signal received: '%s', reloading config", sig)
+				configSignalReload()
+				continue
+			}
+			log.Printf("Signal received: '%s', shutting down", sig)
+			stop <- true
+			return
+		}
 	}()
 
 	return stop
@@ -331,23 +339,30 @@ func getHttpAuth(req *http.Request) (method, secret string) {
 
 // Authenticate non-websocket HTTP request
 func authHttpRequest(req *http.Request) (types.Uid, []byte, error) {
+	uid, _, challenge, err := authHttpRequestOrg(req)
+	return uid, challenge, err
+}
+
+// authHttpRequestOrg authenticates non-websocket HTTP request and returns the organization of the user too.
+func authHttpRequestOrg(req *http.Request) (types.Uid, string, []byte, error) {
 	var uid types.Uid
+	var org string
 	if authMethod, secret := getHttpAuth(req); authMethod != "" {
 		decodedSecret := make([]byte, base64.StdEncoding.DecodedLen(len(secret)))
 		n, err := base64.StdEncoding.Decode(decodedSecret, []byte(secret))
 		if err != nil {
-			return uid, nil, types.ErrMalformed
+			return uid, org, nil, types.ErrMalformed
 		}
 
 		if authhdl := store.GetLogicalAuthHandler(authMethod); authhdl != nil {
 			rec, challenge, err := authhdl.Authenticate(decodedSecret[:n], getRemoteAddr(req), "")
 			if err != nil {
-				return uid, nil, err
+				return uid, org, nil, err
 			}
 			if challenge != nil {
-				return uid, challenge, nil
+				return uid, org, challenge, nil
 			}
-			uid = rec.Uid
+			uid, org = rec.Uid, rec.OrganizationId
 		} else {
 			log.Println("fileUpload: auth data is present but handler is not found", authMethod)
 		}
@@ -355,8 +370,8 @@ func authHttpRequest(req *http.Request) (types.Uid, []byte, error) {
 		// Find the session, make sure it's appropriately authenticated.
 		sess := globals.sessionStore.Get(req.FormValue("sid"))
 		if sess != nil {
-			uid = sess.uid
+			uid, _, org = sess.activeAccount()
 		}
 	}
-	return uid, nil, nil
+	return uid, org, nil, nil
 }
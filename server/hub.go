@@ -10,12 +10,17 @@
 package main
 
 import (
+	"errors"
+	"hash/fnv"
 	"log"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/tinode/chat/server/auth"
+	"github.com/tinode/chat/server/concurrency"
 	"github.com/tinode/chat/server/store"
 	"github.com/tinode/chat/server/store/types"
 )
@@ -35,6 +40,10 @@ type sessionJoin struct {
 	pkt *ClientComMessage
 	// Session to attach to topic.
 	sess *Session
+	// Message to publish to a p2p topic instead of attaching the session to it.
+	pub *ServerComMessage
+	// The reader waited in the queue of a full channel and is now let in.
+	admitted bool
 }
 
 // Session wants to leave the topic
@@ -57,6 +66,9 @@ type topicUnreg struct {
 	forUser types.Uid
 	// Unregister then delete the topic.
 	del bool
+	// Unregister the topic so it's loaded again with changes made directly in the database.
+	// Attached sessions are told to subscribe again.
+	reload bool
 	// Channel for reporting operation completion when deleting topics for a user.
 	done chan<- bool
 }
@@ -68,64 +80,267 @@ type metaReq struct {
 	sess *Session
 	// UID of the user being affected. Could be zero.
 	forUser types.Uid
-	// New topic state value. Only types.StateSuspended is supported at this time.
+	// New topic state value: types.StateOK activates the topics, types.StateUndefined means
+	// the state is unchanged and the user's trusted values are updated, any other state suspends them.
 	state types.ObjState
+	// New trusted values of the user.
+	trusted interface{}
+	// Change of the stored state of the topic made by the server, see topicTask.
+	task func(t *Topic) error
+	// Receives the result of the request generated by the server. Could be nil.
+	done chan<- error
+}
+
+// topicTask is a change of the stored state of a topic made by the server. It must not race with
+// the topic loaded in memory: the topic would overwrite the change or serve stale state.
+type topicTask struct {
+	// Name of the topic.
+	name string
+	// Applies the change if the topic is loaded. Called by the topic goroutine: it must update
+	// the state of the topic in memory too.
+	loaded func(t *Topic) error
+	// Applies the change if the topic is not loaded. The topic is not loaded until it returns.
+	offline func() error
+	// Receives the result.
+	done chan<- error
+}
+
+const (
+	// Time to wait for a topic task to complete.
+	topicTaskTimeout = 30 * time.Second
+	// Number of attempts to apply a topic task when the topic is busy.
+	topicTaskAttempts = 3
+	// Delay between attempts.
+	topicTaskRetryDelay = 100 * time.Millisecond
+)
+
+// errTopicBusy means the topic cannot take a change now: its queue is full or it's being unloaded.
+var errTopicBusy = errors.New("topic busy")
+
+// Names of request queues, used in metrics and logs.
+const (
+	queueHubRoute       = "HubRoute"
+	queueHubJoin        = "HubJoin"
+	queueHubUnreg       = "HubUnreg"
+	queueHubMeta        = "HubMeta"
+	queueTopicBroadcast = "TopicBroadcast"
+	queueTopicReg       = "TopicReg"
+	queueTopicUnreg     = "TopicUnreg"
+	queueTopicMeta      = "TopicMeta"
+	queueTopicSupd      = "TopicSupd"
+)
+
+// queueConfig defines sizes of buffered channels used for passing requests to the hub and topics.
+type queueConfig struct {
+	// Hub shard queues.
+	HubRoute int `json:"hub_route"`
+	HubJoin  int `json:"hub_join"`
+	HubUnreg int `json:"hub_unreg"`
+	HubMeta  int `json:"hub_meta"`
+	// Topic queues.
+	TopicBroadcast int `json:"topic_broadcast"`
+	TopicReg       int `json:"topic_reg"`
+	TopicUnreg     int `json:"topic_unreg"`
+	TopicMeta      int `json:"topic_meta"`
+	TopicSupd      int `json:"topic_supd"`
+}
+
+// queueSizes returns queue sizes from the config with missing values replaced by defaults.
+func queueSizes(conf *queueConfig) queueConfig {
+	sizes := queueConfig{
+		HubRoute:       4096,
+		HubJoin:        256,
+		HubUnreg:       256,
+		HubMeta:        128,
+		TopicBroadcast: 256,
+		TopicReg:       256,
+		TopicUnreg:     256,
+		TopicMeta:      64,
+		TopicSupd:      32,
+	}
+	if conf == nil {
+		return sizes
+	}
+
+	pick := func(val, def int) int {
+		if val > 0 {
+			return val
+		}
+		return def
+	}
+	sizes.HubRoute = pick(conf.HubRoute, sizes.HubRoute)
+	sizes.HubJoin = pick(conf.HubJoin, sizes.HubJoin)
+	sizes.HubUnreg = pick(conf.HubUnreg, sizes.HubUnreg)
+	sizes.HubMeta = pick(conf.HubMeta, sizes.HubMeta)
+	sizes.TopicBroadcast = pick(conf.TopicBroadcast, sizes.TopicBroadcast)
+	sizes.TopicReg = pick(conf.TopicReg, sizes.TopicReg)
+	sizes.TopicUnreg = pick(conf.TopicUnreg, sizes.TopicUnreg)
+	sizes.TopicMeta = pick(conf.TopicMeta, sizes.TopicMeta)
+	sizes.TopicSupd = pick(conf.TopicSupd, sizes.TopicSupd)
+	return sizes
+}
+
+// queueOverflow counts and logs a request which was rejected because the queue was full.
+func queueOverflow(src, queue, topic, sid string, length int) {
+	statsInc(queue+"QueueOverflowTotal", 1)
+	log.Printf("%s: queue full; queue=%s topic=%s sid=%s len=%d", src, queue, topic, sid, length)
 }
 
 // Hub is the core structure which holds topics.
+// Topics are partitioned between shards by hash of the topic name. Each shard is served by
+// its own goroutine so registration of and routing to unrelated topics do not contend.
 type Hub struct {
 
+	// Topic shards, indexed by hash of topic name
+	shards []*hubShard
+
+	// Suspend/activate topics of a user, buffered 128
+	meta chan *metaReq
+
+	// Remove topics of a user, possibly deleting them afterwards, buffered at 32
+	unreg chan *topicUnreg
+
+	// Cluster request to rehash topics, unbuffered
+	rehash chan bool
+
+	// Request to shutdown, unbuffered
+	shutdown chan chan<- bool
+
+	// Workers for detaching sessions from topics in bulk.
+	detachPool *concurrency.GoRoutinePool
+}
+
+// hubShard is a subset of topics with its own request channels.
+type hubShard struct {
 	// Topics must be indexed by name
 	topics *sync.Map
 
-	// Channel for routing messages between topics, buffered at 4096
+	// Channel for routing messages between topics, buffered at 4096 by default
 	route chan *ServerComMessage
 
-	// subscribe session to topic, possibly creating a new topic, buffered at 32
+	// subscribe session to topic, possibly creating a new topic, buffered at 256 by default
 	join chan *sessionJoin
 
-	// Remove topic from hub, possibly deleting it afterwards, buffered at 32
+	// Remove topic from hub, possibly deleting it afterwards, buffered at 256 by default
 	unreg chan *topicUnreg
 
-	// Process get.info requests for topic not subscribed to, buffered 128
+	// Process get.info requests for topic not subscribed to, buffered 128 by default
 	meta chan *metaReq
 
-	// Cluster request to rehash topics, unbuffered
-	rehash chan bool
+	// Cluster request to rehash topics, unbuffered. Shard responds when done.
+	rehash chan chan<- bool
 
-	// Request to shutdown, unbuffered
-	shutdown chan chan<- bool
+	// Request to shutdown, unbuffered. Shard responds with the count of stopped topics.
+	shutdown chan chan<- int
+
+	// Changes of the stored state of topics, buffered at 64.
+	task chan *topicTask
+	// Offline tasks report the names of topics they are done with, buffered at 64.
+	taskDone chan string
+	// Topics which are not loaded and are being changed by offline tasks. Accessed by the shard
+	// goroutine only.
+	busy map[string]bool
+}
+
+// shardFor returns the shard responsible for the topic with the given routable name.
+func (h *Hub) shardFor(name string) *hubShard {
+	if len(h.shards) == 1 {
+		return h.shards[0]
+	}
+	hash := fnv.New32a()
+	hash.Write([]byte(name))
+	return h.shards[hash.Sum32()%uint32(len(h.shards))]
 }
 
 func (h *Hub) topicGet(name string) *Topic {
-	if t, ok := h.topics.Load(name); ok {
+	if t, ok := h.shardFor(name).topics.Load(name); ok {
 		return t.(*Topic)
 	}
 	return nil
 }
 
 func (h *Hub) topicPut(name string, t *Topic) {
-	h.topics.Store(name, t)
+	h.shardFor(name).topics.Store(name, t)
 }
 
 func (h *Hub) topicDel(name string) {
-	h.topics.Delete(name)
+	h.shardFor(name).topics.Delete(name)
+}
+
+// topicsRange calls f for each topic in every shard. Iteration stops if f returns false.
+func (h *Hub) topicsRange(f func(name, t interface{}) bool) {
+	for _, shard := range h.shards {
+		proceed := true
+		shard.topics.Range(func(name, t interface{}) bool {
+			proceed = f(name, t)
+			return proceed
+		})
+		if !proceed {
+			return
+		}
+	}
 }
 
-func newHub() *Hub {
+// routeMsg sends the message to the shard responsible for msg.RcptTo for routing to the topic.
+// Blocks if the route queue is full.
+func (h *Hub) routeMsg(msg *ServerComMessage) {
+	shard := h.shardFor(msg.RcptTo)
+	select {
+	case shard.route <- msg:
+	default:
+		statsInc(queueHubRoute+"QueueBlockedTotal", 1)
+		start := time.Now()
+		shard.route <- msg
+		log.Printf("hub.routeMsg: producer blocked on full queue; queue=%s topic=%s waited=%s",
+			queueHubRoute, msg.RcptTo, time.Since(start))
+	}
+}
+
+func newHub(shardCount int) *Hub {
+	if shardCount <= 0 {
+		shardCount = 1
+	}
+
 	var h = &Hub{
-		topics: &sync.Map{},
-		// this needs to be buffered - hub generates invites and adds them to this queue
-		route:    make(chan *ServerComMessage, 4096),
-		join:     make(chan *sessionJoin, 256),
-		unreg:    make(chan *topicUnreg, 256),
+		shards:   make([]*hubShard, shardCount),
+		unreg:    make(chan *topicUnreg, 32),
 		rehash:   make(chan bool),
 		meta:     make(chan *metaReq, 128),
 		shutdown: make(chan chan<- bool),
+
+		detachPool: concurrency.NewGoRoutinePool(detachWorkers),
+	}
+
+	for i := range h.shards {
+		h.shards[i] = &hubShard{
+			topics: &sync.Map{},
+			// this needs to be buffered - hub generates invites and adds them to this queue
+			route:    make(chan *ServerComMessage, globals.queueSizes.HubRoute),
+			join:     make(chan *sessionJoin, globals.queueSizes.HubJoin),
+			unreg:    make(chan *topicUnreg, globals.queueSizes.HubUnreg),
+			meta:     make(chan *metaReq, globals.queueSizes.HubMeta),
+			rehash:   make(chan chan<- bool),
+			shutdown: make(chan chan<- int),
+			task:     make(chan *topicTask, 64),
+			taskDone: make(chan string, 64),
+			busy:     make(map[string]bool),
+		}
 	}
 
 	statsRegisterInt("LiveTopics")
 	statsRegisterInt("TotalTopics")
+	statsRegisterInt("TopicsMemoryEstimate")
+	statsRegisterInt("TopicsEvictedTotal")
+
+	for _, queue := range []string{queueHubRoute, queueHubJoin, queueHubUnreg, queueHubMeta,
+		queueTopicBroadcast, queueTopicReg, queueTopicUnreg, queueTopicMeta, queueTopicSupd} {
+		// Highest current occupancy of the queue across all shards or topics.
+		statsRegisterInt(queue + "QueueMaxLen")
+		// Requests rejected because the queue was full.
+		statsRegisterInt(queue + "QueueOverflowTotal")
+	}
+	// Producer had to wait for space in the route queue.
+	statsRegisterInt(queueHubRoute + "QueueBlockedTotal")
 
 	statsRegisterInt("IncomingMessagesWebsockTotal")
 	statsRegisterInt("OutgoingMessagesWebsockTotal")
@@ -136,6 +351,11 @@ func newHub() *Hub {
 	statsRegisterInt("IncomingMessagesGrpcTotal")
 	statsRegisterInt("OutgoingMessagesGrpcTotal")
 
+	statsRegisterInt("OutgoingMessagesDroppedTotal")
+
+	// Compliance journal entries which could not be journaled.
+	statsRegisterInt("JournalFailedTotal")
+
 	statsRegisterInt("FileDownloadsTotal")
 	statsRegisterInt("FileUploadsTotal")
 
@@ -147,21 +367,101 @@ func newHub() *Hub {
 	statsRegisterHistogram("RequestLatency", RequestLatencyDistribution)
 	statsRegisterHistogram("OutgoingMessageSize", OutgoingMessageSizeDistribution)
 
+	for _, shard := range h.shards {
+		go h.runShard(shard)
+	}
 	go h.run()
 
 	if !globals.cluster.isRemoteTopic("sys") {
 		// Initialize system 'sys' topic. There is only one sys topic per cluster.
-		h.join <- &sessionJoin{pkt: &ClientComMessage{RcptTo: "sys", Original: "sys"}}
+		h.shardFor("sys").join <- &sessionJoin{pkt: &ClientComMessage{RcptTo: "sys", Original: "sys"}}
 	}
 
 	return h
 }
 
+// run handles requests which are not specific to a single topic.
 func (h *Hub) run() {
+	// Periodically check memory used by topics and evict idle topics if needed.
+	evictTicker := time.NewTicker(topicEvictionPeriod)
+	defer evictTicker.Stop()
 
 	for {
 		select {
-		case join := <-h.join:
+		case <-evictTicker.C:
+			h.evictIdleTopics()
+			h.reportQueueStats()
+
+		case meta := <-h.meta:
+			if meta.state == types.StateUndefined {
+				// Update cached trusted values of the user
+				go h.topicsTrustedForUser(meta.forUser, meta.trusted)
+			} else {
+				// Suspend/activate user's topics
+				go h.topicsStateForUser(meta.forUser, meta.state != types.StateOK)
+			}
+
+		case unreg := <-h.unreg:
+			reason := StopNone
+			if unreg.del {
+				reason = StopDeleted
+			} else if unreg.reload {
+				reason = StopReloading
+			}
+			go h.stopTopicsForUser(unreg.forUser, reason, unreg.done)
+
+		case <-h.rehash:
+			// Cluster rehashing. Some previously local topics became remote,
+			// and the other way round.
+			// Such topics must be shut down at this node.
+			shardsdone := make(chan bool, len(h.shards))
+			for _, shard := range h.shards {
+				shard.rehash <- shardsdone
+			}
+			for range h.shards {
+				<-shardsdone
+			}
+
+			// Check if 'sys' topic has migrated to this node.
+			if h.topicGet("sys") == nil && !globals.cluster.isRemoteTopic("sys") {
+				// Yes, 'sys' has migrated here. Initialize it.
+				// Call from another goroutine. Otherwise could deadlock if the join queue is full.
+				go func() {
+					h.shardFor("sys").join <- &sessionJoin{pkt: &ClientComMessage{RcptTo: "sys", Original: "sys"}}
+				}()
+			}
+
+		case hubdone := <-h.shutdown:
+			// start cleanup process
+			shardsdone := make(chan int, len(h.shards))
+			for _, shard := range h.shards {
+				shard.shutdown <- shardsdone
+			}
+
+			topicCount := 0
+			for range h.shards {
+				topicCount += <-shardsdone
+			}
+
+			log.Printf("Hub shutdown completed with %d topics", topicCount)
+
+			// All topics are stopped, no more sessions to detach.
+			h.detachPool.Stop()
+
+			// let the main goroutine know we are done with the cleanup
+			hubdone <- true
+
+			return
+		}
+	}
+}
+
+// runShard handles requests addressed to topics of one shard.
+func (h *Hub) runShard(shard *hubShard) {
+
+	for {
+		select {
+		case join := <-shard.join:
 			// Handle a subscription request:
 			// 1. Init topic
 			// 1.1 If a new topic is requested, create it
@@ -171,6 +471,14 @@ func (h *Hub) run() {
 			// 1.2.3 if it cannot be loaded (not found), fail
 			// 2. Check access rights and reject, if appropriate
 			// 3. Attach session to the topic
+			if shard.busy[join.pkt.RcptTo] {
+				// The stored topic is being changed, it cannot be loaded now.
+				if join.sess.inflightReqs != nil {
+					join.sess.inflightReqs.Done()
+				}
+				join.sess.queueOut(ErrServiceUnavailableReply(join.pkt, join.pkt.Timestamp))
+				continue
+			}
 			// Is the topic already loaded?
 			t := h.topicGet(join.pkt.RcptTo)
 			if t == nil {
@@ -180,12 +488,13 @@ func (h *Hub) run() {
 					// Indicates a proxy topic.
 					isProxy:   globals.cluster.isRemoteTopic(join.pkt.RcptTo),
 					sessions:  make(map[*Session]perSessionData),
-					broadcast: make(chan *ServerComMessage, 256),
-					reg:       make(chan *sessionJoin, 256),
-					unreg:     make(chan *sessionLeave, 256),
-					meta:      make(chan *metaReq, 64),
-					perUser:   make(map[types.Uid]perUserData),
+					broadcast: make(chan *ServerComMessage, globals.queueSizes.TopicBroadcast),
+					reg:       make(chan *sessionJoin, globals.queueSizes.TopicReg),
+					unreg:     make(chan *sessionLeave, globals.queueSizes.TopicUnreg),
+					meta:      make(chan *metaReq, globals.queueSizes.TopicMeta),
+					perUser:   make(map[types.Uid]*perUserData),
 					exit:      make(chan *shutDown, 1),
+					expire:    make(chan bool, 1),
 				}
 				if globals.cluster != nil {
 					if t.isProxy {
@@ -215,11 +524,11 @@ func (h *Hub) run() {
 						join.sess.inflightReqs.Done()
 					}
 					join.sess.queueOut(ErrServiceUnavailableReply(join.pkt, join.pkt.Timestamp))
-					log.Println("hub.join loop: topic's reg queue full", join.pkt.RcptTo, join.sess.sid, " - total queue len:", len(t.reg))
+					queueOverflow("hub.join", queueTopicReg, join.pkt.RcptTo, join.sess.sid, len(t.reg))
 				}
 			}
 
-		case msg := <-h.route:
+		case msg := <-shard.route:
 			// This is a message from a connection not subscribed to topic
 			// Route incoming message to topic if topic permits such routing.
 
@@ -229,7 +538,7 @@ func (h *Hub) run() {
 					select {
 					case dst.broadcast <- msg:
 					default:
-						log.Println("hub: topic's broadcast queue is full", dst.name)
+						queueOverflow("hub.route", queueTopicBroadcast, dst.name, "", len(dst.broadcast))
 					}
 				} else {
 					log.Println("hub: invalid topic category for broadcast", dst.name)
@@ -251,42 +560,40 @@ func (h *Hub) run() {
 				msg.sess.queueOut(NoErrAcceptedExplicitTs(msg.Id, msg.RcptTo, types.TimeNow(), msg.Timestamp))
 			}
 
-		case meta := <-h.meta:
-			// Suspend/activate user's topics
-			if !meta.forUser.IsZero() {
-				go h.topicsStateForUser(meta.forUser, meta.state == types.StateSuspended)
-			} else {
-				// Metadata read or update from a user who is not attached to the topic.
-				if meta.pkt.Get != nil {
-					if meta.pkt.MetaWhat == constMsgMetaDesc {
-						go replyOfflineTopicGetDesc(meta.sess, meta.pkt)
-					} else {
-						go replyOfflineTopicGetSub(meta.sess, meta.pkt)
-					}
-				} else if meta.pkt.Set != nil {
-					go replyOfflineTopicSetSub(meta.sess, meta.pkt)
+		case meta := <-shard.meta:
+			// Metadata read or update from a user who is not attached to the topic.
+			if shard.busy[meta.pkt.RcptTo] {
+				meta.sess.queueOut(ErrServiceUnavailableReply(meta.pkt, types.TimeNow()))
+			} else if meta.pkt.Get != nil {
+				if meta.pkt.MetaWhat == constMsgMetaDesc {
+					go replyOfflineTopicGetDesc(meta.sess, meta.pkt)
+				} else {
+					go replyOfflineTopicGetSub(meta.sess, meta.pkt)
 				}
+			} else if meta.pkt.Set != nil {
+				go replyOfflineTopicSetSub(meta.sess, meta.pkt)
 			}
 
-		case unreg := <-h.unreg:
+		case unreg := <-shard.unreg:
+			// The topic is being garbage collected or deleted.
 			reason := StopNone
 			if unreg.del {
 				reason = StopDeleted
+			} else if unreg.reload {
+				reason = StopReloading
 			}
-			if unreg.forUser.IsZero() {
-				// The topic is being garbage collected or deleted.
-				if err := h.topicUnreg(unreg.sess, unreg.rcptTo, unreg.pkt, reason); err != nil {
-					log.Println("hub.topicUnreg failed:", err)
-				}
-			} else {
-				go h.stopTopicsForUser(unreg.forUser, reason, unreg.done)
+			if err := h.topicUnreg(unreg.sess, unreg.rcptTo, unreg.pkt, reason); err != nil {
+				log.Println("hub.topicUnreg failed:", err)
 			}
 
-		case <-h.rehash:
-			// Cluster rehashing. Some previously local topics became remote,
-			// and the other way round.
-			// Such topics must be shut down at this node.
-			h.topics.Range(func(_, t interface{}) bool {
+		case task := <-shard.task:
+			h.startTopicTask(shard, task)
+
+		case name := <-shard.taskDone:
+			delete(shard.busy, name)
+
+		case sharddone := <-shard.rehash:
+			shard.topics.Range(func(_, t interface{}) bool {
 				topic := t.(*Topic)
 				// Handle two cases:
 				// 1. Master topic has moved out to another node.
@@ -297,21 +604,12 @@ func (h *Hub) run() {
 				}
 				return true
 			})
+			sharddone <- true
 
-			// Check if 'sys' topic has migrated to this node.
-			if h.topicGet("sys") == nil && !globals.cluster.isRemoteTopic("sys") {
-				// Yes, 'sys' has migrated here. Initialize it.
-				// The h.join is unbuffered. We must call from another goroutine. Otherwise deadlock.
-				go func() {
-					h.join <- &sessionJoin{pkt: &ClientComMessage{RcptTo: "sys", Original: "sys"}}
-				}()
-			}
-
-		case hubdone := <-h.shutdown:
-			// start cleanup process
+		case sharddone := <-shard.shutdown:
 			topicsdone := make(chan bool)
 			topicCount := 0
-			h.topics.Range(func(_, topic interface{}) bool {
+			shard.topics.Range(func(_, topic interface{}) bool {
 				topic.(*Topic).exit <- &shutDown{done: topicsdone}
 				topicCount++
 				return true
@@ -321,10 +619,7 @@ func (h *Hub) run() {
 				<-topicsdone
 			}
 
-			log.Printf("Hub shutdown completed with %d topics", topicCount)
-
-			// let the main goroutine know we are done with the cleanup
-			hubdone <- true
+			sharddone <- topicCount
 
 			return
 
@@ -333,12 +628,103 @@ func (h *Hub) run() {
 	}
 }
 
+// evictIdleTopics shuts down least recently active idle topics when the number of resident
+// topics or their estimated memory use exceed the configured limits.
+func (h *Hub) evictIdleTopics() {
+	var count int
+	var memory int64
+	var idle []*Topic
+	h.topicsRange(func(_, t interface{}) bool {
+		topic := t.(*Topic)
+		count++
+		memory += atomic.LoadInt64(&topic.memSize)
+		if !topic.isProxy && topic.isIdle() {
+			idle = append(idle, topic)
+		}
+		return true
+	})
+
+	statsSet("TopicsMemoryEstimate", memory)
+
+	live := liveConfig()
+	overLimit := func() bool {
+		return (live.maxResidentTopics > 0 && count > live.maxResidentTopics) ||
+			(live.maxTopicsMemory > 0 && memory > live.maxTopicsMemory)
+	}
+
+	if !overLimit() || len(idle) == 0 {
+		return
+	}
+
+	// Least recently active topics go first.
+	sort.Slice(idle, func(i, j int) bool {
+		return atomic.LoadInt64(&idle[i].lastActive) < atomic.LoadInt64(&idle[j].lastActive)
+	})
+
+	evicted := 0
+	for _, topic := range idle {
+		if !overLimit() {
+			break
+		}
+		select {
+		case topic.expire <- true:
+			count--
+			memory -= atomic.LoadInt64(&topic.memSize)
+			evicted++
+		default:
+			// Eviction request is already pending.
+		}
+	}
+
+	if evicted > 0 {
+		log.Printf("hub: evicted %d idle topics; resident topics %d, memory estimate %d", evicted, count, memory)
+		statsInc("TopicsEvictedTotal", evicted)
+	}
+}
+
+// reportQueueStats publishes the highest occupancy of hub and topic queues.
+func (h *Hub) reportQueueStats() {
+	maxLen := func(cur *int, length int) {
+		if length > *cur {
+			*cur = length
+		}
+	}
+
+	var route, join, unreg, meta int
+	for _, shard := range h.shards {
+		maxLen(&route, len(shard.route))
+		maxLen(&join, len(shard.join))
+		maxLen(&unreg, len(shard.unreg))
+		maxLen(&meta, len(shard.meta))
+	}
+	statsSet(queueHubRoute+"QueueMaxLen", int64(route))
+	statsSet(queueHubJoin+"QueueMaxLen", int64(join))
+	statsSet(queueHubUnreg+"QueueMaxLen", int64(unreg))
+	statsSet(queueHubMeta+"QueueMaxLen", int64(meta))
+
+	var broadcast, reg, tunreg, tmeta, supd int
+	h.topicsRange(func(_, t interface{}) bool {
+		topic := t.(*Topic)
+		maxLen(&broadcast, len(topic.broadcast))
+		maxLen(&reg, len(topic.reg))
+		maxLen(&tunreg, len(topic.unreg))
+		maxLen(&tmeta, len(topic.meta))
+		maxLen(&supd, len(topic.supd))
+		return true
+	})
+	statsSet(queueTopicBroadcast+"QueueMaxLen", int64(broadcast))
+	statsSet(queueTopicReg+"QueueMaxLen", int64(reg))
+	statsSet(queueTopicUnreg+"QueueMaxLen", int64(tunreg))
+	statsSet(queueTopicMeta+"QueueMaxLen", int64(tmeta))
+	statsSet(queueTopicSupd+"QueueMaxLen", int64(supd))
+}
+
 // Update state of all topics associated with the given user:
 // * all p2p topics with the given user
 // * group topics where the given user is the owner.
 // 'me' and fnd' are ignored here because they are direcly tied to the user object.
 func (h *Hub) topicsStateForUser(uid types.Uid, suspended bool) {
-	h.topics.Range(func(name interface{}, t interface{}) bool {
+	h.topicsRange(func(name interface{}, t interface{}) bool {
 		topic := t.(*Topic)
 		if topic.cat == types.TopicCatMe || topic.cat == types.TopicCatFnd {
 			return true
@@ -353,6 +739,27 @@ func (h *Hub) topicsStateForUser(uid types.Uid, suspended bool) {
 	})
 }
 
+// topicsTrustedForUser passes new trusted values of the user to the user's 'me' topic and
+// p2p topics with the user which are loaded on this node.
+func (h *Hub) topicsTrustedForUser(uid types.Uid, trusted interface{}) {
+	me := uid.UserId()
+	h.topicsRange(func(name interface{}, t interface{}) bool {
+		topic := t.(*Topic)
+		if topic.isProxy {
+			return true
+		}
+
+		if _, isMember := topic.perUser[uid]; topic.name == me || (topic.cat == types.TopicCatP2P && isMember) {
+			select {
+			case topic.meta <- &metaReq{forUser: uid, state: types.StateUndefined, trusted: trusted}:
+			default:
+				queueOverflow("hub.trusted", queueTopicMeta, topic.name, "", len(topic.meta))
+			}
+		}
+		return true
+	})
+}
+
 // topicUnreg deletes or unregisters the topic:
 //
 // Cases:
@@ -388,8 +795,8 @@ func (h *Hub) topicUnreg(sess *Session, topic string, msg *ClientComMessage, rea
 		// Case 1 (unregister and delete)
 		if t := h.topicGet(topic); t != nil {
 			// Case 1.1: topic is online
-			if t.owner == asUid || (t.cat == types.TopicCatP2P && t.subsCount() < 2) {
-				// Case 1.1.1: requester is the owner or last sub in a p2p topic
+			if t.isOwner(asUid) || (t.cat == types.TopicCatP2P && t.subsCount() < 2) {
+				// Case 1.1.1: requester is the owner or a co-owner or last sub in a p2p topic
 
 				t.markPaused(true)
 				if err := store.Topics.Delete(topic, msg.Del.Hard); err != nil {
@@ -444,7 +851,7 @@ func (h *Hub) topicUnreg(sess *Session, topic string, msg *ClientComMessage, rea
 			}
 
 			tcat := topicCat(topic)
-			if !(sub.ModeGiven & sub.ModeWant).IsOwner() {
+			if !(sub.ModeGiven & sub.ModeWant).IsOwner() && !isStoredCoOwner(topic, asUid) {
 				// Case 1.2.2.1 Not the owner, but possibly last subscription in a P2P topic.
 
 				if tcat == types.TopicCatP2P && len(subs) < 2 {
@@ -479,7 +886,7 @@ func (h *Hub) topicUnreg(sess *Session, topic string, msg *ClientComMessage, rea
 				}
 
 			} else {
-				// Case 1.2.1.1: owner, delete the group topic from db.
+				// Case 1.2.1.1: owner or co-owner, delete the group topic from db.
 				// Only group topics have owners.
 				if err := store.Topics.Delete(topic, msg.Del.Hard); err != nil {
 					sess.queueOut(ErrUnknownReply(msg, now))
@@ -514,6 +921,61 @@ func (h *Hub) topicUnreg(sess *Session, topic string, msg *ClientComMessage, rea
 	return nil
 }
 
+// runTopicTask applies a change to the stored state of a topic hosted by this node: through the topic
+// goroutine if the topic is loaded, otherwise while the topic is kept from loading. Returns errTopicBusy
+// if the topic cannot take the change now.
+func (h *Hub) runTopicTask(name string, loaded func(t *Topic) error, offline func() error) error {
+	for attempt := 1; ; attempt++ {
+		done := make(chan error, 1)
+		h.shardFor(name).task <- &topicTask{name: name, loaded: loaded, offline: offline, done: done}
+
+		timer := time.NewTimer(topicTaskTimeout)
+		var err error
+		select {
+		case err = <-done:
+			timer.Stop()
+		case <-timer.C:
+			return errTopicBusy
+		}
+
+		if err != errTopicBusy || attempt >= topicTaskAttempts {
+			return err
+		}
+		// The topic may be unloading, try again when it's gone.
+		time.Sleep(topicTaskRetryDelay)
+	}
+}
+
+// startTopicTask passes the task to the topic if it's loaded or starts it offline otherwise.
+// Called by the shard goroutine.
+func (h *Hub) startTopicTask(shard *hubShard, task *topicTask) {
+	if t := h.topicGet(task.name); t != nil {
+		if t.isProxy {
+			task.done <- errors.New("topic is hosted by another node")
+			return
+		}
+		select {
+		case t.meta <- &metaReq{task: task.loaded, done: task.done}:
+		default:
+			queueOverflow("hub.task", queueTopicMeta, t.name, "", len(t.meta))
+			task.done <- errTopicBusy
+		}
+		return
+	}
+
+	if shard.busy[task.name] {
+		// Another offline task is changing the topic.
+		task.done <- errTopicBusy
+		return
+	}
+	shard.busy[task.name] = true
+	go func() {
+		err := task.offline()
+		shard.taskDone <- task.name
+		task.done <- err
+	}()
+}
+
 // Terminate all topics associated with the given user:
 // * all p2p topics with the given user
 // * group topics where the given user is the owner.
@@ -525,17 +987,23 @@ func (h *Hub) stopTopicsForUser(uid types.Uid, reason int, alldone chan<- bool)
 	}
 
 	count := 0
-	h.topics.Range(func(name interface{}, t interface{}) bool {
+	h.topicsRange(func(name interface{}, t interface{}) bool {
 		topic := t.(*Topic)
 		if _, isMember := topic.perUser[uid]; (topic.cat != types.TopicCatGrp && isMember) ||
 			topic.owner == uid {
 
+			topicReason := reason
+			if reason == StopDeleted && topic.cat == types.TopicCatGrp && len(topic.owners) > 0 {
+				// Ownership is passed to a co-owner, the topic is reloaded with the new owner.
+				topicReason = StopReloading
+			}
+
 			topic.markDeleted()
 
-			h.topics.Delete(name)
+			h.topicDel(name.(string))
 
 			// This call is non-blocking unless some other routine tries to stop it at the same time.
-			topic.exit <- &shutDown{reason: reason, done: done}
+			topic.exit <- &shutDown{reason: topicReason, done: done}
 
 			// Just send to p2p topics here.
 			if topic.cat == types.TopicCatP2P && len(topic.perUser) == 2 {
@@ -620,7 +1088,7 @@ func replyOfflineTopicGetDesc(sess *Session, msg *ClientComMessage) {
 		desc.CreatedAt = &suser.CreatedAt
 		desc.UpdatedAt = &suser.UpdatedAt
 		desc.Public = suser.Public
-		if sess.authLvl == auth.LevelRoot {
+		if auth.Level(msg.AuthLvl) == auth.LevelRoot {
 			desc.State = suser.State.String()
 		}
 	}
@@ -685,6 +1153,7 @@ func replyOfflineTopicGetSub(sess *Session, msg *ClientComMessage) {
 			sub.DelId = ssub.DelId
 			sub.ReadSeqId = ssub.ReadSeqId
 			sub.RecvSeqId = ssub.RecvSeqId
+			sub.DlvSeqId = ssub.DlvSeqId
 		}
 	}
 
@@ -0,0 +1,173 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *    Localization of texts composed by the server: descriptions of errors and
+ *    names of attachments in digests. Translations are loaded from bundles,
+ *    one JSON file per language.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"strings"
+
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+	"golang.org/x/text/language"
+)
+
+// Built-in texts used when the bundles have no translation.
+var i18nDefaultTexts = map[string]string{
+	"image": "IMAGE",
+	"file":  "FILE",
+}
+
+// i18nConfig is the configuration of localization.
+type i18nConfig struct {
+	// Language used when the language of the user is unknown or has no bundle, "en" by default.
+	DefaultLang string `json:"default_lang"`
+	// Path to the directory with translation bundles: files named after the language, e.g. "es.json".
+	// Each bundle is a JSON object which maps keys to translated texts.
+	Bundles string `json:"bundles"`
+}
+
+var i18n struct {
+	// Translated texts by language. The first bundle is the default one.
+	bundles []map[string]string
+	matcher language.Matcher
+}
+
+// i18nInit loads translation bundles.
+func i18nInit(jsconf json.RawMessage) error {
+	if len(jsconf) == 0 {
+		return nil
+	}
+
+	var config i18nConfig
+	if err := json.Unmarshal(jsconf, &config); err != nil {
+		return errors.New("failed to parse config: " + err.Error())
+	}
+	if config.Bundles == "" {
+		return nil
+	}
+
+	defaultTag := language.English
+	if config.DefaultLang != "" {
+		tag, err := language.Parse(config.DefaultLang)
+		if err != nil {
+			return errors.New("invalid default language: " + err.Error())
+		}
+		defaultTag = tag
+	}
+
+	files, err := filepath.Glob(filepath.Join(config.Bundles, "*.json"))
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return errors.New("no bundles found in " + config.Bundles)
+	}
+
+	// The default language goes first, it's used when nothing else matches. The built-in texts are used
+	// if it has no bundle.
+	tags := []language.Tag{defaultTag}
+	i18n.bundles = []map[string]string{{}}
+	for _, file := range files {
+		tag, err := language.Parse(strings.TrimSuffix(filepath.Base(file), ".json"))
+		if err != nil {
+			return errors.New("invalid name of bundle " + file + ": " + err.Error())
+		}
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		var texts map[string]string
+		if err = json.Unmarshal(data, &texts); err != nil {
+			return errors.New("failed to parse bundle " + file + ": " + err.Error())
+		}
+		if tag == defaultTag {
+			i18n.bundles[0] = texts
+		} else {
+			tags = append(tags, tag)
+			i18n.bundles = append(i18n.bundles, texts)
+		}
+	}
+	i18n.matcher = language.NewMatcher(tags)
+
+	log.Printf("Localization: loaded %d bundles, default '%s'", len(tags), tags[0])
+	return nil
+}
+
+// i18nText returns the text for the key translated to the language closest to lang.
+// Empty string is returned if the text is unknown.
+func i18nText(lang, key string) string {
+	if i18n.matcher != nil {
+		_, idx := language.MatchStrings(i18n.matcher, lang)
+		if text, ok := i18n.bundles[idx][key]; ok {
+			return text
+		}
+		if text, ok := i18n.bundles[0][key]; ok {
+			return text
+		}
+	}
+	return i18nDefaultTexts[key]
+}
+
+// i18nHint returns the description of the error in the language closest to lang, or an empty
+// string if the bundles don't describe it. Errors are looked up by text with the cause,
+// e.g. "error:policy violation/sessions", then by text alone, e.g. "error:policy violation".
+func i18nHint(lang string, ctrl *MsgServerCtrl) string {
+	if i18n.matcher == nil || ctrl.Text == "" {
+		return ""
+	}
+
+	var what string
+	switch params := ctrl.Params.(type) {
+	case map[string]interface{}:
+		what, _ = params["what"].(string)
+	case map[string]string:
+		what = params["what"]
+	}
+	if what != "" {
+		if hint := i18nText(lang, "error:"+ctrl.Text+"/"+what); hint != "" {
+			return hint
+		}
+	}
+	return i18nText(lang, "error:"+ctrl.Text)
+}
+
+// i18nUserLang returns the language of the user's most recently used device, or an empty string
+// if the user has no devices.
+func i18nUserLang(uid types.Uid) string {
+	devices, _, err := store.Devices.GetAll(uid)
+	if err != nil {
+		log.Println("i18n: failed to get devices", uid.UserId(), err)
+		return ""
+	}
+
+	var lang string
+	var latest *types.DeviceDef
+	for i := range devices[uid] {
+		dev := &devices[uid][i]
+		if dev.Lang != "" && (latest == nil || dev.LastSeen.After(latest.LastSeen)) {
+			latest = dev
+			lang = dev.Lang
+		}
+	}
+	return lang
+}
+
+// i18nDraftyLabels returns the names of attachments in plain text translated to lang.
+func i18nDraftyLabels(lang string) map[string]string {
+	return map[string]string{
+		"IM": i18nText(lang, "image"),
+		"EX": i18nText(lang, "file"),
+	}
+}
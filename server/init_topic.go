@@ -68,7 +68,7 @@ func topicInit(t *Topic, join *sessionJoin, h *Hub) {
 		// Re-queue pending requests to join the topic.
 		for len(t.reg) > 0 {
 			reg := <-t.reg
-			h.join <- reg
+			h.shardFor(reg.pkt.RcptTo).join <- reg
 		}
 
 		// Reject all other pending requests
@@ -86,7 +86,10 @@ func topicInit(t *Topic, join *sessionJoin, h *Hub) {
 		}
 		for len(t.meta) > 0 {
 			msg := <-t.meta
-			if msg.pkt.Id != "" {
+			if msg.done != nil {
+				// Request generated by the server.
+				msg.done <- errTopicBusy
+			} else if msg.pkt != nil && msg.pkt.Id != "" {
 				msg.sess.queueOut(ErrLockedReply(msg.pkt, timestamp))
 			}
 		}
@@ -100,6 +103,10 @@ func topicInit(t *Topic, join *sessionJoin, h *Hub) {
 
 	t.computePerUserAcsUnion()
 
+	if !t.isProxy && (t.cat == types.TopicCatP2P || t.cat == types.TopicCatGrp) && globals.recentMessageCount > 0 {
+		t.recent = newRecentMessages(globals.recentMessageCount, t.lastID)
+	}
+
 	// prevent newly initialized topics to go live while shutdown in progress
 	if globals.shuttingDown {
 		h.topicDel(join.pkt.RcptTo)
@@ -136,11 +143,11 @@ func initTopicMe(t *Topic, sreg *sessionJoin) error {
 	user, err := store.Users.Get(types.ParseUserId(t.name))
 	if err != nil {
 		// Log out the session
-		sreg.sess.uid = types.ZeroUid
+		sreg.sess.logoutAccount(types.ParseUserId(t.name))
 		return err
 	} else if user == nil {
 		// Log out the session
-		sreg.sess.uid = types.ZeroUid
+		sreg.sess.logoutAccount(types.ParseUserId(t.name))
 		return types.ErrUserNotFound
 	}
 
@@ -151,11 +158,27 @@ func initTopicMe(t *Topic, sreg *sessionJoin) error {
 	// Assign tags
 	t.tags = user.Tags
 
+	t.blocked = user.Blocked
+	blockListSet(user.Uid(), user.Blocked)
+
+	t.autoReply = user.AutoReply
+	autoReplySet(user.Uid(), user.AutoReply)
+
+	t.autoTranslate = user.AutoTranslate
+	t.birthdate = user.Birthdate
+	autoTranslateSet(user.Uid(), user.AutoTranslate)
+
+	t.chatList = user.ChatList
+
+	t.consent = user.Consent
+	consentSet(user.Uid(), user.Consent)
+
 	if err = t.loadSubscribers(); err != nil {
 		return err
 	}
 
 	t.public = user.Public
+	t.trusted = user.Trusted
 
 	t.created = user.CreatedAt
 	t.updated = user.UpdatedAt
@@ -168,7 +191,7 @@ func initTopicMe(t *Topic, sreg *sessionJoin) error {
 	// Initiate User Agent with the UA of the creating session to report it later
 	t.userAgent = sreg.sess.userAgent
 	// Initialize channel for receiving user agent and session online updates.
-	t.supd = make(chan *sessionUpdate, 32)
+	t.supd = make(chan *sessionUpdate, globals.queueSizes.TopicSupd)
 
 	if !t.isProxy {
 		// Allocate storage for contacts.
@@ -192,7 +215,7 @@ func initTopicFnd(t *Topic, sreg *sessionJoin) error {
 		return err
 	} else if user == nil {
 		if !sreg.sess.isMultiplex() {
-			sreg.sess.uid = types.ZeroUid
+			sreg.sess.logoutAccount(uid)
 		}
 		return types.ErrNotFound
 	}
@@ -208,6 +231,9 @@ func initTopicFnd(t *Topic, sreg *sessionJoin) error {
 	t.created = user.CreatedAt
 	t.updated = user.UpdatedAt
 
+	// Search results are filtered by age.
+	t.birthdate = user.Birthdate
+
 	// 'fnd' has no owner, t.owner = nil
 
 	// Publishing to fnd is not supported
@@ -276,9 +302,10 @@ func initTopicP2P(t *Topic, sreg *sessionJoin) error {
 		for i := 0; i < 2; i++ {
 
 			uid := types.ParseUid(subs[i].User)
-			t.perUser[uid] = perUserData{
+			t.perUser[uid] = &perUserData{
 				// Adapter already swapped the public values
 				public:    subs[i].GetPublic(),
+				trusted:   subs[i].GetTrusted(),
 				topicName: types.ParseUid(subs[(i+1)%2].User).UserId(),
 
 				private:   subs[i].Private,
@@ -287,6 +314,11 @@ func initTopicP2P(t *Topic, sreg *sessionJoin) error {
 				delID:     subs[i].DelId,
 				recvID:    subs[i].RecvSeqId,
 				readID:    subs[i].ReadSeqId,
+				dlvID:     subs[i].DlvSeqId,
+				cursors:   subs[i].Cursors,
+				muteUntil: muteUntilFromStored(subs[i].MuteUntil),
+				quiet:     subs[i].Quiet,
+				notify:    subs[i].Notify,
 			}
 		}
 
@@ -318,6 +350,13 @@ func initTopicP2P(t *Topic, sreg *sessionJoin) error {
 			u1, u2 = 1, 0
 		}
 
+		// Users blocked by the other user cannot start a conversation with them.
+		if len(subs) == 0 || subs[0].User == userID1.String() {
+			if users[u2].Blocked.Find(userID1.UserId()) >= 0 {
+				return types.ErrPermissionDenied
+			}
+		}
+
 		// Figure out which subscriptions are missing: User1's, User2's or both.
 		var sub1, sub2 *types.Subscription
 		// Set to true if only requester's subscription has to be created.
@@ -463,22 +502,26 @@ func initTopicP2P(t *Topic, sreg *sessionJoin) error {
 
 		// Publics are already swapped.
 		userData.public = sub1.GetPublic()
+		userData.trusted = users[u2].Trusted
 		userData.topicName = userID2.UserId()
 		userData.modeWant = sub1.ModeWant
 		userData.modeGiven = sub1.ModeGiven
 		userData.delID = sub1.DelId
 		userData.readID = sub1.ReadSeqId
 		userData.recvID = sub1.RecvSeqId
-		t.perUser[userID1] = userData
+		userData.dlvID = sub1.DlvSeqId
+		t.perUser[userID1] = &userData
 
-		t.perUser[userID2] = perUserData{
+		t.perUser[userID2] = &perUserData{
 			public:    sub2.GetPublic(),
+			trusted:   users[u1].Trusted,
 			topicName: userID1.UserId(),
 			modeWant:  sub2.ModeWant,
 			modeGiven: sub2.ModeGiven,
 			delID:     sub2.DelId,
 			readID:    sub2.ReadSeqId,
 			recvID:    sub2.RecvSeqId,
+			dlvID:     sub2.DlvSeqId,
 		}
 	}
 
@@ -558,9 +601,27 @@ func initTopicNewGrp(t *Topic, sreg *sessionJoin, isChan bool) error {
 		if !restrictedTagsEqual(tags, nil, globals.immutableTagNS) {
 			return types.ErrPermissionDenied
 		}
+		if pktsub.Set.Desc != nil {
+			var err error
+			if tags, _, err = contentDescTags(tags, pktsub.Set.Desc); err != nil {
+				return types.ErrMalformed
+			}
+			// The new topic is placed into the space of the parent.
+			if pktsub.Set.Desc.Parent != nil && *pktsub.Set.Desc.Parent != "" {
+				parent := spaceParentName(*pktsub.Set.Desc.Parent)
+				if err = spaceCheckParent(sreg.pkt.RcptTo, parent, t.owner); err != nil {
+					return err
+				}
+				t.parent = parent
+			}
+		}
+	}
+
+	if _, err := descSchemaCheck(t.cat, t.public, userData.private, nil); err != nil {
+		return types.ErrMalformed
 	}
 
-	t.perUser[t.owner] = userData
+	t.perUser[t.owner] = &userData
 
 	// Assign tags
 	t.tags = tags
@@ -576,7 +637,14 @@ func initTopicNewGrp(t *Topic, sreg *sessionJoin, isChan bool) error {
 		Access:    types.DefaultAccess{Auth: t.accessAuth, Anon: t.accessAnon},
 		Tags:      tags,
 		UseBt:     isChan,
-		Public:    t.public}
+		Public:    t.public,
+		Parent:    t.parent}
+
+	// Topics created by root are never held for approval.
+	hold := auth.Level(sreg.pkt.AuthLvl) != auth.LevelRoot && topicCreationNeedsApproval(sreg.pkt.OrganizationId)
+	if hold {
+		stopic.State = types.StatePending
+	}
 
 	// store.Topics.Create will add a subscription record for the topic creator
 	stopic.GiveAccess(t.owner, userData.modeWant, userData.modeGiven)
@@ -584,6 +652,9 @@ func initTopicNewGrp(t *Topic, sreg *sessionJoin, isChan bool) error {
 	if err != nil {
 		return err
 	}
+	if hold {
+		topicCreationHold(stopic, sreg.pkt.OrganizationId)
+	}
 
 	t.xoriginal = t.name // keeping 'new' or 'nch' as original has no value to the client
 	pktsub.Created = true
@@ -610,6 +681,7 @@ func initTopicGrp(t *Topic, sreg *sessionJoin) error {
 	}
 
 	t.isChan = stopic.UseBt
+	topicCreationSetPending(t.name, stopic.State == types.StatePending)
 
 	// t.owner is set by loadSubscriptions
 
@@ -618,6 +690,22 @@ func initTopicGrp(t *Topic, sreg *sessionJoin) error {
 
 	// Assign tags
 	t.tags = stopic.Tags
+	t.packs = stopic.Packs
+	t.webhook = stopic.Webhook
+	t.stats = stopic.Stats
+	t.guests = stopic.Guests
+	t.owners = ownersFromStored(stopic.Owners)
+	t.receipts = stopic.Receipts
+	t.announce = stopic.Announce
+	t.parent = stopic.Parent
+	t.maxSubs = stopic.MaxSubs
+	t.freezeRestore(stopic.Freeze)
+	t.expiry = stopic.Expiry
+	t.limits = stopic.Limits
+	t.capacity = stopic.Capacity
+	if t.isChan {
+		t.audienceLoad()
+	}
 
 	t.public = stopic.Public
 
@@ -629,8 +717,11 @@ func initTopicGrp(t *Topic, sreg *sessionJoin) error {
 	t.lastID = stopic.SeqId
 	t.delID = stopic.DelId
 
+	// Merge the state replicated by the previous master, if any.
+	t.standbyRestore()
+
 	// Initialize channel for receiving session online updates.
-	t.supd = make(chan *sessionUpdate, 32)
+	t.supd = make(chan *sessionUpdate, globals.queueSizes.TopicSupd)
 
 	t.xoriginal = t.name // topic may have been loaded by a channel reader; make sure it's grpXXX, not chnXXX.
 
@@ -684,15 +775,22 @@ func (t *Topic) loadSubscribers() error {
 	for i := range subs {
 		sub := &subs[i]
 		uid := types.ParseUid(sub.User)
-		t.perUser[uid] = perUserData{
+		t.perUser[uid] = &perUserData{
 			created:   sub.CreatedAt,
 			updated:   sub.UpdatedAt,
 			delID:     sub.DelId,
 			readID:    sub.ReadSeqId,
 			recvID:    sub.RecvSeqId,
+			dlvID:     sub.DlvSeqId,
+			cursors:   sub.Cursors,
 			private:   sub.Private,
 			modeWant:  sub.ModeWant,
-			modeGiven: sub.ModeGiven}
+			modeGiven: sub.ModeGiven,
+			muteUntil: muteUntilFromStored(sub.MuteUntil),
+			quiet:     sub.Quiet,
+			notify:    sub.Notify,
+			request:   sub.Request,
+			ban:       sub.Ban}
 
 		if (sub.ModeGiven & sub.ModeWant).IsOwner() {
 			t.owner = uid
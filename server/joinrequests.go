@@ -0,0 +1,119 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *    Requests to join group topics which users cannot join on their own:
+ *    a {sub} to such a topic creates a pending request, the admins list the
+ *    requests with {get what="requests"} and approve or deny them by setting
+ *    the access mode of the user with {set sub}.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"errors"
+	"log"
+	"sort"
+	"time"
+	"unicode/utf8"
+
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+// Maximum length of the message to the admins attached to the join request, characters.
+const joinRequestMaxNote = 256
+
+// joinRequestNote returns the message to the admins attached to the {sub} or {set sub} request.
+func joinRequestNote(pkt *ClientComMessage) (string, error) {
+	var set *MsgSetQuery
+	if pkt.Sub != nil {
+		set = pkt.Sub.Set
+	} else if pkt.Set != nil {
+		set = &pkt.Set.MsgSetQuery
+	}
+	if set == nil || set.Sub == nil {
+		return "", nil
+	}
+	if utf8.RuneCountInString(set.Sub.Note) > joinRequestMaxNote {
+		return "", errors.New("join request note is too long")
+	}
+	return set.Sub.Note, nil
+}
+
+// joinRequestNeeded checks if the new subscription to the group topic is a request to join:
+// the user wants to join but the default access does not allow it.
+func (t *Topic) joinRequestNeeded(asChan bool, want, given types.AccessMode) bool {
+	return t.cat == types.TopicCatGrp && !asChan && want.IsJoiner() && !given.IsJoiner()
+}
+
+// joinRequestReply tells the user that the request to join is waiting for approval.
+func joinRequestReply(sess *Session, pkt *ClientComMessage, req *types.JoinRequest, now time.Time) {
+	reply := NoErrAccepted(pkt.Id, pkt.Original, now)
+	reply.Ctrl.Params = map[string]interface{}{"what": "request", "created": req.CreatedAt}
+	sess.queueOut(reply)
+}
+
+// joinRequestResolve clears the pending request of the user once an admin has assigned the access mode.
+func (t *Topic) joinRequestResolve(sess *Session, asUid, target types.Uid, pud *perUserData, now time.Time) {
+	if pud.request == nil {
+		return
+	}
+	if err := store.Subs.Update(t.name, target, map[string]interface{}{"Request": nil}, false); err != nil {
+		log.Printf("topic[%s]: failed to clear join request of %s: %v", t.name, target.UserId(), err)
+		return
+	}
+	pud.request = nil
+
+	if !pud.modeGiven.IsJoiner() {
+		// Denied: the user remains unable to join.
+		return
+	}
+
+	// The user may be offline, let them know the request is approved.
+	if pushRcpt := t.pushForSub(asUid, target, pud.modeWant, pud.modeGiven, now, sess.activeOrg()); pushRcpt != nil {
+		usersPush(pushRcpt)
+	}
+	t.recordEvent("join", target, types.ZeroUid, nil)
+}
+
+// replyGetRequests lists pending requests to join the group topic, oldest first. Admins and owners only.
+func (t *Topic) replyGetRequests(sess *Session, asUid types.Uid, msg *ClientComMessage) error {
+	now := types.TimeNow()
+
+	if t.cat != types.TopicCatGrp {
+		sess.queueOut(ErrOperationNotAllowedReply(msg, now))
+		return errors.New("get.requests: invalid topic category")
+	}
+	if pud, ok := t.perUser[asUid]; !ok || pud.deleted || !((pud.modeGiven & pud.modeWant).IsAdmin() || t.isOwner(asUid)) {
+		sess.queueOut(ErrPermissionDeniedReply(msg, now))
+		return errors.New("get.requests: admin access required")
+	}
+
+	var requests []MsgJoinRequest
+	for uid, pud := range t.perUser {
+		if pud.deleted || pud.request == nil {
+			continue
+		}
+		createdAt := pud.request.CreatedAt
+		requests = append(requests, MsgJoinRequest{
+			User:      uid.UserId(),
+			Want:      pud.modeWant.String(),
+			Note:      pud.request.Note,
+			CreatedAt: &createdAt,
+		})
+	}
+	if len(requests) == 0 {
+		sess.queueOut(NoContentParamsReply(msg, now, map[string]string{"what": "requests"}))
+		return nil
+	}
+	sort.Slice(requests, func(i, j int) bool {
+		return requests[i].CreatedAt.Before(*requests[j].CreatedAt)
+	})
+
+	sess.queueOut(&ServerComMessage{
+		Meta: &MsgServerMeta{Id: msg.Id, Topic: t.original(asUid), Timestamp: &now, Requests: requests}})
+
+	return nil
+}
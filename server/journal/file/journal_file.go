@@ -0,0 +1,131 @@
+// Package file implements a journal handler which appends records to a local file, one JSON object per line.
+// The file is suitable for log shippers which forward it to SIEM.
+package file
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"time"
+
+	"github.com/tinode/chat/server/journal"
+)
+
+var handler fileJournal
+
+const (
+	// How much to buffer the input channel.
+	defaultBuffer = 256
+	// How often to flush records to disk.
+	flushInterval = time.Second
+)
+
+type fileJournal struct {
+	input chan *journal.Record
+	stop  chan bool
+	done  chan bool
+}
+
+type configType struct {
+	Enabled bool `json:"enabled"`
+	// Path to the journal file. The file is created if missing and is never truncated.
+	Path   string `json:"path"`
+	Buffer int    `json:"buffer"`
+}
+
+// Init initializes the handler.
+func (fileJournal) Init(jsonconf string) error {
+	if handler.input != nil {
+		return errors.New("already initialized")
+	}
+
+	var config configType
+	if err := json.Unmarshal([]byte(jsonconf), &config); err != nil {
+		return errors.New("failed to parse config: " + err.Error())
+	}
+
+	if !config.Enabled {
+		return nil
+	}
+
+	if config.Path == "" {
+		return errors.New("missing journal file path")
+	}
+
+	file, err := os.OpenFile(config.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+
+	if config.Buffer <= 0 {
+		config.Buffer = defaultBuffer
+	}
+
+	handler.input = make(chan *journal.Record, config.Buffer)
+	handler.stop = make(chan bool, 1)
+	handler.done = make(chan bool, 1)
+
+	go func() {
+		out := bufio.NewWriter(file)
+		enc := json.NewEncoder(out)
+		ticker := time.NewTicker(flushInterval)
+		defer func() {
+			ticker.Stop()
+			if err := out.Flush(); err != nil {
+				log.Println("journal file: flush failed", err)
+			}
+			file.Close()
+			handler.done <- true
+		}()
+
+		write := func(rec *journal.Record) {
+			if err := enc.Encode(rec); err != nil {
+				log.Println("journal file: write failed", rec.Seq, err)
+			}
+		}
+
+		for {
+			select {
+			case rec := <-handler.input:
+				write(rec)
+			case <-ticker.C:
+				if err := out.Flush(); err != nil {
+					log.Println("journal file: flush failed", err)
+				}
+			case <-handler.stop:
+				for {
+					select {
+					case rec := <-handler.input:
+						write(rec)
+					default:
+						return
+					}
+				}
+			}
+		}
+	}()
+
+	return nil
+}
+
+// IsReady checks if the handler is initialized.
+func (fileJournal) IsReady() bool {
+	return handler.input != nil
+}
+
+// Journal returns a channel that the server will use to send records to.
+func (fileJournal) Journal() chan<- *journal.Record {
+	return handler.input
+}
+
+// Stop writes pending records, closes the file and terminates the handler's worker.
+func (fileJournal) Stop() {
+	handler.stop <- true
+	<-handler.done
+}
+
+func init() {
+	journal.Register("file", &handler)
+}
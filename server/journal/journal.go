@@ -0,0 +1,372 @@
+// Package journal streams an immutable copy of messages to external archives for compliance.
+// Records are chained with SHA-256 hashes so that removal or modification of records can be detected.
+package journal
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	t "github.com/tinode/chat/server/store/types"
+)
+
+// Journaled actions.
+const (
+	// Message published.
+	ActMsg = "msg"
+	// Message edited.
+	ActEdit = "edit"
+	// Messages deleted.
+	ActDel = "del"
+)
+
+const (
+	// How much to buffer the input channel by default.
+	defaultBuffer = 1024
+	// How long to wait for space in the input channel by default, milliseconds.
+	defaultWriteTimeout = 500
+)
+
+// ErrQueueFull is returned when the entry could not be queued in time because the handlers are too slow.
+var ErrQueueFull = errors.New("journal queue full")
+
+// Entry is an event recorded in the journal.
+type Entry struct {
+	// Action: message published (msg), message edited (edit) or messages deleted (del).
+	What string `json:"what"`
+	// Organization of the user who caused the event, if known.
+	Org string `json:"org,omitempty"`
+	// Name of the topic.
+	Topic string `json:"topic"`
+	// User who caused the event 'usrXXX'. Empty for messages generated by the server.
+	From string `json:"from,omitempty"`
+	// Time of the event.
+	Timestamp time.Time `json:"ts"`
+
+	// Published or edited message.
+
+	// Sequential ID of the message.
+	SeqId int `json:"seq,omitempty"`
+	// Message headers.
+	Head map[string]interface{} `json:"head,omitempty"`
+	// Message content.
+	Content interface{} `json:"content,omitempty"`
+
+	// Deleted messages.
+
+	// Ranges of deleted message IDs.
+	DelSeq []t.Range `json:"delseq,omitempty"`
+	// Messages were deleted for all users.
+	Hard bool `json:"hard,omitempty"`
+}
+
+// Record is an entry as written to the archive.
+type Record struct {
+	// Name of the cluster node which wrote the record. Each node keeps its own chain of records.
+	Node string `json:"node,omitempty"`
+	// Sequential number of the record in the chain. The chain is continued after a restart if
+	// the chain state is saved.
+	Seq uint64 `json:"jseq"`
+	// Hash of the previous record in the chain, empty for the first record.
+	Prev string `json:"prev"`
+	// Hex-encoded SHA-256 of Prev concatenated with the bytes of Entry as serialized.
+	Hash string `json:"hash"`
+	// Serialized Entry.
+	Entry json.RawMessage `json:"entry"`
+}
+
+// Handler is an interface which must be implemented by archive writers.
+type Handler interface {
+	// Init initializes the handler.
+	Init(jsonconf string) error
+
+	// IsReady checks if the handler is initialized.
+	IsReady() bool
+
+	// Journal returns a channel that the server will use to send records to.
+	// The journal waits if the channel blocks: records are never dropped by the journal itself.
+	Journal() chan<- *Record
+
+	// Stop flushes pending records and terminates the handler's worker.
+	Stop()
+}
+
+type handlerConfig struct {
+	Name   string          `json:"name"`
+	Config json.RawMessage `json:"config"`
+}
+
+type configType struct {
+	Enabled bool `json:"enabled"`
+	// Organizations to journal. All organizations if empty.
+	Orgs []string `json:"orgs"`
+	// Topics to journal. All topics if empty.
+	Topics []string `json:"topics"`
+	// Number of entries buffered before writers have to wait.
+	Buffer int `json:"buffer"`
+	// How long a writer waits for space in a full buffer before the entry is rejected, milliseconds.
+	WriteTimeout int `json:"write_timeout"`
+	// File where the sequential number and the hash of the last record are saved so the chain
+	// is continued after a restart. The chain starts anew on every start if missing.
+	State    string          `json:"state"`
+	Handlers []handlerConfig `json:"handlers"`
+}
+
+// chainState is the position of the chain saved between restarts.
+type chainState struct {
+	Node string `json:"node,omitempty"`
+	Seq  uint64 `json:"jseq"`
+	Hash string `json:"hash"`
+}
+
+var handlers map[string]Handler
+
+var journal struct {
+	node    string
+	orgs    map[string]bool
+	topics  map[string]bool
+	timeout time.Duration
+	// Path to the chain state file, could be empty.
+	state string
+	// Position of the chain at startup.
+	seq   uint64
+	prev  string
+	input chan *Entry
+	stop  chan bool
+	done  sync.WaitGroup
+}
+
+// Register an archive handler.
+func Register(name string, hnd Handler) {
+	if handlers == nil {
+		handlers = make(map[string]Handler)
+	}
+
+	if hnd == nil {
+		panic("Register: journal handler is nil")
+	}
+	if _, dup := handlers[name]; dup {
+		panic("Register: called twice for handler " + name)
+	}
+	handlers[name] = hnd
+}
+
+// Init initializes the journal and the configured handlers. The node is the name of the cluster node.
+func Init(jsconfig, node string) error {
+	if len(jsconfig) == 0 {
+		return nil
+	}
+
+	var config configType
+	if err := json.Unmarshal([]byte(jsconfig), &config); err != nil {
+		return errors.New("failed to parse config: " + err.Error())
+	}
+
+	if !config.Enabled {
+		return nil
+	}
+
+	var ready bool
+	for _, cc := range config.Handlers {
+		hnd := handlers[cc.Name]
+		if hnd == nil {
+			return errors.New("unknown journal handler '" + cc.Name + "'")
+		}
+		if err := hnd.Init(string(cc.Config)); err != nil {
+			return err
+		}
+		ready = ready || hnd.IsReady()
+	}
+	if !ready {
+		return errors.New("journal is enabled but no handlers are ready")
+	}
+
+	if len(config.Orgs) > 0 {
+		journal.orgs = make(map[string]bool, len(config.Orgs))
+		for _, org := range config.Orgs {
+			journal.orgs[org] = true
+		}
+	}
+	if len(config.Topics) > 0 {
+		journal.topics = make(map[string]bool, len(config.Topics))
+		for _, topic := range config.Topics {
+			journal.topics[topic] = true
+		}
+	}
+	if config.Buffer <= 0 {
+		config.Buffer = defaultBuffer
+	}
+	if config.WriteTimeout <= 0 {
+		config.WriteTimeout = defaultWriteTimeout
+	}
+
+	if config.State != "" {
+		state, err := loadState(config.State)
+		if err != nil {
+			return err
+		}
+		if state != nil {
+			if state.Node != node {
+				return errors.New("journal state belongs to node '" + state.Node + "'")
+			}
+			journal.seq, journal.prev = state.Seq, state.Hash
+		}
+	}
+
+	journal.node = node
+	journal.state = config.State
+	journal.timeout = time.Duration(config.WriteTimeout) * time.Millisecond
+	journal.input = make(chan *Entry, config.Buffer)
+	journal.stop = make(chan bool, 1)
+	journal.done.Add(1)
+	go run()
+
+	return nil
+}
+
+// Enabled checks if events in the given topic caused by a user from the given organization are journaled.
+func Enabled(org, topic string) bool {
+	if journal.input == nil {
+		return false
+	}
+	if journal.orgs != nil && !journal.orgs[org] {
+		return false
+	}
+	if journal.topics != nil && !journal.topics[topic] {
+		return false
+	}
+	return true
+}
+
+// Write adds an entry to the journal. The caller should check Enabled first.
+// The entry must not be modified after the call. If the queue is full, Write waits for the configured
+// time, then gives up and returns ErrQueueFull: the entry is not journaled.
+func Write(entry *Entry) error {
+	if journal.input == nil {
+		return nil
+	}
+
+	select {
+	case journal.input <- entry:
+		return nil
+	default:
+	}
+
+	timer := time.NewTimer(journal.timeout)
+	defer timer.Stop()
+	select {
+	case journal.input <- entry:
+		return nil
+	case <-timer.C:
+		return ErrQueueFull
+	}
+}
+
+// loadState reads the saved position of the chain. Returns nil if the state is not saved yet.
+func loadState(path string) (*chainState, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var state chainState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, errors.New("invalid journal state: " + err.Error())
+	}
+	return &state, nil
+}
+
+// saveState saves the position of the chain. The file is replaced atomically so a crash
+// never leaves a partially written state.
+func saveState(path string, state *chainState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0640); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Stop writes the pending entries and stops the handlers.
+func Stop() {
+	if journal.input == nil {
+		return
+	}
+
+	journal.stop <- true
+	journal.done.Wait()
+
+	for _, hnd := range handlers {
+		if hnd.IsReady() {
+			hnd.Stop()
+		}
+	}
+}
+
+// run chains the entries and passes them to the handlers.
+func run() {
+	defer journal.done.Done()
+
+	seq, prev := journal.seq, journal.prev
+	write := func(entry *Entry) {
+		data, err := json.Marshal(entry)
+		if err != nil {
+			log.Println("journal: failed to serialize entry", entry.Topic, entry.SeqId, err)
+			return
+		}
+
+		seq++
+		hash := sha256.New()
+		hash.Write([]byte(prev))
+		hash.Write(data)
+		rec := &Record{
+			Node:  journal.node,
+			Seq:   seq,
+			Prev:  prev,
+			Hash:  hex.EncodeToString(hash.Sum(nil)),
+			Entry: data,
+		}
+		prev = rec.Hash
+
+		for _, hnd := range handlers {
+			if hnd.IsReady() {
+				hnd.Journal() <- rec
+			}
+		}
+
+		if journal.state != "" {
+			if err := saveState(journal.state, &chainState{Node: journal.node, Seq: seq, Hash: prev}); err != nil {
+				// The next start would begin a new chain: the archive shows where.
+				log.Println("journal: failed to save chain state", seq, err)
+			}
+		}
+	}
+
+	for {
+		select {
+		case entry := <-journal.input:
+			write(entry)
+		case <-journal.stop:
+			// Drain the queue.
+			for {
+				select {
+				case entry := <-journal.input:
+					write(entry)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,213 @@
+// Package s3 implements a journal handler which uploads records to Amazon S3 bucket in batches.
+// Each batch is stored as a separate object with one JSON record per line. Objects are never overwritten.
+// Enable S3 Object Lock on the bucket to make the archive immutable.
+package s3
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+
+	"github.com/tinode/chat/server/journal"
+)
+
+var handler s3Journal
+
+const (
+	// How much to buffer the input channel.
+	defaultBuffer = 256
+	// Maximum number of records in one object.
+	defaultBatchSize = 1000
+	// Maximum time to wait before uploading an incomplete batch.
+	defaultBatchDelay = 10 * time.Second
+	// How many times to retry a failed upload.
+	maxRetries = 5
+)
+
+type s3Journal struct {
+	svc   *s3.S3
+	conf  configType
+	input chan *journal.Record
+	stop  chan bool
+	done  chan bool
+}
+
+type configType struct {
+	Enabled         bool   `json:"enabled"`
+	AccessKeyId     string `json:"access_key_id"`
+	SecretAccessKey string `json:"secret_access_key"`
+	Region          string `json:"region"`
+	BucketName      string `json:"bucket"`
+	// Key prefix of the journal objects.
+	Prefix string `json:"prefix"`
+	// Maximum number of records per object.
+	BatchSize int `json:"batch_size"`
+	// Maximum delay in seconds before an incomplete batch is uploaded.
+	BatchDelay int `json:"batch_delay"`
+	Buffer     int `json:"buffer"`
+}
+
+// Init initializes the handler.
+func (s3Journal) Init(jsonconf string) error {
+	if handler.input != nil {
+		return errors.New("already initialized")
+	}
+
+	if err := json.Unmarshal([]byte(jsonconf), &handler.conf); err != nil {
+		return errors.New("failed to parse config: " + err.Error())
+	}
+
+	if !handler.conf.Enabled {
+		return nil
+	}
+
+	if handler.conf.AccessKeyId == "" {
+		return errors.New("missing Access Key ID")
+	}
+	if handler.conf.SecretAccessKey == "" {
+		return errors.New("missing Secret Access Key")
+	}
+	if handler.conf.Region == "" {
+		return errors.New("missing Region")
+	}
+	if handler.conf.BucketName == "" {
+		return errors.New("missing Bucket")
+	}
+
+	sess, err := session.NewSession(&aws.Config{
+		Region:      aws.String(handler.conf.Region),
+		Credentials: credentials.NewStaticCredentials(handler.conf.AccessKeyId, handler.conf.SecretAccessKey, ""),
+	})
+	if err != nil {
+		return err
+	}
+	handler.svc = s3.New(sess)
+
+	// The bucket must exist: journal bucket is expected to be configured by the administrator
+	// with the retention policy required by the regulator.
+	if _, err = handler.svc.HeadBucket(&s3.HeadBucketInput{Bucket: aws.String(handler.conf.BucketName)}); err != nil {
+		return err
+	}
+
+	if handler.conf.Prefix != "" && !strings.HasSuffix(handler.conf.Prefix, "/") {
+		handler.conf.Prefix += "/"
+	}
+	if handler.conf.BatchSize <= 0 {
+		handler.conf.BatchSize = defaultBatchSize
+	}
+	batchDelay := defaultBatchDelay
+	if handler.conf.BatchDelay > 0 {
+		batchDelay = time.Duration(handler.conf.BatchDelay) * time.Second
+	}
+	if handler.conf.Buffer <= 0 {
+		handler.conf.Buffer = defaultBuffer
+	}
+
+	handler.input = make(chan *journal.Record, handler.conf.Buffer)
+	handler.stop = make(chan bool, 1)
+	handler.done = make(chan bool, 1)
+
+	go func() {
+		var batch []*journal.Record
+		ticker := time.NewTicker(batchDelay)
+		defer func() {
+			ticker.Stop()
+			handler.done <- true
+		}()
+
+		flush := func() {
+			if len(batch) > 0 {
+				upload(batch)
+				batch = nil
+			}
+		}
+
+		for {
+			select {
+			case rec := <-handler.input:
+				batch = append(batch, rec)
+				if len(batch) >= handler.conf.BatchSize {
+					flush()
+				}
+			case <-ticker.C:
+				flush()
+			case <-handler.stop:
+				for {
+					select {
+					case rec := <-handler.input:
+						batch = append(batch, rec)
+					default:
+						flush()
+						return
+					}
+				}
+			}
+		}
+	}()
+
+	return nil
+}
+
+// upload writes the batch to S3 as a single object named after the node and the range of records in it:
+// <prefix>YYYY/MM/DD/<node>-<first seq>-<last seq>-<unix nanoseconds>.jsonl
+func upload(batch []*journal.Record) {
+	var body bytes.Buffer
+	enc := json.NewEncoder(&body)
+	for _, rec := range batch {
+		if err := enc.Encode(rec); err != nil {
+			log.Println("journal s3: failed to serialize record", rec.Seq, err)
+		}
+	}
+
+	now := time.Now().UTC()
+	node := batch[0].Node
+	if node == "" {
+		node = "local"
+	}
+	key := fmt.Sprintf("%s%s/%s-%d-%d-%d.jsonl", handler.conf.Prefix, now.Format("2006/01/02"),
+		node, batch[0].Seq, batch[len(batch)-1].Seq, now.UnixNano())
+
+	var err error
+	for i := 0; i < maxRetries; i++ {
+		_, err = handler.svc.PutObject(&s3.PutObjectInput{
+			Bucket:      aws.String(handler.conf.BucketName),
+			Key:         aws.String(key),
+			Body:        bytes.NewReader(body.Bytes()),
+			ContentType: aws.String("application/x-ndjson"),
+		})
+		if err == nil {
+			return
+		}
+		time.Sleep(time.Duration(i+1) * time.Second)
+	}
+	log.Println("journal s3: failed to upload", key, err)
+}
+
+// IsReady checks if the handler is initialized.
+func (s3Journal) IsReady() bool {
+	return handler.input != nil
+}
+
+// Journal returns a channel that the server will use to send records to.
+func (s3Journal) Journal() chan<- *journal.Record {
+	return handler.input
+}
+
+// Stop uploads pending records and terminates the handler's worker.
+func (s3Journal) Stop() {
+	handler.stop <- true
+	<-handler.done
+}
+
+func init() {
+	journal.Register("s3", &handler)
+}
@@ -0,0 +1,224 @@
+// Package smtp implements a journal handler which sends each record as an email to a journaling mailbox,
+// such as Exchange Online or Google Vault journaling address.
+package smtp
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/mail"
+	"net/smtp"
+	"strings"
+	"time"
+
+	"github.com/tinode/chat/server/journal"
+)
+
+var handler smtpJournal
+
+const (
+	// How much to buffer the input channel.
+	defaultBuffer = 256
+	// How many times to retry sending a failed record.
+	maxRetries = 3
+)
+
+type smtpJournal struct {
+	conf        configType
+	auth        smtp.Auth
+	senderEmail string
+	input       chan *journal.Record
+	stop        chan bool
+	done        chan bool
+}
+
+type configType struct {
+	Enabled bool `json:"enabled"`
+	// Address of the journaling mailbox.
+	Recipient string `json:"recipient"`
+	// Sender of the journal messages, e.g. "Tinode Journal <journal@example.com>".
+	SendFrom              string `json:"sender"`
+	SenderPassword        string `json:"sender_password"`
+	Login                 string `json:"login"`
+	SMTPAddr              string `json:"smtp_server"`
+	SMTPPort              string `json:"smtp_port"`
+	SMTPHeloHost          string `json:"smtp_helo_host"`
+	TLSInsecureSkipVerify bool   `json:"insecure_skip_verify"`
+	Buffer                int    `json:"buffer"`
+}
+
+// Init initializes the handler.
+func (smtpJournal) Init(jsonconf string) error {
+	if handler.input != nil {
+		return errors.New("already initialized")
+	}
+
+	if err := json.Unmarshal([]byte(jsonconf), &handler.conf); err != nil {
+		return errors.New("failed to parse config: " + err.Error())
+	}
+
+	if !handler.conf.Enabled {
+		return nil
+	}
+
+	if handler.conf.Recipient == "" {
+		return errors.New("missing journal recipient")
+	}
+	if handler.conf.SMTPAddr == "" || handler.conf.SMTPPort == "" {
+		return errors.New("missing SMTP server address")
+	}
+
+	sender, err := mail.ParseAddress(handler.conf.SendFrom)
+	if err != nil {
+		return err
+	}
+	handler.senderEmail = sender.Address
+
+	if handler.conf.SenderPassword != "" {
+		login := handler.conf.Login
+		if login == "" {
+			login = handler.senderEmail
+		}
+		handler.auth = smtp.PlainAuth("", login, handler.conf.SenderPassword, handler.conf.SMTPAddr)
+	}
+	if handler.conf.SMTPHeloHost == "" {
+		handler.conf.SMTPHeloHost = "localhost"
+	}
+	if handler.conf.Buffer <= 0 {
+		handler.conf.Buffer = defaultBuffer
+	}
+
+	handler.input = make(chan *journal.Record, handler.conf.Buffer)
+	handler.stop = make(chan bool, 1)
+	handler.done = make(chan bool, 1)
+
+	go func() {
+		defer func() {
+			handler.done <- true
+		}()
+
+		for {
+			select {
+			case rec := <-handler.input:
+				send(rec)
+			case <-handler.stop:
+				for {
+					select {
+					case rec := <-handler.input:
+						send(rec)
+					default:
+						return
+					}
+				}
+			}
+		}
+	}()
+
+	return nil
+}
+
+// send formats the record as an email with the record attached as JSON.
+func send(rec *journal.Record) {
+	var entry journal.Entry
+	json.Unmarshal(rec.Entry, &entry)
+
+	body, err := json.MarshalIndent(rec, "", " ")
+	if err != nil {
+		log.Println("journal smtp: failed to serialize record", rec.Seq, err)
+		return
+	}
+
+	message := &bytes.Buffer{}
+	fmt.Fprintf(message, "From: %s\r\n", handler.conf.SendFrom)
+	fmt.Fprintf(message, "To: %s\r\n", handler.conf.Recipient)
+	fmt.Fprintf(message, "Subject: [journal] %s %s #%d\r\n", entry.What, entry.Topic, entry.SeqId)
+	fmt.Fprintf(message, "Date: %s\r\n", entry.Timestamp.Format(time.RFC1123Z))
+	fmt.Fprintf(message, "X-Journal-Node: %s\r\n", rec.Node)
+	fmt.Fprintf(message, "X-Journal-Seq: %d\r\n", rec.Seq)
+	fmt.Fprintf(message, "X-Journal-Hash: %s\r\n", rec.Hash)
+	message.WriteString("MIME-version: 1.0;\r\n")
+	message.WriteString("Content-Type: application/json; charset=\"UTF-8\"\r\n")
+	message.WriteString("Content-Transfer-Encoding: base64\r\n\r\n")
+	b64w := base64.NewEncoder(base64.StdEncoding, message)
+	b64w.Write(body)
+	b64w.Close()
+
+	for i := 0; i < maxRetries; i++ {
+		if err = sendMail([]string{handler.conf.Recipient}, message.Bytes()); err == nil {
+			return
+		}
+		time.Sleep(time.Duration(i+1) * time.Second)
+	}
+	log.Println("journal smtp: failed to send record", rec.Seq, err)
+}
+
+// sendMail is the same as in validate/email.
+func sendMail(rcpt []string, msg []byte) error {
+	client, err := smtp.Dial(handler.conf.SMTPAddr + ":" + handler.conf.SMTPPort)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	if err = client.Hello(handler.conf.SMTPHeloHost); err != nil {
+		return err
+	}
+	if istls, _ := client.Extension("STARTTLS"); istls {
+		tlsConfig := &tls.Config{
+			InsecureSkipVerify: handler.conf.TLSInsecureSkipVerify,
+			ServerName:         handler.conf.SMTPAddr,
+		}
+		if err = client.StartTLS(tlsConfig); err != nil {
+			return err
+		}
+	}
+	if handler.auth != nil {
+		if isauth, _ := client.Extension("AUTH"); isauth {
+			if err = client.Auth(handler.auth); err != nil {
+				return err
+			}
+		}
+	}
+	if err = client.Mail(strings.ReplaceAll(strings.ReplaceAll(handler.senderEmail, "\r", " "), "\n", " ")); err != nil {
+		return err
+	}
+	for _, to := range rcpt {
+		if err = client.Rcpt(strings.ReplaceAll(strings.ReplaceAll(to, "\r", " "), "\n", " ")); err != nil {
+			return err
+		}
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(msg); err != nil {
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+// IsReady checks if the handler is initialized.
+func (smtpJournal) IsReady() bool {
+	return handler.input != nil
+}
+
+// Journal returns a channel that the server will use to send records to.
+func (smtpJournal) Journal() chan<- *journal.Record {
+	return handler.input
+}
+
+// Stop sends pending records and terminates the handler's worker.
+func (smtpJournal) Stop() {
+	handler.stop <- true
+	<-handler.done
+}
+
+func init() {
+	journal.Register("smtp", &handler)
+}
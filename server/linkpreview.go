@@ -0,0 +1,474 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *    Link previews: when a published message contains a URL, a pool of
+ *    workers fetches the OpenGraph metadata of the page and the preview is
+ *    attached to the stored message and broadcast as an edit.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/tinode/chat/server/drafty"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+	"golang.org/x/net/html"
+)
+
+const (
+	// Default timeout of fetching a page.
+	linkPreviewDefaultTimeout = 5 * time.Second
+	// Default number of pages fetched concurrently.
+	linkPreviewDefaultWorkers = 4
+	// Default maximum number of bytes read from a page.
+	linkPreviewDefaultMaxSize = 256 * 1024
+	// Number of messages waiting for previews. Messages are not previewed when the queue is full.
+	linkPreviewQueueSize = 256
+	// Maximum number of previews kept in memory.
+	linkPreviewCacheSize = 1024
+	// Maximum lengths of the title and the description in the preview, characters.
+	linkPreviewMaxTitle = 256
+	linkPreviewMaxDesc  = 512
+	// Message header with the preview of the first link in the message.
+	linkPreviewHeader = "preview"
+)
+
+// URLs in plain text messages.
+var linkPreviewUrlRegexp = regexp.MustCompile(`https?://[^\s<>"]+`)
+
+// linkPreviewConfig is the configuration of link previews.
+type linkPreviewConfig struct {
+	// Enable link previews.
+	Enabled bool `json:"enabled"`
+	// Page fetch timeout in seconds.
+	Timeout int `json:"timeout"`
+	// Number of pages fetched concurrently.
+	Workers int `json:"workers"`
+	// Maximum number of bytes read from a page.
+	MaxSize int64 `json:"max_size"`
+}
+
+// linkPreviewJob is a request to preview a link in a message.
+type linkPreviewJob struct {
+	topic string
+	seq   int
+	// Value of the 'edited' header of the message when the job was created. The preview is discarded
+	// if the message was edited since.
+	edited string
+	url    string
+}
+
+// linkPreviewUpdate is a preview ready to be attached to a message.
+type linkPreviewUpdate struct {
+	seq     int
+	edited  string
+	preview map[string]interface{}
+}
+
+var linkPreview struct {
+	client  *http.Client
+	maxSize int64
+	jobs    chan *linkPreviewJob
+
+	// Previews of pages, URL -> preview; nil preview if the page has none.
+	cacheLock sync.Mutex
+	cache     map[string]map[string]interface{}
+	// Keys of the cached previews, oldest first.
+	cacheKeys []string
+}
+
+// linkPreviewInit configures link previews and starts the workers.
+func linkPreviewInit(jsconf json.RawMessage) error {
+	if len(jsconf) == 0 {
+		return nil
+	}
+
+	var config linkPreviewConfig
+	if err := json.Unmarshal(jsconf, &config); err != nil {
+		return errors.New("failed to parse config: " + err.Error())
+	}
+	if !config.Enabled {
+		return nil
+	}
+	if config.Timeout < 0 || config.Workers < 0 || config.MaxSize < 0 {
+		return errors.New("invalid limits")
+	}
+
+	timeout := linkPreviewDefaultTimeout
+	if config.Timeout > 0 {
+		timeout = time.Duration(config.Timeout) * time.Second
+	}
+	workers := linkPreviewDefaultWorkers
+	if config.Workers > 0 {
+		workers = config.Workers
+	}
+	linkPreview.maxSize = linkPreviewDefaultMaxSize
+	if config.MaxSize > 0 {
+		linkPreview.maxSize = config.MaxSize
+	}
+
+	// Pages are fetched on behalf of users: addresses in private networks must not be reachable.
+	dialer := &net.Dialer{Timeout: timeout, Control: linkPreviewDialControl}
+	linkPreview.client = &http.Client{
+		Timeout:   timeout,
+		Transport: &http.Transport{DialContext: dialer.DialContext},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 3 {
+				return errors.New("too many redirects")
+			}
+			return nil
+		},
+	}
+	linkPreview.cache = make(map[string]map[string]interface{})
+	linkPreview.jobs = make(chan *linkPreviewJob, linkPreviewQueueSize)
+	for i := 0; i < workers; i++ {
+		go linkPreviewWorker()
+	}
+
+	return nil
+}
+
+// linkPreviewEnabled checks if link previews are configured.
+func linkPreviewEnabled() bool {
+	return linkPreview.client != nil
+}
+
+// linkPreviewDialControl rejects connections to loopback, private and link-local addresses.
+func linkPreviewDialControl(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsMulticast() || linkPreviewIsPrivate(ip) {
+		return errors.New("address not allowed: " + host)
+	}
+	return nil
+}
+
+// Private address ranges, RFC 1918 and RFC 4193, and the carrier-grade NAT range.
+var linkPreviewPrivateNets = func() []*net.IPNet {
+	var nets []*net.IPNet
+	for _, cidr := range []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "100.64.0.0/10", "fc00::/7"} {
+		_, n, _ := net.ParseCIDR(cidr)
+		nets = append(nets, n)
+	}
+	return nets
+}()
+
+func linkPreviewIsPrivate(ip net.IP) bool {
+	for _, n := range linkPreviewPrivateNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// linkPreviewFind returns the first http(s) URL in the message content, empty string if there is none.
+func linkPreviewFind(content interface{}) string {
+	var links []string
+	if text, ok := content.(string); ok {
+		for _, link := range linkPreviewUrlRegexp.FindAllString(text, 1) {
+			// Punctuation at the end of a sentence is not a part of the URL.
+			links = append(links, strings.TrimRight(link, ".,;:!?)'"))
+		}
+	} else {
+		links = drafty.Links(content)
+	}
+	for _, link := range links {
+		if u, err := url.Parse(link); err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "" {
+			return u.String()
+		}
+	}
+	return ""
+}
+
+// linkPreviewRequest queues the message for preview if it contains a link.
+func (t *Topic) linkPreviewRequest(data *MsgServerData) {
+	if !linkPreviewEnabled() || t.isProxy || isSysEvent(data) {
+		return
+	}
+	if _, ok := data.Head[linkPreviewHeader]; ok {
+		// The client has provided the preview.
+		return
+	}
+	if _, ok := data.Head["viewOnce"]; ok {
+		return
+	}
+	link := linkPreviewFind(data.Content)
+	if link == "" {
+		return
+	}
+
+	edited, _ := data.Head[msgEditedHeader].(string)
+	select {
+	case linkPreview.jobs <- &linkPreviewJob{topic: t.name, seq: data.SeqId, edited: edited, url: link}:
+	default:
+		log.Printf("topic[%s]: link preview queue full, message %d not previewed", t.name, data.SeqId)
+	}
+}
+
+// linkPreviewWorker fetches previews and delivers them to topics.
+func linkPreviewWorker() {
+	for job := range linkPreview.jobs {
+		preview, err := linkPreviewGet(job.url)
+		if err != nil {
+			log.Println("link preview: failed to fetch", job.url, err)
+			continue
+		}
+		if preview != nil {
+			linkPreviewDeliver(job, preview)
+		}
+	}
+}
+
+// linkPreviewGet returns the preview of the page using the cache. Returns nil if the page has no preview.
+func linkPreviewGet(link string) (map[string]interface{}, error) {
+	linkPreview.cacheLock.Lock()
+	preview, ok := linkPreview.cache[link]
+	linkPreview.cacheLock.Unlock()
+	if ok {
+		return preview, nil
+	}
+
+	preview, err := linkPreviewFetch(link)
+	if err != nil {
+		return nil, err
+	}
+
+	linkPreview.cacheLock.Lock()
+	if _, ok := linkPreview.cache[link]; !ok {
+		if len(linkPreview.cacheKeys) >= linkPreviewCacheSize {
+			delete(linkPreview.cache, linkPreview.cacheKeys[0])
+			linkPreview.cacheKeys = linkPreview.cacheKeys[1:]
+		}
+		linkPreview.cache[link] = preview
+		linkPreview.cacheKeys = append(linkPreview.cacheKeys, link)
+	}
+	linkPreview.cacheLock.Unlock()
+
+	return preview, nil
+}
+
+// linkPreviewFetch downloads the page and extracts the OpenGraph metadata.
+func linkPreviewFetch(link string) (map[string]interface{}, error) {
+	req, err := http.NewRequest(http.MethodGet, link, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "text/html")
+	resp, err := linkPreview.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("unexpected status " + resp.Status)
+	}
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html") {
+		// Not a web page, nothing to preview.
+		return nil, nil
+	}
+
+	meta := linkPreviewParse(io.LimitReader(resp.Body, linkPreview.maxSize))
+	title := meta["og:title"]
+	if title == "" {
+		title = meta["title"]
+	}
+	desc := meta["og:description"]
+	if desc == "" {
+		desc = meta["description"]
+	}
+	if title == "" && desc == "" {
+		return nil, nil
+	}
+
+	preview := map[string]interface{}{"url": link}
+	if title != "" {
+		preview["title"] = linkPreviewTruncate(title, linkPreviewMaxTitle)
+	}
+	if desc != "" {
+		preview["desc"] = linkPreviewTruncate(desc, linkPreviewMaxDesc)
+	}
+	if site := meta["og:site_name"]; site != "" {
+		preview["site"] = linkPreviewTruncate(site, linkPreviewMaxTitle)
+	}
+	if image := meta["og:image"]; image != "" {
+		// Relative image URLs are resolved against the final URL of the page.
+		if ref, err := resp.Request.URL.Parse(image); err == nil && (ref.Scheme == "http" || ref.Scheme == "https") {
+			preview["image"] = ref.String()
+		}
+	}
+	return preview, nil
+}
+
+// linkPreviewParse reads the head of the HTML page and collects the title and the meta tags
+// which describe the page.
+func linkPreviewParse(body io.Reader) map[string]string {
+	meta := make(map[string]string)
+	tokenizer := html.NewTokenizer(body)
+	inTitle := false
+	for {
+		switch tokenizer.Next() {
+		case html.ErrorToken:
+			return meta
+		case html.StartTagToken, html.SelfClosingTagToken:
+			name, hasAttr := tokenizer.TagName()
+			switch string(name) {
+			case "title":
+				inTitle = true
+			case "meta":
+				var key, content string
+				for hasAttr {
+					var attr, val []byte
+					attr, val, hasAttr = tokenizer.TagAttr()
+					switch string(attr) {
+					case "property", "name":
+						key = strings.ToLower(string(val))
+					case "content":
+						content = strings.TrimSpace(string(val))
+					}
+				}
+				switch key {
+				case "og:title", "og:description", "og:image", "og:site_name", "description":
+					if meta[key] == "" {
+						meta[key] = content
+					}
+				}
+			case "body":
+				// Metadata is in the head.
+				return meta
+			}
+		case html.TextToken:
+			if inTitle && meta["title"] == "" {
+				meta["title"] = strings.TrimSpace(string(tokenizer.Text()))
+			}
+		case html.EndTagToken:
+			name, _ := tokenizer.TagName()
+			switch string(name) {
+			case "title":
+				inTitle = false
+			case "head":
+				return meta
+			}
+		}
+	}
+}
+
+// linkPreviewTruncate shortens the text to at most max characters.
+func linkPreviewTruncate(text string, max int) string {
+	runes := []rune(text)
+	if len(runes) <= max {
+		return text
+	}
+	return string(runes[:max-1]) + "…"
+}
+
+// linkPreviewDeliver attaches the preview to the message. If the topic is loaded the preview is
+// broadcast to the attached sessions as an edit of the message.
+func linkPreviewDeliver(job *linkPreviewJob, preview map[string]interface{}) {
+	upd := &linkPreviewUpdate{seq: job.seq, edited: job.edited, preview: preview}
+	if t := globals.hub.topicGet(job.topic); t != nil && !t.isProxy {
+		msg := &ServerComMessage{
+			Data: &MsgServerData{
+				Topic: t.xoriginal,
+				Head:  map[string]interface{}{msgReplaceHeader: ":" + strconv.Itoa(job.seq)},
+				SeqId: job.seq,
+			},
+			RcptTo:    job.topic,
+			Timestamp: types.TimeNow(),
+			preview:   upd,
+		}
+		select {
+		case t.broadcast <- msg:
+		default:
+			log.Printf("topic[%s]: broadcast queue full, link preview of message %d dropped", job.topic, job.seq)
+		}
+		return
+	}
+
+	if globals.cluster.isRemoteTopic(job.topic) {
+		// The topic has moved to another node.
+		log.Printf("topic[%s]: topic is hosted by another node, link preview of message %d dropped", job.topic, job.seq)
+		return
+	}
+	if _, err := linkPreviewSave(job.topic, upd); err != nil {
+		log.Printf("topic[%s]: failed to save link preview of message %d: %v", job.topic, job.seq, err)
+	}
+}
+
+// linkPreviewSave adds the preview to the stored message. Returns the updated message or nil
+// if the message was deleted or edited since the preview was requested.
+func linkPreviewSave(topic string, upd *linkPreviewUpdate) (*types.Message, error) {
+	messages, err := store.Messages.GetAll(topic, types.ZeroUid,
+		&types.QueryOpt{Since: upd.seq, Before: upd.seq + 1, Limit: 1})
+	if err != nil || len(messages) == 0 {
+		return nil, err
+	}
+	mm := &messages[0]
+	if edited, _ := mm.Head[msgEditedHeader].(string); mm.DeletedAt != nil || edited != upd.edited {
+		return nil, nil
+	}
+
+	head := make(types.MessageHeaders, len(mm.Head)+1)
+	for key, val := range mm.Head {
+		head[key] = val
+	}
+	head[linkPreviewHeader] = upd.preview
+	if err = store.Messages.Update(topic, upd.seq, head, mm.Content); err != nil {
+		return nil, err
+	}
+	mm.Head = head
+	return mm, nil
+}
+
+// linkPreviewApply attaches the preview to the message and turns the {data} into an edit of the message
+// to be broadcast to the sessions. Returns false if there is nothing to broadcast.
+func (t *Topic) linkPreviewApply(msg *ServerComMessage) bool {
+	mm, err := linkPreviewSave(t.name, msg.preview)
+	if err != nil {
+		log.Printf("topic[%s]: failed to save link preview of message %d: %v", t.name, msg.preview.seq, err)
+		return false
+	}
+	if mm == nil {
+		return false
+	}
+
+	if t.recent != nil {
+		t.recent.replace(mm.SeqId, mm.Head, mm.Content)
+	}
+
+	// Recipients recognize the edit by the 'replace' header and update the message in place.
+	head := make(map[string]interface{}, len(mm.Head)+1)
+	for key, val := range mm.Head {
+		head[key] = val
+	}
+	head[msgReplaceHeader] = ":" + strconv.Itoa(mm.SeqId)
+	msg.Data.Head = head
+	msg.Data.Content = mm.Content
+	msg.Data.From = types.ParseUid(mm.From).UserId()
+	msg.Data.Timestamp = mm.CreatedAt
+	msg.Data.Replies = mm.Replies
+	msg.Data.LastReply = mm.LastReplyAt
+
+	return true
+}
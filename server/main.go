@@ -24,9 +24,6 @@ import (
 
 	gh "github.com/gorilla/handlers"
 
-	// For stripping comments from JSON config
-	jcr "github.com/tinode/jsonco"
-
 	// Authenticators
 	"github.com/tinode/chat/server/auth"
 	_ "github.com/tinode/chat/server/auth/anon"
@@ -39,6 +36,12 @@ import (
 	_ "github.com/tinode/chat/server/db/mysql"
 	_ "github.com/tinode/chat/server/db/rethinkdb"
 
+	// Compliance journaling
+	"github.com/tinode/chat/server/journal"
+	_ "github.com/tinode/chat/server/journal/file"
+	_ "github.com/tinode/chat/server/journal/s3"
+	_ "github.com/tinode/chat/server/journal/smtp"
+
 	// Push notifications
 	"github.com/tinode/chat/server/push"
 	_ "github.com/tinode/chat/server/push/fcm"
@@ -70,10 +73,44 @@ const (
 	idleMasterTopicTimeout = time.Second * 4
 	// Same as above but shut down the proxy topic sooner. Otherwise master topic would be kept alive for too long.
 	idleProxyTopicTimeout = time.Second * 2
+	// topicEvictionPeriod defines how often to check if idle topics should be evicted from memory.
+	topicEvictionPeriod = time.Second * 5
+	// detachWorkers is the maximum number of goroutines detaching sessions from topics in parallel.
+	detachWorkers = 64
+	// defaultKpCoalescePeriod is the default period during which repeated activity indicators of
+	// the same kind from the same user are not forwarded.
+	defaultKpCoalescePeriod = time.Second * 2
+	// kpMinInterval is the minimum interval between any two activity indicators of the same user
+	// forwarded to other subscribers, even if the kind of activity has changed.
+	kpMinInterval = time.Millisecond * 500
+	// defaultDelGracePeriod is the default time after publishing during which the sender
+	// may hard-delete own messages without the D permission.
+	defaultDelGracePeriod = time.Minute * 10
+	// defaultPushSuppressPeriod is the default time after the latest typing notification or focus report
+	// from a user during which push notifications to the user are suppressed.
+	defaultPushSuppressPeriod = time.Second * 10
+
+	// defaultAccountGracePeriod is the default time a deactivated account can be reactivated before it's deleted.
+	defaultAccountGracePeriod = time.Hour * 24 * 30
+	// accountGcPeriod defines how often to check for deactivated accounts to delete.
+	accountGcPeriod = time.Hour
+	// accountGcBlockSize is the maximum number of deactivated accounts deleted in one pass.
+	accountGcBlockSize = 100
+
+	// defaultDeviceMaxFailures is the default number of failed push notifications in a row after which
+	// the device is deleted.
+	defaultDeviceMaxFailures = 10
+	// defaultDeviceMaxIdle is the default time after which a device which has not logged in is deleted.
+	defaultDeviceMaxIdle = time.Hour * 24 * 90
+	// deviceGcPeriod defines how often to check for stale devices.
+	deviceGcPeriod = time.Hour * 6
 
 	// defaultMaxMessageSize is the default maximum message size
 	defaultMaxMessageSize = 1 << 19 // 512K
 
+	// defaultMaxAttachments is the default maximum number of attachments in a message.
+	defaultMaxAttachments = 32
+
 	// defaultMaxSubscriberCount is the default maximum number of group topic subscribers.
 	// Also set in adapter.
 	defaultMaxSubscriberCount = 256
@@ -81,6 +118,26 @@ const (
 	// defaultMaxTagCount is the default maximum number of indexable tags
 	defaultMaxTagCount = 16
 
+	// defaultRecentMessageCount is the default number of recent messages cached per topic.
+	defaultRecentMessageCount = 32
+
+	// maxRedeliverCount is the maximum number of unacknowledged messages redelivered on subscription.
+	maxRedeliverCount = 128
+
+	// maxSyncCursors is the maximum number of per-device sync cursors kept for one subscription.
+	maxSyncCursors = 16
+
+	// maxDraftSize is the maximum size of a serialized message draft in bytes.
+	maxDraftSize = 1 << 13
+
+	// maxEmojiPackItems is the maximum number of emoji and stickers in one pack.
+	maxEmojiPackItems = 256
+	// maxEmojiPacksEnabled is the maximum number of emoji packs enabled in one topic.
+	maxEmojiPacksEnabled = 32
+
+	// maxSessionAccounts is the maximum number of accounts authenticated in one session.
+	maxSessionAccounts = 8
+
 	// minTagLength is the shortest acceptable length of a tag in runes. Shorter tags are discarded.
 	minTagLength = 2
 	// maxTagLength is the maximum length of a tag in runes. Longer tags are trimmed.
@@ -148,6 +205,8 @@ var globals struct {
 
 	// Salt used for signing API key.
 	apiKeySalt []byte
+	// Key for signing message permalinks. Permalinks are disabled if empty.
+	permalinkKey []byte
 	// Tag namespaces (prefixes) which are immutable to the client.
 	immutableTagNS map[string]bool
 	// Tag namespaces which are immutable on User and partially mutable on Topic:
@@ -159,12 +218,10 @@ var globals struct {
 	tlsStrictMaxAge string
 	// Listen for connections on this address:port and redirect them to HTTPS port.
 	tlsRedirectHTTP string
-	// Maximum message size allowed from peer.
-	maxMessageSize int64
-	// Maximum number of group topic subscribers.
-	maxSubscriberCount int
-	// Maximum number of indexable tags.
-	maxTagCount int
+	// Number of recent messages per topic to cache in memory.
+	recentMessageCount int
+	// Sizes of request queues.
+	queueSizes queueConfig
 
 	// Maximum allowed upload size.
 	maxFileUploadSize int64
@@ -194,6 +251,8 @@ type mediaConfig struct {
 	GcPeriod int `json:"gc_period"`
 	// Number of entries to delete in one pass
 	GcBlockSize int `json:"gc_block_size"`
+	// Content of messages larger than this number of bytes is stored by the media handler, 0 to disable.
+	OffloadThreshold int `json:"offload_threshold"`
 	// Individual handler config params to pass to handlers unchanged.
 	Handlers map[string]json.RawMessage `json:"handlers"`
 }
@@ -223,34 +282,84 @@ type configType struct {
 	StaticData string `json:"static_data"`
 	// Salt used in signing API keys
 	APIKeySalt []byte `json:"api_key_salt"`
+	// Key for signing message permalinks, base64-encoded. Permalinks are disabled if missing.
+	PermalinkKey []byte `json:"permalink_key"`
 	// Maximum message size allowed from client. Intended to prevent malicious client from sending
 	// very large files inband (does not affect out of band uploads).
 	MaxMessageSize int `json:"max_message_size"`
+	// Maximum number of attachments in a message. Topic owners may set a lower limit.
+	MaxAttachments int `json:"max_attachments"`
 	// Maximum number of group topic subscribers.
 	MaxSubscriberCount int `json:"max_subscriber_count"`
 	// Masked tags: tags immutable on User (mask), mutable on Topic only within the mask.
 	MaskedTagNamespaces []string `json:"masked_tags"`
 	// Maximum number of indexable tags
 	MaxTagCount int `json:"max_tag_count"`
+	// Number of hub shards for processing topic requests. Default: number of CPUs.
+	HubShards int `json:"hub_shards"`
+	// Number of recent messages per topic to keep in memory. Default: 32; negative value disables the cache.
+	RecentMessageCount int `json:"recent_message_count"`
+	// Time in seconds to keep a topic in memory after the last session has left it.
+	TopicIdleTimeout int `json:"topic_idle_timeout"`
+	// Time in seconds during which repeated typing notifications of the same kind from one user are not forwarded. Default: 2.
+	KpCoalescePeriod int `json:"kp_coalesce_period"`
+	// Time in seconds after a typing notification or a focus report from a user during which push
+	// notifications about new messages in the topic are not sent to the user. Default: 10; negative value disables.
+	PushSuppressPeriod int `json:"push_suppress_period"`
+	// Time in seconds after publishing during which the sender may hard-delete own messages
+	// without the D permission. Default: 600; negative value disables.
+	DelGracePeriod int `json:"del_grace_period"`
+	// Age in years at which users may find topics rated for adults. Default: 18.
+	AdultAge int `json:"adult_age"`
+	// Maximum number of topics kept in memory before idle topics are evicted. 0 means no limit.
+	MaxResidentTopics int `json:"max_resident_topics"`
+	// Maximum estimated memory used by topics, in bytes, before idle topics are evicted. 0 means no limit.
+	MaxTopicsMemory int64 `json:"max_topics_memory"`
+	// Sizes of request queues of the hub and topics.
+	Queues *queueConfig `json:"queues"`
+	// Number of days a deactivated account can be reactivated by logging in before it's deleted. Default: 30.
+	AccountGracePeriod int `json:"account_grace_period"`
+	// Number of failed push notifications in a row after which the device is deleted. Default: 10.
+	DeviceMaxFailures int `json:"device_max_failures"`
+	// Number of days after which a device which has not logged in is deleted. Default: 90.
+	DeviceMaxIdle int `json:"device_max_idle"`
 	// URL path for exposing runtime stats. Disabled if the path is blank.
 	ExpvarPath string `json:"expvar"`
 	// Take IP address of the client from HTTP header 'X-Forwarded-For'.
 	// Useful when tinode is behind a proxy. If missing, fallback to default RemoteAddr.
 	UseXForwardedFor bool `json:"use_x_forwarded_for"`
+	// Minimum supported versions of client applications by platform: "android", "ios", "web".
+	MinClientVersions map[string]*minClientVersion `json:"min_client_versions"`
 	// 2-letter country code (ISO 3166-1 alpha-2) to assign to sessions by default
 	// when the country isn't specified by the client explicitly and
 	// it's impossible to infer it.
 	DefaultCountryCode string `json:"default_country_code"`
 
 	// Configs for subsystems
-	Cluster   json.RawMessage             `json:"cluster_config"`
-	Plugin    json.RawMessage             `json:"plugins"`
-	Store     json.RawMessage             `json:"store_config"`
-	Push      json.RawMessage             `json:"push"`
-	TLS       json.RawMessage             `json:"tls"`
-	Auth      map[string]json.RawMessage  `json:"auth_config"`
-	Validator map[string]*validatorConfig `json:"acc_validation"`
-	Media     *mediaConfig                `json:"media"`
+	Cluster      json.RawMessage             `json:"cluster_config"`
+	Plugin       json.RawMessage             `json:"plugins"`
+	Store        json.RawMessage             `json:"store_config"`
+	Push         json.RawMessage             `json:"push"`
+	Journal      json.RawMessage             `json:"journal"`
+	ClientConfig json.RawMessage             `json:"client_config"`
+	Translation  json.RawMessage             `json:"translation"`
+	Registration json.RawMessage             `json:"registration"`
+	TopicCreate  json.RawMessage             `json:"topic_creation"`
+	SessLimits   json.RawMessage             `json:"session_limits"`
+	History      json.RawMessage             `json:"grpc_history"`
+	I18n         json.RawMessage             `json:"i18n"`
+	LinkPreview  json.RawMessage             `json:"link_preview"`
+	Maintenance  json.RawMessage             `json:"maintenance"`
+	Masking      json.RawMessage             `json:"masking"`
+	Relays       json.RawMessage             `json:"relays"`
+	Redelivery   json.RawMessage             `json:"redelivery"`
+	Activity     json.RawMessage             `json:"activity"`
+	TLS          json.RawMessage             `json:"tls"`
+	Templates    json.RawMessage             `json:"topic_templates"`
+	DescSchema   json.RawMessage             `json:"desc_schema"`
+	Auth         map[string]json.RawMessage  `json:"auth_config"`
+	Validator    map[string]*validatorConfig `json:"acc_validation"`
+	Media        *mediaConfig                `json:"media"`
 }
 
 func main() {
@@ -280,27 +389,13 @@ func main() {
 	*configfile = toAbsolutePath(rootpath, *configfile)
 	log.Printf("Using config from '%s'", *configfile)
 
-	var config configType
-	if file, err := os.Open(*configfile); err != nil {
-		log.Fatal("Failed to read config file: ", err)
-	} else {
-		jr := jcr.New(file)
-		if err = json.NewDecoder(jr).Decode(&config); err != nil {
-			switch jerr := err.(type) {
-			case *json.UnmarshalTypeError:
-				lnum, cnum, _ := jr.LineAndChar(jerr.Offset)
-				log.Fatalf("Unmarshall error in config file in %s at %d:%d (offset %d bytes): %s",
-					jerr.Field, lnum, cnum, jerr.Offset, jerr.Error())
-			case *json.SyntaxError:
-				lnum, cnum, _ := jr.LineAndChar(jerr.Offset)
-				log.Fatalf("Syntax error in config file at %d:%d (offset %d bytes): %s",
-					lnum, cnum, jerr.Offset, jerr.Error())
-			default:
-				log.Fatal("Failed to parse config file: ", err)
-			}
-		}
-		file.Close()
+	loaded, configHash, err := configRead(*configfile)
+	if err != nil {
+		log.Fatal(err)
 	}
+	config := *loaded
+	// The config as read from the file is the first version for reloading.
+	configStart(*configfile, loaded, configHash)
 
 	if *listenOn != "" {
 		config.Listen = *listenOn
@@ -351,7 +446,7 @@ func main() {
 		log.Printf("Profiling info saved to '%s.(cpu|mem)'", *pprofFile)
 	}
 
-	err := store.Open(workerId, config.Store)
+	err = store.Open(workerId, config.Store)
 	if err != nil {
 		log.Fatal("Failed to connect to DB: ", err)
 	}
@@ -364,6 +459,7 @@ func main() {
 
 	// API key signing secret
 	globals.apiKeySalt = config.APIKeySalt
+	globals.permalinkKey = config.PermalinkKey
 
 	err = store.InitAuthLogicalNames(config.Auth["logical_names"])
 	if err != nil {
@@ -455,6 +551,10 @@ func main() {
 		globals.maskedTagNS[tag] = true
 	}
 
+	// Language and content rating of topics are assigned through topic description.
+	globals.immutableTagNS[contentLangTagNS] = true
+	globals.immutableTagNS[contentRatingTagNS] = true
+
 	var tags []string
 	for tag := range globals.immutableTagNS {
 		tags = append(tags, "'"+tag+"'")
@@ -470,22 +570,20 @@ func main() {
 		log.Println("Masked tags:", tags)
 	}
 
-	// Maximum message size
-	globals.maxMessageSize = int64(config.MaxMessageSize)
-	if globals.maxMessageSize <= 0 {
-		globals.maxMessageSize = defaultMaxMessageSize
+	// Message size, number of subscribers, masking rules and other sections which can be changed
+	// by reloading the config.
+	if err = configApply(&config); err != nil {
+		log.Fatal("Invalid config: ", err)
 	}
-	// Maximum number of group topic subscribers
-	globals.maxSubscriberCount = config.MaxSubscriberCount
-	if globals.maxSubscriberCount <= 1 {
-		globals.maxSubscriberCount = defaultMaxSubscriberCount
-	}
-	// Maximum number of indexable tags per user or topics
-	globals.maxTagCount = config.MaxTagCount
-	if globals.maxTagCount <= 0 {
-		globals.maxTagCount = defaultMaxTagCount
+
+	// Number of recent messages to cache in memory per topic
+	globals.recentMessageCount = config.RecentMessageCount
+	if globals.recentMessageCount == 0 {
+		globals.recentMessageCount = defaultRecentMessageCount
 	}
 
+	globals.queueSizes = queueSizes(config.Queues)
+
 	globals.useXForwardedFor = config.UseXForwardedFor
 	globals.defaultCountryCode = config.DefaultCountryCode
 	if globals.defaultCountryCode == "" {
@@ -506,6 +604,9 @@ func main() {
 					log.Fatalf("Failed to init media handler '%s': %s", config.Media.UseHandler, err)
 				}
 			}
+			if err = store.UseMessageOffload(config.Media.OffloadThreshold); err != nil {
+				log.Fatal("Failed to enable offload of large messages:", err)
+			}
 			if config.Media.GcPeriod > 0 && config.Media.GcBlockSize > 0 {
 				stopFilesGc := largeFileRunGarbageCollection(time.Second*time.Duration(config.Media.GcPeriod),
 					config.Media.GcBlockSize)
@@ -526,10 +627,74 @@ func main() {
 		log.Println("Stopped push notifications")
 	}()
 
+	var nodeName string
+	if globals.cluster != nil {
+		nodeName = globals.cluster.thisNodeName
+	}
+	err = journal.Init(string(config.Journal), nodeName)
+	if err != nil {
+		log.Fatal("Failed to initialize compliance journal:", err)
+	}
+	defer func() {
+		journal.Stop()
+		log.Println("Stopped compliance journal")
+	}()
+
+	if err = clientConfInit(config.ClientConfig, rootpath); err != nil {
+		log.Fatal("Failed to initialize client configuration:", err)
+	}
+
+	if err = translateInit(config.Translation); err != nil {
+		log.Fatal("Failed to initialize translation service:", err)
+	}
+
+	if err = maintenanceInit(config.Maintenance, rootpath); err != nil {
+		log.Fatal("Failed to initialize maintenance schedule:", err)
+	}
+
+	if err = linkPreviewInit(config.LinkPreview); err != nil {
+		log.Fatal("Failed to initialize link previews:", err)
+	}
+
+	if err = relayInit(config.Relays); err != nil {
+		log.Fatal("Failed to initialize edge relays:", err)
+	}
+
+	if err = redeliveryInit(config.Redelivery); err != nil {
+		log.Fatal("Failed to initialize redelivery limits:", err)
+	}
+
+	if err = activityInit(config.Activity); err != nil {
+		log.Fatal("Failed to initialize account activity timeline:", err)
+	}
+
+	if err = registrationInit(config.Registration); err != nil {
+		log.Fatal("Failed to initialize registration approval:", err)
+	}
+
+	if err = topicCreationInit(config.TopicCreate); err != nil {
+		log.Fatal("Failed to initialize limits on topic creation:", err)
+	}
+
+	if err = historyInit(config.History); err != nil {
+		log.Fatal("Failed to initialize message history stream:", err)
+	}
+
+	if err = i18nInit(config.I18n); err != nil {
+		log.Fatal("Failed to initialize localization:", err)
+	}
+
+	// Start delivery of topic webhooks.
+	hookStart()
+
 	// Keep inactive LP sessions for 15 seconds
 	globals.sessionStore = NewSessionStore(idleSessionTimeout + 15*time.Second)
 	// The hub (the main message router)
-	globals.hub = newHub()
+	hubShards := config.HubShards
+	if hubShards <= 0 {
+		hubShards = runtime.NumCPU()
+	}
+	globals.hub = newHub(hubShards)
 
 	// Start accepting cluster traffic.
 	if globals.cluster != nil {
@@ -547,6 +712,52 @@ func main() {
 	// Initialize users cache
 	usersInit()
 
+	// Delete accounts which remained deactivated past the grace period.
+	accountGracePeriod := time.Hour * 24 * time.Duration(config.AccountGracePeriod)
+	if accountGracePeriod <= 0 {
+		accountGracePeriod = defaultAccountGracePeriod
+	}
+	stopAccountGc := usersRunDeactivatedGc(accountGcPeriod, accountGracePeriod, accountGcBlockSize)
+	defer func() {
+		stopAccountGc <- true
+		log.Println("Stopped deactivated accounts garbage collector")
+	}()
+
+	// Delete push tokens which keep failing or belong to devices not used for a long time.
+	deviceMaxFailures := config.DeviceMaxFailures
+	if deviceMaxFailures <= 0 {
+		deviceMaxFailures = defaultDeviceMaxFailures
+	}
+	deviceMaxIdle := time.Hour * 24 * time.Duration(config.DeviceMaxIdle)
+	if deviceMaxIdle <= 0 {
+		deviceMaxIdle = defaultDeviceMaxIdle
+	}
+	stopDeviceGc := devicesRunStaleGc(deviceGcPeriod, deviceMaxFailures, deviceMaxIdle)
+	defer func() {
+		stopDeviceGc <- true
+		log.Println("Stopped stale devices garbage collector")
+	}()
+
+	// Delete account events past the retention period.
+	if stopActivityGc := activityRunGc(activityGcPeriod); stopActivityGc != nil {
+		defer func() {
+			stopActivityGc <- true
+			log.Println("Stopped account activity garbage collector")
+		}()
+	}
+
+	stopDigests := digestsRun(digestCheckPeriod, digestBlockSize)
+	defer func() {
+		stopDigests <- true
+		log.Println("Stopped channel digests")
+	}()
+
+	stopEvents := calEventsRun(calEventCheckPeriod, calEventBlockSize)
+	defer func() {
+		stopEvents <- true
+		log.Println("Stopped event reminders")
+	}()
+
 	// Set up gRPC server, if one is configured
 	if *listenGrpc == "" {
 		*listenGrpc = config.GrpcListen
@@ -623,6 +834,12 @@ func main() {
 		log.Println("Large media handling enabled", config.Media.UseHandler)
 	}
 
+	if len(globals.permalinkKey) > 0 {
+		// Resolve message permalinks.
+		mux.Handle(config.ApiPath+"v0/link/", gh.CompressHandler(http.HandlerFunc(permalinkServe)))
+		log.Println("Message permalinks enabled")
+	}
+
 	if staticMountPoint != "/" {
 		// Serve json-formatted 404 for all other URLs
 		mux.HandleFunc("/", serve404)
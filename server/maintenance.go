@@ -0,0 +1,233 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *    Scheduled maintenance: the window is read from a file which is watched
+ *    for changes. Sessions are notified of the upcoming window, during the
+ *    window the server rejects changes, and it returns to normal after.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/tinode/chat/server/store/types"
+)
+
+const (
+	// Default interval between checks of the maintenance file for changes.
+	defaultMaintenanceCheckInterval = 30 * time.Second
+	// Default time before the start of the window when sessions are notified.
+	defaultMaintenanceAnnounce = time.Hour
+)
+
+// maintenanceConfig is the "maintenance" section of the server config.
+type maintenanceConfig struct {
+	// Path to the JSON file with the maintenance window. No maintenance is scheduled if the file is missing.
+	File string `json:"file"`
+	// Interval in seconds between checks of the file for changes.
+	CheckInterval int `json:"check_interval"`
+}
+
+// maintenanceWindow is the content of the maintenance file.
+type maintenanceWindow struct {
+	// Start and end of the window.
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+	// Explanation shown to users, optional.
+	Note string `json:"note"`
+	// Time in seconds before the start when sessions are notified. Default: 3600.
+	Announce int `json:"announce"`
+}
+
+var maintenance struct {
+	sync.RWMutex
+	window  *maintenanceWindow
+	path    string
+	modTime time.Time
+	// Last state announced to sessions.
+	announced string
+}
+
+// maintenanceInit loads the maintenance window and starts watching the file for changes.
+func maintenanceInit(jsconfig json.RawMessage, rootpath string) error {
+	if len(jsconfig) == 0 {
+		return nil
+	}
+
+	var config maintenanceConfig
+	if err := json.Unmarshal(jsconfig, &config); err != nil {
+		return errors.New("failed to parse config: " + err.Error())
+	}
+	if config.File == "" {
+		return nil
+	}
+	if config.CheckInterval < 0 {
+		return errors.New("invalid check interval")
+	}
+
+	maintenance.path = toAbsolutePath(rootpath, config.File)
+	if err := maintenanceReload(); err != nil {
+		return err
+	}
+
+	interval := time.Duration(config.CheckInterval) * time.Second
+	if interval == 0 {
+		interval = defaultMaintenanceCheckInterval
+	}
+	go func() {
+		// The state is checked every second to switch modes on time, the file is checked less often.
+		ticker := time.NewTicker(time.Second)
+		lastCheck := time.Now()
+		for now := range ticker.C {
+			if now.Sub(lastCheck) >= interval {
+				lastCheck = now
+				if err := maintenanceReload(); err != nil {
+					log.Println("maintenance: failed to reload", err)
+				}
+			}
+			maintenanceAnnounce()
+		}
+	}()
+
+	return nil
+}
+
+// maintenanceReload reads the maintenance file if it has changed since the last read.
+func maintenanceReload() error {
+	info, err := os.Stat(maintenance.path)
+	if os.IsNotExist(err) {
+		// No maintenance scheduled.
+		maintenance.Lock()
+		maintenance.window = nil
+		maintenance.modTime = time.Time{}
+		maintenance.Unlock()
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.ModTime().Equal(maintenance.modTime) {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(maintenance.path)
+	if err != nil {
+		return err
+	}
+	var window *maintenanceWindow
+	if len(data) > 0 {
+		window = &maintenanceWindow{}
+		if err = json.Unmarshal(data, window); err != nil {
+			return errors.New("failed to parse " + maintenance.path + ": " + err.Error())
+		}
+		if window.Start.IsZero() || !window.End.After(window.Start) || window.Announce < 0 {
+			return errors.New("invalid maintenance window in " + maintenance.path)
+		}
+	}
+
+	maintenance.Lock()
+	maintenance.window = window
+	maintenance.modTime = info.ModTime()
+	maintenance.Unlock()
+
+	if window != nil {
+		log.Println("maintenance: window scheduled", window.Start, window.End)
+	} else {
+		log.Println("maintenance: window cleared")
+	}
+	return nil
+}
+
+// maintenanceState returns the current state of maintenance: "" if no maintenance is scheduled or
+// it's not time to announce it yet, "scheduled" if the window is upcoming and "active" during the window.
+func maintenanceState(now time.Time) (string, *maintenanceWindow) {
+	maintenance.RLock()
+	window := maintenance.window
+	maintenance.RUnlock()
+
+	if window == nil || !now.Before(window.End) {
+		return "", nil
+	}
+	if !now.Before(window.Start) {
+		return "active", window
+	}
+	announce := defaultMaintenanceAnnounce
+	if window.Announce > 0 {
+		announce = time.Duration(window.Announce) * time.Second
+	}
+	if window.Start.Sub(now) <= announce {
+		return "scheduled", window
+	}
+	return "", nil
+}
+
+// maintenanceParams returns the description of the maintenance for the clients, nil if there is none.
+func maintenanceParams(now time.Time) map[string]interface{} {
+	state, window := maintenanceState(now)
+	if state == "" {
+		return nil
+	}
+	params := map[string]interface{}{"state": state, "start": window.Start, "end": window.End}
+	if window.Note != "" {
+		params["note"] = window.Note
+	}
+	return params
+}
+
+// maintenanceAnnounce notifies the sessions when the state of maintenance changes.
+func maintenanceAnnounce() {
+	now := types.TimeNow()
+	state, window := maintenanceState(now)
+	key := state
+	if window != nil {
+		// A change of the window is announced too.
+		key += window.Start.String() + window.End.String() + window.Note
+	}
+
+	maintenance.Lock()
+	if key == maintenance.announced {
+		maintenance.Unlock()
+		return
+	}
+	maintenance.announced = key
+	maintenance.Unlock()
+
+	params := maintenanceParams(now)
+	if params == nil {
+		// Maintenance is over or cancelled.
+		params = map[string]interface{}{"state": "done"}
+	}
+	var count int
+	globals.sessionStore.Range(func(sid string, s *Session) bool {
+		if s.isMultiplex() || s.isProxy() {
+			return true
+		}
+		if class, _ := s.confClass.Load().(*clientClass); class == nil {
+			// The session has not sent {hi} yet, it will get the state in response to {hi}.
+			return true
+		}
+		s.queueOut(NoErrMaintenance(params, now))
+		count++
+		return true
+	})
+	log.Println("maintenance:", params["state"], "announced to sessions:", count)
+}
+
+// maintenanceReject returns the response to a request which changes data during the maintenance,
+// nil if changes are permitted.
+func maintenanceReject(msg *ClientComMessage) *ServerComMessage {
+	now := types.TimeNow()
+	if state, window := maintenanceState(now); state == "active" {
+		return ErrMaintenance(msg.Id, msg.Original, now, msg.Timestamp, window)
+	}
+	return nil
+}
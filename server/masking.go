@@ -0,0 +1,326 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *    Masking of sensitive data in messages: card numbers, phone numbers and
+ *    profanity are replaced with '*' in the copies of messages delivered to
+ *    channel readers and to members of flagged topics. Rules are configured
+ *    per organization of the recipient. Stored messages are not changed.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"regexp"
+	"strings"
+
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+const (
+	maskCard      = "card"
+	maskPhone     = "phone"
+	maskProfanity = "profanity"
+)
+
+var (
+	// Sequences of 13 to 19 digits optionally separated by spaces or dashes.
+	maskCardRegexp = regexp.MustCompile(`\b\d(?:[ -]?\d){12,18}\b`)
+	// Sequences of 9 to 15 digits with an optional leading '+' and common separators. Shorter sequences
+	// are not masked to leave dates and times intact.
+	maskPhoneRegexp = regexp.MustCompile(`(?:\+|\b)\d(?:[ ().-]{0,2}\d){8,14}\b`)
+)
+
+// maskingConfig is the "masking" section of the server config.
+type maskingConfig struct {
+	Enabled bool                `json:"enabled"`
+	Rules   []maskingRuleConfig `json:"rules"`
+}
+
+// maskingRuleConfig is the masking rule of one organization.
+type maskingRuleConfig struct {
+	// Organization of the recipients. The rule with the empty org applies to organizations without own rules.
+	Org string `json:"org"`
+	// Kinds of data to mask: "card", "phone", "profanity".
+	Mask []string `json:"mask"`
+	// Words masked as profanity.
+	Words []string `json:"words"`
+	// Topics where messages are masked for members without the 'A' permission.
+	Topics []string `json:"topics"`
+	// Mask messages delivered to channel readers.
+	Readers bool `json:"readers"`
+}
+
+// maskingRule is the parsed masking rule.
+type maskingRule struct {
+	card      bool
+	phone     bool
+	profanity *regexp.Regexp
+	topics    map[string]bool
+	readers   bool
+}
+
+// maskingParse parses masking rules. Returns the rules by organization, nil if masking is disabled.
+func maskingParse(jsconfig json.RawMessage) (map[string]*maskingRule, error) {
+	if len(jsconfig) == 0 {
+		return nil, nil
+	}
+
+	var config maskingConfig
+	if err := json.Unmarshal(jsconfig, &config); err != nil {
+		return nil, errors.New("failed to parse config: " + err.Error())
+	}
+	if !config.Enabled {
+		return nil, nil
+	}
+
+	rules := make(map[string]*maskingRule, len(config.Rules))
+	for _, rc := range config.Rules {
+		if _, ok := rules[rc.Org]; ok {
+			return nil, errors.New("duplicate masking rule for org '" + rc.Org + "'")
+		}
+		rule := &maskingRule{readers: rc.Readers, topics: make(map[string]bool, len(rc.Topics))}
+		for _, kind := range rc.Mask {
+			switch kind {
+			case maskCard:
+				rule.card = true
+			case maskPhone:
+				rule.phone = true
+			case maskProfanity:
+				var words []string
+				for _, word := range rc.Words {
+					if word = strings.TrimSpace(word); word != "" {
+						words = append(words, regexp.QuoteMeta(word))
+					}
+				}
+				if len(words) == 0 {
+					return nil, errors.New("no words to mask as profanity for org '" + rc.Org + "'")
+				}
+				rule.profanity = regexp.MustCompile(`(?i)\b(?:` + strings.Join(words, "|") + `)\b`)
+			default:
+				return nil, errors.New("unknown kind of masked data '" + kind + "'")
+			}
+		}
+		for _, topic := range rc.Topics {
+			if grp := types.ChnToGrp(topic); grp != "" {
+				topic = grp
+			}
+			rule.topics[topic] = true
+		}
+		rules[rc.Org] = rule
+	}
+	return rules, nil
+}
+
+// maskingRuleFor returns the masking rule for the copies of messages delivered to the user
+// of the organization org, nil if the messages are delivered unchanged.
+func (t *Topic) maskingRuleFor(org string, uid types.Uid, asChan bool) *maskingRule {
+	var mode types.AccessMode
+	if pud, ok := t.perUser[uid]; ok {
+		mode = pud.modeGiven & pud.modeWant
+	}
+	if t.isOwner(uid) {
+		mode |= types.ModeOwner
+	}
+	return maskingRuleOf(org, t.name, mode, asChan)
+}
+
+// maskingRuleStored is maskingRuleFor for messages read outside of the topic: the access mode
+// of the user is read from the database.
+func maskingRuleStored(org, topic string, uid types.Uid, asChan bool) (*maskingRule, error) {
+	if len(liveConfig().maskingRules) == 0 {
+		return nil, nil
+	}
+	var mode types.AccessMode
+	if !asChan {
+		sub, err := store.Subs.Get(topic, uid)
+		if err != nil {
+			return nil, err
+		}
+		if sub != nil {
+			mode = sub.ModeGiven & sub.ModeWant
+		}
+	}
+	return maskingRuleOf(org, topic, mode, asChan), nil
+}
+
+// maskingRuleOf returns the masking rule for the copies of messages of the topic delivered to the user
+// of the organization org with the access mode, nil if the messages are delivered unchanged.
+func maskingRuleOf(org, topic string, mode types.AccessMode, asChan bool) *maskingRule {
+	rules := liveConfig().maskingRules
+	rule, ok := rules[org]
+	if !ok {
+		rule = rules[""]
+	}
+	if rule == nil {
+		return nil
+	}
+	if asChan {
+		if rule.readers {
+			return rule
+		}
+		return nil
+	}
+	if !rule.topics[topic] {
+		return nil
+	}
+	// Administrators of the topic see the original messages.
+	if mode.IsAdmin() {
+		return nil
+	}
+	return rule
+}
+
+// stored returns the content of the stored message as delivered to the user: sensitive data is masked
+// unless the user is the sender. The rule may be nil.
+func (r *maskingRule) stored(mm *types.Message, uid types.Uid) interface{} {
+	if r == nil || mm.From == uid.String() {
+		return mm.Content
+	}
+	content, _ := r.content(mm.Content)
+	return content
+}
+
+// text masks sensitive data in the text. The length of the text in runes does not change,
+// so the formatting of Drafty documents remains valid.
+func (r *maskingRule) text(text string) string {
+	if r.card {
+		text = maskCardRegexp.ReplaceAllStringFunc(text, func(match string) string {
+			if !maskLuhnValid(match) {
+				return match
+			}
+			return maskDigits(match, 4)
+		})
+	}
+	if r.phone {
+		text = maskPhoneRegexp.ReplaceAllStringFunc(text, func(match string) string {
+			return maskDigits(match, 2)
+		})
+	}
+	if r.profanity != nil {
+		text = r.profanity.ReplaceAllStringFunc(text, func(match string) string {
+			return strings.Repeat("*", len([]rune(match)))
+		})
+	}
+	return text
+}
+
+// content masks the plain text or the text of the Drafty document. Returns the masked copy
+// of the content and true if anything was masked.
+func (r *maskingRule) content(content interface{}) (interface{}, bool) {
+	switch val := content.(type) {
+	case string:
+		masked := r.text(val)
+		return masked, masked != val
+	case map[string]interface{}:
+		txt, ok := val["txt"].(string)
+		if !ok {
+			return content, false
+		}
+		masked := r.text(txt)
+		if masked == txt {
+			return content, false
+		}
+		drafty := make(map[string]interface{}, len(val))
+		for key, v := range val {
+			drafty[key] = v
+		}
+		drafty["txt"] = masked
+		return drafty, true
+	}
+	return content, false
+}
+
+// maskDigits replaces all digits but the last keep ones with '*'.
+func maskDigits(s string, keep int) string {
+	digits := 0
+	for _, r := range s {
+		if r >= '0' && r <= '9' {
+			digits++
+		}
+	}
+	out := []rune(s)
+	for i := range out {
+		if out[i] >= '0' && out[i] <= '9' {
+			if digits > keep {
+				out[i] = '*'
+			}
+			digits--
+		}
+	}
+	return string(out)
+}
+
+// maskLuhnValid checks the digits of a card number with the Luhn algorithm.
+func maskLuhnValid(s string) bool {
+	var sum, n int
+	for i := len(s) - 1; i >= 0; i-- {
+		c := s[i]
+		if c < '0' || c > '9' {
+			continue
+		}
+		d := int(c - '0')
+		if n%2 == 1 {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		n++
+	}
+	return sum%10 == 0
+}
+
+// maskingFanout collects masked copies of a broadcast message, one per masking rule.
+type maskingFanout struct {
+	topic *Topic
+	from  string
+	// Masked content by rule, nil if there is nothing to mask.
+	masked map[*maskingRule]interface{}
+	// Masked copies converted for gRPC, by rule.
+	pbCache map[*maskingRule]*pbDataCache
+}
+
+// newMaskingFanout creates a collector for the message if masking may apply to it.
+func newMaskingFanout(t *Topic, msg *ServerComMessage) *maskingFanout {
+	if len(liveConfig().maskingRules) == 0 || msg.Data == nil || isSysEvent(msg.Data) {
+		return nil
+	}
+	return &maskingFanout{topic: t, from: msg.Data.From, masked: make(map[*maskingRule]interface{}),
+		pbCache: make(map[*maskingRule]*pbDataCache)}
+}
+
+// copyFor returns the masked copy of the message for the session, nil if the original is delivered.
+// Senders get their own messages unchanged.
+func (mf *maskingFanout) copyFor(sess *Session, pssd perSessionData, data *MsgServerData) *ServerComMessage {
+	if mf == nil || (pssd.uid.IsZero() && !pssd.isChanSub) || pssd.uid.UserId() == mf.from {
+		return nil
+	}
+	rule := mf.topic.maskingRuleFor(sess.activeOrg(), pssd.uid, pssd.isChanSub)
+	if rule == nil {
+		return nil
+	}
+	content, ok := mf.masked[rule]
+	if !ok {
+		var changed bool
+		if content, changed = rule.content(data.Content); !changed {
+			content = nil
+		}
+		mf.masked[rule] = content
+		mf.pbCache[rule] = newPbDataCache()
+	}
+	if content == nil {
+		return nil
+	}
+
+	dst := *data
+	dst.Content = content
+	dst.pbContent = nil
+	dst.pbCache = mf.pbCache[rule]
+	return &ServerComMessage{Data: &dst}
+}
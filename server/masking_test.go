@@ -0,0 +1,68 @@
+package main
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestMaskingRuleText(t *testing.T) {
+	card := &maskingRule{card: true}
+	phone := &maskingRule{phone: true}
+	profanity := &maskingRule{profanity: regexp.MustCompile(`(?i)\b(?:darn|heck)\b`)}
+	all := &maskingRule{card: true, phone: true, profanity: profanity.profanity}
+
+	cases := []struct {
+		rule   *maskingRule
+		input  string
+		expect string
+	}{
+		{card, "card 4111 1111 1111 1111 ok", "card **** **** **** 1111 ok"},
+		{card, "card 4111-1111-1111-1111", "card ****-****-****-1111"},
+		{card, "4111111111111111", "************1111"},
+		// Fails the Luhn check.
+		{card, "card 4111 1111 1111 1112", "card 4111 1111 1111 1112"},
+		// Too short for a card number.
+		{card, "order 123456789012", "order 123456789012"},
+		{phone, "call +1 (415) 555-2671", "call +* (***) ***-**71"},
+		{phone, "call 4155552671 now", "call ********71 now"},
+		// Dates and times are not phone numbers.
+		{phone, "on 2024-01-15 at 10:30", "on 2024-01-15 at 10:30"},
+		{profanity, "Darn it, what the heck", "**** it, what the ****"},
+		// Only whole words are masked.
+		{profanity, "darned", "darned"},
+		{all, "darn, 4111 1111 1111 1111 or +1 415 555 2671",
+			"****, **** **** **** 1111 or +* *** *** **71"},
+		{all, "nothing to mask", "nothing to mask"},
+	}
+
+	for i, tc := range cases {
+		got := tc.rule.text(tc.input)
+		if got != tc.expect {
+			t.Errorf("%d: expected '%s', got '%s'", i, tc.expect, got)
+		}
+		if len([]rune(got)) != len([]rune(tc.input)) {
+			t.Errorf("%d: length changed from %d to %d", i, len([]rune(tc.input)), len([]rune(got)))
+		}
+	}
+}
+
+func TestMaskLuhnValid(t *testing.T) {
+	cases := []struct {
+		input  string
+		expect bool
+	}{
+		{"4111111111111111", true},
+		{"4111 1111 1111 1111", true},
+		{"5500-0000-0000-0004", true},
+		{"79927398713", true},
+		{"4111111111111112", false},
+		{"79927398710", false},
+		{"1234567812345678", false},
+	}
+
+	for _, tc := range cases {
+		if got := maskLuhnValid(tc.input); got != tc.expect {
+			t.Errorf("'%s': expected %v, got %v", tc.input, tc.expect, got)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *    Limit of subscribers of individual group topics, e.g. for paid tiers.
+ *    The limit is set by the administrator and overrides the global
+ *    max_subscriber_count for the topic.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"errors"
+	"log"
+
+	"github.com/tinode/chat/server/auth"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+// subsLimit returns the maximum number of subscribers of the topic.
+func (t *Topic) subsLimit() int {
+	if t.maxSubs > 0 {
+		return t.maxSubs
+	}
+	return liveConfig().maxSubscriberCount
+}
+
+// replySetMaxSubs sets or removes the limit of subscribers of a group topic, 'sys' topic only, root only.
+func (t *Topic) replySetMaxSubs(sess *Session, authLevel auth.Level, msg *ClientComMessage) error {
+	now := types.TimeNow()
+
+	if t.cat != types.TopicCatSys || authLevel != auth.LevelRoot {
+		sess.queueOut(ErrPermissionDeniedReply(msg, now))
+		return errors.New("set.maxsubs: root access required")
+	}
+
+	req := msg.Set.MaxSubs
+	name := req.Topic
+	if tmp := types.ChnToGrp(name); tmp != "" {
+		name = tmp
+	}
+	if topicCat(name) != types.TopicCatGrp || req.Max < 0 || req.Max == 1 {
+		sess.queueOut(ErrMalformedReply(msg, now))
+		return errors.New("set.maxsubs: invalid request")
+	}
+	if globals.cluster.isRemoteTopic(name) {
+		// The topic could be loaded at the other node.
+		sess.queueOut(ErrOperationNotAllowedReply(msg, now))
+		return errors.New("set.maxsubs: topic is hosted by another node")
+	}
+
+	// The limit is changed in the background, the 'sys' topic should not wait for the database.
+	go func() {
+		var changed bool
+		// Saves the new limit and reports if it's different from the stored one.
+		update := func() error {
+			stopic, err := store.Topics.Get(name)
+			if err != nil {
+				return err
+			}
+			if stopic == nil {
+				return types.ErrTopicNotFound
+			}
+			if stopic.MaxSubs == req.Max {
+				return nil
+			}
+			changed = true
+			return store.Topics.Update(name, map[string]interface{}{"MaxSubs": req.Max, "UpdatedAt": now})
+		}
+		err := globals.hub.runTopicTask(name,
+			func(t *Topic) error {
+				// The topic is loaded: the new limit takes effect immediately. Existing subscribers
+				// stay even if there are more of them than the new limit.
+				if err := update(); err != nil {
+					return err
+				}
+				t.maxSubs = req.Max
+				return nil
+			},
+			update)
+		if err == errTopicBusy {
+			sess.queueOut(ErrServiceUnavailableReply(msg, types.TimeNow()))
+			return
+		}
+		if err != nil {
+			log.Println("set.maxsubs: failed to change the limit", name, err)
+			sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, msg.Original, types.TimeNow(), msg.Timestamp, nil))
+			return
+		}
+		if !changed {
+			sess.queueOut(InfoNotModifiedReply(msg, types.TimeNow()))
+			return
+		}
+		sess.queueOut(NoErrReply(msg, types.TimeNow()))
+	}()
+
+	return nil
+}
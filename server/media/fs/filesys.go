@@ -132,6 +132,11 @@ func (fh *fshandler) Download(url string) (*types.FileDef, media.ReadSeekCloser,
 	return fd, file, nil
 }
 
+// CanDownload returns true: files are served from the local file system.
+func (fh *fshandler) CanDownload() bool {
+	return true
+}
+
 // Delete deletes files from storage by provided slice of locations.
 func (fh *fshandler) Delete(locations []string) error {
 	for _, loc := range locations {
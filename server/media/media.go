@@ -31,6 +31,9 @@ type Handler interface {
 	// Download processes request for file download.
 	Download(url string) (*types.FileDef, ReadSeekCloser, error)
 
+	// CanDownload reports if Download returns the content of files rather than redirecting to another server.
+	CanDownload() bool
+
 	// Delete deletes file from storage.
 	Delete(locations []string) error
 
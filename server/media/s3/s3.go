@@ -232,6 +232,11 @@ func (ah *awshandler) Download(url string) (*types.FileDef, media.ReadSeekCloser
 	return nil, nil, types.ErrUnsupported
 }
 
+// CanDownload returns false: files are served by S3 through a redirect.
+func (ah *awshandler) CanDownload() bool {
+	return false
+}
+
 // Delete deletes files from aws by provided slice of locations.
 func (ah *awshandler) Delete(locations []string) error {
 	toDelete := make([]s3manager.BatchDeleteObject, len(locations))
@@ -0,0 +1,226 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *    Mentions of users in group topics: targeted push notifications, counts
+ *    of unread mentions and the inbox of unread mentions and replies in
+ *    threads started by the user, {get what="inbox"} on 'me'.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"errors"
+	"log"
+
+	"github.com/tinode/chat/server/drafty"
+	"github.com/tinode/chat/server/push"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+// Maximum number of items returned by {get what="inbox"}.
+const inboxMaxCount = 100
+
+// mentionsSave records mentions of topic members in the message and moves the mentioned users from rcpt
+// to a separate push receipt flagged as a mention. Returns the new receipt or nil if no one in rcpt is mentioned.
+func (t *Topic) mentionsSave(fromUid types.Uid, data *MsgServerData, rcpt *push.Receipt) *push.Receipt {
+	if t.cat != types.TopicCatGrp {
+		return nil
+	}
+
+	var mentioned []types.Uid
+	for _, userId := range drafty.Mentions(data.Content) {
+		uid := types.ParseUserId(userId)
+		if uid.IsZero() || uid == fromUid {
+			continue
+		}
+		if pud, ok := t.perUser[uid]; !ok || pud.deleted || !(pud.modeGiven & pud.modeWant).IsReader() {
+			continue
+		}
+		mentioned = append(mentioned, uid)
+	}
+	t.mentionsSaveReply(fromUid, data, mentioned)
+	if len(mentioned) == 0 {
+		return nil
+	}
+
+	if err := store.Mentions.Create(t.name, data.SeqId, 0, mentioned); err != nil {
+		log.Printf("topic[%s]: failed to save mentions: %v", t.name, err)
+		return nil
+	}
+
+	var mentionRcpt *push.Receipt
+	for _, uid := range mentioned {
+		var recipient push.Recipient
+		var ok bool
+		if rcpt != nil {
+			recipient, ok = rcpt.To[uid]
+		}
+		if !ok {
+			// The user gets no push notification, only the count of mentions is updated.
+			usersUpdateUnread(uid, 0, 1, true)
+			continue
+		}
+		if mentionRcpt == nil {
+			mentionRcpt = &push.Receipt{
+				To:             make(map[types.Uid]push.Recipient, len(mentioned)),
+				OrganizationId: rcpt.OrganizationId,
+				Payload:        rcpt.Payload,
+			}
+			mentionRcpt.Payload.Mention = true
+		}
+		mentionRcpt.To[uid] = recipient
+		delete(rcpt.To, uid)
+	}
+
+	return mentionRcpt
+}
+
+// mentionsClear removes mentions of the user in the topic up to and including seqId, all mentions
+// if seqId is 0. Returns the number of removed mentions.
+func (t *Topic) mentionsClear(uid types.Uid, seqId int) int {
+	if t.cat != types.TopicCatGrp {
+		return 0
+	}
+	count, err := store.Mentions.Delete(t.name, uid, seqId)
+	if err != nil {
+		log.Printf("topic[%s]: failed to clear mentions: %v", t.name, err)
+	}
+	return count
+}
+
+// mentionsSaveReply records the reply in the thread for the user who started the thread, so it shows up in
+// the user's inbox. The reply is not recorded if the user is mentioned in it.
+func (t *Topic) mentionsSaveReply(fromUid types.Uid, data *MsgServerData, mentioned []types.Uid) {
+	thread, _ := msgThreadRoot(data.Head)
+	if thread == 0 {
+		return
+	}
+
+	author := t.threadAuthor(data)
+	if author.IsZero() || author == fromUid {
+		return
+	}
+	for _, uid := range mentioned {
+		if uid == author {
+			return
+		}
+	}
+	if pud, ok := t.perUser[author]; !ok || pud.deleted || !(pud.modeGiven & pud.modeWant).IsReader() {
+		return
+	}
+
+	if err := store.Mentions.Create(t.name, data.SeqId, thread, []types.Uid{author}); err != nil {
+		log.Printf("topic[%s]: failed to save thread reply: %v", t.name, err)
+	}
+}
+
+// threadAuthor returns the ID of the user who started the thread the message replies to. Returns zero UID if
+// the message is not a reply in a thread or the first message of the thread is deleted.
+func (t *Topic) threadAuthor(data *MsgServerData) types.Uid {
+	thread, _ := msgThreadRoot(data.Head)
+	if thread == 0 {
+		return types.ZeroUid
+	}
+
+	opts := &types.QueryOpt{Since: thread, Before: thread + 1, Limit: 1}
+	var messages []types.Message
+	var cached bool
+	if t.recent != nil {
+		messages, cached = t.recent.get(types.ZeroUid, opts)
+	}
+	if !cached {
+		var err error
+		if messages, err = store.Messages.GetAll(t.name, types.ZeroUid, opts); err != nil {
+			log.Printf("topic[%s]: failed to load first message of thread %d: %v", t.name, thread, err)
+			return types.ZeroUid
+		}
+	}
+	if len(messages) == 0 {
+		// The first message of the thread is deleted.
+		return types.ZeroUid
+	}
+	return types.ParseUid(messages[0].From)
+}
+
+// replyGetInbox returns unread mentions of the user and unread replies in threads started by the user across
+// all topics, newest first, 'me' only. Items are removed from the inbox when the user reads the messages.
+func (t *Topic) replyGetInbox(sess *Session, asUid types.Uid, msg *ClientComMessage) error {
+	now := types.TimeNow()
+
+	if t.cat != types.TopicCatMe {
+		sess.queueOut(ErrOperationNotAllowedReply(msg, now))
+		return errors.New("get.inbox: invalid topic category")
+	}
+
+	mentions, err := store.Mentions.GetAll(asUid, inboxMaxCount)
+	if err != nil {
+		sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, msg.Original, now, msg.Timestamp, nil))
+		return err
+	}
+
+	// Cache of read permissions and masking rules in topics of the items.
+	readable := make(map[string]bool)
+	masks := make(map[string]*maskingRule)
+	var inbox []MsgInboxItem
+	for i := range mentions {
+		m := &mentions[i]
+
+		canRead, ok := readable[m.Topic]
+		if !ok {
+			sub, err := store.Subs.Get(m.Topic, asUid)
+			if err != nil {
+				sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, msg.Original, now, msg.Timestamp, nil))
+				return err
+			}
+			canRead = sub != nil && (sub.ModeGiven & sub.ModeWant).IsReader()
+			readable[m.Topic] = canRead
+			if canRead {
+				masks[m.Topic] = maskingRuleOf(msg.OrganizationId, m.Topic, sub.ModeGiven&sub.ModeWant, false)
+			}
+		}
+		if !canRead {
+			continue
+		}
+
+		messages, err := store.Messages.GetAll(m.Topic, asUid,
+			&types.QueryOpt{Since: m.SeqId, Before: m.SeqId + 1, Limit: 1})
+		if err != nil {
+			sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, msg.Original, now, msg.Timestamp, nil))
+			return err
+		}
+		if len(messages) == 0 || messages[0].DeletedAt != nil {
+			// The message is deleted.
+			continue
+		}
+
+		mm := &messages[0]
+		createdAt := mm.CreatedAt
+		what := "mention"
+		if m.Thread > 0 {
+			what = "reply"
+		}
+		inbox = append(inbox, MsgInboxItem{
+			What:      what,
+			Topic:     topicNameForUser(m.Topic, asUid, false),
+			SeqId:     mm.SeqId,
+			From:      types.ParseUid(mm.From).UserId(),
+			Timestamp: &createdAt,
+			Head:      mm.Head,
+			Content:   masks[m.Topic].stored(mm, asUid),
+			Thread:    m.Thread,
+		})
+	}
+
+	if len(inbox) == 0 {
+		sess.queueOut(NoContentParamsReply(msg, now, map[string]interface{}{"what": "inbox"}))
+		return nil
+	}
+
+	sess.queueOut(&ServerComMessage{
+		Meta: &MsgServerMeta{Id: msg.Id, Topic: msg.Original, Timestamp: &now, Inbox: inbox}})
+
+	return nil
+}
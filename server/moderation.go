@@ -0,0 +1,438 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *    Bulk moderation actions: deletion of messages of given users or matching
+ *    a query in a time range, bans of users across topics. Each action runs
+ *    as a background job which reports progress to the administrator and is
+ *    recorded in the audit log.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/tinode/chat/server/auth"
+	"github.com/tinode/chat/server/journal"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+// Moderation actions.
+const (
+	moderateDel = "del"
+	moderateBan = "ban"
+)
+
+const (
+	// Maximum number of topics in one request.
+	moderateMaxTopics = 100
+	// Maximum number of users in one request.
+	moderateMaxUsers = 1000
+	// Number of messages checked in one query.
+	moderatePageSize = 100
+)
+
+// moderateJob is a bulk moderation action in progress.
+type moderateJob struct {
+	// Request which started the job, the progress is reported in response to it.
+	msg  *ClientComMessage
+	sess *Session
+	// Administrator who started the job.
+	admin types.Uid
+	req   *MsgModerate
+	// Users to act on.
+	users map[types.Uid]bool
+
+	// Messages deleted.
+	deleted int
+	// Users banned.
+	banned int
+	// Bans which were not needed or not allowed: users already banned and owners of topics.
+	ignored int
+	// Topics which could not be processed: missing or hosted by other nodes.
+	skipped []string
+}
+
+// replySetModerate validates the moderation request and starts the job, 'sys' topic only, root only.
+func (t *Topic) replySetModerate(sess *Session, asUid types.Uid, authLevel auth.Level, msg *ClientComMessage) error {
+	now := types.TimeNow()
+
+	if t.cat != types.TopicCatSys || authLevel != auth.LevelRoot {
+		sess.queueOut(ErrPermissionDeniedReply(msg, now))
+		return errors.New("set.moderate: root access required")
+	}
+
+	req := msg.Set.Moderate
+	if len(req.Topics) > moderateMaxTopics {
+		sess.queueOut(ErrPolicyLimitReply(msg, now, "topics", moderateMaxTopics))
+		return types.ErrPolicy
+	}
+	if len(req.Users) > moderateMaxUsers {
+		sess.queueOut(ErrPolicyLimitReply(msg, now, "users", moderateMaxUsers))
+		return types.ErrPolicy
+	}
+
+	users := make(map[types.Uid]bool, len(req.Users))
+	for _, user := range req.Users {
+		uid := types.ParseUserId(user)
+		if uid.IsZero() {
+			sess.queueOut(ErrMalformedReply(msg, now))
+			return errors.New("set.moderate: invalid user ID")
+		}
+		users[uid] = true
+	}
+
+	req.Query = strings.TrimSpace(req.Query)
+	valid := len(req.Topics) > 0
+	switch req.Action {
+	case moderateDel:
+		// Deleting all messages of the topics is what {del topic} is for.
+		valid = valid && (len(users) > 0 || req.Query != "")
+		if req.Since != nil && req.Before != nil && !req.Since.Before(*req.Before) {
+			valid = false
+		}
+	case moderateBan:
+		valid = valid && len(users) > 0
+	default:
+		valid = false
+	}
+	if !valid {
+		sess.queueOut(ErrMalformedReply(msg, now))
+		return errors.New("set.moderate: invalid request")
+	}
+
+	job := &moderateJob{
+		msg:   msg,
+		sess:  sess,
+		admin: asUid,
+		req:   req,
+		users: users,
+	}
+	job.audit("started", 0, nil)
+
+	reply := NoErrAccepted(msg.Id, msg.Original, now)
+	reply.Ctrl.Params = job.progress(0)
+	sess.queueOut(reply)
+
+	go job.run()
+
+	return nil
+}
+
+// run processes the topics one by one and reports progress after each topic.
+func (job *moderateJob) run() {
+	for i, name := range job.req.Topics {
+		var err error
+		if job.req.Action == moderateDel {
+			err = job.delMessages(name)
+		} else {
+			err = job.banUsers(name)
+		}
+		if err != nil {
+			job.audit("failed", i, err)
+			var reply *ServerComMessage
+			if err == errTopicBusy {
+				// The topic is busy with another change, the request may be repeated.
+				reply = ErrServiceUnavailableExplicitTs(job.msg.Id, job.msg.Original, types.TimeNow(),
+					job.msg.Timestamp)
+				reply.Ctrl.Params = job.progress(i)
+			} else {
+				reply = decodeStoreErrorExplicitTs(err, job.msg.Id, job.msg.Original,
+					types.TimeNow(), job.msg.Timestamp, job.progress(i))
+			}
+			job.sess.queueOut(reply)
+			return
+		}
+
+		if i+1 < len(job.req.Topics) {
+			reply := NoErrAccepted(job.msg.Id, job.msg.Original, types.TimeNow())
+			reply.Ctrl.Params = job.progress(i + 1)
+			job.sess.queueOut(reply)
+		}
+	}
+
+	job.audit("completed", len(job.req.Topics), nil)
+
+	params := job.progress(len(job.req.Topics))
+	if len(job.skipped) > 0 {
+		params["notfound"] = job.skipped
+	}
+	job.sess.queueOut(NoErrParamsReply(job.msg, types.TimeNow(), params))
+}
+
+// prepare finds the topic and, if asked, unloads it so the loaded copy does not overwrite the changes.
+// Returns nil topic if the topic cannot be processed by this node.
+func (job *moderateJob) prepare(name string, unload bool) (*types.Topic, error) {
+	grp := name
+	if tmp := types.ChnToGrp(name); tmp != "" {
+		grp = tmp
+	}
+	switch topicCat(grp) {
+	case types.TopicCatGrp, types.TopicCatP2P:
+	default:
+		return nil, nil
+	}
+	if globals.cluster.isRemoteTopic(grp) {
+		return nil, nil
+	}
+
+	stopic, err := store.Topics.Get(grp)
+	if err != nil || stopic == nil || !unload {
+		return stopic, err
+	}
+
+	// The topic is reloaded from the database by the next request. Attached sessions, relays included,
+	// are told to subscribe again, so banned readers are dropped.
+	globals.hub.shardFor(grp).unreg <- &topicUnreg{rcptTo: grp, reload: true}
+	return stopic, nil
+}
+
+// delMessages hard-deletes the messages of the topic which satisfy all conditions of the request.
+func (job *moderateJob) delMessages(name string) error {
+	stopic, err := job.prepare(name, false)
+	if err != nil {
+		return err
+	}
+	if stopic == nil {
+		job.skipped = append(job.skipped, name)
+		return nil
+	}
+
+	opt := &types.QueryOpt{Limit: moderatePageSize}
+	for {
+		var msgs []types.Message
+		if job.req.Query != "" {
+			msgs, err = store.Messages.Search(stopic.Id, types.ZeroUid, job.req.Query, opt)
+		} else {
+			msgs, err = store.Messages.GetAll(stopic.Id, types.ZeroUid, opt)
+		}
+		if err != nil {
+			return err
+		}
+
+		// Messages are sorted by SeqId, newest first.
+		var ranges []types.Range
+		older := false
+		for i := range msgs {
+			m := &msgs[i]
+			if job.req.Since != nil && m.CreatedAt.Before(*job.req.Since) {
+				older = true
+				break
+			}
+			if job.req.Before != nil && !m.CreatedAt.Before(*job.req.Before) {
+				continue
+			}
+			if len(job.users) > 0 && !job.users[types.ParseUid(m.From)] {
+				continue
+			}
+			ranges = append(ranges, types.Range{Low: m.SeqId})
+		}
+
+		if len(ranges) > 0 {
+			count := len(ranges)
+			sort.Sort(types.RangeSorter(ranges))
+			ranges = types.RangeSorter(ranges).Normalize()
+			if err = job.deleteList(stopic, ranges); err != nil {
+				return err
+			}
+			job.deleted += count
+		}
+
+		if older || len(msgs) < moderatePageSize {
+			return nil
+		}
+		opt.Before = msgs[len(msgs)-1].SeqId
+	}
+}
+
+// deleteList hard-deletes the messages through the topic if it's loaded, so its cache is updated and the
+// subscribers are notified. Otherwise the messages are deleted in the database while the topic is kept
+// from loading and the subscribers are notified offline.
+func (job *moderateJob) deleteList(stopic *types.Topic, ranges []types.Range) error {
+	org := job.sess.activeOrg()
+	err := globals.hub.runTopicTask(stopic.Id,
+		func(t *Topic) error {
+			dels := make([]MsgDelRange, 0, len(ranges))
+			for _, r := range ranges {
+				dels = append(dels, MsgDelRange{LowId: r.Low, HiId: r.Hi})
+			}
+			return t.replyDelMsg(nil, job.admin, true, &ClientComMessage{
+				Del: &MsgClientDel{
+					Topic:  stopic.Id,
+					What:   "msg",
+					DelSeq: dels,
+					Hard:   true,
+				},
+				Original:       stopic.Id,
+				RcptTo:         stopic.Id,
+				AsUser:         job.admin.UserId(),
+				MetaWhat:       constMsgDelMsg,
+				Timestamp:      types.TimeNow(),
+				OrganizationId: org,
+			})
+		},
+		func() error {
+			// The topic may have changed since it was read: take the next delete ID of the stored topic.
+			current, err := store.Topics.Get(stopic.Id)
+			if err != nil {
+				return err
+			}
+			if current == nil {
+				return types.ErrTopicNotFound
+			}
+			delID := current.DelId + 1
+			if err := store.Messages.DeleteList(stopic.Id, delID, types.ZeroUid, ranges); err != nil {
+				return err
+			}
+
+			if journal.Enabled(org, stopic.Id) {
+				journalWrite(&journal.Entry{
+					What:      journal.ActDel,
+					Org:       org,
+					Topic:     stopic.Id,
+					From:      job.admin.UserId(),
+					Timestamp: types.TimeNow(),
+					DelSeq:    ranges,
+					Hard:      true})
+			}
+
+			subs, err := store.Topics.GetSubs(stopic.Id, nil)
+			if err != nil {
+				return err
+			}
+			presSubsOfflineOffline(stopic.Id, topicCat(stopic.Id), subs, "del",
+				&presParams{delID: delID, delSeq: delrangeDeserialize(ranges), actor: job.admin.UserId()}, "")
+			return nil
+		})
+	return err
+}
+
+// banUsers bans the users in the topic or in the channel. Users who are not subscribed are banned
+// too, so they cannot join later. Owners of the topic cannot be banned.
+func (job *moderateJob) banUsers(name string) error {
+	stopic, err := job.prepare(name, true)
+	if err != nil {
+		return err
+	}
+	if stopic == nil || topicCat(stopic.Id) != types.TopicCatGrp {
+		job.skipped = append(job.skipped, name)
+		return nil
+	}
+
+	owners := ownersFromStored(stopic.Owners)
+	owners = append(owners, types.ParseUid(stopic.Owner))
+
+	// Readers of a channel are subscribed to the channel, not to the topic.
+	isChan := types.ChnToGrp(name) != ""
+	now := types.TimeNow()
+	for uid := range job.users {
+		if moderateIsOwner(owners, uid) {
+			job.ignored++
+			continue
+		}
+
+		sub, err := store.Subs.Get(name, uid)
+		if err != nil {
+			return err
+		}
+		if sub == nil {
+			sub = &types.Subscription{
+				User:      uid.String(),
+				Topic:     name,
+				ModeWant:  types.ModeNone,
+				ModeGiven: types.ModeNone,
+				CreatedAt: now,
+			}
+			if err = store.Subs.Create(sub); err != nil {
+				return err
+			}
+			pluginSubscription(sub, plgActCreate)
+			job.banned++
+			continue
+		}
+		if sub.ModeGiven == types.ModeNone {
+			job.ignored++
+			continue
+		}
+
+		if err = store.Subs.Update(name, uid, map[string]interface{}{"ModeGiven": types.ModeNone}, true); err != nil {
+			return err
+		}
+		sub.ModeGiven = types.ModeNone
+		pluginSubscription(sub, plgActUpd)
+		if isChan {
+			// Stop push notifications from the channel.
+			pushChannelSub(uid, name, false)
+		}
+		job.banned++
+	}
+	return nil
+}
+
+// moderateIsOwner checks if the user is in the list of owners.
+func moderateIsOwner(owners []types.Uid, uid types.Uid) bool {
+	for _, owner := range owners {
+		if owner == uid {
+			return true
+		}
+	}
+	return false
+}
+
+// progress formats the state of the job for reporting to the client.
+func (job *moderateJob) progress(done int) map[string]interface{} {
+	params := map[string]interface{}{
+		"what":    "moderate",
+		"action":  job.req.Action,
+		"total":   len(job.req.Topics),
+		"done":    done,
+		"skipped": len(job.skipped),
+	}
+	if job.req.Action == moderateDel {
+		params["deleted"] = job.deleted
+	} else {
+		params["banned"] = job.banned
+		params["ignored"] = job.ignored
+	}
+	return params
+}
+
+// audit records the state of the job in the server log: who did what, to which topics and users, with what result.
+func (job *moderateJob) audit(state string, done int, err error) {
+	record := map[string]interface{}{
+		"admin":  job.admin.UserId(),
+		"state":  state,
+		"action": job.req.Action,
+		"topics": job.req.Topics,
+	}
+	if len(job.req.Users) > 0 {
+		record["users"] = job.req.Users
+	}
+	if job.req.Query != "" {
+		record["query"] = job.req.Query
+	}
+	if job.req.Since != nil {
+		record["since"] = job.req.Since
+	}
+	if job.req.Before != nil {
+		record["before"] = job.req.Before
+	}
+	if state != "started" {
+		record["result"] = job.progress(done)
+		if len(job.skipped) > 0 {
+			record["skipped"] = job.skipped
+		}
+	}
+	if err != nil {
+		record["error"] = err.Error()
+	}
+	out, _ := json.Marshal(record)
+	log.Println("moderation audit:", string(out))
+}
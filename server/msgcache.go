@@ -0,0 +1,227 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *    In-memory cache of the most recent messages of a topic.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"time"
+
+	"github.com/tinode/chat/server/store/types"
+)
+
+// recentMessages is a ring buffer holding the last few messages of a topic. It's used for serving
+// {get what="data"} requests for the tail of the topic without querying the database.
+// Not thread-safe: must be accessed from the topic's goroutine only.
+type recentMessages struct {
+	// Circular buffer of messages. Hard-deleted messages are nil.
+	buf []*types.Message
+	// Index of the slot to write the next message to.
+	next int
+	// Number of filled slots.
+	count int
+	// SeqId of the newest message in the buffer.
+	last int
+	// Users who soft-deleted messages, mapped to the highest soft-deleted SeqId.
+	// Requests of such users bypass the cache while the affected messages are still in the buffer.
+	softDeleted map[types.Uid]int
+}
+
+// newRecentMessages creates an empty cache which will receive messages starting with lastID+1.
+func newRecentMessages(size, lastID int) *recentMessages {
+	return &recentMessages{
+		buf:         make([]*types.Message, size),
+		last:        lastID,
+		softDeleted: make(map[types.Uid]int),
+	}
+}
+
+// since returns the lowest SeqId such that all messages with SeqId >= since are in the cache
+// (unless hard-deleted).
+func (r *recentMessages) since() int {
+	return r.last - r.count + 1
+}
+
+// slot returns index of the slot holding message with the given SeqId. The SeqId must be in cache range.
+func (r *recentMessages) slot(seq int) int {
+	size := len(r.buf)
+	return ((r.next-1-(r.last-seq))%size + size) % size
+}
+
+// add appends a newly saved message to the cache evicting the oldest one if the cache is full.
+// Messages must be added in order of their SeqIds without gaps.
+func (r *recentMessages) add(msg *types.Message) {
+	if msg.SeqId != r.last+1 {
+		// Out of sequence: the cache cannot be trusted anymore. Start over.
+		r.reset(msg.SeqId - 1)
+	}
+	// Headers of the message are still used by the caller: keep a copy.
+	cached := *msg
+	cached.Head = copyHeaders(msg.Head)
+	r.buf[r.next] = &cached
+	r.next = (r.next + 1) % len(r.buf)
+	if r.count < len(r.buf) {
+		r.count++
+	}
+	r.last = msg.SeqId
+}
+
+// replace updates headers and content of a cached message after it was edited.
+func (r *recentMessages) replace(seq int, head types.MessageHeaders, content interface{}) {
+	if seq < r.since() || seq > r.last {
+		return
+	}
+	if msg := r.buf[r.slot(seq)]; msg != nil {
+		// Cached messages may be shared with readers, replace the whole object.
+		edited := *msg
+		edited.Head = copyHeaders(head)
+		edited.Content = content
+		r.buf[r.slot(seq)] = &edited
+	}
+}
+
+// replied updates the thread summary of a cached message after a reply was added to its thread.
+func (r *recentMessages) replied(root int, at time.Time) {
+	if root < r.since() || root > r.last {
+		return
+	}
+	if msg := r.buf[r.slot(root)]; msg != nil {
+		updated := *msg
+		updated.Replies++
+		updated.LastReplyAt = &at
+		r.buf[r.slot(root)] = &updated
+	}
+}
+
+// reset drops all cached messages.
+func (r *recentMessages) reset(lastID int) {
+	for i := range r.buf {
+		r.buf[i] = nil
+	}
+	r.next = 0
+	r.count = 0
+	r.last = lastID
+	r.softDeleted = make(map[types.Uid]int)
+}
+
+// delete applies deletion of ranges of messages to cache. Hard-deleted messages (forUser is zero) are removed
+// from cache; soft deletion makes the cache unusable for the user until the affected messages are evicted.
+func (r *recentMessages) delete(forUser types.Uid, ranges []types.Range) {
+	since := r.since()
+	for _, rng := range ranges {
+		hi := rng.Hi - 1
+		if rng.Hi == 0 {
+			hi = rng.Low
+		}
+		if hi > r.last {
+			hi = r.last
+		}
+		if hi < since {
+			continue
+		}
+
+		if !forUser.IsZero() {
+			if r.softDeleted[forUser] < hi {
+				r.softDeleted[forUser] = hi
+			}
+			continue
+		}
+
+		low := rng.Low
+		if low < since {
+			low = since
+		}
+		for seq := low; seq <= hi; seq++ {
+			r.buf[r.slot(seq)] = nil
+		}
+	}
+}
+
+// get returns messages matching the query in descending order of SeqIds, the same as store.Messages.GetAll.
+// The second value is false if the query cannot be answered from cache.
+func (r *recentMessages) get(forUser types.Uid, opts *types.QueryOpt) ([]types.Message, bool) {
+	var lower, upper, limit int
+	if opts != nil {
+		if opts.Order != "" || opts.LastCreatedAt != nil || opts.Thread > 0 || opts.MediaType != "" || len(opts.Mime) > 0 {
+			// Custom pagination, thread and media queries are served by the store.
+			return nil, false
+		}
+		lower, upper, limit = opts.Since, opts.Before, opts.Limit
+	}
+
+	since := r.since()
+	if seq, ok := r.softDeleted[forUser]; ok {
+		if seq >= since {
+			return nil, false
+		}
+		// Soft-deleted messages are no longer cached.
+		delete(r.softDeleted, forUser)
+	}
+
+	hi := r.last
+	if upper > 0 && upper-1 < hi {
+		hi = upper - 1
+	}
+	low := since
+	if lower > low {
+		low = lower
+	}
+
+	var messages []types.Message
+	for seq := hi; seq >= low; seq-- {
+		if limit > 0 && len(messages) == limit {
+			break
+		}
+		if msg := r.buf[r.slot(seq)]; msg != nil {
+			found := *msg
+			found.Head = copyHeaders(msg.Head)
+			messages = append(messages, found)
+		}
+	}
+
+	if (limit > 0 && len(messages) == limit) || lower >= since {
+		return messages, true
+	}
+
+	// Older messages may be needed: they are not in cache.
+	return nil, false
+}
+
+// copyHeaders makes a deep copy of message headers so the cached message is not changed
+// when the caller changes the headers of its copy.
+func copyHeaders(head types.MessageHeaders) types.MessageHeaders {
+	if head == nil {
+		return nil
+	}
+	dst := make(types.MessageHeaders, len(head))
+	for key, val := range head {
+		dst[key] = copyHeaderValue(val)
+	}
+	return dst
+}
+
+// copyHeaderValue makes a deep copy of maps and slices in the value of a header.
+func copyHeaderValue(val interface{}) interface{} {
+	switch v := val.(type) {
+	case map[string]interface{}:
+		dst := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			dst[key] = copyHeaderValue(item)
+		}
+		return dst
+	case []interface{}:
+		dst := make([]interface{}, len(v))
+		for i, item := range v {
+			dst[i] = copyHeaderValue(item)
+		}
+		return dst
+	case []string:
+		return append([]string(nil), v...)
+	default:
+		return val
+	}
+}
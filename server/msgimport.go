@@ -0,0 +1,218 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *    Bulk import of historical messages over gRPC, e.g. when migrating from
+ *    another chat system. Messages keep original senders and timestamps.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/tinode/chat/pbx"
+	"github.com/tinode/chat/server/auth"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// Maximum number of messages in one import request.
+const msgImportMaxMessages = 1000
+
+// errImportOutOfOrder means the imported messages are older than the latest message of the topic.
+var errImportOutOfOrder = errors.New("timestamp out of order")
+
+// msgImportTopic converts the name of the topic into the name of the topic in the database.
+func msgImportTopic(name string) (string, error) {
+	if grp := types.ChnToGrp(name); grp != "" {
+		return grp, nil
+	}
+	switch types.GetTopicCat(name) {
+	case types.TopicCatGrp, types.TopicCatP2P:
+		return name, nil
+	}
+	return "", types.ErrMalformed
+}
+
+// msgImportTime converts the timestamp of an imported message in milliseconds into time.
+func msgImportTime(ms int64) time.Time {
+	if ms <= 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, ms*int64(time.Millisecond)).UTC()
+}
+
+// msgImportSenders checks that the senders of the messages exist and may post to the topic.
+func msgImportSenders(stopic *types.Topic, senders map[types.Uid]bool) error {
+	uids := make([]types.Uid, 0, len(senders))
+	for uid := range senders {
+		uids = append(uids, uid)
+	}
+	if types.GetTopicCat(stopic.Id) == types.TopicCatP2P {
+		// Only the two parties of a p2p topic can be the senders.
+		uid1, uid2, _ := types.ParseP2P(stopic.Id)
+		for _, uid := range uids {
+			if uid != uid1 && uid != uid2 {
+				return types.ErrPermissionDenied
+			}
+		}
+	}
+	users, err := store.Users.GetAll(uids...)
+	if err != nil {
+		return err
+	}
+	if len(users) != len(uids) {
+		return types.ErrUserNotFound
+	}
+	return nil
+}
+
+// msgImportSave saves the messages after the message lastID of the topic. The first message cannot be older
+// than the latest message already in the topic, touched. Returns the ID of the last saved message.
+func msgImportSave(topic string, lastID int, touched time.Time, messages []*pbx.ImportMessage) (int, error) {
+	if lastID > 0 && msgImportTime(messages[0].GetTimestamp()).Before(touched) {
+		return lastID, errImportOutOfOrder
+	}
+
+	// Each saved message updates the last ID and the touched time of the stored topic.
+	seq := lastID
+	for _, msg := range messages {
+		stored := &types.Message{
+			ObjHeader: types.ObjHeader{CreatedAt: msgImportTime(msg.GetTimestamp())},
+			SeqId:     seq + 1,
+			Topic:     topic,
+			From:      types.ParseUserId(msg.GetFromUserId()).String(),
+			Head:      byteMapToInterfaceMap(msg.GetHead()),
+			Content:   bytesToInterface(msg.GetContent()),
+		}
+		if err := store.Messages.Save(stored, true); err != nil {
+			return seq, err
+		}
+		seq++
+	}
+	return seq, nil
+}
+
+// ImportMessages saves historical messages to a topic.
+func (*grpcNodeServer) ImportMessages(ctx context.Context, req *pbx.ImportReq) (*pbx.ImportResp, error) {
+	var remoteAddr string
+	if p, ok := peer.FromContext(ctx); ok {
+		remoteAddr = p.Addr.String()
+	}
+
+	rec, err := historyAuthenticate(req.GetScheme(), req.GetSecret(), remoteAddr)
+	if err != nil {
+		log.Println("grpc import: authentication failed", remoteAddr, err)
+		return nil, historyStatus(err)
+	}
+	if rec.AuthLevel != auth.LevelRoot {
+		return nil, historyStatus(types.ErrPermissionDenied)
+	}
+
+	topic, err := msgImportTopic(req.GetTopic())
+	if err != nil {
+		return nil, historyStatus(err)
+	}
+	messages := req.GetMessages()
+	if len(messages) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "no messages")
+	}
+	if len(messages) > msgImportMaxMessages {
+		return nil, status.Error(codes.ResourceExhausted, "too many messages")
+	}
+	if globals.cluster.isRemoteTopic(topic) {
+		// The topic could be loaded at the other node.
+		return nil, status.Error(codes.FailedPrecondition, "topic is hosted by another node")
+	}
+
+	stopic, err := store.Topics.Get(topic)
+	if err != nil {
+		return nil, historyStatus(err)
+	}
+	if stopic == nil {
+		return nil, historyStatus(types.ErrTopicNotFound)
+	}
+
+	// Validate all messages before saving any.
+	// Imported messages cannot be older than the latest message already in the topic.
+	var last time.Time
+	if stopic.SeqId > 0 {
+		last = stopic.TouchedAt
+	}
+	senders := make(map[types.Uid]bool)
+	for _, msg := range messages {
+		from := types.ParseUserId(msg.GetFromUserId())
+		ts := msgImportTime(msg.GetTimestamp())
+		if from.IsZero() || ts.IsZero() || ts.Before(last) {
+			return nil, status.Error(codes.InvalidArgument, "invalid sender or timestamp out of order")
+		}
+		if int64(len(msg.GetContent())) > liveConfig().maxMessageSize {
+			return nil, status.Error(codes.InvalidArgument, "message too large")
+		}
+		senders[from] = true
+		last = ts
+	}
+	if err = msgImportSenders(stopic, senders); err != nil {
+		return nil, historyStatus(err)
+	}
+
+	// Messages are saved through the topic if it's loaded, so it keeps counting from the imported ones.
+	var first, seq int
+	err = globals.hub.runTopicTask(topic,
+		func(t *Topic) error {
+			first = t.lastID + 1
+			var err error
+			seq, err = msgImportSave(topic, t.lastID, t.touched, messages)
+			if seq >= first {
+				t.lastID = seq
+				t.touched = msgImportTime(messages[seq-first].GetTimestamp())
+				if t.recent != nil {
+					// The cache does not have the imported messages.
+					t.recent = newRecentMessages(globals.recentMessageCount, t.lastID)
+				}
+			}
+			return err
+		},
+		func() error {
+			// The topic is kept from loading: it may have changed since it was read.
+			stopic, err := store.Topics.Get(topic)
+			if err != nil {
+				return err
+			}
+			if stopic == nil {
+				return types.ErrTopicNotFound
+			}
+			first = stopic.SeqId + 1
+			seq, err = msgImportSave(topic, stopic.SeqId, stopic.TouchedAt, messages)
+			return err
+		})
+
+	switch err {
+	case nil:
+	case errTopicBusy:
+		return nil, status.Error(codes.Unavailable, "topic is busy")
+	case errImportOutOfOrder:
+		return nil, status.Error(codes.InvalidArgument, "invalid sender or timestamp out of order")
+	}
+
+	if err != nil {
+		log.Println("grpc import: failed to save message", topic, seq+1, err)
+		if seq < first {
+			return nil, historyStatus(err)
+		}
+		// Some messages are saved, the client should retry the rest.
+		return nil, status.Errorf(codes.Aborted, "import interrupted, saved %d messages up to seq %d",
+			seq-first+1, seq)
+	}
+
+	log.Println("grpc import: imported messages", topic, first, seq, rec.Uid.UserId())
+	return &pbx.ImportResp{FirstSeqId: int32(first), LastSeqId: int32(seq)}, nil
+}
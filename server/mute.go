@@ -0,0 +1,168 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *    Temporary mute of topic notifications and daily quiet hours. Unlike
+ *    clearing the P permission, the mute lapses by itself and quiet hours
+ *    silence notifications only at night or whenever the user chooses.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"errors"
+	"time"
+
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+// Maximum duration of a mute. Use the P permission to turn notifications off indefinitely.
+const maxMuteDuration = 365 * 24 * time.Hour
+
+// muteUntilFromStored converts the stored mute time to the in-memory form.
+func muteUntilFromStored(until *time.Time) time.Time {
+	if until == nil {
+		return time.Time{}
+	}
+	return *until
+}
+
+// isMuted checks if the user muted notifications of the topic and the mute has not lapsed yet.
+func (pud *perUserData) isMuted(now time.Time) bool {
+	return pud.muteUntil.After(now)
+}
+
+// quietHoursValid checks the daily schedule of quiet hours: minutes since midnight
+// and the offset of the user's time zone from UTC, minutes.
+func quietHoursValid(start, end, tz int) bool {
+	return start >= 0 && start < minutesPerDay && end >= 0 && end < minutesPerDay &&
+		tz >= -12*60 && tz <= 14*60
+}
+
+// quietHoursUntil returns the end of the quiet hours if the given time falls within them,
+// zero time otherwise. Equal start and end mean there are no quiet hours.
+func quietHoursUntil(start, end, tz int, at time.Time) time.Time {
+	if start == end {
+		return time.Time{}
+	}
+
+	local := at.Add(time.Duration(tz) * time.Minute)
+	mins := local.Hour()*60 + local.Minute()
+	var quiet bool
+	if start < end {
+		quiet = mins >= start && mins < end
+	} else {
+		// Quiet hours span midnight.
+		quiet = mins >= start || mins < end
+	}
+	if !quiet {
+		return time.Time{}
+	}
+
+	wait := (end - mins + minutesPerDay) % minutesPerDay
+	return at.Truncate(time.Minute).Add(time.Duration(wait) * time.Minute)
+}
+
+// isQuiet checks if the given time falls within the user's quiet hours of the topic.
+func (pud *perUserData) isQuiet(at time.Time) bool {
+	if pud.quiet == nil {
+		return false
+	}
+	return !quietHoursUntil(pud.quiet.Start, pud.quiet.End, pud.quiet.TzOffset, at).IsZero()
+}
+
+// replySetMute mutes notifications of the topic for the current user for the given duration
+// or unmutes the topic. If the request has the schedule of quiet hours, only the schedule is changed.
+func (t *Topic) replySetMute(sess *Session, asUid types.Uid, msg *ClientComMessage) error {
+	now := types.TimeNow()
+
+	if t.cat != types.TopicCatP2P && t.cat != types.TopicCatGrp {
+		sess.queueOut(ErrOperationNotAllowedReply(msg, now))
+		return errors.New("set.mute: invalid topic category")
+	}
+	if asChan, _ := t.verifyChannelAccess(msg.Original); asChan {
+		sess.queueOut(ErrOperationNotAllowedReply(msg, now))
+		return errors.New("set.mute: channel readers cannot mute")
+	}
+
+	pud, ok := t.perUser[asUid]
+	if !ok || pud.deleted {
+		sess.queueOut(ErrPermissionDeniedReply(msg, now))
+		return errors.New("set.mute: not a subscriber")
+	}
+
+	if msg.Set.Mute.Quiet != nil {
+		return t.replySetQuiet(sess, asUid, pud, msg, now)
+	}
+
+	dur := time.Duration(msg.Set.Mute.For) * time.Second
+	if dur < 0 || dur > maxMuteDuration {
+		sess.queueOut(ErrMalformedReply(msg, now))
+		return errors.New("set.mute: invalid duration")
+	}
+
+	var until time.Time
+	var update map[string]interface{}
+	if dur > 0 {
+		until = now.Add(dur)
+		update = map[string]interface{}{"MuteUntil": &until}
+	} else {
+		update = map[string]interface{}{"MuteUntil": nil}
+	}
+	if err := store.Subs.Update(t.name, asUid, update, false); err != nil {
+		sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, msg.Original, now, msg.Timestamp, nil))
+		return err
+	}
+
+	pud.muteUntil = until
+	t.perUser[asUid] = pud
+
+	// Let user's other sessions know the mute has changed.
+	t.presSubsOnline("mute", "", nilPresParams, &presFilters{singleUser: asUid.UserId()}, sess.sid)
+
+	if until.IsZero() {
+		sess.queueOut(NoErrReply(msg, now))
+	} else {
+		sess.queueOut(NoErrParamsReply(msg, now, map[string]interface{}{"what": "mute", "until": until}))
+	}
+
+	return nil
+}
+
+// replySetQuiet sets or clears the daily quiet hours of the topic for the current user.
+func (t *Topic) replySetQuiet(sess *Session, asUid types.Uid, pud *perUserData, msg *ClientComMessage, now time.Time) error {
+	req := msg.Set.Mute.Quiet
+	if !quietHoursValid(req.Start, req.End, req.Tz) {
+		sess.queueOut(ErrMalformedReply(msg, now))
+		return errors.New("set.mute: invalid quiet hours")
+	}
+
+	var quiet *types.QuietHours
+	var update map[string]interface{}
+	if req.Start != req.End {
+		quiet = &types.QuietHours{Start: req.Start, End: req.End, TzOffset: req.Tz}
+		update = map[string]interface{}{"Quiet": quiet}
+	} else {
+		update = map[string]interface{}{"Quiet": nil}
+	}
+	if err := store.Subs.Update(t.name, asUid, update, false); err != nil {
+		sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, msg.Original, now, msg.Timestamp, nil))
+		return err
+	}
+
+	pud.quiet = quiet
+	t.perUser[asUid] = pud
+
+	// Let user's other sessions know the quiet hours have changed.
+	t.presSubsOnline("mute", "", nilPresParams, &presFilters{singleUser: asUid.UserId()}, sess.sid)
+
+	if quiet == nil {
+		sess.queueOut(NoErrReply(msg, now))
+	} else {
+		sess.queueOut(NoErrParamsReply(msg, now, map[string]interface{}{"what": "mute", "quiet": req}))
+	}
+
+	return nil
+}
@@ -0,0 +1,100 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *    Level of push notifications of a subscription: every message, only
+ *    mentions and replies to the user, or nothing. Unlike the P permission,
+ *    the level does not change presence notifications.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"errors"
+
+	"github.com/tinode/chat/server/drafty"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+// Levels of push notifications. Empty level means the P permission decides.
+const (
+	notifyAllMessages = "all"
+	notifyMentions    = "mentions"
+	notifyNone        = "none"
+)
+
+// notifyAll checks if the subscriber with the given access mode and level of notifications
+// is notified of every message.
+func notifyAll(mode types.AccessMode, level string) bool {
+	switch level {
+	case notifyAllMessages:
+		return true
+	case notifyMentions, notifyNone:
+		return false
+	default:
+		return mode.IsPresencer()
+	}
+}
+
+// notifyTargets finds the users the message is directed at: mentioned in the message or
+// the user who started the thread the message replies to.
+func (t *Topic) notifyTargets(fromUid types.Uid, data *MsgServerData) map[types.Uid]bool {
+	targets := make(map[types.Uid]bool)
+	for _, userId := range drafty.Mentions(data.Content) {
+		if uid := types.ParseUserId(userId); !uid.IsZero() && uid != fromUid {
+			targets[uid] = true
+		}
+	}
+	if author := t.threadAuthor(data); !author.IsZero() && author != fromUid {
+		targets[author] = true
+	}
+	return targets
+}
+
+// replySetNotify sets the level of push notifications of the topic for the current user.
+func (t *Topic) replySetNotify(sess *Session, asUid types.Uid, msg *ClientComMessage) error {
+	now := types.TimeNow()
+
+	if t.cat != types.TopicCatP2P && t.cat != types.TopicCatGrp {
+		sess.queueOut(ErrOperationNotAllowedReply(msg, now))
+		return errors.New("set.notify: invalid topic category")
+	}
+	if asChan, _ := t.verifyChannelAccess(msg.Original); asChan {
+		sess.queueOut(ErrOperationNotAllowedReply(msg, now))
+		return errors.New("set.notify: channel readers cannot change notifications")
+	}
+
+	pud, ok := t.perUser[asUid]
+	if !ok || pud.deleted {
+		sess.queueOut(ErrPermissionDeniedReply(msg, now))
+		return errors.New("set.notify: not a subscriber")
+	}
+
+	level := *msg.Set.Notify
+	switch level {
+	case "", notifyAllMessages, notifyMentions, notifyNone:
+	default:
+		sess.queueOut(ErrMalformedReply(msg, now))
+		return errors.New("set.notify: invalid level")
+	}
+	if level == pud.notify {
+		sess.queueOut(InfoNotModifiedReply(msg, now))
+		return nil
+	}
+
+	if err := store.Subs.Update(t.name, asUid, map[string]interface{}{"Notify": level}, false); err != nil {
+		sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, msg.Original, now, msg.Timestamp, nil))
+		return err
+	}
+
+	pud.notify = level
+	t.perUser[asUid] = pud
+
+	// Let user's other sessions know the notifications have changed.
+	t.presSubsOnline("mute", "", nilPresParams, &presFilters{singleUser: asUid.UserId()}, sess.sid)
+
+	sess.queueOut(NoErrReply(msg, now))
+	return nil
+}
@@ -0,0 +1,286 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *    Co-owners of group topics: users who share the rights of the owner, so
+ *    the topic is not lost or unmanageable when the owner's account is.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"errors"
+	"log"
+
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+// Maximum number of co-owners of a topic.
+const maxCoOwners = 16
+
+// isOwner checks if the user is the owner or a co-owner of the topic.
+func (t *Topic) isOwner(uid types.Uid) bool {
+	if uid.IsZero() {
+		return false
+	}
+	if t.owner == uid {
+		return true
+	}
+	for _, owner := range t.owners {
+		if owner == uid {
+			return true
+		}
+	}
+	return false
+}
+
+// ownersFromStored converts the list of co-owners as stored in the database to Uids.
+func ownersFromStored(stored []string) []types.Uid {
+	var owners []types.Uid
+	for _, id := range stored {
+		if uid := types.ParseUserId(id); !uid.IsZero() {
+			owners = append(owners, uid)
+		}
+	}
+	return owners
+}
+
+// ownersToStored converts the list of co-owners to the database format.
+func ownersToStored(owners []types.Uid) types.StringSlice {
+	if len(owners) == 0 {
+		return nil
+	}
+	stored := make(types.StringSlice, len(owners))
+	for i, uid := range owners {
+		stored[i] = uid.UserId()
+	}
+	return stored
+}
+
+// isStoredCoOwner checks if the user is a co-owner of a topic which is not loaded.
+func isStoredCoOwner(topic string, uid types.Uid) bool {
+	if types.GetTopicCat(topic) != types.TopicCatGrp {
+		return false
+	}
+	stopic, err := store.Topics.Get(topic)
+	if err != nil {
+		log.Println("owners: failed to load topic", topic, err)
+		return false
+	}
+	if stopic == nil {
+		return false
+	}
+	for _, id := range stopic.Owners {
+		if types.ParseUserId(id) == uid {
+			return true
+		}
+	}
+	return false
+}
+
+// ownersDrop removes the user from co-owners of the topic, e.g. when the user leaves the topic.
+func (t *Topic) ownersDrop(uid types.Uid) {
+	owners := make([]types.Uid, 0, len(t.owners))
+	for _, owner := range t.owners {
+		if owner != uid {
+			owners = append(owners, owner)
+		}
+	}
+	if len(owners) == len(t.owners) {
+		return
+	}
+
+	if err := store.Topics.Update(t.name, map[string]interface{}{
+		"Owners": ownersToStored(owners), "UpdatedAt": types.TimeNow()}); err != nil {
+		log.Printf("topic[%s]: failed to remove co-owner %s: %v", t.name, uid.UserId(), err)
+		return
+	}
+	t.owners = owners
+}
+
+// replyGetOwners returns the list of co-owners of a group topic to its members.
+func (t *Topic) replyGetOwners(sess *Session, asUid types.Uid, msg *ClientComMessage) error {
+	now := types.TimeNow()
+
+	if t.cat != types.TopicCatGrp {
+		sess.queueOut(ErrOperationNotAllowedReply(msg, now))
+		return errors.New("get.owners: invalid topic category")
+	}
+	if _, ok := t.perUser[asUid]; !ok {
+		sess.queueOut(ErrPermissionDeniedReply(msg, now))
+		return errors.New("get.owners: request by non-member")
+	}
+
+	if len(t.owners) == 0 {
+		sess.queueOut(NoContentParamsReply(msg, now, map[string]string{"what": "owners"}))
+		return nil
+	}
+
+	sess.queueOut(&ServerComMessage{
+		Meta: &MsgServerMeta{Id: msg.Id, Topic: t.original(asUid), Timestamp: &now,
+			Owners: ownersToStored(t.owners)}})
+
+	return nil
+}
+
+// replySetOwners replaces the list of co-owners of a group topic. Any of the owners can change it.
+// Co-owners must be subscribed to the topic.
+func (t *Topic) replySetOwners(sess *Session, asUid types.Uid, msg *ClientComMessage) error {
+	now := types.TimeNow()
+
+	if t.cat != types.TopicCatGrp {
+		sess.queueOut(ErrOperationNotAllowedReply(msg, now))
+		return errors.New("set.owners: invalid topic category")
+	}
+	if !t.isOwner(asUid) {
+		sess.queueOut(ErrPermissionDeniedReply(msg, now))
+		return errors.New("set.owners: request by non-owner")
+	}
+
+	req := msg.Set.Owners.Users
+	if len(req) > maxCoOwners {
+		sess.queueOut(ErrPolicyLimitReply(msg, now, "owners", maxCoOwners))
+		return errors.New("set.owners: too many co-owners")
+	}
+
+	var owners []types.Uid
+	seen := make(map[types.Uid]bool, len(req))
+	for _, id := range req {
+		uid := types.ParseUserId(id)
+		if uid.IsZero() || uid == t.owner {
+			sess.queueOut(ErrMalformedReply(msg, now))
+			return errors.New("set.owners: invalid co-owner")
+		}
+		if seen[uid] {
+			continue
+		}
+		seen[uid] = true
+
+		if pud, ok := t.perUser[uid]; !ok || pud.deleted || !(pud.modeGiven & pud.modeWant).IsJoiner() {
+			sess.queueOut(ErrPermissionDeniedReply(msg, now))
+			return errors.New("set.owners: co-owner is not a member")
+		}
+		owners = append(owners, uid)
+	}
+
+	if err := store.Topics.Update(t.name, map[string]interface{}{
+		"Owners": ownersToStored(owners), "UpdatedAt": now}); err != nil {
+		sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, t.original(asUid), now, msg.Timestamp, nil))
+		return err
+	}
+
+	t.owners = owners
+	t.updated = now
+	t.recordEvent("owners", asUid, types.ZeroUid, map[string]interface{}{"users": ownersToStored(owners)})
+
+	sess.queueOut(NoErrReply(msg, now))
+
+	return nil
+}
+
+// ownersSucceed passes ownership of the group topics owned by the user to their first co-owner.
+// Called before the user is deleted so the topics are not deleted with the user.
+// Returns names of the topics which got a new owner.
+func ownersSucceed(uid types.Uid) []string {
+	topics, err := store.Users.GetOwnTopics(uid)
+	if err != nil {
+		log.Println("owners: failed to get topics of", uid.UserId(), err)
+		return nil
+	}
+
+	var passed []string
+	for _, name := range topics {
+		stopic, err := store.Topics.Get(name)
+		if err != nil || stopic == nil || len(stopic.Owners) == 0 {
+			continue
+		}
+
+		owners := ownersFromStored(stopic.Owners)
+		for i, heir := range owners {
+			sub, err := store.Subs.Get(name, heir)
+			if err != nil || sub == nil || !(sub.ModeGiven & sub.ModeWant).IsJoiner() {
+				continue
+			}
+
+			// Moves the O permission from the user to the heir.
+			if err := store.Topics.OwnerChange(name, heir); err != nil {
+				log.Println("owners: failed to pass ownership", name, heir.UserId(), err)
+				break
+			}
+			rest := append(append([]types.Uid{}, owners[:i]...), owners[i+1:]...)
+			if err := store.Topics.Update(name, map[string]interface{}{
+				"Owners": ownersToStored(rest)}); err != nil {
+				log.Println("owners: failed to update co-owners", name, err)
+			}
+			passed = append(passed, name)
+			break
+		}
+	}
+	return passed
+}
+
+// ownersTransfer makes a member of the group topic its owner at once. The old owner keeps all other
+// permissions. The new owner is notified on 'me' if online and by a push notification.
+func (t *Topic) ownersTransfer(sess *Session, asUid, target types.Uid, modeGiven types.AccessMode,
+	msg *ClientComMessage) (*MsgAccessMode, error) {
+
+	now := types.TimeNow()
+
+	newOwner, ok := t.perUser[target]
+	if t.cat != types.TopicCatGrp || !ok || newOwner.deleted || !(newOwner.modeGiven & newOwner.modeWant).IsJoiner() {
+		sess.queueOut(ErrPermissionDeniedReply(msg, now))
+		return nil, errors.New("ownership can be transferred to a member of a group topic only")
+	}
+	if !modeGiven.IsJoiner() {
+		sess.queueOut(ErrMalformedReply(msg, now))
+		return nil, errors.New("new owner cannot be banned")
+	}
+
+	oldOwner := t.perUser[asUid]
+	oldWant, oldGiven := newOwner.modeWant, newOwner.modeGiven
+	newWant, newGiven := oldWant|types.ModeOwner, modeGiven|types.ModeOwner
+
+	// The new access mode of the member is saved first, the ownership is moved in one operation.
+	if update := modeGiven &^ types.ModeOwner; update != oldGiven {
+		if err := store.Subs.Update(t.name, target, map[string]interface{}{"ModeGiven": update}, false); err != nil {
+			sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, msg.Original, now, msg.Timestamp, nil))
+			return nil, err
+		}
+	}
+	if err := store.Topics.OwnerChange(t.name, target); err != nil {
+		sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, msg.Original, now, msg.Timestamp, nil))
+		return nil, err
+	}
+
+	ownerOldWant, ownerOldGiven := oldOwner.modeWant, oldOwner.modeGiven
+	oldOwner.modeWant &^= types.ModeOwner
+	oldOwner.modeGiven &^= types.ModeOwner
+	newOwner.modeWant, newOwner.modeGiven = newWant, newGiven
+
+	if oldReader, newReader := (oldWant & oldGiven).IsReader(), (newWant & newGiven).IsReader(); oldReader && !newReader {
+		usersUpdateUnread(target, newOwner.readID-t.lastID, 0, true)
+	} else if !oldReader && newReader {
+		usersUpdateUnread(target, t.lastID-newOwner.readID, 0, true)
+	}
+
+	// Sessions of the old owner, including this one, learn of the lost O permission.
+	t.notifySubChange(asUid, asUid, false, ownerOldWant, ownerOldGiven, oldOwner.modeWant, oldOwner.modeGiven, "")
+	t.notifySubChange(target, asUid, false, oldWant, oldGiven, newWant, newGiven, sess.sid)
+	// The new owner may be offline.
+	if pushRcpt := t.pushForSub(asUid, target, newWant, newGiven, now, msg.OrganizationId); pushRcpt != nil {
+		usersPush(pushRcpt)
+	}
+
+	t.recordEvent("owner", asUid, target, nil)
+	t.owner = target
+	// The new owner is no longer a co-owner.
+	t.ownersDrop(target)
+
+	return &MsgAccessMode{
+		Given: newGiven.String(),
+		Want:  newWant.String(),
+		Mode:  (newGiven & newWant).String(),
+	}, nil
+}
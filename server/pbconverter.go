@@ -5,6 +5,7 @@ package main
 import (
 	"encoding/json"
 	"log"
+	"sync"
 	"time"
 
 	"github.com/tinode/chat/pbx"
@@ -24,18 +25,55 @@ func pbServCtrlSerialize(ctrl *MsgServerCtrl) *pbx.ServerMsg_Ctrl {
 		Topic:  ctrl.Topic,
 		Code:   int32(ctrl.Code),
 		Text:   ctrl.Text,
-		Params: params}}
+		Params: params,
+		Hint:   ctrl.Hint}}
+}
+
+// pbDataCache keeps a {data} message converted for gRPC. Copies of the message sent to different
+// sessions share the cache and differ only in the topic name and the sender, which are part of the key.
+// Sessions serialize messages concurrently.
+type pbDataCache struct {
+	lock sync.Mutex
+	data map[string]*pbx.ServerData
+}
+
+func newPbDataCache() *pbDataCache {
+	return &pbDataCache{data: make(map[string]*pbx.ServerData)}
 }
 
 func pbServDataSerialize(data *MsgServerData) *pbx.ServerMsg_Data {
-	return &pbx.ServerMsg_Data{Data: &pbx.ServerData{
+	if data.pbCache == nil {
+		return &pbx.ServerMsg_Data{Data: pbServData(data)}
+	}
+
+	key := data.Topic + ":" + data.From
+	data.pbCache.lock.Lock()
+	defer data.pbCache.lock.Unlock()
+	out, ok := data.pbCache.data[key]
+	if !ok {
+		out = pbServData(data)
+		data.pbCache.data[key] = out
+	}
+	return &pbx.ServerMsg_Data{Data: out}
+}
+
+func pbServData(data *MsgServerData) *pbx.ServerData {
+	return &pbx.ServerData{
 		Topic:      data.Topic,
 		FromUserId: data.From,
 		Timestamp:  timeToInt64(&data.Timestamp),
 		DeletedAt:  timeToInt64(data.DeletedAt),
 		SeqId:      int32(data.SeqId),
 		Head:       interfaceMapToByteMap(data.Head),
-		Content:    interfaceToBytes(data.Content)}}
+		Content:    pbDataContent(data)}
+}
+
+// pbDataContent returns message content serialized for gRPC, reusing the bytes received over gRPC if available.
+func pbDataContent(data *MsgServerData) []byte {
+	if data.pbContent != nil {
+		return data.pbContent
+	}
+	return interfaceToBytes(data.Content)
 }
 
 func pbServPresSerialize(pres *MsgServerPres) *pbx.ServerMsg_Pres {
@@ -65,8 +103,11 @@ func pbServPresSerialize(pres *MsgServerPres) *pbx.ServerMsg_Pres {
 		what = pbx.ServerPres_DEL
 	case "tags":
 		what = pbx.ServerPres_TAGS
+	case "delivered":
+		what = pbx.ServerPres_DELIVERED
 	default:
-		log.Fatal("Unknown pres.what value", pres.What)
+		// Notifications not defined in the gRPC protocol are not sent to gRPC clients.
+		return nil
 	}
 	return &pbx.ServerMsg_Pres{Pres: &pbx.ServerPres{
 		Topic:        pres.Topic,
@@ -112,7 +153,9 @@ func pbServSerialize(msg *ServerComMessage) *pbx.ServerMsg {
 	case msg.Data != nil:
 		pkt.Message = pbServDataSerialize(msg.Data)
 	case msg.Pres != nil:
-		pkt.Message = pbServPresSerialize(msg.Pres)
+		if pres := pbServPresSerialize(msg.Pres); pres != nil {
+			pkt.Message = pres
+		}
 	case msg.Info != nil:
 		pkt.Message = pbServInfoSerialize(msg.Info)
 	case msg.Meta != nil:
@@ -133,6 +176,7 @@ func pbServDeserialize(pkt *pbx.ServerMsg) *ServerComMessage {
 			Code:   int(ctrl.GetCode()),
 			Text:   ctrl.GetText(),
 			Params: byteMapToInterfaceMap(ctrl.GetParams()),
+			Hint:   ctrl.GetHint(),
 		}
 	} else if data := pkt.GetData(); data != nil {
 		tsptr := int64ToTime(data.GetTimestamp())
@@ -175,6 +219,8 @@ func pbServDeserialize(pkt *pbx.ServerMsg) *ServerComMessage {
 			what = "del"
 		case pbx.ServerPres_TAGS:
 			what = "tags"
+		case pbx.ServerPres_DELIVERED:
+			what = "delivered"
 		}
 		msg.Pres = &MsgServerPres{
 			Topic:     pres.GetTopic(),
@@ -254,12 +300,16 @@ func pbCliSerialize(msg *ClientComMessage) *pbx.ClientMsg {
 			Topic: msg.Leave.Topic,
 			Unsub: msg.Leave.Unsub}}
 	case msg.Pub != nil:
+		content := msg.Pub.pbContent
+		if content == nil {
+			content = interfaceToBytes(msg.Pub.Content)
+		}
 		pkt.Message = &pbx.ClientMsg_Pub{Pub: &pbx.ClientPub{
 			Id:      msg.Pub.Id,
 			Topic:   msg.Pub.Topic,
 			NoEcho:  msg.Pub.NoEcho,
 			Head:    interfaceMapToByteMap(msg.Pub.Head),
-			Content: interfaceToBytes(msg.Pub.Content)}}
+			Content: content}}
 	case msg.Get != nil:
 		pkt.Message = &pbx.ClientMsg_Get{Get: &pbx.ClientGet{
 			Id:    msg.Get.Id,
@@ -363,6 +413,10 @@ func pbCliDeserialize(pkt *pbx.ClientMsg) *ClientComMessage {
 			Head:    byteMapToInterfaceMap(pub.GetHead()),
 			Content: bytesToInterface(pub.GetContent()),
 		}
+		if msg.Pub.Content != nil {
+			// Keep the original bytes for sending the content to gRPC recipients.
+			msg.Pub.pbContent = pub.GetContent()
+		}
 	} else if get := pkt.GetGet(); get != nil {
 		msg.Get = &MsgClientGet{
 			Id:          get.GetId(),
@@ -408,6 +462,8 @@ func pbCliDeserialize(pkt *pbx.ClientMsg) *ClientComMessage {
 			msg.Note.What = "recv"
 		case pbx.InfoNote_KP:
 			msg.Note.What = "kp"
+		case pbx.InfoNote_DLV:
+			msg.Note.What = "dlv"
 		}
 	}
 
@@ -648,6 +704,8 @@ func pbInfoNoteWhatSerialize(what string) pbx.InfoNote {
 		out = pbx.InfoNote_READ
 	case "recv":
 		out = pbx.InfoNote_RECV
+	case "dlv":
+		out = pbx.InfoNote_DLV
 	default:
 		log.Fatal("unknown info-note.what", what)
 	}
@@ -663,6 +721,8 @@ func pbInfoNoteWhatDeserialize(what pbx.InfoNote) string {
 		out = "read"
 	case pbx.InfoNote_RECV:
 		out = "recv"
+	case pbx.InfoNote_DLV:
+		out = "dlv"
 	default:
 		log.Fatal("unknown info-note.what", what)
 	}
@@ -0,0 +1,232 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *    Signed permalinks to messages and the HTTP handler which resolves them.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+// Length of the truncated HMAC signature of a permalink, bytes.
+const permalinkSigLength = 16
+
+// permalinkResponse is the body of a successful response to the permalink resolution request.
+type permalinkResponse struct {
+	// Topic name as seen by the requester.
+	Topic string `json:"topic"`
+	// Public data of the topic or of the other user of a P2P topic.
+	Public interface{} `json:"public,omitempty"`
+	// Message the permalink points to.
+	Data *MsgServerData `json:"data"`
+}
+
+// permalinkSign computes the signature of the permalink payload.
+func permalinkSign(payload string) []byte {
+	mac := hmac.New(sha256.New, globals.permalinkKey)
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)[:permalinkSigLength]
+}
+
+// permalinkMake creates a permalink to the message. The topic is the name of the topic as stored
+// in the database. Returns an empty string if permalinks are disabled.
+func permalinkMake(topic string, seq int) string {
+	if len(globals.permalinkKey) == 0 {
+		return ""
+	}
+	payload := topic + "/" + strconv.Itoa(seq)
+	return base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." +
+		base64.RawURLEncoding.EncodeToString(permalinkSign(payload))
+}
+
+// permalinkParse verifies the signature of the permalink and extracts the topic name and message ID.
+func permalinkParse(link string) (string, int, error) {
+	parts := strings.Split(link, ".")
+	if len(parts) != 2 {
+		return "", 0, types.ErrMalformed
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", 0, types.ErrMalformed
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || !hmac.Equal(sig, permalinkSign(string(payload))) {
+		return "", 0, types.ErrMalformed
+	}
+
+	i := strings.LastIndexByte(string(payload), '/')
+	if i <= 0 {
+		return "", 0, types.ErrMalformed
+	}
+	seq, err := strconv.Atoi(string(payload[i+1:]))
+	if err != nil || seq <= 0 {
+		return "", 0, types.ErrMalformed
+	}
+	return string(payload[:i]), seq, nil
+}
+
+// replyGetLink creates a permalink to a message in the topic.
+func (t *Topic) replyGetLink(sess *Session, asUid types.Uid, req *MsgGetLink, msg *ClientComMessage) error {
+	now := types.TimeNow()
+
+	if t.cat != types.TopicCatGrp && t.cat != types.TopicCatP2P {
+		sess.queueOut(ErrOperationNotAllowedReply(msg, now))
+		return errors.New("get.link: invalid topic category")
+	}
+	if len(globals.permalinkKey) == 0 {
+		sess.queueOut(ErrOperationNotAllowedReply(msg, now))
+		return errors.New("get.link: permalinks are disabled")
+	}
+	if req == nil || req.Seq <= 0 || req.Seq > t.lastID {
+		sess.queueOut(ErrMalformedReply(msg, now))
+		return errors.New("get.link: invalid message ID")
+	}
+
+	asChan, err := t.verifyChannelAccess(msg.Original)
+	if err != nil {
+		// User should not be able to address non-channel topic as channel.
+		sess.queueOut(ErrNotFoundReply(msg, now))
+		return types.ErrNotFound
+	}
+	if userData, ok := t.perUser[asUid]; !asChan && (!ok || !(userData.modeGiven & userData.modeWant).IsReader()) {
+		sess.queueOut(ErrPermissionDeniedReply(msg, now))
+		return errors.New("get.link: request by non-reader")
+	}
+
+	sess.queueOut(NoErrParamsReply(msg, now, map[string]interface{}{
+		"what": "link", "seq": req.Seq, "link": permalinkMake(t.name, req.Seq)}))
+
+	return nil
+}
+
+// permalinkAccess finds the subscription of the user which permits reading the topic.
+// Returns the name of the topic as seen by the user and true if the user is a channel reader.
+func permalinkAccess(topic string, uid types.Uid) (string, bool, error) {
+	names := []string{topic}
+	if types.GetTopicCat(topic) == types.TopicCatGrp {
+		names = append(names, types.GrpToChn(topic))
+	}
+
+	for _, name := range names {
+		sub, err := store.Subs.Get(name, uid)
+		if err != nil {
+			return "", false, err
+		}
+		if sub == nil || !(sub.ModeWant & sub.ModeGiven).IsReader() {
+			continue
+		}
+
+		if types.GetTopicCat(topic) == types.TopicCatP2P {
+			uid1, uid2, _ := types.ParseP2P(topic)
+			if uid1 == uid {
+				return uid2.UserId(), false, nil
+			}
+			return uid1.UserId(), false, nil
+		}
+		return name, name != topic, nil
+	}
+	return "", false, types.ErrNotFound
+}
+
+// permalinkServe resolves a permalink into the message for a user who has access to it.
+func permalinkServe(wrt http.ResponseWriter, req *http.Request) {
+	now := types.TimeNow()
+	enc := json.NewEncoder(wrt)
+
+	writeHttpResponse := func(msg *ServerComMessage, err error) {
+		// Gorilla CompressHandler requires Content-Type to be set.
+		wrt.Header().Set("Content-Type", "application/json; charset=utf-8")
+		wrt.WriteHeader(msg.Ctrl.Code)
+		enc.Encode(msg)
+		if err != nil {
+			log.Println("permalink:", err)
+		}
+	}
+
+	if req.Method != http.MethodGet {
+		writeHttpResponse(ErrOperationNotAllowed("", "", now), errors.New("method '"+req.Method+"' not allowed"))
+		return
+	}
+
+	// Check for API key presence
+	if isValid, _ := checkAPIKey(getAPIKey(req)); !isValid {
+		writeHttpResponse(ErrAPIKeyRequired(now), nil)
+		return
+	}
+
+	// Check authorization: either auth information or SID must be present
+	uid, org, challenge, err := authHttpRequestOrg(req)
+	if err != nil {
+		writeHttpResponse(decodeStoreError(err, "", "", now, nil), err)
+		return
+	}
+	if challenge != nil {
+		writeHttpResponse(InfoChallenge("", now, challenge), nil)
+		return
+	}
+	if uid.IsZero() {
+		// Not authenticated
+		writeHttpResponse(ErrAuthRequired("", "", now, now), nil)
+		return
+	}
+
+	// The permalink is the last component of the URL path.
+	path := req.URL.Path
+	topic, seq, err := permalinkParse(path[strings.LastIndexByte(path, '/')+1:])
+	if err != nil {
+		writeHttpResponse(ErrMalformed("", "", now), nil)
+		return
+	}
+
+	// Users without access get the same response as for a missing message.
+	original, asChan, err := permalinkAccess(topic, uid)
+	if err != nil {
+		writeHttpResponse(decodeStoreError(err, "", "", now, nil), err)
+		return
+	}
+
+	mask, err := maskingRuleStored(org, topic, uid, asChan)
+	if err != nil {
+		writeHttpResponse(decodeStoreError(err, "", "", now, nil), err)
+		return
+	}
+
+	messages, err := store.Messages.GetAll(topic, uid, &types.QueryOpt{Since: seq, Before: seq + 1, Limit: 1})
+	if err != nil {
+		writeHttpResponse(decodeStoreError(err, "", "", now, nil), err)
+		return
+	}
+	if len(messages) == 0 {
+		writeHttpResponse(ErrNotFound("", "", now, now), nil)
+		return
+	}
+
+	resp := &permalinkResponse{Topic: original}
+	resp.Data = storedDataMessage(&messages[0], original, asChan, mask, uid).Data
+
+	if types.GetTopicCat(topic) == types.TopicCatP2P {
+		if user, err := store.Users.Get(types.ParseUserId(original)); err == nil && user != nil {
+			resp.Public = user.Public
+		}
+	} else if stopic, err := store.Topics.Get(topic); err == nil && stopic != nil {
+		resp.Public = stopic.Public
+	}
+
+	wrt.Header().Set("Content-Type", "application/json; charset=utf-8")
+	enc.Encode(resp)
+}
@@ -327,12 +327,13 @@ func pluginGenerateClientReq(sess *Session, msg *ClientComMessage) *pbx.ClientRe
 	if cmsg == nil {
 		return nil
 	}
+	uid, authLvl, _ := sess.activeAccount()
 	return &pbx.ClientReq{
 		Msg: cmsg,
 		Sess: &pbx.Session{
 			SessionId:  sess.sid,
-			UserId:     sess.uid.UserId(),
-			AuthLevel:  pbx.AuthLevel(sess.authLvl),
+			UserId:     uid.UserId(),
+			AuthLevel:  pbx.AuthLevel(authLvl),
 			UserAgent:  sess.userAgent,
 			RemoteAddr: sess.remoteAddr,
 			DeviceId:   sess.deviceID,
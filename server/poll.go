@@ -0,0 +1,194 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *    Polls in group topics: a message with a poll in the head creates the
+ *    poll, members vote with {note what="vote"} and everyone attached to
+ *    the topic gets the updated tally.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"sort"
+	"unicode/utf8"
+
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+const (
+	// Message head field which defines the poll.
+	pollHeader = "poll"
+
+	// Minimum and maximum number of options in a poll.
+	pollMinOptions = 2
+	pollMaxOptions = 10
+	// Maximum length of the question and of an option, runes.
+	pollMaxText = 256
+)
+
+// pollHead is the definition of a poll in the message head.
+type pollHead struct {
+	Question string   `json:"question"`
+	Options  []string `json:"options"`
+	Multi    bool     `json:"multi,omitempty"`
+}
+
+// pollParse extracts the poll from the message head. Returns nil if the message does not create
+// a poll. The second value is false if the message creates a poll but the poll is malformed.
+func pollParse(head map[string]interface{}) (*types.Poll, bool) {
+	def, ok := head[pollHeader]
+	if !ok {
+		return nil, true
+	}
+
+	var ph pollHead
+	raw, err := json.Marshal(def)
+	if err == nil {
+		err = json.Unmarshal(raw, &ph)
+	}
+	if err != nil || ph.Question == "" || utf8.RuneCountInString(ph.Question) > pollMaxText ||
+		len(ph.Options) < pollMinOptions || len(ph.Options) > pollMaxOptions {
+		return nil, false
+	}
+	for _, opt := range ph.Options {
+		if opt == "" || utf8.RuneCountInString(opt) > pollMaxText {
+			return nil, false
+		}
+	}
+
+	return &types.Poll{
+		Question: ph.Question,
+		Options:  ph.Options,
+		Multi:    ph.Multi,
+	}, true
+}
+
+// pollCreate saves the poll created by the message which has just been saved.
+func (t *Topic) pollCreate(poll *types.Poll, seq int) {
+	poll.Topic = t.name
+	poll.SeqId = seq
+	if err := store.Polls.Create(poll); err != nil {
+		log.Printf("topic[%s]: failed to save poll: %v", t.name, err)
+	}
+}
+
+// pollTally counts votes for each option of the poll.
+func pollTally(poll *types.Poll) []int {
+	tally := make([]int, len(poll.Options))
+	for _, vote := range poll.Votes {
+		for _, opt := range vote {
+			if opt >= 0 && opt < len(tally) {
+				tally[opt]++
+			}
+		}
+	}
+	return tally
+}
+
+// pollVote records the vote in info and replaces the vote with the updated tally.
+// Returns false if the vote is invalid or changes nothing, and should not be broadcast.
+func (t *Topic) pollVote(uid types.Uid, info *MsgServerInfo) bool {
+	poll, err := store.Polls.Get(t.name, info.SeqId)
+	if err != nil {
+		log.Printf("topic[%s]: failed to get poll: %v", t.name, err)
+		return false
+	}
+	if poll == nil || (!poll.Multi && len(info.Vote) > 1) {
+		return false
+	}
+
+	vote := append([]int(nil), info.Vote...)
+	sort.Ints(vote)
+	for i, opt := range vote {
+		if opt < 0 || opt >= len(poll.Options) || (i > 0 && vote[i-1] == opt) {
+			return false
+		}
+	}
+
+	prev := poll.Votes[uid.String()]
+	if len(prev) == len(vote) {
+		same := true
+		for i := range vote {
+			if prev[i] != vote[i] {
+				same = false
+				break
+			}
+		}
+		if same {
+			return false
+		}
+	}
+
+	if err = store.Polls.Vote(t.name, info.SeqId, uid, vote); err != nil {
+		log.Printf("topic[%s]: failed to save vote: %v", t.name, err)
+		return false
+	}
+
+	if poll.Votes == nil {
+		poll.Votes = make(map[string][]int)
+	}
+	if len(vote) > 0 {
+		poll.Votes[uid.String()] = vote
+	} else {
+		delete(poll.Votes, uid.String())
+	}
+
+	// Votes are secret: others see the tally only.
+	info.Vote = nil
+	info.Tally = pollTally(poll)
+	return true
+}
+
+// replyGetPoll returns the poll with the current tally and the requester's own vote.
+func (t *Topic) replyGetPoll(sess *Session, asUid types.Uid, req *MsgGetPoll, msg *ClientComMessage) error {
+	now := types.TimeNow()
+
+	asChan, err := t.verifyChannelAccess(msg.Original)
+	if err != nil {
+		sess.queueOut(ErrNotFoundReply(msg, now))
+		return types.ErrNotFound
+	}
+	if t.cat != types.TopicCatGrp {
+		sess.queueOut(ErrOperationNotAllowedReply(msg, now))
+		return errors.New("get.poll: invalid topic category")
+	}
+	if pud, ok := t.perUser[asUid]; !asChan && (!ok || !(pud.modeGiven & pud.modeWant).IsReader()) {
+		sess.queueOut(ErrPermissionDeniedReply(msg, now))
+		return errors.New("get.poll: no read permission")
+	}
+	if req == nil || req.Seq <= 0 || req.Seq > t.lastID {
+		sess.queueOut(ErrMalformedReply(msg, now))
+		return errors.New("get.poll: invalid seq ID")
+	}
+
+	poll, err := store.Polls.Get(t.name, req.Seq)
+	if err == nil && poll == nil {
+		err = types.ErrNotFound
+	}
+	if err != nil {
+		sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, msg.Original, now, msg.Timestamp, nil))
+		return err
+	}
+
+	result := &MsgPoll{
+		Seq:      poll.SeqId,
+		Question: poll.Question,
+		Options:  poll.Options,
+		Multi:    poll.Multi,
+		Tally:    pollTally(poll),
+	}
+	if !asChan {
+		result.Own = poll.Votes[asUid.String()]
+	}
+
+	sess.queueOut(&ServerComMessage{
+		Meta: &MsgServerMeta{Id: msg.Id, Topic: msg.Original, Timestamp: &now, Poll: result}})
+
+	return nil
+}
@@ -6,6 +6,7 @@ import (
 	"reflect"
 	"regexp"
 	"strings"
+	"time"
 
 	"github.com/tinode/chat/server/push"
 	"github.com/tinode/chat/server/store"
@@ -25,6 +26,8 @@ type presParams struct {
 	target string
 	dWant  string
 	dGiven string
+	// Role label of the target
+	role string
 }
 
 type presFilters struct {
@@ -144,6 +147,11 @@ func (t *Topic) presProcReq(fromUserID, what string, wantReply bool) string {
 
 	if t.cat == types.TopicCatMe {
 
+		if cmd != "rem" && t.blocked.Find(fromUserID) >= 0 {
+			// Presence of blocked users is ignored and they get no reply.
+			return ""
+		}
+
 		// Find if the contact is listed.
 		if psd, ok := t.perSubs[fromUserID]; ok {
 
@@ -219,16 +227,48 @@ func (t *Topic) presProcReq(fromUserID, what string, wantReply bool) string {
 	// B[online, A:on] to A[online, B:off]: {pres B on}
 	// A[online, B:on] to B[online, A:on]: {pres A on} <<-- unnecessary, that's why wantReply is needed
 	if (onlineUpdate || reqReply) && wantReply {
-		globals.hub.route <- &ServerComMessage{
+		globals.hub.routeMsg(&ServerComMessage{
 			// Topic is 'me' even for group topics; group topics will use 'me' as a signal to drop the message
 			// without forwarding to sessions
 			Pres:   &MsgServerPres{Topic: "me", What: replyAs, Src: t.name, WantReply: reqReply},
-			RcptTo: fromUserID}
+			RcptTo: fromUserID})
 	}
 
 	return what
 }
 
+// presBlockContact stops or resumes exchange of presence notifications with a P2P contact
+// when the contact is blocked or unblocked on 'me'.
+func (t *Topic) presBlockContact(contact string, blocked bool) {
+	psd, ok := t.perSubs[contact]
+	if !ok || !psd.enabled {
+		return
+	}
+
+	if blocked {
+		// Tell the contact the user went offline.
+		globals.hub.routeMsg(&ServerComMessage{
+			Pres:   &MsgServerPres{Topic: "me", What: "off", Src: t.name},
+			RcptTo: contact})
+
+		if psd.online {
+			psd.online = false
+			t.perSubs[contact] = psd
+			// Tell user's sessions the contact went offline. The message cannot be routed through
+			// the topic: presence of blocked contacts is dropped there.
+			msg := &ServerComMessage{Pres: &MsgServerPres{Topic: "me", What: "off", Src: contact}}
+			for sess := range t.sessions {
+				sess.queueOut(msg)
+			}
+		}
+	} else {
+		// Announce user's presence and ask the contact to reply with theirs.
+		globals.hub.routeMsg(&ServerComMessage{
+			Pres:   &MsgServerPres{Topic: "me", What: "on", Src: t.name, WantReply: true},
+			RcptTo: contact})
+	}
+}
+
 // Publish user's update to his/her users of interest on their 'me' topic
 // Case A: user came online, "on", ua
 // Case B: user went offline, "off", ua
@@ -266,13 +306,13 @@ func (t *Topic) presUsersOfInterest(what, ua string) {
 					organizationId := ""
 					// search owner session to resolve organization id
 					for session := range t.sessions {
-						if organizationId == "" && session.uid.UserId() == ownerId {
-							organizationId = session.OrganizationId
+						if uid, _, org := session.activeAccount(); organizationId == "" && uid.UserId() == ownerId {
+							organizationId = org
 						}
 					}
 
 					for userId := range t.perSubs {
-						if types.GetTopicCat(userId) == types.TopicCatMe && userId != ownerId {
+						if types.GetTopicCat(userId) == types.TopicCatMe && userId != ownerId && t.blocked.Find(userId) < 0 {
 							receipt := push.Receipt{
 								To:             make(map[types.Uid]push.Recipient, t.subsCount()),
 								OrganizationId: organizationId,
@@ -300,6 +340,10 @@ func (t *Topic) presUsersOfInterest(what, ua string) {
 
 	// Push update to subscriptions
 	for topic, psd := range t.perSubs {
+		if t.blocked.Find(topic) >= 0 {
+			// Blocked users are not notified.
+			continue
+		}
 		// P2P contacts are notified on 'me', group topics are notified on proper topic name.
 		notifyOn := "me"
 		if what == "upd" || what == "ua" {
@@ -316,14 +360,14 @@ func (t *Topic) presUsersOfInterest(what, ua string) {
 				notifyOn = topic
 			}
 		}
-		globals.hub.route <- &ServerComMessage{
+		globals.hub.routeMsg(&ServerComMessage{
 			Pres: &MsgServerPres{
 				Topic:     notifyOn,
 				What:      what,
 				Src:       t.name,
 				UserAgent: ua,
 				WantReply: wantReply},
-			RcptTo: topic}
+			RcptTo: topic})
 
 		if psd.online && goOffline {
 			psd.online = false
@@ -337,9 +381,9 @@ func (t *Topic) presUsersOfInterest(what, ua string) {
 func presUsersOfInterestOffline(uid types.Uid, subs []types.Subscription, what string) {
 	// Push update to subscriptions
 	for _, sub := range subs {
-		globals.hub.route <- &ServerComMessage{
+		globals.hub.routeMsg(&ServerComMessage{
 			Pres:   &MsgServerPres{Topic: "me", What: what, Src: uid.UserId(), WantReply: false},
-			RcptTo: sub.Topic}
+			RcptTo: sub.Topic})
 	}
 }
 
@@ -366,13 +410,13 @@ func (t *Topic) presSubsOnline(what, src string, params *presParams, filter *pre
 		target = ""
 	}
 
-	globals.hub.route <- &ServerComMessage{
+	globals.hub.routeMsg(&ServerComMessage{
 		Pres: &MsgServerPres{Topic: t.xoriginal, What: what, Src: src,
 			Acs: params.packAcs(), AcsActor: actor, AcsTarget: target,
-			SeqId: params.seqID, DelId: params.delID, DelSeq: params.delSeq,
+			SeqId: params.seqID, DelId: params.delID, DelSeq: params.delSeq, Role: params.role,
 			FilterIn: int(filter.filterIn), FilterOut: int(filter.filterOut),
 			SingleUser: filter.singleUser, ExcludeUser: filter.excludeUser},
-		RcptTo: t.name, SkipSid: skipSid}
+		RcptTo: t.name, SkipSid: skipSid})
 }
 
 // userIsPresencer returns true if the user (specified by `uid`) may receive presence notifications.
@@ -383,8 +427,8 @@ func (t *Topic) userIsPresencer(uid types.Uid) bool {
 		want = t.modeWantUnion
 		given = t.modeGivenUnion
 	} else {
-		pud := t.perUser[uid]
-		if pud.deleted {
+		pud, ok := t.perUser[uid]
+		if !ok || pud.deleted {
 			return false
 		}
 		want = pud.modeWant
@@ -399,6 +443,7 @@ func (t *Topic) presSubsOnlineDirect(what string, params *presParams, filter *pr
 	msg := &ServerComMessage{
 		Pres: &MsgServerPres{Topic: t.xoriginal, What: what, Acs: params.packAcs(),
 			SeqId: params.seqID, DelId: params.delID, DelSeq: params.delSeq}}
+	msg.enableSerializeCache()
 
 	for s, pssd := range t.sessions {
 		if !s.isMultiplex() {
@@ -406,9 +451,16 @@ func (t *Topic) presSubsOnlineDirect(what string, params *presParams, filter *pr
 				continue
 			}
 
-			pud := t.perUser[pssd.uid]
+			// Channel readers have no per-user data.
+			var mode types.AccessMode
+			if pud, ok := t.perUser[pssd.uid]; ok {
+				if pud.deleted {
+					continue
+				}
+				mode = pud.modeGiven & pud.modeWant
+			}
 			// Check presence filters
-			if pud.deleted || (!presShouldBypassMode(what) && !presOfflineFilter(pud.modeGiven&pud.modeWant, filter)) {
+			if !presShouldBypassMode(what) && !presOfflineFilter(mode, filter) {
 				continue
 			}
 
@@ -459,8 +511,10 @@ func (t *Topic) presSubsOffline(what string, params *presParams,
 		skipTopic = t.name
 	}
 
+	now := time.Now()
 	for uid, pud := range t.perUser {
-		if pud.deleted || (!presShouldBypassMode(what) && !presOfflineFilter(pud.modeGiven&pud.modeWant, filterSource)) {
+		if pud.deleted || (!presShouldBypassMode(what) &&
+			(!presOfflineFilter(pud.modeGiven&pud.modeWant, filterSource) || pud.isMuted(now))) {
 			continue
 		}
 
@@ -475,14 +529,14 @@ func (t *Topic) presSubsOffline(what string, params *presParams,
 			target = ""
 		}
 
-		globals.hub.route <- &ServerComMessage{
+		globals.hub.routeMsg(&ServerComMessage{
 			Pres: &MsgServerPres{Topic: "me", What: what, Src: t.original(uid),
 				Acs: params.packAcs(), AcsActor: actor, AcsTarget: target,
 				SeqId: params.seqID, DelId: params.delID,
 				FilterIn: int(filterTarget.filterIn), FilterOut: int(filterTarget.filterOut),
 				SingleUser: filterTarget.singleUser, ExcludeUser: filterTarget.excludeUser,
 				SkipTopic: skipTopic},
-			RcptTo: user, SkipSid: skipSid}
+			RcptTo: user, SkipSid: skipSid})
 	}
 }
 
@@ -516,11 +570,11 @@ func presSubsOfflineOffline(topic string, cat types.TopicCat, subs []types.Subsc
 			target = ""
 		}
 
-		globals.hub.route <- &ServerComMessage{
+		globals.hub.routeMsg(&ServerComMessage{
 			Pres: &MsgServerPres{Topic: "me", What: what, Src: original,
 				Acs: params.packAcs(), AcsActor: actor, AcsTarget: target,
 				SeqId: params.seqID, DelId: params.delID},
-			RcptTo: user, SkipSid: skipSid}
+			RcptTo: user, SkipSid: skipSid})
 	}
 }
 
@@ -552,12 +606,12 @@ func (t *Topic) presSingleUserOffline(uid types.Uid, mode types.AccessMode,
 			target = ""
 		}
 
-		globals.hub.route <- &ServerComMessage{
+		globals.hub.routeMsg(&ServerComMessage{
 			Pres: &MsgServerPres{Topic: "me", What: what,
 				Src: t.original(uid), SeqId: params.seqID, DelId: params.delID,
 				Acs: params.packAcs(), AcsActor: actor, AcsTarget: target, UserAgent: params.userAgent,
 				WantReply: strings.HasPrefix(what, "?unkn"), SkipTopic: skipTopic},
-			RcptTo: user, SkipSid: skipSid}
+			RcptTo: user, SkipSid: skipSid})
 	}
 }
 
@@ -576,11 +630,11 @@ func presSingleUserOfflineOffline(uid types.Uid, original, what string, params *
 		target = ""
 	}
 
-	globals.hub.route <- &ServerComMessage{
+	globals.hub.routeMsg(&ServerComMessage{
 		Pres: &MsgServerPres{Topic: "me", What: what,
 			Src: original, SeqId: params.seqID, DelId: params.delID,
 			Acs: params.packAcs(), AcsActor: actor, AcsTarget: target},
-		RcptTo: uid.UserId(), SkipSid: skipSid}
+		RcptTo: uid.UserId(), SkipSid: skipSid})
 }
 
 // Let other sessions of a given user know what messages are now received/read
@@ -604,6 +658,22 @@ func (t *Topic) presPubMessageCount(uid types.Uid, mode types.AccessMode, recv,
 	}
 }
 
+// Let the other user of a P2P topic know that messages up to dlvID have reached a device of the user.
+// Sessions attached to the topic receive {info what="dlv"} instead.
+func (t *Topic) presPubMessageDelivered(uid types.Uid, dlvID int) {
+	if t.cat != types.TopicCatP2P {
+		return
+	}
+
+	for sender, pud := range t.perUser {
+		if sender == uid || pud.deleted {
+			continue
+		}
+		t.presSingleUserOffline(sender, pud.modeGiven&pud.modeWant, "delivered",
+			&presParams{seqID: dlvID, actor: uid.UserId()}, "", true)
+	}
+}
+
 // Let other sessions of a given user know that messages are now deleted
 // Cases V.1, V.2
 func (t *Topic) presPubMessageDelete(uid types.Uid, mode types.AccessMode, delID int, list []MsgDelRange, skip string) {
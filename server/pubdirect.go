@@ -0,0 +1,84 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *    Direct messages: a {pub} addressed to a user ID is delivered without
+ *    subscribing to the p2p topic first. The topic and the subscriptions are
+ *    created if missing, subject to the default access of the other user.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"strings"
+
+	"github.com/tinode/chat/server/store/types"
+)
+
+// isDirectPublish checks if the message could be published to a p2p topic without attaching to it.
+func isDirectPublish(msg *ClientComMessage) bool {
+	return strings.HasPrefix(msg.Original, "usr") && !globals.cluster.isRemoteTopic(msg.RcptTo)
+}
+
+// publishDirect asks the hub to load or create the p2p topic and to publish the message there.
+// The session is not attached to the topic.
+func (s *Session) publishDirect(msg *ClientComMessage, data *ServerComMessage) {
+	// Accounts waiting for approval can only use 'me'.
+	if registrationIsPending(types.ParseUserId(msg.AsUser)) {
+		resp := ErrPermissionDeniedReply(msg, msg.Timestamp)
+		resp.Ctrl.Params = map[string]interface{}{"what": "pending"}
+		s.queueOut(resp)
+		return
+	}
+
+	// The topic is loaded the same way as for a {sub} with no parameters.
+	join := &sessionJoin{
+		pkt: &ClientComMessage{
+			Sub:            &MsgClientSub{Id: msg.Id, Topic: msg.Original},
+			Id:             msg.Id,
+			Original:       msg.Original,
+			RcptTo:         msg.RcptTo,
+			AsUser:         msg.AsUser,
+			AuthLvl:        msg.AuthLvl,
+			Timestamp:      msg.Timestamp,
+			OrganizationId: msg.OrganizationId,
+		},
+		sess: s,
+		pub:  data,
+	}
+
+	s.inflightReqs.Add(1)
+	select {
+	case globals.hub.shardFor(msg.RcptTo).join <- join:
+	default:
+		// Reply with a 500 to the user.
+		s.queueOut(ErrUnknownReply(msg, msg.Timestamp))
+		s.inflightReqs.Done()
+		queueOverflow("s.publishDirect", queueHubJoin, msg.RcptTo, s.sid, len(globals.hub.shardFor(msg.RcptTo).join))
+	}
+}
+
+// handlePublishDirect creates the subscription of the sender if it's missing and publishes the message.
+func (t *Topic) handlePublishDirect(h *Hub, join *sessionJoin) error {
+	asUid := types.ParseUserId(join.pkt.AsUser)
+
+	msgsub := join.pkt.Sub
+	if !msgsub.Newsub {
+		pud, found := t.perUser[asUid]
+		msgsub.Newsub = !found || pud.deleted
+	}
+
+	modeChanged, err := t.thisUserSub(h, join.sess, join.pkt, asUid, "", nil)
+	if err != nil {
+		return err
+	}
+	if modeChanged != nil {
+		// Let the other user know of the new topic.
+		t.sendImmediateSubNotifications(asUid, modeChanged, join)
+	}
+
+	// Write permission is checked as for any other message.
+	t.handleBroadcast(join.pub)
+	return nil
+}
@@ -151,6 +151,12 @@ func payloadToData(pl *push.Payload) (map[string]string, error) {
 	if pl.What == push.ActMsg {
 		data["seq"] = strconv.Itoa(pl.SeqId)
 		data["mime"] = pl.ContentType
+		if pl.Link != "" {
+			data["link"] = pl.Link
+		}
+		if pl.Mention {
+			data["mention"] = "true"
+		}
 		data["content"], err = drafty.ToPlainText(pl.Content)
 		if err != nil {
 			return nil, err
@@ -167,6 +173,24 @@ func payloadToData(pl *push.Payload) (map[string]string, error) {
 	} else if pl.What == push.ActSub {
 		data["modeWant"] = pl.ModeWant.String()
 		data["modeGiven"] = pl.ModeGiven.String()
+	} else if pl.What == push.ActDigest {
+		data["seq"] = strconv.Itoa(pl.SeqId)
+		data["count"] = strconv.Itoa(pl.Count)
+		data["content"], err = drafty.ToPlainText(pl.Content)
+		if err != nil {
+			return nil, err
+		}
+	} else if pl.What == push.ActReminder {
+		data["seq"] = strconv.Itoa(pl.SeqId)
+		data["content"], err = drafty.ToPlainText(pl.Content)
+		if err != nil {
+			return nil, err
+		}
+	} else if pl.What == push.ActSecurity {
+		data["event"] = pl.Event
+		if ua, ok := pl.Content.(string); ok {
+			data["content"] = ua
+		}
 	} else {
 		return nil, errors.New("unknown push type")
 	}
@@ -276,10 +300,16 @@ func PrepareNotifications(rcpt *push.Receipt, config *AndroidConfig) []MessageDa
 	var messages []MessageData
 	for uid, devList := range devices {
 		userData := data
-		if rcpt.To[uid].Delivered > 0 {
-			// Silence the push for user who have received the data interactively.
+		if rcpt.To[uid].Delivered > 0 || rcpt.To[uid].Mentions > 0 {
 			userData = clonePayload(data)
-			userData["silent"] = "true"
+			if rcpt.To[uid].Delivered > 0 {
+				// Silence the push for user who have received the data interactively.
+				userData["silent"] = "true"
+			}
+			if rcpt.To[uid].Mentions > 0 {
+				// Let the client badge mentions separately from unread messages.
+				userData["mentions"] = strconv.Itoa(rcpt.To[uid].Mentions)
+			}
 		}
 		for i := range devList {
 			d := &devList[i]
@@ -333,6 +363,25 @@ func PrepareNotifications(rcpt *push.Receipt, config *AndroidConfig) []MessageDa
 	return messages
 }
 
+// RecordPushResults saves the outcome of push notifications sent to devices. Devices which keep failing
+// are eventually deleted by the server.
+func RecordPushResults(batch []MessageData, delivered, failed []int) {
+	var ok, bad []string
+	for _, i := range delivered {
+		if batch[i].DeviceId != "" {
+			ok = append(ok, batch[i].DeviceId)
+		}
+	}
+	for _, i := range failed {
+		if batch[i].DeviceId != "" {
+			bad = append(bad, batch[i].DeviceId)
+		}
+	}
+	if err := store.Devices.PushResults(ok, bad); err != nil {
+		log.Println("fcm: failed to record push results", err)
+	}
+}
+
 // DevicesForUser loads device IDs of the given user.
 func DevicesForUser(uid t.Uid) []string {
 	ddef, count, err := store.Devices.GetAll(uid)
@@ -174,14 +174,23 @@ func processSubscription(req *push.ChannelReq) {
 // handlePushError processes errors returned by a call to fcm.SendAll.
 // returns false to stop further processing of other messages.
 func handlePushErrors(response *fcm.BatchResponse, batch []MessageData) bool {
-	if response.FailureCount <= 0 {
-		return true
-	}
+	var delivered, failed []int
+	defer func() {
+		RecordPushResults(batch, delivered, failed)
+	}()
 
 	for i, resp := range response.Responses {
+		if resp.Success {
+			delivered = append(delivered, i)
+			continue
+		}
 		if !handleFcmError(resp.Error, batch[i].Uid, batch[i].DeviceId) {
 			return false
 		}
+		if !fcm.IsRegistrationTokenNotRegistered(resp.Error) {
+			// The device did not receive the notification. Invalid tokens are deleted already.
+			failed = append(failed, i)
+		}
 	}
 	return true
 }
@@ -15,6 +15,12 @@ const (
 	ActMsg = "msg"
 	// New subscription.
 	ActSub = "sub"
+	// Digest of new messages in a channel.
+	ActDigest = "digest"
+	// Reminder of an upcoming event.
+	ActReminder = "reminder"
+	// Security-related event in the user's account, e.g. a login from a new device.
+	ActSecurity = "security"
 )
 
 // Recipient is a user targeted by the push.
@@ -25,6 +31,10 @@ type Recipient struct {
 	Devices []string `json:"devices,omitempty"`
 	// Unread count to include in the push
 	Unread int `json:"unread"`
+	// Count of unread mentions to include in the push
+	Mentions int `json:"mentions,omitempty"`
+	// The user is active in the topic: counters are updated but the push is not sent.
+	Suppressed bool `json:"-"`
 }
 
 // Receipt is the push payload with a list of recipients.
@@ -69,6 +79,23 @@ type Payload struct {
 	ContentType string `json:"mime"`
 	// Actual Data.Content of the message, if requested
 	Content interface{} `json:"content,omitempty"`
+	// Signed permalink to the message, if permalinks are enabled.
+	Link string `json:"link,omitempty"`
+	// The recipients are mentioned in the message.
+	Mention bool `json:"mention,omitempty"`
+
+	// {digest} notification: SeqId and Content are the latest message and the summary of new messages.
+
+	// Number of new messages since the previous digest.
+	Count int `json:"count,omitempty"`
+
+	// {reminder} notification: SeqId is the message which announced the event, Content is the title
+	// of the event, Timestamp is the start time.
+
+	// {security} notification: Content is the user agent of the session which caused the event.
+
+	// Kind of the account event: "login" (from a new device), "passwd", "cred", "export".
+	Event string `json:"event,omitempty"`
 
 	// New subscription notification
 
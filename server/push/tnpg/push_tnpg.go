@@ -246,13 +246,15 @@ func processSubscription(req *push.ChannelReq, config *configType) {
 }
 
 func handlePushResponse(batch *batchResponse, messages []fcm.MessageData) {
-	if batch.FailureCount <= 0 {
-		return
-	}
+	var delivered, failed []int
+	defer func() {
+		fcm.RecordPushResults(messages, delivered, failed)
+	}()
 
 	for i, resp := range batch.Responses {
 		switch resp.ErrorCode {
 		case "": // no error
+			delivered = append(delivered, i)
 		case messageRateExceeded, quotaExceeded, serverUnavailable, unavailableError, internalError, unknownError:
 			// Transient errors. Stop sending this batch.
 			log.Println("tnpg: transient failure", resp.ErrorMessage)
@@ -269,6 +271,7 @@ func handlePushResponse(batch *batchResponse, messages []fcm.MessageData) {
 			}
 		default:
 			log.Println("tnpg: unrecognized error", resp.ErrorMessage)
+			failed = append(failed, i)
 		}
 	}
 }
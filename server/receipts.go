@@ -0,0 +1,116 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *    Per-message read receipts in small group topics: who has read which
+ *    message and when.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"errors"
+	"log"
+
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+// Receipts are recorded only in topics with at most this many subscribers.
+const receiptsMaxSubscribers = 32
+
+// receiptSave records that the user has read messages from seqFrom to seqTo, if the topic records
+// receipts. Users who don't share read receipts or whose choice is not known are not recorded.
+func (t *Topic) receiptSave(uid types.Uid, pud *perUserData, seqFrom, seqTo int) {
+	if !t.receipts || t.subsCount() > receiptsMaxSubscribers {
+		return
+	}
+	if consent := t.consentOf(uid, pud); consent == nil || !consent.AllowsReadReceipts() {
+		return
+	}
+	if err := store.Receipts.Create(t.name, uid, seqFrom, seqTo, types.TimeNow()); err != nil {
+		log.Printf("topic[%s]: failed to save read receipt: %v", t.name, err)
+	}
+}
+
+// replyGetReceipts returns users who have read the message.
+func (t *Topic) replyGetReceipts(sess *Session, asUid types.Uid, req *MsgGetReceipts, msg *ClientComMessage) error {
+	now := types.TimeNow()
+
+	asChan, err := t.verifyChannelAccess(msg.Original)
+	if err != nil || asChan || t.cat != types.TopicCatGrp {
+		sess.queueOut(ErrOperationNotAllowedReply(msg, now))
+		return errors.New("get.receipts: not a member of a group topic")
+	}
+	if pud, ok := t.perUser[asUid]; !ok || pud.deleted || !(pud.modeGiven & pud.modeWant).IsReader() {
+		sess.queueOut(ErrPermissionDeniedReply(msg, now))
+		return errors.New("get.receipts: no read permission")
+	}
+	if req == nil || req.Seq <= 0 || req.Seq > t.lastID {
+		sess.queueOut(ErrMalformedReply(msg, now))
+		return errors.New("get.receipts: invalid seq ID")
+	}
+
+	receipts, err := store.Receipts.GetForMessage(t.name, req.Seq)
+	if err != nil {
+		sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, msg.Original, now, msg.Timestamp, nil))
+		return err
+	}
+	if len(receipts) == 0 {
+		sess.queueOut(NoContentParamsReply(msg, now, map[string]string{"what": "receipts"}))
+		return nil
+	}
+
+	read := make([]MsgReceipt, 0, len(receipts))
+	for i := range receipts {
+		readAt := receipts[i].ReadAt
+		read = append(read, MsgReceipt{
+			User:   types.ParseUid(receipts[i].User).UserId(),
+			ReadAt: &readAt,
+		})
+	}
+
+	sess.queueOut(&ServerComMessage{
+		Meta: &MsgServerMeta{Id: msg.Id, Topic: msg.Original, Timestamp: &now,
+			Receipts: &MsgReceipts{Seq: req.Seq, Read: read}}})
+
+	return nil
+}
+
+// replySetReceipts enables or disables recording of per-message read receipts, owner only.
+func (t *Topic) replySetReceipts(sess *Session, asUid types.Uid, msg *ClientComMessage) error {
+	now := types.TimeNow()
+
+	if t.cat != types.TopicCatGrp {
+		sess.queueOut(ErrOperationNotAllowedReply(msg, now))
+		return errors.New("set.receipts: invalid topic category")
+	}
+	if !t.isOwner(asUid) {
+		sess.queueOut(ErrPermissionDeniedReply(msg, now))
+		return errors.New("set.receipts: request by non-owner")
+	}
+
+	enable := *msg.Set.Receipts
+	if enable == t.receipts {
+		sess.queueOut(InfoNotModifiedReply(msg, now))
+		return nil
+	}
+	if enable && (t.isChan || t.subsCount() > receiptsMaxSubscribers) {
+		sess.queueOut(ErrPolicyLimitReply(msg, now, "subscribers", receiptsMaxSubscribers))
+		return errors.New("set.receipts: topic is too large")
+	}
+
+	if err := store.Topics.Update(t.name, map[string]interface{}{
+		"Receipts": enable, "UpdatedAt": now}); err != nil {
+		sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, t.original(asUid), now, msg.Timestamp, nil))
+		return err
+	}
+
+	t.receipts = enable
+	t.updated = now
+
+	sess.queueOut(NoErrReply(msg, now))
+
+	return nil
+}
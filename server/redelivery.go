@@ -0,0 +1,80 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *    Limits on redelivery of unacknowledged messages: how many messages of
+ *    one topic are redelivered on subscription and how many are redelivered
+ *    to one session across all topics. Older messages above the limits are
+ *    skipped and the client is told which ones.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"sync/atomic"
+)
+
+// redeliveryConfig is the configuration of limits on redelivery of unacknowledged messages.
+type redeliveryConfig struct {
+	// Maximum number of the most recent unacknowledged messages of one topic which are redelivered,
+	// 0 for no limit.
+	TopicLimit int `json:"topic_limit"`
+	// Maximum number of messages redelivered to one session across all topics, 0 for no limit.
+	UserLimit int `json:"user_limit"`
+}
+
+var redelivery struct {
+	topicLimit int
+	userLimit  int
+}
+
+// redeliveryInit configures limits on redelivery of unacknowledged messages.
+func redeliveryInit(jsconf json.RawMessage) error {
+	if len(jsconf) == 0 {
+		return nil
+	}
+
+	var config redeliveryConfig
+	if err := json.Unmarshal(jsconf, &config); err != nil {
+		return errors.New("failed to parse config: " + err.Error())
+	}
+	if config.TopicLimit < 0 || config.UserLimit < 0 {
+		return errors.New("invalid limits")
+	}
+
+	redelivery.topicLimit = config.TopicLimit
+	redelivery.userLimit = config.UserLimit
+
+	return nil
+}
+
+// redeliveryReserve takes up to count messages from the redelivery budget of the session.
+// Returns the number of messages the session may receive.
+func (s *Session) redeliveryReserve(count int) int {
+	if redelivery.userLimit <= 0 {
+		return count
+	}
+	for {
+		used := atomic.LoadInt32(&s.redelivered)
+		left := redelivery.userLimit - int(used)
+		if left <= 0 {
+			return 0
+		}
+		if count > left {
+			count = left
+		}
+		if atomic.CompareAndSwapInt32(&s.redelivered, used, used+int32(count)) {
+			return count
+		}
+	}
+}
+
+// redeliveryRelease returns unused messages to the redelivery budget of the session.
+func (s *Session) redeliveryRelease(count int) {
+	if redelivery.userLimit > 0 && count > 0 {
+		atomic.AddInt32(&s.redelivered, -int32(count))
+	}
+}
@@ -0,0 +1,258 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *    Approval of new accounts: accounts are created pending and cannot join
+ *    topics until approved by a root user or by the approval webhook.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/tinode/chat/server/auth"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+const (
+	// Timeout of a request to the approval webhook.
+	registrationHookTimeout = 10 * time.Second
+	// How long the pending state of an account is trusted before it's checked again:
+	// the account may be approved at another cluster node.
+	registrationPendingTTL = time.Minute
+	// Maximum number of pending accounts returned to the administrator at once.
+	registrationMaxPending = 100
+)
+
+// registrationConfig is the configuration of the approval of new accounts.
+type registrationConfig struct {
+	// New accounts must be approved.
+	Approval bool `json:"approval"`
+	// Organizations where accounts must be approved. All organizations if empty.
+	Orgs []string `json:"orgs"`
+	// Optional webhook which decides on new accounts.
+	Webhook *struct {
+		Url string `json:"url"`
+		// Secret for signing requests.
+		Secret string `json:"secret"`
+	} `json:"webhook"`
+}
+
+// registrationHookRequest is the body of a request to the approval webhook.
+type registrationHookRequest struct {
+	Event string `json:"event"`
+	// New account.
+	User string `json:"user"`
+	// Organization of the account, if known.
+	Org string `json:"org,omitempty"`
+	// Time when the account was created.
+	Timestamp time.Time `json:"ts"`
+}
+
+// registrationHookResponse is the decision of the approval webhook. The account remains pending
+// for manual review if the decision is missing.
+type registrationHookResponse struct {
+	Approve *bool `json:"approve"`
+}
+
+var registration struct {
+	enabled bool
+	orgs    map[string]bool
+
+	hookUrl    string
+	hookSecret string
+	hookClient *http.Client
+}
+
+type registrationCached struct {
+	loadedAt time.Time
+}
+
+// Accounts known to be pending approval at this node, types.Uid -> *registrationCached.
+var registrationPending sync.Map
+
+// registrationInit configures approval of new accounts.
+func registrationInit(jsconf json.RawMessage) error {
+	if len(jsconf) == 0 {
+		return nil
+	}
+
+	var config registrationConfig
+	if err := json.Unmarshal(jsconf, &config); err != nil {
+		return errors.New("failed to parse config: " + err.Error())
+	}
+	if !config.Approval {
+		return nil
+	}
+
+	registration.enabled = true
+	if len(config.Orgs) > 0 {
+		registration.orgs = make(map[string]bool, len(config.Orgs))
+		for _, org := range config.Orgs {
+			registration.orgs[org] = true
+		}
+	}
+	if config.Webhook != nil && config.Webhook.Url != "" {
+		registration.hookUrl = config.Webhook.Url
+		registration.hookSecret = config.Webhook.Secret
+		registration.hookClient = &http.Client{Timeout: registrationHookTimeout}
+	}
+
+	return nil
+}
+
+// registrationNeedsApproval checks if new accounts of the organization must be approved.
+func registrationNeedsApproval(org string) bool {
+	return registration.enabled && (registration.orgs == nil || registration.orgs[org])
+}
+
+// registrationSetPending records the state of the account which has just logged in.
+func registrationSetPending(uid types.Uid, pending bool) {
+	if pending {
+		registrationPending.Store(uid, &registrationCached{loadedAt: time.Now()})
+	} else {
+		registrationPending.Delete(uid)
+	}
+}
+
+// registrationIsPending checks if the account is still waiting for approval.
+func registrationIsPending(uid types.Uid) bool {
+	val, ok := registrationPending.Load(uid)
+	if !ok {
+		return false
+	}
+	if time.Since(val.(*registrationCached).loadedAt) < registrationPendingTTL {
+		return true
+	}
+
+	// The account may have been approved at another node.
+	state, err := userGetState(uid)
+	if err != nil {
+		log.Println("registration: failed to get user state", uid.UserId(), err)
+		return true
+	}
+	registrationSetPending(uid, state == types.StatePending)
+	return state == types.StatePending
+}
+
+// registrationHold puts the new account on hold until approved and asks the webhook, if configured,
+// to decide on it.
+func registrationHold(uid types.Uid, org string) error {
+	if err := store.Users.UpdateState(uid, types.StatePending); err != nil {
+		return err
+	}
+	registrationSetPending(uid, true)
+
+	if registration.hookUrl != "" {
+		go registrationAskHook(uid, org)
+	}
+	return nil
+}
+
+// registrationAskHook sends the new account to the approval webhook and applies the decision.
+func registrationAskHook(uid types.Uid, org string) {
+	body, err := json.Marshal(&registrationHookRequest{
+		Event:     "register",
+		User:      uid.UserId(),
+		Org:       org,
+		Timestamp: types.TimeNow()})
+	if err != nil {
+		log.Println("registration: failed to serialize request", uid.UserId(), err)
+		return
+	}
+
+	req, err := http.NewRequest(http.MethodPost, registration.hookUrl, bytes.NewReader(body))
+	if err != nil {
+		log.Println("registration: invalid webhook request", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Tinode/"+currentVersion)
+	req.Header.Set("X-Tinode-Event", "register")
+	if registration.hookSecret != "" {
+		req.Header.Set("X-Tinode-Signature", hookSignature(registration.hookSecret, body))
+	}
+
+	resp, err := registration.hookClient.Do(req)
+	if err != nil {
+		log.Println("registration: webhook failed, account left for review", uid.UserId(), err)
+		return
+	}
+	defer resp.Body.Close()
+
+	var decision registrationHookResponse
+	if resp.StatusCode >= 300 || json.NewDecoder(resp.Body).Decode(&decision) != nil || decision.Approve == nil {
+		// No decision: the account is reviewed by an administrator.
+		return
+	}
+
+	if *decision.Approve {
+		err = registrationApprove(uid)
+	} else {
+		err = deleteUser(uid, true, "")
+	}
+	if err != nil {
+		log.Println("registration: failed to apply webhook decision", uid.UserId(), *decision.Approve, err)
+	}
+}
+
+// registrationApprove activates the pending account.
+func registrationApprove(uid types.Uid) error {
+	if err := store.Users.UpdateState(uid, types.StateOK); err != nil {
+		return err
+	}
+	registrationSetPending(uid, false)
+	return nil
+}
+
+// replyGetPending returns accounts waiting for approval, 'sys' topic only, root only.
+func (t *Topic) replyGetPending(sess *Session, asUid types.Uid, authLevel auth.Level, msg *ClientComMessage) error {
+	now := types.TimeNow()
+
+	if t.cat != types.TopicCatSys || authLevel != auth.LevelRoot {
+		sess.queueOut(ErrPermissionDeniedReply(msg, now))
+		return errors.New("get.pending: root access required")
+	}
+
+	uids, err := store.Users.GetByState(types.StatePending, now, types.ZeroUid, registrationMaxPending)
+	if err == nil && len(uids) == 0 {
+		sess.queueOut(NoContentParamsReply(msg, now, map[string]string{"what": "pending"}))
+		return nil
+	}
+	var users []types.User
+	if err == nil {
+		users, err = store.Users.GetAll(uids...)
+	}
+	if err != nil {
+		sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, t.original(asUid), now, msg.Timestamp, nil))
+		return err
+	}
+
+	pending := make([]MsgPendingAccount, 0, len(users))
+	for i := range users {
+		user := &users[i]
+		if user.State != types.StatePending {
+			continue
+		}
+		createdAt := user.CreatedAt
+		pending = append(pending, MsgPendingAccount{
+			User:      user.Uid().UserId(),
+			CreatedAt: &createdAt,
+			Public:    user.Public,
+		})
+	}
+
+	sess.queueOut(&ServerComMessage{
+		Meta: &MsgServerMeta{Id: msg.Id, Topic: t.original(asUid), Timestamp: &now, Pending: pending}})
+
+	return nil
+}
@@ -0,0 +1,176 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *    Edge relays: readers of popular channels are pointed to stateless relay
+ *    processes which subscribe to the channel once over gRPC and fan out
+ *    messages to their own reader connections. Each channel is pinned to one
+ *    relay by consistent hashing.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/tinode/chat/server/ringhash"
+	"github.com/tinode/chat/server/store/types"
+)
+
+const (
+	// Number of replicas of each relay in the hash ring.
+	relayRingReplicas = 20
+	// Lifetime of a grant to read the channel through a relay if not configured.
+	relayGrantDefaultTTL = 5 * time.Minute
+	// Maximum lifetime of a grant. Relays keep revocations for this long.
+	relayGrantMaxTTL = time.Hour
+	// Minimum length of the key for signing grants, bytes.
+	relayGrantKeyLength = 32
+	// Length of the truncated HMAC signature of a grant, bytes.
+	relayGrantSigLength = 16
+)
+
+// relayConfig is the "relays" section of the server config.
+type relayConfig struct {
+	Enabled bool `json:"enabled"`
+	// Public URLs of the relays, e.g. "wss://edge1.example.com/v0/channels".
+	Endpoints []string `json:"endpoints"`
+	// Readers are pointed to the relay when the channel has at least this many readers on this node.
+	MinReaders int `json:"min_readers"`
+	// Key for signing grants of readers, shared with the relays. Base64-encoded.
+	GrantKey []byte `json:"grant_key"`
+	// Lifetime of a grant in seconds.
+	GrantLifetime int `json:"grant_lifetime"`
+	// IDs of the accounts the relays use to subscribe to channels, e.g. "usrAbC123". They are
+	// notified when readers lose access to channels.
+	Accounts []string `json:"accounts"`
+}
+
+var relays struct {
+	ring       *ringhash.Ring
+	minReaders int
+	grantKey   []byte
+	grantTTL   time.Duration
+	accounts   []types.Uid
+}
+
+// relayInit parses the list of relays.
+func relayInit(jsconfig json.RawMessage) error {
+	if len(jsconfig) == 0 {
+		return nil
+	}
+
+	var config relayConfig
+	if err := json.Unmarshal(jsconfig, &config); err != nil {
+		return errors.New("failed to parse config: " + err.Error())
+	}
+	if !config.Enabled {
+		return nil
+	}
+	if len(config.Endpoints) == 0 {
+		return errors.New("no relay endpoints")
+	}
+
+	seen := make(map[string]bool, len(config.Endpoints))
+	for _, endpoint := range config.Endpoints {
+		if endpoint == "" || seen[endpoint] {
+			return errors.New("empty or duplicate relay endpoint '" + endpoint + "'")
+		}
+		seen[endpoint] = true
+	}
+
+	if len(config.GrantKey) < relayGrantKeyLength {
+		return errors.New("missing or too short grant_key")
+	}
+	ttl := relayGrantDefaultTTL
+	if config.GrantLifetime != 0 {
+		ttl = time.Duration(config.GrantLifetime) * time.Second
+		if ttl < 0 || ttl > relayGrantMaxTTL {
+			return errors.New("invalid grant_lifetime")
+		}
+	}
+	accounts := make([]types.Uid, 0, len(config.Accounts))
+	for _, acct := range config.Accounts {
+		uid := types.ParseUserId(acct)
+		if uid.IsZero() {
+			return errors.New("invalid relay account '" + acct + "'")
+		}
+		accounts = append(accounts, uid)
+	}
+	if len(accounts) == 0 {
+		return errors.New("no relay accounts")
+	}
+
+	relays.ring = ringhash.New(relayRingReplicas, nil)
+	relays.ring.Add(config.Endpoints...)
+	relays.minReaders = config.MinReaders
+	relays.grantKey = config.GrantKey
+	relays.grantTTL = ttl
+	relays.accounts = accounts
+	return nil
+}
+
+// relayGrantSign computes the signature of the grant. Relays compute it the same way.
+func relayGrantSign(key []byte, uid, topic string, issued, expires int64) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(uid + "/" + topic + "/" + strconv.FormatInt(issued, 10) + "/" + strconv.FormatInt(expires, 10)))
+	return mac.Sum(nil)[:relayGrantSigLength]
+}
+
+// relayGrantMake issues a grant which lets the user read the channel through a relay,
+// formatted as "<issued>.<expires>.<signature>".
+func relayGrantMake(uid types.Uid, topic string, now time.Time) string {
+	issued := now.Unix()
+	expires := now.Add(relays.grantTTL).Unix()
+	return strconv.FormatInt(issued, 10) + "." + strconv.FormatInt(expires, 10) + "." +
+		base64.RawURLEncoding.EncodeToString(relayGrantSign(relays.grantKey, uid.UserId(), topic, issued, expires))
+}
+
+// isRelayAccount checks if the user is one of the accounts used by the relays.
+func isRelayAccount(uid types.Uid) bool {
+	for _, acct := range relays.accounts {
+		if acct == uid {
+			return true
+		}
+	}
+	return false
+}
+
+// relayRevoke tells the relays that the user may no longer read the channel. Relays detach the
+// user's readers and stop honoring the grants issued before now.
+func (t *Topic) relayRevoke(uid types.Uid) {
+	if relays.ring == nil || !t.isChan {
+		return
+	}
+	for _, acct := range relays.accounts {
+		t.presSubsOnline("acs", uid.UserId(), &presParams{dWant: types.ModeNone.String(), dGiven: types.ModeNone.String()},
+			&presFilters{singleUser: acct.UserId()}, "")
+	}
+}
+
+// relayFor returns the URL of the relay the channel is pinned to, or an empty string if the readers
+// should stay connected to this node.
+func (t *Topic) relayFor() string {
+	if relays.ring == nil || !t.isChan {
+		return ""
+	}
+	if relays.minReaders > 0 {
+		readers := 0
+		for _, pssd := range t.sessions {
+			if pssd.isChanSub {
+				readers++
+			}
+		}
+		if readers < relays.minReaders {
+			return ""
+		}
+	}
+	return relays.ring.Get(t.name)
+}
@@ -0,0 +1,407 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *    Reloading of the config file without restarting the server: on SIGHUP
+ *    or by request of the root user in the 'sys' topic. Limits and some of
+ *    the sections are applied at once, changes to other sections are
+ *    reported as requiring a restart. Applied versions are kept for
+ *    rollback.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	jcr "github.com/tinode/jsonco"
+
+	"github.com/tinode/chat/server/auth"
+	"github.com/tinode/chat/server/store/types"
+)
+
+// Actions of {set config}.
+const (
+	configActReload   = "reload"
+	configActRollback = "rollback"
+)
+
+// Number of previously applied versions of the config kept for rollback.
+const configMaxHistory = 8
+
+// Sections of the config applied on reload. Changes to other sections require a restart.
+var configReloadable = map[string]bool{
+	"max_message_size":     true,
+	"max_attachments":      true,
+	"max_subscriber_count": true,
+	"max_tag_count":        true,
+	"min_client_versions":  true,
+	"topic_idle_timeout":   true,
+	"max_resident_topics":  true,
+	"max_topics_memory":    true,
+	"kp_coalesce_period":   true,
+	"push_suppress_period": true,
+	"del_grace_period":     true,
+	"adult_age":            true,
+	"session_limits":       true,
+	"masking":              true,
+	"topic_templates":      true,
+	"desc_schema":          true,
+}
+
+// configVersion is one applied version of the config.
+type configVersion struct {
+	// Sequential number of the version, 1 is the config loaded at startup.
+	version int
+	// Hash of the content of the config file.
+	hash string
+	// What caused the version to be applied: "startup", "signal", "admin", "rollback".
+	source  string
+	applied time.Time
+	config  *configType
+}
+
+var configState struct {
+	// Serializes reloads.
+	lock sync.Mutex
+	path string
+
+	current *configVersion
+	// Previously applied versions, oldest first.
+	history []*configVersion
+}
+
+// configRead reads and parses the config file. Returns the config and the hash of the file content.
+func configRead(path string) (*configType, string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, "", errors.New("failed to read config file: " + err.Error())
+	}
+
+	var config configType
+	jr := jcr.New(bytes.NewReader(data))
+	if err = json.NewDecoder(jr).Decode(&config); err != nil {
+		switch jerr := err.(type) {
+		case *json.UnmarshalTypeError:
+			lnum, cnum, _ := jr.LineAndChar(jerr.Offset)
+			return nil, "", fmt.Errorf("unmarshall error in config file in %s at %d:%d (offset %d bytes): %s",
+				jerr.Field, lnum, cnum, jerr.Offset, jerr.Error())
+		case *json.SyntaxError:
+			lnum, cnum, _ := jr.LineAndChar(jerr.Offset)
+			return nil, "", fmt.Errorf("syntax error in config file at %d:%d (offset %d bytes): %s",
+				lnum, cnum, jerr.Offset, jerr.Error())
+		default:
+			return nil, "", errors.New("failed to parse config file: " + err.Error())
+		}
+	}
+
+	sum := sha256.Sum256(data)
+	return &config, hex.EncodeToString(sum[:8]), nil
+}
+
+// configLive holds the values of the reloadable sections of the config. A published snapshot is
+// never changed: a reload publishes a new one, so readers see either the old or the new config
+// as a whole.
+type configLive struct {
+	// Maximum message size allowed from peer.
+	maxMessageSize int64
+	// Maximum number of attachments in a message.
+	maxAttachments int
+	// Maximum number of group topic subscribers.
+	maxSubscriberCount int
+	// Maximum number of indexable tags.
+	maxTagCount int
+	// How long to keep a topic in memory after the last session has left it.
+	topicIdleTimeout time.Duration
+	// Period during which repeated activity indicators of the same kind from the same user are dropped.
+	kpCoalescePeriod time.Duration
+	// Period after user's activity in a topic during which push notifications to the user are suppressed.
+	pushSuppressPeriod time.Duration
+	// Period after publishing during which senders may hard-delete own messages.
+	delGracePeriod time.Duration
+	// Age at which users may find topics rated for adults.
+	adultAge int
+	// Limits on the number of topics kept in memory and their estimated memory use.
+	maxResidentTopics int
+	maxTopicsMemory   int64
+	// Minimum supported versions of client applications by platform.
+	minClientVersions map[string]*minClientVersion
+
+	// Masking rules by organization, nil if masking is disabled.
+	maskingRules map[string]*maskingRule
+	// Topic templates by name.
+	templates map[string]*topicTemplate
+	// Schemas of public, private and trusted values by topic category then by field.
+	descSchemas map[string]map[string]*descSchema
+}
+
+// The published *configLive.
+var configLiveValue atomic.Value
+
+// Limits of an empty config, in effect until the config is loaded.
+var configLiveDefault, _ = configParseLimits(&configType{})
+
+// liveConfig returns the current snapshot of the reloadable sections of the config.
+func liveConfig() *configLive {
+	if live, ok := configLiveValue.Load().(*configLive); ok {
+		return live
+	}
+	return configLiveDefault
+}
+
+// configParseLimits validates the limits from the top level of the config.
+func configParseLimits(config *configType) (*configLive, error) {
+	live := &configLive{}
+
+	// Minimum supported client versions
+	for platf, mcv := range config.MinClientVersions {
+		if mcv.ver = parseVersion(mcv.Version); mcv.ver == 0 {
+			return nil, fmt.Errorf("invalid minimum client version '%s' for platform '%s'", mcv.Version, platf)
+		}
+	}
+	live.minClientVersions = config.MinClientVersions
+
+	// Maximum message size
+	live.maxMessageSize = int64(config.MaxMessageSize)
+	if live.maxMessageSize <= 0 {
+		live.maxMessageSize = defaultMaxMessageSize
+	}
+	// Maximum number of attachments in a message
+	live.maxAttachments = config.MaxAttachments
+	if live.maxAttachments <= 0 {
+		live.maxAttachments = defaultMaxAttachments
+	}
+	// Maximum number of group topic subscribers
+	live.maxSubscriberCount = config.MaxSubscriberCount
+	if live.maxSubscriberCount <= 1 {
+		live.maxSubscriberCount = defaultMaxSubscriberCount
+	}
+	// Maximum number of indexable tags per user or topics
+	live.maxTagCount = config.MaxTagCount
+	if live.maxTagCount <= 0 {
+		live.maxTagCount = defaultMaxTagCount
+	}
+
+	// Lifetime and eviction of idle topics
+	live.topicIdleTimeout = time.Second * time.Duration(config.TopicIdleTimeout)
+	if live.topicIdleTimeout <= 0 {
+		live.topicIdleTimeout = idleMasterTopicTimeout
+	}
+	live.maxResidentTopics = config.MaxResidentTopics
+	live.maxTopicsMemory = config.MaxTopicsMemory
+
+	// Collapsing of repeated typing notifications
+	live.kpCoalescePeriod = time.Second * time.Duration(config.KpCoalescePeriod)
+	if live.kpCoalescePeriod <= 0 {
+		live.kpCoalescePeriod = defaultKpCoalescePeriod
+	}
+	// Suppression of push notifications to active users
+	live.pushSuppressPeriod = time.Second * time.Duration(config.PushSuppressPeriod)
+	if config.PushSuppressPeriod == 0 {
+		live.pushSuppressPeriod = defaultPushSuppressPeriod
+	}
+	// Hard deletion of own messages by senders
+	live.delGracePeriod = time.Second * time.Duration(config.DelGracePeriod)
+	if config.DelGracePeriod == 0 {
+		live.delGracePeriod = defaultDelGracePeriod
+	}
+	// Access to topics rated for adults
+	live.adultAge = config.AdultAge
+	if live.adultAge <= 0 {
+		live.adultAge = defaultAdultAge
+	}
+
+	return live, nil
+}
+
+// configBuild validates the reloadable sections of the config and converts them to a snapshot.
+func configBuild(config *configType) (*configLive, error) {
+	live, err := configParseLimits(config)
+	if err != nil {
+		return nil, err
+	}
+	if live.maskingRules, err = maskingParse(config.Masking); err != nil {
+		return nil, errors.New("masking: " + err.Error())
+	}
+	if live.templates, err = templatesParse(config.Templates, live.maxMessageSize); err != nil {
+		return nil, errors.New("topic_templates: " + err.Error())
+	}
+	if live.descSchemas, err = descSchemaParse(config.DescSchema); err != nil {
+		return nil, errors.New("desc_schema: " + err.Error())
+	}
+	return live, nil
+}
+
+// configApply applies the reloadable sections of the config. Nothing is changed if the config is invalid.
+func configApply(config *configType) error {
+	live, err := configBuild(config)
+	if err != nil {
+		return err
+	}
+	if err := sessionLimitsInit(config.SessLimits); err != nil {
+		return errors.New("session_limits: " + err.Error())
+	}
+	configLiveValue.Store(live)
+	return nil
+}
+
+// configStart records the config loaded at startup as the first version.
+func configStart(path string, config *configType, hash string) {
+	configState.path = path
+	configState.current = &configVersion{
+		version: 1,
+		hash:    hash,
+		source:  "startup",
+		applied: time.Now(),
+		config:  config,
+	}
+}
+
+// configChanges lists the sections of the config which differ between the two versions.
+func configChanges(prev, next *configType) (changed []string, restart []string) {
+	pv, nv := reflect.ValueOf(prev).Elem(), reflect.ValueOf(next).Elem()
+	for i := 0; i < pv.NumField(); i++ {
+		name := strings.Split(pv.Type().Field(i).Tag.Get("json"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+		before, _ := json.Marshal(pv.Field(i).Interface())
+		after, _ := json.Marshal(nv.Field(i).Interface())
+		if string(before) == string(after) {
+			continue
+		}
+		if configReloadable[name] {
+			changed = append(changed, name)
+		} else {
+			restart = append(restart, name)
+		}
+	}
+	return changed, restart
+}
+
+// configReload reads the config file again and applies it. If the new config fails validation,
+// the current config is applied again and nothing is changed.
+func configReload(source string) (*configVersion, []string, []string, error) {
+	configState.lock.Lock()
+	defer configState.lock.Unlock()
+
+	config, hash, err := configRead(configState.path)
+	if err != nil {
+		return configState.current, nil, nil, err
+	}
+	return configSwitch(config, hash, source, false)
+}
+
+// configRollback applies the previous version of the config.
+func configRollback(source string) (*configVersion, []string, []string, error) {
+	configState.lock.Lock()
+	defer configState.lock.Unlock()
+
+	if len(configState.history) == 0 {
+		return configState.current, nil, nil, types.ErrNotFound
+	}
+	prev := configState.history[len(configState.history)-1]
+	return configSwitch(prev.config, prev.hash, source, true)
+}
+
+// configSwitch applies the config as the new current version. Must be called under lock.
+func configSwitch(config *configType, hash, source string, rollback bool) (*configVersion, []string, []string, error) {
+	current := configState.current
+	changed, restart := configChanges(current.config, config)
+
+	if err := configApply(config); err != nil {
+		return current, nil, nil, err
+	}
+
+	if rollback {
+		configState.history = configState.history[:len(configState.history)-1]
+	} else {
+		configState.history = append(configState.history, current)
+		if len(configState.history) > configMaxHistory {
+			configState.history = configState.history[1:]
+		}
+	}
+	configState.current = &configVersion{
+		version: current.version + 1,
+		hash:    hash,
+		source:  source,
+		applied: time.Now(),
+		config:  config,
+	}
+
+	log.Printf("config: applied version %d (%s) from %s; changed %v, restart required for %v",
+		configState.current.version, hash, source, changed, restart)
+	return configState.current, changed, restart, nil
+}
+
+// configSignalReload reloads the config on SIGHUP.
+func configSignalReload() {
+	if _, _, _, err := configReload("signal"); err != nil {
+		log.Println("config: reload failed, config not changed:", err)
+	}
+}
+
+// replySetConfig reloads the config or rolls it back to the previous version, 'sys' topic only, root only.
+// The config is reloaded at the node which hosts the 'sys' topic only, other cluster nodes are not told.
+func (t *Topic) replySetConfig(sess *Session, authLevel auth.Level, msg *ClientComMessage) error {
+	now := types.TimeNow()
+
+	if t.cat != types.TopicCatSys || authLevel != auth.LevelRoot {
+		sess.queueOut(ErrPermissionDeniedReply(msg, now))
+		return errors.New("set.config: root access required")
+	}
+
+	var ver *configVersion
+	var changed, restart []string
+	var err error
+	switch msg.Set.Config.Action {
+	case configActReload:
+		ver, changed, restart, err = configReload("admin")
+	case configActRollback:
+		ver, changed, restart, err = configRollback("admin")
+	default:
+		sess.queueOut(ErrMalformedReply(msg, now))
+		return errors.New("set.config: unknown action")
+	}
+
+	params := map[string]interface{}{
+		"what":    "config",
+		"version": ver.version,
+		"hash":    ver.hash,
+		"source":  ver.source,
+		"applied": ver.applied,
+	}
+	if err != nil {
+		if err == types.ErrNotFound {
+			sess.queueOut(ErrNotFoundReply(msg, now))
+		} else {
+			resp := ErrMalformedReply(msg, now)
+			params["error"] = err.Error()
+			resp.Ctrl.Params = params
+			sess.queueOut(resp)
+		}
+		return err
+	}
+
+	if len(changed) > 0 {
+		params["changed"] = changed
+	}
+	if len(restart) > 0 {
+		params["restart"] = restart
+	}
+	sess.queueOut(NoErrParamsReply(msg, now, params))
+	return nil
+}
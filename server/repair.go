@@ -0,0 +1,224 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *    Repair of the stored state of a topic after partial write failures:
+ *    counters of the topic and of its subscriptions are recomputed from the
+ *    messages and made consistent with each other.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"github.com/tinode/chat/server/auth"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+// topicRepair checks the stored state of the topic and fixes inconsistencies. If the topic is loaded, it must be
+// called by the topic goroutine followed by repairLoaded. Returns the list of what was fixed, empty if nothing was.
+func topicRepair(name string) (map[string]interface{}, error) {
+	stopic, err := store.Topics.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	if stopic == nil {
+		return nil, types.ErrTopicNotFound
+	}
+
+	fixed := map[string]interface{}{}
+	update := map[string]interface{}{}
+
+	// The last message ID and the time of the last message cannot be older than the latest stored message.
+	latest, err := store.Messages.GetAll(name, types.ZeroUid, &types.QueryOpt{Limit: 1})
+	if err != nil {
+		return nil, err
+	}
+	if len(latest) > 0 {
+		if latest[0].SeqId > stopic.SeqId {
+			stopic.SeqId = latest[0].SeqId
+			update["SeqId"] = stopic.SeqId
+			fixed["seq"] = stopic.SeqId
+		}
+		if latest[0].CreatedAt.After(stopic.TouchedAt) {
+			stopic.TouchedAt = latest[0].CreatedAt
+			update["TouchedAt"] = stopic.TouchedAt
+			fixed["touched"] = stopic.TouchedAt
+		}
+	}
+
+	subs, err := store.Topics.GetSubs(name, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// Per-user deletions cannot be newer than the deletions of the topic.
+	for i := range subs {
+		if subs[i].DelId > stopic.DelId {
+			stopic.DelId = subs[i].DelId
+			update["DelId"] = stopic.DelId
+			fixed["clear"] = stopic.DelId
+		}
+	}
+
+	if len(update) > 0 {
+		if err = store.Topics.Update(name, update); err != nil {
+			return nil, err
+		}
+	}
+
+	// Subscriptions must satisfy read <= recv <= dlv <= seq.
+	var fixedSubs []string
+	for i := range subs {
+		sub := &subs[i]
+		readID, recvID, dlvID := sub.ReadSeqId, sub.RecvSeqId, sub.DlvSeqId
+		if readID > stopic.SeqId {
+			readID = stopic.SeqId
+		}
+		if recvID > stopic.SeqId {
+			recvID = stopic.SeqId
+		}
+		if dlvID > stopic.SeqId {
+			dlvID = stopic.SeqId
+		}
+		if recvID < readID {
+			recvID = readID
+		}
+		if dlvID < recvID {
+			dlvID = recvID
+		}
+
+		subUpdate := map[string]interface{}{}
+		if readID != sub.ReadSeqId || recvID != sub.RecvSeqId || dlvID != sub.DlvSeqId {
+			subUpdate["ReadSeqId"] = readID
+			subUpdate["RecvSeqId"] = recvID
+			subUpdate["DlvSeqId"] = dlvID
+		}
+		if sub.User == stopic.Owner && types.GetTopicCat(name) == types.TopicCatGrp &&
+			!sub.ModeGiven.IsOwner() {
+			// The owner of a group topic lost the 'O' permission.
+			subUpdate["ModeGiven"] = sub.ModeGiven | types.ModeOwner
+			subUpdate["ModeWant"] = sub.ModeWant | types.ModeOwner
+		}
+		if len(subUpdate) == 0 {
+			continue
+		}
+
+		uid := types.ParseUid(sub.User)
+		if err = store.Subs.Update(name, uid, subUpdate, false); err != nil {
+			return nil, err
+		}
+		fixedSubs = append(fixedSubs, uid.UserId())
+	}
+	if len(fixedSubs) > 0 {
+		fixed["subs"] = fixedSubs
+	}
+
+	return fixed, nil
+}
+
+// repairLoaded brings the state of the loaded topic in line with the repaired stored state.
+func (t *Topic) repairLoaded(fixed map[string]interface{}) error {
+	if seq, ok := fixed["seq"].(int); ok && seq > t.lastID {
+		t.lastID = seq
+		if t.recent != nil {
+			// Cached messages may be missing some of the messages now known to exist.
+			t.recent = newRecentMessages(globals.recentMessageCount, t.lastID)
+		}
+	}
+	if touched, ok := fixed["touched"].(time.Time); ok && touched.After(t.touched) {
+		t.touched = touched
+	}
+	if delID, ok := fixed["clear"].(int); ok && delID > t.delID {
+		t.delID = delID
+	}
+
+	users, _ := fixed["subs"].([]string)
+	for _, user := range users {
+		uid := types.ParseUserId(user)
+		pud := t.perUser[uid]
+		if pud == nil {
+			continue
+		}
+		sub, err := store.Subs.Get(t.name, uid)
+		if err != nil {
+			return err
+		}
+		if sub == nil {
+			continue
+		}
+		pud.readID, pud.recvID, pud.dlvID = sub.ReadSeqId, sub.RecvSeqId, sub.DlvSeqId
+		pud.modeGiven, pud.modeWant = sub.ModeGiven, sub.ModeWant
+	}
+	if len(users) > 0 {
+		t.computePerUserAcsUnion()
+	}
+	return nil
+}
+
+// replySetRepair repairs the stored state of a topic, 'sys' topic only, root only.
+func (t *Topic) replySetRepair(sess *Session, asUid types.Uid, authLevel auth.Level, msg *ClientComMessage) error {
+	now := types.TimeNow()
+
+	if t.cat != types.TopicCatSys || authLevel != auth.LevelRoot {
+		sess.queueOut(ErrPermissionDeniedReply(msg, now))
+		return errors.New("set.repair: root access required")
+	}
+
+	name := msg.Set.Repair.Topic
+	if tmp := types.ChnToGrp(name); tmp != "" {
+		name = tmp
+	}
+	if cat := topicCat(name); cat != types.TopicCatGrp && cat != types.TopicCatP2P {
+		sess.queueOut(ErrMalformedReply(msg, now))
+		return errors.New("set.repair: invalid topic")
+	}
+	if globals.cluster.isRemoteTopic(name) {
+		// The topic could be loaded at the other node.
+		sess.queueOut(ErrOperationNotAllowedReply(msg, now))
+		return errors.New("set.repair: topic is hosted by another node")
+	}
+
+	// The topic is repaired in the background, the 'sys' topic should not wait for the database.
+	go func() {
+		var fixed map[string]interface{}
+		err := globals.hub.runTopicTask(name,
+			func(t *Topic) error {
+				// The topic is loaded: repair it in the topic goroutine so it does not overwrite the repaired state.
+				var err error
+				if fixed, err = topicRepair(name); err != nil {
+					return err
+				}
+				return t.repairLoaded(fixed)
+			},
+			func() error {
+				var err error
+				fixed, err = topicRepair(name)
+				return err
+			})
+		if err == errTopicBusy {
+			sess.queueOut(ErrServiceUnavailableReply(msg, types.TimeNow()))
+			return
+		}
+		if err != nil {
+			log.Println("set.repair: failed to repair topic", name, err)
+			sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, msg.Original, types.TimeNow(), msg.Timestamp, nil))
+			return
+		}
+		if len(fixed) == 0 {
+			sess.queueOut(InfoNotModifiedReply(msg, types.TimeNow()))
+			return
+		}
+		log.Println("set.repair: repaired topic", name, fixed)
+		fixed["what"] = "repair"
+		fixed["topic"] = msg.Set.Repair.Topic
+		sess.queueOut(NoErrParamsReply(msg, types.TimeNow(), fixed))
+	}()
+
+	return nil
+}
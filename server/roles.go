@@ -0,0 +1,78 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *    Named roles of subscribers of group topics: labels such as "moderator"
+ *    which clients render as badges. Roles are assigned by the topic admins
+ *    and don't change the access mode of the subscriber.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"errors"
+
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+// Known roles.
+var validRoles = map[string]bool{
+	"moderator": true,
+	"speaker":   true,
+	"guest":     true,
+}
+
+// replySetRole assigns the role to the subscriber of a group topic or clears it. Admins and owners only.
+func (t *Topic) replySetRole(sess *Session, asUid, target types.Uid, msg *ClientComMessage) error {
+	now := types.TimeNow()
+
+	if t.cat != types.TopicCatGrp {
+		sess.queueOut(ErrOperationNotAllowedReply(msg, now))
+		return errors.New("set.sub.role: invalid topic category")
+	}
+	if asChan, _ := t.verifyChannelAccess(msg.Original); asChan {
+		sess.queueOut(ErrOperationNotAllowedReply(msg, now))
+		return errors.New("set.sub.role: roles cannot be assigned in channels")
+	}
+
+	role := *msg.Set.Sub.Role
+	if role != "" && !validRoles[role] {
+		sess.queueOut(ErrMalformedReply(msg, now))
+		return errors.New("set.sub.role: unknown role")
+	}
+
+	if pud, ok := t.perUser[asUid]; !ok || pud.deleted || !((pud.modeGiven & pud.modeWant).IsAdmin() || t.isOwner(asUid)) {
+		sess.queueOut(ErrPermissionDeniedReply(msg, now))
+		return errors.New("set.sub.role: admin access required")
+	}
+	if pud, ok := t.perUser[target]; !ok || pud.deleted {
+		sess.queueOut(ErrUserNotFoundReply(msg, now))
+		return errors.New("set.sub.role: not a subscriber")
+	}
+
+	sub, err := store.Subs.Get(t.name, target)
+	if err == nil && sub == nil {
+		err = types.ErrNotFound
+	}
+	if err != nil {
+		sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, msg.Original, now, msg.Timestamp, nil))
+		return err
+	}
+	if sub.Role == role {
+		sess.queueOut(InfoNotModifiedReply(msg, now))
+		return nil
+	}
+
+	if err := store.Subs.Update(t.name, target, map[string]interface{}{"Role": role}, true); err != nil {
+		sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, msg.Original, now, msg.Timestamp, nil))
+		return err
+	}
+
+	// Let the subscribers update the badge of the user.
+	t.presSubsOnline("role", target.UserId(), &presParams{actor: asUid.UserId(), role: role}, &presFilters{}, "")
+	sess.queueOut(NoErrParamsReply(msg, now, map[string]interface{}{"what": "role", "user": target.UserId(), "role": role}))
+
+	return nil
+}
@@ -0,0 +1,141 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *    Full-text search of messages in a topic.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"errors"
+	"strings"
+	"unicode"
+
+	"github.com/tinode/chat/server/drafty"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+const (
+	// Maximum length of the search query in bytes.
+	searchMaxQueryLength = 256
+	// Length of the snippet of the found message in characters.
+	searchSnippetLength = 80
+	// Number of characters shown before the match in the snippet.
+	searchSnippetLead = 24
+)
+
+// replyGetDataSearch finds messages matching the full-text query and returns their IDs with snippets
+// of the text around the match. The caller checks that the user may read the topic.
+func (t *Topic) replyGetDataSearch(sess *Session, asUid types.Uid, asChan bool, req *MsgGetOpts, msg *ClientComMessage) error {
+	now := types.TimeNow()
+	toriginal := t.original(asUid)
+
+	query := strings.TrimSpace(req.Query)
+	if query == "" || len(query) > searchMaxQueryLength {
+		sess.queueOut(ErrMalformedReply(msg, now))
+		return errors.New("get.data: invalid search query")
+	}
+
+	messages, err := store.Messages.Search(t.name, asUid, query, msgOpts2storeOpts(req))
+	if err != nil {
+		sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, toriginal, now, msg.Timestamp, nil))
+		return err
+	}
+	if len(messages) == 0 {
+		sess.queueOut(NoContentParamsReply(msg, now, map[string]interface{}{"what": "data"}))
+		return nil
+	}
+
+	found := make([]MsgFoundMessage, 0, len(messages))
+	for i := range messages {
+		mm := &messages[i]
+		from := ""
+		if !asChan {
+			// Don't show sender for channel readers
+			from = types.ParseUid(mm.From).UserId()
+		}
+		createdAt := mm.CreatedAt
+		found = append(found, MsgFoundMessage{
+			SeqId:     mm.SeqId,
+			From:      from,
+			Timestamp: &createdAt,
+			Snippet:   searchSnippet(mm.Content, query),
+		})
+	}
+
+	sess.queueOut(&ServerComMessage{
+		Meta: &MsgServerMeta{Id: msg.Id, Topic: toriginal, Timestamp: &now, Found: found}})
+
+	return nil
+}
+
+// searchSnippet cuts the part of the message text around the first occurrence of any of the query terms.
+func searchSnippet(content interface{}, query string) string {
+	text, err := drafty.ToPlainText(content)
+	if err != nil || text == "" {
+		return ""
+	}
+	text = strings.Join(strings.Fields(text), " ")
+
+	runes := []rune(text)
+	lower := make([]rune, len(runes))
+	for i, r := range runes {
+		lower[i] = unicode.ToLower(r)
+	}
+
+	// Position of the earliest match of a query term.
+	pos := -1
+	for _, term := range strings.Fields(query) {
+		// Drop operators of the boolean search syntax.
+		term = strings.Trim(term, "+-~<>()\"*")
+		if term == "" {
+			continue
+		}
+		at := runeIndex(lower, []rune(strings.ToLower(term)))
+		if at >= 0 && (pos < 0 || at < pos) {
+			pos = at
+		}
+	}
+
+	start := 0
+	if pos > searchSnippetLead {
+		start = pos - searchSnippetLead
+	}
+	end := start + searchSnippetLength
+	if end > len(runes) {
+		end = len(runes)
+		// Show more text before the match if the match is close to the end.
+		if start = end - searchSnippetLength; start < 0 {
+			start = 0
+		}
+	}
+
+	snippet := string(runes[start:end])
+	if start > 0 {
+		snippet = "…" + snippet
+	}
+	if end < len(runes) {
+		snippet += "…"
+	}
+	return snippet
+}
+
+// runeIndex returns the index of the first occurrence of sub in str or -1.
+func runeIndex(str, sub []rune) int {
+	for i := 0; i+len(sub) <= len(str); i++ {
+		match := true
+		for j := range sub {
+			if str[i+j] != sub[j] {
+				match = false
+				break
+			}
+		}
+		if match {
+			return i
+		}
+	}
+	return -1
+}
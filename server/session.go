@@ -34,9 +34,18 @@ import (
 // https://elixir.bootlin.com/linux/latest/source/kernel/sched/fair.c#L38
 const sendTimeout = time.Millisecond * 7
 
-// Maximum number of queued messages before session is considered stale and dropped.
+// Maximum time to wait for a session to accept a request to detach from a topic.
+// Sessions which don't accept it in time are considered stuck.
+const detachTimeout = time.Millisecond * 500
+
+// Maximum number of queued messages in the send channel.
 const sendQueueLimit = 128
 
+// Maximum number of {data}, {ctrl} and {meta} messages which did not fit into the send queue
+// before the session is considered stale and dropped. {pres} and {info} are never kept in
+// overflow, they are dropped when the send queue is full.
+const sendOverflowLimit = 1024
+
 // Time given to a background session to terminate to avoid tiggering presence notifications.
 // If session terminates (or unsubscribes from topic) in this time frame notifications are not sent at all.
 const deferredNotificationsTimeout = time.Second * 5
@@ -89,6 +98,10 @@ type Session struct {
 	// IP address of the client. For long polling this is the IP of the last poll.
 	remoteAddr string
 
+	// IP address and users the session is counted against in session limits. Guarded by sessionLimits.lock.
+	limitIP   string
+	limitUids []types.Uid
+
 	// User agent, a string provived by an authenticated client in {login} packet.
 	userAgent string
 
@@ -105,12 +118,18 @@ type Session struct {
 	countryCode string
 
 	// ID of the current user. Could be zero if session is not authenticated
-	// or for multiplexing sessions.
+	// or for multiplexing sessions. Changed under accountsLock: other goroutines must read it
+	// with activeAccount().
 	uid types.Uid
 
-	// Authentication level - NONE (unset), ANON, AUTH, ROOT.
+	// Authentication level - NONE (unset), ANON, AUTH, ROOT. Changed under accountsLock.
 	authLvl auth.Level
 
+	// Accounts authenticated in this session in addition to the active one, indexed by user ID.
+	// Guarded by accountsLock.
+	accounts     map[types.Uid]*sessionAccount
+	accountsLock sync.RWMutex
+
 	// Time when the long polling session was last refreshed
 	lastTouched time.Time
 
@@ -139,6 +158,22 @@ type Session struct {
 	// The content must be serialized in format suitable for the session.
 	send chan interface{}
 
+	// High priority outbound messages which did not fit into 'send', in the order they were queued.
+	// Guarded by overflowLock.
+	overflow     []interface{}
+	overflowLock sync.Mutex
+	// Number of messages in the overflow queue. Read/written atomically.
+	overflowLen int32
+	// Wakes up the write loop when messages are added to the overflow queue or dropped,
+	// in case it has already drained the send queue. Buffered by 1.
+	overflowReady chan struct{}
+	// Number of low priority messages dropped since the client was last notified of the gap.
+	// Read/written atomically.
+	droppedCount int32
+	// Number of unacknowledged messages redelivered to the session across all topics.
+	// Read/written atomically.
+	redelivered int32
+
 	// Channel for shutting down the session, buffer 1.
 	// Content in the same format as for 'send'
 	stop chan interface{}
@@ -157,12 +192,34 @@ type Session struct {
 	// Needed for long polling and grpc.
 	lock sync.Mutex
 
+	// Highest seq ID of {data} delivered through proxy topics, indexed by topic name.
+	// Used to drop messages re-broadcast after the topic master moved to another node.
+	// Guarded by deliveredLock.
+	delivered     map[string]int
+	deliveredLock sync.Mutex
+
 	// Field used only in cluster mode by topic master node.
 
 	// Type of proxy to master request being handled.
 	proxyReq ProxyReqType
 
+	// Organization of the active account. Changed under accountsLock: other goroutines must read it
+	// with activeAccount().
 	OrganizationId string
+
+	// The client application is too old: the session is read-only. Parameters of the requirement
+	// are reported to the client when a request is rejected.
+	upgradeRequired map[string]interface{}
+
+	// Class of the client for selecting the client configuration, *clientClass.
+	// Updated by the session, read by the configuration broadcaster.
+	confClass atomic.Value
+}
+
+// sessionAccount is an additional account authenticated in the session.
+type sessionAccount struct {
+	authLvl auth.Level
+	org     string
 }
 
 // Subscription is a mapper of sessions to topics.
@@ -179,6 +236,9 @@ type Subscription struct {
 
 	// Channel to ping topic with session's updates
 	supd chan<- *sessionUpdate
+
+	// Account on behalf of which the topic is attached. Zero for guests.
+	uid types.Uid
 }
 
 func (s *Session) addSub(topic string, sub *Subscription) {
@@ -224,6 +284,36 @@ func (s *Session) countSub() int {
 	return len(s.subs)
 }
 
+// markDelivered records delivery of a {data} message received from the topic master through
+// a proxy topic. Returns false if the message with the same or later seq ID was already delivered,
+// e.g. when it's re-broadcast after a cluster failover. Edits of earlier messages are always delivered.
+func (s *Session) markDelivered(topic string, data *MsgServerData) bool {
+	if msgReplaceSeq(data.Head) > 0 {
+		return true
+	}
+
+	s.deliveredLock.Lock()
+	defer s.deliveredLock.Unlock()
+
+	if data.SeqId <= s.delivered[topic] {
+		return false
+	}
+	if s.delivered == nil {
+		s.delivered = make(map[string]int)
+	}
+	s.delivered[topic] = data.SeqId
+	return true
+}
+
+// forgetDelivered clears the delivery high-water mark of the topic. Called when the user
+// unsubscribes, is evicted from the topic or is told the topic is gone: seq IDs may start over
+// if the topic is created again.
+func (s *Session) forgetDelivered(topic string) {
+	s.deliveredLock.Lock()
+	delete(s.delivered, topic)
+	s.deliveredLock.Unlock()
+}
+
 // Inform topics that the session is being terminated.
 // No need to check for s.multi because it's not called for PROXY sessions.
 func (s *Session) unsubAll() {
@@ -237,6 +327,45 @@ func (s *Session) unsubAll() {
 	}
 }
 
+// logoutAccount logs out one of the accounts authenticated in the session.
+func (s *Session) logoutAccount(uid types.Uid) {
+	s.accountsLock.Lock()
+	defer s.accountsLock.Unlock()
+
+	if uid == s.uid {
+		s.uid, s.authLvl, s.OrganizationId = types.ZeroUid, auth.LevelNone, ""
+	} else {
+		delete(s.accounts, uid)
+	}
+}
+
+// evictAccount logs out one of several accounts authenticated in the session and detaches the topics
+// attached on behalf of the account. The session stays open for the other accounts. If the active
+// account is evicted, the session has no active account until the client switches to another one.
+func (s *Session) evictAccount(uid types.Uid, now time.Time) {
+	s.logoutAccount(uid)
+
+	var detach []string
+	s.subsLock.RLock()
+	for topic, sub := range s.subs {
+		if sub.uid == uid {
+			detach = append(detach, topic)
+		}
+	}
+	s.subsLock.RUnlock()
+
+	for _, topic := range detach {
+		if sub := s.getSub(topic); sub != nil {
+			s.delSub(topic)
+			sub.done <- &sessionLeave{sess: s}
+		}
+	}
+
+	evicted := NoErrEvicted("", "", now)
+	evicted.Ctrl.Params = map[string]interface{}{"user": uid.UserId()}
+	s.queueOut(evicted)
+}
+
 // Represents a proxied (remote) session.
 type remoteSession struct {
 	// User id of the proxied session.
@@ -288,16 +417,18 @@ func (s *Session) queueOut(msg *ServerComMessage) bool {
 		} else {
 			log.Println("Invalid response code: ", msg.Ctrl.Code)
 		}
+		if msg.Ctrl.Code >= 400 && msg.Ctrl.Hint == "" {
+			// Describe the error in the language of the client.
+			msg.Ctrl.Hint = i18nHint(s.lang, msg.Ctrl)
+		}
 	}
 
 	dataSize, data := s.serialize(msg)
 	if dataSize >= 0 {
 		statsAddHistSample("OutgoingMessageSize", float64(dataSize))
 	}
-	select {
-	case s.send <- data:
-	default:
-		// Never block here since it may also block the topic's run() goroutine.
+	// Never block here since it may also block the topic's run() goroutine.
+	if !s.enqueue(data, msg.Pres != nil || msg.Info != nil) {
 		log.Println("s.queueOut: session's send queue full", s.sid)
 		return false
 	}
@@ -311,18 +442,130 @@ func (s *Session) queueOutBytes(data []byte) bool {
 		return true
 	}
 
-	select {
-	case s.send <- data:
-	default:
+	if !s.enqueue(data, false) {
 		log.Println("s.queueOutBytes: session's send queue full", s.sid)
 		return false
 	}
 	return true
 }
 
-func (s *Session) detachSession(fromTopic string) {
-	if atomic.LoadInt32(&s.terminating) == 0 {
-		s.detach <- fromTopic
+// enqueue places a serialized message into the send queue without blocking.
+// If the send queue is full, droppable (low priority) messages are discarded and counted,
+// all other messages are kept in the overflow queue to be sent once the queue drains.
+// Returns false if the session cannot keep up and must be dropped.
+func (s *Session) enqueue(data interface{}, droppable bool) bool {
+	if s.isCluster() {
+		// Cluster sessions have no overflow: messages are forwarded to other nodes.
+		select {
+		case s.send <- data:
+			return true
+		default:
+			return false
+		}
+	}
+
+	s.overflowLock.Lock()
+	defer s.overflowLock.Unlock()
+
+	// Nothing is waiting in overflow, try to queue directly. The lock keeps the message
+	// from overtaking the ones being moved from the overflow by the write loop.
+	if len(s.overflow) == 0 {
+		select {
+		case s.send <- data:
+			return true
+		default:
+		}
+	}
+
+	if droppable {
+		atomic.AddInt32(&s.droppedCount, 1)
+		statsInc("OutgoingMessagesDroppedTotal", 1)
+	} else {
+		if len(s.overflow) >= sendOverflowLimit {
+			return false
+		}
+		s.overflow = append(s.overflow, data)
+		atomic.StoreInt32(&s.overflowLen, int32(len(s.overflow)))
+	}
+
+	// The write loop may have drained the send queue already. Make sure it checks the overflow.
+	select {
+	case s.overflowReady <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// sendOverflow moves messages from the overflow queue into the send queue as space becomes available.
+// Once the overflow is cleared, informs the client of any dropped notifications so it can resync.
+// Must be called by the write loop after a message is taken from the send queue and when
+// woken up by overflowReady.
+func (s *Session) sendOverflow() {
+	if atomic.LoadInt32(&s.overflowLen) == 0 && atomic.LoadInt32(&s.droppedCount) == 0 {
+		return
+	}
+
+	s.overflowLock.Lock()
+	defer s.overflowLock.Unlock()
+
+	sent := 0
+loop:
+	for _, data := range s.overflow {
+		select {
+		case s.send <- data:
+			sent++
+		default:
+			break loop
+		}
+	}
+	if sent > 0 {
+		// Release references to sent messages.
+		for i := 0; i < sent; i++ {
+			s.overflow[i] = nil
+		}
+		s.overflow = s.overflow[sent:]
+		if len(s.overflow) == 0 {
+			s.overflow = nil
+		}
+		atomic.StoreInt32(&s.overflowLen, int32(len(s.overflow)))
+	}
+
+	if len(s.overflow) > 0 {
+		return
+	}
+
+	if dropped := atomic.SwapInt32(&s.droppedCount, 0); dropped > 0 {
+		_, data := s.serialize(NoErrDropped(types.TimeNow(), int(dropped)))
+		select {
+		case s.send <- data:
+		default:
+			// Try again next time.
+			atomic.AddInt32(&s.droppedCount, dropped)
+		}
+	}
+}
+
+// detachSession tells the session to remove the topic. Returns false if the session
+// did not accept the request within detachTimeout.
+func (s *Session) detachSession(fromTopic string) bool {
+	if atomic.LoadInt32(&s.terminating) > 0 {
+		return true
+	}
+
+	select {
+	case s.detach <- fromTopic:
+		return true
+	default:
+	}
+
+	// The queue is full. Wait for it to drain.
+	timer := time.NewTimer(detachTimeout)
+	defer timer.Stop()
+	select {
+	case s.detach <- fromTopic:
+		return true
+	case <-timer.C:
+		return false
 	}
 }
 
@@ -331,6 +574,11 @@ func (s *Session) stopSession(data interface{}) {
 }
 
 func (sess *Session) purgeChannels() {
+	sess.overflowLock.Lock()
+	sess.overflow = nil
+	atomic.StoreInt32(&sess.overflowLen, 0)
+	sess.overflowLock.Unlock()
+
 	for len(sess.send) > 0 {
 		<-sess.send
 	}
@@ -353,6 +601,8 @@ func (s *Session) cleanUp(expired bool) {
 		s.sessionStoreLock.Unlock()
 	}
 
+	s.sessionLimitsRelease()
+
 	s.background = false
 	s.bkgTimer.Stop()
 	s.unsubAll()
@@ -383,7 +633,8 @@ func (s *Session) dispatchRaw(raw []byte) {
 		toLog = raw[:512]
 		truncated = "<...>"
 	}
-	log.Printf("in: '%s%s' sid='%s' uid='%s'", toLog, truncated, s.sid, s.uid)
+	uid, _, _ := s.activeAccount()
+	log.Printf("in: '%s%s' sid='%s' uid='%s'", toLog, truncated, s.sid, uid)
 
 	if err := json.Unmarshal(raw, &msg); err != nil {
 		// Malformed message
@@ -400,14 +651,29 @@ func (s *Session) dispatch(msg *ClientComMessage) {
 	atomic.StoreInt64(&s.lastAction, now.UnixNano())
 	msg.Timestamp = now
 
-	if s.OrganizationId != "" {
-		msg.OrganizationId = s.OrganizationId
+	uid, authLvl, org := s.activeAccount()
+	if org != "" {
+		msg.OrganizationId = org
 	}
 
-	if msg.AsUser == "" {
-		msg.AsUser = s.uid.UserId()
-		msg.AuthLvl = int(s.authLvl)
-	} else if s.authLvl != auth.LevelRoot {
+	if msg.AsUser == "" && msg.From == "" {
+		msg.AsUser = uid.UserId()
+		msg.AuthLvl = int(authLvl)
+	} else if msg.AsUser == "" {
+		// Request addressed to one of the accounts authenticated in this session.
+		lvl, org, ok := s.account(types.ParseUserId(msg.From))
+		if !ok {
+			s.queueOut(ErrPermissionDenied("", "", msg.Timestamp))
+			log.Println("s.dispatch: account is not authenticated", msg.From, s.sid)
+			return
+		}
+		msg.AsUser = msg.From
+		msg.AuthLvl = int(lvl)
+		msg.OrganizationId = org
+	} else if lvl, org, ok := s.account(types.ParseUserId(msg.AsUser)); ok {
+		msg.AuthLvl = int(lvl)
+		msg.OrganizationId = org
+	} else if authLvl != auth.LevelRoot {
 		// Only root user can set non-default msg.from && msg.authLvl values.
 		s.queueOut(ErrPermissionDenied("", "", msg.Timestamp))
 		log.Println("s.dispatch: non-root asigned msg.from", s.sid)
@@ -446,6 +712,24 @@ func (s *Session) dispatch(msg *ClientComMessage) {
 		}
 	}
 
+	// Check if the session is allowed to make changes
+	checkWrite := func(m *ClientComMessage, handler func(*ClientComMessage)) func(*ClientComMessage) {
+		return func(m *ClientComMessage) {
+			if s.upgradeRequired != nil {
+				s.queueOut(ErrUpgradeRequired(m.Id, m.Original, msg.Timestamp, s.upgradeRequired))
+				return
+			}
+			// Root users may make changes during maintenance.
+			if auth.Level(m.AuthLvl) != auth.LevelRoot {
+				if resp := maintenanceReject(m); resp != nil {
+					s.queueOut(resp)
+					return
+				}
+			}
+			handler(m)
+		}
+	}
+
 	// Check if user is logged in
 	checkUser := func(m *ClientComMessage, handler func(*ClientComMessage)) func(*ClientComMessage) {
 		return func(m *ClientComMessage) {
@@ -460,13 +744,18 @@ func (s *Session) dispatch(msg *ClientComMessage) {
 
 	switch {
 	case msg.Pub != nil:
-		handler = checkVers(msg, checkUser(msg, s.publish))
+		handler = checkVers(msg, checkUser(msg, checkWrite(msg, s.publish)))
 		msg.Id = msg.Pub.Id
 		msg.Original = msg.Pub.Topic
 		uaRefresh = true
 
 	case msg.Sub != nil:
-		handler = checkVers(msg, checkUser(msg, s.subscribe))
+		if msg.Sub.Guest != "" && msg.AsUser == "" {
+			// Read-only guest access to a channel does not require authentication.
+			handler = checkVers(msg, s.subscribeGuest)
+		} else {
+			handler = checkVers(msg, checkUser(msg, s.subscribe))
+		}
 		msg.Id = msg.Sub.Id
 		msg.Original = msg.Sub.Topic
 		uaRefresh = true
@@ -492,18 +781,18 @@ func (s *Session) dispatch(msg *ClientComMessage) {
 		uaRefresh = true
 
 	case msg.Set != nil:
-		handler = checkVers(msg, checkUser(msg, s.set))
+		handler = checkVers(msg, checkUser(msg, checkWrite(msg, s.set)))
 		msg.Id = msg.Set.Id
 		msg.Original = msg.Set.Topic
 		uaRefresh = true
 
 	case msg.Del != nil:
-		handler = checkVers(msg, checkUser(msg, s.del))
+		handler = checkVers(msg, checkUser(msg, checkWrite(msg, s.del)))
 		msg.Id = msg.Del.Id
 		msg.Original = msg.Del.Topic
 
 	case msg.Acc != nil:
-		handler = checkVers(msg, s.acc)
+		handler = checkVers(msg, checkWrite(msg, s.acc))
 		msg.Id = msg.Acc.Id
 
 	case msg.Note != nil:
@@ -551,20 +840,40 @@ func (s *Session) subscribe(msg *ClientComMessage) {
 		}
 	}
 
+	// Accounts waiting for approval can only use 'me'.
+	if msg.Original != "me" && registrationIsPending(types.ParseUserId(msg.AsUser)) {
+		resp := ErrPermissionDeniedReply(msg, msg.Timestamp)
+		resp.Ctrl.Params = map[string]interface{}{"what": "pending"}
+		s.queueOut(resp)
+		return
+	}
+
+	// Users may create a limited number of group topics. Root is not limited.
+	if (strings.HasPrefix(msg.Original, "new") || strings.HasPrefix(msg.Original, "nch")) &&
+		auth.Level(msg.AuthLvl) != auth.LevelRoot {
+		if retry := topicCreationAllow(types.ParseUserId(msg.AsUser), msg.OrganizationId); retry > 0 {
+			resp := ErrPolicyReply(msg, msg.Timestamp)
+			// Retry delay is rounded up to whole seconds.
+			resp.Ctrl.Params = map[string]interface{}{"what": "rate", "retry": int((retry + time.Second - 1) / time.Second)}
+			s.queueOut(resp)
+			return
+		}
+	}
+
 	// Session can subscribe to topic on behalf of a single user at a time.
 	if sub := s.getSub(msg.RcptTo); sub != nil {
 		s.queueOut(InfoAlreadySubscribed(msg.Id, msg.Original, msg.Timestamp))
 	} else {
 		s.inflightReqs.Add(1)
 		select {
-		case globals.hub.join <- &sessionJoin{
+		case globals.hub.shardFor(msg.RcptTo).join <- &sessionJoin{
 			pkt:  msg,
 			sess: s}:
 		default:
 			// Reply with a 500 to the user.
 			s.queueOut(ErrUnknownReply(msg, msg.Timestamp))
 			s.inflightReqs.Done()
-			log.Println("s.subscribe: hub.join queue full, topic ", msg.RcptTo, s.sid)
+			queueOverflow("s.subscribe", queueHubJoin, msg.RcptTo, s.sid, len(globals.hub.shardFor(msg.RcptTo).join))
 		}
 		// Hub will send Ctrl success/failure packets back to session
 	}
@@ -588,6 +897,9 @@ func (s *Session) leave(msg *ClientComMessage) {
 		} else {
 			// Unlink from topic, topic will send a reply.
 			s.delSub(msg.RcptTo)
+			if msg.Leave.Unsub {
+				s.forgetDelivered(msg.RcptTo)
+			}
 			s.inflightReqs.Add(1)
 			sub.done <- &sessionLeave{
 				pkt:  msg,
@@ -615,11 +927,12 @@ func (s *Session) publish(msg *ClientComMessage) {
 	}
 
 	// Add "sender" header if the message is sent on behalf of another user.
-	if msg.AsUser != s.uid.UserId() {
+	if _, _, own := s.account(types.ParseUserId(msg.AsUser)); !own {
 		if msg.Pub.Head == nil {
 			msg.Pub.Head = make(map[string]interface{})
 		}
-		msg.Pub.Head["sender"] = s.uid.UserId()
+		uid, _, _ := s.activeAccount()
+		msg.Pub.Head["sender"] = uid.UserId()
 	} else if msg.Pub.Head != nil {
 		// Clear potentially false "sender" field.
 		delete(msg.Pub.Head, "sender")
@@ -633,7 +946,8 @@ func (s *Session) publish(msg *ClientComMessage) {
 		From:      msg.AsUser,
 		Timestamp: msg.Timestamp,
 		Head:      msg.Pub.Head,
-		Content:   msg.Pub.Content},
+		Content:   msg.Pub.Content,
+		pbContent: msg.Pub.pbContent},
 		// Internal-only values.
 		Id:        msg.Id,
 		RcptTo:    msg.RcptTo,
@@ -650,17 +964,20 @@ func (s *Session) publish(msg *ClientComMessage) {
 		default:
 			// Reply with a 500 to the user.
 			s.queueOut(ErrUnknownReply(msg, msg.Timestamp))
-			log.Println("s.publish: sub.broadcast channel full, topic ", msg.RcptTo, s.sid)
+			queueOverflow("s.publish", queueTopicBroadcast, msg.RcptTo, s.sid, len(sub.broadcast))
 		}
 	} else if msg.RcptTo == "sys" {
 		// Publishing to "sys" topic requires no subsription.
 		select {
-		case globals.hub.route <- data:
+		case globals.hub.shardFor(data.RcptTo).route <- data:
 		default:
 			// Reply with a 500 to the user.
 			s.queueOut(ErrUnknownReply(msg, msg.Timestamp))
-			log.Println("s.publish: hub.route channel full", s.sid)
+			queueOverflow("s.publish", queueHubRoute, msg.RcptTo, s.sid, len(globals.hub.shardFor(msg.RcptTo).route))
 		}
+	} else if isDirectPublish(msg) {
+		// Direct message to a user: the p2p topic is created or loaded by the hub.
+		s.publishDirect(msg, data)
 	} else {
 		// Publish request received without attaching to topic first.
 		s.queueOut(ErrAttachFirst(msg, msg.Timestamp))
@@ -688,24 +1005,42 @@ func (s *Session) hello(msg *ClientComMessage) {
 			return
 		}
 
+		live := liveConfig()
 		params = map[string]interface{}{
 			"ver":                currentVersion,
 			"build":              store.GetAdapterName() + ":" + buildstamp,
-			"maxMessageSize":     globals.maxMessageSize,
-			"maxSubscriberCount": globals.maxSubscriberCount,
+			"maxMessageSize":     live.maxMessageSize,
+			"maxAttachments":     live.maxAttachments,
+			"maxSubscriberCount": live.maxSubscriberCount,
 			"minTagLength":       minTagLength,
 			"maxTagLength":       maxTagLength,
-			"maxTagCount":        globals.maxTagCount,
+			"maxTagCount":        live.maxTagCount,
 			"maxFileUploadSize":  globals.maxFileUploadSize,
 		}
+		if maint := maintenanceParams(msg.Timestamp); maint != nil {
+			params["maintenance"] = maint
+		}
+
+		platf := msg.Hi.Platform
+		if platf == "" {
+			platf = platformFromUA(msg.Hi.UserAgent)
+		}
+		if mcv := clientUpgradeRequired(msg.Hi.UserAgent, platf); mcv != nil {
+			if !mcv.ReadOnly {
+				s.ver = 0
+				s.queueOut(ErrUpgradeRequired(msg.Id, "", msg.Timestamp, mcv.params(platf)))
+				log.Println("s.hello:", "client upgrade required", msg.Hi.UserAgent, s.sid)
+				return
+			}
+			// Grace mode: the client can read but cannot make changes.
+			s.upgradeRequired = mcv.params(platf)
+			params["upgrade"] = s.upgradeRequired
+		}
 
 		// Set ua & platform in the beginning of the session.
 		// Don't change them later.
 		s.userAgent = msg.Hi.UserAgent
-		s.platf = msg.Hi.Platform
-		if s.platf == "" {
-			s.platf = platformFromUA(msg.Hi.UserAgent)
-		}
+		s.platf = platf
 		// This is a background session. Start a timer.
 		if msg.Hi.Background {
 			s.bkgTimer.Reset(deferredNotificationsTimeout)
@@ -713,14 +1048,14 @@ func (s *Session) hello(msg *ClientComMessage) {
 	} else if msg.Hi.Version == "" || parseVersion(msg.Hi.Version) == s.ver {
 		// Save changed device ID+Lang or delete earlier specified device ID.
 		// Platform cannot be changed.
-		if !s.uid.IsZero() {
+		if uid, _, _ := s.activeAccount(); !uid.IsZero() {
 			var err error
 			if msg.Hi.DeviceID == types.NullValue {
 				deviceIDUpdate = true
-				err = store.Devices.Delete(s.uid, s.deviceID)
+				err = store.Devices.Delete(uid, s.deviceID)
 			} else if msg.Hi.DeviceID != "" {
 				deviceIDUpdate = true
-				err = store.Devices.Update(s.uid, s.deviceID, &types.DeviceDef{
+				err = store.Devices.Update(uid, s.deviceID, &types.DeviceDef{
 					DeviceId: msg.Hi.DeviceID,
 					Platform: s.platf,
 					LastSeen: msg.Timestamp,
@@ -746,6 +1081,17 @@ func (s *Session) hello(msg *ClientComMessage) {
 		s.userAgent = msg.Hi.UserAgent
 	}
 
+	// Client configuration depends on the user agent. Send it in response to the first {hi} and
+	// whenever the user agent changes.
+	if class := clientClassFor(s.userAgent, s.platf, s.activeOrg()); s.updateConfClass(class) || params != nil {
+		if config := clientConfGet(class); config != nil {
+			if params == nil {
+				params = map[string]interface{}{}
+			}
+			params["config"] = config
+		}
+	}
+
 	if msg.Hi.DeviceID == types.NullValue {
 		msg.Hi.DeviceID = ""
 	}
@@ -787,13 +1133,23 @@ func (s *Session) hello(msg *ClientComMessage) {
 	s.queueOut(&ServerComMessage{Ctrl: ctrl})
 }
 
+// updateConfClass saves the class of the client for selecting the client configuration.
+// Returns true if the class has changed.
+func (s *Session) updateConfClass(class *clientClass) bool {
+	if old, _ := s.confClass.Load().(*clientClass); old != nil && *old == *class {
+		return false
+	}
+	s.confClass.Store(class)
+	return true
+}
+
 // Account creation
 func (s *Session) acc(msg *ClientComMessage) {
 
 	// If token is provided, get the user ID from it.
 	var rec *auth.Rec
 	if msg.Acc.Token != nil {
-		if !s.uid.IsZero() {
+		if uid, _, _ := s.activeAccount(); !uid.IsZero() {
 			s.queueOut(ErrAlreadyAuthenticated(msg.Acc.Id, "", msg.Timestamp))
 			log.Println("s.acc: got token while already authenticated", s.sid)
 			return
@@ -831,13 +1187,23 @@ func (s *Session) login(msg *ClientComMessage) {
 		return
 	}
 
-	if !s.uid.IsZero() {
+	if msg.Login.Switch != "" {
+		s.switchAccount(msg)
+		return
+	}
+
+	if uid, _, _ := s.activeAccount(); !uid.IsZero() && !msg.Login.Add {
 		// TODO: change error to notice InfoNoChange and return current user ID & auth level
 		// params := map[string]interface{}{"user": s.uid.UserId(), "authlvl": s.authLevel.String()}
 		s.queueOut(ErrAlreadyAuthenticated(msg.Id, "", msg.Timestamp))
 		return
 	}
 
+	if msg.Login.Add && s.accountCount() >= maxSessionAccounts {
+		s.queueOut(ErrPolicyLimitReply(msg, msg.Timestamp, "accounts", maxSessionAccounts))
+		return
+	}
+
 	handler := store.GetLogicalAuthHandler(msg.Login.Scheme)
 	if handler == nil {
 		log.Println("s.login: unknown authentication scheme", msg.Login.Scheme, s.sid)
@@ -860,7 +1226,9 @@ func (s *Session) login(msg *ClientComMessage) {
 	if rec.State == types.StateUndefined {
 		rec.State, err = userGetState(rec.Uid)
 	}
-	if err == nil && rec.State != types.StateOK {
+	// Deactivated accounts are reactivated by logging in. Pending accounts may log in but cannot join topics.
+	if err == nil && rec.State != types.StateOK && rec.State != types.StateDeactivated &&
+		rec.State != types.StatePending {
 		err = types.ErrPermissionDenied
 	}
 
@@ -885,11 +1253,22 @@ func (s *Session) login(msg *ClientComMessage) {
 			_, missing = stringSliceDelta(globals.authValidators[rec.AuthLevel], validated)
 		}
 	}
+	if err == nil && rec.State == types.StateDeactivated && len(missing) == 0 &&
+		rec.Features&auth.FeatureNoLogin == 0 {
+		// The user logged in within the grace period: reactivate the account.
+		if err = userReactivate(rec.Uid); err != nil {
+			log.Println("s.login: failed to reactivate user", rec.Uid, err, s.sid)
+		}
+	}
 	if err != nil {
 		log.Println("s.login: failed to validate credentials:", err, s.sid)
 		s.queueOut(decodeStoreError(err, msg.Id, "", msg.Timestamp, nil))
 	} else {
-		s.queueOut(s.onLogin(msg.Id, msg.Timestamp, rec, missing))
+		reply := s.onLogin(msg.Id, msg.Timestamp, rec, missing)
+		if reply.Ctrl.Code == http.StatusOK && rec.Features&auth.FeatureNoLogin == 0 {
+			activityRecord(s.activityEvent(rec.Uid, activityLogin, msg.Login.Scheme))
+		}
+		s.queueOut(reply)
 	}
 }
 
@@ -939,6 +1318,118 @@ func (s *Session) authSecretReset(params []byte) error {
 	return validator.ResetSecret(credValue, authScheme, s.lang, token, resetParams)
 }
 
+// activeAccount returns the ID, the authentication level and the organization of the active account.
+func (s *Session) activeAccount() (types.Uid, auth.Level, string) {
+	s.accountsLock.RLock()
+	defer s.accountsLock.RUnlock()
+	return s.uid, s.authLvl, s.OrganizationId
+}
+
+// activeOrg returns the organization of the active account.
+func (s *Session) activeOrg() string {
+	_, _, org := s.activeAccount()
+	return org
+}
+
+// setActiveAccount changes the active account of the session. A zero uid logs the session out.
+func (s *Session) setActiveAccount(uid types.Uid, authLvl auth.Level, org string) {
+	s.accountsLock.Lock()
+	s.uid, s.authLvl, s.OrganizationId = uid, authLvl, org
+	s.accountsLock.Unlock()
+}
+
+// setActiveOrg sets the organization of the active account if the account is uid or the session
+// has no active account. Returns true if the organization was set.
+func (s *Session) setActiveOrg(uid types.Uid, org string) bool {
+	s.accountsLock.Lock()
+	defer s.accountsLock.Unlock()
+
+	if !s.uid.IsZero() && s.uid != uid {
+		return false
+	}
+	s.OrganizationId = org
+	return true
+}
+
+// account returns the authentication level and the organization of an account authenticated in the session,
+// either active or additional.
+func (s *Session) account(uid types.Uid) (auth.Level, string, bool) {
+	if uid.IsZero() {
+		return auth.LevelNone, "", false
+	}
+
+	s.accountsLock.RLock()
+	defer s.accountsLock.RUnlock()
+	if uid == s.uid {
+		return s.authLvl, s.OrganizationId, true
+	}
+	if acc := s.accounts[uid]; acc != nil {
+		return acc.authLvl, acc.org, true
+	}
+	return auth.LevelNone, "", false
+}
+
+// accountCount returns the number of accounts authenticated in the session.
+func (s *Session) accountCount() int {
+	s.accountsLock.RLock()
+	defer s.accountsLock.RUnlock()
+
+	count := len(s.accounts)
+	if !s.uid.IsZero() {
+		count++
+	}
+	return count
+}
+
+// addAccount adds or updates an additional account authenticated in the session.
+func (s *Session) addAccount(uid types.Uid, authLvl auth.Level, org string) {
+	s.accountsLock.Lock()
+	defer s.accountsLock.Unlock()
+
+	if s.accounts == nil {
+		s.accounts = make(map[types.Uid]*sessionAccount)
+	}
+	s.accounts[uid] = &sessionAccount{authLvl: authLvl, org: org}
+}
+
+// switchAccount makes active another account authenticated in the session. The previously active
+// account remains authenticated. Topics stay attached on behalf of the accounts which attached them.
+func (s *Session) switchAccount(msg *ClientComMessage) {
+	uid := types.ParseUserId(msg.Login.Switch)
+	if uid.IsZero() {
+		s.queueOut(ErrMalformed(msg.Id, "", msg.Timestamp))
+		return
+	}
+
+	s.accountsLock.Lock()
+	if uid != s.uid {
+		acc := s.accounts[uid]
+		if acc == nil {
+			s.accountsLock.Unlock()
+			s.queueOut(ErrPermissionDenied(msg.Id, "", msg.Timestamp))
+			return
+		}
+		delete(s.accounts, uid)
+		if !s.uid.IsZero() {
+			s.accounts[s.uid] = &sessionAccount{authLvl: s.authLvl, org: s.OrganizationId}
+		}
+		s.uid, s.authLvl, s.OrganizationId = uid, acc.authLvl, acc.org
+	}
+	authLvl, org := s.authLvl, s.OrganizationId
+	s.accountsLock.Unlock()
+
+	params := map[string]interface{}{
+		"user":    uid.UserId(),
+		"authlvl": authLvl.String()}
+	// Configuration may be specific to the organization of the account.
+	if class := clientClassFor(s.userAgent, s.platf, org); s.updateConfClass(class) {
+		if config := clientConfGet(class); config != nil {
+			params["config"] = config
+		}
+	}
+	s.queueOut(NoErrParams(msg.Id, "", msg.Timestamp, params))
+}
+
 // onLogin performs steps after successful authentication.
 func (s *Session) onLogin(msgID string, timestamp time.Time, rec *auth.Rec, missing []string) *ServerComMessage {
 
@@ -962,11 +1453,28 @@ func (s *Session) onLogin(msgID string, timestamp time.Time, rec *auth.Rec, miss
 
 		// Check if the token is suitable for session authentication.
 		if features&auth.FeatureNoLogin == 0 {
-			// Authenticate the session.
-			s.uid = rec.Uid
-			s.authLvl = rec.AuthLevel
+			if !s.sessionLimitsAcquireUser(rec.Uid) {
+				log.Println("s.login: too many sessions of the user", rec.Uid.UserId(), s.sid)
+				reply = ErrPolicy(msgID, "", timestamp)
+				reply.Ctrl.Params = map[string]interface{}{"what": "sessions", "limit": sessionLimits.perUser}
+				return reply
+			}
+			if uid, _, org := s.activeAccount(); uid.IsZero() || uid == rec.Uid {
+				// Authenticate the session.
+				s.setActiveAccount(rec.Uid, rec.AuthLevel, org)
+			} else {
+				// Additional account, the active account is unchanged.
+				s.addAccount(rec.Uid, rec.AuthLevel, rec.OrganizationId)
+			}
 			// Reset expiration time.
 			rec.Lifetime = 0
+			// Messages delivered to the session are filtered by the user's block list. Refresh it:
+			// the cached copy may be stale if an update from another cluster node was lost.
+			blockListLoad(rec.Uid)
+			registrationSetPending(rec.Uid, rec.State == types.StatePending)
+		}
+		if rec.State == types.StatePending {
+			params["state"] = rec.State.String()
 		}
 		features |= auth.FeatureValidated
 
@@ -983,8 +1491,16 @@ func (s *Session) onLogin(msgID string, timestamp time.Time, rec *auth.Rec, miss
 		}
 	}
 
-	s.OrganizationId = rec.OrganizationId
-	log.Println("OrganizationId", s.OrganizationId)
+	if s.setActiveOrg(rec.Uid, rec.OrganizationId) {
+		log.Println("OrganizationId", rec.OrganizationId)
+
+		// Configuration may be specific to the organization.
+		if class := clientClassFor(s.userAgent, s.platf, rec.OrganizationId); s.updateConfClass(class) {
+			if config := clientConfGet(class); config != nil {
+				params["config"] = config
+			}
+		}
+	}
 
 	// GenSecret fails only if tokenLifetime is < 0. It can't be < 0 here,
 	// otherwise login would have failed earlier.
@@ -1020,16 +1536,16 @@ func (s *Session) get(msg *ClientComMessage) {
 		default:
 			// Reply with a 500 to the user.
 			s.queueOut(ErrUnknownReply(msg, msg.Timestamp))
-			log.Println("s.get: sub.meta channel full, topic ", msg.RcptTo, s.sid)
+			queueOverflow("s.get", queueTopicMeta, msg.RcptTo, s.sid, len(sub.meta))
 		}
 	} else if meta.pkt.MetaWhat&(constMsgMetaDesc|constMsgMetaSub) != 0 {
 		// Request some minimal info from a topic not currently attached to.
 		select {
-		case globals.hub.meta <- meta:
+		case globals.hub.shardFor(meta.pkt.RcptTo).meta <- meta:
 		default:
 			// Reply with a 500 to the user.
 			s.queueOut(ErrUnknownReply(msg, msg.Timestamp))
-			log.Println("s.get: hub.meta channel full", s.sid)
+			queueOverflow("s.get", queueHubMeta, msg.RcptTo, s.sid, len(globals.hub.shardFor(msg.RcptTo).meta))
 		}
 	} else {
 		log.Println("s.get: subscribe first to get=", msg.Get.What)
@@ -1062,6 +1578,84 @@ func (s *Session) set(msg *ClientComMessage) {
 	if msg.Set.Cred != nil {
 		meta.pkt.MetaWhat |= constMsgMetaCred
 	}
+	if msg.Set.Block != nil {
+		meta.pkt.MetaWhat |= constMsgMetaBlock
+	}
+	if msg.Set.Draft != nil {
+		meta.pkt.MetaWhat |= constMsgMetaDraft
+	}
+	if msg.Set.Emoji != nil {
+		meta.pkt.MetaWhat |= constMsgMetaEmoji
+	}
+	if msg.Set.Hook != nil {
+		meta.pkt.MetaWhat |= constMsgMetaHook
+	}
+	if msg.Set.AutoReply != nil {
+		meta.pkt.MetaWhat |= constMsgMetaAutoReply
+	}
+	if msg.Set.Import != nil {
+		meta.pkt.MetaWhat |= constMsgMetaImport
+	}
+	if msg.Set.Guests != nil {
+		meta.pkt.MetaWhat |= constMsgMetaGuests
+	}
+	if msg.Set.Owners != nil {
+		meta.pkt.MetaWhat |= constMsgMetaOwners
+	}
+	if msg.Set.Translate != nil {
+		meta.pkt.MetaWhat |= constMsgMetaTranslate
+	}
+	if msg.Set.Digest != nil {
+		meta.pkt.MetaWhat |= constMsgMetaDigest
+	}
+	if msg.Set.Mute != nil {
+		meta.pkt.MetaWhat |= constMsgMetaMute
+	}
+	if msg.Set.ChatList != nil {
+		meta.pkt.MetaWhat |= constMsgMetaChatList
+	}
+	if msg.Set.Consent != nil {
+		meta.pkt.MetaWhat |= constMsgMetaConsent
+	}
+	if msg.Set.Rsvp != nil {
+		meta.pkt.MetaWhat |= constMsgMetaRsvp
+	}
+	if msg.Set.Review != nil {
+		meta.pkt.MetaWhat |= constMsgMetaReview
+	}
+	if msg.Set.Receipts != nil {
+		meta.pkt.MetaWhat |= constMsgMetaReceipts
+	}
+	if msg.Set.Repair != nil {
+		meta.pkt.MetaWhat |= constMsgMetaRepair
+	}
+	if msg.Set.Announce != nil {
+		meta.pkt.MetaWhat |= constMsgMetaAnnounce
+	}
+	if msg.Set.Moderate != nil {
+		meta.pkt.MetaWhat |= constMsgMetaModerate
+	}
+	if msg.Set.Capacity != nil {
+		meta.pkt.MetaWhat |= constMsgMetaCapacity
+	}
+	if msg.Set.Config != nil {
+		meta.pkt.MetaWhat |= constMsgMetaConfig
+	}
+	if msg.Set.MaxSubs != nil {
+		meta.pkt.MetaWhat |= constMsgMetaMaxSubs
+	}
+	if msg.Set.Freeze != nil {
+		meta.pkt.MetaWhat |= constMsgMetaFreeze
+	}
+	if msg.Set.Notify != nil {
+		meta.pkt.MetaWhat |= constMsgMetaNotify
+	}
+	if msg.Set.Ban != nil {
+		meta.pkt.MetaWhat |= constMsgMetaBanned
+	}
+	if msg.Set.Ttl != nil {
+		meta.pkt.MetaWhat |= constMsgMetaTtl
+	}
 
 	if meta.pkt.MetaWhat == 0 {
 		s.queueOut(ErrMalformedReply(msg, msg.Timestamp))
@@ -1072,19 +1666,25 @@ func (s *Session) set(msg *ClientComMessage) {
 		default:
 			// Reply with a 500 to the user.
 			s.queueOut(ErrUnknownReply(msg, msg.Timestamp))
-			log.Println("s.set: sub.meta channel full, topic ", msg.RcptTo, s.sid)
+			queueOverflow("s.set", queueTopicMeta, msg.RcptTo, s.sid, len(sub.meta))
 		}
-	} else if meta.pkt.MetaWhat&(constMsgMetaTags|constMsgMetaCred) != 0 {
-		log.Println("s.set: can Set tags/creds for subscribed topics only", meta.pkt.MetaWhat)
+	} else if meta.pkt.MetaWhat&(constMsgMetaTags|constMsgMetaCred|constMsgMetaBlock|constMsgMetaDraft|
+		constMsgMetaEmoji|constMsgMetaHook|constMsgMetaAutoReply|constMsgMetaImport|constMsgMetaGuests|
+		constMsgMetaOwners|constMsgMetaTranslate|constMsgMetaDigest|constMsgMetaMute|
+		constMsgMetaChatList|constMsgMetaConsent|constMsgMetaRsvp|constMsgMetaReview|
+		constMsgMetaReceipts|constMsgMetaRepair|constMsgMetaAnnounce|constMsgMetaModerate|
+		constMsgMetaCapacity|constMsgMetaConfig|constMsgMetaMaxSubs|constMsgMetaFreeze|
+		constMsgMetaNotify|constMsgMetaBanned|constMsgMetaTtl) != 0 {
+		log.Println("s.set: can Set tags/creds/blocks/drafts/emoji/hook/autoreply/import/guests/owners/translate/digest/mute/chatlist/consent/rsvp/review/receipts/repair/announce/moderate/capacity/config/maxsubs/freeze/notify/ban/ttl for subscribed topics only", meta.pkt.MetaWhat)
 		s.queueOut(ErrPermissionDeniedReply(msg, msg.Timestamp))
 	} else {
 		// Desc.Private and Sub updates are possible without the subscription.
 		select {
-		case globals.hub.meta <- meta:
+		case globals.hub.shardFor(meta.pkt.RcptTo).meta <- meta:
 		default:
 			// Reply with a 500 to the user.
 			s.queueOut(ErrUnknownReply(msg, msg.Timestamp))
-			log.Println("s.set: hub.meta channel full", s.sid)
+			queueOverflow("s.set", queueHubMeta, msg.RcptTo, s.sid, len(globals.hub.shardFor(msg.RcptTo).meta))
 		}
 	}
 }
@@ -1123,13 +1723,14 @@ func (s *Session) del(msg *ClientComMessage) {
 		default:
 			// Reply with a 500 to the user.
 			s.queueOut(ErrUnknownReply(msg, msg.Timestamp))
-			log.Println("s.del: sub.meta channel full, topic ", msg.RcptTo, s.sid)
+			queueOverflow("s.del", queueTopicMeta, msg.RcptTo, s.sid, len(sub.meta))
 		}
 	} else if msg.MetaWhat == constMsgDelTopic {
 		// Deleting topic: for sessions attached or not attached, send request to hub first.
 		// Hub will forward to topic, if appropriate.
+		s.forgetDelivered(msg.RcptTo)
 		select {
-		case globals.hub.unreg <- &topicUnreg{
+		case globals.hub.shardFor(msg.RcptTo).unreg <- &topicUnreg{
 			rcptTo: msg.RcptTo,
 			pkt:    msg,
 			sess:   s,
@@ -1137,7 +1738,7 @@ func (s *Session) del(msg *ClientComMessage) {
 		default:
 			// Reply with a 500 to the user.
 			s.queueOut(ErrUnknownReply(msg, msg.Timestamp))
-			log.Println("s.del: hub.unreg channel full", s.sid)
+			queueOverflow("s.del", queueHubUnreg, msg.RcptTo, s.sid, len(globals.hub.shardFor(msg.RcptTo).unreg))
 		}
 	} else {
 		// Must join the topic to delete messages or subscriptions.
@@ -1165,13 +1766,21 @@ func (s *Session) note(msg *ClientComMessage) {
 
 	switch msg.Note.What {
 	case "kp":
+		if msg.Note.SeqId != 0 || (msg.Note.Act != "" && !kpActivities[msg.Note.Act]) {
+			return
+		}
+	case "focus", "blur":
 		if msg.Note.SeqId != 0 {
 			return
 		}
-	case "read", "recv":
+	case "read", "recv", "dlv", "credit", "star", "unstar":
 		if msg.Note.SeqId <= 0 {
 			return
 		}
+	case "vote":
+		if msg.Note.SeqId <= 0 || len(msg.Note.Vote) > pollMaxOptions {
+			return
+		}
 	default:
 		return
 	}
@@ -1181,7 +1790,9 @@ func (s *Session) note(msg *ClientComMessage) {
 			Topic: msg.Original,
 			From:  msg.AsUser,
 			What:  msg.Note.What,
-			SeqId: msg.Note.SeqId},
+			SeqId: msg.Note.SeqId,
+			Act:   msg.Note.Act,
+			Vote:  msg.Note.Vote},
 		RcptTo:    msg.RcptTo,
 		AsUser:    msg.AsUser,
 		Timestamp: msg.Timestamp,
@@ -1194,18 +1805,19 @@ func (s *Session) note(msg *ClientComMessage) {
 		default:
 			// Reply with a 500 to the user.
 			s.queueOut(ErrUnknownReply(msg, msg.Timestamp))
-			log.Println("s.note: sub.broacast channel full, topic ", msg.RcptTo, s.sid)
+			queueOverflow("s.note", queueTopicBroadcast, msg.RcptTo, s.sid, len(sub.broadcast))
 		}
-	} else if msg.Note.What == "recv" {
+	} else if msg.Note.What == "recv" || msg.Note.What == "dlv" {
 		// Client received a pres notification about a new message, initiated a fetch
 		// from the server (and detached from the topic) and acknowledges receipt.
+		// Or a push notification has reached the device which is not attached to the topic.
 		// Hub will forward to topic, if appropriate.
 		select {
-		case globals.hub.route <- response:
+		case globals.hub.shardFor(response.RcptTo).route <- response:
 		default:
 			// Reply with a 500 to the user.
 			s.queueOut(ErrUnknownReply(msg, msg.Timestamp))
-			log.Println("s.note: hub.route channel full", s.sid)
+			queueOverflow("s.note", queueHubRoute, msg.RcptTo, s.sid, len(globals.hub.shardFor(msg.RcptTo).route))
 		}
 	} else {
 		s.queueOut(ErrAttachFirst(msg, msg.Timestamp))
@@ -1255,20 +1867,43 @@ func (s *Session) expandTopicName(msg *ClientComMessage) (string, *ServerComMess
 }
 
 func (s *Session) serialize(msg *ServerComMessage) (int, interface{}) {
-	if s.proto == GRPC {
-		msg := pbServSerialize(msg)
-		// TODO: calculate and return the size of `msg`.
-		return -1, msg
-	}
-
 	if s.proto == MULTIPLEX {
 		// No need to serialize the message to bytes within the cluster,
 		// but we have to create a copy because the original msg can be mutated.
 		return -1, msg.copy()
 	}
 
-	out, _ := json.Marshal(msg)
-	return len(out), out
+	// Websocket and long polling sessions share the same JSON representation.
+	format := WEBSOCK
+	if s.proto == GRPC {
+		format = GRPC
+	}
+
+	var key string
+	if msg.serialized != nil {
+		key = msg.serializeCacheKey(format)
+		if out, ok := msg.serialized[key]; ok {
+			if data, ok := out.([]byte); ok {
+				return len(data), data
+			}
+			return -1, out
+		}
+	}
+
+	var size int
+	var out interface{}
+	if format == GRPC {
+		// TODO: calculate and return the size of `msg`.
+		size, out = -1, pbServSerialize(msg)
+	} else {
+		data, _ := json.Marshal(msg)
+		size, out = len(data), data
+	}
+
+	if msg.serialized != nil {
+		msg.serialized[key] = out
+	}
+	return size, out
 }
 
 // onBackgroundTimer marks background session as foreground and informs topics it's subscribed to.
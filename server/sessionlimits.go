@@ -0,0 +1,226 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *    Limits on concurrent sessions: the number of sessions from one IP address
+ *    and of one user, and the list of banned IP addresses.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tinode/chat/server/store/types"
+)
+
+var (
+	errSessionBanned = errors.New("address is banned")
+	errSessionQuota  = errors.New("too many sessions")
+)
+
+// sessionLimitsConfig is the configuration of limits on concurrent sessions.
+type sessionLimitsConfig struct {
+	// Maximum number of concurrent sessions from one IP address, 0 for no limit.
+	PerIP int `json:"per_ip"`
+	// Maximum number of concurrent sessions of one user, 0 for no limit.
+	PerUser int `json:"per_user"`
+	// IP addresses and CIDR ranges which are not allowed to connect.
+	Banned []string `json:"banned"`
+}
+
+var sessionLimits struct {
+	perIP   int
+	perUser int
+	banned  []*net.IPNet
+
+	// Guards the counters and the counted IP and users of sessions.
+	lock   sync.Mutex
+	byIP   map[string]int
+	byUser map[types.Uid]int
+}
+
+// sessionLimitsInit configures limits on concurrent sessions. Called again when the config is reloaded:
+// sessions counted before are still counted.
+func sessionLimitsInit(jsconf json.RawMessage) error {
+	if len(jsconf) == 0 && sessionLimits.byIP == nil {
+		return nil
+	}
+
+	var config sessionLimitsConfig
+	if len(jsconf) > 0 {
+		if err := json.Unmarshal(jsconf, &config); err != nil {
+			return errors.New("failed to parse config: " + err.Error())
+		}
+	}
+	if config.PerIP < 0 || config.PerUser < 0 {
+		return errors.New("invalid limits")
+	}
+
+	var banned []*net.IPNet
+	for _, entry := range config.Banned {
+		if !strings.Contains(entry, "/") {
+			// A single address.
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return errors.New("invalid banned address '" + entry + "'")
+			}
+			if ip4 := ip.To4(); ip4 != nil {
+				ip = ip4
+			}
+			bits := 8 * len(ip)
+			banned = append(banned, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipnet, err := net.ParseCIDR(entry)
+		if err != nil {
+			return errors.New("invalid banned address '" + entry + "'")
+		}
+		banned = append(banned, ipnet)
+	}
+
+	sessionLimits.lock.Lock()
+	defer sessionLimits.lock.Unlock()
+
+	sessionLimits.perIP = config.PerIP
+	sessionLimits.perUser = config.PerUser
+	sessionLimits.banned = banned
+	if sessionLimits.byIP == nil {
+		sessionLimits.byIP = make(map[string]int)
+		sessionLimits.byUser = make(map[types.Uid]int)
+	}
+
+	return nil
+}
+
+// sessionLimitsIP extracts the IP address of the client from the remote address of the connection:
+// 'host:port' or the value of the X-Forwarded-For header where the first address is the client's.
+func sessionLimitsIP(addr string) string {
+	if i := strings.IndexByte(addr, ','); i >= 0 {
+		addr = addr[:i]
+	}
+	addr = strings.TrimSpace(addr)
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	if ip := net.ParseIP(addr); ip != nil {
+		return ip.String()
+	}
+	return addr
+}
+
+// sessionLimitsAcquireIP checks if a new session may be opened from the remote address and counts it.
+// Returns the counted IP address to be released with the session, possibly empty.
+func sessionLimitsAcquireIP(remoteAddr string) (string, error) {
+	if sessionLimits.byIP == nil {
+		return "", nil
+	}
+
+	addr := sessionLimitsIP(remoteAddr)
+	if ip := net.ParseIP(addr); ip != nil {
+		for _, ipnet := range sessionLimits.banned {
+			if ipnet.Contains(ip) {
+				return "", errSessionBanned
+			}
+		}
+	}
+
+	if sessionLimits.perIP == 0 {
+		return "", nil
+	}
+
+	sessionLimits.lock.Lock()
+	defer sessionLimits.lock.Unlock()
+
+	if sessionLimits.byIP[addr] >= sessionLimits.perIP {
+		return "", errSessionQuota
+	}
+	sessionLimits.byIP[addr]++
+	return addr, nil
+}
+
+// sessionLimitsReject responds to an HTTP request for a new session rejected by the session limits.
+func sessionLimitsReject(wrt http.ResponseWriter, err error, now time.Time) {
+	if err == errSessionBanned {
+		wrt.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(wrt).Encode(ErrPermissionDenied("", "", now))
+		return
+	}
+	wrt.WriteHeader(http.StatusTooManyRequests)
+	reply := ErrPolicy("", "", now)
+	reply.Ctrl.Params = map[string]interface{}{"what": "sessions", "limit": sessionLimits.perIP}
+	json.NewEncoder(wrt).Encode(reply)
+}
+
+// sessionLimitsAcquireUser checks if the user may authenticate one more session and counts the session.
+func (s *Session) sessionLimitsAcquireUser(uid types.Uid) bool {
+	if sessionLimits.perUser == 0 || s.isMultiplex() {
+		return true
+	}
+
+	sessionLimits.lock.Lock()
+	defer sessionLimits.lock.Unlock()
+
+	for _, counted := range s.limitUids {
+		if counted == uid {
+			return true
+		}
+	}
+	if sessionLimits.byUser[uid] >= sessionLimits.perUser {
+		return false
+	}
+	sessionLimits.byUser[uid]++
+	s.limitUids = append(s.limitUids, uid)
+	return true
+}
+
+// sessionLimitsRelease stops counting the terminated session against the limits.
+func (s *Session) sessionLimitsRelease() {
+	if sessionLimits.byIP == nil {
+		return
+	}
+
+	sessionLimits.lock.Lock()
+	defer sessionLimits.lock.Unlock()
+
+	if s.limitIP != "" {
+		sessionLimitsDecIP(s.limitIP)
+		s.limitIP = ""
+	}
+	for _, uid := range s.limitUids {
+		if sessionLimits.byUser[uid] <= 1 {
+			delete(sessionLimits.byUser, uid)
+		} else {
+			sessionLimits.byUser[uid]--
+		}
+	}
+	s.limitUids = nil
+}
+
+// sessionLimitsReleaseIP stops counting a session which was not opened after all.
+func sessionLimitsReleaseIP(addr string) {
+	if addr == "" {
+		return
+	}
+
+	sessionLimits.lock.Lock()
+	defer sessionLimits.lock.Unlock()
+
+	sessionLimitsDecIP(addr)
+}
+
+// sessionLimitsDecIP decrements the count of sessions from the IP address. Must be called with the lock held.
+func sessionLimitsDecIP(addr string) {
+	if sessionLimits.byIP[addr] <= 1 {
+		delete(sessionLimits.byIP, addr)
+	} else {
+		sessionLimits.byIP[addr]--
+	}
+}
@@ -72,6 +72,7 @@ func (ss *SessionStore) NewSession(conn interface{}, sid string) (*Session, int)
 	s.send = make(chan interface{}, sendQueueLimit+32) // buffered
 	s.stop = make(chan interface{}, 1)                 // Buffered by 1 just to make it non-blocking
 	s.detach = make(chan string, 64)                   // buffered
+	s.overflowReady = make(chan struct{}, 1)
 
 	s.bkgTimer = time.NewTimer(time.Hour)
 	s.bkgTimer.Stop()
@@ -137,6 +138,19 @@ func (ss *SessionStore) Get(sid string) *Session {
 	return nil
 }
 
+// Range calls f for each session in the store until f returns false.
+// The store is locked while iterating: f must not call other methods of the store.
+func (ss *SessionStore) Range(f func(sid string, s *Session) bool) {
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+
+	for sid, s := range ss.sessCache {
+		if !f(sid, s) {
+			break
+		}
+	}
+}
+
 // Delete removes session from store.
 func (ss *SessionStore) Delete(s *Session) {
 	ss.lock.Lock()
@@ -169,7 +183,8 @@ func (ss *SessionStore) Shutdown() {
 	log.Println("SessionStore shut down, sessions terminated:", len(ss.sessCache))
 }
 
-// EvictUser terminates all sessions of a given user.
+// EvictUser terminates all sessions of a given user. Sessions where the user is one of several
+// authenticated accounts stay open: only the user's account is logged out.
 func (ss *SessionStore) EvictUser(uid types.Uid, skipSid string) {
 	ss.lock.Lock()
 	defer ss.lock.Unlock()
@@ -178,7 +193,16 @@ func (ss *SessionStore) EvictUser(uid types.Uid, skipSid string) {
 	evicted := NoErrEvicted("", "", types.TimeNow())
 	evicted.AsUser = uid.UserId()
 	for _, s := range ss.sessCache {
-		if s.uid == uid && !s.isMultiplex() && s.sid != skipSid {
+		if s.isMultiplex() || s.sid == skipSid {
+			continue
+		}
+		// The user could be one of several accounts authenticated in the session.
+		if _, _, ok := s.account(uid); ok {
+			if s.accountCount() > 1 {
+				// Detaching topics may block: don't hold the store lock.
+				go s.evictAccount(uid, evicted.Ctrl.Timestamp)
+				continue
+			}
 			_, data := s.serialize(evicted)
 			s.stopSession(data)
 			delete(ss.sessCache, s.sid)
@@ -0,0 +1,130 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *    Spaces: group topics organized under a parent topic. Members of the
+ *    parent are suggested as subscribers of a new child topic, child topics
+ *    are listed by {get what="sub"} on the parent. Spaces are not nested.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"log"
+
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+const (
+	// Maximum number of child topics in a space.
+	spaceMaxChildren = 256
+	// Maximum number of members of the parent suggested as subscribers of a new child topic.
+	spaceMaxSuggest = 64
+)
+
+// spaceParentName converts the name of the parent topic as sent by the client to the stored form.
+// Returns an empty string if the name cannot be a parent.
+func spaceParentName(parent string) string {
+	if len(parent) < 4 {
+		return ""
+	}
+	return types.ChnToGrp(parent)
+}
+
+// spaceCheckParent verifies that the topic can be placed into the space of the parent topic
+// by the given user: the parent exists, is not a child itself, and the user is its member.
+func spaceCheckParent(topic, parent string, asUid types.Uid) error {
+	if parent == "" || parent == topic {
+		return types.ErrMalformed
+	}
+
+	stopic, err := store.Topics.Get(parent)
+	if err != nil {
+		return err
+	}
+	if stopic == nil || stopic.State != types.StateOK {
+		return types.ErrTopicNotFound
+	}
+	if stopic.Parent != "" {
+		// Spaces are not nested.
+		return types.ErrMalformed
+	}
+
+	// A topic with children of its own cannot become a child.
+	children, err := store.Topics.GetChildren(topic, 1)
+	if err != nil {
+		return err
+	}
+	if len(children) > 0 {
+		return types.ErrMalformed
+	}
+
+	subs, err := store.Topics.GetSubs(parent, &types.QueryOpt{User: asUid, Limit: 1})
+	if err != nil {
+		return err
+	}
+	if len(subs) == 0 || !(subs[0].ModeGiven & subs[0].ModeWant).IsJoiner() {
+		return types.ErrPermissionDenied
+	}
+
+	if children, err = store.Topics.GetChildren(parent, spaceMaxChildren); err != nil {
+		return err
+	}
+	if len(children) >= spaceMaxChildren {
+		return types.ErrPolicy
+	}
+	return nil
+}
+
+// spaceSuggest returns IDs of the members of the parent topic to be suggested as subscribers
+// of a new child topic. The creator of the child topic is skipped.
+func spaceSuggest(parent string, skip types.Uid) []string {
+	subs, err := store.Topics.GetSubs(parent, &types.QueryOpt{Limit: spaceMaxSuggest + 1})
+	if err != nil {
+		log.Printf("topic[%s]: failed to load members of the space: %v", parent, err)
+		return nil
+	}
+
+	var suggest []string
+	for i := range subs {
+		sub := &subs[i]
+		uid := types.ParseUid(sub.User)
+		if uid == skip || !(sub.ModeGiven & sub.ModeWant).IsJoiner() {
+			continue
+		}
+		suggest = append(suggest, uid.UserId())
+		if len(suggest) == spaceMaxSuggest {
+			break
+		}
+	}
+	return suggest
+}
+
+// spaceChildren lists the child topics of the space. Topics held for approval, suspended or
+// deleted are not listed.
+func spaceChildren(parent string) ([]MsgSpaceChild, error) {
+	topics, err := store.Topics.GetChildren(parent, spaceMaxChildren)
+	if err != nil {
+		return nil, err
+	}
+
+	var children []MsgSpaceChild
+	for i := range topics {
+		topic := &topics[i]
+		if topic.State != types.StateOK {
+			continue
+		}
+		child := MsgSpaceChild{
+			Topic:     topic.Id,
+			CreatedAt: &topic.CreatedAt,
+			Public:    topic.Public,
+		}
+		if !topic.TouchedAt.IsZero() {
+			child.TouchedAt = &topic.TouchedAt
+		}
+		children = append(children, child)
+	}
+	return children, nil
+}
@@ -2,14 +2,20 @@
 package store
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
+	"io/ioutil"
+	"log"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/tinode/chat/server/auth"
 	adapter "github.com/tinode/chat/server/db"
+	"github.com/tinode/chat/server/drafty"
 	"github.com/tinode/chat/server/media"
 	"github.com/tinode/chat/server/store/types"
 	"github.com/tinode/chat/server/validate"
@@ -305,6 +311,12 @@ func (UsersObjMapper) GetByCred(method, value string) (types.Uid, error) {
 	return adp.UserGetByCred(method, value)
 }
 
+// GetByState returns IDs of up to limit users who have been in the given state since before the given time,
+// ordered by ID. If after is not zero, the IDs start after it.
+func (UsersObjMapper) GetByState(state types.ObjState, before time.Time, after types.Uid, limit int) ([]types.Uid, error) {
+	return adp.UserGetByState(state, before, after, limit)
+}
+
 // Delete deletes user records.
 func (UsersObjMapper) Delete(id types.Uid, hard bool) error {
 	return adp.UserDelete(id, hard)
@@ -346,12 +358,13 @@ func (UsersObjMapper) GetSubs(id types.Uid, opts *types.QueryOpt) ([]types.Subsc
 // `required` specifies an AND of ORs for required terms:
 // at least one element of every sublist in `required` must be present in the object's tags list.
 // `optional` specifies a list of optional terms.
-func (UsersObjMapper) FindSubs(id types.Uid, required [][]string, optional []string) ([]types.Subscription, error) {
+// `excluded` specifies a list of terms: topics with any of them are not returned.
+func (UsersObjMapper) FindSubs(id types.Uid, required [][]string, optional, excluded []string) ([]types.Subscription, error) {
 	usubs, err := adp.FindUsers(id, required, optional)
 	if err != nil {
 		return nil, err
 	}
-	tsubs, err := adp.FindTopics(required, optional)
+	tsubs, err := adp.FindTopics(required, optional, excluded)
 	if err != nil {
 		return nil, err
 	}
@@ -465,6 +478,21 @@ func (TopicsObjMapper) Get(topic string) (*types.Topic, error) {
 	return adp.TopicGet(topic)
 }
 
+// GetByState loads up to limit topics in the given state, oldest first.
+func (TopicsObjMapper) GetByState(state types.ObjState, limit int) ([]types.Topic, error) {
+	return adp.TopicGetByState(state, limit)
+}
+
+// GetChildren loads up to limit topics which have the given parent, oldest first.
+func (TopicsObjMapper) GetChildren(parent string, limit int) ([]types.Topic, error) {
+	return adp.TopicGetChildren(parent, limit)
+}
+
+// GetDirectory loads one page of active topics which have the category tag of the query.
+func (TopicsObjMapper) GetDirectory(query *types.TopicDirectoryQuery) ([]types.Topic, error) {
+	return adp.TopicGetDirectory(query)
+}
+
 // GetUsers loads subscriptions for topic plus loads user.Public.
 // Deleted subscriptions are not loaded.
 func (TopicsObjMapper) GetUsers(topic string, opts *types.QueryOpt) ([]types.Subscription, error) {
@@ -483,6 +511,11 @@ func (TopicsObjMapper) GetSubs(topic string, opts *types.QueryOpt) ([]types.Subs
 	return adp.SubsForTopic(topic, false, opts)
 }
 
+// CountSubs returns the number of subscriptions to the given topic, deleted subscriptions are not counted.
+func (TopicsObjMapper) CountSubs(topic string) (int, error) {
+	return adp.SubsCountForTopic(topic)
+}
+
 // GetSubsAny loads a list of subscriptions to the given topic including deleted subscription.
 // user.Public is not loaded
 func (TopicsObjMapper) GetSubsAny(topic string, opts *types.QueryOpt) ([]types.Subscription, error) {
@@ -497,7 +530,8 @@ func (TopicsObjMapper) Update(topic string, update map[string]interface{}) error
 	return adp.TopicUpdate(topic, update)
 }
 
-// OwnerChange replaces the old topic owner with the new owner.
+// OwnerChange replaces the old topic owner with the new owner. The O permission is moved from
+// the subscription of the old owner to the subscription of the new owner in the same operation.
 func (TopicsObjMapper) OwnerChange(topic string, newOwner types.Uid) error {
 	return adp.TopicOwnerChange(topic, newOwner)
 }
@@ -576,11 +610,26 @@ func (MessagesObjMapper) Save(msg *types.Message, readBySender bool) error {
 		}
 	}
 
+	// Large content is stored by the media handler, the message keeps the reference and the preview.
+	head, content := msg.Head, msg.Content
+	var blob types.Uid
+	msg.Head, msg.Content, blob = msgOffload(msg)
+	if !blob.IsZero() {
+		attachments = append(attachments, blob.String())
+	}
+
 	err = adp.MessageSave(msg)
+	// The caller gets the message back unchanged.
+	msg.Head, msg.Content = head, content
 	if err != nil {
 		return err
 	}
 
+	if msg.Thread > 0 {
+		// Ignore the error: the reply is saved, the thread summary is informational.
+		adp.MessageThreadReply(msg.Topic, msg.Thread, msg.CreatedAt)
+	}
+
 	// Mark message as read by the sender.
 	if readBySender {
 		// Make sure From is valid, otherwise we will reset values for all subscribers.
@@ -589,6 +638,7 @@ func (MessagesObjMapper) Save(msg *types.Message, readBySender bool) error {
 			// Ignore the error here. It's not a big deal if it fails.
 			adp.SubsUpdate(msg.Topic, fromUid,
 				map[string]interface{}{
+					"DlvSeqId":  msg.SeqId,
 					"RecvSeqId": msg.SeqId,
 					"ReadSeqId": msg.SeqId})
 		}
@@ -601,6 +651,44 @@ func (MessagesObjMapper) Save(msg *types.Message, readBySender bool) error {
 	return nil
 }
 
+// Update replaces headers and content of a previously saved message. Large content is stored by
+// the media handler as a new file, the file with the previous content is released.
+func (MessagesObjMapper) Update(topic string, seqId int, head types.MessageHeaders, content interface{}) error {
+	msg := &types.Message{Topic: topic, SeqId: seqId, Head: head, Content: content}
+
+	// The file with the content before the edit.
+	var stale []string
+	if mediaHandler != nil {
+		msgs, err := adp.MessageGetAll(topic, types.ZeroUid, &types.QueryOpt{Since: seqId, Before: seqId + 1, Limit: 1})
+		if err != nil {
+			return err
+		}
+		if len(msgs) > 0 {
+			msg.From = msgs[0].From
+			if url, ok := msgs[0].Head[msgOffloadHeader].(string); ok {
+				if fid := mediaHandler.GetIdFromUrl(url); !fid.IsZero() {
+					stale = append(stale, fid.String())
+				}
+			}
+		}
+	}
+
+	head, content, blob := msgOffload(msg)
+	if err := adp.MessageUpdate(topic, seqId, head, content); err != nil {
+		return err
+	}
+
+	var fresh []string
+	if !blob.IsZero() {
+		fresh = append(fresh, blob.String())
+	}
+	if len(fresh) == 0 && len(stale) == 0 {
+		return nil
+	}
+	// The released file is deleted with other unused files.
+	return adp.MessageAttachmentsUpdate(topic, seqId, fresh, stale)
+}
+
 // DeleteList deletes multiple messages defined by a list of ranges.
 func (MessagesObjMapper) DeleteList(topic string, delID int, forUser types.Uid, ranges []types.Range) error {
 	var toDel *types.DelMessage
@@ -640,7 +728,181 @@ func (MessagesObjMapper) DeleteList(topic string, delID int, forUser types.Uid,
 
 // GetAll returns multiple messages.
 func (MessagesObjMapper) GetAll(topic string, forUser types.Uid, opt *types.QueryOpt) ([]types.Message, error) {
-	return adp.MessageGetAll(topic, forUser, opt)
+	msgs, err := adp.MessageGetAll(topic, forUser, opt)
+	if err == nil {
+		msgRehydrate(msgs)
+	}
+	return msgs, err
+}
+
+// Search returns messages of the topic which match the full-text query and are not deleted for the user.
+func (MessagesObjMapper) Search(topic string, forUser types.Uid, query string, opt *types.QueryOpt) ([]types.Message, error) {
+	msgs, err := adp.MessageSearch(topic, forUser, query, opt)
+	if err == nil {
+		msgRehydrate(msgs)
+	}
+	return msgs, err
+}
+
+// Header of messages with the content stored by the media handler: URL of the content.
+const msgOffloadHeader = "offload"
+
+// Maximum length of the preview of the offloaded content in characters.
+const msgOffloadPreviewLen = 256
+
+// Maximum number of offloaded messages loaded from the media handler at once.
+const msgRehydrateConcurrency = 8
+
+// Maximum time to load the offloaded content of the messages returned by one query.
+const msgRehydrateTimeout = 2 * time.Second
+
+// Content of messages larger than this number of bytes is stored by the media handler, 0 if disabled.
+var msgOffloadThreshold int
+
+// UseMessageOffload enables storing content of messages larger than threshold bytes by the media handler.
+// Must be called after UseMediaHandler.
+func UseMessageOffload(threshold int) error {
+	if threshold <= 0 {
+		msgOffloadThreshold = 0
+		return nil
+	}
+	if mediaHandler == nil {
+		return errors.New("media handler is not configured")
+	}
+	// Handlers which serve files from elsewhere, e.g. S3, cannot load the content back.
+	if !mediaHandler.CanDownload() {
+		return errors.New("media handler does not support downloads")
+	}
+	msgOffloadThreshold = threshold
+	return nil
+}
+
+// msgOffload stores the content of the message by the media handler if the content is too large.
+// Returns headers and content to save in the database: the headers with the reference to the stored content
+// and the preview of the content. The ID of the file with the content is zero if the content is not offloaded.
+// If the media handler fails, the content is saved in the database.
+func msgOffload(msg *types.Message) (types.MessageHeaders, interface{}, types.Uid) {
+	// The header is set by the store only.
+	head := msgHeadWithout(msg.Head, msgOffloadHeader)
+	if msgOffloadThreshold == 0 || msg.Content == nil {
+		return head, msg.Content, types.ZeroUid
+	}
+	data, err := json.Marshal(msg.Content)
+	if err != nil || len(data) <= msgOffloadThreshold {
+		return head, msg.Content, types.ZeroUid
+	}
+
+	fdef := &types.FileDef{User: msg.From, MimeType: "application/json"}
+	fdef.Id = GetUidString()
+	fdef.InitTimes()
+	url, err := mediaHandler.Upload(fdef, bytes.NewReader(data))
+	if err != nil {
+		log.Println("store: failed to offload content", msg.Topic, msg.SeqId, err)
+		return head, msg.Content, types.ZeroUid
+	}
+
+	offloaded := make(types.MessageHeaders, len(head)+1)
+	for key, val := range head {
+		offloaded[key] = val
+	}
+	offloaded[msgOffloadHeader] = url
+
+	// The preview is the beginning of the text of the message.
+	preview, _ := drafty.ToPlainText(msg.Content)
+	if utf8.RuneCountInString(preview) > msgOffloadPreviewLen {
+		preview = string([]rune(preview)[:msgOffloadPreviewLen])
+	}
+
+	return offloaded, preview, fdef.Uid()
+}
+
+// msgRehydrate replaces previews of the offloaded content with the content stored by the media handler.
+// The content is loaded concurrently for at most msgRehydrateTimeout. Messages keep the preview and
+// the reference if the content cannot be loaded in time.
+func msgRehydrate(msgs []types.Message) {
+	if mediaHandler == nil {
+		return
+	}
+
+	type loaded struct {
+		index   int
+		content interface{}
+		err     error
+	}
+	// Buffered so the loaders which are late don't block.
+	results := make(chan loaded, len(msgs))
+	slots := make(chan struct{}, msgRehydrateConcurrency)
+	count := 0
+	for i := range msgs {
+		url, ok := msgs[i].Head[msgOffloadHeader].(string)
+		if !ok || msgs[i].DeletedAt != nil {
+			continue
+		}
+		count++
+		go func(index int, url string) {
+			slots <- struct{}{}
+			content, err := msgOffloadLoad(url)
+			<-slots
+			results <- loaded{index: index, content: content, err: err}
+		}(i, url)
+	}
+	if count == 0 {
+		return
+	}
+
+	timer := time.NewTimer(msgRehydrateTimeout)
+	defer timer.Stop()
+	for ; count > 0; count-- {
+		select {
+		case res := <-results:
+			mm := &msgs[res.index]
+			if res.err != nil {
+				log.Println("store: failed to load offloaded content", mm.Topic, mm.SeqId, res.err)
+				continue
+			}
+			mm.Head = msgHeadWithout(mm.Head, msgOffloadHeader)
+			mm.Content = res.content
+		case <-timer.C:
+			log.Println("store: timed out loading offloaded content", msgs[0].Topic, count)
+			return
+		}
+	}
+}
+
+// msgHeadWithout returns a copy of the headers without the key, or the headers unchanged if the key is
+// not present. Returns nil if no headers are left.
+func msgHeadWithout(head types.MessageHeaders, key string) types.MessageHeaders {
+	if _, ok := head[key]; !ok {
+		return head
+	}
+	var copied types.MessageHeaders
+	for k, val := range head {
+		if k == key {
+			continue
+		}
+		if copied == nil {
+			copied = make(types.MessageHeaders, len(head))
+		}
+		copied[k] = val
+	}
+	return copied
+}
+
+// msgOffloadLoad reads the offloaded content from the media handler.
+func msgOffloadLoad(url string) (interface{}, error) {
+	_, file, err := mediaHandler.Download(url)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	data, err := ioutil.ReadAll(file)
+	if err != nil {
+		return nil, err
+	}
+	var content interface{}
+	err = json.Unmarshal(data, &content)
+	return content, err
 }
 
 // GetDeleted returns the ranges of deleted messages and the largest DelId reported in the list.
@@ -836,6 +1098,20 @@ func (DeviceMapper) Delete(uid types.Uid, deviceID string) error {
 	return adp.DeviceDelete(uid, deviceID)
 }
 
+// PushResults records results of push notifications sent to devices.
+func (DeviceMapper) PushResults(delivered, failed []string) error {
+	if len(delivered) == 0 && len(failed) == 0 {
+		return nil
+	}
+	return adp.DevicePushResults(delivered, failed, types.TimeNow())
+}
+
+// DeleteStale deletes devices with at least maxFailures failed push notifications in a row or
+// not seen since idleBefore.
+func (DeviceMapper) DeleteStale(maxFailures int, idleBefore time.Time) (int, error) {
+	return adp.DeviceDeleteStale(maxFailures, idleBefore)
+}
+
 // Registered media/file handlers.
 var fileHandlers map[string]media.Handler
 
@@ -905,3 +1181,282 @@ func (FileMapper) DeleteUnused(olderThan time.Time, limit int) error {
 	}
 	return nil
 }
+
+// PackMapper is a struct to map methods used for handling custom emoji packs.
+type PackMapper struct{}
+
+// Packs is an instance of PackMapper to be used for handling custom emoji packs.
+var Packs PackMapper
+
+// Upsert creates a new pack or replaces an existing one.
+func (PackMapper) Upsert(pack *types.EmojiPack) error {
+	if pack.Id == "" {
+		pack.SetUid(GetUid())
+		pack.InitTimes()
+	} else {
+		pack.UpdatedAt = types.TimeNow()
+	}
+	return adp.PackUpsert(pack)
+}
+
+// Get fetches packs with the given IDs. Missing packs are skipped.
+func (PackMapper) Get(ids ...string) ([]types.EmojiPack, error) {
+	return adp.PackGet(ids...)
+}
+
+// GetForOrg fetches all packs which belong to the given organizations.
+func (PackMapper) GetForOrg(orgs ...string) ([]types.EmojiPack, error) {
+	return adp.PackGetForOrg(orgs...)
+}
+
+// Delete deletes the pack. The files used by the pack become unused and are garbage collected.
+func (PackMapper) Delete(id string) error {
+	return adp.PackDelete(id)
+}
+
+// DigestMapper is a struct to map methods used for handling channel digests.
+type DigestMapper struct{}
+
+// Digests is an instance of DigestMapper to be used for handling channel digests.
+var Digests DigestMapper
+
+// Upsert creates a new digest or replaces the existing one of the same reader and channel.
+func (DigestMapper) Upsert(dg *types.Digest) error {
+	dg.Id = dg.Topic + ":" + dg.User
+	if dg.CreatedAt.IsZero() {
+		dg.InitTimes()
+	} else {
+		dg.UpdatedAt = types.TimeNow()
+	}
+	return adp.DigestUpsert(dg)
+}
+
+// Get fetches the digest of the channel reader. Returns nil if the reader has no digest.
+func (DigestMapper) Get(topic string, user types.Uid) (*types.Digest, error) {
+	return adp.DigestGet(topic, user)
+}
+
+// GetDue fetches digests which are due before the given time.
+func (DigestMapper) GetDue(before time.Time, limit int) ([]types.Digest, error) {
+	return adp.DigestGetDue(before, limit)
+}
+
+// Delete deletes the digest of the channel reader.
+func (DigestMapper) Delete(topic string, user types.Uid) error {
+	return adp.DigestDelete(topic, user)
+}
+
+// CalEventMapper is a struct to map methods used for handling events announced in topics.
+type CalEventMapper struct{}
+
+// CalEvents is an instance of CalEventMapper to be used for handling events announced in topics.
+var CalEvents CalEventMapper
+
+// Create saves a new event announced by the message ev.SeqId.
+func (CalEventMapper) Create(ev *types.CalEvent) error {
+	ev.Id = ev.Topic + ":" + strconv.Itoa(ev.SeqId)
+	ev.InitTimes()
+	return adp.CalEventUpsert(ev)
+}
+
+// Get fetches the event announced by the message. Returns nil if the message announced no event.
+func (CalEventMapper) Get(topic string, seqId int) (*types.CalEvent, error) {
+	return adp.CalEventGet(topic, seqId)
+}
+
+// GetAll fetches events of the topic starting at or after the given time.
+func (CalEventMapper) GetAll(topic string, since time.Time, limit int) ([]types.CalEvent, error) {
+	return adp.CalEventGetAll(topic, since, limit)
+}
+
+// GetDue fetches events with reminders due before the given time.
+func (CalEventMapper) GetDue(before time.Time, limit int) ([]types.CalEvent, error) {
+	return adp.CalEventGetDue(before, limit)
+}
+
+// Rsvp records the response of the user to the event. An empty response removes it.
+func (CalEventMapper) Rsvp(topic string, seqId int, user types.Uid, resp string) error {
+	return adp.CalEventRsvp(topic, seqId, user, resp)
+}
+
+// Reminded marks the reminder of the event as sent.
+func (CalEventMapper) Reminded(topic string, seqId int) error {
+	return adp.CalEventReminded(topic, seqId)
+}
+
+// ReceiptMapper is a struct to map methods used for handling per-message read receipts.
+type ReceiptMapper struct{}
+
+// Receipts is an instance of ReceiptMapper to be used for handling per-message read receipts.
+var Receipts ReceiptMapper
+
+// Create records that the user has read messages from seqFrom to seqTo inclusive.
+func (ReceiptMapper) Create(topic string, user types.Uid, seqFrom, seqTo int, readAt time.Time) error {
+	return adp.ReceiptCreate(&types.Receipt{
+		Topic:   topic,
+		User:    user.String(),
+		SeqFrom: seqFrom,
+		SeqTo:   seqTo,
+		ReadAt:  readAt,
+	})
+}
+
+// GetForMessage fetches receipts of users who have read the message.
+func (ReceiptMapper) GetForMessage(topic string, seqId int) ([]types.Receipt, error) {
+	return adp.ReceiptsForMessage(topic, seqId)
+}
+
+// PollMapper is a struct to map methods used for handling polls.
+type PollMapper struct{}
+
+// Polls is an instance of PollMapper to be used for handling polls.
+var Polls PollMapper
+
+// Create saves a new poll.
+func (PollMapper) Create(poll *types.Poll) error {
+	poll.Id = poll.Topic + ":" + strconv.Itoa(poll.SeqId)
+	poll.InitTimes()
+	return adp.PollCreate(poll)
+}
+
+// Get fetches the poll created by the message. Returns nil if the message created no poll.
+func (PollMapper) Get(topic string, seqId int) (*types.Poll, error) {
+	return adp.PollGet(topic, seqId)
+}
+
+// Vote records the vote of the user replacing the previous one. An empty vote removes it.
+func (PollMapper) Vote(topic string, seqId int, user types.Uid, options []int) error {
+	return adp.PollVote(topic, seqId, user, options)
+}
+
+// MentionMapper is a struct to map methods used for handling unread mentions.
+type MentionMapper struct{}
+
+// Mentions is an instance of MentionMapper to be used for handling unread mentions.
+var Mentions MentionMapper
+
+// Create records that the users were mentioned in the message or, if thread is not 0, that the message
+// is a reply in the thread started by the users.
+func (MentionMapper) Create(topic string, seqId, thread int, users []types.Uid) error {
+	if len(users) == 0 {
+		return nil
+	}
+	now := types.TimeNow()
+	mentions := make([]types.Mention, 0, len(users))
+	for _, uid := range users {
+		mentions = append(mentions, types.Mention{
+			Topic:     topic,
+			User:      uid.String(),
+			SeqId:     seqId,
+			Thread:    thread,
+			CreatedAt: now,
+		})
+	}
+	return adp.MentionsCreate(mentions)
+}
+
+// Delete removes mentions and thread replies of the user in the topic up to and including seqId, all
+// of them if seqId is 0. Returns the number of removed mentions.
+func (MentionMapper) Delete(topic string, user types.Uid, seqId int) (int, error) {
+	return adp.MentionsDelete(topic, user, seqId)
+}
+
+// Count returns the number of unread mentions of the user.
+func (MentionMapper) Count(user types.Uid) (int, error) {
+	return adp.MentionsCount(user)
+}
+
+// GetAll returns unread mentions and thread replies of the user, newest first.
+func (MentionMapper) GetAll(user types.Uid, limit int) ([]types.Mention, error) {
+	return adp.MentionsGetAll(user, limit)
+}
+
+// BookmarkMapper is a struct to map methods used for handling starred messages.
+type BookmarkMapper struct{}
+
+// Bookmarks is an instance of BookmarkMapper to be used for handling starred messages.
+var Bookmarks BookmarkMapper
+
+// Create stars the message for the user. Starring a starred message is not an error.
+func (BookmarkMapper) Create(user types.Uid, topic string, seqId int) error {
+	return adp.BookmarkCreate(&types.Bookmark{
+		Id:        user.String() + ":" + topic + ":" + strconv.Itoa(seqId),
+		User:      user.String(),
+		Topic:     topic,
+		SeqId:     seqId,
+		CreatedAt: types.TimeNow(),
+	})
+}
+
+// Delete removes the star from the message.
+func (BookmarkMapper) Delete(user types.Uid, topic string, seqId int) error {
+	return adp.BookmarkDelete(user, topic, seqId)
+}
+
+// GetAll returns up to limit messages starred by the user, most recently starred first.
+func (BookmarkMapper) GetAll(user types.Uid, limit int) ([]types.Bookmark, error) {
+	return adp.BookmarkGetAll(user, limit)
+}
+
+// ViewOnceMapper is a struct to map methods used for handling view-once attachments.
+type ViewOnceMapper struct{}
+
+// ViewOnce is an instance of ViewOnceMapper to be used for handling view-once attachments.
+var ViewOnce ViewOnceMapper
+
+// Create marks the files attached to the message as view-once.
+func (ViewOnceMapper) Create(topic string, seqId int, from types.Uid, fids []string) error {
+	now := types.TimeNow()
+	vos := make([]types.ViewOnce, 0, len(fids))
+	for _, fid := range fids {
+		vos = append(vos, types.ViewOnce{
+			Id:        fid,
+			CreatedAt: now,
+			Topic:     topic,
+			SeqId:     seqId,
+			From:      from.String(),
+		})
+	}
+	return adp.ViewOnceCreate(vos)
+}
+
+// Get returns the view-once mark of the file, nil if the file is not view-once.
+func (ViewOnceMapper) Get(fid types.Uid) (*types.ViewOnce, error) {
+	return adp.ViewOnceGet(fid.String())
+}
+
+// View records that the user has retrieved the file. Returns false if the user has retrieved it before.
+func (ViewOnceMapper) View(vo *types.ViewOnce, user types.Uid) (bool, error) {
+	return adp.ViewOnceView(&types.ViewOnceView{
+		Id:        vo.Id + ":" + user.String(),
+		CreatedAt: types.TimeNow(),
+		FileId:    vo.Id,
+		User:      user.String(),
+		Topic:     vo.Topic,
+	})
+}
+
+// AccountEventMapper is a struct to map methods used for handling the account activity timeline.
+type AccountEventMapper struct{}
+
+// AccountEvents is an instance of AccountEventMapper to be used for handling the account activity timeline.
+var AccountEvents AccountEventMapper
+
+// Create saves the event.
+func (AccountEventMapper) Create(ev *types.AccountEvent) error {
+	ev.Id = GetUidString()
+	if ev.CreatedAt.IsZero() {
+		ev.CreatedAt = types.TimeNow()
+	}
+	return adp.AccountEventCreate(ev)
+}
+
+// GetAll returns up to limit events of the user, newest first.
+func (AccountEventMapper) GetAll(user types.Uid, limit int) ([]types.AccountEvent, error) {
+	return adp.AccountEventGetAll(user, limit)
+}
+
+// DeleteOlder deletes events of all users created before the given time. Returns the number of deleted events.
+func (AccountEventMapper) DeleteOlder(before time.Time) (int, error) {
+	return adp.AccountEventDeleteOlder(before)
+}
@@ -387,6 +387,340 @@ func (ss StringSlice) Value() (driver.Value, error) {
 	return json.Marshal(ss)
 }
 
+// BlockedUser is an entry in the user's block list.
+type BlockedUser struct {
+	// ID of the blocked user.
+	User string
+	// Hide messages of the blocked user in group topics.
+	Hide bool
+	// Time when the user was blocked.
+	CreatedAt time.Time
+}
+
+// BlockList is a list of users blocked by the user. Defined so Scanner and Valuer can be attached to it.
+type BlockList []BlockedUser
+
+// Scan implements sql.Scanner interface.
+func (bl *BlockList) Scan(val interface{}) error {
+	if val == nil {
+		return nil
+	}
+	return json.Unmarshal(val.([]byte), bl)
+}
+
+// Value implements sql/driver.Valuer interface.
+func (bl BlockList) Value() (driver.Value, error) {
+	return json.Marshal(bl)
+}
+
+// Find returns the index of the given user in the list or -1 if the user is not blocked.
+func (bl BlockList) Find(user string) int {
+	for i := range bl {
+		if bl[i].User == user {
+			return i
+		}
+	}
+	return -1
+}
+
+// LoginAlias is a login previously used by the user.
+type LoginAlias struct {
+	// Authentication scheme the login belongs to.
+	Scheme string
+	// The old login.
+	Login string
+	// Time when the user stopped using the login.
+	ChangedAt time.Time
+}
+
+// AliasList is a history of user's logins. Defined so Scanner and Valuer can be attached to it.
+type AliasList []LoginAlias
+
+// Scan implements sql.Scanner interface.
+func (al *AliasList) Scan(val interface{}) error {
+	if val == nil {
+		return nil
+	}
+	return json.Unmarshal(val.([]byte), al)
+}
+
+// Value implements sql/driver.Valuer interface.
+func (al AliasList) Value() (driver.Value, error) {
+	return json.Marshal(al)
+}
+
+// Find returns the index of the given login in the list or -1 if the login is not found.
+func (al AliasList) Find(scheme, login string) int {
+	for i := range al {
+		if al[i].Scheme == scheme && al[i].Login == login {
+			return i
+		}
+	}
+	return -1
+}
+
+// SyncCursor is a position of a device in the message stream of a topic.
+type SyncCursor struct {
+	// ID of the device.
+	Device string
+	// SeqId of the latest message delivered to the device.
+	Delivered int
+	// SeqId of the latest message acknowledged by the device with {note what="recv"} or "read".
+	Ack int
+	// Time when the cursor was last moved.
+	UpdatedAt time.Time
+}
+
+// SyncCursors is a list of per-device cursors of a subscription. Defined so Scanner and Valuer can be attached to it.
+type SyncCursors []SyncCursor
+
+// Scan implements sql.Scanner interface.
+func (sc *SyncCursors) Scan(val interface{}) error {
+	// Start with a new slice: json.Unmarshal reuses the backing array of the old one.
+	*sc = nil
+	if val == nil {
+		return nil
+	}
+	return json.Unmarshal(val.([]byte), sc)
+}
+
+// Value implements sql/driver.Valuer interface.
+func (sc SyncCursors) Value() (driver.Value, error) {
+	return json.Marshal(sc)
+}
+
+// Find returns the index of the cursor of the given device or -1 if the device has no cursor.
+func (sc SyncCursors) Find(device string) int {
+	for i := range sc {
+		if sc[i].Device == device {
+			return i
+		}
+	}
+	return -1
+}
+
+// MessageDraft is an unsent message saved by the user on a subscription.
+type MessageDraft struct {
+	// Content of the draft. Nil if the draft was cleared.
+	Content interface{}
+	// SeqId of the message the draft is a reply to.
+	ReplyTo int
+	// Time when the draft was edited by the client.
+	UpdatedAt time.Time
+}
+
+// Scan implements sql.Scanner interface.
+func (md *MessageDraft) Scan(val interface{}) error {
+	return json.Unmarshal(val.([]byte), md)
+}
+
+// Value implements sql/driver.Valuer interface.
+func (md *MessageDraft) Value() (driver.Value, error) {
+	if md == nil {
+		return nil, nil
+	}
+	return json.Marshal(md)
+}
+
+// JoinRequest is a request of a user to join a group topic which is waiting for approval by the admins.
+type JoinRequest struct {
+	// Time when the request was made.
+	CreatedAt time.Time
+	// Message to the admins of the topic.
+	Note string `json:"Note,omitempty" bson:",omitempty"`
+}
+
+// Scan implements sql.Scanner interface.
+func (jr *JoinRequest) Scan(val interface{}) error {
+	return json.Unmarshal(val.([]byte), jr)
+}
+
+// Value implements sql/driver.Valuer interface.
+func (jr *JoinRequest) Value() (driver.Value, error) {
+	if jr == nil {
+		return nil, nil
+	}
+	return json.Marshal(jr)
+}
+
+// SubBan records the ban of a user from a group topic.
+type SubBan struct {
+	// Time when the user was banned.
+	CreatedAt time.Time
+	// Time when the ban is lifted automatically. Nil if the ban does not lapse.
+	Until *time.Time `json:"Until,omitempty" bson:",omitempty"`
+	// Reason given by the admin.
+	Reason string `json:"Reason,omitempty" bson:",omitempty"`
+	// ID of the admin who banned the user.
+	By string `json:"By,omitempty" bson:",omitempty"`
+	// Access given to the user before the ban, restored when the ban is lifted.
+	Given AccessMode
+}
+
+// Scan implements sql.Scanner interface.
+func (sb *SubBan) Scan(val interface{}) error {
+	return json.Unmarshal(val.([]byte), sb)
+}
+
+// Value implements sql/driver.Valuer interface.
+func (sb *SubBan) Value() (driver.Value, error) {
+	if sb == nil {
+		return nil, nil
+	}
+	return json.Marshal(sb)
+}
+
+// QuietHours is a daily period when notifications of a topic are muted, in the user's local time.
+type QuietHours struct {
+	// Start and end of the period in minutes since midnight. The period may span midnight.
+	Start int
+	End   int
+	// Offset of the user's local time from UTC in minutes.
+	TzOffset int
+}
+
+// Scan implements sql.Scanner interface.
+func (qh *QuietHours) Scan(val interface{}) error {
+	return json.Unmarshal(val.([]byte), qh)
+}
+
+// Value implements sql/driver.Valuer interface.
+func (qh *QuietHours) Value() (driver.Value, error) {
+	if qh == nil {
+		return nil, nil
+	}
+	return json.Marshal(qh)
+}
+
+// Consent holds the user's choices on sharing data. Choices which were not made default to sharing.
+type Consent struct {
+	// Engagement analytics may identify the user.
+	Analytics *bool `json:"analytics,omitempty" bson:",omitempty"`
+	// Promotional push notifications: channel broadcasts and digests.
+	Marketing *bool `json:"marketing,omitempty" bson:",omitempty"`
+	// Other users see which messages the user has received and read.
+	ReadReceipts *bool `json:"receipts,omitempty" bson:",omitempty"`
+	// Other users see when the user was last online.
+	LastSeen *bool `json:"lastseen,omitempty" bson:",omitempty"`
+}
+
+func consentGiven(choice *bool) bool {
+	return choice == nil || *choice
+}
+
+// AllowsAnalytics checks if the user consented to engagement analytics.
+func (c *Consent) AllowsAnalytics() bool {
+	return consentGiven(c.Analytics)
+}
+
+// AllowsMarketing checks if the user consented to promotional push notifications.
+func (c *Consent) AllowsMarketing() bool {
+	return consentGiven(c.Marketing)
+}
+
+// AllowsReadReceipts checks if the user consented to sharing read receipts.
+func (c *Consent) AllowsReadReceipts() bool {
+	return consentGiven(c.ReadReceipts)
+}
+
+// AllowsLastSeen checks if the user consented to sharing the time when the user was last online.
+func (c *Consent) AllowsLastSeen() bool {
+	return consentGiven(c.LastSeen)
+}
+
+// Scan implements sql.Scanner interface.
+func (c *Consent) Scan(val interface{}) error {
+	if val == nil {
+		return nil
+	}
+	return json.Unmarshal(val.([]byte), c)
+}
+
+// Value implements sql/driver.Valuer interface.
+func (c Consent) Value() (driver.Value, error) {
+	if c.Analytics == nil && c.Marketing == nil && c.ReadReceipts == nil && c.LastSeen == nil {
+		return nil, nil
+	}
+	return json.Marshal(c)
+}
+
+// ChatFolder is a named group of topics in the user's chat list.
+type ChatFolder struct {
+	Name string `json:"name"`
+	// Topics in the folder in display order.
+	Topics []string `json:"topics,omitempty" bson:",omitempty"`
+}
+
+// ChatList is the user's arrangement of the chat list shared by all user's devices.
+type ChatList struct {
+	// Pinned topics in display order.
+	Pinned []string `json:"pinned,omitempty" bson:",omitempty"`
+	// Folders in display order.
+	Folders []ChatFolder `json:"folders,omitempty" bson:",omitempty"`
+}
+
+// IsEmpty checks if the list has neither pinned topics nor folders.
+func (cl *ChatList) IsEmpty() bool {
+	return len(cl.Pinned) == 0 && len(cl.Folders) == 0
+}
+
+// Scan implements sql.Scanner interface.
+func (cl *ChatList) Scan(val interface{}) error {
+	if val == nil {
+		return nil
+	}
+	return json.Unmarshal(val.([]byte), cl)
+}
+
+// Value implements sql/driver.Valuer interface.
+func (cl ChatList) Value() (driver.Value, error) {
+	if cl.IsEmpty() {
+		return nil, nil
+	}
+	return json.Marshal(cl)
+}
+
+// AutoReply is a message sent by the server on behalf of the user in response to P2P messages,
+// such as a vacation notice.
+type AutoReply struct {
+	// Content of the reply. Auto-reply is disabled if nil.
+	Content interface{} `json:"content,omitempty" bson:",omitempty"`
+	// Time when the auto-reply becomes active, optional.
+	Start *time.Time `json:"start,omitempty" bson:",omitempty"`
+	// Time when the auto-reply stops being active, optional.
+	End *time.Time `json:"end,omitempty" bson:",omitempty"`
+}
+
+// Scan implements sql.Scanner interface.
+func (ar *AutoReply) Scan(val interface{}) error {
+	if val == nil {
+		return nil
+	}
+	return json.Unmarshal(val.([]byte), ar)
+}
+
+// Value implements sql/driver.Valuer interface.
+func (ar AutoReply) Value() (driver.Value, error) {
+	if ar.Content == nil {
+		return nil, nil
+	}
+	return json.Marshal(ar)
+}
+
+// Active checks if the auto-reply is enabled at the given time.
+func (ar *AutoReply) Active(now time.Time) bool {
+	if ar.Content == nil {
+		return false
+	}
+	if ar.Start != nil && now.Before(*ar.Start) {
+		return false
+	}
+	if ar.End != nil && !now.Before(*ar.End) {
+		return false
+	}
+	return true
+}
+
 // ObjState represents information on objects state,
 // such as an indication that User or Topic is suspended/soft-deleted.
 type ObjState int
@@ -394,8 +728,13 @@ type ObjState int
 const (
 	// StateOK indicates normal user or topic.
 	StateOK ObjState = 0
+	// StatePending indicates a new user account awaiting approval.
+	StatePending ObjState = 5
 	// StateSuspended indicates suspended user or topic.
 	StateSuspended ObjState = 10
+	// StateDeactivated indicates user who deactivated own account. The account is deleted
+	// unless the user logs in again within a grace period.
+	StateDeactivated ObjState = 15
 	// StateDeleted indicates soft-deleted user or topic.
 	StateDeleted ObjState = 20
 	// StateUndefined indicates state which has not been set explicitly.
@@ -407,8 +746,12 @@ func (os ObjState) String() string {
 	switch os {
 	case StateOK:
 		return "ok"
+	case StatePending:
+		return "pend"
 	case StateSuspended:
 		return "susp"
+	case StateDeactivated:
+		return "deact"
 	case StateDeleted:
 		return "del"
 	case StateUndefined:
@@ -423,8 +766,12 @@ func NewObjState(in string) (ObjState, error) {
 	switch in {
 	case "", "ok":
 		return StateOK, nil
+	case "pend":
+		return StatePending, nil
 	case "susp":
 		return StateSuspended, nil
+	case "deact":
+		return StateDeactivated, nil
 	case "del":
 		return StateDeleted, nil
 	case "undef":
@@ -485,11 +832,34 @@ type User struct {
 	UserAgent string
 
 	Public interface{}
+	// Values assigned by the server or root, such as a verified badge. Users cannot change them.
+	Trusted interface{}
 
 	// Unique indexed tags (email, phone) for finding this user. Stored on the
 	// 'users' as well as indexed in 'tagunique'
 	Tags StringSlice
 
+	// Users blocked by this user regardless of topics.
+	Blocked BlockList
+
+	// Logins previously used by this user.
+	Aliases AliasList
+
+	// Message sent automatically in response to P2P messages.
+	AutoReply AutoReply
+
+	// Language to translate incoming messages to, e.g. "en". No translation if empty.
+	AutoTranslate string
+
+	// Pinned topics and folders of the chat list.
+	ChatList ChatList
+
+	// Choices on sharing user's data.
+	Consent Consent
+
+	// Date of birth as YYYY-MM-DD, empty if unknown.
+	Birthdate string
+
 	// Info on known devices, used for push notifications
 	Devices map[string]*DeviceDef `bson:"__devices,skip,omitempty"`
 	// Same for mongodb scheme. Ignore in other db backends if its not suitable.
@@ -860,6 +1230,27 @@ type Subscription struct {
 	RecvSeqId int
 	// Last SeqID reported read by the user
 	ReadSeqId int
+	// Last SeqId reported as delivered to at least one of user's devices
+	DlvSeqId int
+	// Per-device positions in the message stream
+	Cursors SyncCursors
+	// Unsent message saved by the user
+	Draft *MessageDraft
+	// Notifications are muted until this time.
+	MuteUntil *time.Time `bson:",omitempty"`
+	// Notifications are muted daily during these hours.
+	Quiet *QuietHours `bson:",omitempty"`
+	// Which messages trigger push notifications: "all", "mentions" or "none". Empty if the P permission decides.
+	Notify string `bson:",omitempty"`
+	// Position in the message stream saved by the user, such as the scroll position.
+	AnchorSeq int
+	// Role label of the subscriber in a group topic, such as "moderator". Does not grant any permissions.
+	Role string
+	// Pending request of the user to join a group topic. Nil if there is no request.
+	Request *JoinRequest `bson:",omitempty"`
+	// Why and until when the user is banned from a group topic. Nil if the user is not banned or
+	// the ban was made without a reason or expiration.
+	Ban *SubBan `bson:",omitempty"`
 
 	// Access mode requested by this user
 	ModeWant AccessMode
@@ -873,6 +1264,8 @@ type Subscription struct {
 	// Deserialized public value from topic or user (depends on context)
 	// In case of P2P topics this is the Public value of the other user.
 	public interface{}
+	// Deserialized trusted value of the user, P2P topics and users only.
+	trusted interface{}
 	// deserialized SeqID from user or topic
 	seqId int
 	// Deserialized TouchedAt from topic
@@ -903,6 +1296,16 @@ func (s *Subscription) GetPublic() interface{} {
 	return s.public
 }
 
+// SetTrusted assigns the trusted value of the user, otherwise not accessible from outside the package.
+func (s *Subscription) SetTrusted(trusted interface{}) {
+	s.trusted = trusted
+}
+
+// GetTrusted reads value of the trusted field.
+func (s *Subscription) GetTrusted() interface{} {
+	return s.trusted
+}
+
 // SetWith sets other user for P2P subscriptions.
 func (s *Subscription) SetWith(with string) {
 	s.with = with
@@ -1027,10 +1430,297 @@ type Topic struct {
 	// Indexed tags for finding this topic.
 	Tags StringSlice
 
+	// IDs of custom emoji packs enabled in the topic.
+	Packs StringSlice
+
+	// Endpoint notified of membership changes, 'grp' only.
+	Webhook TopicWebhook
+
+	// Engagement counters, 'grp' only.
+	Stats TopicStats
+
+	// Read-only guest access to the channel, 'grp' only.
+	Guests TopicGuests
+
+	// IDs of co-owners: users who share the rights of the owner, 'grp' only.
+	Owners StringSlice
+
+	// Per-message read receipts are recorded, 'grp' only.
+	Receipts bool `json:"Receipts,omitempty" bson:",omitempty"`
+
+	// Only administrators may publish, 'grp' only.
+	Announce bool `json:"Announce,omitempty" bson:",omitempty"`
+
+	// Limits on the content of messages stricter than the global limits, 'grp' only.
+	Limits TopicLimits
+
+	// Limit of readers attached to the channel at the same time, channels only.
+	Capacity TopicCapacity
+
+	// Name of the parent topic when the topic belongs to a space, 'grp' only.
+	Parent string `json:"Parent,omitempty" bson:",omitempty"`
+
+	// Maximum number of subscribers overriding the global limit, 'grp' only. Zero if not overridden.
+	MaxSubs int `json:"MaxSubs,omitempty" bson:",omitempty"`
+
+	// Posting to the topic is suspended, 'grp' only.
+	Freeze TopicFreeze
+
+	// Default time to live of messages and the progress of deleting expired messages.
+	Expiry TopicExpiry
+
 	// Deserialized ephemeral params
 	perUser map[Uid]*perUserData // deserialized from Subscription
 }
 
+// TopicStats contains daily engagement counters of a topic.
+type TopicStats struct {
+	// Counters by day, oldest first.
+	Days []TopicDayStats `json:"days,omitempty" bson:",omitempty"`
+	// IDs of users who posted on the last day in Days, needed to count distinct posters.
+	Posters StringSlice `json:"posters,omitempty" bson:",omitempty"`
+	// Counters by hour for the last 24 hours, oldest first.
+	Hours []TopicHourStats `json:"hours,omitempty" bson:",omitempty"`
+	// Number of messages published.
+	Messages int64 `json:"msgs,omitempty" bson:",omitempty"`
+	// Size of the content of published messages, bytes.
+	Bytes int64 `json:"bytes,omitempty" bson:",omitempty"`
+	// Number of members when the counters were saved.
+	Members int `json:"members,omitempty" bson:",omitempty"`
+}
+
+// TopicDayStats contains engagement counters of a topic for one day, UTC.
+type TopicDayStats struct {
+	// Day in "2006-01-02" format.
+	Day string `json:"day"`
+	// Number of messages published.
+	Messages int `json:"msgs,omitempty" bson:",omitempty"`
+	// Number of distinct users who published messages.
+	Posters int `json:"posters,omitempty" bson:",omitempty"`
+	// Number of users who joined the topic.
+	Joins int `json:"joins,omitempty" bson:",omitempty"`
+	// Number of users who left or were removed from the topic.
+	Leaves int `json:"leaves,omitempty" bson:",omitempty"`
+}
+
+// TopicHourStats contains activity counters of a topic for one hour, UTC.
+type TopicHourStats struct {
+	// Hour in "2006-01-02T15" format.
+	Hour string `json:"hour"`
+	// Number of messages published.
+	Messages int `json:"msgs,omitempty" bson:",omitempty"`
+	// Number of users who joined the topic.
+	Joins int `json:"joins,omitempty" bson:",omitempty"`
+	// Number of users who left or were removed from the topic.
+	Leaves int `json:"leaves,omitempty" bson:",omitempty"`
+}
+
+// Scan implements sql.Scanner interface.
+func (ts *TopicStats) Scan(val interface{}) error {
+	if val == nil {
+		return nil
+	}
+	return json.Unmarshal(val.([]byte), ts)
+}
+
+// Value implements sql/driver.Valuer interface.
+func (ts TopicStats) Value() (driver.Value, error) {
+	if len(ts.Days) == 0 && ts.Members == 0 {
+		return nil, nil
+	}
+	return json.Marshal(ts)
+}
+
+// TopicLimits restricts the content of messages published to the topic. Zero values mean
+// the global limits apply.
+type TopicLimits struct {
+	// Maximum size of the content of a message, bytes.
+	MaxMessageSize int64 `json:"maxsize,omitempty" bson:",omitempty"`
+	// Maximum number of attachments in a message.
+	MaxAttachments int `json:"maxatt,omitempty" bson:",omitempty"`
+}
+
+// Scan implements sql.Scanner interface.
+func (tl *TopicLimits) Scan(val interface{}) error {
+	if val == nil {
+		return nil
+	}
+	return json.Unmarshal(val.([]byte), tl)
+}
+
+// Value implements sql/driver.Valuer interface.
+func (tl TopicLimits) Value() (driver.Value, error) {
+	if tl.MaxMessageSize == 0 && tl.MaxAttachments == 0 {
+		return nil, nil
+	}
+	return json.Marshal(tl)
+}
+
+// TopicCapacity limits the number of readers attached to a channel at the same time, e.g. for
+// ticketed live events.
+type TopicCapacity struct {
+	// Maximum number of attached readers. Zero if not limited.
+	Max int `json:"max,omitempty" bson:",omitempty"`
+	// What happens to readers over the limit: "reject" or "queue".
+	Overflow string `json:"overflow,omitempty" bson:",omitempty"`
+	// Seconds before a rejected reader should try again.
+	RetryAfter int `json:"retry,omitempty" bson:",omitempty"`
+}
+
+// Scan implements sql.Scanner interface.
+func (tc *TopicCapacity) Scan(val interface{}) error {
+	if val == nil {
+		return nil
+	}
+	return json.Unmarshal(val.([]byte), tc)
+}
+
+// Value implements sql/driver.Valuer interface.
+func (tc TopicCapacity) Value() (driver.Value, error) {
+	if tc.Max == 0 {
+		return nil, nil
+	}
+	return json.Marshal(tc)
+}
+
+// TopicFreeze suspends posting to a topic, optionally until the given time.
+type TopicFreeze struct {
+	// Time when the topic was frozen. Zero if the topic is not frozen.
+	Since time.Time `json:"since,omitempty" bson:",omitempty"`
+	// Time when the topic is unfrozen automatically. Nil if the freeze does not lapse.
+	Until *time.Time `json:"until,omitempty" bson:",omitempty"`
+	// ID of the user who froze the topic.
+	By string `json:"by,omitempty" bson:",omitempty"`
+}
+
+// Scan implements sql.Scanner interface.
+func (tf *TopicFreeze) Scan(val interface{}) error {
+	if val == nil {
+		return nil
+	}
+	return json.Unmarshal(val.([]byte), tf)
+}
+
+// Value implements sql/driver.Valuer interface.
+func (tf TopicFreeze) Value() (driver.Value, error) {
+	if tf.Since.IsZero() {
+		return nil, nil
+	}
+	return json.Marshal(tf)
+}
+
+// TopicExpiry is the default time to live of messages of a topic.
+type TopicExpiry struct {
+	// Time to live of new messages in seconds. Zero if messages do not expire by default.
+	Ttl int `json:"ttl,omitempty" bson:",omitempty"`
+	// Lowest seq ID of a message which may expire. Zero if no message is waiting to expire.
+	Seq int `json:"seq,omitempty" bson:",omitempty"`
+}
+
+// Scan implements sql.Scanner interface.
+func (te *TopicExpiry) Scan(val interface{}) error {
+	if val == nil {
+		return nil
+	}
+	return json.Unmarshal(val.([]byte), te)
+}
+
+// Value implements sql/driver.Valuer interface.
+func (te TopicExpiry) Value() (driver.Value, error) {
+	if te.Ttl == 0 && te.Seq == 0 {
+		return nil, nil
+	}
+	return json.Marshal(te)
+}
+
+// TopicDirectoryQuery selects one page of active topics listed in the directory under a category tag.
+type TopicDirectoryQuery struct {
+	// Tag of the category.
+	Tag string
+	// Sort topics by the number of members, most first. Otherwise by the time of the last message, latest first.
+	ByMembers bool
+	// The last topic of the previous page, nil for the first page.
+	After *TopicDirectoryCursor
+	// Topics with any of these tags are not listed.
+	Exclude []string
+	// Maximum number of topics to load.
+	Limit int
+}
+
+// TopicDirectoryCursor is the position of a topic in the directory: the sort key and the name of the topic
+// which breaks the ties.
+type TopicDirectoryCursor struct {
+	Name      string
+	Members   int
+	TouchedAt time.Time
+}
+
+// TopicGuests controls read-only access to a channel by unauthenticated guests.
+type TopicGuests struct {
+	// Maximum number of guests attached to the channel at the same time. Zero if guest access is disabled.
+	Limit int `json:"limit,omitempty" bson:",omitempty"`
+	// Key for signing guest tokens.
+	Secret []byte `json:"secret,omitempty" bson:",omitempty"`
+}
+
+// Scan implements sql.Scanner interface.
+func (tg *TopicGuests) Scan(val interface{}) error {
+	if val == nil {
+		return nil
+	}
+	return json.Unmarshal(val.([]byte), tg)
+}
+
+// Value implements sql/driver.Valuer interface.
+func (tg TopicGuests) Value() (driver.Value, error) {
+	if tg.Limit == 0 {
+		return nil, nil
+	}
+	return json.Marshal(tg)
+}
+
+// TopicWebhook is an endpoint which receives signed membership events of a topic.
+type TopicWebhook struct {
+	// URL to POST the events to. Empty if the webhook is not set.
+	Url string `json:"url,omitempty" bson:",omitempty"`
+	// Key for signing the events.
+	Secret string `json:"secret,omitempty" bson:",omitempty"`
+	// Events to report. All events are reported if empty.
+	Events StringSlice `json:"events,omitempty" bson:",omitempty"`
+}
+
+// Scan implements sql.Scanner interface.
+func (wh *TopicWebhook) Scan(val interface{}) error {
+	if val == nil {
+		return nil
+	}
+	return json.Unmarshal(val.([]byte), wh)
+}
+
+// Value implements sql/driver.Valuer interface.
+func (wh TopicWebhook) Value() (driver.Value, error) {
+	if wh.Url == "" {
+		return nil, nil
+	}
+	return json.Marshal(wh)
+}
+
+// Wants checks if the webhook reports the event.
+func (wh *TopicWebhook) Wants(event string) bool {
+	if wh.Url == "" {
+		return false
+	}
+	if len(wh.Events) == 0 {
+		return true
+	}
+	for _, e := range wh.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
 // GiveAccess updates access mode for the given user.
 func (t *Topic) GiveAccess(uid Uid, want, given AccessMode) {
 	if t.perUser == nil {
@@ -1124,6 +1814,18 @@ type Message struct {
 	From    string
 	Head    MessageHeaders `json:"Head,omitempty" bson:",omitempty"`
 	Content interface{}
+
+	// SeqId of the first message of the thread this message belongs to, 0 if the message is not a thread reply.
+	Thread int `json:"Thread,omitempty" bson:",omitempty"`
+	// Number of replies in the thread started by this message.
+	Replies int `json:"Replies,omitempty" bson:",omitempty"`
+	// Time of the latest reply in the thread started by this message.
+	LastReplyAt *time.Time `json:"LastReplyAt,omitempty" bson:",omitempty"`
+
+	// Type of media of the message, e.g. "audio", empty for other messages.
+	MediaType string `json:"MediaType,omitempty" bson:",omitempty"`
+	// MIME type of the first attachment of the message, empty if there are none.
+	Mime string `json:"Mime,omitempty" bson:",omitempty"`
 }
 
 // Range is a range of message SeqIDs. Low end is inclusive (closed), high end is exclusive (open): [Low, Hi).
@@ -1212,6 +1914,12 @@ type QueryOpt struct {
 	Order string
 	// last timestamp for pagination
 	LastCreatedAt *time.Time
+	// Messages: replies in the thread started by the message with this SeqId.
+	Thread int
+	// Messages: only messages with this type of media, e.g. "audio".
+	MediaType string
+	// Messages: only messages with attachments of these MIME types, e.g. "image/png" or "video/*".
+	Mime []string
 }
 
 // TopicCat is an enum of topic categories.
@@ -1259,6 +1967,10 @@ type DeviceDef struct {
 	LastSeen time.Time
 	// Device language, ISO code
 	Lang string
+	// Last successful push notification, nil if none yet
+	LastPushAt *time.Time
+	// Number of push notifications which failed since the last successful one
+	PushFailures int
 }
 
 // Media handling constants
@@ -1286,6 +1998,201 @@ type FileDef struct {
 	Location string
 }
 
+// EmojiItem is a single custom emoji or sticker.
+type EmojiItem struct {
+	// Short code which identifies the item in the pack, e.g. "party" for :party:.
+	Code string
+	// ID of the uploaded file with the image.
+	FileId string
+	// URL of the image as returned by the upload handler.
+	Ref string
+	// Type of the image.
+	MimeType string
+	// Item is a sticker rather than an inline emoji.
+	Sticker bool `json:"Sticker,omitempty" bson:",omitempty"`
+}
+
+// EmojiItems is a list of items in an emoji pack. Defined so Scanner and Valuer can be attached to it.
+type EmojiItems []EmojiItem
+
+// Scan implements sql.Scanner interface.
+func (ei *EmojiItems) Scan(val interface{}) error {
+	if val == nil {
+		return nil
+	}
+	return json.Unmarshal(val.([]byte), ei)
+}
+
+// Value implements sql/driver.Valuer interface.
+func (ei EmojiItems) Value() (driver.Value, error) {
+	return json.Marshal(ei)
+}
+
+// Find returns the index of the item with the given code or -1 if the pack has no such item.
+func (ei EmojiItems) Find(code string) int {
+	for i := range ei {
+		if ei[i].Code == code {
+			return i
+		}
+	}
+	return -1
+}
+
+// FileIds returns IDs of files used by the items.
+func (ei EmojiItems) FileIds() []string {
+	var fids []string
+	for i := range ei {
+		fids = append(fids, ei[i].FileId)
+	}
+	return fids
+}
+
+// EmojiPack is a named collection of custom emoji and stickers.
+type EmojiPack struct {
+	ObjHeader `bson:",inline"`
+	// Organization the pack belongs to. Empty for packs available to all users.
+	Org string
+	// Human-readable name of the pack.
+	Name string
+	// Emoji and stickers in the pack.
+	Items EmojiItems
+}
+
+// Digest is a schedule of periodic notifications which summarize new messages in a channel.
+// A reader with a digest receives it instead of a push notification for every message.
+type Digest struct {
+	ObjHeader `bson:",inline"`
+	// Reader of the channel.
+	User string
+	// Name of the channel, 'chnXXX'.
+	Topic string
+	// Interval between digests, minutes.
+	Period int
+	// Maximum number of messages in a digest.
+	Limit int
+	// Quiet hours, minutes since midnight of the reader's local time. Digests are not sent
+	// from QuietStart to QuietEnd. No quiet hours if the values are equal.
+	QuietStart int
+	QuietEnd   int
+	// Offset of the reader's local time from UTC, minutes.
+	TzOffset int
+	// SeqId of the latest message covered by a digest.
+	SeqId int
+	// Time when the next digest is due.
+	NextAt time.Time
+}
+
+// Responses to an event.
+const (
+	RsvpYes   = "yes"
+	RsvpNo    = "no"
+	RsvpMaybe = "maybe"
+)
+
+// CalEvent is an event, such as a meeting, announced by a message in a group topic. Members of the topic
+// respond whether they will attend. The event is identified by the topic and the seq ID of the message.
+type CalEvent struct {
+	ObjHeader `bson:",inline"`
+	// Name of the topic, 'grpXXX'.
+	Topic string
+	// SeqId of the message which announced the event.
+	SeqId    int
+	Title    string
+	Location string `json:"Location,omitempty" bson:",omitempty"`
+	StartAt  time.Time
+	EndAt    *time.Time `json:"EndAt,omitempty" bson:",omitempty"`
+	// Time when the reminder is due. Missing if the event has no reminder or the reminder has been sent.
+	RemindAt *time.Time `json:"RemindAt,omitempty" bson:",omitempty"`
+	// Responses of members: user ID -> RsvpYes, RsvpNo or RsvpMaybe.
+	Rsvp map[string]string `json:"Rsvp,omitempty" bson:",omitempty"`
+}
+
+// Receipt records that the user has read messages of the topic with SeqIds from SeqFrom to SeqTo inclusive.
+type Receipt struct {
+	Topic   string
+	User    string
+	SeqFrom int
+	SeqTo   int
+	ReadAt  time.Time
+}
+
+// Poll is a poll created by a message in a group topic. Members vote for one or, if the poll allows it,
+// several options.
+type Poll struct {
+	ObjHeader `bson:",inline"`
+	// Name of the topic, 'grpXXX'.
+	Topic string
+	// SeqId of the message which created the poll.
+	SeqId    int
+	Question string
+	Options  []string
+	// Members may vote for more than one option.
+	Multi bool `json:"Multi,omitempty" bson:",omitempty"`
+	// Votes of members: user ID -> indexes of the chosen options.
+	Votes map[string][]int `json:"Votes,omitempty" bson:",omitempty"`
+}
+
+// Mention records that the user was mentioned in the message SeqId of the topic and has not read it yet.
+// The same record is used for unread replies in the thread started by the user.
+type Mention struct {
+	Topic string
+	User  string
+	SeqId int
+	// SeqId of the first message of the thread if the message is a reply in the user's thread, 0 for mentions.
+	Thread    int
+	CreatedAt time.Time
+}
+
+// Bookmark records that the user has starred the message SeqId of the topic.
+type Bookmark struct {
+	// Unique ID of the bookmark: 'userid:topic:seqid'.
+	Id   string `bson:"_id"`
+	User string
+	// Name of the topic as stored, e.g. 'p2pXXX' or 'grpXXX'.
+	Topic     string
+	SeqId     int
+	CreatedAt time.Time
+}
+
+// ViewOnce marks a file attached to a view-once message: each user may retrieve the file once.
+type ViewOnce struct {
+	// ID of the file.
+	Id        string `bson:"_id"`
+	CreatedAt time.Time
+	// Name of the topic as stored, e.g. 'p2pXXX' or 'grpXXX'.
+	Topic string
+	SeqId int
+	// ID of the sender. The sender may retrieve the file any number of times.
+	From string
+}
+
+// ViewOnceView records that the user has retrieved the file attached to a view-once message.
+type ViewOnceView struct {
+	// Unique ID of the view: 'fileid:userid'.
+	Id        string `bson:"_id"`
+	CreatedAt time.Time
+	FileId    string
+	User      string
+	Topic     string
+}
+
+// AccountEvent is a security-related event in the user's account shown in the activity timeline.
+type AccountEvent struct {
+	Id        string `bson:"_id"`
+	CreatedAt time.Time
+	User      string
+	// Kind of the event: "login", "passwd", "cred", "export".
+	What string
+	// Details of the event, e.g. the authentication scheme or the credential method.
+	Detail string
+	// The login is from a device the user has not logged in from before.
+	NewDevice  bool
+	UserAgent  string
+	RemoteAddr string
+	// Push token of the device, if known.
+	DeviceId string
+}
+
 // FlattenDoubleSlice turns 2d slice into a 1d slice.
 func FlattenDoubleSlice(data [][]string) []string {
 	var result []string
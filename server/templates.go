@@ -0,0 +1,280 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *    Templates of group topics defined in the config. Provisioning tools
+ *    create topics from templates over gRPC in one request: the topic with
+ *    its tags, default access and public data, the starter subscribers and
+ *    the pinned message.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+
+	"github.com/tinode/chat/pbx"
+	"github.com/tinode/chat/server/auth"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// Name of the message header which marks the pinned message of a topic created from a template.
+const templatePinnedHeader = "pinned"
+
+// templateSubscriber is a subscriber of the topic created from the template.
+type templateSubscriber struct {
+	User string `json:"user"`
+	// Access mode given to the user, the default access of the topic if empty.
+	Mode string `json:"mode"`
+
+	uid  types.Uid
+	mode types.AccessMode
+}
+
+// topicTemplate is a template of a group topic.
+type topicTemplate struct {
+	// Create a channel rather than a group topic.
+	Channel bool               `json:"channel"`
+	Tags    []string           `json:"tags"`
+	DefAcs  *MsgDefaultAcsMode `json:"defacs"`
+	Public  interface{}        `json:"public"`
+	// Content of the message saved in the new topic and marked as pinned: a string or a Drafty document.
+	Pinned      interface{}          `json:"pinned"`
+	Subscribers []templateSubscriber `json:"subscribers"`
+
+	accessAuth types.AccessMode
+	accessAnon types.AccessMode
+}
+
+// templateParseSubscribers validates the subscribers and parses their access modes.
+func templateParseSubscribers(subs []templateSubscriber) error {
+	for i := range subs {
+		sub := &subs[i]
+		if sub.uid = types.ParseUserId(sub.User); sub.uid.IsZero() {
+			return errors.New("invalid subscriber '" + sub.User + "'")
+		}
+		sub.mode = types.ModeUnset
+		if sub.Mode != "" {
+			if err := sub.mode.UnmarshalText([]byte(sub.Mode)); err != nil {
+				return errors.New("invalid access mode of subscriber '" + sub.User + "'")
+			}
+			if sub.mode.IsOwner() {
+				return errors.New("subscriber '" + sub.User + "' cannot be given the O permission")
+			}
+		}
+	}
+	return nil
+}
+
+// templatesParse parses topic templates from the config. The pinned messages must not be larger
+// than maxMessageSize.
+func templatesParse(jsconf json.RawMessage, maxMessageSize int64) (map[string]*topicTemplate, error) {
+	templates := make(map[string]*topicTemplate)
+	if len(jsconf) > 0 {
+		if err := json.Unmarshal(jsconf, &templates); err != nil {
+			return nil, errors.New("failed to parse config: " + err.Error())
+		}
+	}
+
+	for name, tmpl := range templates {
+		if name == "" || tmpl == nil {
+			return nil, errors.New("invalid template '" + name + "'")
+		}
+		tmpl.accessAuth = getDefaultAccess(types.TopicCatGrp, true, tmpl.Channel)
+		tmpl.accessAnon = getDefaultAccess(types.TopicCatGrp, false, tmpl.Channel)
+		if tmpl.DefAcs != nil {
+			authMode, anonMode, err := parseTopicAccess(tmpl.DefAcs, tmpl.accessAuth, tmpl.accessAnon)
+			if err != nil || authMode.IsOwner() || anonMode.IsOwner() {
+				return nil, errors.New("invalid default access in template '" + name + "'")
+			}
+			tmpl.accessAuth, tmpl.accessAnon = authMode, anonMode
+		}
+		tmpl.Tags = normalizeTags(tmpl.Tags)
+		if err := templateParseSubscribers(tmpl.Subscribers); err != nil {
+			return nil, errors.New(err.Error() + " in template '" + name + "'")
+		}
+		if tmpl.Pinned != nil {
+			if content, _ := json.Marshal(tmpl.Pinned); int64(len(content)) > maxMessageSize {
+				return nil, errors.New("pinned message is too large in template '" + name + "'")
+			}
+		}
+	}
+
+	return templates, nil
+}
+
+// templateGet returns the template with the given name or nil.
+func templateGet(name string) *topicTemplate {
+	return liveConfig().templates[name]
+}
+
+// templateUsers checks that the owner and the subscribers exist and are not suspended.
+func templateUsers(uids []types.Uid) error {
+	users, err := store.Users.GetAll(uids...)
+	if err != nil {
+		return err
+	}
+	if len(users) != len(uids) {
+		return types.ErrUserNotFound
+	}
+	for i := range users {
+		if users[i].State != types.StateOK {
+			return types.ErrPermissionDenied
+		}
+	}
+	return nil
+}
+
+// templateCreate saves the topic, the subscriptions and the pinned message. If any of them fails,
+// the topic is deleted. Returns the seq ID of the pinned message.
+func templateCreate(stopic *types.Topic, owner types.Uid, subs []*types.Subscription, pinned *types.Message) (int, error) {
+	if err := store.Topics.Create(stopic, owner, nil); err != nil {
+		return 0, err
+	}
+
+	err := store.Subs.Create(subs...)
+	if err == nil && pinned != nil {
+		err = store.Messages.Save(pinned, true)
+	}
+	if err != nil {
+		if derr := store.Topics.Delete(stopic.Id, true); derr != nil {
+			log.Println("grpc template: failed to delete incomplete topic", stopic.Id, derr)
+		}
+		return 0, err
+	}
+
+	if pinned != nil {
+		return pinned.SeqId, nil
+	}
+	return 0, nil
+}
+
+// CreateTopic creates a group topic from the template.
+func (*grpcNodeServer) CreateTopic(ctx context.Context, req *pbx.TopicTemplateReq) (*pbx.TopicTemplateResp, error) {
+	var remoteAddr string
+	if p, ok := peer.FromContext(ctx); ok {
+		remoteAddr = p.Addr.String()
+	}
+
+	rec, err := historyAuthenticate(req.GetScheme(), req.GetSecret(), remoteAddr)
+	if err != nil {
+		log.Println("grpc template: authentication failed", remoteAddr, err)
+		return nil, historyStatus(err)
+	}
+	if rec.AuthLevel != auth.LevelRoot {
+		return nil, historyStatus(types.ErrPermissionDenied)
+	}
+
+	tmpl := templateGet(req.GetTemplate())
+	if tmpl == nil {
+		return nil, status.Error(codes.NotFound, "template not found")
+	}
+	owner := types.ParseUserId(req.GetOwnerId())
+	if owner.IsZero() {
+		return nil, status.Error(codes.InvalidArgument, "invalid owner")
+	}
+
+	public := tmpl.Public
+	if len(req.GetPublic()) > 0 {
+		if public = bytesToInterface(req.GetPublic()); public == nil {
+			return nil, status.Error(codes.InvalidArgument, "invalid public")
+		}
+	}
+
+	if _, err := descSchemaCheck(types.TopicCatGrp, public, nil, nil); err != nil {
+		return nil, status.Error(codes.InvalidArgument, "invalid public: "+err.Error())
+	}
+
+	tags := normalizeTags(append(append([]string{}, tmpl.Tags...), req.GetTags()...))
+	if len(tags) > liveConfig().maxTagCount {
+		return nil, status.Error(codes.ResourceExhausted, "too many tags")
+	}
+
+	// Subscribers of the template first, then the ones from the request. The owner is skipped.
+	extra := make([]templateSubscriber, 0, len(req.GetSubscribers()))
+	for _, sub := range req.GetSubscribers() {
+		extra = append(extra, templateSubscriber{User: sub.GetUserId(), Mode: sub.GetMode()})
+	}
+	if err = templateParseSubscribers(extra); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	uids := []types.Uid{owner}
+	given := make(map[types.Uid]types.AccessMode)
+	for _, sub := range append(append([]templateSubscriber{}, tmpl.Subscribers...), extra...) {
+		if _, ok := given[sub.uid]; ok || sub.uid == owner {
+			continue
+		}
+		mode := sub.mode
+		if mode == types.ModeUnset {
+			// Enable the subscription even if the default access is not a joiner.
+			mode = tmpl.accessAuth | types.ModeJoin
+		}
+		given[sub.uid] = mode
+		uids = append(uids, sub.uid)
+	}
+	if len(uids) > liveConfig().maxSubscriberCount {
+		return nil, status.Error(codes.ResourceExhausted, "too many subscribers")
+	}
+	if err = templateUsers(uids); err != nil {
+		return nil, historyStatus(err)
+	}
+
+	now := types.TimeNow()
+	name := globals.cluster.genLocalTopicName()
+	stopic := &types.Topic{
+		ObjHeader: types.ObjHeader{Id: name, CreatedAt: now},
+		Access:    types.DefaultAccess{Auth: tmpl.accessAuth, Anon: tmpl.accessAnon},
+		Tags:      tags,
+		UseBt:     tmpl.Channel,
+		Public:    public}
+	stopic.GiveAccess(owner, types.ModeCFull, types.ModeCFull)
+
+	subs := make([]*types.Subscription, 0, len(uids)-1)
+	for _, uid := range uids[1:] {
+		subs = append(subs, &types.Subscription{
+			User:      uid.String(),
+			Topic:     name,
+			ModeWant:  given[uid],
+			ModeGiven: given[uid],
+			CreatedAt: now,
+		})
+	}
+
+	var pinned *types.Message
+	if tmpl.Pinned != nil {
+		head := map[string]interface{}{templatePinnedHeader: true}
+		if _, ok := tmpl.Pinned.(string); !ok {
+			head["mime"] = "text/x-drafty"
+		}
+		pinned = &types.Message{
+			ObjHeader: types.ObjHeader{CreatedAt: now},
+			SeqId:     1,
+			Topic:     name,
+			From:      owner.String(),
+			Head:      head,
+			Content:   tmpl.Pinned,
+		}
+	}
+
+	seq, err := templateCreate(stopic, owner, subs, pinned)
+	if err != nil {
+		log.Println("grpc template: failed to create topic", req.GetTemplate(), err)
+		return nil, historyStatus(err)
+	}
+
+	for _, uid := range uids {
+		usersRegisterUser(uid, true)
+	}
+
+	log.Println("grpc template: created topic", name, "from", req.GetTemplate(), "for", owner.UserId(),
+		"by", rec.Uid.UserId())
+	return &pbx.TopicTemplateResp{Topic: name, Subscribers: int32(len(uids)), PinnedSeqId: int32(seq)}, nil
+}
@@ -0,0 +1,23 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *    Threaded replies: messages with the 'thread' header are indexed by the
+ *    first message of the thread which keeps the thread summary.
+ *
+ *****************************************************************************/
+
+package main
+
+// Header of messages which belong to a thread: ID of the first message of the thread ":123".
+const msgThreadHeader = "thread"
+
+// msgThreadRoot returns the seq ID of the first message of the thread the message belongs to, 0 if the message
+// is not a thread reply. The second value is false if the header is present but malformed.
+func msgThreadRoot(head map[string]interface{}) (int, bool) {
+	if _, ok := head[msgThreadHeader]; !ok {
+		return 0, true
+	}
+	seq := msgHeadSeq(head, msgThreadHeader)
+	return seq, seq > 0
+}
@@ -9,16 +9,19 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
 	"log"
 	"reflect"
 	"sort"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/tinode/chat/server/auth"
 	"github.com/tinode/chat/server/concurrency"
+	"github.com/tinode/chat/server/journal"
 	"github.com/tinode/chat/server/push"
 	"github.com/tinode/chat/server/store"
 	"github.com/tinode/chat/server/store/types"
@@ -77,11 +80,16 @@ type Topic struct {
 	// ID of the deletion operation. Not an ID of the message.
 	delID int
 
+	// Cache of the most recent messages. Could be nil.
+	recent *recentMessages
+
 	// Last published userAgent ('me' topic only)
 	userAgent string
 
 	// User ID of the topic owner/creator. Could be zero.
 	owner types.Uid
+	// IDs of co-owners who share the rights of the owner, 'grp' only.
+	owners []types.Uid
 
 	// Default access mode
 	accessAuth types.AccessMode
@@ -90,11 +98,89 @@ type Topic struct {
 	// Topic discovery tags
 	tags []string
 
+	// Users blocked by the topic owner, 'me' only. Shared with blockLists: never modified in place.
+	blocked types.BlockList
+
+	// Auto-reply of the topic owner, 'me' only.
+	autoReply types.AutoReply
+
+	// Language to translate incoming messages to, 'me' only.
+	autoTranslate string
+
+	// Date of birth of the user, 'me' and 'fnd' only. The 'fnd' topic keeps the value it was loaded with:
+	// the date of birth can be set only once, until then the user is treated as a minor.
+	birthdate string
+
+	// Pinned topics and folders of the chat list, 'me' only.
+	chatList types.ChatList
+
+	// Consent to sharing data, 'me' only.
+	consent types.Consent
+
+	// IDs of custom emoji packs enabled in the topic, 'grp' only.
+	packs []string
+
+	// Endpoint notified of membership changes, 'grp' only.
+	webhook types.TopicWebhook
+
+	// Daily engagement counters, 'grp' only.
+	stats types.TopicStats
+	// Counters have changed since they were last saved.
+	statsDirty bool
+	// Time when the counters were last saved.
+	statsSaved time.Time
+
+	// Read-only guest access to the channel, 'grp' only.
+	guests types.TopicGuests
+
+	// Per-message read receipts are recorded, 'grp' only.
+	receipts bool
+	// Only administrators may publish, 'grp' only.
+	announce bool
+	// Limits on the content of messages set by the owner, 'grp' only.
+	limits types.TopicLimits
+	// Number of guest sessions attached to the channel.
+	guestsOnline int
+	// Limit of readers attached to the channel at the same time.
+	capacity types.TopicCapacity
+	// Parent topic of the space the topic belongs to, 'grp' only.
+	parent string
+	// Maximum number of subscribers overriding the global limit, 'grp' only. Zero if not overridden.
+	maxSubs int
+	// Posting is suspended, 'grp' only.
+	freeze types.TopicFreeze
+	// Fires when the freeze lapses.
+	freezeTimer *time.Timer
+	// Fires when the earliest ban lapses, 'grp' only.
+	banTimer *time.Timer
+	// Default time to live of messages, 'grp' only.
+	expiry types.TopicExpiry
+	// Fires when expired messages should be deleted.
+	expiryTimer *time.Timer
+	// Readers waiting for a free slot in the channel, oldest first.
+	capQueue []*sessionJoin
+	// The channel was full when the webhook was last notified.
+	capFull bool
+	// Number of channel readers, channels only.
+	chanReaders int
+	// Size of the audience last sent to the attached sessions, channels only.
+	audienceSent MsgAudience
+	// Read and received pointers of channel readers who have acknowledged messages, channels only.
+	chanCursors map[types.Uid]*chanCursor
+
+	// State of the topic last replicated to the standby node, 'grp' only. Could be nil.
+	standby *topicStandby
+	// Users who were online in the topic before the failover and have not come back yet, 'grp' only.
+	standbyOnline map[types.Uid]bool
+
 	// Topic's public data
 	public interface{}
+	// Values assigned to the user by the server or root, 'me' only.
+	trusted interface{}
 
-	// Topic's per-subscriber data
-	perUser map[types.Uid]perUserData
+	// Topic's per-subscriber data. The records are owned by the topic goroutine: they must not be
+	// accessed from other goroutines and pointers to them must not be retained outside of the topic.
+	perUser map[types.Uid]*perUserData
 	// Union of permissions across all users (used by proxy sessions with uid = 0).
 	// These are used by master topics only (in the proxy-master topic context)
 	// as a coarse-grained attempt to perform acs checks since proxy sessions "impersonate"
@@ -126,6 +212,13 @@ type Topic struct {
 	proxy chan *ClusterResp
 	// Channel to receive topic proxy service requests, e.g. sending deferred notifications.
 	master chan *ClusterSessUpdate
+	// Request to shut down the idle topic without waiting for the timeout. Buffered = 1.
+	expire chan bool
+
+	// Time of the last processed request, Unix nanoseconds. Read/written atomically.
+	lastActive int64
+	// Estimated size of memory used by the topic, bytes. Read/written atomically.
+	memSize int64
 
 	// Flag which tells topic lifecycle status: new, ready, paused, marked for deletion.
 	status int32
@@ -143,16 +236,43 @@ type perUserData struct {
 	// Last t.lastId reported by user through {pres} as received or read
 	recvID int
 	readID int
+	// Last t.lastId reported as delivered to one of user's devices
+	dlvID int
 	// ID of the latest Delete operation
 	delID int
+	// Positions of user's devices in the message stream.
+	cursors types.SyncCursors
+	// Kind and time of the last activity indicator forwarded to other subscribers.
+	kpAct string
+	kpAt  time.Time
+	// Time of the latest typing notification or focus report from the user, zero if the user
+	// has reported losing focus. Push notifications are suppressed while the user is active.
+	activeAt time.Time
 
 	private interface{}
 
 	modeWant  types.AccessMode
 	modeGiven types.AccessMode
 
+	// Notifications are muted until this time. Zero if not muted.
+	muteUntil time.Time
+	// Daily quiet hours of push notifications. Nil if not set.
+	quiet *types.QuietHours
+	// Which messages trigger push notifications, empty if the P permission decides.
+	notify string
+
+	// Why and until when the user is banned, 'grp' only. Nil if unknown or not banned.
+	ban *types.SubBan
+
+	// Pending request to join the topic, 'grp' only.
+	request *types.JoinRequest
+
+	// User's consent to sharing data, loaded when the user attaches to the topic. Nil if not known.
+	consent *types.Consent
+
 	// P2P only:
 	public    interface{}
+	trusted   interface{}
 	topicName string
 	deleted   bool
 }
@@ -175,6 +295,30 @@ type perSessionData struct {
 	isChanSub bool
 	// IDs of subscribed users in a multiplexing session.
 	muids []types.Uid
+	// Flow control state, nil if the session did not request flow control.
+	flow *flowControl
+	// Unauthenticated guest attached to the channel with a guest token.
+	guest bool
+}
+
+// flowControl is a credit-based flow control window of a session subscribed to a channel.
+type flowControl struct {
+	// Number of {data} messages which can be sent to the session.
+	credit int
+	// Number of {data} messages not sent because the credit was exhausted.
+	skipped int
+	// Range of SeqIds of skipped messages [since, before).
+	since  int
+	before int
+}
+
+// skip records a message not sent to the session.
+func (fc *flowControl) skip(seq int) {
+	if fc.skipped == 0 {
+		fc.since = seq
+	}
+	fc.before = seq + 1
+	fc.skipped++
 }
 
 // Reasons why topic is being shut down.
@@ -187,6 +331,8 @@ const (
 	StopDeleted
 	// StopRehashing terminated due to cluster rehashing (moved to a different node).
 	StopRehashing
+	// StopReloading terminated to be loaded again with changes made directly in the database.
+	StopReloading
 )
 
 // Topic shutdown
@@ -221,8 +367,10 @@ func (t *Topic) getPerUserAcs(uid types.Uid) (types.AccessMode, types.AccessMode
 		// For zero uids (typically for proxy sessions), return the union of all permissions.
 		return t.modeWantUnion, t.modeGivenUnion
 	}
-	pud := t.perUser[uid]
-	return pud.modeWant, pud.modeGiven
+	if pud, ok := t.perUser[uid]; ok {
+		return pud.modeWant, pud.modeGiven
+	}
+	return types.ModeNone, types.ModeNone
 }
 
 // passesPresenceFilters applies presence filters to `msg`
@@ -230,7 +378,9 @@ func (t *Topic) getPerUserAcs(uid types.Uid) (types.AccessMode, types.AccessMode
 func (t *Topic) passesPresenceFilters(pres *MsgServerPres, uid types.Uid) bool {
 	modeWant, modeGiven := t.getPerUserAcs(uid)
 	// "gone" and "acs" notifications are sent even if the topic is muted.
-	return ((modeGiven & modeWant).IsPresencer() || pres.What == "gone" || pres.What == "acs") &&
+	// "audience" is sent to channel readers too, "freeze" to everyone who may be posting.
+	return ((modeGiven & modeWant).IsPresencer() || pres.What == "gone" || pres.What == "acs" ||
+		pres.What == "audience" || pres.What == "freeze") &&
 		(pres.FilterIn == 0 || int(modeGiven&modeWant)&pres.FilterIn != 0) &&
 		(pres.FilterOut == 0 || int(modeGiven&modeWant)&pres.FilterOut == 0)
 }
@@ -279,7 +429,6 @@ func (t *Topic) fixUpUserCounts(userCounts map[types.Uid]int) {
 	for uid, decrementBy := range userCounts {
 		if pud, ok := t.perUser[uid]; ok {
 			pud.online -= decrementBy
-			t.perUser[uid] = pud
 			if pud.online < 0 {
 				log.Printf("topic[%s]: invalid online count for user %s", t.name, uid)
 			}
@@ -289,7 +438,7 @@ func (t *Topic) fixUpUserCounts(userCounts map[types.Uid]int) {
 
 func (t *Topic) runLocal(hub *Hub) {
 	// Kills topic after a period of inactivity.
-	keepAlive := idleMasterTopicTimeout
+	keepAlive := liveConfig().topicIdleTimeout
 	killTimer := time.NewTimer(time.Hour)
 	killTimer.Stop()
 
@@ -301,7 +450,38 @@ func (t *Topic) runLocal(hub *Hub) {
 	// Ticker for deferred presence notifications.
 	defrNotifTimer := time.NewTimer(time.Millisecond * 500)
 
+	// Sends updates of the audience size to channel readers. Channels only.
+	audienceTimer := time.NewTimer(time.Hour)
+	audienceTimer.Stop()
+	if t.cat == types.TopicCatGrp && t.isChan {
+		audienceTimer.Reset(audienceInterval)
+	}
+
+	// Lifts the freeze of the topic when it lapses.
+	t.freezeTimer = time.NewTimer(time.Hour)
+	t.freezeTimer.Stop()
+	t.freezeSchedule()
+
+	// Lifts bans of users when they lapse.
+	t.banTimer = time.NewTimer(time.Hour)
+	t.banTimer.Stop()
+	t.banSchedule()
+
+	// Deletes expired messages.
+	t.expiryTimer = time.NewTimer(time.Hour)
+	t.expiryTimer.Stop()
+	t.expirySchedule()
+
+	// Replicates the state of the topic to the standby node.
+	standbyTimer := time.NewTimer(time.Hour)
+	standbyTimer.Stop()
+	if t.standbyEnabled() {
+		standbyTimer.Reset(globals.cluster.sb.interval)
+	}
+
 	for {
+		t.updateAccounting()
+
 		select {
 		case join := <-t.reg:
 			// Request to add a connection to this topic
@@ -311,15 +491,28 @@ func (t *Topic) runLocal(hub *Hub) {
 				// The topic is alive, so stop the kill timer, if it's ticking. We don't want the topic to die
 				// while processing the call
 				killTimer.Stop()
-				if err := t.handleSubscription(hub, join); err == nil {
+				t.markIdle(false)
+				var err error
+				if join.pub != nil {
+					err = t.handlePublishDirect(hub, join)
+				} else {
+					err = t.handleSubscription(hub, join)
+				}
+				if err == nil {
 					if join.pkt.Sub.Created {
 						// Call plugins with the new topic
 						pluginTopic(t, plgActCreate)
 					}
+					if join.pub != nil && len(t.sessions) == 0 {
+						// The message is published without attaching the session.
+						killTimer.Reset(keepAlive)
+						t.markIdle(true)
+					}
 				} else {
 					if len(t.sessions) == 0 && t.cat != types.TopicCatSys {
 						// Failed to subscribe, the topic is still inactive
 						killTimer.Reset(keepAlive)
+						t.markIdle(true)
 					}
 					log.Printf("topic[%s] subscription failed %v, sid=%s", t.name, err, join.sess.sid)
 				}
@@ -329,6 +522,8 @@ func (t *Topic) runLocal(hub *Hub) {
 			}
 		case leave := <-t.unreg:
 			t.handleLeaveRequest(hub, leave)
+			// Let the waiting readers into the channel.
+			t.capacityUpdate(hub)
 			if leave.pkt != nil && leave.sess.inflightReqs != nil {
 				// If it's a client initiated request.
 				leave.sess.inflightReqs.Done()
@@ -337,6 +532,7 @@ func (t *Topic) runLocal(hub *Hub) {
 			// If there are no more subscriptions to this topic, start a kill timer
 			if len(t.sessions) == 0 && t.cat != types.TopicCatSys {
 				killTimer.Reset(keepAlive)
+				t.markIdle(true)
 			}
 
 		case msg := <-t.broadcast:
@@ -344,6 +540,17 @@ func (t *Topic) runLocal(hub *Hub) {
 			t.handleBroadcast(msg)
 
 		case meta := <-t.meta:
+			if meta.task != nil {
+				// Change of the stored state of the topic made by the server.
+				meta.done <- meta.task(t)
+				continue
+			}
+			if meta.pkt == nil {
+				// Request from the hub to update trusted values of a user.
+				t.updateTrusted(meta.forUser, meta.trusted)
+				continue
+			}
+
 			// Request to get/set topic metadata
 			asUid := types.ParseUserId(meta.pkt.AsUser)
 			authLevel := auth.Level(meta.pkt.AuthLvl)
@@ -370,6 +577,11 @@ func (t *Topic) runLocal(hub *Hub) {
 						log.Printf("topic[%s] meta.Get.Del failed: %s", t.name, err)
 					}
 				}
+				if meta.pkt.MetaWhat&constMsgMetaGap != 0 {
+					if err := t.replyGetGap(meta.sess, asUid, meta.pkt.Get.Gap, meta.pkt); err != nil {
+						log.Printf("topic[%s] meta.Get.Gap failed: %s", t.name, err)
+					}
+				}
 				if meta.pkt.MetaWhat&constMsgMetaTags != 0 {
 					if err := t.replyGetTags(meta.sess, asUid, meta.pkt); err != nil {
 						log.Printf("topic[%s] meta.Get.Tags failed: %s", t.name, err)
@@ -381,6 +593,126 @@ func (t *Topic) runLocal(hub *Hub) {
 						log.Printf("topic[%s] meta.Get.Creds failed: %s", t.name, err)
 					}
 				}
+				if meta.pkt.MetaWhat&constMsgMetaBlock != 0 {
+					if err := t.replyGetBlocks(meta.sess, asUid, meta.pkt); err != nil {
+						log.Printf("topic[%s] meta.Get.Block failed: %s", t.name, err)
+					}
+				}
+				if meta.pkt.MetaWhat&constMsgMetaDraft != 0 {
+					if err := t.replyGetDraft(meta.sess, asUid, meta.pkt); err != nil {
+						log.Printf("topic[%s] meta.Get.Draft failed: %s", t.name, err)
+					}
+				}
+				if meta.pkt.MetaWhat&constMsgMetaEmoji != 0 {
+					if err := t.replyGetEmoji(meta.sess, asUid, meta.pkt); err != nil {
+						log.Printf("topic[%s] meta.Get.Emoji failed: %s", t.name, err)
+					}
+				}
+				if meta.pkt.MetaWhat&constMsgMetaHook != 0 {
+					if err := t.replyGetHook(meta.sess, asUid, meta.pkt); err != nil {
+						log.Printf("topic[%s] meta.Get.Hook failed: %s", t.name, err)
+					}
+				}
+				if meta.pkt.MetaWhat&constMsgMetaAutoReply != 0 {
+					if err := t.replyGetAutoReply(meta.sess, asUid, meta.pkt); err != nil {
+						log.Printf("topic[%s] meta.Get.AutoReply failed: %s", t.name, err)
+					}
+				}
+				if meta.pkt.MetaWhat&constMsgMetaStats != 0 {
+					if err := t.replyGetStats(meta.sess, asUid, authLevel, meta.pkt.Get.Stats, meta.pkt); err != nil {
+						log.Printf("topic[%s] meta.Get.Stats failed: %s", t.name, err)
+					}
+				}
+				if meta.pkt.MetaWhat&constMsgMetaLink != 0 {
+					if err := t.replyGetLink(meta.sess, asUid, meta.pkt.Get.Link, meta.pkt); err != nil {
+						log.Printf("topic[%s] meta.Get.Link failed: %s", t.name, err)
+					}
+				}
+				if meta.pkt.MetaWhat&constMsgMetaGuests != 0 {
+					if err := t.replyGetGuests(meta.sess, asUid, meta.pkt.Get.Guests, meta.pkt); err != nil {
+						log.Printf("topic[%s] meta.Get.Guests failed: %s", t.name, err)
+					}
+				}
+				if meta.pkt.MetaWhat&constMsgMetaOwners != 0 {
+					if err := t.replyGetOwners(meta.sess, asUid, meta.pkt); err != nil {
+						log.Printf("topic[%s] meta.Get.Owners failed: %s", t.name, err)
+					}
+				}
+				if meta.pkt.MetaWhat&constMsgMetaTranslate != 0 {
+					if err := t.replyGetTranslate(meta.sess, asUid, meta.pkt.Get.Translate, meta.pkt); err != nil {
+						log.Printf("topic[%s] meta.Get.Translate failed: %s", t.name, err)
+					}
+				}
+				if meta.pkt.MetaWhat&constMsgMetaDigest != 0 {
+					if err := t.replyGetDigest(meta.sess, asUid, meta.pkt); err != nil {
+						log.Printf("topic[%s] meta.Get.Digest failed: %s", t.name, err)
+					}
+				}
+				if meta.pkt.MetaWhat&constMsgMetaConsent != 0 {
+					if err := t.replyGetConsent(meta.sess, asUid, meta.pkt); err != nil {
+						log.Printf("topic[%s] meta.Get.Consent failed: %s", t.name, err)
+					}
+				}
+				if meta.pkt.MetaWhat&constMsgMetaPending != 0 {
+					if err := t.replyGetPending(meta.sess, asUid, authLevel, meta.pkt); err != nil {
+						log.Printf("topic[%s] meta.Get.Pending failed: %s", t.name, err)
+					}
+				}
+				if meta.pkt.MetaWhat&constMsgMetaDevices != 0 {
+					if err := t.replyGetDevices(meta.sess, asUid, authLevel, meta.pkt.Get.Devices, meta.pkt); err != nil {
+						log.Printf("topic[%s] meta.Get.Devices failed: %s", t.name, err)
+					}
+				}
+				if meta.pkt.MetaWhat&constMsgMetaEvents != 0 {
+					if err := t.replyGetEvents(meta.sess, asUid, meta.pkt); err != nil {
+						log.Printf("topic[%s] meta.Get.Events failed: %s", t.name, err)
+					}
+				}
+				if meta.pkt.MetaWhat&constMsgMetaReview != 0 {
+					if err := t.replyGetReview(meta.sess, asUid, authLevel, meta.pkt); err != nil {
+						log.Printf("topic[%s] meta.Get.Review failed: %s", t.name, err)
+					}
+				}
+				if meta.pkt.MetaWhat&constMsgMetaReceipts != 0 {
+					if err := t.replyGetReceipts(meta.sess, asUid, meta.pkt.Get.Receipts, meta.pkt); err != nil {
+						log.Printf("topic[%s] meta.Get.Receipts failed: %s", t.name, err)
+					}
+				}
+				if meta.pkt.MetaWhat&constMsgMetaPoll != 0 {
+					if err := t.replyGetPoll(meta.sess, asUid, meta.pkt.Get.Poll, meta.pkt); err != nil {
+						log.Printf("topic[%s] meta.Get.Poll failed: %s", t.name, err)
+					}
+				}
+				if meta.pkt.MetaWhat&constMsgMetaStarred != 0 {
+					if err := t.replyGetStarred(meta.sess, asUid, meta.pkt); err != nil {
+						log.Printf("topic[%s] meta.Get.Starred failed: %s", t.name, err)
+					}
+				}
+				if meta.pkt.MetaWhat&constMsgMetaInbox != 0 {
+					if err := t.replyGetInbox(meta.sess, asUid, meta.pkt); err != nil {
+						log.Printf("topic[%s] meta.Get.Inbox failed: %s", t.name, err)
+					}
+				}
+				if meta.pkt.MetaWhat&constMsgMetaActivity != 0 {
+					if err := t.replyGetActivity(meta.sess, asUid, meta.pkt); err != nil {
+						log.Printf("topic[%s] meta.Get.Activity failed: %s", t.name, err)
+					}
+				}
+				if meta.pkt.MetaWhat&constMsgMetaRequests != 0 {
+					if err := t.replyGetRequests(meta.sess, asUid, meta.pkt); err != nil {
+						log.Printf("topic[%s] meta.Get.Requests failed: %s", t.name, err)
+					}
+				}
+				if meta.pkt.MetaWhat&constMsgMetaBanned != 0 {
+					if err := t.replyGetBanned(meta.sess, asUid, meta.pkt); err != nil {
+						log.Printf("topic[%s] meta.Get.Banned failed: %s", t.name, err)
+					}
+				}
+				if meta.pkt.MetaWhat&constMsgMetaDirectory != 0 {
+					if err := t.replyGetDirectory(meta.sess, asUid, meta.pkt.Get.Directory, meta.pkt); err != nil {
+						log.Printf("topic[%s] meta.Get.Directory failed: %s", t.name, err)
+					}
+				}
 
 			case meta.pkt.Set != nil:
 				// Set request
@@ -407,19 +739,153 @@ func (t *Topic) runLocal(hub *Hub) {
 						log.Printf("topic[%s] meta.Set.Cred failed: %v", t.name, err)
 					}
 				}
+				if meta.pkt.MetaWhat&constMsgMetaBlock != 0 {
+					if err := t.replySetBlock(meta.sess, asUid, meta.pkt); err != nil {
+						log.Printf("topic[%s] meta.Set.Block failed: %v", t.name, err)
+					}
+				}
+				if meta.pkt.MetaWhat&constMsgMetaDraft != 0 {
+					if err := t.replySetDraft(meta.sess, asUid, meta.pkt); err != nil {
+						log.Printf("topic[%s] meta.Set.Draft failed: %v", t.name, err)
+					}
+				}
+				if meta.pkt.MetaWhat&constMsgMetaEmoji != 0 {
+					if err := t.replySetEmoji(meta.sess, asUid, authLevel, meta.pkt); err != nil {
+						log.Printf("topic[%s] meta.Set.Emoji failed: %v", t.name, err)
+					}
+				}
+				if meta.pkt.MetaWhat&constMsgMetaHook != 0 {
+					if err := t.replySetHook(meta.sess, asUid, meta.pkt); err != nil {
+						log.Printf("topic[%s] meta.Set.Hook failed: %v", t.name, err)
+					}
+				}
+				if meta.pkt.MetaWhat&constMsgMetaAutoReply != 0 {
+					if err := t.replySetAutoReply(meta.sess, asUid, meta.pkt); err != nil {
+						log.Printf("topic[%s] meta.Set.AutoReply failed: %v", t.name, err)
+					}
+				}
+				if meta.pkt.MetaWhat&constMsgMetaImport != 0 {
+					if err := t.replySetImport(meta.sess, authLevel, meta.pkt); err != nil {
+						log.Printf("topic[%s] meta.Set.Import failed: %v", t.name, err)
+					}
+				}
+				if meta.pkt.MetaWhat&constMsgMetaGuests != 0 {
+					if err := t.replySetGuests(meta.sess, asUid, meta.pkt); err != nil {
+						log.Printf("topic[%s] meta.Set.Guests failed: %v", t.name, err)
+					}
+				}
+				if meta.pkt.MetaWhat&constMsgMetaOwners != 0 {
+					if err := t.replySetOwners(meta.sess, asUid, meta.pkt); err != nil {
+						log.Printf("topic[%s] meta.Set.Owners failed: %v", t.name, err)
+					}
+				}
+				if meta.pkt.MetaWhat&constMsgMetaTranslate != 0 {
+					if err := t.replySetTranslate(meta.sess, asUid, meta.pkt); err != nil {
+						log.Printf("topic[%s] meta.Set.Translate failed: %v", t.name, err)
+					}
+				}
+				if meta.pkt.MetaWhat&constMsgMetaDigest != 0 {
+					if err := t.replySetDigest(meta.sess, asUid, meta.pkt); err != nil {
+						log.Printf("topic[%s] meta.Set.Digest failed: %v", t.name, err)
+					}
+				}
+				if meta.pkt.MetaWhat&constMsgMetaMute != 0 {
+					if err := t.replySetMute(meta.sess, asUid, meta.pkt); err != nil {
+						log.Printf("topic[%s] meta.Set.Mute failed: %v", t.name, err)
+					}
+				}
+				if meta.pkt.MetaWhat&constMsgMetaChatList != 0 {
+					if err := t.replySetChatList(meta.sess, asUid, meta.pkt); err != nil {
+						log.Printf("topic[%s] meta.Set.ChatList failed: %v", t.name, err)
+					}
+				}
+				if meta.pkt.MetaWhat&constMsgMetaConsent != 0 {
+					if err := t.replySetConsent(meta.sess, asUid, meta.pkt); err != nil {
+						log.Printf("topic[%s] meta.Set.Consent failed: %v", t.name, err)
+					}
+				}
+				if meta.pkt.MetaWhat&constMsgMetaRsvp != 0 {
+					if err := t.replySetRsvp(meta.sess, asUid, meta.pkt); err != nil {
+						log.Printf("topic[%s] meta.Set.Rsvp failed: %v", t.name, err)
+					}
+				}
+				if meta.pkt.MetaWhat&constMsgMetaReview != 0 {
+					if err := t.replySetReview(meta.sess, asUid, authLevel, meta.pkt); err != nil {
+						log.Printf("topic[%s] meta.Set.Review failed: %v", t.name, err)
+					}
+				}
+				if meta.pkt.MetaWhat&constMsgMetaReceipts != 0 {
+					if err := t.replySetReceipts(meta.sess, asUid, meta.pkt); err != nil {
+						log.Printf("topic[%s] meta.Set.Receipts failed: %v", t.name, err)
+					}
+				}
+				if meta.pkt.MetaWhat&constMsgMetaRepair != 0 {
+					if err := t.replySetRepair(meta.sess, asUid, authLevel, meta.pkt); err != nil {
+						log.Printf("topic[%s] meta.Set.Repair failed: %v", t.name, err)
+					}
+				}
+				if meta.pkt.MetaWhat&constMsgMetaAnnounce != 0 {
+					if err := t.replySetAnnounce(meta.sess, asUid, meta.pkt); err != nil {
+						log.Printf("topic[%s] meta.Set.Announce failed: %v", t.name, err)
+					}
+				}
+				if meta.pkt.MetaWhat&constMsgMetaCapacity != 0 {
+					if err := t.replySetCapacity(hub, meta.sess, asUid, meta.pkt); err != nil {
+						log.Printf("topic[%s] meta.Set.Capacity failed: %v", t.name, err)
+					}
+				}
+				if meta.pkt.MetaWhat&constMsgMetaModerate != 0 {
+					if err := t.replySetModerate(meta.sess, asUid, authLevel, meta.pkt); err != nil {
+						log.Printf("topic[%s] meta.Set.Moderate failed: %v", t.name, err)
+					}
+				}
+				if meta.pkt.MetaWhat&constMsgMetaConfig != 0 {
+					if err := t.replySetConfig(meta.sess, authLevel, meta.pkt); err != nil {
+						log.Printf("topic[%s] meta.Set.Config failed: %v", t.name, err)
+					}
+				}
+				if meta.pkt.MetaWhat&constMsgMetaMaxSubs != 0 {
+					if err := t.replySetMaxSubs(meta.sess, authLevel, meta.pkt); err != nil {
+						log.Printf("topic[%s] meta.Set.MaxSubs failed: %v", t.name, err)
+					}
+				}
+				if meta.pkt.MetaWhat&constMsgMetaFreeze != 0 {
+					if err := t.replySetFreeze(meta.sess, asUid, authLevel, meta.pkt); err != nil {
+						log.Printf("topic[%s] meta.Set.Freeze failed: %v", t.name, err)
+					}
+				}
+				if meta.pkt.MetaWhat&constMsgMetaNotify != 0 {
+					if err := t.replySetNotify(meta.sess, asUid, meta.pkt); err != nil {
+						log.Printf("topic[%s] meta.Set.Notify failed: %v", t.name, err)
+					}
+				}
+				if meta.pkt.MetaWhat&constMsgMetaBanned != 0 {
+					if err := t.replySetBan(meta.sess, asUid, meta.pkt); err != nil {
+						log.Printf("topic[%s] meta.Set.Ban failed: %v", t.name, err)
+					}
+				}
+				if meta.pkt.MetaWhat&constMsgMetaTtl != 0 {
+					if err := t.replySetTtl(meta.sess, asUid, meta.pkt); err != nil {
+						log.Printf("topic[%s] meta.Set.Ttl failed: %v", t.name, err)
+					}
+				}
 
 			case meta.pkt.Del != nil:
 				// Del request
 				var err error
 				switch meta.pkt.MetaWhat {
 				case constMsgDelMsg:
-					err = t.replyDelMsg(meta.sess, asUid, meta.pkt)
+					err = t.replyDelMsg(meta.sess, asUid, false, meta.pkt)
 				case constMsgDelSub:
 					err = t.replyDelSub(hub, meta.sess, asUid, meta.pkt)
 				case constMsgDelTopic:
 					err = t.replyDelTopic(hub, meta.sess, asUid, meta.pkt)
 				case constMsgDelCred:
 					err = t.replyDelCred(hub, meta.sess, asUid, authLevel, meta.pkt)
+				case constMsgDelBlock:
+					err = t.replyDelBlock(meta.sess, asUid, meta.pkt)
+				case constMsgDelEmoji:
+					err = t.replyDelEmoji(meta.sess, asUid, authLevel, meta.pkt)
 				}
 
 				if err != nil {
@@ -447,9 +913,33 @@ func (t *Topic) runLocal(hub *Hub) {
 			t.userAgent = currentUA
 			t.presUsersOfInterest("ua", t.userAgent)
 
+		case <-standbyTimer.C:
+			t.standbyReplicate()
+			standbyTimer.Reset(globals.cluster.sb.interval)
+
+		case <-audienceTimer.C:
+			t.audienceUpdate()
+			t.chanCursorsPrune()
+			audienceTimer.Reset(audienceInterval)
+
+		case <-t.freezeTimer.C:
+			t.freezeLapse()
+
+		case <-t.banTimer.C:
+			t.banLapse()
+
+		case <-t.expiryTimer.C:
+			t.expiryReap()
+
+		case <-t.expire:
+			// Hub is evicting idle topics to free up memory. Shut down now if the topic is still idle.
+			if t.isIdle() && len(t.sessions) == 0 {
+				killTimer.Reset(0)
+			}
+
 		case <-killTimer.C:
 			// Topic timeout
-			hub.unreg <- &topicUnreg{rcptTo: t.name}
+			hub.shardFor(t.name).unreg <- &topicUnreg{rcptTo: t.name}
 			defrNotifTimer.Stop()
 			if t.cat == types.TopicCatMe {
 				uaTimer.Stop()
@@ -474,17 +964,32 @@ func (t *Topic) runLocal(hub *Hub) {
 				// Inform plugins that the topic is deleted
 				pluginTopic(t, plgActDel)
 
-			} else if sd.reason == StopRehashing {
+			} else if sd.reason == StopRehashing || sd.reason == StopReloading {
 				// Must send individual messages to sessions because normal sending through the topic's
 				// broadcast channel won't work - it will be shut down too soon.
 				t.presSubsOnlineDirect("term", nilPresParams, nilPresFilters, "")
 			}
+
+			if sd.reason != StopDeleted {
+				// Save the counters changed since the last save.
+				t.statsSave()
+			}
+			standbyTimer.Stop()
+			audienceTimer.Stop()
+			t.freezeTimer.Stop()
+			t.banTimer.Stop()
+			t.expiryTimer.Stop()
+			if sd.reason == StopNone || sd.reason == StopDeleted {
+				// The topic is not moving to another node.
+				t.standbyGone()
+			}
 			// In case of a system shutdown don't bother with notifications. They won't be delivered anyway.
 
 			// Tell sessions to remove the topic
-			for s := range t.sessions {
-				s.detachSession(t.name)
-			}
+			t.detachSessions(t.sessionList())
+
+			// The hub retries queued changes of the stored state once the topic is gone.
+			t.rejectTasks()
 
 			usersRegisterTopic(t, false)
 
@@ -497,12 +1002,31 @@ func (t *Topic) runLocal(hub *Hub) {
 	}
 }
 
+// rejectTasks tells the server code waiting for requests still queued to the topic that the topic is busy.
+func (t *Topic) rejectTasks() {
+	for len(t.meta) > 0 {
+		if meta := <-t.meta; meta.done != nil {
+			meta.done <- errTopicBusy
+		}
+	}
+}
+
 // Session subscribed to a topic, created == true if topic was just created and {pres} needs to be announced
 func (t *Topic) handleSubscription(h *Hub, join *sessionJoin) error {
 	asUid := types.ParseUserId(join.pkt.AsUser)
 	authLevel := auth.Level(join.pkt.AuthLvl)
 	asChan := isChannel(join.pkt.Original)
 
+	if ok, err := t.capacityAdmit(join); !ok {
+		// The channel is full: the reader is queued or rejected.
+		return err
+	}
+
+	if asUid.IsZero() {
+		// Unauthenticated guest with a guest token.
+		return t.guestJoin(join)
+	}
+
 	msgsub := join.pkt.Sub
 	getWhat := 0
 	if msgsub.Get != nil {
@@ -555,9 +1079,190 @@ func (t *Topic) handleSubscription(h *Hub, join *sessionJoin) error {
 		}
 	}
 
+	if getWhat&constMsgMetaGap != 0 {
+		// Send the missing messages and deletions
+		if err := t.replyGetGap(join.sess, asUid, msgsub.Get.Gap, join.pkt); err != nil {
+			log.Printf("topic[%s] handleSubscription Get.Gap failed: %v sid=%s", t.name, err, join.sess.sid)
+		}
+	}
+
+	if msgsub.Window > 0 && asChan {
+		// Enable flow control for the channel reader.
+		if pssd, ok := t.sessions[join.sess]; ok {
+			pssd.flow = &flowControl{credit: msgsub.Window}
+			t.sessions[join.sess] = pssd
+		}
+	}
+
+	if t.cat == types.TopicCatGrp && !t.isProxy {
+		// Messages of blocked users are hidden by the block list of the recipient: have it cached.
+		blockListRefresh(asUid)
+	}
+
+	if msgsub.Ack && !asChan {
+		// Redeliver messages the user has not acknowledged yet.
+		if err := t.redeliverUnacked(join.sess, asUid, join.pkt.OrganizationId); err != nil {
+			log.Printf("topic[%s] handleSubscription redelivery failed: %v sid=%s", t.name, err, join.sess.sid)
+		}
+	}
+
+	return nil
+}
+
+// grantCredit adds flow control credit to the session. If messages were skipped while the credit was
+// exhausted, the session is informed about them.
+func (t *Topic) grantCredit(sess *Session, credit int) {
+	pssd, ok := t.sessions[sess]
+	if !ok || pssd.flow == nil {
+		return
+	}
+
+	pssd.flow.credit += credit
+	if pssd.flow.skipped > 0 {
+		sess.queueOut(NoErrSkipped(t.original(pssd.uid), types.TimeNow(),
+			pssd.flow.skipped, pssd.flow.since, pssd.flow.before))
+		pssd.flow.skipped = 0
+	}
+}
+
+// storedDataMessage converts a message read from the database or the cache of recent messages
+// to {data} for the reader asUid of the topic. Channel readers don't see the sender. Sensitive data
+// is masked by the rule, if any.
+func storedDataMessage(mm *types.Message, toriginal string, asChan bool, mask *maskingRule,
+	asUid types.Uid) *ServerComMessage {
+	from := ""
+	if !asChan {
+		from = types.ParseUid(mm.From).UserId()
+	}
+	return &ServerComMessage{Data: &MsgServerData{
+		Topic:     toriginal,
+		Head:      mm.Head,
+		SeqId:     mm.SeqId,
+		From:      from,
+		Timestamp: mm.CreatedAt,
+		Content:   mask.stored(mm, asUid),
+		Replies:   mm.Replies,
+		LastReply: mm.LastReplyAt}}
+}
+
+// redeliverUnacked sends to the session messages published after the last message acknowledged by
+// the user with {note what="recv"}, oldest first. Messages and acknowledgements are persistent, so
+// delivery survives disconnects and dropped sessions (at-least-once delivery). At most
+// maxRedeliverCount messages are sent at a time; the client is expected to acknowledge
+// them and resubscribe to receive the rest. Messages above the redelivery limits of the topic and
+// of the session are skipped oldest first, and the client is told the range of skipped messages.
+// Sensitive data is masked according to the rules of the organization org.
+func (t *Topic) redeliverUnacked(sess *Session, asUid types.Uid, org string) error {
+	pud, ok := t.perUser[asUid]
+	if !ok || pud.deleted || !(pud.modeGiven & pud.modeWant).IsReader() {
+		return nil
+	}
+
+	// Devices with a sync cursor receive messages since their own last acknowledgement.
+	ackID := pud.recvID
+	if sess.deviceID != "" {
+		if i := pud.cursors.Find(sess.deviceID); i >= 0 && pud.cursors[i].Ack > 0 {
+			ackID = pud.cursors[i].Ack
+		}
+	}
+
+	if ackID >= t.lastID {
+		// Nothing to redeliver.
+		return nil
+	}
+
+	since := ackID + 1
+	if redelivery.topicLimit > 0 && t.lastID-since+1 > redelivery.topicLimit {
+		// Only the most recent messages of the topic are redelivered.
+		since = t.lastID - redelivery.topicLimit + 1
+	}
+	count := t.lastID - since + 1
+	if count > maxRedeliverCount {
+		count = maxRedeliverCount
+	}
+	if allowed := sess.redeliveryReserve(count); allowed < count {
+		// The session has received too many messages: send the most recent ones it can still receive.
+		since = t.lastID - allowed + 1
+		count = allowed
+	}
+
+	toriginal := t.original(asUid)
+	if since > ackID+1 {
+		sess.queueOut(NoErrTruncated(toriginal, types.TimeNow(), since-ackID-1, ackID+1, since))
+	}
+	if count == 0 {
+		return nil
+	}
+
+	opts := &types.QueryOpt{Since: since, Before: since + count}
+	var messages []types.Message
+	var cached bool
+	if t.recent != nil {
+		messages, cached = t.recent.get(asUid, opts)
+	}
+	if !cached {
+		var err error
+		if messages, err = store.Messages.GetAll(t.name, asUid, opts); err != nil {
+			sess.redeliveryRelease(count)
+			return err
+		}
+	}
+	// Deleted messages are not sent and do not count.
+	sess.redeliveryRelease(count - len(messages))
+
+	// Messages are returned in descending order. Send them oldest first.
+	mask := t.maskingRuleFor(org, asUid, false)
+	for i := len(messages) - 1; i >= 0; i-- {
+		sess.queueOut(storedDataMessage(&messages[i], toriginal, false, mask, asUid))
+	}
+
+	if len(messages) > 0 && sess.deviceID != "" {
+		pud.advanceCursor(sess.deviceID, messages[0].SeqId, false, types.TimeNow())
+	}
+
 	return nil
 }
 
+// advanceCursor moves the sync cursor of the device forward to seq: either the delivered position
+// or, if ack is true, the acknowledged one. A cursor is created if the device has none. The least
+// recently moved cursor is dropped when there are too many devices. Returns true if the cursor has moved.
+func (pud *perUserData) advanceCursor(device string, seq int, ack bool, now time.Time) bool {
+	i := pud.cursors.Find(device)
+	if i < 0 {
+		if len(pud.cursors) >= maxSyncCursors {
+			oldest := 0
+			for j := range pud.cursors {
+				if pud.cursors[j].UpdatedAt.Before(pud.cursors[oldest].UpdatedAt) {
+					oldest = j
+				}
+			}
+			pud.cursors = append(pud.cursors[:oldest], pud.cursors[oldest+1:]...)
+		}
+		// A new device starts where the user has acknowledged messages on other devices.
+		pud.cursors = append(pud.cursors, types.SyncCursor{Device: device, Ack: pud.recvID, Delivered: pud.recvID})
+		i = len(pud.cursors) - 1
+	}
+
+	cur := &pud.cursors[i]
+	if ack {
+		if seq <= cur.Ack {
+			return false
+		}
+		cur.Ack = seq
+		if cur.Delivered < seq {
+			cur.Delivered = seq
+		}
+	} else {
+		if seq <= cur.Delivered {
+			return false
+		}
+		cur.Delivered = seq
+	}
+	cur.UpdatedAt = now
+
+	return true
+}
+
 // handleLeaveRequest processes a session leave request.
 func (t *Topic) handleLeaveRequest(hub *Hub, leave *sessionLeave) {
 	// Remove connection from topic; session may continue to function
@@ -620,21 +1325,21 @@ func (t *Topic) handleLeaveRequest(hub *Hub, leave *sessionLeave) {
 			uid = pssd.uid
 		}
 
-		var pud perUserData
+		var pud *perUserData
 		// uid may be zero when a proxy session is trying to terminate (it called unsubAll).
 		if !uid.IsZero() {
 			// UID not zero: one user removed.
 			pud = t.perUser[uid]
-			if !leave.sess.background {
+			if pud != nil && !leave.sess.background {
 				pud.online--
 			}
 		} else if len(pssd.muids) > 0 {
 			// UID is zero: multiplexing session is dropped altogether.
 			// Using new 'uid' and 'pud' variables.
 			for _, uid := range pssd.muids {
-				pud := t.perUser[uid]
-				pud.online--
-				t.perUser[uid] = pud
+				if pud := t.perUser[uid]; pud != nil {
+					pud.online--
+				}
 			}
 		} else if !leave.sess.isCluster() {
 			log.Panic("cannot determine uid: leave req=", leave)
@@ -660,7 +1365,7 @@ func (t *Topic) handleLeaveRequest(hub *Hub, leave *sessionLeave) {
 				// len(pssd.muids) could be zero if the session was a background session.
 				meUid = pssd.muids[0]
 			}
-			if !meUid.IsZero() {
+			if !meUid.IsZero() && t.consent.AllowsLastSeen() {
 				// Update user's last online timestamp & user agent. Only one user can be subscribed to 'me' topic.
 				if err := store.Users.UpdateLastSeen(meUid, mrs.userAgent, now); err != nil {
 					log.Println(err)
@@ -674,12 +1379,12 @@ func (t *Topic) handleLeaveRequest(hub *Hub, leave *sessionLeave) {
 			// Topic is going offline: notify online subscribers on 'me'.
 			readFilter := &presFilters{filterIn: types.ModeRead}
 			if !uid.IsZero() {
-				if pud.online == 0 {
+				if pud != nil && pud.online == 0 {
 					t.presSubsOnline("off", uid.UserId(), nilPresParams, readFilter, "")
 				}
 			} else if len(pssd.muids) > 0 {
 				for _, uid := range pssd.muids {
-					if t.perUser[uid].online == 0 {
+					if pud := t.perUser[uid]; pud != nil && pud.online == 0 {
 						t.presSubsOnline("off", uid.UserId(), nilPresParams, readFilter, "")
 					}
 				}
@@ -687,8 +1392,6 @@ func (t *Topic) handleLeaveRequest(hub *Hub, leave *sessionLeave) {
 		}
 
 		if !uid.IsZero() {
-			t.perUser[uid] = pud
-
 			// Respond if contains an id.
 			if leave.pkt != nil {
 				leave.sess.queueOut(NoErrReply(leave.pkt, now))
@@ -710,13 +1413,16 @@ func (t *Topic) sessToForeground(sess *Session) {
 		if s.isMultiplex() {
 			// If 's' is a multiplexing session, then sess is a proxy and it contains correct UID.
 			// Add UID to the list of online users.
-			uid := sess.uid
+			uid, _, _ := sess.activeAccount()
 			pssd.muids = append(pssd.muids, uid)
 		}
 		// Mark user as online
-		pud := t.perUser[uid]
+		pud, ok := t.perUser[uid]
+		if !ok {
+			pud = &perUserData{}
+			t.perUser[uid] = pud
+		}
 		pud.online++
-		t.perUser[uid] = pud
 
 		t.sendSubNotifications(uid, sess.sid, sess.userAgent)
 	}
@@ -724,10 +1430,7 @@ func (t *Topic) sessToForeground(sess *Session) {
 
 // Subscribe or unsubscribe user to/from FCM topic (channel).
 func (t *Topic) channelSubUnsub(uid types.Uid, sub bool) {
-	push.ChannelSub(&push.ChannelReq{
-		Uid:     uid,
-		Channel: types.GrpToChn(t.name),
-		Unsub:   !sub})
+	pushChannelSub(uid, types.GrpToChn(t.name), sub)
 }
 
 // Send immediate presence notification in response to a subscription.
@@ -771,7 +1474,7 @@ func (t *Topic) sendImmediateSubNotifications(asUid types.Uid, acs *MsgAccessMod
 			t.presSingleUserOffline(uid2, mode2, status, nilPresParams, "", false)
 
 			// Also send a push notification to the other user.
-			if pushRcpt := t.pushForSub(asUid, uid2, pud2.modeWant, pud2.modeGiven, types.TimeNow(), sreg.sess.OrganizationId); pushRcpt != nil {
+			if pushRcpt := t.pushForSub(asUid, uid2, pud2.modeWant, pud2.modeGiven, types.TimeNow(), sreg.pkt.OrganizationId); pushRcpt != nil {
 				usersPush(pushRcpt)
 			}
 		}
@@ -809,7 +1512,11 @@ func (t *Topic) sendSubNotifications(asUid types.Uid, sid, userAgent string) {
 		}
 
 	case types.TopicCatGrp:
-		pud := t.perUser[asUid]
+		pud, ok := t.perUser[asUid]
+		if !ok {
+			// Multiplexing sessions have no per-user record.
+			pud = &perUserData{}
+		}
 
 		// Enable notifications for a new group topic, if appropriate.
 		if !t.isLoaded() {
@@ -821,8 +1528,8 @@ func (t *Topic) sendSubNotifications(asUid types.Uid, sid, userAgent string) {
 
 			// Notify topic subscribers that the topic is online now.
 			t.presSubsOffline(status, nilPresParams, nilPresFilters, nilPresFilters, "", false)
-		} else if pud.online == 1 {
-			// If this is the first session of the user in the topic.
+		} else if pud.online == 1 && !t.standbyWasOnline(asUid) {
+			// If this is the first session of the user in the topic and the user was not online before a failover.
 			// Notify other online group members that the user is online now.
 			t.presSubsOnline("on", asUid.UserId(), nilPresParams,
 				&presFilters{filterIn: types.ModeRead}, sid)
@@ -841,51 +1548,165 @@ func (t *Topic) handleBroadcast(msg *ServerComMessage) {
 		return
 	}
 
-	var pushRcpt *push.Receipt
-	if msg.Data != nil {
+	if msg.Data != nil && msg.preview == nil && !t.isProxy && !t.contentAllowed(msg, asUid) {
+		// The message is too large or has too many attachments.
+		return
+	}
+
+	var pushRcpt, mentionRcpt *push.Receipt
+	// Sender of the message to respond to with an auto-reply.
+	var autoReplyTo types.Uid
+	if msg.Data != nil && msg.preview != nil {
+		// Link preview fetched by the server: broadcast as an edit of the message.
+		if !t.linkPreviewApply(msg) {
+			return
+		}
+	} else if msg.Data != nil && msgReplaceSeq(msg.Data.Head) > 0 {
+		// Edit of a previously published message: no new seq ID, no push notifications.
+		if !t.replaceMessage(msg) {
+			return
+		}
+		// The new content may contain a different link.
+		t.linkPreviewRequest(msg.Data)
+	} else if msg.Data != nil {
 		if t.isReadOnly() {
 			msg.sess.queueOut(ErrPermissionDenied(msg.Id, t.original(asUid), msg.Timestamp))
 			return
 		}
+		if t.cat == types.TopicCatGrp && topicCreationIsPending(t.name) {
+			// Nothing is published to a new topic until it's approved.
+			resp := ErrPermissionDenied(msg.Id, t.original(asUid), msg.Timestamp)
+			resp.Ctrl.Params = map[string]interface{}{"what": "pending"}
+			msg.sess.queueOut(resp)
+			return
+		}
 
 		asUser := types.ParseUserId(msg.Data.From)
 		userData, userFound := t.perUser[asUser]
-		// Anyone is allowed to post to 'sys' topic.
-		if t.cat != types.TopicCatSys {
+		sysEvent := isSysEvent(msg.Data)
+		// Anyone is allowed to post to 'sys' topic. System events are generated by the server.
+		if t.cat != types.TopicCatSys && !sysEvent {
 			// If it's not 'sys' check write permission.
-			if !(userData.modeWant & userData.modeGiven).IsWriter() {
+			if !userFound || !(userData.modeWant & userData.modeGiven).IsWriter() {
 				msg.sess.queueOut(ErrPermissionDenied(msg.Id, t.original(asUid), msg.Timestamp))
 				return
 			}
+			if !t.announceAllowed(asUser) {
+				// Only administrators may publish in announcement mode.
+				resp := ErrPermissionDenied(msg.Id, t.original(asUid), msg.Timestamp)
+				resp.Ctrl.Params = map[string]interface{}{"what": "announce"}
+				msg.sess.queueOut(resp)
+				return
+			}
+		}
+
+		// Messages generated by the server have no session.
+		var org string
+		if msg.sess != nil {
+			org = msg.sess.activeOrg()
 		}
 
 		if t.isProxy {
 			t.lastID = msg.Data.SeqId
 		} else {
-			// Save to DB at master topic.
-			if err := store.Messages.Save(&types.Message{
-				ObjHeader: types.ObjHeader{CreatedAt: msg.Data.Timestamp},
-				SeqId:     t.lastID + 1,
-				Topic:     t.name,
-				From:      asUser.String(),
-				Head:      msg.Data.Head,
-				Content:   msg.Data.Content}, (userData.modeGiven & userData.modeWant).IsReader()); err != nil {
-
-				log.Printf("topic[%s]: failed to save message: %v", t.name, err)
-				msg.sess.queueOut(ErrUnknown(msg.Id, t.original(asUid), msg.Timestamp))
-
+			thread, ok := msgThreadRoot(msg.Data.Head)
+			if !ok || thread > t.lastID {
+				msg.sess.queueOut(ErrMalformed(msg.Id, t.original(asUid), msg.Timestamp))
 				return
 			}
-
-			t.lastID++
+			// Events can be announced in group topics only.
+			event, ok := calEventParse(msg.Data.Head, msg.Data.Content)
+			if !ok || (event != nil && t.cat != types.TopicCatGrp) {
+				msg.sess.queueOut(ErrMalformed(msg.Id, t.original(asUid), msg.Timestamp))
+				return
+			}
+			// Polls are created in group topics only.
+			poll, ok := pollParse(msg.Data.Head)
+			if !ok || (poll != nil && t.cat != types.TopicCatGrp) {
+				msg.sess.queueOut(ErrMalformed(msg.Id, t.original(asUid), msg.Timestamp))
+				return
+			}
+			// View-once attachments are not supported in channels.
+			viewOnce, ok := viewOnceParse(msg.Data.Head)
+			if !ok || (viewOnce != nil && (t.isChan || (t.cat != types.TopicCatGrp && t.cat != types.TopicCatP2P))) {
+				msg.sess.queueOut(ErrMalformed(msg.Id, t.original(asUid), msg.Timestamp))
+				return
+			}
+
+			// Voice messages are indexed by the type of media.
+			mediaType, ok := audioParse(msg.Data.Head)
+			if !ok {
+				msg.sess.queueOut(ErrMalformed(msg.Id, t.original(asUid), msg.Timestamp))
+				return
+			}
+			// The message expires by default or sooner if the sender asks.
+			expires, ok := t.expiryStamp(msg.Data)
+			if !ok {
+				msg.sess.queueOut(ErrMalformed(msg.Id, t.original(asUid), msg.Timestamp))
+				return
+			}
+
+			// Save to DB at master topic.
+			stored := &types.Message{
+				ObjHeader: types.ObjHeader{CreatedAt: msg.Data.Timestamp},
+				SeqId:     t.lastID + 1,
+				Topic:     t.name,
+				From:      asUser.String(),
+				Head:      msg.Data.Head,
+				Content:   msg.Data.Content,
+				Thread:    thread,
+				MediaType: mediaType,
+				Mime:      galleryMime(msg.Data.Content)}
+			if err := store.Messages.Save(stored,
+				userFound && (userData.modeGiven&userData.modeWant).IsReader()); err != nil {
+
+				log.Printf("topic[%s]: failed to save message: %v", t.name, err)
+				msg.sess.queueOut(ErrUnknown(msg.Id, t.original(asUid), msg.Timestamp))
+
+				return
+			}
+
+			if t.recent != nil {
+				t.recent.add(stored)
+				if thread > 0 {
+					t.recent.replied(thread, msg.Data.Timestamp)
+				}
+			}
+
+			t.lastID++
 			t.touched = msg.Data.Timestamp
 			msg.Data.SeqId = t.lastID
+
+			if event != nil {
+				t.calEventCreate(event, t.lastID)
+			}
+			if poll != nil {
+				t.pollCreate(poll, t.lastID)
+			}
+			if viewOnce != nil {
+				t.viewOnceCreate(asUser, t.lastID, viewOnce)
+			}
+			if expires != nil {
+				t.expiryAdded(t.lastID)
+			}
+			t.linkPreviewRequest(msg.Data)
+
+			if journal.Enabled(org, t.name) {
+				journalWrite(&journal.Entry{
+					What:      journal.ActMsg,
+					Org:       org,
+					Topic:     t.name,
+					From:      msg.Data.From,
+					Timestamp: msg.Data.Timestamp,
+					SeqId:     t.lastID,
+					Head:      msg.Data.Head,
+					Content:   msg.Data.Content})
+			}
 		}
 
 		if userFound {
 			userData.readID = t.lastID
 			userData.readID = t.lastID
-			t.perUser[asUser] = userData
 		}
 
 		if msg.Id != "" && msg.sess != nil {
@@ -895,7 +1716,20 @@ func (t *Topic) handleBroadcast(msg *ServerComMessage) {
 		}
 
 		if !t.isProxy {
-			pushRcpt = t.pushForData(asUser, msg.Data, msg.sess.OrganizationId)
+			if !sysEvent {
+				pushRcpt = t.pushForData(asUser, msg.Data, org)
+				// Mentioned users get a separate push flagged as a mention.
+				mentionRcpt = t.mentionsSave(asUser, msg.Data, pushRcpt)
+				autoReplyTo = asUser
+				t.statsMessage(asUser, msg.Data)
+			} else {
+				// No push notifications for system events, but the event is counted as unread.
+				for uid, pud := range t.perUser {
+					if !pud.deleted && (pud.modeGiven & pud.modeWant).IsReader() {
+						usersUpdateUnread(uid, 1, 0, true)
+					}
+				}
+			}
 
 			// Message sent: notify offline 'R' subscrbers on 'me'.
 			t.presSubsOffline("msg", &presParams{seqID: t.lastID, actor: msg.Data.From},
@@ -914,79 +1748,203 @@ func (t *Topic) handleBroadcast(msg *ServerComMessage) {
 
 		// "what" may have changed, i.e. unset or "+command" removed ("on+en" -> "on")
 		msg.Pres.What = what
+	} else if msg.Info != nil && msg.Info.What != "credit" && isChannel(msg.Info.Topic) {
+		// Channel readers are not in perUser, only their read and received pointers are tracked.
+		if !t.chanReaderNote(msg) {
+			return
+		}
 	} else if msg.Info != nil {
+		if msg.Info.What == "credit" {
+			// Flow control credit is consumed by the topic, it's not forwarded to sessions.
+			t.grantCredit(msg.sess, msg.Info.SeqId)
+			return
+		}
+
 		if msg.Info.SeqId > t.lastID {
 			// Drop bogus read notification
 			return
 		}
 
 		asUser := types.ParseUserId(msg.Info.From)
-		pud := t.perUser[asUser]
+		pud, ok := t.perUser[asUser]
+		if !ok {
+			// Ignore notifications from people without a subscription.
+			return
+		}
 		mode := pud.modeGiven & pud.modeWant
 		if pud.deleted {
 			mode = types.ModeInvalid
 		}
 
-		// Filter out "kp" from users with no 'W' permission (or people without a subscription)
-		if msg.Info.What == "kp" && (!mode.IsWriter() || t.isReadOnly()) {
+		if msg.Info.What == "kp" {
+			// Filter out "kp" from users with no 'W' permission
+			if !mode.IsWriter() || t.isReadOnly() {
+				return
+			}
+			pud.activeAt = msg.Timestamp
+			// Coalesce repeated indicators: the recipients show the indicator for a few seconds,
+			// there is no need to forward every one of them.
+			// A change of activity is forwarded sooner, but a flood of alternating activities is still collapsed.
+			if since := msg.Timestamp.Sub(pud.kpAt); since < kpMinInterval ||
+				(pud.kpAct == msg.Info.Act && since < liveConfig().kpCoalescePeriod) {
+				return
+			}
+			pud.kpAct, pud.kpAt = msg.Info.Act, msg.Timestamp
+		}
+
+		if msg.Info.What == "focus" || msg.Info.What == "blur" {
+			// Focus reports are not forwarded, they only suppress push notifications.
+			if mode.IsReader() {
+				if msg.Info.What == "focus" {
+					pud.activeAt = msg.Timestamp
+				} else {
+					pud.activeAt = time.Time{}
+				}
+			}
 			return
 		}
 
-		if msg.Info.What == "read" || msg.Info.What == "recv" {
-			// Filter out "read/recv" from users with no 'R' permission (or people without a subscription)
+		if msg.Info.What == "star" || msg.Info.What == "unstar" {
+			// Members with 'R' permission star messages. Stars are private.
+			if !mode.IsReader() || (!t.isProxy && !t.bookmarkSave(asUser, msg.Info)) {
+				return
+			}
+		}
+
+		if msg.Info.What == "vote" && !t.isProxy {
+			// Members with 'R' permission vote, the vote is broadcast with the updated tally.
+			if !mode.IsReader() || !t.pollVote(asUser, msg.Info) {
+				return
+			}
+		}
+
+		if msg.Info.What == "read" || msg.Info.What == "recv" || msg.Info.What == "dlv" {
+			// Filter out "read/recv/dlv" from users with no 'R' permission
 			if !mode.IsReader() {
 				return
 			}
 
-			var read, recv, unread int
+			if !t.isProxy {
+				// Receipts of users who opted out of sharing them or whose choice is not known yet
+				// are sent to the user's own sessions only. Proxy topics get the decision from the master.
+				consent := t.consentOf(asUser, pud)
+				msg.Info.Private = consent == nil || !consent.AllowsReadReceipts()
+			}
+
+			// Move the sync cursor of the device which sent the notification. Other sessions of
+			// the user may have acknowledged the message already, the device cursor is independent.
+			// The "dlv" only moves the delivered position, it's not an acknowledgement.
+			var cursorMoved bool
+			if msg.sess != nil && msg.sess.deviceID != "" {
+				cursorMoved = pud.advanceCursor(msg.sess.deviceID, msg.Info.SeqId,
+					msg.Info.What != "dlv", types.TimeNow())
+			}
+
+			// Changes are applied to pud only after they are persisted.
+			readID, recvID, dlvID := pud.readID, pud.recvID, pud.dlvID
+			var read, recv, dlv, unread, mentions int
 			if msg.Info.What == "read" {
-				if msg.Info.SeqId > pud.readID {
+				if msg.Info.SeqId > readID {
 					// The number of unread messages has decreased, negative value
-					unread = pud.readID - msg.Info.SeqId
-					pud.readID = msg.Info.SeqId
-					read = pud.readID
-				} else {
-					// No need to report stale or bogus read status
-					return
+					unread = readID - msg.Info.SeqId
+					readID = msg.Info.SeqId
+					read = readID
 				}
 			} else if msg.Info.What == "recv" {
-				if msg.Info.SeqId > pud.recvID {
-					pud.recvID = msg.Info.SeqId
-					recv = pud.recvID
-				} else {
-					return
+				if msg.Info.SeqId > recvID {
+					recvID = msg.Info.SeqId
+					recv = recvID
 				}
+			} else if msg.Info.SeqId > dlvID {
+				dlvID = msg.Info.SeqId
+				dlv = dlvID
 			}
 
-			if pud.readID > pud.recvID {
-				pud.recvID = pud.readID
-				recv = pud.recvID
+			if read == 0 && recv == 0 && dlv == 0 && !cursorMoved {
+				// No need to report stale or bogus read status
+				return
 			}
 
-			if !t.isProxy {
-				if err := store.Subs.Update(t.name, asUser,
-					map[string]interface{}{
-						"RecvSeqId": pud.recvID,
-						"ReadSeqId": pud.readID},
-					false); err != nil {
+			// Message which was read was also received, received message was also delivered.
+			if readID > recvID {
+				recvID = readID
+				recv = recvID
+			}
+			if recvID > dlvID {
+				dlvID = recvID
+			}
 
+			if !t.isProxy {
+				update := map[string]interface{}{
+					"DlvSeqId":  dlvID,
+					"RecvSeqId": recvID,
+					"ReadSeqId": readID}
+				if cursorMoved {
+					// Delivered positions are saved together with acknowledgements.
+					update["Cursors"] = pud.cursors
+				}
+				if err := store.Subs.Update(t.name, asUser, update, false); err != nil {
 					log.Printf("topic[%s]: failed to update SeqRead/Recv counter: %v", t.name, err)
 					return
 				}
+				if read > 0 {
+					t.receiptSave(asUser, pud, pud.readID+1, readID)
+					// The number of unread mentions has decreased, negative value
+					mentions = -t.mentionsClear(asUser, readID)
+				}
+			}
+			delivered := dlvID > pud.dlvID
+			pud.readID, pud.recvID, pud.dlvID = readID, recvID, dlvID
 
+			if read == 0 && recv == 0 && dlv == 0 {
+				// Only the device cursor has moved, nothing to report.
+				return
+			}
+
+			if !t.isProxy {
 				// Read/recv updated: notify user's other sessions of the change
 				t.presPubMessageCount(asUser, mode, recv, read, msg.SkipSid)
 
-				// Update cached count of unread messages
-				usersUpdateUnread(asUser, unread, true)
+				if delivered {
+					// Tell the sender that messages have reached a device of the recipient.
+					t.presPubMessageDelivered(asUser, dlvID)
+				}
+
+				// Update cached counts of unread messages and mentions
+				usersUpdateUnread(asUser, unread, mentions, true)
 			}
-			t.perUser[asUser] = pud
 		}
 	} else {
 		// TODO(gene): remove this
 		log.Panic("topic: wrong message type for broadcasting", t.name)
 	}
 
+	// Serialize the message once per recipient variant rather than once per session.
+	msg.enableSerializeCache()
+	defer msg.disableSerializeCache()
+
+	var from string
+	if msg.Data != nil {
+		from = msg.Data.From
+	}
+
+	// Notification from a channel reader. The topic name is changed for each recipient below.
+	chanNote := msg.Info != nil && isChannel(msg.Info.Topic)
+
+	// Private receipts and stars are sent to the user's own sessions only.
+	ownSessionsOnly := false
+	if msg.Info != nil && (msg.Info.What == "read" || msg.Info.What == "recv" || msg.Info.What == "dlv") {
+		// Channel readers are anonymous, their pointers are synced between their own sessions only.
+		ownSessionsOnly = msg.Info.Private || chanNote
+	} else if msg.Info != nil && (msg.Info.What == "star" || msg.Info.What == "unstar") {
+		ownSessionsOnly = true
+	}
+
+	// Recipients who want the message translated.
+	trans := newTranslateFanout(t.name, msg)
+	// Recipients who get the message with sensitive data masked.
+	masks := newMaskingFanout(t, msg)
+
 	// Broadcast the message. Only {data}, {pres}, {info} are broadcastable.
 	// {meta} and {ctrl} are sent to the session only
 	for sess, pssd := range t.sessions {
@@ -997,6 +1955,15 @@ func (t *Topic) handleBroadcast(msg *ServerComMessage) {
 			}
 
 			if msg.Pres != nil {
+				// The user has left or deleted the topic. If the topic is created again, its seq IDs start over.
+				if msg.Pres.What == "gone" && t.cat == types.TopicCatMe {
+					gone := msg.Pres.Src
+					if peer := types.ParseUserId(gone); !peer.IsZero() {
+						gone = pssd.uid.P2PName(peer)
+					}
+					sess.forgetDelivered(gone)
+				}
+
 				// Skip notifying - already notified on topic.
 				if msg.Pres.SkipTopic != "" && sess.getSub(msg.Pres.SkipTopic) != nil {
 					continue
@@ -1022,8 +1989,8 @@ func (t *Topic) handleBroadcast(msg *ServerComMessage) {
 					continue
 				}
 
-				// Don't send read receipts and key presses to channel readers.
-				if msg.Info != nil && pssd.isChanSub {
+				// Don't send read receipts and key presses to channel readers, except their own receipts.
+				if msg.Info != nil && pssd.isChanSub && !chanNote {
 					continue
 				}
 
@@ -1031,6 +1998,29 @@ func (t *Topic) handleBroadcast(msg *ServerComMessage) {
 				if msg.Info != nil && msg.Info.What == "kp" && msg.Info.From == pssd.uid.UserId() {
 					continue
 				}
+
+				if ownSessionsOnly && msg.Info.From != pssd.uid.UserId() {
+					continue
+				}
+
+				// Don't show messages of blocked users in group topics if the recipient asked to hide them.
+				if msg.Data != nil && t.cat == types.TopicCatGrp && blockListHides(pssd.uid, from, false) {
+					continue
+				}
+
+				// The new topic master may re-broadcast messages after a failover. Don't deliver them twice.
+				if msg.Data != nil && t.isProxy && !sess.markDelivered(t.name, msg.Data) {
+					continue
+				}
+
+				// Don't send more messages than the session is willing to receive.
+				if msg.Data != nil && pssd.flow != nil {
+					if pssd.flow.credit <= 0 {
+						pssd.flow.skip(msg.Data.SeqId)
+						continue
+					}
+					pssd.flow.credit--
+				}
 			}
 		}
 
@@ -1038,26 +2028,88 @@ func (t *Topic) handleBroadcast(msg *ServerComMessage) {
 		t.maybeFixTopicName(msg, pssd.uid)
 
 		// Send channel messages anonymously.
-		if pssd.isChanSub && msg.Data != nil {
-			msg.Data.From = ""
+		if msg.Data != nil {
+			if pssd.isChanSub {
+				msg.Data.From = ""
+			} else {
+				msg.Data.From = from
+			}
 		}
 		// Send message to session.
-		if !sess.queueOut(msg) {
+		out := msg
+		if !sess.isMultiplex() && msg.Data != nil {
+			if masked := masks.copyFor(sess, pssd, msg.Data); masked != nil {
+				out = masked
+			}
+		}
+		if !sess.queueOut(out) {
 			log.Printf("topic[%s]: connection stuck, detaching - %s", t.name, sess.sid)
 			// The whole session is being dropped, so sessionLeave.pkt is not set.
 			// Must not block here: it may lead to a deadlock.
 			select {
 			case t.unreg <- &sessionLeave{sess: sess}:
 			default:
-				log.Printf("topic[%s]: unreg queue full - %s", t.name, sess.sid)
+				queueOverflow("topic.broadcast", queueTopicUnreg, t.name, sess.sid, len(t.unreg))
+			}
+		} else if msg.Data != nil {
+			if sess.deviceID != "" && !pssd.isChanSub {
+				// Track delivery to the device. The position is persisted with the next acknowledgement.
+				if pud, ok := t.perUser[pssd.uid]; ok {
+					pud.advanceCursor(sess.deviceID, msg.Data.SeqId, false, msg.Data.Timestamp)
+				}
+			}
+			if !sess.isMultiplex() && out == msg {
+				// Masked messages are not translated: the translation would reveal the original.
+				trans.add(sess, pssd.uid, msg.Data)
 			}
 		}
 	}
 
+	// Translated copies follow the original message.
+	trans.run()
+
 	if !t.isProxy && pushRcpt != nil {
 		// usersPush will update unread message count and send push notification.
 		usersPush(pushRcpt)
 	}
+	if !t.isProxy && mentionRcpt != nil {
+		usersPush(mentionRcpt)
+	}
+
+	if !autoReplyTo.IsZero() {
+		// Respond after the message is delivered so the reply follows it.
+		t.sendAutoReply(autoReplyTo, msg.Data)
+	}
+}
+
+// recordEvent saves a system event to the message stream of a group topic and broadcasts it to the
+// subscribers, so the event remains visible in history. The actor is the user who caused the event,
+// the target is the user affected by it, if any.
+func (t *Topic) recordEvent(what string, actor, target types.Uid, params map[string]interface{}) {
+	if t.cat != types.TopicCatGrp || t.isProxy {
+		return
+	}
+
+	content := map[string]interface{}{"what": what}
+	if !actor.IsZero() {
+		content["act"] = actor.UserId()
+	}
+	if !target.IsZero() {
+		content["tgt"] = target.UserId()
+	}
+	for key, val := range params {
+		content[key] = val
+	}
+
+	now := types.TimeNow()
+	t.handleBroadcast(&ServerComMessage{
+		Data: &MsgServerData{
+			Topic:     t.xoriginal,
+			Timestamp: now,
+			Head:      map[string]interface{}{"mime": sysEventMime},
+			Content:   content},
+		RcptTo:    t.name,
+		Timestamp: now})
 }
 
 // subscriptionReply generates a response to a subscription request
@@ -1110,14 +2162,24 @@ func (t *Topic) subscriptionReply(h *Hub, asChan bool, join *sessionJoin) error
 		broadcast: t.broadcast,
 		done:      t.unreg,
 		meta:      t.meta,
-		supd:      t.supd})
+		supd:      t.supd,
+		uid:       asUid})
 	t.addSession(join.sess, asUid, asChan)
 
+	if pud, ok := t.perUser[asUid]; ok && !asChan && (t.cat == types.TopicCatGrp || t.cat == types.TopicCatP2P) {
+		// Receipts and stats depend on the consent of the user, it's not read again for each message.
+		consent := consentGet(asUid)
+		pud.consent = &consent
+	}
+
 	// The user is online in the topic. Increment the counter if notifications are not deferred.
 	if !join.sess.background && !asChan {
-		userData := t.perUser[asUid]
+		userData, ok := t.perUser[asUid]
+		if !ok {
+			userData = &perUserData{}
+			t.perUser[asUid] = userData
+		}
 		userData.online++
-		t.perUser[asUid] = userData
 	}
 
 	params := map[string]interface{}{}
@@ -1132,6 +2194,21 @@ func (t *Topic) subscriptionReply(h *Hub, asChan bool, join *sessionJoin) error
 	if msgsub.Created && join.pkt.Original != toriginal {
 		params["tmpname"] = join.pkt.Original
 	}
+	// Members of the space are suggested as subscribers of a new child topic.
+	if msgsub.Created && t.parent != "" {
+		params["parent"] = t.parent
+		if suggest := spaceSuggest(t.parent, asUid); len(suggest) > 0 {
+			params["suggest"] = suggest
+		}
+	}
+	// Readers of a popular channel are asked to reconnect to the relay the channel is pinned to.
+	// The grant lets the relay check the reader's access to the channel.
+	if asChan && !isRelayAccount(asUid) {
+		if relay := t.relayFor(); relay != "" {
+			params["relay"] = relay
+			params["grant"] = relayGrantMake(asUid, toriginal, now)
+		}
+	}
 
 	if len(params) == 0 {
 		// Don't send empty params '{}'
@@ -1205,16 +2282,31 @@ func (t *Topic) thisUserSub(h *Hub, sess *Session, pkt *ClientComMessage, asUid
 
 	// Check if it's an attempt at a new subscription to the topic / a channel reader (channel readers are not cached).
 	// It could be an actual subscription (IsJoiner() == true) or a ban (IsJoiner() == false).
-	userData, existingSub := t.perUser[asUid]
+	// Changes are made to a copy of the user's record and applied once they are persisted.
+	var userData perUserData
+	pud, existingSub := t.perUser[asUid]
+	if existingSub {
+		userData = *pud
+	}
+	// The user has joined the topic for the first time, the event is recorded in the message stream.
+	var joined bool
 	if !existingSub || userData.deleted {
 		// New subscription or a channel reader, either new or existing.
 
 		// Check if the max number of subscriptions is already reached.
-		if t.cat == types.TopicCatGrp && !asChan && t.subsCount() >= globals.maxSubscriberCount {
-			sess.queueOut(ErrPolicyReply(pkt, now))
+		if limit := t.subsLimit(); t.cat == types.TopicCatGrp && !asChan && t.subsCount() >= limit {
+			sess.queueOut(ErrPolicyLimitReply(pkt, now, "subscribers", limit))
 			return nil, errors.New("max subscription count exceeded")
 		}
 
+		// Only the owner is subscribed to a new topic until it's approved.
+		if t.cat == types.TopicCatGrp && topicCreationIsPending(t.name) {
+			resp := ErrPermissionDeniedReply(pkt, now)
+			resp.Ctrl.Params = map[string]interface{}{"what": "pending"}
+			sess.queueOut(resp)
+			return nil, errors.New("topic is pending approval")
+		}
+
 		var sub *types.Subscription
 		tname := t.name
 		if t.cat == types.TopicCatP2P {
@@ -1288,6 +2380,17 @@ func (t *Topic) thisUserSub(h *Hub, sess *Session, pkt *ClientComMessage, asUid
 		}
 		userData.private = private
 
+		// A user who cannot join on their own asks the admins for approval.
+		userData.request = nil
+		if t.joinRequestNeeded(asChan, userData.modeWant, userData.modeGiven) {
+			note, err := joinRequestNote(pkt)
+			if err != nil {
+				sess.queueOut(ErrMalformedReply(pkt, now))
+				return nil, err
+			}
+			userData.request = &types.JoinRequest{CreatedAt: now, Note: note}
+		}
+
 		// Add subscription to database, if missing.
 		if sub == nil {
 			sub = &types.Subscription{
@@ -1304,6 +2407,20 @@ func (t *Topic) thisUserSub(h *Hub, sess *Session, pkt *ClientComMessage, asUid
 				return nil, err
 			}
 
+			if userData.request != nil {
+				if err := store.Subs.Update(tname, asUid,
+					map[string]interface{}{"Request": userData.request}, true); err != nil {
+					sess.queueOut(ErrUnknownReply(pkt, now))
+					return nil, err
+				}
+			}
+
+			if asChan {
+				// New channel reader. Joins of regular subscribers are counted in notifySubChange.
+				t.statsMember(true)
+				t.audienceReader(true)
+			}
+
 		} else if asChan && userData.modeWant != oldWant {
 			// Channel reader changed access mode, save changed mode to db.
 			if err := store.Subs.Update(tname, asUid,
@@ -1313,7 +2430,8 @@ func (t *Topic) thisUserSub(h *Hub, sess *Session, pkt *ClientComMessage, asUid
 			}
 
 			// Enable or disable fcm push notifications for the subsciption.
-			t.channelSubUnsub(asUid, userData.modeWant.IsPresencer())
+			// Readers who get digests are not notified of individual messages.
+			t.channelSubUnsub(asUid, userData.modeWant.IsPresencer() && !digestActive(tname, asUid))
 		}
 
 		if asChan {
@@ -1327,6 +2445,7 @@ func (t *Topic) thisUserSub(h *Hub, sess *Session, pkt *ClientComMessage, asUid
 			usersRegisterUser(asUid, true)
 			// Notify plugins of a new subscription
 			pluginSubscription(sub, plgActCreate)
+			joined = true
 		}
 
 	} else {
@@ -1373,6 +2492,11 @@ func (t *Topic) thisUserSub(h *Hub, sess *Session, pkt *ClientComMessage, asUid
 				// Ownership transfer can only be initiated by the owner.
 				sess.queueOut(ErrPermissionDeniedReply(pkt, now))
 				return nil, errors.New("non-owner cannot request ownership transfer")
+			} else if t.isOwner(asUid) {
+				// A co-owner should be able to grant himself any permissions except ownership.
+				if !userData.modeGiven.BetterEqual(modeWant) {
+					userData.modeGiven |= modeWant
+				}
 			} else if t.cat == types.TopicCatGrp && userData.modeGiven.IsAdmin() && modeWant.IsAdmin() {
 				// A group topic Admin should be able to grant himself any permissions except
 				// ownership (checked previously) & hard-deleting messages.
@@ -1424,26 +2548,23 @@ func (t *Topic) thisUserSub(h *Hub, sess *Session, pkt *ClientComMessage, asUid
 			}
 		}
 
-		// No transactions in RethinkDB, but two owners are better than none
 		if ownerChange {
 			oldOwnerData := t.perUser[t.owner]
 			oldOwnerOldWant, oldOwnerOldGiven := oldOwnerData.modeWant, oldOwnerData.modeGiven
-			oldOwnerData.modeGiven = (oldOwnerData.modeGiven & ^types.ModeOwner)
-			oldOwnerData.modeWant = (oldOwnerData.modeWant & ^types.ModeOwner)
-			if err := store.Subs.Update(t.name, t.owner,
-				map[string]interface{}{
-					"ModeWant":  oldOwnerData.modeWant,
-					"ModeGiven": oldOwnerData.modeGiven}, false); err != nil {
-				return nil, err
-			}
+			oldOwnerNewGiven := (oldOwnerOldGiven & ^types.ModeOwner)
+			oldOwnerNewWant := (oldOwnerOldWant & ^types.ModeOwner)
+			// Takes the O permission from the old owner too.
 			if err := store.Topics.OwnerChange(t.name, asUid); err != nil {
 				return nil, err
 			}
-			t.perUser[t.owner] = oldOwnerData
+			oldOwnerData.modeWant, oldOwnerData.modeGiven = oldOwnerNewWant, oldOwnerNewGiven
 			// Send presence notifications.
 			t.notifySubChange(t.owner, asUid, false,
-				oldOwnerOldWant, oldOwnerOldGiven, oldOwnerData.modeWant, oldOwnerData.modeGiven, "")
+				oldOwnerOldWant, oldOwnerOldGiven, oldOwnerNewWant, oldOwnerNewGiven, "")
+			t.recordEvent("owner", t.owner, asUid, nil)
 			t.owner = asUid
+			// The new owner is no longer a co-owner.
+			t.ownersDrop(asUid)
 		}
 	}
 
@@ -1460,7 +2581,7 @@ func (t *Topic) thisUserSub(h *Hub, sess *Session, pkt *ClientComMessage, asUid
 		}
 
 		// Apply changes.
-		t.perUser[asUid] = userData
+		t.perUser[asUid] = &userData
 	}
 
 	var modeChanged *MsgAccessMode
@@ -1472,10 +2593,10 @@ func (t *Topic) thisUserSub(h *Hub, sess *Session, pkt *ClientComMessage, asUid
 
 			if oldReader && !newReader {
 				// Decrement unread count
-				usersUpdateUnread(asUid, userData.readID-t.lastID, true)
+				usersUpdateUnread(asUid, userData.readID-t.lastID, 0, true)
 			} else if !oldReader && newReader {
 				// Increment unread count
-				usersUpdateUnread(asUid, t.lastID-userData.readID, true)
+				usersUpdateUnread(asUid, t.lastID-userData.readID, 0, true)
 			}
 		}
 
@@ -1498,11 +2619,20 @@ func (t *Topic) thisUserSub(h *Hub, sess *Session, pkt *ClientComMessage, asUid
 		return modeChanged, nil
 
 	} else if !userData.modeGiven.IsJoiner() {
+		if userData.request != nil {
+			// The request to join is waiting for approval by the admins.
+			joinRequestReply(sess, pkt, userData.request, now)
+			return nil, errors.New("request to join is pending approval")
+		}
 		// User was banned
 		sess.queueOut(ErrPermissionDeniedReply(pkt, now))
 		return nil, errors.New("topic access denied; user is banned")
 	}
 
+	if joined {
+		t.recordEvent("join", asUid, types.ZeroUid, nil)
+	}
+
 	return modeChanged, nil
 }
 
@@ -1527,18 +2657,14 @@ func (t *Topic) anotherUserSub(h *Hub, sess *Session, asUid, target types.Uid,
 
 	// Check if approver actually has permission to manage sharing
 	userData, ok := t.perUser[asUid]
-	if !ok || !(userData.modeGiven & userData.modeWant).IsSharer() {
+	if !ok || !((userData.modeGiven & userData.modeWant).IsSharer() || t.isOwner(asUid)) {
 		sess.queueOut(ErrPermissionDeniedReply(pkt, now))
 		return nil, errors.New("topic access denied; approver has no permission")
 	}
 
+	// Addressing the channel means the target is a reader to be promoted to a subscriber.
 	asChan, err := t.verifyChannelAccess(pkt.Original)
-	if asChan {
-		// TODO: need to implement promoting reader to subscriber.
-		// Just reject for now.
-		sess.queueOut(ErrPermissionDeniedReply(pkt, now))
-		return nil, errors.New("topic access denied: cannot subscribe reader to channel")
-	} else if err != nil {
+	if err != nil {
 		// User should not be able to address non-channel topic as channel.
 		sess.queueOut(ErrNotFoundReply(pkt, now))
 		return nil, types.ErrNotFound
@@ -1550,7 +2676,19 @@ func (t *Topic) anotherUserSub(h *Hub, sess *Session, asUid, target types.Uid,
 		return nil, errors.New("topic is suspended")
 	}
 
+	// Check if the new topic is approved.
+	if t.cat == types.TopicCatGrp && topicCreationIsPending(t.name) {
+		resp := ErrPermissionDeniedReply(pkt, now)
+		resp.Ctrl.Params = map[string]interface{}{"what": "pending"}
+		sess.queueOut(resp)
+		return nil, errors.New("topic is pending approval")
+	}
+
 	hostMode = userData.modeGiven & userData.modeWant
+	if t.isOwner(asUid) {
+		// Co-owners manage subscriptions the same way as the owner.
+		hostMode |= types.ModeApprove
+	}
 
 	// Parse the access mode granted
 	modeGiven := types.ModeUnset
@@ -1579,13 +2717,37 @@ func (t *Topic) anotherUserSub(h *Hub, sess *Session, asUid, target types.Uid,
 		return nil, errors.New("attempt to transfer ownership by non-owner")
 	}
 
+	// Access of the owner cannot be changed by others, access of co-owners only by the owners.
+	if target == t.owner || (t.isOwner(target) && !t.isOwner(asUid)) {
+		sess.queueOut(ErrPermissionDeniedReply(pkt, now))
+		return nil, errors.New("attempt to change access of an owner")
+	}
+
+	if modeGiven.IsOwner() {
+		// The owner passes the ownership to another member, no need for the member to accept it.
+		return t.ownersTransfer(sess, asUid, target, modeGiven, pkt)
+	}
+
 	// Check if it's a new invite. If so, save it to database as a subscription.
 	// Saved subscription does not mean the user is allowed to post/read
 	userData, existingSub := t.perUser[target]
 	if !existingSub {
+		// A channel reader becomes a subscriber.
+		var reader *types.Subscription
+		if t.isChan {
+			if reader, err = store.Subs.Get(types.GrpToChn(t.name), target); err != nil {
+				sess.queueOut(ErrUnknownReply(pkt, now))
+				return nil, err
+			}
+		}
+		if asChan && reader == nil {
+			sess.queueOut(ErrUserNotFoundReply(pkt, now))
+			return nil, errors.New("user is not a channel reader")
+		}
+
 		// Check if the max number of subscriptions is already reached.
-		if t.cat == types.TopicCatGrp && t.subsCount() >= globals.maxSubscriberCount {
-			sess.queueOut(ErrPolicyReply(pkt, now))
+		if limit := t.subsLimit(); t.cat == types.TopicCatGrp && t.subsCount() >= limit {
+			sess.queueOut(ErrPolicyLimitReply(pkt, now, "subscribers", limit))
 			return nil, errors.New("max subscription count exceeded")
 		}
 
@@ -1627,11 +2789,23 @@ func (t *Topic) anotherUserSub(h *Hub, sess *Session, asUid, target types.Uid,
 			return nil, err
 		}
 
-		userData = perUserData{
+		userData = &perUserData{
 			modeGiven: sub.ModeGiven,
 			modeWant:  sub.ModeWant,
 			private:   nil,
 		}
+		if reader != nil {
+			if err := t.promoteReader(target, reader); err != nil {
+				// Leave the user a reader.
+				if derr := store.Subs.Delete(t.name, target); derr != nil {
+					log.Printf("topic[%s]: failed to undo subscription of %s: %v", t.name, target.UserId(), derr)
+				}
+				sess.queueOut(ErrUnknownReply(pkt, now))
+				return nil, err
+			}
+			userData.readID = reader.ReadSeqId
+			userData.recvID = reader.RecvSeqId
+		}
 		t.perUser[target] = userData
 		t.computePerUserAcsUnion()
 
@@ -1639,10 +2813,12 @@ func (t *Topic) anotherUserSub(h *Hub, sess *Session, asUid, target types.Uid,
 		usersRegisterUser(target, true)
 
 		// Send push notification for the new subscription.
-		if pushRcpt := t.pushForSub(asUid, target, userData.modeWant, userData.modeGiven, now, sess.OrganizationId); pushRcpt != nil {
+		if pushRcpt := t.pushForSub(asUid, target, userData.modeWant, userData.modeGiven, now, pkt.OrganizationId); pushRcpt != nil {
 			// TODO: maybe skip user's devices which were online when this event has happened.
 			usersPush(pushRcpt)
 		}
+
+		t.recordEvent("add", asUid, target, nil)
 	} else {
 		// Action on an existing subscription: re-invite, change existing permission, confirm/decline request.
 		oldGiven = userData.modeGiven
@@ -1652,15 +2828,20 @@ func (t *Topic) anotherUserSub(h *Hub, sess *Session, asUid, target types.Uid,
 			// Request to re-send invite without changing the access mode
 			modeGiven = userData.modeGiven
 		} else if modeGiven != userData.modeGiven {
-			// Changing the previously assigned value
-			userData.modeGiven = modeGiven
-
 			// Save changed value to database
 			if err := store.Subs.Update(t.name, target,
 				map[string]interface{}{"ModeGiven": modeGiven}, false); err != nil {
 				return nil, err
 			}
-			t.perUser[target] = userData
+
+			// Changing the previously assigned value
+			userData.modeGiven = modeGiven
+		}
+
+		// The admin has decided on the pending request to join.
+		if set.Sub.Mode != "" {
+			t.joinRequestResolve(sess, asUid, target, userData, now)
+			t.banResolve(target, userData)
 		}
 	}
 
@@ -1672,10 +2853,10 @@ func (t *Topic) anotherUserSub(h *Hub, sess *Session, asUid, target types.Uid,
 		newReader := (userData.modeWant & userData.modeGiven).IsReader()
 		if oldReader && !newReader {
 			// Decrement unread count
-			usersUpdateUnread(target, userData.readID-t.lastID, true)
+			usersUpdateUnread(target, userData.readID-t.lastID, 0, true)
 		} else if !oldReader && newReader {
 			// Increment unread count
-			usersUpdateUnread(target, t.lastID-userData.readID, true)
+			usersUpdateUnread(target, t.lastID-userData.readID, 0, true)
 		}
 		t.notifySubChange(target, asUid, false,
 			oldWant, oldGiven, userData.modeWant, userData.modeGiven, sess.sid)
@@ -1695,6 +2876,39 @@ func (t *Topic) anotherUserSub(h *Hub, sess *Session, asUid, target types.Uid,
 	return modeChanged, nil
 }
 
+// promoteReader moves the read and received pointers of the channel reader to the new subscription
+// of the user to the topic, then deletes the reader's subscription to the channel. Sessions attached
+// as a reader are detached: the user must subscribe again to the topic as a member.
+func (t *Topic) promoteReader(uid types.Uid, reader *types.Subscription) error {
+	chn := types.GrpToChn(t.name)
+
+	if reader.ReadSeqId > 0 || reader.RecvSeqId > 0 {
+		if err := store.Subs.Update(t.name, uid, map[string]interface{}{
+			"ReadSeqId": reader.ReadSeqId,
+			"RecvSeqId": reader.RecvSeqId}, false); err != nil {
+			return err
+		}
+	}
+	if err := store.Subs.Delete(chn, uid); err != nil {
+		return err
+	}
+
+	t.audienceReader(false)
+	t.chanCursorForget(uid)
+	// Push notifications to members are sent individually, not through the channel.
+	t.channelSubUnsub(uid, false)
+	if err := store.Digests.Delete(chn, uid); err != nil {
+		log.Printf("topic[%s]: failed to delete digest of %s: %v", t.name, uid.UserId(), err)
+	}
+
+	t.evictUser(uid, false, "")
+	t.relayRevoke(uid)
+	// The user's sessions on 'me' drop the channel, the new subscription is announced by notifySubChange.
+	presSingleUserOfflineOffline(uid, chn, "gone", nilPresParams, "")
+
+	return nil
+}
+
 // replyGetDesc is a response to a get.desc request on a topic, sent to just the session as a {meta} packet
 func (t *Topic) replyGetDesc(sess *Session, asUid types.Uid, opts *MsgGetOpts, msg *ClientComMessage) error {
 	now := types.TimeNow()
@@ -1724,6 +2938,9 @@ func (t *Topic) replyGetDesc(sess *Session, asUid types.Uid, opts *MsgGetOpts, m
 	}
 
 	pud, full := t.perUser[asUid]
+	if !full {
+		pud = &perUserData{}
+	}
 
 	if t.cat == types.TopicCatMe {
 		full = true
@@ -1735,6 +2952,19 @@ func (t *Topic) replyGetDesc(sess *Session, asUid types.Uid, opts *MsgGetOpts, m
 		} else if full && t.cat == types.TopicCatP2P {
 			desc.Public = pud.public
 		}
+		if t.cat == types.TopicCatMe {
+			desc.Trusted = t.trusted
+		} else if full && t.cat == types.TopicCatP2P {
+			desc.Trusted = pud.trusted
+		}
+		if t.cat == types.TopicCatGrp {
+			desc.Lang = contentTagValue(t.tags, contentLangTagNS)
+			desc.Rating = contentTagValue(t.tags, contentRatingTagNS)
+		}
+	}
+
+	if t.cat == types.TopicCatGrp && t.isChan {
+		desc.Audience = t.audience()
 	}
 
 	// Request may come from a subscriber (full == true) or a stranger.
@@ -1754,7 +2984,7 @@ func (t *Topic) replyGetDesc(sess *Session, asUid types.Uid, opts *MsgGetOpts, m
 			Given: pud.modeGiven.String(),
 			Mode:  (pud.modeGiven & pud.modeWant).String()}
 
-		if t.cat == types.TopicCatMe && sess.authLvl == auth.LevelRoot {
+		if t.cat == types.TopicCatMe && auth.Level(msg.AuthLvl) == auth.LevelRoot {
 			// If 'me' is in memory then user account is invariably not suspended.
 			desc.State = types.StateOK.String()
 		}
@@ -1762,6 +2992,25 @@ func (t *Topic) replyGetDesc(sess *Session, asUid types.Uid, opts *MsgGetOpts, m
 		if t.cat == types.TopicCatGrp && (pud.modeGiven & pud.modeWant).IsPresencer() {
 			desc.Online = t.isOnline()
 		}
+		if t.cat == types.TopicCatGrp {
+			desc.Receipts = t.receipts
+			desc.Announce = t.announce
+			desc.Limits = contentLimitsDesc(t.limits)
+			desc.Capacity = capacityDesc(t.capacity)
+			desc.Parent = t.parent
+			if t.isOwner(asUid) {
+				desc.MaxSubs = t.subsLimit()
+			}
+			desc.Freeze = freezeDesc(t.freeze)
+			desc.Ttl = t.expiry.Ttl
+		}
+		if t.cat == types.TopicCatMe {
+			if count, err := store.Mentions.Count(asUid); err == nil {
+				desc.Mentions = count
+			} else {
+				log.Printf("topic[%s]: failed to count mentions: %v", t.name, err)
+			}
+		}
 		if ifUpdated {
 			desc.Private = pud.private
 		}
@@ -1778,6 +3027,7 @@ func (t *Topic) replyGetDesc(sess *Session, asUid types.Uid, opts *MsgGetOpts, m
 			desc.DelId = max(pud.delID, t.delID)
 			desc.ReadSeqId = pud.readID
 			desc.RecvSeqId = max(pud.recvID, pud.readID)
+			desc.DlvSeqId = max(pud.dlvID, desc.RecvSeqId)
 		} else {
 			// Send some sane value of touched.
 			desc.TouchedAt = &t.updated
@@ -1801,6 +3051,7 @@ func (t *Topic) replyGetDesc(sess *Session, asUid types.Uid, opts *MsgGetOpts, m
 			desc.DelId = max(sub.DelId, t.delID)
 			desc.ReadSeqId = sub.ReadSeqId
 			desc.RecvSeqId = max(sub.RecvSeqId, sub.ReadSeqId)
+			desc.DlvSeqId = max(sub.DlvSeqId, desc.RecvSeqId)
 		}
 	}
 
@@ -1827,6 +3078,12 @@ func (t *Topic) replySetDesc(sess *Session, asUid types.Uid, msg *ClientComMessa
 		return types.ErrNotFound
 	}
 
+	if set.Desc.Trusted != nil {
+		// Trusted values are assigned by root through {acc}, users cannot change them.
+		sess.queueOut(ErrPermissionDeniedReply(msg, now))
+		return errors.New("attempt to change trusted values")
+	}
+
 	assignAccess := func(upd map[string]interface{}, mode *MsgDefaultAcsMode) error {
 		if mode == nil {
 			return nil
@@ -1884,6 +3141,18 @@ func (t *Topic) replySetDesc(sess *Session, asUid types.Uid, msg *ClientComMessa
 		switch t.cat {
 		case types.TopicCatMe:
 			// Update current user
+			if set.Desc.Birthdate != "" && set.Desc.Birthdate != t.birthdate {
+				if t.birthdate != "" {
+					// The date of birth cannot be changed by the user once set.
+					sess.queueOut(ErrPermissionDeniedReply(msg, now))
+					return errors.New("attempt to change date of birth")
+				}
+				if err := birthdateParse(set.Desc.Birthdate, now); err != nil {
+					sess.queueOut(ErrMalformedReply(msg, now))
+					return err
+				}
+				core["Birthdate"] = set.Desc.Birthdate
+			}
 			err = assignAccess(core, set.Desc.DefaultAcs)
 			sendCommon = assignGenericValues(core, "Public", t.public, set.Desc.Public)
 		case types.TopicCatFnd:
@@ -1892,16 +3161,55 @@ func (t *Topic) replySetDesc(sess *Session, asUid types.Uid, msg *ClientComMessa
 			assignGenericValues(core, "Public", t.fndGetPublic(sess), set.Desc.Public)
 		case types.TopicCatP2P:
 			// Reject direct changes to P2P topics.
-			if set.Desc.Public != nil || set.Desc.DefaultAcs != nil {
+			if set.Desc.Public != nil || set.Desc.DefaultAcs != nil || set.Desc.Limits != nil ||
+				set.Desc.Lang != "" || set.Desc.Rating != "" || set.Desc.Parent != nil {
 				sess.queueOut(ErrPermissionDeniedReply(msg, now))
 				return errors.New("incorrect attempt to change metadata of a p2p topic")
 			}
 		case types.TopicCatGrp:
 			// Update group topic
-			if t.owner == asUid {
+			if t.isOwner(asUid) {
+				if set.Desc.Limits != nil {
+					limits, what, limit, err := contentLimitsParse(set.Desc.Limits)
+					if what != "" {
+						sess.queueOut(ErrPolicyLimitReply(msg, now, what, limit))
+						return err
+					} else if err != nil {
+						sess.queueOut(ErrMalformedReply(msg, now))
+						return err
+					}
+					if limits != t.limits {
+						core["Limits"] = limits
+						sendCommon = true
+					}
+				}
+				tags, changed, terr := contentDescTags(t.tags, set.Desc)
+				if terr != nil {
+					sess.queueOut(ErrMalformedReply(msg, now))
+					return terr
+				}
+				if changed {
+					core["Tags"] = types.StringSlice(tags)
+					sendCommon = true
+				}
+				if set.Desc.Parent != nil {
+					parent := *set.Desc.Parent
+					if parent != "" {
+						parent = spaceParentName(parent)
+						if perr := spaceCheckParent(t.name, parent, asUid); perr != nil {
+							sess.queueOut(decodeStoreErrorExplicitTs(perr, msg.Id, msg.Original, now, msg.Timestamp, nil))
+							return perr
+						}
+					}
+					if parent != t.parent {
+						core["Parent"] = parent
+						sendCommon = true
+					}
+				}
 				err = assignAccess(core, set.Desc.DefaultAcs)
-				sendCommon = assignGenericValues(core, "Public", t.public, set.Desc.Public)
-			} else if set.Desc.DefaultAcs != nil || set.Desc.Public != nil {
+				sendCommon = assignGenericValues(core, "Public", t.public, set.Desc.Public) || sendCommon
+			} else if set.Desc.DefaultAcs != nil || set.Desc.Public != nil || set.Desc.Limits != nil ||
+				set.Desc.Lang != "" || set.Desc.Rating != "" || set.Desc.Parent != nil {
 				// This is a request from non-owner
 				sess.queueOut(ErrPermissionDeniedReply(msg, now))
 				return errors.New("attempt to change public or permissions by non-owner")
@@ -1913,7 +3221,18 @@ func (t *Topic) replySetDesc(sess *Session, asUid types.Uid, msg *ClientComMessa
 			return err
 		}
 
-		sendPriv = assignGenericValues(sub, "Private", t.perUser[asUid].private, set.Desc.Private)
+		var private interface{}
+		if pud, ok := t.perUser[asUid]; ok {
+			private = pud.private
+		}
+		sendPriv = assignGenericValues(sub, "Private", private, set.Desc.Private)
+
+		if what, err := descSchemaCheck(t.cat, core["Public"], sub["Private"], nil); err != nil {
+			resp := ErrMalformedReply(msg, now)
+			resp.Ctrl.Params = map[string]interface{}{"what": what, "reason": err.Error()}
+			sess.queueOut(resp)
+			return err
+		}
 	}
 
 	if len(core)+len(sub) == 0 {
@@ -1955,6 +3274,18 @@ func (t *Topic) replySetDesc(sess *Session, asUid types.Uid, msg *ClientComMessa
 		if public, ok := core["Public"]; ok {
 			t.public = public
 		}
+		if limits, ok := core["Limits"]; ok {
+			t.limits = limits.(types.TopicLimits)
+		}
+		if tags, ok := core["Tags"]; ok {
+			t.tags = tags.(types.StringSlice)
+		}
+		if parent, ok := core["Parent"]; ok {
+			t.parent = parent.(string)
+		}
+		if birthdate, ok := core["Birthdate"]; ok {
+			t.birthdate = birthdate.(string)
+		}
 	} else if t.cat == types.TopicCatFnd {
 		// Assign per-session fnd.Public.
 		t.fndSetPublic(sess, core["Public"])
@@ -1962,10 +3293,13 @@ func (t *Topic) replySetDesc(sess *Session, asUid types.Uid, msg *ClientComMessa
 
 	mode := types.ModeNone
 	if private, ok := sub["Private"]; ok && !asChan {
-		pud := t.perUser[asUid]
+		pud, ok := t.perUser[asUid]
+		if !ok {
+			pud = &perUserData{}
+			t.perUser[asUid] = pud
+		}
 		pud.private = private
 		pud.updated = now
-		t.perUser[asUid] = pud
 		mode = pud.modeGiven & pud.modeWant
 	}
 
@@ -1989,6 +3323,18 @@ func (t *Topic) replySetDesc(sess *Session, asUid types.Uid, msg *ClientComMessa
 
 	sess.queueOut(NoErrReply(msg, now))
 
+	if _, ok := core["Public"]; ok && t.cat == types.TopicCatGrp {
+		// Record changes to title, avatar, etc. Only the names of the changed fields are recorded.
+		var changed []string
+		if public, ok := set.Desc.Public.(map[string]interface{}); ok {
+			for key := range public {
+				changed = append(changed, key)
+			}
+			sort.Strings(changed)
+		}
+		t.recordEvent("desc", asUid, types.ZeroUid, map[string]interface{}{"changed": changed})
+	}
+
 	return nil
 }
 
@@ -2016,8 +3362,8 @@ func (t *Topic) replyGetSub(sess *Session, asUid types.Uid, authLevel auth.Level
 		return types.ErrNotFound
 	}
 
-	userData := t.perUser[asUid]
-	if !(userData.modeGiven & userData.modeWant).IsSharer() {
+	userData, ok := t.perUser[asUid]
+	if !ok || !(userData.modeGiven & userData.modeWant).IsSharer() {
 		sess.queueOut(ErrPermissionDeniedReply(msg, now))
 		return errors.New("user does not have S permission")
 	}
@@ -2074,7 +3420,7 @@ func (t *Topic) replyGetSub(sess *Session, asUid types.Uid, authLevel auth.Level
 						}
 
 						// FIXME: allow root to find suspended users and topics.
-						subs, err = store.Users.FindSubs(asUid, req, opt)
+						subs, err = store.Users.FindSubs(asUid, req, opt, t.contentFindExclude(now))
 						if err != nil {
 							sess.queueOut(decodeStoreErrorExplicitTs(err, id, t.original(asUid), now, incomingReqTs, nil))
 							return err
@@ -2118,8 +3464,20 @@ func (t *Topic) replyGetSub(sess *Session, asUid types.Uid, authLevel auth.Level
 		return err
 	}
 
+	var children []MsgSpaceChild
+	if t.cat == types.TopicCatGrp && req != nil && req.Children {
+		if children, err = spaceChildren(t.name); err != nil {
+			sess.queueOut(decodeStoreErrorExplicitTs(err, id, t.original(asUid), now, incomingReqTs, nil))
+			return err
+		}
+	}
+
 	if len(subs) > 0 {
-		meta := &MsgServerMeta{Id: id, Topic: t.original(asUid), Timestamp: &now}
+		meta := &MsgServerMeta{Id: id, Topic: t.original(asUid), Timestamp: &now, Children: children}
+		if t.cat == types.TopicCatMe {
+			// Pins and folders apply to the subscriptions being sent.
+			meta.ChatList = chatListToMsg(&t.chatList)
+		}
 		meta.Sub = make([]MsgTopicSub, 0, len(subs))
 		presencer := (userData.modeGiven & userData.modeWant).IsPresencer()
 
@@ -2148,7 +3506,11 @@ func (t *Topic) replyGetSub(sess *Session, asUid types.Uid, authLevel auth.Level
 			uid := types.ParseUid(sub.User)
 			isReader := (sub.ModeGiven & sub.ModeWant).IsReader()
 			if t.cat == types.TopicCatMe {
-				createdAt := sub.GetCreatedAt()
+				if sub.GetWith() != "" && sub.GetState() == types.StateDeactivated {
+					// Hide contacts who deactivated their accounts.
+					continue
+				}
+				createdAt := sub.GetCreatedAt()
 				mts.CreatedAt = &createdAt
 
 				// Mark subscriptions that the user does not care about.
@@ -2207,17 +3569,19 @@ func (t *Topic) replyGetSub(sess *Session, asUid types.Uid, authLevel auth.Level
 					}
 
 					if t.cat == types.TopicCatGrp {
-						pud := t.perUser[uid]
-						mts.Online = pud.online > 0 && presencer
+						if pud, ok := t.perUser[uid]; ok {
+							mts.Online = pud.online > 0 && presencer
+						}
 					}
 				}
 			}
 
 			if !deleted {
 				mts.UpdatedAt = &sub.UpdatedAt
-				if isReader && !banned {
+				if isReader && !banned && (uid == asUid || consentAllowsReceipts(uid)) {
 					mts.ReadSeqId = sub.ReadSeqId
 					mts.RecvSeqId = sub.RecvSeqId
+					mts.DlvSeqId = sub.DlvSeqId
 				}
 
 				if t.cat != types.TopicCatFnd {
@@ -2243,10 +3607,27 @@ func (t *Topic) replyGetSub(sess *Session, asUid types.Uid, authLevel auth.Level
 					}
 				}
 
+				// Report mute of own subscriptions only while it's in effect.
+				if (t.cat == types.TopicCatMe || uid == asUid) && sub.MuteUntil != nil && sub.MuteUntil.After(now) {
+					mts.MuteUntil = sub.MuteUntil
+				}
+				if (t.cat == types.TopicCatMe || uid == asUid) && sub.Quiet != nil {
+					mts.Quiet = &MsgQuietHours{Start: sub.Quiet.Start, End: sub.Quiet.End, Tz: sub.Quiet.TzOffset}
+				}
+				if t.cat == types.TopicCatMe || uid == asUid {
+					mts.Notify = sub.Notify
+				}
+				if t.cat == types.TopicCatMe || uid == asUid {
+					mts.Anchor = sub.AnchorSeq
+				}
+				mts.Role = sub.Role
+
 				// Returning public and private only if they have changed since ifModified
 				if sendPubPriv {
 					// 'sub' has nil 'public' in p2p topics which is OK.
 					mts.Public = sub.GetPublic()
+					// 'trusted' is set for users and p2p topics only.
+					mts.Trusted = sub.GetTrusted()
 					// Reporting 'private' only if it's user's own subscription.
 					if uid == asUid {
 						mts.Private = sub.Private
@@ -2297,6 +3678,24 @@ func (t *Topic) replySetSub(h *Hub, sess *Session, pkt *ClientComMessage) error
 		target = asUid
 	}
 
+	if set.Sub.Anchor != nil {
+		// Saving the position is a separate request, it does not change the subscription.
+		if target != asUid || set.Sub.Mode != "" {
+			sess.queueOut(ErrMalformedReply(pkt, now))
+			return errors.New("anchor must be set alone and for the current user only")
+		}
+		return t.replySetAnchor(sess, asUid, pkt)
+	}
+
+	if set.Sub.Role != nil {
+		// Roles are labels only, changing the role does not change the access mode.
+		if set.Sub.Mode != "" {
+			sess.queueOut(ErrMalformedReply(pkt, now))
+			return errors.New("role must be set without changing the access mode")
+		}
+		return t.replySetRole(sess, asUid, target, pkt)
+	}
+
 	var err error
 	var modeChanged *MsgAccessMode
 	if target == asUid {
@@ -2333,11 +3732,22 @@ func (t *Topic) replyGetData(sess *Session, asUid types.Uid, req *MsgGetOpts, ms
 	now := types.TimeNow()
 	toriginal := t.original(asUid)
 
-	if req != nil && (req.IfModifiedSince != nil || req.User != "" || req.Topic != "") {
+	if req != nil && (req.IfModifiedSince != nil || req.User != "" || req.Topic != "" ||
+		(req.Type != "" && (req.Type != msgMediaAudio || req.Query != ""))) {
 		sess.queueOut(ErrMalformedReply(msg, now))
 		return errors.New("invalid MsgGetOpts query")
 	}
 
+	var mimes []string
+	if req != nil && req.Filter != nil {
+		var err error
+		// Full-text search cannot be combined with the filter.
+		if mimes, err = galleryFilterParse(req.Filter); err != nil || req.Query != "" {
+			sess.queueOut(ErrMalformedReply(msg, now))
+			return errors.New("invalid MsgGetOpts filter")
+		}
+	}
+
 	asChan, err := t.verifyChannelAccess(msg.Original)
 	if err != nil {
 		// User should not be able to address non-channel topic as channel.
@@ -2347,31 +3757,36 @@ func (t *Topic) replyGetData(sess *Session, asUid types.Uid, req *MsgGetOpts, ms
 
 	// Check if the user has permission to read the topic data
 	count := 0
-	if userData := t.perUser[asUid]; (userData.modeGiven & userData.modeWant).IsReader() || asChan {
-		// Read messages from DB
-		messages, err := store.Messages.GetAll(t.name, asUid, msgOpts2storeOpts(req))
-		if err != nil {
-			sess.queueOut(ErrUnknownReply(msg, now))
-			return err
+	if userData, ok := t.perUser[asUid]; asChan || (ok && (userData.modeGiven & userData.modeWant).IsReader()) {
+		if req != nil && req.Query != "" {
+			return t.replyGetDataSearch(sess, asUid, asChan, req, msg)
+		}
+
+		opts := msgOpts2storeOpts(req)
+		if opts != nil {
+			opts.Mime = mimes
+		}
+		var messages []types.Message
+		var cached bool
+		if t.recent != nil {
+			// Try to serve the request from the cache of recent messages first.
+			messages, cached = t.recent.get(asUid, opts)
+		}
+		if !cached {
+			// Read messages from DB
+			messages, err = store.Messages.GetAll(t.name, asUid, opts)
+			if err != nil {
+				sess.queueOut(ErrUnknownReply(msg, now))
+				return err
+			}
 		}
 
 		// Push the list of messages to the client as {data}.
 		if messages != nil {
 			count = len(messages)
+			mask := t.maskingRuleFor(msg.OrganizationId, asUid, asChan)
 			for i := range messages {
-				mm := &messages[i]
-				from := ""
-				if !asChan {
-					// Don't show sender for channel readers
-					from = types.ParseUid(mm.From).UserId()
-				}
-				sess.queueOut(&ServerComMessage{Data: &MsgServerData{
-					Topic:     toriginal,
-					Head:      mm.Head,
-					SeqId:     mm.SeqId,
-					From:      from,
-					Timestamp: mm.CreatedAt,
-					Content:   mm.Content}})
+				sess.queueOut(storedDataMessage(&messages[i], toriginal, asChan, mask, asUid))
 			}
 		}
 	}
@@ -2400,7 +3815,7 @@ func (t *Topic) replyGetTags(sess *Session, asUid types.Uid, msg *ClientComMessa
 		sess.queueOut(ErrOperationNotAllowedReply(msg, now))
 		return errors.New("invalid topic category for getting tags")
 	}
-	if t.cat == types.TopicCatGrp && t.owner != asUid {
+	if t.cat == types.TopicCatGrp && !t.isOwner(asUid) {
 		sess.queueOut(ErrPermissionDeniedReply(msg, now))
 		return errors.New("request for tags from non-owner")
 	}
@@ -2434,7 +3849,7 @@ func (t *Topic) replySetTags(sess *Session, asUid types.Uid, msg *ClientComMessa
 		resp = ErrOperationNotAllowedReply(msg, now)
 		err = errors.New("invalid topic category to assign tags")
 
-	} else if t.cat == types.TopicCatGrp && t.owner != asUid {
+	} else if t.cat == types.TopicCatGrp && !t.isOwner(asUid) {
 		resp = ErrPermissionDeniedReply(msg, now)
 		err = errors.New("tags update by non-owner")
 
@@ -2480,6 +3895,116 @@ func (t *Topic) replySetTags(sess *Session, asUid types.Uid, msg *ClientComMessa
 	return err
 }
 
+// updateTrusted replaces cached trusted values of the user: own values in 'me',
+// values of the other user in p2p topics.
+func (t *Topic) updateTrusted(uid types.Uid, trusted interface{}) {
+	switch t.cat {
+	case types.TopicCatMe:
+		t.trusted = trusted
+	case types.TopicCatP2P:
+		for u, pud := range t.perUser {
+			if u != uid {
+				pud.trusted = trusted
+			}
+		}
+	}
+}
+
+// replyGetDraft returns the unsent message saved by the user on the subscription, p2p and grp topics only.
+func (t *Topic) replyGetDraft(sess *Session, asUid types.Uid, msg *ClientComMessage) error {
+	now := types.TimeNow()
+
+	if t.cat != types.TopicCatP2P && t.cat != types.TopicCatGrp {
+		sess.queueOut(ErrOperationNotAllowedReply(msg, now))
+		return errors.New("invalid topic category for getting draft")
+	}
+	if pud, ok := t.perUser[asUid]; !ok || pud.deleted {
+		sess.queueOut(ErrPermissionDeniedReply(msg, now))
+		return errors.New("request for draft from non-subscriber")
+	}
+
+	sub, err := store.Subs.Get(t.name, asUid)
+	if err != nil {
+		sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, msg.Original, now, msg.Timestamp, nil))
+		return err
+	}
+
+	if sub != nil && sub.Draft != nil && sub.Draft.Content != nil {
+		sess.queueOut(&ServerComMessage{
+			Meta: &MsgServerMeta{Id: msg.Id, Topic: t.original(asUid), Timestamp: &now,
+				Draft: &MsgDraft{
+					Content:   sub.Draft.Content,
+					ReplyTo:   sub.Draft.ReplyTo,
+					UpdatedAt: &sub.Draft.UpdatedAt}}})
+		return nil
+	}
+
+	// Inform the requester that there is no draft.
+	sess.queueOut(NoContentParamsReply(msg, now, map[string]string{"what": "draft"}))
+
+	return nil
+}
+
+// replySetDraft saves or clears the unsent message of the user. The edit made last according to the
+// client-provided timestamp wins: older edits are rejected as not modified.
+func (t *Topic) replySetDraft(sess *Session, asUid types.Uid, msg *ClientComMessage) error {
+	now := types.TimeNow()
+	draft := msg.Set.Draft
+
+	if t.cat != types.TopicCatP2P && t.cat != types.TopicCatGrp {
+		sess.queueOut(ErrOperationNotAllowedReply(msg, now))
+		return errors.New("invalid topic category for saving draft")
+	}
+	if pud, ok := t.perUser[asUid]; !ok || pud.deleted {
+		sess.queueOut(ErrPermissionDeniedReply(msg, now))
+		return errors.New("draft update by non-subscriber")
+	}
+
+	if draft.Content != nil {
+		if content, err := json.Marshal(draft.Content); err != nil {
+			sess.queueOut(ErrMalformedReply(msg, now))
+			return err
+		} else if len(content) > maxDraftSize {
+			sess.queueOut(ErrTooLarge(msg.Id, msg.Original, now))
+			return errors.New("draft is too large")
+		}
+	}
+
+	// Edits from the future are treated as made now so a device with a wrong clock
+	// cannot block updates from other devices.
+	updated := now
+	if draft.UpdatedAt != nil && draft.UpdatedAt.Before(now) {
+		updated = draft.UpdatedAt.UTC().Round(time.Millisecond)
+	}
+
+	sub, err := store.Subs.Get(t.name, asUid)
+	if err != nil {
+		sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, msg.Original, now, msg.Timestamp, nil))
+		return err
+	}
+	if sub != nil && sub.Draft != nil && !sub.Draft.UpdatedAt.Before(updated) {
+		// A newer edit is already saved.
+		sess.queueOut(InfoNotModifiedReply(msg, now))
+		return nil
+	}
+
+	// Cleared draft is kept as an empty record with a timestamp so older edits cannot restore it.
+	saved := &types.MessageDraft{Content: draft.Content, UpdatedAt: updated}
+	if draft.Content != nil {
+		saved.ReplyTo = draft.ReplyTo
+	}
+	if err := store.Subs.Update(t.name, asUid, map[string]interface{}{"Draft": saved}, false); err != nil {
+		sess.queueOut(ErrUnknownReply(msg, now))
+		return err
+	}
+
+	// Let user's other sessions know the draft has changed.
+	t.presSubsOnline("draft", "", nilPresParams, &presFilters{singleUser: asUid.UserId()}, sess.sid)
+	sess.queueOut(NoErrReply(msg, now))
+
+	return nil
+}
+
 // replyGetCreds returns user's credentials such as email and phone numbers.
 func (t *Topic) replyGetCreds(sess *Session, asUid types.Uid, msg *ClientComMessage) error {
 	now := types.TimeNow()
@@ -2512,259 +4037,869 @@ func (t *Topic) replyGetCreds(sess *Session, asUid types.Uid, msg *ClientComMess
 	return nil
 }
 
-// replySetCreds adds or validates user credentials such as email and phone numbers.
-func (t *Topic) replySetCred(sess *Session, asUid types.Uid, authLevel auth.Level, msg *ClientComMessage) error {
-
+// replySetCreds adds or validates user credentials such as email and phone numbers.
+func (t *Topic) replySetCred(sess *Session, asUid types.Uid, authLevel auth.Level, msg *ClientComMessage) error {
+
+	now := types.TimeNow()
+	set := msg.Set
+	incomingReqTs := msg.Timestamp
+
+	if t.cat != types.TopicCatMe {
+		sess.queueOut(ErrOperationNotAllowedReply(msg, now))
+		return errors.New("invalid topic category for updating credentials")
+	}
+
+	var err error
+	var tags []string
+	creds := []MsgCredClient{*set.Cred}
+	if set.Cred.Response != "" {
+		// Credential is being validated. Return an arror if response is invalid.
+		_, tags, err = validatedCreds(asUid, authLevel, creds, true)
+	} else {
+		// Credential is being added or updated.
+		tmpToken, _, _ := store.GetLogicalAuthHandler("token").GenSecret(&auth.Rec{
+			Uid:       asUid,
+			AuthLevel: auth.LevelNone,
+			Lifetime:  auth.Duration(time.Hour * 24),
+			Features:  auth.FeatureNoLogin})
+		_, tags, err = addCreds(asUid, creds, nil, sess.lang, tmpToken)
+		if err == nil {
+			activityRecord(sess.activityEvent(asUid, activityCred, "add:"+set.Cred.Method))
+		}
+	}
+
+	if tags != nil {
+		t.tags = tags
+		t.presSubsOnline("tags", "", nilPresParams, nilPresFilters, "")
+	}
+
+	sess.queueOut(decodeStoreErrorExplicitTs(err, set.Id, t.original(asUid), now, incomingReqTs, nil))
+
+	return err
+}
+
+// replyGetDel is a response to a get[what=del] request: load a list of deleted message ids, send them to
+// a session as {meta}
+// response goes to a single session rather than all sessions in a topic
+func (t *Topic) replyGetDel(sess *Session, asUid types.Uid, req *MsgGetOpts, msg *ClientComMessage) error {
+	now := types.TimeNow()
+	toriginal := t.original(asUid)
+
+	id := msg.Id
+	incomingReqTs := msg.Timestamp
+
+	asChan, err := t.verifyChannelAccess(msg.Original)
+	if err != nil {
+		// User should not be able to address non-channel topic as channel.
+		sess.queueOut(ErrNotFoundReply(msg, now))
+		return types.ErrNotFound
+	}
+
+	if req != nil && (req.IfModifiedSince != nil || req.User != "" || req.Topic != "") {
+		sess.queueOut(ErrMalformedReply(msg, now))
+		return errors.New("invalid MsgGetOpts query")
+	}
+
+	// Check if the user has permission to read the topic data and the request is valid.
+	if userData, ok := t.perUser[asUid]; asChan || (ok && (userData.modeGiven & userData.modeWant).IsReader()) {
+		ranges, delID, err := store.Messages.GetDeleted(t.name, asUid, msgOpts2storeOpts(req))
+		if err != nil {
+			sess.queueOut(ErrUnknownReply(msg, now))
+			return err
+		}
+
+		if len(ranges) > 0 {
+			sess.queueOut(&ServerComMessage{Meta: &MsgServerMeta{
+				Id:    id,
+				Topic: toriginal,
+				Del: &MsgDelValues{
+					DelId:  delID,
+					DelSeq: delrangeDeserialize(ranges)},
+				Timestamp: &now}})
+			return nil
+		}
+	}
+
+	sess.queueOut(NoContentParams(id, toriginal, now, incomingReqTs, map[string]string{"what": "del"}))
+
+	return nil
+}
+
+// replyGetGap fills the gaps in the client's copy of the topic in one request: sends the ranges of messages
+// deleted since the client's latest known delete ID as {meta}, the messages published after the highest
+// contiguous SeqId the client has as {data}, oldest first, then a {ctrl} with the new sync state.
+func (t *Topic) replyGetGap(sess *Session, asUid types.Uid, req *MsgGetGap, msg *ClientComMessage) error {
+	now := types.TimeNow()
+	toriginal := t.original(asUid)
+
+	if req == nil || req.Seq < 0 || req.Clear < 0 || req.Limit < 0 {
+		sess.queueOut(ErrMalformedReply(msg, now))
+		return errors.New("invalid gap query")
+	}
+
+	asChan, err := t.verifyChannelAccess(msg.Original)
+	if err != nil {
+		// User should not be able to address non-channel topic as channel.
+		sess.queueOut(ErrNotFoundReply(msg, now))
+		return types.ErrNotFound
+	}
+
+	if userData, ok := t.perUser[asUid]; !asChan && (!ok || !(userData.modeGiven & userData.modeWant).IsReader()) {
+		sess.queueOut(ErrPermissionDeniedReply(msg, now))
+		return errors.New("gap fill by non-reader")
+	}
+
+	// Deletions are reported first: the client should not treat deleted messages as missing.
+	ranges, delID, err := store.Messages.GetDeleted(t.name, asUid, &types.QueryOpt{Since: req.Clear + 1})
+	if err != nil {
+		sess.queueOut(ErrUnknownReply(msg, now))
+		return err
+	}
+	if len(ranges) > 0 {
+		sess.queueOut(&ServerComMessage{Meta: &MsgServerMeta{
+			Id:    msg.Id,
+			Topic: toriginal,
+			Del: &MsgDelValues{
+				DelId:  delID,
+				DelSeq: delrangeDeserialize(ranges)},
+			Timestamp: &now}})
+	}
+	if delID < req.Clear {
+		delID = req.Clear
+	}
+
+	limit := req.Limit
+	if limit == 0 || limit > maxRedeliverCount {
+		limit = maxRedeliverCount
+	}
+	// The range is bounded from both sides so the oldest missing messages are sent first.
+	upto := req.Seq
+	since := req.Seq + 1
+	if redelivery.topicLimit > 0 && t.lastID-since+1 > redelivery.topicLimit {
+		// Only the most recent messages of the topic are sent, same as when redelivering.
+		since = t.lastID - redelivery.topicLimit + 1
+	}
+	if since <= t.lastID {
+		if allowed := sess.redeliveryReserve(limit); allowed < limit {
+			if allowed == 0 {
+				// The session has received too many messages: the rest is skipped.
+				since = t.lastID + 1
+			}
+			limit = allowed
+		}
+	}
+	if since > req.Seq+1 {
+		sess.queueOut(NoErrTruncated(toriginal, now, since-req.Seq-1, req.Seq+1, since))
+		upto = since - 1
+	}
+	var count int
+	if since <= t.lastID {
+		opts := &types.QueryOpt{Since: since, Before: since + limit}
+		var messages []types.Message
+		var cached bool
+		if t.recent != nil {
+			messages, cached = t.recent.get(asUid, opts)
+		}
+		if !cached {
+			if messages, err = store.Messages.GetAll(t.name, asUid, opts); err != nil {
+				sess.redeliveryRelease(limit)
+				sess.queueOut(ErrUnknownReply(msg, now))
+				return err
+			}
+		}
+		// Deleted messages are not sent and do not count.
+		sess.redeliveryRelease(limit - len(messages))
+
+		// Messages are returned in descending order. Send them oldest first.
+		mask := t.maskingRuleFor(msg.OrganizationId, asUid, asChan)
+		for i := len(messages) - 1; i >= 0; i-- {
+			sess.queueOut(storedDataMessage(&messages[i], toriginal, asChan, mask, asUid))
+		}
+		count = len(messages)
+		// Messages in the range which were not returned are deleted.
+		upto = opts.Before - 1
+		if upto > t.lastID {
+			upto = t.lastID
+		}
+	}
+
+	// The client has everything up to 'upto' now. If it's less than 'seq', the request should be repeated.
+	sess.queueOut(NoErrParamsReply(msg, now, map[string]interface{}{
+		"what":  "gap",
+		"count": count,
+		"upto":  upto,
+		"seq":   t.lastID,
+		"clear": delID}))
+
+	return nil
+}
+
+// replyDelMsg deletes (soft or hard) messages in response to del.msg packet.
+// Moderated requests hard-delete messages regardless of the access mode of the user.
+func (t *Topic) replyDelMsg(sess *Session, asUid types.Uid, moderated bool, msg *ClientComMessage) error {
+	now := types.TimeNow()
+	del := msg.Del
+
+	asChan, err := t.verifyChannelAccess(msg.Original)
+	if err != nil {
+		// User should not be able to address non-channel topic as channel.
+		sess.queueOut(ErrNotFoundReply(msg, now))
+		return types.ErrNotFound
+	}
+	if asChan {
+		// Do not allow channel readers delete messages.
+		sess.queueOut(ErrOperationNotAllowedReply(msg, now))
+		return errors.New("channel readers cannot delete messages")
+	}
+
+	// Hard delete requested by a user without the D permission.
+	var senderHard bool
+	pud, ok := t.perUser[asUid]
+	if moderated {
+		del.Hard = true
+	} else if !ok || !(pud.modeGiven & pud.modeWant).IsDeleter() {
+		// User must have an R permission: if the user cannot read messages, he has
+		// no business of deleting them.
+		if !ok || !(pud.modeGiven & pud.modeWant).IsReader() {
+			sess.queueOut(ErrPermissionDeniedReply(msg, now))
+			return errors.New("del.msg: permission denied")
+		}
+
+		// User has just the R permission, cannot hard-delete messages other than own recent ones,
+		// silently switching to soft-deleting
+		senderHard = del.Hard
+		del.Hard = false
+	}
+
+	var ranges []types.Range
+	if len(del.DelSeq) == 0 {
+		err = errors.New("del.msg: no IDs to delete")
+	} else {
+		count := 0
+		for _, dq := range del.DelSeq {
+			if dq.LowId > t.lastID || dq.LowId < 0 || dq.HiId < 0 ||
+				(dq.HiId > 0 && dq.LowId > dq.HiId) ||
+				(dq.LowId == 0 && dq.HiId == 0) {
+				err = errors.New("del.msg: invalid entry in list")
+				break
+			}
+
+			if dq.HiId > t.lastID {
+				// Range is inclusive - exclusive [low, hi),
+				// to delete all messages hi must be lastId + 1
+				dq.HiId = t.lastID + 1
+			} else if dq.LowId == dq.HiId || dq.LowId+1 == dq.HiId {
+				dq.HiId = 0
+			}
+
+			if dq.HiId == 0 {
+				count++
+			} else {
+				count += dq.HiId - dq.LowId
+			}
+
+			ranges = append(ranges, types.Range{Low: dq.LowId, Hi: dq.HiId})
+		}
+
+		if err == nil {
+			// Sort by Low ascending then by Hi descending.
+			sort.Sort(types.RangeSorter(ranges))
+			// Collapse overlapping ranges
+			ranges = types.RangeSorter(ranges).Normalize()
+		}
+
+		if count > defaultMaxDeleteCount && len(ranges) > 1 {
+			err = errors.New("del.msg: too many messages to delete")
+		}
+	}
+
+	if err != nil {
+		sess.queueOut(ErrMalformedReply(msg, now))
+		return err
+	}
+
+	if senderHard {
+		del.Hard = t.ownRecentMessages(asUid, ranges, now)
+	}
+
+	forUser := asUid
+	if del.Hard {
+		forUser = types.ZeroUid
+	}
+
+	if err = store.Messages.DeleteList(t.name, t.delID+1, forUser, ranges); err != nil {
+		sess.queueOut(ErrUnknownReply(msg, now))
+		return err
+	}
+
+	if t.recent != nil {
+		t.recent.delete(forUser, ranges)
+	}
+
+	// Requests generated by the server, e.g. revocation of view-once attachments, have no session.
+	org, sid := msg.OrganizationId, ""
+	if sess != nil {
+		sid = sess.sid
+	}
+
+	if journal.Enabled(org, t.name) {
+		journalWrite(&journal.Entry{
+			What:      journal.ActDel,
+			Org:       org,
+			Topic:     t.name,
+			From:      asUid.UserId(),
+			Timestamp: now,
+			DelSeq:    ranges,
+			Hard:      del.Hard})
+	}
+
+	// Increment Delete transaction ID
+	t.delID++
+	dr := delrangeDeserialize(ranges)
+	if del.Hard {
+		for _, pud := range t.perUser {
+			pud.delID = t.delID
+		}
+		// Broadcast the change to all, online and offline, exclude the session making the change.
+		params := &presParams{delID: t.delID, delSeq: dr, actor: asUid.UserId()}
+		filters := &presFilters{filterIn: types.ModeRead}
+		t.presSubsOnline("del", params.actor, params, filters, sid)
+		t.presSubsOffline("del", params, filters, nilPresFilters, sid, true)
+	} else {
+		pud.delID = t.delID
+
+		// Notify user's other sessions
+		t.presPubMessageDelete(asUid, pud.modeGiven&pud.modeWant, t.delID, dr, sid)
+	}
+
+	sess.queueOut(NoErrParamsReply(msg, now, map[string]int{"del": t.delID}))
+
+	return nil
+}
+
+// Shut down the topic in response to {del what="topic"} request
+// See detailed description at hub.topicUnreg()
+// 1. Checks if the requester is the owner. If so:
+// 1.2 Evict all sessions
+// 1.3 Ask hub to unregister self
+// 1.4 Exit the run() loop
+// 2. If requester is not the owner:
+// 2.1 If this is a p2p topic:
+// 2.1.1 Check if the other subscription still exists, if so, treat request as {leave unreg=true}
+// 2.1.2 If the other subscription does not exist, delete topic
+// 2.2 If this is not a p2p topic, treat it as {leave unreg=true}
+func (t *Topic) replyDelTopic(h *Hub, sess *Session, asUid types.Uid, msg *ClientComMessage) error {
+	if !t.isOwner(asUid) {
+		// Cases 2.1.1 and 2.2
+		if t.cat != types.TopicCatP2P || t.subsCount() == 2 {
+			return t.replyLeaveUnsub(h, sess, msg, asUid)
+		}
+	}
+
+	// Notifications are sent from the topic loop.
+
+	return nil
+}
+
+// Delete credential
+func (t *Topic) replyDelCred(h *Hub, sess *Session, asUid types.Uid, authLvl auth.Level, msg *ClientComMessage) error {
+	now := types.TimeNow()
+	incomingReqTs := msg.Timestamp
+	del := msg.Del
+
+	if t.cat != types.TopicCatMe {
+		sess.queueOut(ErrPermissionDeniedReply(msg, now))
+		return errors.New("del.cred: invalid topic category")
+	}
+	if del.Cred == nil || del.Cred.Method == "" {
+		sess.queueOut(ErrMalformedReply(msg, now))
+		return errors.New("del.cred: missing method")
+	}
+
+	tags, err := deleteCred(asUid, authLvl, del.Cred)
+	if err == nil {
+		activityRecord(sess.activityEvent(asUid, activityCred, "del:"+del.Cred.Method))
+	}
+	if tags != nil {
+		// Check if anything has been actually removed.
+		_, removed := stringSliceDelta(t.tags, tags)
+		if len(removed) > 0 {
+			t.tags = tags
+			t.presSubsOnline("tags", "", nilPresParams, nilPresFilters, "")
+		}
+	} else if err == nil {
+		sess.queueOut(InfoNoActionReply(msg, now))
+		return nil
+	}
+	sess.queueOut(decodeStoreErrorExplicitTs(err, del.Id, del.Topic, now, incomingReqTs, nil))
+	return err
+}
+
+// replyGetBlocks returns the list of users blocked by the user, 'me' only.
+func (t *Topic) replyGetBlocks(sess *Session, asUid types.Uid, msg *ClientComMessage) error {
+	now := types.TimeNow()
+
+	if t.cat != types.TopicCatMe {
+		sess.queueOut(ErrOperationNotAllowedReply(msg, now))
+		return errors.New("invalid topic category for getting block list")
+	}
+
+	if len(t.blocked) > 0 {
+		blocks := make([]MsgBlockedUser, len(t.blocked))
+		for i := range t.blocked {
+			blocks[i] = MsgBlockedUser{User: t.blocked[i].User, Hide: t.blocked[i].Hide, Created: &t.blocked[i].CreatedAt}
+		}
+		sess.queueOut(&ServerComMessage{
+			Meta: &MsgServerMeta{Id: msg.Id, Topic: t.original(asUid), Timestamp: &now, Block: blocks}})
+		return nil
+	}
+
+	// Inform the requester that no one is blocked.
+	sess.queueOut(NoContentParamsReply(msg, now, map[string]string{"what": "block"}))
+
+	return nil
+}
+
+// replySetBlock adds a user to the block list or changes visibility of the blocked user's messages.
+func (t *Topic) replySetBlock(sess *Session, asUid types.Uid, msg *ClientComMessage) error {
+	now := types.TimeNow()
+	set := msg.Set
+
+	if t.cat != types.TopicCatMe {
+		sess.queueOut(ErrPermissionDeniedReply(msg, now))
+		return errors.New("set.block: invalid topic category")
+	}
+
+	uid := types.ParseUserId(set.Block.User)
+	if uid.IsZero() || uid == asUid {
+		sess.queueOut(ErrMalformedReply(msg, now))
+		return errors.New("set.block: invalid user ID")
+	}
+	user := uid.UserId()
+
+	// The list is shared with other goroutines, update a copy.
+	blocked := make(types.BlockList, len(t.blocked), len(t.blocked)+1)
+	copy(blocked, t.blocked)
+	i := blocked.Find(user)
+	if i >= 0 {
+		if blocked[i].Hide == set.Block.Hide {
+			sess.queueOut(InfoNotModifiedReply(msg, now))
+			return nil
+		}
+		blocked[i].Hide = set.Block.Hide
+	} else {
+		blocked = append(blocked, types.BlockedUser{User: user, Hide: set.Block.Hide, CreatedAt: now})
+	}
+
+	if err := store.Users.Update(asUid, map[string]interface{}{"Blocked": blocked}); err != nil {
+		sess.queueOut(decodeStoreErrorExplicitTs(err, set.Id, t.original(asUid), now, msg.Timestamp, nil))
+		return err
+	}
+
+	t.blocked = blocked
+	blockListChanged(asUid, blocked)
+	if i < 0 {
+		t.presBlockContact(user, true)
+	}
+
+	sess.queueOut(NoErrReply(msg, now))
+
+	return nil
+}
+
+// replyDelBlock removes a user from the block list.
+func (t *Topic) replyDelBlock(sess *Session, asUid types.Uid, msg *ClientComMessage) error {
+	now := types.TimeNow()
+	del := msg.Del
+
+	if t.cat != types.TopicCatMe {
+		sess.queueOut(ErrPermissionDeniedReply(msg, now))
+		return errors.New("del.block: invalid topic category")
+	}
+
+	uid := types.ParseUserId(del.User)
+	if uid.IsZero() {
+		sess.queueOut(ErrMalformedReply(msg, now))
+		return errors.New("del.block: invalid user ID")
+	}
+	user := uid.UserId()
+
+	i := t.blocked.Find(user)
+	if i < 0 {
+		sess.queueOut(InfoNoActionReply(msg, now))
+		return nil
+	}
+
+	// The list is shared with other goroutines, update a copy.
+	blocked := make(types.BlockList, 0, len(t.blocked)-1)
+	blocked = append(blocked, t.blocked[:i]...)
+	blocked = append(blocked, t.blocked[i+1:]...)
+
+	if err := store.Users.Update(asUid, map[string]interface{}{"Blocked": blocked}); err != nil {
+		sess.queueOut(decodeStoreErrorExplicitTs(err, del.Id, t.original(asUid), now, msg.Timestamp, nil))
+		return err
+	}
+
+	t.blocked = blocked
+	blockListChanged(asUid, blocked)
+	t.presBlockContact(user, false)
+
+	sess.queueOut(NoErrReply(msg, now))
+
+	return nil
+}
+
+// replyGetEmoji returns custom emoji packs: packs available to the user in 'me', packs enabled
+// in the topic in 'grp'. If short codes are given, only the matching items are returned.
+func (t *Topic) replyGetEmoji(sess *Session, asUid types.Uid, msg *ClientComMessage) error {
+	now := types.TimeNow()
+
+	var packs []types.EmojiPack
+	var err error
+	switch t.cat {
+	case types.TopicCatMe:
+		packs, err = emojiPacksAvailable(msg.OrganizationId)
+	case types.TopicCatGrp:
+		if pud, ok := t.perUser[asUid]; !ok || pud.deleted {
+			sess.queueOut(ErrPermissionDeniedReply(msg, now))
+			return errors.New("request for emoji from non-subscriber")
+		}
+		if len(t.packs) > 0 {
+			var found []types.EmojiPack
+			if found, err = store.Packs.Get(t.packs...); err == nil {
+				// Keep the order in which the packs were enabled: it defines which pack wins
+				// when the same short code is used in more than one pack.
+				for _, id := range t.packs {
+					for i := range found {
+						if found[i].Id == id {
+							packs = append(packs, found[i])
+							break
+						}
+					}
+				}
+			}
+		}
+	default:
+		sess.queueOut(ErrOperationNotAllowedReply(msg, now))
+		return errors.New("invalid topic category for getting emoji")
+	}
+
+	if err != nil {
+		sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, t.original(asUid), now, msg.Timestamp, nil))
+		return err
+	}
+
+	var codes []string
+	if msg.Get.Emoji != nil {
+		codes = msg.Get.Emoji.Codes
+	}
+	if result := emojiPacksToMsg(packs, codes); len(result) > 0 {
+		sess.queueOut(&ServerComMessage{
+			Meta: &MsgServerMeta{Id: msg.Id, Topic: t.original(asUid), Timestamp: &now, Emoji: result}})
+		return nil
+	}
+
+	// Inform the requester that there are no packs or no matching codes.
+	sess.queueOut(NoContentParamsReply(msg, now, map[string]string{"what": "emoji"}))
+
+	return nil
+}
+
+// replySetEmoji creates or replaces an emoji pack ('me', root only) or changes the list of packs
+// enabled in a group topic (owner and admins only).
+func (t *Topic) replySetEmoji(sess *Session, asUid types.Uid, authLvl auth.Level, msg *ClientComMessage) error {
+	now := types.TimeNow()
+	set := msg.Set.Emoji
+
+	if set.Pack != nil {
+		if t.cat != types.TopicCatMe || authLvl != auth.LevelRoot {
+			sess.queueOut(ErrPermissionDeniedReply(msg, now))
+			return errors.New("set.emoji: pack update by non-root")
+		}
+
+		pack, err := emojiPackFromMsg(set.Pack)
+		if err == nil {
+			err = store.Packs.Upsert(pack)
+		}
+		if err != nil {
+			sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, t.original(asUid), now, msg.Timestamp, nil))
+			return err
+		}
+
+		sess.queueOut(NoErrParamsReply(msg, now, map[string]string{"id": pack.Id}))
+		return nil
+	}
+
+	if set.Enabled == nil {
+		sess.queueOut(ErrMalformedReply(msg, now))
+		return errors.New("set.emoji: empty request")
+	}
+
+	if t.cat != types.TopicCatGrp {
+		sess.queueOut(ErrOperationNotAllowedReply(msg, now))
+		return errors.New("set.emoji: invalid topic category")
+	}
+	if pud, ok := t.perUser[asUid]; !ok || !(pud.modeGiven & pud.modeWant).IsAdmin() {
+		sess.queueOut(ErrPermissionDeniedReply(msg, now))
+		return errors.New("set.emoji: packs enabled by non-admin")
+	}
+
+	// The order of packs is significant, keep it and drop duplicates.
+	var enabled []string
+	seen := make(map[string]bool, len(set.Enabled))
+	for _, id := range set.Enabled {
+		if types.ParseUid(id).IsZero() {
+			sess.queueOut(ErrMalformedReply(msg, now))
+			return errors.New("set.emoji: invalid pack ID")
+		}
+		if !seen[id] {
+			seen[id] = true
+			enabled = append(enabled, id)
+		}
+	}
+	if len(enabled) > maxEmojiPacksEnabled {
+		sess.queueOut(ErrPolicyLimitReply(msg, now, "emoji", maxEmojiPacksEnabled))
+		return errors.New("set.emoji: too many packs")
+	}
+
+	changed := len(enabled) != len(t.packs)
+	var added []string
+	for i, id := range enabled {
+		if !changed && t.packs[i] != id {
+			changed = true
+		}
+		found := false
+		for _, old := range t.packs {
+			if old == id {
+				found = true
+				break
+			}
+		}
+		if !found {
+			added = append(added, id)
+		}
+	}
+	if !changed {
+		sess.queueOut(InfoNotModifiedReply(msg, now))
+		return nil
+	}
+
+	if len(added) > 0 {
+		// Only packs available to the user can be enabled.
+		packs, err := store.Packs.Get(added...)
+		if err != nil {
+			sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, t.original(asUid), now, msg.Timestamp, nil))
+			return err
+		}
+		if len(packs) != len(added) {
+			sess.queueOut(ErrNotFoundReply(msg, now))
+			return errors.New("set.emoji: pack not found")
+		}
+		for i := range packs {
+			if packs[i].Org != "" && packs[i].Org != msg.OrganizationId {
+				sess.queueOut(ErrPermissionDeniedReply(msg, now))
+				return errors.New("set.emoji: pack of another organization")
+			}
+		}
+	}
+
+	if err := store.Topics.Update(t.name, map[string]interface{}{
+		"Packs": types.StringSlice(enabled), "UpdatedAt": now}); err != nil {
+		sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, t.original(asUid), now, msg.Timestamp, nil))
+		return err
+	}
+
+	t.packs = enabled
+	t.updated = now
+	// Tell online subscribers to refresh the list of packs.
+	t.presSubsOnline("emoji", "", nilPresParams, nilPresFilters, sess.sid)
+
+	sess.queueOut(NoErrReply(msg, now))
+
+	return nil
+}
+
+// replyDelEmoji deletes an emoji pack, 'me' only, root only.
+func (t *Topic) replyDelEmoji(sess *Session, asUid types.Uid, authLvl auth.Level, msg *ClientComMessage) error {
+	now := types.TimeNow()
+
+	if t.cat != types.TopicCatMe || authLvl != auth.LevelRoot {
+		sess.queueOut(ErrPermissionDeniedReply(msg, now))
+		return errors.New("del.emoji: pack deleted by non-root")
+	}
+
+	if types.ParseUid(msg.Del.Pack).IsZero() {
+		sess.queueOut(ErrMalformedReply(msg, now))
+		return errors.New("del.emoji: invalid pack ID")
+	}
+
+	if err := store.Packs.Delete(msg.Del.Pack); err != nil {
+		sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, t.original(asUid), now, msg.Timestamp, nil))
+		return err
+	}
+
+	sess.queueOut(NoErrReply(msg, now))
+
+	return nil
+}
+
+// replyGetHook returns the membership webhook of a group topic without the secret, owner only.
+func (t *Topic) replyGetHook(sess *Session, asUid types.Uid, msg *ClientComMessage) error {
 	now := types.TimeNow()
-	set := msg.Set
-	incomingReqTs := msg.Timestamp
 
-	if t.cat != types.TopicCatMe {
+	if t.cat != types.TopicCatGrp {
 		sess.queueOut(ErrOperationNotAllowedReply(msg, now))
-		return errors.New("invalid topic category for updating credentials")
+		return errors.New("get.hook: invalid topic category")
 	}
-
-	var err error
-	var tags []string
-	creds := []MsgCredClient{*set.Cred}
-	if set.Cred.Response != "" {
-		// Credential is being validated. Return an arror if response is invalid.
-		_, tags, err = validatedCreds(asUid, authLevel, creds, true)
-	} else {
-		// Credential is being added or updated.
-		tmpToken, _, _ := store.GetLogicalAuthHandler("token").GenSecret(&auth.Rec{
-			Uid:       asUid,
-			AuthLevel: auth.LevelNone,
-			Lifetime:  auth.Duration(time.Hour * 24),
-			Features:  auth.FeatureNoLogin})
-		_, tags, err = addCreds(asUid, creds, nil, sess.lang, tmpToken)
+	if !t.isOwner(asUid) {
+		sess.queueOut(ErrPermissionDeniedReply(msg, now))
+		return errors.New("get.hook: request by non-owner")
 	}
 
-	if tags != nil {
-		t.tags = tags
-		t.presSubsOnline("tags", "", nilPresParams, nilPresFilters, "")
+	if t.webhook.Url == "" {
+		sess.queueOut(NoContentParamsReply(msg, now, map[string]string{"what": "hook"}))
+		return nil
 	}
 
-	sess.queueOut(decodeStoreErrorExplicitTs(err, set.Id, t.original(asUid), now, incomingReqTs, nil))
+	sess.queueOut(&ServerComMessage{
+		Meta: &MsgServerMeta{Id: msg.Id, Topic: t.original(asUid), Timestamp: &now,
+			Hook: &MsgTopicHook{Url: t.webhook.Url, Events: t.webhook.Events}}})
 
-	return err
+	return nil
 }
 
-// replyGetDel is a response to a get[what=del] request: load a list of deleted message ids, send them to
-// a session as {meta}
-// response goes to a single session rather than all sessions in a topic
-func (t *Topic) replyGetDel(sess *Session, asUid types.Uid, req *MsgGetOpts, msg *ClientComMessage) error {
+// replySetHook sets, replaces or removes the membership webhook of a group topic, owner only.
+func (t *Topic) replySetHook(sess *Session, asUid types.Uid, msg *ClientComMessage) error {
 	now := types.TimeNow()
-	toriginal := t.original(asUid)
 
-	id := msg.Id
-	incomingReqTs := msg.Timestamp
+	if t.cat != types.TopicCatGrp {
+		sess.queueOut(ErrOperationNotAllowedReply(msg, now))
+		return errors.New("set.hook: invalid topic category")
+	}
+	if !t.isOwner(asUid) {
+		sess.queueOut(ErrPermissionDeniedReply(msg, now))
+		return errors.New("set.hook: request by non-owner")
+	}
 
-	asChan, err := t.verifyChannelAccess(msg.Original)
+	hook, secret, err := hookFromMsg(msg.Set.Hook)
 	if err != nil {
-		// User should not be able to address non-channel topic as channel.
-		sess.queueOut(ErrNotFoundReply(msg, now))
-		return types.ErrNotFound
+		sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, t.original(asUid), now, msg.Timestamp, nil))
+		return err
 	}
 
-	if req != nil && (req.IfModifiedSince != nil || req.User != "" || req.Topic != "") {
-		sess.queueOut(ErrMalformedReply(msg, now))
-		return errors.New("invalid MsgGetOpts query")
+	if hook.Url == "" && t.webhook.Url == "" {
+		sess.queueOut(InfoNotModifiedReply(msg, now))
+		return nil
 	}
 
-	// Check if the user has permission to read the topic data and the request is valid.
-	if userData := t.perUser[asUid]; asChan || (userData.modeGiven & userData.modeWant).IsReader() {
-		ranges, delID, err := store.Messages.GetDeleted(t.name, asUid, msgOpts2storeOpts(req))
-		if err != nil {
-			sess.queueOut(ErrUnknownReply(msg, now))
-			return err
-		}
-
-		if len(ranges) > 0 {
-			sess.queueOut(&ServerComMessage{Meta: &MsgServerMeta{
-				Id:    id,
-				Topic: toriginal,
-				Del: &MsgDelValues{
-					DelId:  delID,
-					DelSeq: delrangeDeserialize(ranges)},
-				Timestamp: &now}})
-			return nil
-		}
+	if err := store.Topics.Update(t.name, map[string]interface{}{
+		"Webhook": *hook, "UpdatedAt": now}); err != nil {
+		sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, t.original(asUid), now, msg.Timestamp, nil))
+		return err
 	}
 
-	sess.queueOut(NoContentParams(id, toriginal, now, incomingReqTs, map[string]string{"what": "del"}))
+	t.webhook = *hook
+	t.updated = now
+
+	if secret != "" {
+		// The secret was generated by the server. This is the only time it's reported to the client.
+		sess.queueOut(NoErrParamsReply(msg, now, map[string]string{"secret": secret}))
+	} else {
+		sess.queueOut(NoErrReply(msg, now))
+	}
 
 	return nil
 }
 
-// replyDelMsg deletes (soft or hard) messages in response to del.msg packet.
-func (t *Topic) replyDelMsg(sess *Session, asUid types.Uid, msg *ClientComMessage) error {
+// replyGetAutoReply returns the auto-reply of the user, 'me' only.
+func (t *Topic) replyGetAutoReply(sess *Session, asUid types.Uid, msg *ClientComMessage) error {
 	now := types.TimeNow()
-	del := msg.Del
 
-	asChan, err := t.verifyChannelAccess(msg.Original)
-	if err != nil {
-		// User should not be able to address non-channel topic as channel.
-		sess.queueOut(ErrNotFoundReply(msg, now))
-		return types.ErrNotFound
-	}
-	if asChan {
-		// Do not allow channel readers delete messages.
+	if t.cat != types.TopicCatMe {
 		sess.queueOut(ErrOperationNotAllowedReply(msg, now))
-		return errors.New("channel readers cannot delete messages")
+		return errors.New("get.autoreply: invalid topic category")
 	}
 
-	pud := t.perUser[asUid]
-	if !(pud.modeGiven & pud.modeWant).IsDeleter() {
-		// User must have an R permission: if the user cannot read messages, he has
-		// no business of deleting them.
-		if !(pud.modeGiven & pud.modeWant).IsReader() {
-			sess.queueOut(ErrPermissionDeniedReply(msg, now))
-			return errors.New("del.msg: permission denied")
-		}
-
-		// User has just the R permission, cannot hard-delete messages, silently
-		// switching to soft-deleting
-		del.Hard = false
+	if t.autoReply.Content == nil {
+		sess.queueOut(NoContentParamsReply(msg, now, map[string]string{"what": "autoreply"}))
+		return nil
 	}
 
-	var ranges []types.Range
-	if len(del.DelSeq) == 0 {
-		err = errors.New("del.msg: no IDs to delete")
-	} else {
-		count := 0
-		for _, dq := range del.DelSeq {
-			if dq.LowId > t.lastID || dq.LowId < 0 || dq.HiId < 0 ||
-				(dq.HiId > 0 && dq.LowId > dq.HiId) ||
-				(dq.LowId == 0 && dq.HiId == 0) {
-				err = errors.New("del.msg: invalid entry in list")
-				break
-			}
-
-			if dq.HiId > t.lastID {
-				// Range is inclusive - exclusive [low, hi),
-				// to delete all messages hi must be lastId + 1
-				dq.HiId = t.lastID + 1
-			} else if dq.LowId == dq.HiId || dq.LowId+1 == dq.HiId {
-				dq.HiId = 0
-			}
-
-			if dq.HiId == 0 {
-				count++
-			} else {
-				count += dq.HiId - dq.LowId
-			}
+	sess.queueOut(&ServerComMessage{
+		Meta: &MsgServerMeta{Id: msg.Id, Topic: t.original(asUid), Timestamp: &now,
+			AutoReply: &MsgAutoReply{Content: t.autoReply.Content, Start: t.autoReply.Start, End: t.autoReply.End}}})
 
-			ranges = append(ranges, types.Range{Low: dq.LowId, Hi: dq.HiId})
-		}
+	return nil
+}
 
-		if err == nil {
-			// Sort by Low ascending then by Hi descending.
-			sort.Sort(types.RangeSorter(ranges))
-			// Collapse overlapping ranges
-			ranges = types.RangeSorter(ranges).Normalize()
-		}
+// replySetAutoReply sets, replaces or removes the auto-reply of the user, 'me' only.
+func (t *Topic) replySetAutoReply(sess *Session, asUid types.Uid, msg *ClientComMessage) error {
+	now := types.TimeNow()
 
-		if count > defaultMaxDeleteCount && len(ranges) > 1 {
-			err = errors.New("del.msg: too many messages to delete")
-		}
+	if t.cat != types.TopicCatMe {
+		sess.queueOut(ErrOperationNotAllowedReply(msg, now))
+		return errors.New("set.autoreply: invalid topic category")
 	}
 
+	reply, err := autoReplyFromMsg(msg.Set.AutoReply)
 	if err != nil {
-		sess.queueOut(ErrMalformedReply(msg, now))
+		sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, t.original(asUid), now, msg.Timestamp, nil))
 		return err
 	}
 
-	forUser := asUid
-	if del.Hard {
-		forUser = types.ZeroUid
+	if reply.Content == nil && t.autoReply.Content == nil {
+		sess.queueOut(InfoNotModifiedReply(msg, now))
+		return nil
 	}
 
-	if err = store.Messages.DeleteList(t.name, t.delID+1, forUser, ranges); err != nil {
-		sess.queueOut(ErrUnknownReply(msg, now))
+	if err := store.Users.Update(asUid, map[string]interface{}{"AutoReply": reply}); err != nil {
+		sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, t.original(asUid), now, msg.Timestamp, nil))
 		return err
 	}
 
-	// Increment Delete transaction ID
-	t.delID++
-	dr := delrangeDeserialize(ranges)
-	if del.Hard {
-		for uid, pud := range t.perUser {
-			pud.delID = t.delID
-			t.perUser[uid] = pud
-		}
-		// Broadcast the change to all, online and offline, exclude the session making the change.
-		params := &presParams{delID: t.delID, delSeq: dr, actor: asUid.UserId()}
-		filters := &presFilters{filterIn: types.ModeRead}
-		t.presSubsOnline("del", params.actor, params, filters, sess.sid)
-		t.presSubsOffline("del", params, filters, nilPresFilters, sess.sid, true)
-	} else {
-		pud := t.perUser[asUid]
-		pud.delID = t.delID
-		t.perUser[asUid] = pud
-
-		// Notify user's other sessions
-		t.presPubMessageDelete(asUid, pud.modeGiven&pud.modeWant, t.delID, dr, sess.sid)
-	}
+	t.autoReply = reply
+	autoReplySet(asUid, reply)
 
-	sess.queueOut(NoErrParamsReply(msg, now, map[string]int{"del": t.delID}))
+	sess.queueOut(NoErrReply(msg, now))
 
 	return nil
 }
 
-// Shut down the topic in response to {del what="topic"} request
-// See detailed description at hub.topicUnreg()
-// 1. Checks if the requester is the owner. If so:
-// 1.2 Evict all sessions
-// 1.3 Ask hub to unregister self
-// 1.4 Exit the run() loop
-// 2. If requester is not the owner:
-// 2.1 If this is a p2p topic:
-// 2.1.1 Check if the other subscription still exists, if so, treat request as {leave unreg=true}
-// 2.1.2 If the other subscription does not exist, delete topic
-// 2.2 If this is not a p2p topic, treat it as {leave unreg=true}
-func (t *Topic) replyDelTopic(h *Hub, sess *Session, asUid types.Uid, msg *ClientComMessage) error {
-	if t.owner != asUid {
-		// Cases 2.1.1 and 2.2
-		if t.cat != types.TopicCatP2P || t.subsCount() == 2 {
-			return t.replyLeaveUnsub(h, sess, msg, asUid)
-		}
+// replySetImport starts an import of channel readers, 'me' only, root only.
+func (t *Topic) replySetImport(sess *Session, authLvl auth.Level, msg *ClientComMessage) error {
+	if t.cat != types.TopicCatMe || authLvl != auth.LevelRoot {
+		sess.queueOut(ErrPermissionDeniedReply(msg, types.TimeNow()))
+		return errors.New("set.import: request by non-root")
 	}
 
-	// Notifications are sent from the topic loop.
-
-	return nil
+	// The import may take a long time, it's done outside of the topic.
+	return chnImportStart(sess, msg)
 }
 
-// Delete credential
-func (t *Topic) replyDelCred(h *Hub, sess *Session, asUid types.Uid, authLvl auth.Level, msg *ClientComMessage) error {
-	now := types.TimeNow()
-	incomingReqTs := msg.Timestamp
-	del := msg.Del
-
-	if t.cat != types.TopicCatMe {
-		sess.queueOut(ErrPermissionDeniedReply(msg, now))
-		return errors.New("del.cred: invalid topic category")
+// fireMemberHook reports the change in user's membership to the topic's webhook.
+func (t *Topic) fireMemberHook(uid, actor types.Uid, oldWant, oldGiven, newWant, newGiven types.AccessMode) {
+	if t.cat != types.TopicCatGrp || t.isProxy || t.webhook.Url == "" {
+		return
 	}
-	if del.Cred == nil || del.Cred.Method == "" {
-		sess.queueOut(ErrMalformedReply(msg, now))
-		return errors.New("del.cred: missing method")
+
+	event := hookMemberEvent(oldWant, oldGiven, newWant, newGiven)
+	if event == "" {
+		return
 	}
 
-	tags, err := deleteCred(asUid, authLvl, del.Cred)
-	if tags != nil {
-		// Check if anything has been actually removed.
-		_, removed := stringSliceDelta(t.tags, tags)
-		if len(removed) > 0 {
-			t.tags = tags
-			t.presSubsOnline("tags", "", nilPresParams, nilPresFilters, "")
-		}
-	} else if err == nil {
-		sess.queueOut(InfoNoActionReply(msg, now))
-		return nil
+	evt := &hookEvent{
+		Event:     event,
+		Topic:     t.name,
+		User:      uid.UserId(),
+		Actor:     actor.UserId(),
+		Timestamp: types.TimeNow(),
 	}
-	sess.queueOut(decodeStoreErrorExplicitTs(err, del.Id, del.Topic, now, incomingReqTs, nil))
-	return err
+	if event != hookEventLeave || newWant.IsDefined() && newGiven.IsDefined() {
+		evt.Want = newWant.String()
+		evt.Given = newGiven.String()
+		evt.Mode = (newWant & newGiven).String()
+	}
+	hookFire(&t.webhook, evt)
 }
 
 // Delete subscription.
@@ -2787,8 +4922,7 @@ func (t *Topic) replyDelSub(h *Hub, sess *Session, asUid types.Uid, msg *ClientC
 	// Get ID of the affected user
 	uid := types.ParseUserId(del.User)
 
-	pud := t.perUser[asUid]
-	if !(pud.modeGiven & pud.modeWant).IsAdmin() {
+	if pud, ok := t.perUser[asUid]; !ok || !((pud.modeGiven & pud.modeWant).IsAdmin() || t.isOwner(asUid)) {
 		err = errors.New("del.sub: permission denied")
 	} else if uid.IsZero() || uid == asUid {
 		// Cannot delete self-subscription. User [leave unsub] or [delete topic]
@@ -2812,6 +4946,8 @@ func (t *Topic) replyDelSub(h *Hub, sess *Session, asUid types.Uid, msg *ClientC
 	// Check if the user being ejected is the owner.
 	if (pud.modeGiven & pud.modeWant).IsOwner() {
 		err = errors.New("del.sub: cannot evict topic owner")
+	} else if t.isOwner(uid) && !t.isOwner(asUid) {
+		err = errors.New("del.sub: cannot evict co-owner")
 	} else if !pud.modeWant.IsJoiner() {
 		// If the user has banned the topic, subscription should not be deleted. Otherwise user may be re-invited
 		// which defeats the purpose of banning.
@@ -2837,7 +4973,7 @@ func (t *Topic) replyDelSub(h *Hub, sess *Session, asUid types.Uid, msg *ClientC
 
 	// Update cached unread count: negative value
 	if (pud.modeWant & pud.modeGiven).IsReader() {
-		usersUpdateUnread(uid, pud.readID-t.lastID, true)
+		usersUpdateUnread(uid, pud.readID-t.lastID, -t.mentionsClear(uid, 0), true)
 	}
 
 	// ModeUnset signifies deleted subscription as opposite to ModeNone - no access.
@@ -2846,6 +4982,8 @@ func (t *Topic) replyDelSub(h *Hub, sess *Session, asUid types.Uid, msg *ClientC
 
 	t.evictUser(uid, true, "")
 
+	t.recordEvent("rm", asUid, uid, nil)
+
 	return nil
 }
 
@@ -2910,17 +5048,24 @@ func (t *Topic) replyLeaveUnsub(h *Hub, sess *Session, msg *ClientComMessage, as
 	var oldWant types.AccessMode
 	var oldGiven types.AccessMode
 	if !asChan {
-		pud := t.perUser[asUid]
-
-		// Update cached unread count: negative value
-		if (pud.modeWant & pud.modeGiven).IsReader() {
-			usersUpdateUnread(asUid, pud.readID-t.lastID, true)
+		if pud, ok := t.perUser[asUid]; ok {
+			// Update cached unread count: negative value
+			if (pud.modeWant & pud.modeGiven).IsReader() {
+				usersUpdateUnread(asUid, pud.readID-t.lastID, -t.mentionsClear(asUid, 0), true)
+			}
+			oldWant, oldGiven = pud.modeWant, pud.modeGiven
 		}
-		oldWant, oldGiven = pud.modeWant, pud.modeGiven
 	} else {
 		oldWant, oldGiven = types.ModeCChnReader, types.ModeCChnReader
+		// Unread messages of the channel are no longer counted.
+		t.chanCursorForget(asUid)
+		usersRecountUnread(asUid)
 		// Unsubscribe user's devices from the channel (FCM topic).
 		t.channelSubUnsub(asUid, false)
+		if err := store.Digests.Delete(types.GrpToChn(t.name), asUid); err != nil {
+			log.Printf("topic[%s]: failed to delete digest of %s: %v", t.name, asUid.UserId(), err)
+		}
+		t.relayRevoke(asUid)
 	}
 
 	// Send prsence notifictions to admins, other users, and user's other sessions.
@@ -2929,6 +5074,10 @@ func (t *Topic) replyLeaveUnsub(h *Hub, sess *Session, msg *ClientComMessage, as
 	// Evict all user's sessions, clear cached data, send notifications.
 	t.evictUser(asUid, true, sess.sid)
 
+	if !asChan {
+		t.recordEvent("leave", asUid, types.ZeroUid, nil)
+	}
+
 	return nil
 }
 
@@ -2941,20 +5090,21 @@ func (t *Topic) evictUser(uid types.Uid, unsub bool, skip string) {
 	if unsub {
 		if t.cat == types.TopicCatP2P {
 			// P2P: mark user as deleted
-			pud.online = 0
-			pud.deleted = true
-			t.perUser[uid] = pud
+			if ok {
+				pud.online = 0
+				pud.deleted = true
+			}
 		} else if ok {
 			// Grp: delete per-user data
 			delete(t.perUser, uid)
 			t.computePerUserAcsUnion()
+			t.ownersDrop(uid)
 
 			usersRegisterUser(uid, false)
 		}
 	} else if ok {
 		// Clear online status
 		pud.online = 0
-		t.perUser[uid] = pud
 	}
 
 	// Detach all user's sessions
@@ -2963,16 +5113,54 @@ func (t *Topic) evictUser(uid types.Uid, unsub bool, skip string) {
 	msg.SkipSid = skip
 	msg.uid = uid
 	msg.AsUser = uid.UserId()
+	var detach []*Session
 	for s := range t.sessions {
 		if pssd, removed := t.remSession(s, uid); pssd != nil {
 			if removed {
-				s.detachSession(t.name)
+				detach = append(detach, s)
 			}
 			if s.sid != skip {
 				s.queueOut(msg)
 			}
 		}
 	}
+	t.detachSessions(detach)
+}
+
+// sessionList returns all sessions attached to the topic.
+func (t *Topic) sessionList() []*Session {
+	sessions := make([]*Session, 0, len(t.sessions))
+	for s := range t.sessions {
+		sessions = append(sessions, s)
+	}
+	return sessions
+}
+
+// detachSessions tells the sessions to remove the topic. Sessions are notified in parallel by the hub's
+// workers: a channel with tens of thousands of readers would otherwise block the topic for seconds
+// if some of the sessions are stuck. Returns when all sessions are notified or timed out.
+func (t *Topic) detachSessions(sessions []*Session) {
+	if len(sessions) == 0 {
+		return
+	}
+
+	var wg sync.WaitGroup
+	var stuck int32
+	wg.Add(len(sessions))
+	for _, s := range sessions {
+		s := s
+		globals.hub.detachPool.Schedule(func() {
+			if !s.detachSession(t.name) {
+				atomic.AddInt32(&stuck, 1)
+			}
+			wg.Done()
+		})
+	}
+	wg.Wait()
+
+	if stuck > 0 {
+		log.Printf("topic[%s]: failed to detach %d stuck session(s)", t.name, stuck)
+	}
 }
 
 // User's subscription to a topic has changed, send presence notifications.
@@ -2992,6 +5180,20 @@ func (t *Topic) notifySubChange(uid, actor types.Uid, isChan bool,
 
 	target := uid.UserId()
 
+	if !isChan {
+		t.fireMemberHook(uid, actor, oldWant, oldGiven, newWant, newGiven)
+		switch hookMemberEvent(oldWant, oldGiven, newWant, newGiven) {
+		case hookEventJoin:
+			t.statsMember(true)
+		case hookEventLeave, hookEventBan:
+			t.statsMember(false)
+		}
+	} else if unsub {
+		// Channel reader has left.
+		t.statsMember(false)
+		t.audienceReader(false)
+	}
+
 	dWant := types.ModeNone.String()
 	if newWant.IsDefined() {
 		if oldWant.IsDefined() && !oldWant.IsZero() {
@@ -3102,24 +5304,41 @@ func (t *Topic) pushForData(fromUid types.Uid, data *MsgServerData, organization
 			Timestamp:   data.Timestamp,
 			SeqId:       data.SeqId,
 			ContentType: contentType,
-			Content:     data.Content}}
+			Content:     data.Content,
+			Link:        permalinkMake(t.name, data.SeqId)}}
 
 	if t.isChan {
 		receipt.Channel = types.GrpToChn(t.xoriginal)
 	}
 
+	suppressPeriod := liveConfig().pushSuppressPeriod
+	// Users mentioned in the message or replied to, found only if someone is notified of mentions only.
+	var targets map[types.Uid]bool
 	for uid, pud := range t.perUser {
 		// Send only to those who have notifications enabled, exclude the originating user.
 		if uid == fromUid {
 			continue
 		}
 		mode := pud.modeWant & pud.modeGiven
-		if mode.IsPresencer() && mode.IsReader() && !pud.deleted {
-			receipt.To[uid] = push.Recipient{
-				// Number of sessions this data message will be delivered to.
-				// Push notifications sent to users with non-zero online sessions will be marked silent.
-				Delivered: pud.online,
+		if !mode.IsReader() || pud.deleted || pud.isMuted(data.Timestamp) || pud.isQuiet(data.Timestamp) {
+			continue
+		}
+		if pud.notify == notifyMentions {
+			if targets == nil {
+				targets = t.notifyTargets(fromUid, data)
 			}
+			if !targets[uid] {
+				continue
+			}
+		} else if !notifyAll(mode, pud.notify) {
+			continue
+		}
+		receipt.To[uid] = push.Recipient{
+			// Number of sessions this data message will be delivered to.
+			// Push notifications sent to users with non-zero online sessions will be marked silent.
+			Delivered: pud.online,
+			// The user is typing or looking at the topic: no need to notify.
+			Suppressed: pud.online > 0 && suppressPeriod > 0 && data.Timestamp.Sub(pud.activeAt) < suppressPeriod,
 		}
 	}
 	if len(receipt.To) > 0 || receipt.Channel != "" {
@@ -3176,6 +5395,8 @@ const (
 	topicStatusLoaded = 0x1
 	// Topic is paused: all packets are rejected.
 	topicStatusPaused = 0x2
+	// Topic has no attached sessions and will be shut down after a timeout.
+	topicStatusIdle = 0x4
 
 	// Topic is in the process of being deleted. This is irrecoverable.
 	topicStatusMarkedDeleted = 0x10
@@ -3213,6 +5434,11 @@ func (t *Topic) markPaused(pause bool) {
 	t.statusChangeBits(topicStatusPaused, pause)
 }
 
+// markIdle sets or clears the idle flag. Idle topics are subject to eviction.
+func (t *Topic) markIdle(idle bool) {
+	t.statusChangeBits(topicStatusIdle, idle)
+}
+
 // markDeleted marks topic as being deleted.
 func (t *Topic) markDeleted() {
 	t.statusChangeBits(topicStatusMarkedDeleted, true)
@@ -3240,6 +5466,40 @@ func (t *Topic) isDeleted() bool {
 	return (atomic.LoadInt32((*int32)(&t.status)) & topicStatusMarkedDeleted) != 0
 }
 
+func (t *Topic) isIdle() bool {
+	return (atomic.LoadInt32((*int32)(&t.status)) & topicStatusIdle) != 0
+}
+
+// Rough estimates of memory used by topic's data structures, in bytes.
+const (
+	topicMemSize         = 2048
+	perUserMemSize       = 256
+	perSubsMemSize       = 192
+	perSessionMemSize    = 64
+	chanSlotMemSize      = 8
+	recentMessageMemSize = 1024
+)
+
+// memoryEstimate returns approximate size of memory used by the topic.
+func (t *Topic) memoryEstimate() int64 {
+	size := topicMemSize +
+		len(t.perUser)*perUserMemSize +
+		len(t.perSubs)*perSubsMemSize +
+		len(t.sessions)*perSessionMemSize +
+		(cap(t.broadcast)+cap(t.reg)+cap(t.unreg)+cap(t.meta))*chanSlotMemSize
+	if t.recent != nil {
+		size += t.recent.count * recentMessageMemSize
+	}
+	return int64(size)
+}
+
+// updateAccounting records the time of the last activity and current memory usage of the topic
+// for use by the hub when evicting idle topics.
+func (t *Topic) updateAccounting() {
+	atomic.StoreInt64(&t.lastActive, time.Now().UnixNano())
+	atomic.StoreInt64(&t.memSize, t.memoryEstimate())
+}
+
 // Get topic name suitable for the given client
 func (t *Topic) original(uid types.Uid) string {
 	if t.cat == types.TopicCatP2P {
@@ -3476,6 +5736,9 @@ func (t *Topic) remSession(sess *Session, asUid types.Uid) (*perSessionData, boo
 
 	if pssd.uid == asUid || asUid.IsZero() {
 		delete(t.sessions, s)
+		if pssd.guest {
+			t.guestsOnline--
+		}
 		if s.isMultiplex() && !t.remProxiedSession(s) {
 			log.Printf("topic[%s]: multiplex session %s not removed from the event loop", t.name, s.sid)
 		}
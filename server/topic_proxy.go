@@ -81,9 +81,7 @@ func (t *Topic) runProxy(hub *Hub) {
 
 		case sd := <-t.exit:
 			// Tell sessions to remove the topic
-			for s := range t.sessions {
-				s.detachSession(t.name)
-			}
+			t.detachSessions(t.sessionList())
 
 			if err := globals.cluster.topicProxyGone(t.name); err != nil {
 				log.Printf("topic proxy shutdown [%s]: failed to notify master - %s", t.name, err)
@@ -97,7 +95,7 @@ func (t *Topic) runProxy(hub *Hub) {
 
 		case <-killTimer.C:
 			// Topic timeout
-			hub.unreg <- &topicUnreg{rcptTo: t.name}
+			hub.shardFor(t.name).unreg <- &topicUnreg{rcptTo: t.name}
 		}
 	}
 }
@@ -188,7 +186,8 @@ func (t *Topic) proxyMasterResponse(msg *ClusterResp, killTimer *time.Timer) {
 							broadcast: t.broadcast,
 							done:      t.unreg,
 							meta:      t.meta,
-							supd:      t.supd})
+							supd:      t.supd,
+							uid:       msg.SrvMsg.uid})
 					}
 					sess.sessionStoreLock.Unlock()
 
@@ -203,7 +202,7 @@ func (t *Topic) proxyMasterResponse(msg *ClusterResp, killTimer *time.Timer) {
 			if msg.SrvMsg != nil && msg.SrvMsg.Ctrl != nil {
 				if msg.SrvMsg.Ctrl.Code < 300 {
 					if sess != nil {
-						t.remSession(sess, sess.uid)
+						t.remSession(sess, msg.SrvMsg.uid)
 					}
 				}
 				// All sessions are gone. Start the kill timer.
@@ -230,15 +229,19 @@ func (t *Topic) proxyCtrlBroadcast(msg *ServerComMessage) {
 		if msg.uid.IsZero() {
 			log.Panicf("topic[%s]: proxy received evict message with empty uid", t.name)
 		}
+		var detach []*Session
 		for sess := range t.sessions {
 			// Proxy topic may only have ordinary sessions. No multiplexing or proxy sessions here.
 			if _, removed := t.remSession(sess, msg.uid); removed {
-				sess.detachSession(t.name)
+				detach = append(detach, sess)
+				// The user is no longer subscribed: the topic may be deleted and created again.
+				sess.forgetDelivered(t.name)
 				if sess.sid != msg.SkipSid {
 					sess.queueOut(msg)
 				}
 			}
 		}
+		t.detachSessions(detach)
 	}
 }
 
@@ -251,16 +254,24 @@ func (t *Topic) updateAcsFromPresMsg(pres *MsgServerPres) {
 		return
 	}
 
-	// If t.perUser[uid] does not exist, pud is initialized with blanks, otherwise it gets existing values.
-	pud := t.perUser[uid]
-	if err := pud.modeWant.ApplyMutation(dacs.Want); err != nil {
+	// If t.perUser[uid] does not exist, modes are initialized with blanks, otherwise they get existing values.
+	var modeWant, modeGiven types.AccessMode
+	pud, ok := t.perUser[uid]
+	if ok {
+		modeWant, modeGiven = pud.modeWant, pud.modeGiven
+	}
+	if err := modeWant.ApplyMutation(dacs.Want); err != nil {
 		log.Printf("proxy topic[%s]: could not process acs change - want: %+v", t.name, err)
 		return
 	}
-	if err := pud.modeGiven.ApplyMutation(dacs.Given); err != nil {
+	if err := modeGiven.ApplyMutation(dacs.Given); err != nil {
 		log.Printf("proxy topic[%s]: could not process acs change - given: %+v", t.name, err)
 		return
 	}
 	// Update existing or add new.
-	t.perUser[uid] = pud
+	if !ok {
+		pud = &perUserData{}
+		t.perUser[uid] = pud
+	}
+	pud.modeWant, pud.modeGiven = modeWant, modeGiven
 }
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/tinode/chat/server/store/types"
+)
+
+// newBenchTopic creates a proxy group topic with the given number of subscribers, one session each.
+// Proxy topics don't touch the database. Sessions are marked as terminating so that messages are
+// not serialized: the benchmarks measure the overhead of the topic itself.
+func newBenchTopic(subscribers int) (*Topic, []types.Uid) {
+	t := &Topic{
+		name:      "grpBenchmark",
+		xoriginal: "grpBenchmark",
+		cat:       types.TopicCatGrp,
+		isProxy:   true,
+		perUser:   make(map[types.Uid]*perUserData, subscribers),
+		sessions:  make(map[*Session]perSessionData, subscribers),
+	}
+
+	var uids []types.Uid
+	for i := 0; i < subscribers; i++ {
+		uid := types.Uid(i + 1)
+		uids = append(uids, uid)
+		t.perUser[uid] = &perUserData{
+			online:    1,
+			modeWant:  types.ModeCPublic,
+			modeGiven: types.ModeCPublic}
+		t.sessions[&Session{sid: strconv.Itoa(i), terminating: 1}] = perSessionData{uid: uid}
+	}
+
+	return t, uids
+}
+
+func BenchmarkBroadcastData16(b *testing.B)   { benchmarkBroadcastData(b, 16) }
+func BenchmarkBroadcastData1024(b *testing.B) { benchmarkBroadcastData(b, 1024) }
+
+func benchmarkBroadcastData(b *testing.B, subscribers int) {
+	t, uids := newBenchTopic(subscribers)
+	now := time.Now()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		from := uids[i%len(uids)].UserId()
+		t.handleBroadcast(&ServerComMessage{
+			Data: &MsgServerData{
+				Topic:     t.xoriginal,
+				From:      from,
+				SeqId:     i + 1,
+				Timestamp: now,
+				Content:   "hello"},
+			AsUser:    from,
+			RcptTo:    t.name,
+			Timestamp: now})
+	}
+}
+
+func BenchmarkBroadcastRead16(b *testing.B)   { benchmarkBroadcastRead(b, 16) }
+func BenchmarkBroadcastRead1024(b *testing.B) { benchmarkBroadcastRead(b, 1024) }
+
+func benchmarkBroadcastRead(b *testing.B, subscribers int) {
+	t, uids := newBenchTopic(subscribers)
+	t.lastID = b.N
+	now := time.Now()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		from := uids[i%len(uids)].UserId()
+		t.handleBroadcast(&ServerComMessage{
+			Info: &MsgServerInfo{
+				Topic: t.xoriginal,
+				From:  from,
+				What:  "read",
+				SeqId: i + 1},
+			AsUser:    from,
+			RcptTo:    t.name,
+			Timestamp: now})
+	}
+}
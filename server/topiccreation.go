@@ -0,0 +1,401 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *    Limits on creation of group topics: the number of topics a user or an
+ *    organization may create in a period and an optional approval of new
+ *    topics by a root user or by the approval webhook.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/tinode/chat/server/auth"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+const (
+	// Default period of the creation limits, seconds.
+	topicCreationDefaultPeriod = 3600
+	// Timeout of a request to the approval webhook.
+	topicCreationHookTimeout = 10 * time.Second
+	// How long the pending state of a topic is trusted before it's checked again:
+	// the topic may be approved at another cluster node.
+	topicCreationPendingTTL = time.Minute
+	// Maximum number of pending topics returned to the administrator at once.
+	topicCreationMaxPending = 100
+)
+
+// topicCreationConfig is the configuration of limits on creation of group topics.
+type topicCreationConfig struct {
+	// Maximum number of topics one user may create in the period, 0 for no limit.
+	UserLimit int `json:"user_limit"`
+	// Maximum number of topics all users of one organization may create in the period, 0 for no limit.
+	OrgLimit int `json:"org_limit"`
+	// Period of the limits, seconds.
+	Period int `json:"period"`
+	// New topics must be approved.
+	Approval bool `json:"approval"`
+	// Organizations where topics must be approved. All organizations if empty.
+	Orgs []string `json:"orgs"`
+	// Optional webhook which decides on new topics.
+	Webhook *struct {
+		Url string `json:"url"`
+		// Secret for signing requests.
+		Secret string `json:"secret"`
+	} `json:"webhook"`
+}
+
+// topicCreationHookRequest is the body of a request to the approval webhook.
+type topicCreationHookRequest struct {
+	Event string `json:"event"`
+	// New topic.
+	Topic string `json:"topic"`
+	// Creator of the topic.
+	Owner string `json:"owner"`
+	// Organization of the creator, if known.
+	Org    string      `json:"org,omitempty"`
+	Public interface{} `json:"public,omitempty"`
+	// Time when the topic was created.
+	Timestamp time.Time `json:"ts"`
+}
+
+// topicCreationHookResponse is the decision of the approval webhook. The topic remains pending
+// for manual review if the decision is missing.
+type topicCreationHookResponse struct {
+	Approve *bool `json:"approve"`
+}
+
+var topicCreation struct {
+	userLimit int
+	orgLimit  int
+	period    time.Duration
+
+	approval bool
+	orgs     map[string]bool
+
+	hookUrl    string
+	hookSecret string
+	hookClient *http.Client
+
+	lock sync.Mutex
+	// Times when topics were created recently, user ID or "org:" + organization -> times, oldest first.
+	recent map[string][]time.Time
+	// Time when expired entries were last removed from recent.
+	sweptAt time.Time
+}
+
+type topicCreationCached struct {
+	loadedAt time.Time
+}
+
+// Topics known to be pending approval at this node, topic name -> *topicCreationCached.
+var topicCreationPending sync.Map
+
+// topicCreationInit configures limits on creation of group topics.
+func topicCreationInit(jsconf json.RawMessage) error {
+	if len(jsconf) == 0 {
+		return nil
+	}
+
+	var config topicCreationConfig
+	if err := json.Unmarshal(jsconf, &config); err != nil {
+		return errors.New("failed to parse config: " + err.Error())
+	}
+	if config.UserLimit < 0 || config.OrgLimit < 0 || config.Period < 0 {
+		return errors.New("invalid limits")
+	}
+
+	if config.UserLimit > 0 || config.OrgLimit > 0 {
+		topicCreation.userLimit = config.UserLimit
+		topicCreation.orgLimit = config.OrgLimit
+		if config.Period == 0 {
+			config.Period = topicCreationDefaultPeriod
+		}
+		topicCreation.period = time.Duration(config.Period) * time.Second
+		topicCreation.recent = make(map[string][]time.Time)
+	}
+
+	if !config.Approval {
+		return nil
+	}
+
+	topicCreation.approval = true
+	if len(config.Orgs) > 0 {
+		topicCreation.orgs = make(map[string]bool, len(config.Orgs))
+		for _, org := range config.Orgs {
+			topicCreation.orgs[org] = true
+		}
+	}
+	if config.Webhook != nil && config.Webhook.Url != "" {
+		topicCreation.hookUrl = config.Webhook.Url
+		topicCreation.hookSecret = config.Webhook.Secret
+		topicCreation.hookClient = &http.Client{Timeout: topicCreationHookTimeout}
+	}
+
+	return nil
+}
+
+// topicCreationAllow checks if the user may create one more topic and counts the topic if so.
+// Topics are counted at the node where they are created, the limits apply to each node separately.
+// Returns 0 if the topic may be created, otherwise the time until the user may try again.
+func topicCreationAllow(uid types.Uid, org string) time.Duration {
+	if topicCreation.recent == nil {
+		// No limits.
+		return 0
+	}
+
+	now := time.Now()
+	since := now.Add(-topicCreation.period)
+
+	topicCreation.lock.Lock()
+	defer topicCreation.lock.Unlock()
+
+	if now.Sub(topicCreation.sweptAt) > topicCreation.period {
+		// Forget users and organizations which have not created topics recently.
+		for key := range topicCreation.recent {
+			topicCreationRecent(key, since)
+		}
+		topicCreation.sweptAt = now
+	}
+
+	userKey := uid.UserId()
+	if topicCreation.userLimit > 0 {
+		if recent := topicCreationRecent(userKey, since); len(recent) >= topicCreation.userLimit {
+			// The oldest counted topic goes out of the period first.
+			return recent[0].Sub(since)
+		}
+	}
+	var orgKey string
+	if topicCreation.orgLimit > 0 && org != "" {
+		orgKey = "org:" + org
+		if recent := topicCreationRecent(orgKey, since); len(recent) >= topicCreation.orgLimit {
+			return recent[0].Sub(since)
+		}
+	}
+
+	topicCreation.recent[userKey] = append(topicCreation.recent[userKey], now)
+	if orgKey != "" {
+		topicCreation.recent[orgKey] = append(topicCreation.recent[orgKey], now)
+	}
+	return 0
+}
+
+// topicCreationRecent drops creation times older than since and returns the rest.
+// Must be called with the lock held.
+func topicCreationRecent(key string, since time.Time) []time.Time {
+	times := topicCreation.recent[key]
+	i := 0
+	for i < len(times) && !times[i].After(since) {
+		i++
+	}
+	if i == len(times) {
+		delete(topicCreation.recent, key)
+		return nil
+	}
+	if i > 0 {
+		times = times[i:]
+		topicCreation.recent[key] = times
+	}
+	return times
+}
+
+// topicCreationNeedsApproval checks if new topics created by users of the organization must be approved.
+func topicCreationNeedsApproval(org string) bool {
+	return topicCreation.approval && (topicCreation.orgs == nil || topicCreation.orgs[org])
+}
+
+// topicCreationSetPending records the state of the topic which has just been loaded.
+func topicCreationSetPending(name string, pending bool) {
+	if pending {
+		topicCreationPending.Store(name, &topicCreationCached{loadedAt: time.Now()})
+	} else {
+		topicCreationPending.Delete(name)
+	}
+}
+
+// topicCreationIsPending checks if the topic is still waiting for approval.
+func topicCreationIsPending(name string) bool {
+	val, ok := topicCreationPending.Load(name)
+	if !ok {
+		return false
+	}
+	if time.Since(val.(*topicCreationCached).loadedAt) < topicCreationPendingTTL {
+		return true
+	}
+
+	// The topic may have been approved at another node.
+	stopic, err := store.Topics.Get(name)
+	if err != nil {
+		log.Println("topic creation: failed to get topic state", name, err)
+		return true
+	}
+	// Declined topics are deleted: they remain blocked until unloaded.
+	pending := stopic == nil || stopic.State == types.StatePending
+	topicCreationSetPending(name, pending)
+	return pending
+}
+
+// topicCreationHold keeps the new topic, already saved as pending, on hold until approved and
+// asks the webhook, if configured, to decide on it.
+func topicCreationHold(stopic *types.Topic, org string) {
+	topicCreationSetPending(stopic.Id, true)
+
+	if topicCreation.hookUrl != "" {
+		go topicCreationAskHook(stopic.Id, stopic.Owner, org, stopic.Public)
+	}
+}
+
+// topicCreationAskHook sends the new topic to the approval webhook and applies the decision.
+func topicCreationAskHook(name, owner, org string, public interface{}) {
+	body, err := json.Marshal(&topicCreationHookRequest{
+		Event:     "topic",
+		Topic:     name,
+		Owner:     types.ParseUid(owner).UserId(),
+		Org:       org,
+		Public:    public,
+		Timestamp: types.TimeNow()})
+	if err != nil {
+		log.Println("topic creation: failed to serialize request", name, err)
+		return
+	}
+
+	req, err := http.NewRequest(http.MethodPost, topicCreation.hookUrl, bytes.NewReader(body))
+	if err != nil {
+		log.Println("topic creation: invalid webhook request", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Tinode/"+currentVersion)
+	req.Header.Set("X-Tinode-Event", "topic")
+	if topicCreation.hookSecret != "" {
+		req.Header.Set("X-Tinode-Signature", hookSignature(topicCreation.hookSecret, body))
+	}
+
+	resp, err := topicCreation.hookClient.Do(req)
+	if err != nil {
+		log.Println("topic creation: webhook failed, topic left for review", name, err)
+		return
+	}
+	defer resp.Body.Close()
+
+	var decision topicCreationHookResponse
+	if resp.StatusCode >= 300 || json.NewDecoder(resp.Body).Decode(&decision) != nil || decision.Approve == nil {
+		// No decision: the topic is reviewed by an administrator.
+		return
+	}
+
+	if *decision.Approve {
+		err = topicCreationApprove(name)
+	} else {
+		err = topicCreationDecline(name)
+	}
+	if err != nil {
+		log.Println("topic creation: failed to apply webhook decision", name, *decision.Approve, err)
+	}
+}
+
+// topicCreationApprove activates the pending topic.
+func topicCreationApprove(name string) error {
+	now := types.TimeNow()
+	if err := store.Topics.Update(name, map[string]interface{}{"State": types.StateOK, "StateAt": now}); err != nil {
+		return err
+	}
+	topicCreationSetPending(name, false)
+	return nil
+}
+
+// topicCreationDecline deletes the pending topic.
+func topicCreationDecline(name string) error {
+	if err := store.Topics.Delete(name, true); err != nil {
+		return err
+	}
+	if !globals.cluster.isRemoteTopic(name) {
+		// Unload the topic if it's loaded, the owner's sessions are detached.
+		globals.hub.shardFor(name).unreg <- &topicUnreg{rcptTo: name}
+		topicCreationPending.Delete(name)
+	}
+	return nil
+}
+
+// replyGetReview returns new group topics waiting for approval, 'sys' topic only, root only.
+func (t *Topic) replyGetReview(sess *Session, asUid types.Uid, authLevel auth.Level, msg *ClientComMessage) error {
+	now := types.TimeNow()
+
+	if t.cat != types.TopicCatSys || authLevel != auth.LevelRoot {
+		sess.queueOut(ErrPermissionDeniedReply(msg, now))
+		return errors.New("get.review: root access required")
+	}
+
+	topics, err := store.Topics.GetByState(types.StatePending, topicCreationMaxPending)
+	if err != nil {
+		sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, t.original(asUid), now, msg.Timestamp, nil))
+		return err
+	}
+	if len(topics) == 0 {
+		sess.queueOut(NoContentParamsReply(msg, now, map[string]string{"what": "review"}))
+		return nil
+	}
+
+	pending := make([]MsgPendingTopic, 0, len(topics))
+	for i := range topics {
+		topic := &topics[i]
+		createdAt := topic.CreatedAt
+		pending = append(pending, MsgPendingTopic{
+			Topic:     topic.Id,
+			Owner:     types.ParseUid(topic.Owner).UserId(),
+			CreatedAt: &createdAt,
+			Public:    topic.Public,
+		})
+	}
+
+	sess.queueOut(&ServerComMessage{
+		Meta: &MsgServerMeta{Id: msg.Id, Topic: t.original(asUid), Timestamp: &now, Review: pending}})
+
+	return nil
+}
+
+// replySetReview approves or declines the new group topic, 'sys' topic only, root only.
+func (t *Topic) replySetReview(sess *Session, asUid types.Uid, authLevel auth.Level, msg *ClientComMessage) error {
+	now := types.TimeNow()
+
+	if t.cat != types.TopicCatSys || authLevel != auth.LevelRoot {
+		sess.queueOut(ErrPermissionDeniedReply(msg, now))
+		return errors.New("set.review: root access required")
+	}
+
+	req := msg.Set.Review
+	if topicCat(req.Topic) != types.TopicCatGrp {
+		sess.queueOut(ErrMalformedReply(msg, now))
+		return errors.New("set.review: invalid topic")
+	}
+
+	stopic, err := store.Topics.Get(req.Topic)
+	if err == nil && (stopic == nil || stopic.State != types.StatePending) {
+		err = types.ErrNotFound
+	}
+	if err == nil {
+		if req.Approve {
+			err = topicCreationApprove(req.Topic)
+		} else {
+			err = topicCreationDecline(req.Topic)
+		}
+	}
+	if err != nil {
+		sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, t.original(asUid), now, msg.Timestamp, nil))
+		return err
+	}
+
+	sess.queueOut(NoErrReply(msg, now))
+	return nil
+}
@@ -0,0 +1,258 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *    Engagement counters of group topics: daily and hourly counters and
+ *    running totals, maintained by the topic as messages are published and
+ *    members join and leave.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/tinode/chat/server/auth"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+const (
+	// Number of days the counters are kept for.
+	topicStatsDays = 30
+	// Number of hours the hourly counters are kept for.
+	topicStatsHours = 24
+	// Minimum interval between saving the counters to the database.
+	topicStatsSaveInterval = 5 * time.Minute
+)
+
+// statsToday returns the counters for the day of the given time, adding a new day if needed.
+func (t *Topic) statsToday(now time.Time) *types.TopicDayStats {
+	day := now.UTC().Format("2006-01-02")
+	if n := len(t.stats.Days); n > 0 && t.stats.Days[n-1].Day == day {
+		return &t.stats.Days[n-1]
+	}
+
+	t.stats.Days = append(t.stats.Days, types.TopicDayStats{Day: day})
+	if len(t.stats.Days) > topicStatsDays {
+		t.stats.Days = t.stats.Days[len(t.stats.Days)-topicStatsDays:]
+	}
+	t.stats.Posters = nil
+	return &t.stats.Days[len(t.stats.Days)-1]
+}
+
+// statsHour returns the counters for the hour of the given time, adding a new hour if needed.
+func (t *Topic) statsHour(now time.Time) *types.TopicHourStats {
+	hour := now.UTC().Format("2006-01-02T15")
+	if n := len(t.stats.Hours); n > 0 && t.stats.Hours[n-1].Hour == hour {
+		return &t.stats.Hours[n-1]
+	}
+
+	t.stats.Hours = append(t.stats.Hours, types.TopicHourStats{Hour: hour})
+	if len(t.stats.Hours) > topicStatsHours {
+		t.stats.Hours = t.stats.Hours[len(t.stats.Hours)-topicStatsHours:]
+	}
+	return &t.stats.Hours[len(t.stats.Hours)-1]
+}
+
+// statsMessage counts a message published by the user.
+func (t *Topic) statsMessage(from types.Uid, data *MsgServerData) {
+	if t.cat != types.TopicCatGrp || t.isProxy {
+		return
+	}
+
+	now := data.Timestamp
+	today := t.statsToday(now)
+	today.Messages++
+	t.statsHour(now).Messages++
+
+	t.stats.Messages++
+	if content, err := json.Marshal(data.Content); err == nil {
+		t.stats.Bytes += int64(len(content))
+	}
+
+	if consent := consentGet(from); !consent.AllowsAnalytics() {
+		// The message is counted but the poster is not tracked.
+		t.statsChanged(now)
+		return
+	}
+
+	poster := from.UserId()
+	known := false
+	for _, uid := range t.stats.Posters {
+		if uid == poster {
+			known = true
+			break
+		}
+	}
+	if !known {
+		t.stats.Posters = append(t.stats.Posters, poster)
+		today.Posters++
+	}
+
+	t.statsChanged(now)
+}
+
+// statsMember counts a user joining or leaving the topic.
+func (t *Topic) statsMember(joined bool) {
+	if t.cat != types.TopicCatGrp || t.isProxy {
+		return
+	}
+
+	now := types.TimeNow()
+	today := t.statsToday(now)
+	hour := t.statsHour(now)
+	if joined {
+		today.Joins++
+		hour.Joins++
+	} else {
+		today.Leaves++
+		hour.Leaves++
+	}
+
+	t.statsChanged(now)
+}
+
+// statsChanged saves the counters if they were not saved for a while.
+func (t *Topic) statsChanged(now time.Time) {
+	t.statsDirty = true
+	if t.statsSaved.IsZero() {
+		t.statsSaved = now
+	} else if now.Sub(t.statsSaved) >= topicStatsSaveInterval {
+		t.statsSave()
+	}
+}
+
+// statsSave writes the counters to the database if they have changed.
+func (t *Topic) statsSave() {
+	if !t.statsDirty {
+		return
+	}
+
+	t.stats.Members, _ = t.statsMembers()
+
+	// Counters are not a change to the topic, keep the update time.
+	if err := store.Topics.Update(t.name, map[string]interface{}{
+		"Stats": t.stats, "UpdatedAt": t.updated}); err != nil {
+		log.Printf("topic[%s]: failed to save stats: %v", t.name, err)
+		return
+	}
+	t.statsDirty = false
+	t.statsSaved = types.TimeNow()
+}
+
+// statsMembers counts the subscribers with the J permission and those of them attached to the topic.
+func (t *Topic) statsMembers() (members, online int) {
+	for _, pud := range t.perUser {
+		if pud.deleted || !(pud.modeGiven & pud.modeWant).IsJoiner() {
+			continue
+		}
+		members++
+		if pud.online > 0 {
+			online++
+		}
+	}
+	return members, online
+}
+
+// statsTotals converts the running totals and the hourly counters of the last 24 hours.
+func statsTotals(stats *types.TopicStats, now time.Time) *MsgTopicStats {
+	totals := &MsgTopicStats{
+		Messages: stats.Messages,
+		Bytes:    stats.Bytes,
+		Members:  stats.Members,
+	}
+	// Hours are ordered, compare them as strings.
+	since := now.Add(-(topicStatsHours - 1) * time.Hour).UTC().Format("2006-01-02T15")
+	for i := range stats.Hours {
+		hour := &stats.Hours[i]
+		if hour.Hour < since {
+			continue
+		}
+		totals.Hours = append(totals.Hours, MsgHourStats{Hour: hour.Hour, Messages: hour.Messages,
+			Joins: hour.Joins, Leaves: hour.Leaves})
+	}
+	return totals
+}
+
+// replyGetStats returns engagement counters of a group topic, owner only. In the 'sys' topic root users
+// get the counters of any group topic as last saved to the database.
+func (t *Topic) replyGetStats(sess *Session, asUid types.Uid, authLevel auth.Level, req *MsgGetOpts, msg *ClientComMessage) error {
+	now := types.TimeNow()
+
+	if t.cat == types.TopicCatSys {
+		return t.replyGetStatsAdmin(sess, asUid, authLevel, req, msg)
+	}
+	if t.cat != types.TopicCatGrp {
+		sess.queueOut(ErrOperationNotAllowedReply(msg, now))
+		return errors.New("get.stats: invalid topic category")
+	}
+	if !t.isOwner(asUid) {
+		sess.queueOut(ErrPermissionDeniedReply(msg, now))
+		return errors.New("get.stats: request by non-owner")
+	}
+
+	totals := statsTotals(&t.stats, now)
+	totals.Members, totals.Online = t.statsMembers()
+
+	sess.queueOut(&ServerComMessage{
+		Meta: &MsgServerMeta{Id: msg.Id, Topic: t.original(asUid), Timestamp: &now,
+			Stats: statsDays(&t.stats), Totals: totals}})
+
+	return nil
+}
+
+// replyGetStatsAdmin returns the saved counters of the group topic, 'sys' topic only, root only.
+func (t *Topic) replyGetStatsAdmin(sess *Session, asUid types.Uid, authLevel auth.Level, req *MsgGetOpts, msg *ClientComMessage) error {
+	now := types.TimeNow()
+
+	if authLevel != auth.LevelRoot {
+		sess.queueOut(ErrPermissionDeniedReply(msg, now))
+		return errors.New("get.stats: root access required")
+	}
+	var name string
+	if req != nil {
+		name = types.ChnToGrp(req.Topic)
+	}
+	if len(name) <= 3 {
+		sess.queueOut(ErrMalformedReply(msg, now))
+		return errors.New("get.stats: invalid topic")
+	}
+
+	stopic, err := store.Topics.Get(name)
+	if err != nil {
+		sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, t.original(asUid), now, msg.Timestamp, nil))
+		return err
+	}
+	if stopic == nil {
+		sess.queueOut(ErrNotFoundReply(msg, now))
+		return types.ErrTopicNotFound
+	}
+
+	totals := statsTotals(&stopic.Stats, now)
+	totals.Topic = req.Topic
+
+	sess.queueOut(&ServerComMessage{
+		Meta: &MsgServerMeta{Id: msg.Id, Topic: t.original(asUid), Timestamp: &now,
+			Stats: statsDays(&stopic.Stats), Totals: totals}})
+
+	return nil
+}
+
+// statsDays converts the daily counters.
+func statsDays(stats *types.TopicStats) []MsgDayStats {
+	if len(stats.Days) == 0 {
+		return nil
+	}
+	days := make([]MsgDayStats, len(stats.Days))
+	for i := range stats.Days {
+		day := &stats.Days[i]
+		days[i] = MsgDayStats{Day: day.Day, Messages: day.Messages, Posters: day.Posters,
+			Joins: day.Joins, Leaves: day.Leaves}
+	}
+	return days
+}
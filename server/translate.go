@@ -0,0 +1,424 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *    Translation of messages by an external translation service: on demand
+ *    and automatically for users who asked for it.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/tinode/chat/server/drafty"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+const (
+	// Default timeout of a request to the translation service.
+	translateDefaultTimeout = 5 * time.Second
+	// Maximum number of concurrent requests to the translation service.
+	translateMaxConcurrent = 8
+	// Maximum number of translations kept in memory.
+	translateCacheSize = 4096
+	// Maximum length of text sent for translation, bytes.
+	translateMaxText = 4096
+	// Message header with translations of the message content, language -> text.
+	translateHeader = "trans"
+)
+
+// Language codes like "en", "pt-BR", "zh-Hans".
+var translateLangRegexp = regexp.MustCompile(`^[a-z]{2,3}(-[A-Za-z]{2,4})?$`)
+
+// translateConfig is the configuration of the translation service.
+type translateConfig struct {
+	// Enable translation.
+	Enabled bool `json:"enabled"`
+	// URL of the LibreTranslate-compatible endpoint, e.g. http://localhost:5000/translate
+	Url string `json:"url"`
+	// API key passed to the service, optional.
+	ApiKey string `json:"api_key"`
+	// Request timeout in seconds.
+	Timeout int `json:"timeout"`
+	// Languages users may ask for. Any language is accepted if empty.
+	Languages []string `json:"languages"`
+}
+
+// translateRequest is the body of a request to the translation service.
+type translateRequest struct {
+	Q      string `json:"q"`
+	Source string `json:"source"`
+	Target string `json:"target"`
+	Format string `json:"format"`
+	ApiKey string `json:"api_key,omitempty"`
+}
+
+// translateResponse is the body of a response of the translation service.
+type translateResponse struct {
+	TranslatedText string `json:"translatedText"`
+	Error          string `json:"error,omitempty"`
+}
+
+var translator struct {
+	url       string
+	apiKey    string
+	languages map[string]bool
+	client    *http.Client
+	// Limits concurrent requests to the service.
+	slots chan struct{}
+
+	// Translations of messages, "topic/seq/lang" -> text.
+	cacheLock sync.Mutex
+	cache     map[string]string
+	// Keys of the cached translations, oldest first.
+	cacheKeys []string
+}
+
+// Auto-translation languages of users, types.Uid -> string.
+var autoTranslateLangs sync.Map
+
+// translateInit configures the translation service.
+func translateInit(jsconf json.RawMessage) error {
+	if len(jsconf) == 0 {
+		return nil
+	}
+
+	var config translateConfig
+	if err := json.Unmarshal(jsconf, &config); err != nil {
+		return errors.New("failed to parse config: " + err.Error())
+	}
+	if !config.Enabled {
+		return nil
+	}
+	if config.Url == "" {
+		return errors.New("missing translation service url")
+	}
+
+	timeout := translateDefaultTimeout
+	if config.Timeout > 0 {
+		timeout = time.Duration(config.Timeout) * time.Second
+	}
+
+	translator.url = config.Url
+	translator.apiKey = config.ApiKey
+	translator.client = &http.Client{Timeout: timeout}
+	translator.slots = make(chan struct{}, translateMaxConcurrent)
+	translator.cache = make(map[string]string)
+	if len(config.Languages) > 0 {
+		translator.languages = make(map[string]bool, len(config.Languages))
+		for _, lang := range config.Languages {
+			translator.languages[lang] = true
+		}
+	}
+	return nil
+}
+
+// translateEnabled checks if the translation service is configured.
+func translateEnabled() bool {
+	return translator.client != nil
+}
+
+// translateLangValid checks if the language can be requested by users.
+func translateLangValid(lang string) bool {
+	if translator.languages != nil {
+		return translator.languages[lang]
+	}
+	return translateLangRegexp.MatchString(lang)
+}
+
+// translateText sends the text to the translation service.
+func translateText(text, lang string) (string, error) {
+	body, err := json.Marshal(&translateRequest{Q: text, Source: "auto", Target: lang, Format: "text",
+		ApiKey: translator.apiKey})
+	if err != nil {
+		return "", err
+	}
+
+	translator.slots <- struct{}{}
+	defer func() { <-translator.slots }()
+
+	resp, err := translator.client.Post(translator.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var result translateResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.New("translation service: " + resp.Status + " " + result.Error)
+	}
+	return result.TranslatedText, nil
+}
+
+// translateMessage translates the content of the message using the cache.
+func translateMessage(topic string, data *MsgServerData, lang string) (string, error) {
+	key := topic + "/" + strconv.Itoa(data.SeqId) + "/" + lang
+	if edited, ok := data.Head[msgEditedHeader].(string); ok {
+		// Edited messages are translated again.
+		key += "/" + edited
+	}
+
+	translator.cacheLock.Lock()
+	text, ok := translator.cache[key]
+	translator.cacheLock.Unlock()
+	if ok {
+		return text, nil
+	}
+
+	plain, err := drafty.ToPlainText(data.Content)
+	if err != nil {
+		return "", err
+	}
+	if plain == "" {
+		return "", nil
+	}
+	if len(plain) > translateMaxText {
+		return "", types.ErrPolicy
+	}
+
+	if text, err = translateText(plain, lang); err != nil {
+		return "", err
+	}
+
+	translator.cacheLock.Lock()
+	if _, ok := translator.cache[key]; !ok {
+		if len(translator.cacheKeys) >= translateCacheSize {
+			delete(translator.cache, translator.cacheKeys[0])
+			translator.cacheKeys = translator.cacheKeys[1:]
+		}
+		translator.cache[key] = text
+		translator.cacheKeys = append(translator.cacheKeys, key)
+	}
+	translator.cacheLock.Unlock()
+
+	return text, nil
+}
+
+// translatedCopy creates a copy of the message with the translation attached to the head.
+func translatedCopy(data *MsgServerData, lang, text string) *ServerComMessage {
+	head := make(map[string]interface{}, len(data.Head)+1)
+	for key, val := range data.Head {
+		head[key] = val
+	}
+	head[translateHeader] = map[string]string{lang: text}
+
+	dst := *data
+	dst.Head = head
+	dst.pbCache = nil
+	return &ServerComMessage{Data: &dst}
+}
+
+// autoTranslateSet replaces the cached auto-translation language of the user.
+func autoTranslateSet(uid types.Uid, lang string) {
+	if lang == "" {
+		autoTranslateLangs.Delete(uid)
+	} else {
+		autoTranslateLangs.Store(uid, lang)
+	}
+}
+
+// autoTranslateGet returns the auto-translation language of the user if the user is online.
+func autoTranslateGet(uid types.Uid) string {
+	if val, ok := autoTranslateLangs.Load(uid); ok {
+		return val.(string)
+	}
+	return ""
+}
+
+// translateFanout collects sessions which receive a message and want it translated.
+type translateFanout struct {
+	topic string
+	from  string
+	// Copies of the message as sent to each session, grouped by language.
+	pending map[string][]translatePending
+}
+
+type translatePending struct {
+	sess *Session
+	data MsgServerData
+}
+
+// newTranslateFanout creates a collector for the message if it can be auto-translated.
+func newTranslateFanout(topic string, msg *ServerComMessage) *translateFanout {
+	if !translateEnabled() || msg.Data == nil || isSysEvent(msg.Data) {
+		return nil
+	}
+	if _, ok := msg.Data.Head[translateHeader]; ok {
+		return nil
+	}
+	return &translateFanout{topic: topic, from: msg.Data.From}
+}
+
+// add records the session if its user wants messages translated. Senders don't get their own
+// messages translated.
+func (tf *translateFanout) add(sess *Session, uid types.Uid, data *MsgServerData) {
+	if tf == nil || uid.IsZero() || uid.UserId() == tf.from {
+		return
+	}
+	lang := autoTranslateGet(uid)
+	if lang == "" {
+		return
+	}
+	if tf.pending == nil {
+		tf.pending = make(map[string][]translatePending)
+	}
+	tf.pending[lang] = append(tf.pending[lang], translatePending{sess: sess, data: *data})
+}
+
+// run translates the message to the collected languages and sends the translated copies
+// to the sessions.
+func (tf *translateFanout) run() {
+	if tf == nil || len(tf.pending) == 0 {
+		return
+	}
+
+	go func() {
+		for lang, sessions := range tf.pending {
+			text, err := translateMessage(tf.topic, &sessions[0].data, lang)
+			if err != nil {
+				log.Printf("topic[%s]: failed to translate message to '%s': %v", tf.topic, lang, err)
+				continue
+			}
+			if text == "" {
+				continue
+			}
+			// Sessions receive the same translated copy, it's converted for gRPC once.
+			cache := newPbDataCache()
+			for i := range sessions {
+				out := translatedCopy(&sessions[i].data, lang, text)
+				out.Data.pbCache = cache
+				sessions[i].sess.queueOut(out)
+			}
+		}
+	}()
+}
+
+// replyGetTranslate translates a message on request of a reader. In 'me' it returns the language
+// of automatic translation instead.
+func (t *Topic) replyGetTranslate(sess *Session, asUid types.Uid, req *MsgGetTranslate, msg *ClientComMessage) error {
+	now := types.TimeNow()
+
+	if !translateEnabled() {
+		sess.queueOut(ErrOperationNotAllowedReply(msg, now))
+		return errors.New("get.translate: translation is disabled")
+	}
+
+	if t.cat == types.TopicCatMe {
+		if t.autoTranslate == "" {
+			sess.queueOut(NoContentParamsReply(msg, now, map[string]string{"what": "translate"}))
+			return nil
+		}
+		sess.queueOut(&ServerComMessage{
+			Meta: &MsgServerMeta{Id: msg.Id, Topic: t.original(asUid), Timestamp: &now,
+				Translate: &MsgTranslate{Lang: t.autoTranslate}}})
+		return nil
+	}
+
+	if t.cat != types.TopicCatGrp && t.cat != types.TopicCatP2P {
+		sess.queueOut(ErrOperationNotAllowedReply(msg, now))
+		return errors.New("get.translate: invalid topic category")
+	}
+	if req == nil || req.Seq <= 0 || req.Seq > t.lastID || !translateLangValid(req.Lang) {
+		sess.queueOut(ErrMalformedReply(msg, now))
+		return errors.New("get.translate: invalid message ID or language")
+	}
+
+	asChan, err := t.verifyChannelAccess(msg.Original)
+	if err != nil {
+		// User should not be able to address non-channel topic as channel.
+		sess.queueOut(ErrNotFoundReply(msg, now))
+		return types.ErrNotFound
+	}
+	if userData, ok := t.perUser[asUid]; !asChan && (!ok || !(userData.modeGiven & userData.modeWant).IsReader()) {
+		sess.queueOut(ErrPermissionDeniedReply(msg, now))
+		return errors.New("get.translate: request by non-reader")
+	}
+
+	opts := &types.QueryOpt{Since: req.Seq, Before: req.Seq + 1, Limit: 1}
+	var messages []types.Message
+	var cached bool
+	if t.recent != nil {
+		messages, cached = t.recent.get(asUid, opts)
+	}
+	if !cached {
+		if messages, err = store.Messages.GetAll(t.name, asUid, opts); err != nil {
+			sess.queueOut(ErrUnknownReply(msg, now))
+			return err
+		}
+	}
+	if len(messages) == 0 {
+		sess.queueOut(ErrNotFoundReply(msg, now))
+		return nil
+	}
+
+	// The translation is made from the text the user can see.
+	mask := t.maskingRuleFor(msg.OrganizationId, asUid, asChan)
+	data := storedDataMessage(&messages[0], t.original(asUid), asChan, mask, asUid).Data
+
+	// The translation service may be slow, don't block the topic.
+	go func() {
+		text, err := translateMessage(t.name, data, req.Lang)
+		if err != nil {
+			log.Printf("topic[%s]: failed to translate message %d to '%s': %v", t.name, req.Seq, req.Lang, err)
+			sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, msg.Original, types.TimeNow(), msg.Timestamp, nil))
+			return
+		}
+
+		params := map[string]interface{}{"what": "translate", "seq": req.Seq, "lang": req.Lang}
+		if text == "" {
+			// Nothing to translate.
+			sess.queueOut(NoContentParamsReply(msg, types.TimeNow(), params))
+			return
+		}
+		sess.queueOut(translatedCopy(data, req.Lang, text))
+		sess.queueOut(NoErrParamsReply(msg, types.TimeNow(), params))
+	}()
+
+	return nil
+}
+
+// replySetTranslate sets or clears the language of automatic translation, 'me' only.
+func (t *Topic) replySetTranslate(sess *Session, asUid types.Uid, msg *ClientComMessage) error {
+	now := types.TimeNow()
+
+	if t.cat != types.TopicCatMe || !translateEnabled() {
+		sess.queueOut(ErrOperationNotAllowedReply(msg, now))
+		return errors.New("set.translate: invalid topic category or translation is disabled")
+	}
+
+	lang := msg.Set.Translate.Lang
+	if lang != "" && !translateLangValid(lang) {
+		sess.queueOut(ErrMalformedReply(msg, now))
+		return errors.New("set.translate: invalid language")
+	}
+	if lang == t.autoTranslate {
+		sess.queueOut(InfoNotModifiedReply(msg, now))
+		return nil
+	}
+
+	if err := store.Users.Update(asUid, map[string]interface{}{"AutoTranslate": lang}); err != nil {
+		sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, t.original(asUid), now, msg.Timestamp, nil))
+		return err
+	}
+
+	t.autoTranslate = lang
+	autoTranslateSet(asUid, lang)
+
+	sess.queueOut(NoErrReply(msg, now))
+
+	return nil
+}
@@ -13,7 +13,7 @@ import (
 // Process request for a new account.
 func replyCreateUser(s *Session, msg *ClientComMessage, rec *auth.Rec) {
 	// The session cannot authenticate with the new account because  it's already authenticated.
-	if msg.Acc.Login && (!s.uid.IsZero() || rec != nil) {
+	if sessUid, _, _ := s.activeAccount(); msg.Acc.Login && (!sessUid.IsZero() || rec != nil) {
 		s.queueOut(ErrAlreadyAuthenticated(msg.Id, "", msg.Timestamp))
 		log.Println("create user: login requested while authenticated", s.sid)
 		return
@@ -58,6 +58,15 @@ func replyCreateUser(s *Session, msg *ClientComMessage, rec *auth.Rec) {
 		user.State = state
 	}
 
+	// Trusted values can be assigned by root only.
+	if msg.Acc.Desc != nil && msg.Acc.Desc.Trusted != nil && auth.Level(msg.AuthLvl) != auth.LevelRoot {
+		log.Println("create user: attempt to set trusted values by non-root", s.sid)
+		msg := ErrPermissionDenied(msg.Id, "", msg.Timestamp)
+		msg.Ctrl.Params = map[string]interface{}{"what": "trusted"}
+		s.queueOut(msg)
+		return
+	}
+
 	// Ensure tags are unique and not restricted.
 	if tags := normalizeTags(msg.Acc.Tags); tags != nil {
 		if !restrictedTagsEqual(tags, nil, globals.immutableTagNS) {
@@ -111,11 +120,22 @@ func replyCreateUser(s *Session, msg *ClientComMessage, rec *auth.Rec) {
 		if !isNullValue(msg.Acc.Desc.Public) {
 			user.Public = msg.Acc.Desc.Public
 		}
+		if !isNullValue(msg.Acc.Desc.Trusted) {
+			user.Trusted = msg.Acc.Desc.Trusted
+		}
 		if !isNullValue(msg.Acc.Desc.Private) {
 			private = msg.Acc.Desc.Private
 		}
 	}
 
+	if what, err := descSchemaCheck(types.TopicCatMe, user.Public, private, user.Trusted); err != nil {
+		log.Println("create user: invalid", what, err, s.sid)
+		msg := ErrMalformed(msg.Id, "", msg.Timestamp)
+		msg.Ctrl.Params = map[string]interface{}{"what": what, "reason": err.Error()}
+		s.queueOut(msg)
+		return
+	}
+
 	// Create user record in the database.
 	if _, err := store.Users.Create(&user, private); err != nil {
 		log.Println("create user: failed to create user", err, s.sid)
@@ -141,7 +161,7 @@ func replyCreateUser(s *Session, msg *ClientComMessage, rec *auth.Rec) {
 		store.Users.Delete(user.Uid(), false)
 		_, missing := stringSliceDelta(globals.authValidators[rec.AuthLevel], credentialMethods(creds))
 		s.queueOut(decodeStoreError(types.ErrPolicy, msg.Id, "", msg.Timestamp,
-			map[string]interface{}{"creds": missing}))
+			map[string]interface{}{"what": "creds", "creds": missing}))
 		return
 	}
 
@@ -160,6 +180,18 @@ func replyCreateUser(s *Session, msg *ClientComMessage, rec *auth.Rec) {
 		return
 	}
 
+	// Accounts not created by root may require approval.
+	if msg.Acc.State == "" && auth.Level(msg.AuthLvl) != auth.LevelRoot && registrationNeedsApproval(rec.OrganizationId) {
+		if err := registrationHold(user.Uid(), rec.OrganizationId); err != nil {
+			log.Println("create user: failed to put account on hold", err, s.sid)
+			store.Users.Delete(user.Uid(), false)
+			s.queueOut(decodeStoreError(err, msg.Id, "", msg.Timestamp, nil))
+			return
+		}
+		user.State = types.StatePending
+		rec.State = types.StatePending
+	}
+
 	var reply *ServerComMessage
 	if msg.Acc.Login {
 		// Process user's login request.
@@ -172,6 +204,9 @@ func replyCreateUser(s *Session, msg *ClientComMessage, rec *auth.Rec) {
 			"user":    user.Uid().UserId(),
 			"authlvl": rec.AuthLevel.String(),
 		}
+		if user.State == types.StatePending {
+			reply.Ctrl.Params.(map[string]interface{})["state"] = user.State.String()
+		}
 	}
 	params := reply.Ctrl.Params.(map[string]interface{})
 	params["desc"] = &MsgTopicDesc{
@@ -192,7 +227,8 @@ func replyCreateUser(s *Session, msg *ClientComMessage, rec *auth.Rec) {
 // * Authentication update, i.e. login/password change
 // * Credentials update
 func replyUpdateUser(s *Session, msg *ClientComMessage, rec *auth.Rec) {
-	if s.uid.IsZero() && rec == nil {
+	sessUid, sessLvl, _ := s.activeAccount()
+	if sessUid.IsZero() && rec == nil {
 		// Session is not authenticated and no token provided.
 		log.Println("replyUpdateUser: not a new account and not authenticated", s.sid)
 		s.queueOut(ErrPermissionDenied(msg.Id, "", msg.Timestamp))
@@ -212,7 +248,7 @@ func replyUpdateUser(s *Session, msg *ClientComMessage, rec *auth.Rec) {
 	}
 
 	if msg.Acc.User != "" && msg.Acc.User != userId {
-		if s.authLvl != auth.LevelRoot {
+		if sessLvl != auth.LevelRoot {
 			log.Println("replyUpdateUser: attempt to change another's account by non-root", s.sid)
 			s.queueOut(ErrPermissionDenied(msg.Id, "", msg.Timestamp))
 			return
@@ -230,11 +266,13 @@ func replyUpdateUser(s *Session, msg *ClientComMessage, rec *auth.Rec) {
 		return
 	}
 
-	// Only root can suspend accounts, including own account.
-	if msg.Acc.State != "" && s.authLvl != auth.LevelRoot {
-		s.queueOut(ErrPermissionDenied(msg.Id, "", msg.Timestamp))
-		log.Println("replyUpdateUser: attempt to change account state by non-root", s.sid)
-		return
+	// Only root can suspend accounts, including own account. Users can deactivate own account.
+	if msg.Acc.State != "" && sessLvl != auth.LevelRoot {
+		if state, _ := types.NewObjState(msg.Acc.State); state != types.StateDeactivated || uid != sessUid {
+			s.queueOut(ErrPermissionDenied(msg.Id, "", msg.Timestamp))
+			log.Println("replyUpdateUser: attempt to change account state by non-root", s.sid)
+			return
+		}
 	}
 
 	user, err := store.Users.Get(uid)
@@ -249,7 +287,9 @@ func replyUpdateUser(s *Session, msg *ClientComMessage, rec *auth.Rec) {
 
 	var params map[string]interface{}
 	if msg.Acc.Scheme != "" {
-		err = updateUserAuth(msg, user, rec, s.remoteAddr)
+		if err = updateUserAuth(msg, user, rec, s.remoteAddr); err == nil {
+			activityRecord(s.activityEvent(uid, activityPasswd, msg.Acc.Scheme))
+		}
 	} else if len(msg.Acc.Cred) > 0 {
 		if authLvl == auth.LevelNone {
 			// msg.Acc.AuthLevel contains invalid data.
@@ -265,6 +305,9 @@ func replyUpdateUser(s *Session, msg *ClientComMessage, rec *auth.Rec) {
 			Features:  auth.FeatureNoLogin})
 		_, _, err := addCreds(uid, msg.Acc.Cred, nil, s.lang, tmpToken)
 		if err == nil {
+			for i := range msg.Acc.Cred {
+				activityRecord(s.activityEvent(uid, activityCred, "add:"+msg.Acc.Cred[i].Method))
+			}
 			if allCreds, err := store.Users.GetAllCreds(uid, "", true); err != nil {
 				var validated []string
 				for i := range allCreds {
@@ -283,6 +326,18 @@ func replyUpdateUser(s *Session, msg *ClientComMessage, rec *auth.Rec) {
 			s.queueOut(InfoNotModified(msg.Id, "", msg.Timestamp))
 			return
 		}
+	} else if msg.Acc.Desc != nil && msg.Acc.Desc.Trusted != nil {
+		if sessLvl != auth.LevelRoot {
+			log.Println("replyUpdateUser: attempt to change trusted values by non-root", s.sid)
+			s.queueOut(ErrPermissionDenied(msg.Id, "", msg.Timestamp))
+			return
+		}
+		var changed bool
+		changed, err = updateUserTrusted(uid, user, msg.Acc.Desc.Trusted)
+		if !changed && err == nil {
+			s.queueOut(InfoNotModified(msg.Id, "", msg.Timestamp))
+			return
+		}
 	} else {
 		err = types.ErrMalformed
 	}
@@ -297,6 +352,17 @@ func replyUpdateUser(s *Session, msg *ClientComMessage, rec *auth.Rec) {
 
 	// Call plugin with the account update
 	pluginAccount(user, plgActUpd)
+
+	if msg.Acc.State != "" && user.State != types.StateOK && uid == sessUid && s.multi == nil {
+		// The user has suspended or deactivated own account, terminate the current session
+		// unless other accounts are authenticated in it.
+		if s.accountCount() > 1 {
+			s.evictAccount(uid, msg.Timestamp)
+		} else {
+			_, data := s.serialize(NoErrEvicted("", "", msg.Timestamp))
+			s.stopSession(data)
+		}
+	}
 }
 
 // Authentication update
@@ -516,12 +582,34 @@ func deleteCred(uid types.Uid, authLvl auth.Level, cred *MsgCredClient) ([]strin
 	return tags, nil
 }
 
+// updateUserTrusted merges new trusted values into the user's record and passes the result to
+// the user's loaded topics. Returns true if the values have changed.
+func updateUserTrusted(uid types.Uid, user *types.User, trusted interface{}) (bool, error) {
+	merged, changed := mergeInterfaces(user.Trusted, trusted)
+	if !changed {
+		return false, nil
+	}
+	if _, err := descSchemaCheck(types.TopicCatMe, nil, nil, merged); err != nil {
+		return false, types.ErrMalformed
+	}
+
+	if err := store.Users.Update(uid, map[string]interface{}{"Trusted": merged, "UpdatedAt": types.TimeNow()}); err != nil {
+		return false, err
+	}
+	user.Trusted = merged
+
+	globals.hub.meta <- &metaReq{forUser: uid, state: types.StateUndefined, trusted: merged}
+
+	return true, nil
+}
+
 // Change user state: suspended/normal (ok).
 // 1. Not needed -- Disable/enable logins (state checked after login).
 // 2. If suspending, evict user's sessions. Skip this step if resuming.
-// 3. Suspend/activate p2p with the user.
-// 4. Suspend/activate grp topics where the user is the owner.
-// 5. Update user's DB record.
+// 3. If deactivating, stop push notifications.
+// 4. Suspend/activate p2p with the user.
+// 5. Suspend/activate grp topics where the user is the owner.
+// 6. Update user's DB record.
 func changeUserState(s *Session, uid types.Uid, user *types.User, msg *ClientComMessage) (bool, error) {
 	state, err := types.NewObjState(msg.Acc.State)
 	if err != nil || state == types.StateUndefined {
@@ -535,14 +623,23 @@ func changeUserState(s *Session, uid types.Uid, user *types.User, msg *ClientCom
 	}
 
 	if state != types.StateOK {
-		// Terminate all sessions.
-		globals.sessionStore.EvictUser(uid, "")
+		// Terminate all sessions. The requester's session is terminated after the response is sent.
+		globals.sessionStore.EvictUser(uid, s.sid)
+	}
+
+	if state == types.StateDeactivated {
+		// Stop push notifications. The device is registered again when the user logs back in.
+		if err := store.Devices.Delete(uid, ""); err != nil {
+			log.Println("changeUserState: failed to delete devices", uid.UserId(), err, s.sid)
+		}
 	}
 
 	err = store.Users.UpdateState(uid, state)
 	if err != nil {
 		return false, err
 	}
+	// Approval of a pending account takes effect immediately at this node.
+	registrationSetPending(uid, state == types.StatePending)
 
 	// Update state of all loaded in memory user's p2p & grp-owner topics.
 	globals.hub.meta <- &metaReq{forUser: uid, state: state, sess: s}
@@ -562,10 +659,11 @@ func changeUserState(s *Session, uid types.Uid, user *types.User, msg *ClientCom
 func replyDelUser(s *Session, msg *ClientComMessage) {
 	var uid types.Uid
 
-	if msg.Del.User == "" || msg.Del.User == s.uid.UserId() {
+	sessUid, sessLvl, _ := s.activeAccount()
+	if msg.Del.User == "" || msg.Del.User == sessUid.UserId() {
 		// Delete current user.
-		uid = s.uid
-	} else if s.authLvl == auth.LevelRoot {
+		uid = sessUid
+	} else if sessLvl == auth.LevelRoot {
 		// Delete another user.
 		uid = types.ParseUserId(msg.Del.User)
 		if uid.IsZero() {
@@ -579,66 +677,147 @@ func replyDelUser(s *Session, msg *ClientComMessage) {
 		return
 	}
 
+	if err := deleteUser(uid, msg.Del.Hard, s.sid); err != nil {
+		log.Println("replyDelUser: failed to delete user", err, s.sid)
+		if err == types.ErrUnsupported {
+			// Authenticator refused to delete record: user account cannot be deleted.
+			s.queueOut(ErrOperationNotAllowed(msg.Id, "", msg.Timestamp))
+		} else {
+			s.queueOut(decodeStoreError(err, msg.Id, "", msg.Timestamp, nil))
+		}
+		return
+	}
+
+	s.queueOut(NoErr(msg.Id, "", msg.Timestamp))
+
+	if _, _, ok := s.account(uid); ok && s.multi == nil {
+		// Evict the current session if it belongs to the deleted user.
+		// No need to send it to multiplexing session: remote node will be notified separately.
+		if s.accountCount() > 1 {
+			// Other accounts authenticated in the session stay logged in.
+			s.evictAccount(uid, msg.Timestamp)
+			return
+		}
+		_, data := s.serialize(NoErrEvicted("", "", msg.Timestamp))
+		s.stopSession(data)
+	}
+}
+
+// deleteUser deletes the user account:
+// 1. Disable user's login
+// 2. Terminate all user's sessions except skipSid.
+// 3. Stop all active topics
+// 4. Notify other subscribers that topics are being deleted.
+// 5. Delete user from the database.
+func deleteUser(uid types.Uid, hard bool, skipSid string) error {
 	// Disable all authenticators
 	authnames := store.GetAuthNames()
 	for _, name := range authnames {
 		if err := store.GetAuthHandler(name).DelRecords(uid); err != nil {
 			// This could be completely benign, i.e. authenticator exists but not used.
-			log.Println("replyDelUser: failed to delete auth record", uid.UserId(), name, err, s.sid)
+			log.Println("deleteUser: failed to delete auth record", uid.UserId(), name, err)
 			if storeErr, ok := err.(types.StoreError); ok && storeErr == types.ErrUnsupported {
 				// Authenticator refused to delete record: user account cannot be deleted.
-				s.queueOut(ErrOperationNotAllowed(msg.Id, "", msg.Timestamp))
-				return
+				return types.ErrUnsupported
 			}
 		}
 	}
 
-	// Terminate all sessions. Skip the current session so the requester gets a response.
-	globals.sessionStore.EvictUser(uid, s.sid)
+	// Terminate all sessions. Skip the requester's session so it gets a response.
+	globals.sessionStore.EvictUser(uid, skipSid)
 	// Remove user from cache and announce to cluster that the user is deleted.
 	usersRemoveUser(uid)
 
+	// Pass ownership of group topics to co-owners so the topics outlive the user.
+	if passed := ownersSucceed(uid); len(passed) > 0 {
+		log.Println("deleteUser: ownership passed to co-owners", uid.UserId(), passed)
+	}
+
 	// Stop topics where the user is the owner and p2p topics.
 	done := make(chan bool)
-	globals.hub.unreg <- &topicUnreg{forUser: uid, del: msg.Del.Hard, done: done}
+	globals.hub.unreg <- &topicUnreg{forUser: uid, del: hard, done: done}
 	<-done
 
 	// Notify users of interest that the user is gone.
 	if uoi, err := store.Users.GetSubs(uid, nil); err == nil {
 		presUsersOfInterestOffline(uid, uoi, "gone")
 	} else {
-		log.Println("replyDelUser: failed to send notifications to users", err, s.sid)
+		log.Println("deleteUser: failed to send notifications to users", uid.UserId(), err)
 	}
 
 	// Notify subscribers of the group topics where the user was the owner that the topics were deleted.
 	if ownTopics, err := store.Users.GetOwnTopics(uid); err == nil {
 		for _, topicName := range ownTopics {
 			if subs, err := store.Topics.GetSubs(topicName, nil); err == nil {
-				presSubsOfflineOffline(topicName, types.TopicCatGrp, subs, "gone", &presParams{}, s.sid)
+				presSubsOfflineOffline(topicName, types.TopicCatGrp, subs, "gone", &presParams{}, skipSid)
 			} else {
-				log.Println("replyDelUser: failed to notify topic subscribers", err, topicName, s.sid)
+				log.Println("deleteUser: failed to notify topic subscribers", err, topicName)
 			}
 		}
 	} else {
-		log.Println("replyDelUser: failed to send notifications to owned topics", err, s.sid)
+		log.Println("deleteUser: failed to send notifications to owned topics", uid.UserId(), err)
 	}
 
 	// TODO: suspend all P2P topics with the user.
 
 	// Delete user's records from the database.
-	if err := store.Users.Delete(uid, msg.Del.Hard); err != nil {
-		log.Println("replyDelUser: failed to delete user", err, s.sid)
-		s.queueOut(decodeStoreError(err, msg.Id, "", msg.Timestamp, nil))
-		return
+	return store.Users.Delete(uid, hard)
+}
+
+// userReactivate restores the account deactivated by the user. Called when the user logs in
+// within the grace period.
+func userReactivate(uid types.Uid) error {
+	if err := store.Users.UpdateState(uid, types.StateOK); err != nil {
+		return err
 	}
 
-	s.queueOut(NoErr(msg.Id, "", msg.Timestamp))
+	// Activate user's p2p & grp-owner topics loaded in memory.
+	globals.hub.meta <- &metaReq{forUser: uid, state: types.StateOK}
+	return nil
+}
 
-	if s.uid == uid && s.multi == nil {
-		// Evict the current session if it belongs to the deleted user.
-		// No need to send it to multiplexing session: remote node will be notified separately.
-		_, data := s.serialize(NoErrEvicted("", "", msg.Timestamp))
-		s.stopSession(data)
+// usersRunDeactivatedGc periodically deletes accounts which remained deactivated longer than
+// the grace period. Accounts are deleted by the cluster node which owns the user.
+func usersRunDeactivatedGc(period, grace time.Duration, block int) chan<- bool {
+	// Unbuffered stop channel. Whoever stops it must wait for the process to finish.
+	stop := make(chan bool)
+	go func() {
+		gcTimer := time.Tick(period)
+		for {
+			select {
+			case <-gcTimer:
+				usersDeleteDeactivated(time.Now().Add(-grace), block)
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	return stop
+}
+
+// usersDeleteDeactivated deletes accounts deactivated before the given time, block accounts at a time.
+// Accounts which fail to be deleted are skipped until the next run.
+func usersDeleteDeactivated(before time.Time, block int) {
+	after := types.ZeroUid
+	for {
+		uids, err := store.Users.GetByState(types.StateDeactivated, before, after, block)
+		if err != nil {
+			log.Println("deactivated accounts gc:", err)
+			return
+		}
+		for _, uid := range uids {
+			if globals.cluster.isRemoteTopic(uid.UserId()) {
+				continue
+			}
+			if err := deleteUser(uid, false, ""); err != nil {
+				log.Println("deactivated accounts gc: failed to delete user", uid.UserId(), err)
+			}
+		}
+		if len(uids) < block {
+			return
+		}
+		after = uids[len(uids)-1]
 	}
 }
 
@@ -666,19 +845,24 @@ type UserCacheReq struct {
 	UserIdList []types.Uid
 	// Unread count (UserId is set)
 	Unread int
-	// In case of set UserId: treat Unread count as an increment as opposite to the final value.
+	// Count of unread mentions (UserId is set)
+	Mentions int
+	// In case of set UserId: treat Unread and Mentions counts as increments as opposite to the final values.
 	// In case of set UserIdList: intement (Inc == true) or decrement subscription count by one.
 	Inc bool
 	// User is being deleted, remove user from cache.
 	Gone bool
+	// Cached counts are stale and should be loaded again when needed (UserId is set).
+	Recount bool
 
 	// Optional push notification
 	PushRcpt *push.Receipt
 }
 
 type userCacheEntry struct {
-	unread int
-	topics int
+	unread   int
+	mentions int
+	topics   int
 }
 
 var usersCache map[types.Uid]userCacheEntry
@@ -699,12 +883,32 @@ func usersShutdown() {
 	}
 }
 
-func usersUpdateUnread(uid types.Uid, val int, inc bool) {
-	if globals.usersUpdate == nil || (val == 0 && inc) {
+// usersUpdateUnread updates cached counts of unread messages and unread mentions of the user.
+func usersUpdateUnread(uid types.Uid, val, mentions int, inc bool) {
+	if globals.usersUpdate == nil || (val == 0 && mentions == 0 && inc) {
 		return
 	}
 
-	upd := &UserCacheReq{UserId: uid, Unread: val, Inc: inc}
+	upd := &UserCacheReq{UserId: uid, Unread: val, Mentions: mentions, Inc: inc}
+	if globals.cluster.isRemoteTopic(uid.UserId()) {
+		// Send request to remote node which owns the user.
+		globals.cluster.routeUserReq(upd)
+	} else {
+		select {
+		case globals.usersUpdate <- upd:
+		default:
+		}
+	}
+}
+
+// usersRecountUnread discards cached counts of unread messages and mentions of the user. They are
+// loaded from the database when needed next time.
+func usersRecountUnread(uid types.Uid) {
+	if globals.usersUpdate == nil {
+		return
+	}
+
+	upd := &UserCacheReq{UserId: uid, Recount: true}
 	if globals.cluster.isRemoteTopic(uid.UserId()) {
 		// Send request to remote node which owns the user.
 		globals.cluster.routeUserReq(upd)
@@ -855,29 +1059,38 @@ func usersRequestFromCluster(req *UserCacheReq) {
 
 // The go routine for processing updates to users cache.
 func userUpdater() {
-	unreadUpdater := func(uid types.Uid, val int, inc bool) int {
+	unreadUpdater := func(uid types.Uid, val, mentions int, inc bool) (int, int) {
 		uce, ok := usersCache[uid]
 		if !ok {
 			log.Println("ERROR: attempt to update unread count for user who has not been loaded")
-			return -1
+			return -1, -1
 		}
 
 		if uce.unread < 0 {
 			count, err := store.Users.GetUnreadCount(uid)
 			if err != nil {
 				log.Println("users: failed to load unread count", err)
-				return -1
+				return -1, -1
+			}
+			mcount, err := store.Mentions.Count(uid)
+			if err != nil {
+				log.Println("users: failed to load count of mentions", err)
+				return -1, -1
 			}
-			uce.unread = count
+			uce.unread, uce.mentions = count, mcount
 		} else if inc {
 			uce.unread += val
+			uce.mentions += mentions
+			if uce.mentions < 0 {
+				uce.mentions = 0
+			}
 		} else {
-			uce.unread = val
+			uce.unread, uce.mentions = val, mentions
 		}
 
 		usersCache[uid] = uce
 
-		return uce.unread
+		return uce.unread, uce.mentions
 	}
 
 	for upd := range globals.usersUpdate {
@@ -896,15 +1109,37 @@ func userUpdater() {
 
 		// Request to send push notifications.
 		if upd.PushRcpt != nil {
+			var hideFrom string
+			if upd.PushRcpt.Payload.What == push.ActMsg && types.GetTopicCat(upd.PushRcpt.Payload.Topic) == types.TopicCatGrp {
+				// Messages of blocked users in group topics may be hidden.
+				hideFrom = upd.PushRcpt.Payload.From
+			}
 			for uid, rcptTo := range upd.PushRcpt.To {
+				if hideFrom != "" && blockListHides(uid, hideFrom, true) {
+					delete(upd.PushRcpt.To, uid)
+					continue
+				}
 				// Handle update
-				unread := unreadUpdater(uid, 1, true)
+				var mention int
+				if upd.PushRcpt.Payload.Mention {
+					mention = 1
+				}
+				unread, mentions := unreadUpdater(uid, 1, mention, true)
 				if unread >= 0 {
 					rcptTo.Unread = unread
+					if upd.PushRcpt.Payload.Mention {
+						rcptTo.Mentions = mentions
+					}
 					upd.PushRcpt.To[uid] = rcptTo
 				}
+				if rcptTo.Suppressed {
+					// The unread count is updated, but the user needs no notification.
+					delete(upd.PushRcpt.To, uid)
+				}
+			}
+			if len(upd.PushRcpt.To) > 0 || upd.PushRcpt.Channel != "" {
+				push.Push(upd.PushRcpt)
 			}
-			push.Push(upd.PushRcpt)
 			continue
 		}
 
@@ -942,8 +1177,17 @@ func userUpdater() {
 			continue
 		}
 
+		if upd.Recount {
+			// Users who are not cached have no counts to discard.
+			if uce, ok := usersCache[upd.UserId]; ok {
+				uce.unread = -1
+				usersCache[upd.UserId] = uce
+			}
+			continue
+		}
+
 		// Request to update unread count.
-		unreadUpdater(upd.UserId, upd.Unread, upd.Inc)
+		unreadUpdater(upd.UserId, upd.Unread, upd.Mentions, upd.Inc)
 	}
 
 	log.Println("users: shutdown")
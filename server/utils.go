@@ -20,6 +20,7 @@ import (
 	"unicode/utf8"
 
 	"github.com/tinode/chat/server/auth"
+	"github.com/tinode/chat/server/journal"
 	"github.com/tinode/chat/server/store"
 	"github.com/tinode/chat/server/store/types"
 
@@ -37,6 +38,17 @@ var tagRegexp = regexp.MustCompile(`^[-_+.!?#@\pL\pN]{1,96}$`)
 
 const nullValue = "\u2421"
 
+// journalWrite adds an entry to the compliance journal. Entries which could not be journaled
+// are logged and counted. Returns false if the entry was not journaled.
+func journalWrite(entry *journal.Entry) bool {
+	if err := journal.Write(entry); err != nil {
+		log.Println("journal: entry not journaled", entry.What, entry.Topic, entry.SeqId, err)
+		statsInc("JournalFailedTotal", 1)
+		return false
+	}
+	return true
+}
+
 // Convert a list of IDs into ranges
 func delrangeDeserialize(in []types.Range) []MsgDelRange {
 	if len(in) == 0 {
@@ -61,8 +73,8 @@ func normalizeTags(src []string) types.StringSlice {
 	// Make sure the number of tags does not exceed the maximum.
 	// Technically it may result in fewer tags than the maximum due to empty tags and
 	// duplicates, but that's user's fault.
-	if len(src) > globals.maxTagCount {
-		src = src[:globals.maxTagCount]
+	if maxTagCount := liveConfig().maxTagCount; len(src) > maxTagCount {
+		src = src[:maxTagCount]
 	}
 
 	// Trim whitespace and force to lowercase.
@@ -214,6 +226,8 @@ func msgOpts2storeOpts(req *MsgGetOpts) *types.QueryOpt {
 			LastCreatedAt:   req.LastCreatedAt,
 			Since:           req.SinceId,
 			Before:          req.BeforeId,
+			Thread:          req.Thread,
+			MediaType:       req.Type,
 		}
 	}
 	return opts
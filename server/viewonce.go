@@ -0,0 +1,204 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *    View-once attachments: files attached to a message with the 'viewOnce'
+ *    head are served to each recipient only once. After the first retrieval
+ *    the message is soft-deleted for the recipient.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+const (
+	// Number of attempts to revoke a view-once message when the topic is busy or its node is not available.
+	viewOnceRevokeAttempts = 10
+	// Time to wait for the topic before trying again.
+	viewOnceRevokeDelay = time.Second
+)
+
+// Returned when the recipient requests a view-once attachment for the second time.
+var errViewOnceRetrieved = errors.New("view-once attachment already retrieved")
+
+// viewOnceParse checks the 'viewOnce' head of the message and finds IDs of the attached files.
+// Returns nil if the message is not view-once, false if the head is invalid or the message
+// has no attachments.
+func viewOnceParse(head map[string]interface{}) ([]string, bool) {
+	val, ok := head["viewOnce"]
+	if !ok {
+		return nil, true
+	}
+	if viewOnce, ok := val.(bool); !ok || !viewOnce {
+		return nil, ok
+	}
+
+	var fids []string
+	urls, _ := head["attachments"].([]interface{})
+	for _, val := range urls {
+		if url, ok := val.(string); ok {
+			if fid := store.GetMediaHandler().GetIdFromUrl(url); !fid.IsZero() {
+				fids = append(fids, fid.String())
+			}
+		}
+	}
+	return fids, len(fids) > 0
+}
+
+// viewOnceCreate marks the files attached to a just published message as view-once.
+func (t *Topic) viewOnceCreate(from types.Uid, seq int, fids []string) {
+	if err := store.ViewOnce.Create(t.name, seq, from, fids); err != nil {
+		log.Printf("topic[%s]: failed to mark attachments as view-once: %v", t.name, err)
+	}
+}
+
+// viewOnceGet returns the view-once mark of the requested file if the file must be served
+// to the user only once, nil otherwise. The user must have read access to the topic.
+func viewOnceGet(fid types.Uid, uid types.Uid) (*types.ViewOnce, error) {
+	if fid.IsZero() {
+		return nil, nil
+	}
+	vo, err := store.ViewOnce.Get(fid)
+	if err != nil || vo == nil {
+		return nil, err
+	}
+	if vo.From == uid.String() {
+		// The sender can always retrieve own attachments.
+		return nil, nil
+	}
+	if _, _, err = permalinkAccess(vo.Topic, uid); err != nil {
+		return nil, err
+	}
+	return vo, nil
+}
+
+// viewOnceRetrieve records the retrieval of the view-once file by the user and revokes the message.
+// Returns errViewOnceRetrieved if the user has retrieved the file before.
+func viewOnceRetrieve(vo *types.ViewOnce, uid types.Uid) error {
+	if vo == nil {
+		return nil
+	}
+	first, err := store.ViewOnce.View(vo, uid)
+	if err != nil {
+		return err
+	}
+	if !first {
+		return errViewOnceRetrieved
+	}
+	go viewOnceRevoke(vo, uid)
+	return nil
+}
+
+// viewOnceError converts an error of view-once retrieval into a response.
+func viewOnceError(err error, ts time.Time) *ServerComMessage {
+	if err == errViewOnceRetrieved {
+		return ErrGone("", "", ts)
+	}
+	return decodeStoreError(err, "", "", ts, nil)
+}
+
+// viewOnceRevoke soft-deletes the message with the view-once attachment for the user. Messages of
+// topics hosted by other nodes are revoked by the node which hosts the topic.
+func viewOnceRevoke(vo *types.ViewOnce, uid types.Uid) {
+	for attempt := 0; attempt < viewOnceRevokeAttempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(viewOnceRevokeDelay)
+		}
+
+		if globals.cluster.isRemoteTopic(vo.Topic) {
+			if err := viewOnceRevokeRemote(vo, uid); err != nil {
+				log.Println("view-once: failed to forward revocation", vo.Topic, vo.SeqId, uid.UserId(), err)
+				continue
+			}
+			return
+		}
+
+		err := globals.hub.runTopicTask(vo.Topic,
+			func(t *Topic) error {
+				// The topic is loaded: delete through the topic to notify the user's sessions.
+				return t.replyDelMsg(nil, uid, false, &ClientComMessage{
+					Del: &MsgClientDel{
+						Topic:  vo.Topic,
+						What:   "msg",
+						DelSeq: []MsgDelRange{{LowId: vo.SeqId}},
+					},
+					Original:  vo.Topic,
+					RcptTo:    vo.Topic,
+					AsUser:    uid.UserId(),
+					MetaWhat:  constMsgDelMsg,
+					Timestamp: types.TimeNow(),
+				})
+			},
+			func() error {
+				// The topic is kept from loading, so the next delete ID is not taken concurrently.
+				stopic, err := store.Topics.Get(vo.Topic)
+				if err != nil {
+					return err
+				}
+				if stopic == nil {
+					return types.ErrTopicNotFound
+				}
+				return store.Messages.DeleteList(vo.Topic, stopic.DelId+1, uid, []types.Range{{Low: vo.SeqId}})
+			})
+		if err == errTopicBusy {
+			continue
+		}
+		if err != nil {
+			log.Println("view-once: failed to revoke message", vo.Topic, vo.SeqId, uid.UserId(), err)
+		}
+		return
+	}
+
+	log.Println("view-once: topic is not available, message not revoked", vo.Topic, vo.SeqId, uid.UserId())
+}
+
+// ClusterViewOnce is a request to revoke a view-once message sent to the node which hosts the topic.
+type ClusterViewOnce struct {
+	// Name of the node sending this request.
+	Node string
+	// Name of the topic as stored.
+	Topic string
+	SeqId int
+	// User who retrieved the attachment.
+	UserId types.Uid
+}
+
+// viewOnceRevokeRemote forwards the revocation to the node which hosts the topic.
+func viewOnceRevokeRemote(vo *types.ViewOnce, uid types.Uid) error {
+	n := globals.cluster.nodeForTopic(vo.Topic)
+	if n == nil {
+		return errors.New("node for topic not found")
+	}
+	var rejected bool
+	err := n.call("Cluster.ViewOnceRevoke", &ClusterViewOnce{
+		Node:   globals.cluster.thisNodeName,
+		Topic:  vo.Topic,
+		SeqId:  vo.SeqId,
+		UserId: uid,
+	}, &rejected)
+	if err == nil && rejected {
+		err = errors.New("revocation rejected by " + n.name)
+	}
+	return err
+}
+
+// ViewOnceRevoke is a gRPC endpoint which receives revocations of view-once messages of topics hosted by this node.
+func (c *Cluster) ViewOnceRevoke(msg *ClusterViewOnce, rejected *bool) error {
+	if c.isRemoteTopic(msg.Topic) {
+		// The ring has changed: the sender retries with the new node.
+		log.Println("cluster ViewOnceRevoke: topic is hosted by another node", msg.Topic, msg.Node)
+		*rejected = true
+		return nil
+	}
+	*rejected = false
+	go viewOnceRevoke(&types.ViewOnce{Topic: msg.Topic, SeqId: msg.SeqId}, msg.UserId)
+	return nil
+}
@@ -0,0 +1,302 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *    Per-topic membership webhooks: delivery of signed events with retries.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+// Membership events reported by webhooks.
+const (
+	hookEventJoin  = "join"
+	hookEventLeave = "leave"
+	hookEventBan   = "ban"
+	hookEventRole  = "role"
+	// The channel became full or has free slots again.
+	hookEventCapacity = "capacity"
+)
+
+const (
+	// Number of events waiting for delivery before new events are dropped.
+	hookQueueSize = 1024
+	// Number of concurrent deliveries.
+	hookWorkers = 4
+	// Timeout of a single delivery attempt.
+	hookTimeout = 10 * time.Second
+	// Number of delivery attempts before the event is dropped.
+	hookMaxAttempts = 6
+	// Delay before the first retry, doubled after each failed attempt.
+	hookRetryDelay = 2 * time.Second
+	// Maximum length of the webhook URL.
+	hookMaxUrlLength = 1024
+)
+
+// hookEvent is the body of a webhook request.
+type hookEvent struct {
+	// Unique ID of the event. Retries of the same event have the same ID.
+	Id string `json:"id"`
+	// Event type: join, leave, ban, role, capacity.
+	Event string `json:"event"`
+	// Name of the topic.
+	Topic string `json:"topic"`
+	// User affected by the event. Missing for 'capacity'.
+	User string `json:"user,omitempty"`
+	// User who caused the event.
+	Actor string `json:"actor,omitempty"`
+	// Access mode of the user after the event: want, given, and effective. Missing for 'leave'.
+	Want  string `json:"want,omitempty"`
+	Given string `json:"given,omitempty"`
+	Mode  string `json:"mode,omitempty"`
+	// State of the channel for 'capacity': "full" or "open", the number of attached and waiting readers.
+	State   string `json:"state,omitempty"`
+	Readers int    `json:"readers,omitempty"`
+	Queued  int    `json:"queued,omitempty"`
+	// Time of the event.
+	Timestamp time.Time `json:"ts"`
+}
+
+// hookDelivery is a pending delivery of an event.
+type hookDelivery struct {
+	url     string
+	secret  string
+	event   string
+	id      string
+	body    []byte
+	attempt int
+}
+
+var hookQueue chan *hookDelivery
+
+// Client which refuses to connect to loopback, private and link-local addresses:
+// webhook URLs are supplied by topic owners and must not reach internal services.
+var hookClient = &http.Client{
+	Timeout: hookTimeout,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: hookTimeout,
+			Control: hookDialControl,
+		}).DialContext,
+		MaxIdleConnsPerHost: 2,
+		IdleConnTimeout:     90 * time.Second,
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		// Redirects are not followed: the receiver must respond at the registered URL.
+		return http.ErrUseLastResponse
+	},
+}
+
+var hookForbiddenNets []*net.IPNet
+
+func init() {
+	for _, cidr := range []string{
+		"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16",
+		"172.16.0.0/12", "192.168.0.0/16", "::1/128", "fc00::/7", "fe80::/10",
+	} {
+		_, ipnet, _ := net.ParseCIDR(cidr)
+		hookForbiddenNets = append(hookForbiddenNets, ipnet)
+	}
+}
+
+func hookDialControl(network, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return errors.New("webhook: invalid address " + host)
+	}
+	for _, ipnet := range hookForbiddenNets {
+		if ipnet.Contains(ip) {
+			return errors.New("webhook: forbidden address " + host)
+		}
+	}
+	return nil
+}
+
+// hookStart starts webhook delivery workers.
+func hookStart() {
+	hookQueue = make(chan *hookDelivery, hookQueueSize)
+	for i := 0; i < hookWorkers; i++ {
+		go func() {
+			for dlv := range hookQueue {
+				hookDeliver(dlv)
+			}
+		}()
+	}
+}
+
+// hookEnqueue schedules the delivery of the event. Does not block.
+func hookEnqueue(dlv *hookDelivery) {
+	select {
+	case hookQueue <- dlv:
+	default:
+		log.Println("webhook: queue full, event dropped", dlv.event, dlv.id)
+	}
+}
+
+// hookFire sends the event to the webhook.
+func hookFire(hook *types.TopicWebhook, evt *hookEvent) {
+	if hookQueue == nil || !hook.Wants(evt.Event) {
+		return
+	}
+
+	evt.Id = store.GetUidString()
+	body, err := json.Marshal(evt)
+	if err != nil {
+		log.Println("webhook: failed to serialize event", evt.Topic, err)
+		return
+	}
+
+	hookEnqueue(&hookDelivery{
+		url:    hook.Url,
+		secret: hook.Secret,
+		event:  evt.Event,
+		id:     evt.Id,
+		body:   body,
+	})
+}
+
+// hookSignature computes the value of X-Tinode-Signature header: hex-encoded HMAC-SHA256 of the body.
+func hookSignature(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// hookDeliver makes one delivery attempt and schedules a retry on failure.
+func hookDeliver(dlv *hookDelivery) {
+	dlv.attempt++
+
+	ctx, cancel := context.WithTimeout(context.Background(), hookTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, dlv.url, bytes.NewReader(dlv.body))
+	if err != nil {
+		log.Println("webhook: invalid request", dlv.url, err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Tinode/"+currentVersion)
+	req.Header.Set("X-Tinode-Event", dlv.event)
+	req.Header.Set("X-Tinode-Delivery", dlv.id)
+	req.Header.Set("X-Tinode-Attempt", strconv.Itoa(dlv.attempt))
+	req.Header.Set("X-Tinode-Signature", hookSignature(dlv.secret, dlv.body))
+
+	resp, err := hookClient.Do(req)
+	if err == nil {
+		resp.Body.Close()
+		if resp.StatusCode < 300 {
+			return
+		}
+		if resp.StatusCode < 500 && resp.StatusCode != http.StatusTooManyRequests &&
+			resp.StatusCode != http.StatusRequestTimeout {
+			// The receiver rejected the event, retrying won't help.
+			log.Println("webhook: event rejected", dlv.url, dlv.id, resp.StatusCode)
+			return
+		}
+		err = errors.New(resp.Status)
+	}
+
+	if dlv.attempt >= hookMaxAttempts {
+		log.Println("webhook: delivery failed, event dropped", dlv.url, dlv.id, err)
+		return
+	}
+
+	time.AfterFunc(hookRetryDelay<<uint(dlv.attempt-1), func() {
+		hookEnqueue(dlv)
+	})
+}
+
+// hookFromMsg validates the webhook sent by the client and converts it to the stored format.
+// Returns the generated secret if the client has not provided one.
+func hookFromMsg(src *MsgTopicHook) (*types.TopicWebhook, string, error) {
+	if src.Url == "" {
+		// Remove the webhook.
+		return &types.TopicWebhook{}, "", nil
+	}
+
+	if len(src.Url) > hookMaxUrlLength {
+		return nil, "", types.ErrPolicy
+	}
+	u, err := url.Parse(src.Url)
+	if err != nil || !u.IsAbs() || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" || u.User != nil {
+		return nil, "", types.ErrMalformed
+	}
+
+	var events types.StringSlice
+	seen := make(map[string]bool, len(src.Events))
+	for _, event := range src.Events {
+		switch event {
+		case hookEventJoin, hookEventLeave, hookEventBan, hookEventRole, hookEventCapacity:
+		default:
+			return nil, "", types.ErrMalformed
+		}
+		if !seen[event] {
+			seen[event] = true
+			events = append(events, event)
+		}
+	}
+
+	var generated string
+	secret := src.Secret
+	if secret == "" {
+		buf := make([]byte, 24)
+		if _, err := rand.Read(buf); err != nil {
+			return nil, "", err
+		}
+		secret = hex.EncodeToString(buf)
+		generated = secret
+	} else if len(secret) < 16 || len(secret) > 256 {
+		return nil, "", types.ErrPolicy
+	}
+
+	return &types.TopicWebhook{Url: u.String(), Secret: secret, Events: events}, generated, nil
+}
+
+// hookMemberEvent classifies the change of access mode as a membership event.
+// Returns an empty string if the change is not reported.
+func hookMemberEvent(oldWant, oldGiven, newWant, newGiven types.AccessMode) string {
+	if newWant == types.ModeUnset || newGiven == types.ModeUnset {
+		return hookEventLeave
+	}
+
+	oldJoined := oldWant.IsDefined() && oldGiven.IsDefined() && (oldWant & oldGiven).IsJoiner()
+	newJoined := (newWant & newGiven).IsJoiner()
+	switch {
+	case !oldJoined && newJoined:
+		return hookEventJoin
+	case oldJoined && !newJoined:
+		if !newGiven.IsJoiner() {
+			return hookEventBan
+		}
+		// The user has banned the topic.
+		return hookEventLeave
+	case oldJoined && oldWant&oldGiven != newWant&newGiven:
+		return hookEventRole
+	}
+	return ""
+}